@@ -0,0 +1,336 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-signal/pkg/signalbackup"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+)
+
+var cmdImportBackup = &commands.FullHandler{
+	Func: wrapCommand(fnImportBackup),
+	Name: "import-backup",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Import message history from a Signal Android backup. Reply to an uploaded `.backup` file with the command, or give a path on the bridge server (admins only).",
+		Args:        "[_path_] <_passphrase_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnImportBackup(ce *WrappedCommandEvent) {
+	var path string
+	args := ce.Args
+	if ce.ReplyTo == "" {
+		if !ce.User.Admin {
+			ce.Reply("**Usage:** reply to a `.backup` file with `import-backup <passphrase>`")
+			return
+		} else if len(args) < 2 {
+			ce.Reply("**Usage:** `import-backup <path> <passphrase>`, or reply to a `.backup` file with `import-backup <passphrase>`")
+			return
+		}
+		path = args[0]
+		args = args[1:]
+	} else if len(args) == 0 {
+		ce.Reply("**Usage:** reply to a `.backup` file with `import-backup <passphrase>`")
+		return
+	}
+	passphrase, err := signalbackup.NormalizePassphrase(strings.Join(args, ""))
+	// The passphrase can decrypt the whole backup, so don't leave it in the room
+	ce.Redact()
+	if err != nil {
+		ce.Reply("Invalid passphrase: the passphrase should be the 30 digits shown when backups were enabled in Signal")
+		return
+	}
+
+	ctx := ce.ZLog.WithContext(context.TODO())
+	var reader io.ReadCloser
+	if path != "" {
+		reader, err = os.Open(path)
+	} else {
+		reader, err = openBackupFromEvent(ctx, ce)
+	}
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to open backup file")
+		ce.Reply("Failed to open backup file: %v", err)
+		return
+	}
+	ce.Reply("Decrypting backup, this may take a while...")
+	backup, err := signalbackup.Open(ctx, reader, passphrase, "")
+	_ = reader.Close()
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to decrypt backup")
+		ce.Reply("Failed to decrypt backup: %v", err)
+		return
+	}
+	defer backup.Close()
+
+	threads, messages, err := importBackup(ctx, ce.User, backup)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to import backup")
+		ce.Reply("Failed to import backup: %v", err)
+		return
+	}
+	ce.Reply("Imported %d messages from %d chats", messages, threads)
+}
+
+// openBackupFromEvent downloads the file in the event that the command is replying to.
+func openBackupFromEvent(ctx context.Context, ce *WrappedCommandEvent) (io.ReadCloser, error) {
+	evt, err := ce.Bot.GetEvent(ce.RoomID, ce.ReplyTo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get replied-to event: %w", err)
+	}
+	if evt.Type == event.EventEncrypted && ce.Bridge.Crypto != nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+		evt, err = ce.Bridge.Crypto.Decrypt(evt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt replied-to event: %w", err)
+		}
+	} else if err = evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return nil, fmt.Errorf("failed to parse replied-to event: %w", err)
+	}
+	content := evt.Content.AsMessage()
+	if content.MsgType != event.MsgFile {
+		return nil, errors.New("replied-to event isn't a file")
+	}
+	mxc := content.URL
+	if content.File != nil {
+		mxc = content.File.URL
+		if err = content.File.PrepareForDecryption(); err != nil {
+			return nil, err
+		}
+	}
+	parsedMXC, err := mxc.Parse()
+	if err != nil {
+		return nil, err
+	}
+	body, err := ce.Bot.DownloadContext(ctx, parsedMXC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	if content.File != nil {
+		// The hash is only checked when closing, but the backup frames have their own MACs anyway
+		return &decryptedDownload{ReadCloser: content.File.DecryptStream(body), body: body}, nil
+	}
+	return body, nil
+}
+
+type decryptedDownload struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (dd *decryptedDownload) Close() error {
+	_ = dd.body.Close()
+	return dd.ReadCloser.Close()
+}
+
+// importBackup sends the messages in the backup to the corresponding portals.
+// Portals handle them like any other incoming message, so already bridged messages are skipped
+// and the rest are sent with their original timestamps.
+func importBackup(ctx context.Context, user *User, backup *signalbackup.Backup) (threadCount, messageCount int, err error) {
+	recipients, err := backup.Recipients(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get recipients: %w", err)
+	}
+	threads, err := backup.Threads(ctx, recipients)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get chats: %w", err)
+	}
+	for _, thread := range threads {
+		log := user.log.With().Int64("backup_thread_id", thread.ID).Logger()
+		portal := getBackupThreadPortal(user, thread)
+		if portal == nil {
+			continue
+		}
+		messages, err := backup.Messages(ctx, thread.ID, recipients)
+		if err != nil {
+			return threadCount, messageCount, fmt.Errorf("failed to get messages of chat %d: %w", thread.ID, err)
+		} else if len(messages) == 0 {
+			continue
+		}
+		if portal.MXID == "" {
+			err = portal.CreateMatrixRoom(user, nil)
+			if err != nil {
+				log.Err(err).Msg("Failed to create portal room for backup import")
+				continue
+			}
+		}
+		log.Info().Int("message_count", len(messages)).Stringer("portal_mxid", portal.MXID).Msg("Importing messages from backup")
+		var queue []portalSignalMessage
+		for _, msg := range messages {
+			queue = append(queue, convertBackupMessage(ctx, user, portal, thread, msg)...)
+		}
+		if len(queue) == 0 {
+			continue
+		}
+		// Wait for the portal to handle everything, as the attachment files are deleted when the backup is closed
+		done := make(chan struct{})
+		queue[len(queue)-1].done = done
+		for _, portalMessage := range queue {
+			portal.signalMessages <- portalMessage
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return threadCount, messageCount, ctx.Err()
+		}
+		threadCount++
+		messageCount += len(messages)
+	}
+	return threadCount, messageCount, nil
+}
+
+func getBackupThreadPortal(user *User, thread *signalbackup.Thread) *Portal {
+	if thread.Recipient.GroupID != "" {
+		return user.GetPortalByChatID(thread.Recipient.GroupID)
+	} else if thread.Recipient.ACI != uuid.Nil && thread.Recipient.ACI != user.SignalID {
+		return user.GetPortalByChatID(thread.Recipient.ACI.String())
+	}
+	// Note to self and groups that were never migrated to v2 aren't bridged
+	return nil
+}
+
+// convertBackupMessage converts a message from the backup into the same parts signalmeow would
+// produce for an incoming message, followed by the reactions to it.
+func convertBackupMessage(ctx context.Context, user *User, portal *Portal, thread *signalbackup.Thread, msg *signalbackup.Message) []portalSignalMessage {
+	senderID := user.SignalID
+	if !msg.Outgoing {
+		senderID = msg.Sender.ACI
+	}
+	sender := getBackupMessageSender(user, senderID)
+	if sender == nil {
+		return nil
+	}
+	base := IncomingSignalMessageBase{
+		SenderUUID: senderID.String(),
+		Timestamp:  msg.DateSent,
+	}
+	if thread.Recipient.GroupID != "" {
+		groupID := signalmeow.GroupIdentifier(thread.Recipient.GroupID)
+		base.GroupID = &groupID
+	} else if msg.Outgoing {
+		base.RecipientUUID = thread.Recipient.ACI.String()
+	} else {
+		base.RecipientUUID = user.SignalID.String()
+	}
+	if msg.QuoteTimestamp != 0 && msg.QuoteAuthor != nil && msg.QuoteAuthor.ACI != uuid.Nil {
+		base.Quote = &IncomingSignalMessageQuoteData{
+			QuotedTimestamp: msg.QuoteTimestamp,
+			QuotedSender:    msg.QuoteAuthor.ACI.String(),
+		}
+	}
+
+	var parts []IncomingSignalMessage
+	var queue []portalSignalMessage
+	var attachments []*signalbackup.Attachment
+	for _, att := range msg.Attachments {
+		// Attachments that weren't downloaded on the phone aren't included in backups
+		if att.Path != "" {
+			attachments = append(attachments, att)
+		}
+	}
+	captionInMessage := user.bridge.Config.Bridge.CaptionInMessage
+	captionSent := false
+	for index, att := range attachments {
+		part := IncomingSignalMessageAttachment{
+			IncomingSignalMessageBase: base,
+			Attachment:                signalmeow.NewLocalIncomingAttachment(att.Path, uint32(att.Size)),
+			Filename:                  att.FileName,
+			ContentType:               att.ContentType,
+			Size:                      uint64(att.Size),
+			Width:                     uint32(att.Width),
+			Height:                    uint32(att.Height),
+			Caption:                   att.Caption,
+			AlbumIndex:                index,
+			AlbumSize:                 len(attachments),
+		}
+		part.PartIndex = len(parts)
+		if captionInMessage && !captionSent && msg.Body != "" {
+			part.Caption = msg.Body
+			captionSent = true
+		}
+		parts = append(parts, part)
+	}
+	if msg.Body != "" && !captionSent {
+		part := IncomingSignalMessageText{
+			IncomingSignalMessageBase: base,
+			Content:                   msg.Body,
+		}
+		part.PartIndex = len(parts)
+		parts = append(parts, part)
+	}
+	for _, part := range parts {
+		queue = append(queue, portalSignalMessage{
+			user:    user,
+			sender:  sender,
+			message: part,
+			sync:    msg.Outgoing,
+		})
+	}
+	// Reactions come after their target message, so the portal will find it in the database
+	for _, reaction := range msg.Reactions {
+		if reaction.Author.ACI == uuid.Nil {
+			continue
+		}
+		existing, err := portal.bridge.DB.Reaction.GetBySignalID(ctx, senderID, msg.DateSent, reaction.Author.ACI, portal.Receiver)
+		if err != nil || existing != nil {
+			// Don't replace reactions that were already bridged
+			continue
+		}
+		reactionSender := getBackupMessageSender(user, reaction.Author.ACI)
+		if reactionSender == nil {
+			continue
+		}
+		reactionBase := base
+		reactionBase.SenderUUID = reaction.Author.ACI.String()
+		reactionBase.Timestamp = reaction.DateSent
+		reactionBase.Quote = nil
+		queue = append(queue, portalSignalMessage{
+			user:   user,
+			sender: reactionSender,
+			message: IncomingSignalMessageReaction{
+				IncomingSignalMessageBase: reactionBase,
+				Emoji:                     reaction.Emoji,
+				TargetAuthorUUID:          senderID.String(),
+				TargetMessageTimestamp:    msg.DateSent,
+			},
+		})
+	}
+	return queue
+}
+
+func getBackupMessageSender(user *User, senderID uuid.UUID) *Puppet {
+	if senderID == user.SignalID {
+		// Same as sync messages, prefer the double puppet for our own messages
+		if puppet := user.bridge.GetPuppetByCustomMXID(user.MXID); puppet != nil {
+			return puppet
+		}
+	}
+	return user.bridge.GetPuppetBySignalID(senderID)
+}
@@ -18,7 +18,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/skip2/go-qrcode"
@@ -51,12 +55,19 @@ func (br *SignalBridge) RegisterCommands() {
 		cmdPing,
 		cmdLogin,
 		cmdSetDeviceName,
+		cmdListDevices,
+		cmdUnlinkDevice,
+		cmdSubmitCaptcha,
+		cmdSync,
 		cmdPM,
 		cmdDeleteSession,
 		cmdSetRelay,
 		cmdUnsetRelay,
 		cmdDeletePortal,
 		cmdDeleteAllPortals,
+		cmdDisappearingTimer,
+		cmdRetryMedia,
+		cmdImportBackup,
 		cmdCleanupLostPortals,
 	)
 }
@@ -128,11 +139,11 @@ var cmdDeleteSession = &commands.FullHandler{
 }
 
 func fnDeleteSession(ce *WrappedCommandEvent) {
-	if !ce.User.SignalDevice.IsDeviceLoggedIn() {
+	if !ce.User.Client.IsDeviceLoggedIn() {
 		ce.Reply("You're not logged in")
 		return
 	}
-	ce.User.SignalDevice.ClearKeysAndDisconnect()
+	ce.User.Client.Device.ClearKeysAndDisconnect()
 	ce.Reply("Disconnected from Signal")
 }
 
@@ -148,9 +159,9 @@ var cmdPing = &commands.FullHandler{
 func fnPing(ce *WrappedCommandEvent) {
 	if ce.User.SignalID == uuid.Nil {
 		ce.Reply("You're not logged in")
-	} else if !ce.User.SignalDevice.IsDeviceLoggedIn() {
+	} else if !ce.User.Client.IsDeviceLoggedIn() {
 		ce.Reply("You were logged in at some point, but are not anymore")
-	} else if !ce.User.SignalDevice.Connection.IsConnected() {
+	} else if !ce.User.Client.Device.Connection.IsConnected() {
 		ce.Reply("You're logged into Signal, but not connected to the server")
 	} else {
 		ce.Reply("You're logged into Signal and probably connected to the server")
@@ -175,7 +186,7 @@ func fnSetDeviceName(ce *WrappedCommandEvent) {
 	}
 
 	name := strings.Join(ce.Args, " ")
-	err := ce.User.SignalDevice.UpdateDeviceName(name)
+	err := ce.User.Client.Device.UpdateDeviceName(name)
 	if err != nil {
 		ce.Reply("Error setting device name: %v", err)
 		return
@@ -183,6 +194,132 @@ func fnSetDeviceName(ce *WrappedCommandEvent) {
 	ce.Reply("Device name updated")
 }
 
+var cmdListDevices = &commands.FullHandler{
+	Func: wrapCommand(fnListDevices),
+	Name: "list-devices",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "List the devices linked to your Signal account",
+	},
+	RequiresLogin: true,
+}
+
+func fnListDevices(ce *WrappedCommandEvent) {
+	devices, err := ce.User.Client.Device.ListDevices(context.TODO())
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to list devices")
+		ce.Reply("Error listing devices: %v", err)
+		return
+	}
+	lines := make([]string, len(devices))
+	for i, device := range devices {
+		name := device.Name
+		if name == "" {
+			name = "unnamed device"
+		}
+		var tags []string
+		if device.ID == signalmeow.PrimaryDeviceID {
+			tags = append(tags, "primary")
+		}
+		if device.ID == ce.User.Client.Device.Data.DeviceId {
+			tags = append(tags, "this bridge")
+		}
+		if len(tags) > 0 {
+			name = fmt.Sprintf("%s (%s)", name, strings.Join(tags, ", "))
+		}
+		lines[i] = fmt.Sprintf(
+			"* %d: %s - linked %s, last seen %s",
+			device.ID, name, device.Created.Format("2006-01-02"), device.LastSeen.Format("2006-01-02"),
+		)
+	}
+	ce.Reply("Devices linked to your Signal account:\n\n%s", strings.Join(lines, "\n"))
+}
+
+var cmdUnlinkDevice = &commands.FullHandler{
+	Func: wrapCommand(fnUnlinkDevice),
+	Name: "unlink-device",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Unlink another device from your Signal account",
+		Args:        "<_device ID_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnUnlinkDevice(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `unlink-device <device ID>` (see `list-devices` for the IDs)")
+		return
+	}
+	deviceID, err := strconv.Atoi(ce.Args[0])
+	if err != nil {
+		ce.Reply("Invalid device ID %q", ce.Args[0])
+		return
+	} else if deviceID == signalmeow.PrimaryDeviceID {
+		ce.Reply("The primary device can't be unlinked")
+		return
+	}
+	err = ce.User.Client.Device.UnlinkDevice(context.TODO(), deviceID)
+	if errors.Is(err, signalmeow.ErrCantUnlinkOwnDevice) || errors.Is(err, signalmeow.ErrNotPrimaryDevice) {
+		ce.Reply("Can't unlink device %d: %v", deviceID, err)
+	} else if err != nil {
+		ce.ZLog.Err(err).Int("device_id", deviceID).Msg("Failed to unlink device")
+		ce.Reply("Error unlinking device: %v", err)
+	} else {
+		ce.Reply("Device %d unlinked", deviceID)
+	}
+}
+
+var cmdSubmitCaptcha = &commands.FullHandler{
+	Func: wrapCommand(fnSubmitCaptcha),
+	Name: "submit-captcha",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Submit a captcha token to resume sending messages after Signal asked for one",
+		Args:        "<_signalcaptcha:// link_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnSubmitCaptcha(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `submit-captcha <token>` (get the token from %s)", signalmeow.CaptchaURL)
+		return
+	}
+	err := ce.User.Client.SubmitCaptcha(context.TODO(), ce.Args[0])
+	if errors.Is(err, signalmeow.ErrNoPendingChallenge) {
+		ce.Reply("Signal hasn't asked for a captcha")
+	} else if errors.Is(err, signalmeow.ErrCaptchaRejected) {
+		ce.Reply("Signal rejected the captcha, please solve a new one at %s and try again", signalmeow.CaptchaURL)
+	} else if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to submit captcha")
+		ce.Reply("Error submitting captcha: %v", err)
+	} else {
+		ce.Reply("Captcha accepted, sending queued messages")
+		go ce.Bridge.WakeOutboxes(context.TODO(), true)
+	}
+}
+
+var cmdSync = &commands.FullHandler{
+	Func: wrapCommand(fnSync),
+	Name: "sync",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Request contacts, blocked users, settings and keys from your primary Signal device",
+	},
+	RequiresLogin: true,
+}
+
+func fnSync(ce *WrappedCommandEvent) {
+	err := ce.User.Client.SendFullSyncRequest(context.TODO())
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to send sync request")
+		ce.Reply("Error sending sync request: %v", err)
+		return
+	}
+	ce.Reply("Sync requested, your primary device should send the data shortly")
+}
+
 var cmdPM = &commands.FullHandler{
 	Func: wrapCommand(fnPM),
 	Name: "pm",
@@ -202,7 +339,7 @@ func fnPM(ce *WrappedCommandEvent) {
 
 	user := ce.User
 	number := strings.Join(ce.Args, "")
-	contact, err := user.SignalDevice.ContactByE164(number)
+	contact, err := user.Client.Device.ContactByE164(number)
 	if err != nil {
 		ce.Reply("Error looking up number in local contact list: %v", err)
 		return
@@ -415,6 +552,97 @@ func fnDeletePortal(ce *WrappedCommandEvent) {
 	ce.Portal.Cleanup(false)
 }
 
+var cmdDisappearingTimer = &commands.FullHandler{
+	Func: wrapCommand(fnDisappearingTimer),
+	Name: "disappearing-timer",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Set the disappearing message timer in this chat, e.g. `30s`, `1h`, `1d`, `1w` or `off`.",
+		Args:        "<_duration_|off>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func parseDisappearingTimer(input string) (time.Duration, error) {
+	input = strings.ToLower(strings.TrimSpace(input))
+	if input == "off" || input == "0" {
+		return 0, nil
+	}
+	// time.ParseDuration doesn't know about days or weeks
+	multipliers := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, multiplier := range multipliers {
+		if count, err := strconv.Atoi(strings.TrimSuffix(input, suffix)); err == nil && strings.HasSuffix(input, suffix) {
+			return time.Duration(count) * multiplier, nil
+		}
+	}
+	return time.ParseDuration(input)
+}
+
+func fnDisappearingTimer(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `disappearing-timer <duration|off>`")
+		return
+	}
+	duration, err := parseDisappearingTimer(ce.Args[0])
+	if err != nil || duration < 0 {
+		ce.Reply("Invalid duration. Use e.g. `30s`, `5m`, `1h`, `1d`, `1w` or `off`")
+		return
+	} else if duration > 0 && duration < time.Second {
+		ce.Reply("The timer must be at least one second")
+		return
+	}
+	newTimer := uint32(duration / time.Second)
+	err = ce.Portal.SetDisappearingTimer(context.TODO(), ce.User, newTimer)
+	if errors.Is(err, signalmeow.ErrGroupChangeForbidden) {
+		ce.Reply("You're not allowed to change the disappearing message timer in this group")
+	} else if errors.Is(err, signalmeow.ErrGroupChangeNotSent) {
+		ce.Reply("The disappearing message timer was changed, but other members may only see it later: %v", err)
+		ce.Portal.HandleNewDisappearingMessageTime(newTimer)
+	} else if err != nil {
+		ce.Reply("Failed to change disappearing message timer: %v", err)
+	} else {
+		ce.Portal.HandleNewDisappearingMessageTime(newTimer)
+	}
+}
+
+var cmdRetryMedia = &commands.FullHandler{
+	Func: wrapCommand(fnRetryMedia),
+	Name: "retry-media",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Retry downloading attachments that failed to bridge. Reply to a placeholder to only retry that one.",
+	},
+	RequiresPortal: true,
+}
+
+func fnRetryMedia(ce *WrappedCommandEvent) {
+	ctx := ce.ZLog.WithContext(context.TODO())
+	if ce.ReplyTo != "" {
+		failed, err := ce.Bridge.DB.FailedAttachment.GetByMXID(ctx, ce.ReplyTo)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to get failed attachment from database")
+			ce.Reply("Failed to get failed attachment from database")
+		} else if failed == nil || failed.RoomID != ce.Portal.MXID {
+			ce.Reply("That message isn't a failed attachment")
+		} else if err = ce.Bridge.mediaRetryManager.Retry(ctx, failed); err != nil {
+			ce.Reply("Failed to download attachment: %v", err)
+		} else {
+			ce.React("✅")
+		}
+		return
+	}
+	succeeded, failed, err := ce.Bridge.mediaRetryManager.RetryRoom(ctx, ce.Portal.MXID)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to get failed attachments from database")
+		ce.Reply("Failed to get failed attachments from database")
+	} else if succeeded == 0 && failed == 0 {
+		ce.Reply("There are no failed attachments in this room")
+	} else {
+		ce.Reply("Successfully bridged %d attachments, %d still failed", succeeded, failed)
+	}
+}
+
 var cmdDeleteAllPortals = &commands.FullHandler{
 	Func: wrapCommand(fnDeleteAllPortals),
 	Name: "delete-all-portals",
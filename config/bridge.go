@@ -47,8 +47,12 @@ type BridgeConfig struct {
 	SyncDirectChatList  bool `yaml:"sync_direct_chat_list"`
 	ResendBridgeInfo    bool `yaml:"resend_bridge_info"`
 	CaptionInMessage    bool `yaml:"caption_in_message"`
+	CoalesceAlbums      bool `yaml:"coalesce_albums"`
 	FederateRooms       bool `yaml:"federate_rooms"`
 
+	LocationTileURL string `yaml:"location_tile_url"`
+	MaxMediaSizeMB  int64  `yaml:"max_media_size_mb"`
+
 	MessageHandlingTimeout struct {
 		ErrorAfterStr string `yaml:"error_after"`
 		DeadlineStr   string `yaml:"deadline"`
@@ -76,6 +80,11 @@ type BridgeConfig struct {
 	displaynameTemplate *template.Template `yaml:"-"`
 }
 
+// MaxMediaSize returns the maximum size of media to bridge in bytes, or 0 if there's no limit.
+func (bc *BridgeConfig) MaxMediaSize() int64 {
+	return bc.MaxMediaSizeMB * 1024 * 1024
+}
+
 func (bc *BridgeConfig) GetResendBridgeInfo() bool {
 	return bc.ResendBridgeInfo
 }
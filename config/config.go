@@ -19,6 +19,8 @@ package config
 import (
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
 )
 
 type Config struct {
@@ -29,9 +31,7 @@ type Config struct {
 		Listen  string `yaml:"listen"`
 	} `yaml:"metrics"`
 
-	Signal struct {
-		DeviceName string `yaml:"device_name"`
-	} `yaml:"signal"`
+	Signal SignalConfig `yaml:"signal"`
 
 	Bridge BridgeConfig `yaml:"bridge"`
 }
@@ -42,3 +42,32 @@ func (config *Config) CanAutoDoublePuppet(userID id.UserID) bool {
 
 	return hasSecret
 }
+
+type SignalConfig struct {
+	DeviceName string `yaml:"device_name"`
+
+	Proxy      string `yaml:"proxy"`
+	TLSProxy   string `yaml:"tls_proxy"`
+	CACertPath string `yaml:"ca_cert_path"`
+
+	ChatURL    string            `yaml:"chat_url"`
+	StorageURL string            `yaml:"storage_url"`
+	CDNURLs    map[uint32]string `yaml:"cdn_urls"`
+
+	TrustRoot          string `yaml:"trust_root"`
+	ServerPublicParams string `yaml:"server_public_params"`
+}
+
+// WebConfig converts the config into the format used by signalmeow.
+func (sc *SignalConfig) WebConfig() web.Config {
+	return web.Config{
+		ChatURL:            sc.ChatURL,
+		StorageURL:         sc.StorageURL,
+		CDNURLs:            sc.CDNURLs,
+		ProxyURL:           sc.Proxy,
+		TLSProxy:           sc.TLSProxy,
+		CACertPath:         sc.CACertPath,
+		TrustRoot:          sc.TrustRoot,
+		ServerPublicParams: sc.ServerPublicParams,
+	}
+}
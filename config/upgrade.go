@@ -70,6 +70,14 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str, "metrics", "listen")
 
 	helper.Copy(up.Str, "signal", "device_name")
+	helper.Copy(up.Str|up.Null, "signal", "proxy")
+	helper.Copy(up.Str|up.Null, "signal", "tls_proxy")
+	helper.Copy(up.Str|up.Null, "signal", "ca_cert_path")
+	helper.Copy(up.Str|up.Null, "signal", "chat_url")
+	helper.Copy(up.Str|up.Null, "signal", "storage_url")
+	helper.Copy(up.Map, "signal", "cdn_urls")
+	helper.Copy(up.Str|up.Null, "signal", "trust_root")
+	helper.Copy(up.Str|up.Null, "signal", "server_public_params")
 
 	if usernameTemplate, ok := helper.Get(up.Str, "bridge", "username_template"); ok && strings.Contains(usernameTemplate, "{userid}") {
 		helper.Set(up.Str, strings.ReplaceAll(usernameTemplate, "{userid}", "{{.}}"), "bridge", "username_template")
@@ -90,7 +98,10 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "sync_direct_chat_list")
 	helper.Copy(up.Bool, "bridge", "resend_bridge_info")
 	helper.Copy(up.Bool, "bridge", "caption_in_message")
+	helper.Copy(up.Bool, "bridge", "coalesce_albums")
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
+	helper.Copy(up.Str|up.Null, "bridge", "location_tile_url")
+	helper.Copy(up.Int, "bridge", "max_media_size_mb")
 	helper.Copy(up.Map, "bridge", "double_puppet_server_map")
 	helper.Copy(up.Bool, "bridge", "double_puppet_allow_discovery")
 	helper.Copy(up.Map, "bridge", "login_shared_secret_map")
@@ -36,6 +36,8 @@ type Database struct {
 	Message             *MessageQuery
 	Reaction            *ReactionQuery
 	DisappearingMessage *DisappearingMessageQuery
+	FailedAttachment    *FailedAttachmentQuery
+	OutboxMessage       *OutboxMessageQuery
 }
 
 func New(db *dbutil.Database) *Database {
@@ -49,5 +51,7 @@ func New(db *dbutil.Database) *Database {
 		Message:             &MessageQuery{dbutil.MakeQueryHelper(db, newMessage)},
 		Reaction:            &ReactionQuery{dbutil.MakeQueryHelper(db, newReaction)},
 		DisappearingMessage: &DisappearingMessageQuery{dbutil.MakeQueryHelper(db, newDisappearingMessage)},
+		FailedAttachment:    &FailedAttachmentQuery{dbutil.MakeQueryHelper(db, newFailedAttachment)},
+		OutboxMessage:       &OutboxMessageQuery{dbutil.MakeQueryHelper(db, newOutboxMessage)},
 	}
 }
@@ -26,23 +26,32 @@ import (
 )
 
 const (
-	getUnscheduledDisappearingMessagesForRoomQuery = `
-		SELECT room_id, mxid, expiration_seconds, expiration_ts
-		FROM disappearing_message WHERE expiration_ts IS NULL AND room_id = $1
+	// Messages that aren't in the message table (e.g. notices) are included as they can't be correlated with timestamps.
+	// Edits are matched using the timestamp of the message they edit.
+	getUnscheduledDisappearingMessagesForRoomBeforeQuery = `
+		SELECT disappearing_message.room_id, disappearing_message.mxid, expiration_seconds, expiration_ts, expiration_start_ts, edit_of
+		FROM disappearing_message
+		LEFT JOIN message ON message.mxid = COALESCE(disappearing_message.edit_of, disappearing_message.mxid)
+		WHERE expiration_ts IS NULL AND disappearing_message.room_id = $1 AND (message.timestamp IS NULL OR message.timestamp <= $2)
+	`
+	getDisappearingMessageByMXIDQuery = `
+		SELECT room_id, mxid, expiration_seconds, expiration_ts, expiration_start_ts, edit_of
+		FROM disappearing_message WHERE mxid=$1
 	`
 	getExpiredDisappearingMessagesQuery = `
-		SELECT room_id, mxid, expiration_seconds, expiration_ts
+		SELECT room_id, mxid, expiration_seconds, expiration_ts, expiration_start_ts, edit_of
 		FROM disappearing_message WHERE expiration_ts IS NOT NULL AND expiration_ts <= $1
 	`
 	getNextDisappearingMessageQuery = `
-		SELECT room_id, mxid, expiration_seconds, expiration_ts
+		SELECT room_id, mxid, expiration_seconds, expiration_ts, expiration_start_ts, edit_of
 		FROM disappearing_message WHERE expiration_ts IS NOT NULL ORDER BY expiration_ts ASC LIMIT 1
 	`
 	insertDisappearingMessageQuery = `
-		INSERT INTO disappearing_message (room_id, mxid, expiration_seconds, expiration_ts) VALUES ($1, $2, $3, $4)
+		INSERT INTO disappearing_message (room_id, mxid, expiration_seconds, expiration_ts, expiration_start_ts, edit_of)
+		VALUES ($1, $2, $3, $4, $5, $6)
 	`
 	updateDisappearingMessageQuery = `
-		UPDATE disappearing_message SET expiration_ts=$2 WHERE mxid=$1
+		UPDATE disappearing_message SET expiration_ts=$2, expiration_start_ts=$3 WHERE mxid=$1
 	`
 	deleteDisappearingMessageQuery = `
 		DELETE FROM disappearing_message WHERE mxid=$1
@@ -60,24 +69,39 @@ type DisappearingMessage struct {
 	EventID  id.EventID
 	ExpireIn time.Duration
 	ExpireAt time.Time
+	// ExpireStart is when the timer was started, i.e. when the message was sent or read.
+	ExpireStart time.Time
+	// EditOf is the original message if this is an edit. Edits expire together with the original.
+	EditOf id.EventID
 }
 
 func newDisappearingMessage(qh *dbutil.QueryHelper[*DisappearingMessage]) *DisappearingMessage {
 	return &DisappearingMessage{qh: qh}
 }
 
-func (dmq *DisappearingMessageQuery) NewWithValues(roomID id.RoomID, eventID id.EventID, expireIn time.Duration, expireAt time.Time) *DisappearingMessage {
-	return &DisappearingMessage{
-		qh:       dmq.QueryHelper,
-		RoomID:   roomID,
-		EventID:  eventID,
-		ExpireIn: expireIn,
-		ExpireAt: expireAt,
+// NewWithValues creates a disappearing message row. If expireStart is zero, the timer isn't started yet.
+func (dmq *DisappearingMessageQuery) NewWithValues(roomID id.RoomID, eventID id.EventID, expireIn time.Duration, expireStart time.Time) *DisappearingMessage {
+	msg := &DisappearingMessage{
+		qh:          dmq.QueryHelper,
+		RoomID:      roomID,
+		EventID:     eventID,
+		ExpireIn:    expireIn,
+		ExpireStart: expireStart,
+	}
+	if !expireStart.IsZero() {
+		msg.ExpireAt = expireStart.Add(expireIn)
 	}
+	return msg
 }
 
-func (dmq *DisappearingMessageQuery) GetUnscheduledForRoom(ctx context.Context, roomID id.RoomID) ([]*DisappearingMessage, error) {
-	return dmq.QueryMany(ctx, getUnscheduledDisappearingMessagesForRoomQuery, roomID)
+// GetUnscheduledForRoomBefore returns the messages in the room whose timers haven't been started
+// and which were sent at or before the given Signal timestamp.
+func (dmq *DisappearingMessageQuery) GetUnscheduledForRoomBefore(ctx context.Context, roomID id.RoomID, timestamp uint64) ([]*DisappearingMessage, error) {
+	return dmq.QueryMany(ctx, getUnscheduledDisappearingMessagesForRoomBeforeQuery, roomID, timestamp)
+}
+
+func (dmq *DisappearingMessageQuery) GetByMXID(ctx context.Context, mxid id.EventID) (*DisappearingMessage, error) {
+	return dmq.QueryOne(ctx, getDisappearingMessageByMXIDQuery, mxid)
 }
 
 func (dmq *DisappearingMessageQuery) GetExpiredMessages(ctx context.Context) ([]*DisappearingMessage, error) {
@@ -90,8 +114,9 @@ func (dmq *DisappearingMessageQuery) GetNextScheduledMessage(ctx context.Context
 
 func (msg *DisappearingMessage) Scan(row dbutil.Scannable) (*DisappearingMessage, error) {
 	var expireIn int64
-	var expireAt sql.NullInt64
-	err := row.Scan(&msg.RoomID, &msg.EventID, &expireIn, &expireAt)
+	var expireAt, expireStart sql.NullInt64
+	var editOf sql.NullString
+	err := row.Scan(&msg.RoomID, &msg.EventID, &expireIn, &expireAt, &expireStart, &editOf)
 	if err != nil {
 		return nil, err
 	}
@@ -99,25 +124,40 @@ func (msg *DisappearingMessage) Scan(row dbutil.Scannable) (*DisappearingMessage
 	if expireAt.Valid {
 		msg.ExpireAt = time.Unix(expireAt.Int64, 0)
 	}
+	if expireStart.Valid {
+		msg.ExpireStart = time.UnixMilli(expireStart.Int64)
+	}
+	msg.EditOf = id.EventID(editOf.String)
 	return msg, nil
 }
 
-func (msg *DisappearingMessage) sqlVariables() []any {
-	var expireAt sql.NullInt64
+func (msg *DisappearingMessage) expirationVariables() (expireAt, expireStart sql.NullInt64) {
 	if !msg.ExpireAt.IsZero() {
 		expireAt.Valid = true
 		expireAt.Int64 = msg.ExpireAt.Unix()
 	}
-	return []any{msg.RoomID, msg.EventID, int64(msg.ExpireIn.Seconds()), expireAt}
+	if !msg.ExpireStart.IsZero() {
+		expireStart.Valid = true
+		expireStart.Int64 = msg.ExpireStart.UnixMilli()
+	}
+	return
+}
+
+func (msg *DisappearingMessage) sqlVariables() []any {
+	expireAt, expireStart := msg.expirationVariables()
+	return []any{msg.RoomID, msg.EventID, int64(msg.ExpireIn.Seconds()), expireAt, expireStart, dbutil.StrPtr(msg.EditOf)}
 }
 
 func (msg *DisappearingMessage) Insert(ctx context.Context) error {
 	return msg.qh.Exec(ctx, insertDisappearingMessageQuery, msg.sqlVariables()...)
 }
 
-func (msg *DisappearingMessage) StartExpirationTimer(ctx context.Context) error {
-	msg.ExpireAt = time.Now().Add(msg.ExpireIn)
-	return msg.qh.Exec(ctx, updateDisappearingMessageQuery, msg.EventID, msg.ExpireAt.Unix())
+// StartExpirationTimer starts the timer of the message at the given time, which is usually when it was read.
+func (msg *DisappearingMessage) StartExpirationTimer(ctx context.Context, startAt time.Time) error {
+	msg.ExpireStart = startAt
+	msg.ExpireAt = startAt.Add(msg.ExpireIn)
+	expireAt, expireStart := msg.expirationVariables()
+	return msg.qh.Exec(ctx, updateDisappearingMessageQuery, msg.EventID, expireAt, expireStart)
 }
 
 func (msg *DisappearingMessage) Delete(ctx context.Context) error {
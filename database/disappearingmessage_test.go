@@ -0,0 +1,126 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber, Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	rawDB, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = rawDB.Close() })
+	db := New(rawDB)
+	require.NoError(t, db.Upgrade())
+	return db
+}
+
+func insertTestMessage(t *testing.T, db *Database, roomID id.RoomID, eventID id.EventID, timestamp uint64) {
+	msg := db.Message.New()
+	msg.Sender = uuid.New()
+	msg.Timestamp = timestamp
+	msg.SignalChatID = "chat"
+	msg.SignalReceiver = uuid.New()
+	msg.MXID = eventID
+	msg.RoomID = roomID
+	require.NoError(t, msg.Insert(context.Background()))
+}
+
+func eventIDs(msgs []*DisappearingMessage) []id.EventID {
+	ids := make([]id.EventID, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.EventID
+	}
+	return ids
+}
+
+func TestGetUnscheduledForRoomBefore(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	const room = id.RoomID("!room:example.com")
+	const otherRoom = id.RoomID("!other:example.com")
+
+	insertTestMessage(t, db, room, "$old", 1000)
+	insertTestMessage(t, db, room, "$new", 3000)
+	insertTestMessage(t, db, room, "$started", 1000)
+	insertTestMessage(t, db, otherRoom, "$other", 1000)
+	for _, evtID := range []id.EventID{"$old", "$new", "$notice"} {
+		require.NoError(t, db.DisappearingMessage.NewWithValues(room, evtID, time.Minute, time.Time{}).Insert(ctx))
+	}
+	require.NoError(t, db.DisappearingMessage.NewWithValues(room, "$started", time.Minute, time.Now()).Insert(ctx))
+	require.NoError(t, db.DisappearingMessage.NewWithValues(otherRoom, "$other", time.Minute, time.Time{}).Insert(ctx))
+	edit := db.DisappearingMessage.NewWithValues(room, "$old-edit", time.Minute, time.Time{})
+	edit.EditOf = "$old"
+	require.NoError(t, edit.Insert(ctx))
+	newEdit := db.DisappearingMessage.NewWithValues(room, "$new-edit", time.Minute, time.Time{})
+	newEdit.EditOf = "$new"
+	require.NoError(t, newEdit.Insert(ctx))
+
+	msgs, err := db.DisappearingMessage.GetUnscheduledForRoomBefore(ctx, room, 2000)
+	require.NoError(t, err)
+	// Notices aren't in the message table, so they're always included,
+	// and edits use the timestamp of the message they edit.
+	assert.ElementsMatch(t, []id.EventID{"$old", "$notice", "$old-edit"}, eventIDs(msgs))
+
+	msgs, err = db.DisappearingMessage.GetUnscheduledForRoomBefore(ctx, room, 3000)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []id.EventID{"$old", "$new", "$notice", "$old-edit", "$new-edit"}, eventIDs(msgs))
+
+	for _, msg := range msgs {
+		require.NoError(t, msg.StartExpirationTimer(ctx, time.Now()))
+	}
+	msgs, err = db.DisappearingMessage.GetUnscheduledForRoomBefore(ctx, room, 3000)
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestDisappearingMessageEditOf(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	const room = id.RoomID("!room:example.com")
+	start := time.UnixMilli(time.Now().UnixMilli())
+
+	edit := db.DisappearingMessage.NewWithValues(room, "$edit", time.Minute, start)
+	edit.EditOf = "$original"
+	require.NoError(t, edit.Insert(ctx))
+	require.NoError(t, db.DisappearingMessage.NewWithValues(room, "$original", time.Minute, start).Insert(ctx))
+
+	loaded, err := db.DisappearingMessage.GetByMXID(ctx, "$edit")
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, id.EventID("$original"), loaded.EditOf)
+	assert.Equal(t, start, loaded.ExpireStart)
+	assert.Equal(t, start.Add(time.Minute).Unix(), loaded.ExpireAt.Unix())
+
+	loaded, err = db.DisappearingMessage.GetByMXID(ctx, "$original")
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Empty(t, loaded.EditOf)
+
+	loaded, err = db.DisappearingMessage.GetByMXID(ctx, "$missing")
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+}
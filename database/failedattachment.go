@@ -0,0 +1,139 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber, Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getFailedAttachmentByMXIDQuery = `
+		SELECT mxid, room_id, sender, content, pointer, attempts, next_attempt_ts, last_error
+		FROM failed_attachment WHERE mxid=$1
+	`
+	getFailedAttachmentsForRoomQuery = `
+		SELECT mxid, room_id, sender, content, pointer, attempts, next_attempt_ts, last_error
+		FROM failed_attachment WHERE room_id=$1
+	`
+	getDueFailedAttachmentsQuery = `
+		SELECT mxid, room_id, sender, content, pointer, attempts, next_attempt_ts, last_error
+		FROM failed_attachment WHERE next_attempt_ts IS NOT NULL AND next_attempt_ts <= $1
+	`
+	getNextFailedAttachmentQuery = `
+		SELECT mxid, room_id, sender, content, pointer, attempts, next_attempt_ts, last_error
+		FROM failed_attachment WHERE next_attempt_ts IS NOT NULL ORDER BY next_attempt_ts ASC LIMIT 1
+	`
+	insertFailedAttachmentQuery = `
+		INSERT INTO failed_attachment (mxid, room_id, sender, content, pointer, attempts, next_attempt_ts, last_error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	updateFailedAttachmentQuery = `
+		UPDATE failed_attachment SET attempts=$2, next_attempt_ts=$3, last_error=$4 WHERE mxid=$1
+	`
+	deleteFailedAttachmentQuery = `
+		DELETE FROM failed_attachment WHERE mxid=$1
+	`
+)
+
+type FailedAttachmentQuery struct {
+	*dbutil.QueryHelper[*FailedAttachment]
+}
+
+// FailedAttachment is an attachment from Signal that couldn't be downloaded. A placeholder
+// was sent to Matrix instead, which is edited into the real media if a retry succeeds.
+type FailedAttachment struct {
+	qh *dbutil.QueryHelper[*FailedAttachment]
+
+	MXID    id.EventID
+	RoomID  id.RoomID
+	Sender  uuid.UUID
+	Content *event.MessageEventContent
+	// Pointer is the serialized AttachmentPointer protobuf
+	Pointer     []byte
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+func newFailedAttachment(qh *dbutil.QueryHelper[*FailedAttachment]) *FailedAttachment {
+	return &FailedAttachment{qh: qh}
+}
+
+func (faq *FailedAttachmentQuery) New() *FailedAttachment {
+	return newFailedAttachment(faq.QueryHelper)
+}
+
+func (faq *FailedAttachmentQuery) GetByMXID(ctx context.Context, mxid id.EventID) (*FailedAttachment, error) {
+	return faq.QueryOne(ctx, getFailedAttachmentByMXIDQuery, mxid)
+}
+
+func (faq *FailedAttachmentQuery) GetAllForRoom(ctx context.Context, roomID id.RoomID) ([]*FailedAttachment, error) {
+	return faq.QueryMany(ctx, getFailedAttachmentsForRoomQuery, roomID)
+}
+
+func (faq *FailedAttachmentQuery) GetDue(ctx context.Context) ([]*FailedAttachment, error) {
+	return faq.QueryMany(ctx, getDueFailedAttachmentsQuery, time.Now().Unix())
+}
+
+func (faq *FailedAttachmentQuery) GetNextScheduled(ctx context.Context) (*FailedAttachment, error) {
+	return faq.QueryOne(ctx, getNextFailedAttachmentQuery)
+}
+
+func (fa *FailedAttachment) Scan(row dbutil.Scannable) (*FailedAttachment, error) {
+	var nextAttempt sql.NullInt64
+	fa.Content = &event.MessageEventContent{}
+	err := row.Scan(
+		&fa.MXID, &fa.RoomID, &fa.Sender, dbutil.JSON{Data: fa.Content}, &fa.Pointer,
+		&fa.Attempts, &nextAttempt, &fa.LastError,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if nextAttempt.Valid {
+		fa.NextAttempt = time.Unix(nextAttempt.Int64, 0)
+	}
+	return fa, nil
+}
+
+func (fa *FailedAttachment) nextAttemptTS() sql.NullInt64 {
+	if fa.NextAttempt.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: fa.NextAttempt.Unix(), Valid: true}
+}
+
+func (fa *FailedAttachment) Insert(ctx context.Context) error {
+	return fa.qh.Exec(ctx, insertFailedAttachmentQuery,
+		fa.MXID, fa.RoomID, fa.Sender, dbutil.JSON{Data: fa.Content}, fa.Pointer,
+		fa.Attempts, fa.nextAttemptTS(), fa.LastError,
+	)
+}
+
+func (fa *FailedAttachment) Update(ctx context.Context) error {
+	return fa.qh.Exec(ctx, updateFailedAttachmentQuery, fa.MXID, fa.Attempts, fa.nextAttemptTS(), fa.LastError)
+}
+
+func (fa *FailedAttachment) Delete(ctx context.Context) error {
+	return fa.qh.Exec(ctx, deleteFailedAttachmentQuery, fa.MXID)
+}
@@ -0,0 +1,207 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber, Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	outboxBaseSelect = `
+		SELECT mxid, room_id, sender, extra_mxids, timestamp, content, queued_ts, attempts, next_attempt_ts, last_error, recipients, album_pending
+		FROM outbox
+	`
+	getOutboxMessageByMXIDQueryPostgres = outboxBaseSelect + `
+		WHERE mxid=$1 OR EXISTS(SELECT 1 FROM jsonb_array_elements_text(extra_mxids::jsonb) WHERE value=$1)
+	`
+	getOutboxMessageByMXIDQuerySQLite = outboxBaseSelect + `
+		WHERE mxid=$1 OR EXISTS(SELECT 1 FROM json_each(outbox.extra_mxids) WHERE json_each.value=$1)
+	`
+	getNextOutboxMessageForRoomQuery = outboxBaseSelect + `
+		WHERE room_id=$1 AND (
+			recipients IS NOT NULL OR
+			timestamp=(SELECT MIN(timestamp) FROM outbox WHERE room_id=$1 AND recipients IS NULL)
+		)
+		ORDER BY COALESCE(next_attempt_ts, queued_ts) ASC, timestamp ASC LIMIT 1
+	`
+	getOutboxMessagesFromQuery = outboxBaseSelect + `
+		WHERE room_id=$1 AND recipients IS NULL AND timestamp>=$2
+		ORDER BY timestamp ASC, queued_ts ASC LIMIT $3
+	`
+	getOutboxRoomsQuery      = `SELECT DISTINCT room_id FROM outbox`
+	insertOutboxMessageQuery = `
+		INSERT INTO outbox (mxid, room_id, sender, extra_mxids, timestamp, content, queued_ts, attempts, next_attempt_ts, last_error, recipients, album_pending)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`
+	updateOutboxMessageQuery = `
+		UPDATE outbox SET attempts=$2, next_attempt_ts=$3, last_error=$4, recipients=$5 WHERE mxid=$1
+	`
+	mergeOutboxAlbumQuery = `
+		UPDATE outbox SET extra_mxids=$2, content=$3, album_pending=false WHERE mxid=$1
+	`
+	deleteOutboxMessageQuery = `
+		DELETE FROM outbox WHERE mxid=$1
+	`
+)
+
+type OutboxMessageQuery struct {
+	*dbutil.QueryHelper[*OutboxMessage]
+}
+
+// OutboxMessage is a message from Matrix that has been converted, but not yet successfully sent to Signal.
+type OutboxMessage struct {
+	qh *dbutil.QueryHelper[*OutboxMessage]
+
+	MXID   id.EventID
+	RoomID id.RoomID
+	Sender id.UserID
+	// ExtraMXIDs are the other events that were merged into the message, e.g. album parts
+	ExtraMXIDs []id.EventID
+	Timestamp  uint64
+	// Content is the serialized Content protobuf
+	Content     []byte
+	QueuedAt    time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	// Recipients are the group members that the message still has to be sent to, if it was already sent to the others.
+	// It's nil for messages that haven't been sent to anyone yet.
+	Recipients []string
+	// AlbumPending is true for images that haven't been sent yet and may still be merged into an album
+	// with the images queued after them.
+	AlbumPending bool
+}
+
+func newOutboxMessage(qh *dbutil.QueryHelper[*OutboxMessage]) *OutboxMessage {
+	return &OutboxMessage{qh: qh}
+}
+
+func (omq *OutboxMessageQuery) New() *OutboxMessage {
+	return newOutboxMessage(omq.QueryHelper)
+}
+
+// GetByMXID returns the queued message that the given event is part of, including merged album parts.
+func (omq *OutboxMessageQuery) GetByMXID(ctx context.Context, mxid id.EventID) (*OutboxMessage, error) {
+	if omq.GetDB().Dialect == dbutil.Postgres {
+		return omq.QueryOne(ctx, getOutboxMessageByMXIDQueryPostgres, mxid)
+	}
+	return omq.QueryOne(ctx, getOutboxMessageByMXIDQuerySQLite, mxid)
+}
+
+// GetNextForRoom returns the next message to send in the room. That's either the oldest queued message,
+// which must be sent before any others, or a partially sent message that has to be sent to the remaining members.
+// Partially sent messages don't block the queue, so the one that's due first is returned,
+// where messages that haven't been attempted yet are due when they were queued.
+func (omq *OutboxMessageQuery) GetNextForRoom(ctx context.Context, roomID id.RoomID) (*OutboxMessage, error) {
+	return omq.QueryOne(ctx, getNextOutboxMessageForRoomQuery, roomID)
+}
+
+// GetManyFrom returns up to limit messages in the room that haven't been sent to anyone yet,
+// starting from the given timestamp, in the order they'll be sent.
+func (omq *OutboxMessageQuery) GetManyFrom(ctx context.Context, roomID id.RoomID, timestamp uint64, limit int) ([]*OutboxMessage, error) {
+	return omq.QueryMany(ctx, getOutboxMessagesFromQuery, roomID, timestamp, limit)
+}
+
+// GetRooms returns all rooms that have queued messages.
+func (omq *OutboxMessageQuery) GetRooms(ctx context.Context) ([]id.RoomID, error) {
+	rows, err := omq.GetDB().Conn(ctx).QueryContext(ctx, getOutboxRoomsQuery)
+	if err != nil {
+		return nil, err
+	}
+	return dbutil.NewRowIter(rows, func(row dbutil.Rows) (roomID id.RoomID, err error) {
+		err = row.Scan(&roomID)
+		return
+	}).AsList()
+}
+
+func (om *OutboxMessage) Scan(row dbutil.Scannable) (*OutboxMessage, error) {
+	var queuedAt int64
+	var nextAttempt sql.NullInt64
+	err := row.Scan(
+		&om.MXID, &om.RoomID, &om.Sender, dbutil.JSON{Data: &om.ExtraMXIDs}, &om.Timestamp, &om.Content,
+		&queuedAt, &om.Attempts, &nextAttempt, &om.LastError, dbutil.JSON{Data: &om.Recipients}, &om.AlbumPending,
+	)
+	if err != nil {
+		return nil, err
+	}
+	om.QueuedAt = time.UnixMilli(queuedAt)
+	if nextAttempt.Valid {
+		om.NextAttempt = time.UnixMilli(nextAttempt.Int64)
+	}
+	return om, nil
+}
+
+func (om *OutboxMessage) nextAttemptTS() sql.NullInt64 {
+	if om.NextAttempt.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: om.NextAttempt.UnixMilli(), Valid: true}
+}
+
+func (om *OutboxMessage) recipientsJSON() any {
+	if om.Recipients == nil {
+		return nil
+	}
+	return dbutil.JSON{Data: om.Recipients}
+}
+
+func (om *OutboxMessage) Insert(ctx context.Context) error {
+	if om.ExtraMXIDs == nil {
+		om.ExtraMXIDs = []id.EventID{}
+	}
+	return om.qh.Exec(ctx, insertOutboxMessageQuery,
+		om.MXID, om.RoomID, om.Sender, dbutil.JSON{Data: om.ExtraMXIDs}, om.Timestamp, om.Content,
+		om.QueuedAt.UnixMilli(), om.Attempts, om.nextAttemptTS(), om.LastError, om.recipientsJSON(), om.AlbumPending,
+	)
+}
+
+func (om *OutboxMessage) Update(ctx context.Context) error {
+	return om.qh.Exec(ctx, updateOutboxMessageQuery, om.MXID, om.Attempts, om.nextAttemptTS(), om.LastError, om.recipientsJSON())
+}
+
+// MergeAlbum saves the content and ExtraMXIDs of a message that the queued images in parts were merged into,
+// and removes the parts from the outbox. The message can't be merged with more images afterwards.
+func (om *OutboxMessage) MergeAlbum(ctx context.Context, parts []*OutboxMessage) error {
+	if om.ExtraMXIDs == nil {
+		om.ExtraMXIDs = []id.EventID{}
+	}
+	err := om.qh.GetDB().DoTxn(ctx, nil, func(ctx context.Context) error {
+		err := om.qh.Exec(ctx, mergeOutboxAlbumQuery, om.MXID, dbutil.JSON{Data: om.ExtraMXIDs}, om.Content)
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			if err = part.Delete(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		om.AlbumPending = false
+	}
+	return err
+}
+
+func (om *OutboxMessage) Delete(ctx context.Context) error {
+	return om.qh.Exec(ctx, deleteOutboxMessageQuery, om.MXID)
+}
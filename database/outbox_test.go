@@ -0,0 +1,167 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber, Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
+)
+
+func queueTestMessage(t *testing.T, db *Database, roomID id.RoomID, eventID id.EventID, timestamp uint64, extra ...id.EventID) *OutboxMessage {
+	msg := db.OutboxMessage.New()
+	msg.MXID = eventID
+	msg.RoomID = roomID
+	msg.Sender = "@user:example.com"
+	msg.ExtraMXIDs = extra
+	msg.Timestamp = timestamp
+	msg.Content = []byte("content")
+	msg.QueuedAt = time.Now()
+	require.NoError(t, msg.Insert(context.Background()))
+	return msg
+}
+
+func nextOutboxEventID(t *testing.T, db *Database, roomID id.RoomID) id.EventID {
+	msg, err := db.OutboxMessage.GetNextForRoom(context.Background(), roomID)
+	require.NoError(t, err)
+	if msg == nil {
+		return ""
+	}
+	return msg.MXID
+}
+
+func TestOutboxQueueOrder(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	const room = id.RoomID("!room:example.com")
+	const otherRoom = id.RoomID("!other:example.com")
+	assert.Empty(t, nextOutboxEventID(t, db, room))
+
+	second := queueTestMessage(t, db, room, "$second", 2000)
+	first := queueTestMessage(t, db, room, "$first", 1000)
+	queueTestMessage(t, db, otherRoom, "$other", 500)
+	assert.Equal(t, id.EventID("$first"), nextOutboxEventID(t, db, room))
+
+	// Messages waiting for a retry still block newer messages in the same room
+	first.Attempts = 1
+	first.NextAttempt = time.Now().Add(time.Minute)
+	require.NoError(t, first.Update(ctx))
+	assert.Equal(t, id.EventID("$first"), nextOutboxEventID(t, db, room))
+
+	rooms, err := db.OutboxMessage.GetRooms(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []id.RoomID{room, otherRoom}, rooms)
+
+	require.NoError(t, first.Delete(ctx))
+	assert.Equal(t, id.EventID("$second"), nextOutboxEventID(t, db, room))
+	require.NoError(t, second.Delete(ctx))
+	assert.Empty(t, nextOutboxEventID(t, db, room))
+}
+
+func TestOutboxPartialRetryDoesNotBlock(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	const room = id.RoomID("!room:example.com")
+
+	partial := queueTestMessage(t, db, room, "$partial", 1000)
+	partial.Recipients = []string{"member-1", "member-2"}
+	partial.Attempts = 1
+	partial.NextAttempt = time.Now().Add(time.Minute)
+	require.NoError(t, partial.Update(ctx))
+	queueTestMessage(t, db, room, "$second", 2000)
+	queueTestMessage(t, db, room, "$third", 3000)
+
+	// The partially sent message isn't due yet, so the oldest unsent message goes first
+	assert.Equal(t, id.EventID("$second"), nextOutboxEventID(t, db, room))
+
+	// Once it's due, it goes before messages that were queued later
+	partial.NextAttempt = time.Now().Add(-time.Minute)
+	require.NoError(t, partial.Update(ctx))
+	loaded, err := db.OutboxMessage.GetNextForRoom(ctx, room)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, id.EventID("$partial"), loaded.MXID)
+	assert.Equal(t, []string{"member-1", "member-2"}, loaded.Recipients)
+}
+
+func TestOutboxGetByMXID(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	const room = id.RoomID("!room:example.com")
+	queueTestMessage(t, db, room, "$album", 1000, "$album-2", "$album-3")
+
+	for _, evtID := range []id.EventID{"$album", "$album-2", "$album-3"} {
+		msg, err := db.OutboxMessage.GetByMXID(ctx, evtID)
+		require.NoError(t, err)
+		require.NotNil(t, msg, evtID)
+		assert.Equal(t, id.EventID("$album"), msg.MXID)
+		assert.Equal(t, []id.EventID{"$album-2", "$album-3"}, msg.ExtraMXIDs)
+		assert.Nil(t, msg.Recipients)
+	}
+	// Only whole event IDs match, LIKE wildcards and parts of the JSON list don't
+	for _, evtID := range []id.EventID{"$album-", "$album_2", "$album-%", `$album-2","$album-3`, "album-2"} {
+		msg, err := db.OutboxMessage.GetByMXID(ctx, evtID)
+		require.NoError(t, err)
+		assert.Nil(t, msg, evtID)
+	}
+}
+
+func TestOutboxMergeAlbum(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	const room = id.RoomID("!room:example.com")
+	first := queueTestMessage(t, db, room, "$first", 1000)
+	second := queueTestMessage(t, db, room, "$second", 2000)
+	queueTestMessage(t, db, room, "$text", 3000)
+	queueTestMessage(t, db, "!other:example.com", "$other", 1500)
+	for _, msg := range []*OutboxMessage{first, second} {
+		require.NoError(t, msg.Delete(ctx))
+		msg.AlbumPending = true
+		require.NoError(t, msg.Insert(ctx))
+	}
+
+	queued, err := db.OutboxMessage.GetManyFrom(ctx, room, first.Timestamp, 5)
+	require.NoError(t, err)
+	require.Len(t, queued, 3)
+	assert.Equal(t, id.EventID("$first"), queued[0].MXID)
+	assert.True(t, queued[0].AlbumPending)
+	assert.Equal(t, id.EventID("$second"), queued[1].MXID)
+	assert.False(t, queued[2].AlbumPending)
+
+	first.Content = []byte("merged")
+	first.ExtraMXIDs = []id.EventID{second.MXID}
+	require.NoError(t, first.MergeAlbum(ctx, []*OutboxMessage{second}))
+	assert.False(t, first.AlbumPending)
+
+	queued, err = db.OutboxMessage.GetManyFrom(ctx, room, first.Timestamp, 5)
+	require.NoError(t, err)
+	require.Len(t, queued, 2)
+	assert.Equal(t, id.EventID("$first"), queued[0].MXID)
+	assert.False(t, queued[0].AlbumPending)
+	assert.Equal(t, []byte("merged"), queued[0].Content)
+	assert.Equal(t, []id.EventID{"$second"}, queued[0].ExtraMXIDs)
+	assert.Equal(t, id.EventID("$text"), queued[1].MXID)
+
+	msg, err := db.OutboxMessage.GetByMXID(ctx, "$second")
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.Equal(t, id.EventID("$first"), msg.MXID)
+}
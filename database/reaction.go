@@ -25,9 +25,13 @@ import (
 )
 
 const (
-	getReactionByMXIDQuery     = `SELECT msg_author, msg_timestamp, author, emoji, signal_chat_id, signal_receiver, mxid, mx_room FROM reaction WHERE mxid=$1`
-	getReactionBySignalIDQuery = `SELECT msg_author, msg_timestamp, author, emoji, signal_chat_id, signal_receiver, mxid, mx_room FROM reaction WHERE msg_author=$1 AND msg_timestamp=$2 AND author=$3 AND signal_receiver=$4`
-	insertReactionQuery        = `
+	getReactionByMXIDQuery        = `SELECT msg_author, msg_timestamp, author, emoji, signal_chat_id, signal_receiver, mxid, mx_room FROM reaction WHERE mxid=$1`
+	getReactionBySignalIDQuery    = `SELECT msg_author, msg_timestamp, author, emoji, signal_chat_id, signal_receiver, mxid, mx_room FROM reaction WHERE msg_author=$1 AND msg_timestamp=$2 AND author=$3 AND signal_receiver=$4`
+	getAllReactionsToMessageQuery = `
+		SELECT msg_author, msg_timestamp, author, emoji, signal_chat_id, signal_receiver, mxid, mx_room FROM reaction
+		WHERE msg_author=$1 AND msg_timestamp=$2 AND signal_receiver=$3
+	`
+	insertReactionQuery = `
 		INSERT INTO reaction (msg_author, msg_timestamp, author, emoji, signal_chat_id, signal_receiver, mxid, mx_room)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
@@ -67,6 +71,10 @@ func (rq *ReactionQuery) GetBySignalID(ctx context.Context, msgAuthor uuid.UUID,
 	return rq.QueryOne(ctx, getReactionBySignalIDQuery, msgAuthor, msgTimestamp, author, signalReceiver)
 }
 
+func (rq *ReactionQuery) GetAllToMessage(ctx context.Context, msgAuthor uuid.UUID, msgTimestamp uint64, signalReceiver uuid.UUID) ([]*Reaction, error) {
+	return rq.QueryMany(ctx, getAllReactionsToMessageQuery, msgAuthor, msgTimestamp, signalReceiver)
+}
+
 func (r *Reaction) Scan(row dbutil.Scannable) (*Reaction, error) {
 	return dbutil.ValueOrErr(r, row.Scan(
 		&r.MsgAuthor, &r.MsgTimestamp, &r.Author, &r.Emoji, &r.SignalChatID, &r.SignalReceiver, &r.MXID, &r.RoomID,
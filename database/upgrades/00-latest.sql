@@ -1,4 +1,4 @@
--- v0 -> v17: Latest revision
+-- v0 -> v23: Latest revision
 
 CREATE TABLE portal (
     chat_id     TEXT    NOT NULL,
@@ -93,5 +93,34 @@ CREATE TABLE disappearing_message (
     mxid                TEXT   NOT NULL PRIMARY KEY,
     room_id             TEXT   NOT NULL,
     expiration_seconds  BIGINT NOT NULL,
-    expiration_ts       BIGINT
+    expiration_ts       BIGINT,
+    expiration_start_ts BIGINT,
+    edit_of             TEXT
 );
+
+CREATE TABLE failed_attachment (
+    mxid            TEXT    NOT NULL PRIMARY KEY,
+    room_id         TEXT    NOT NULL,
+    sender          uuid    NOT NULL,
+    content         TEXT    NOT NULL,
+    pointer         bytea   NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_ts BIGINT,
+    last_error      TEXT    NOT NULL
+);
+
+CREATE TABLE outbox (
+    mxid            TEXT    NOT NULL PRIMARY KEY,
+    room_id         TEXT    NOT NULL,
+    sender          TEXT    NOT NULL,
+    extra_mxids     TEXT    NOT NULL,
+    timestamp       BIGINT  NOT NULL,
+    content         bytea   NOT NULL,
+    queued_ts       BIGINT  NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_ts BIGINT,
+    last_error      TEXT    NOT NULL DEFAULT '',
+    recipients      TEXT,
+    album_pending   BOOLEAN NOT NULL DEFAULT false
+);
+CREATE INDEX outbox_room_idx ON outbox (room_id, timestamp);
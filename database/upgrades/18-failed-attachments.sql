@@ -0,0 +1,11 @@
+-- v18: Store failed attachment downloads for retrying
+CREATE TABLE failed_attachment (
+    mxid            TEXT    NOT NULL PRIMARY KEY,
+    room_id         TEXT    NOT NULL,
+    sender          uuid    NOT NULL,
+    content         TEXT    NOT NULL,
+    pointer         bytea   NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_ts BIGINT,
+    last_error      TEXT    NOT NULL
+);
@@ -0,0 +1,3 @@
+-- v19: Store when disappearing message timers were started
+ALTER TABLE disappearing_message ADD COLUMN expiration_start_ts BIGINT;
+UPDATE disappearing_message SET expiration_start_ts=(expiration_ts-expiration_seconds)*1000 WHERE expiration_ts IS NOT NULL;
@@ -0,0 +1,14 @@
+-- v20: Store outgoing messages until they've been sent to Signal
+CREATE TABLE outbox (
+    mxid            TEXT    NOT NULL PRIMARY KEY,
+    room_id         TEXT    NOT NULL,
+    sender          TEXT    NOT NULL,
+    extra_mxids     TEXT    NOT NULL,
+    timestamp       BIGINT  NOT NULL,
+    content         bytea   NOT NULL,
+    queued_ts       BIGINT  NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_ts BIGINT,
+    last_error      TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX outbox_room_idx ON outbox (room_id, timestamp);
@@ -0,0 +1,2 @@
+-- v21: Store edits of disappearing messages so they're redacted together with the original
+ALTER TABLE disappearing_message ADD COLUMN edit_of TEXT;
@@ -0,0 +1,2 @@
+-- v22: Store the group members that a partially sent message still has to be sent to
+ALTER TABLE outbox ADD COLUMN recipients TEXT;
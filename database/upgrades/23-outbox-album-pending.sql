@@ -0,0 +1,2 @@
+-- v23: Queue images that may be merged into an album separately until they're sent
+ALTER TABLE outbox ADD COLUMN album_pending BOOLEAN NOT NULL DEFAULT false;
@@ -18,16 +18,91 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-signal/database"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
 )
 
+// TypeDisappearingTimer is the state event used to show and change the disappearing message timer of a room.
+var TypeDisappearingTimer = event.Type{Type: "com.beeper.disappearing_timer", Class: event.StateEventType}
+
+const DisappearingTimerTypeAfterRead = "after_read"
+
+type DisappearingTimerEventContent struct {
+	Type string `json:"type,omitempty"`
+	// Timer is the disappearing message timer in milliseconds, zero means disabled
+	Timer int64 `json:"timer"`
+}
+
+func NewDisappearingTimerEventContent(expireInSeconds uint32) *DisappearingTimerEventContent {
+	if expireInSeconds == 0 {
+		return &DisappearingTimerEventContent{}
+	}
+	// Signal timers only start once the message has been read
+	return &DisappearingTimerEventContent{
+		Type:  DisappearingTimerTypeAfterRead,
+		Timer: int64(expireInSeconds) * 1000,
+	}
+}
+
+// Seconds returns the timer in seconds as used by Signal.
+func (content *DisappearingTimerEventContent) Seconds() uint32 {
+	if content.Type == "" || content.Timer <= 0 {
+		return 0
+	}
+	return uint32(content.Timer / 1000)
+}
+
+func (br *SignalBridge) HandleDisappearingTimerEvent(evt *event.Event) {
+	defer br.MatrixHandler.TrackEventDuration(evt.Type)()
+	if evt.Sender == br.Bot.UserID || br.IsGhost(evt.Sender) {
+		return
+	}
+	log := br.ZLog.With().
+		Str("event_id", evt.ID.String()).
+		Str("room_id", evt.RoomID.String()).
+		Str("sender", evt.Sender.String()).
+		Logger()
+	user := br.GetUserByMXID(evt.Sender)
+	if user == nil || !user.IsLoggedIn() {
+		return
+	}
+	portal := br.GetPortalByMXID(evt.RoomID)
+	if portal == nil {
+		return
+	}
+	var content DisappearingTimerEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &content)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to parse disappearing timer event")
+		return
+	}
+	newTimer := content.Seconds()
+	if int(newTimer) == portal.ExpirationTime {
+		return
+	}
+	ctx := log.WithContext(context.TODO())
+	err = portal.SetDisappearingTimer(ctx, user, newTimer)
+	if errors.Is(err, signalmeow.ErrGroupChangeNotSent) {
+		log.Warn().Err(err).Uint32("new_timer", newTimer).Msg("Changed disappearing timer, but failed to notify members")
+		portal.MainIntent().SendNotice(portal.MXID, fmt.Sprintf("The disappearing message timer was changed, but other members may only see it later: %v", err))
+	} else if err != nil {
+		log.Err(err).Uint32("new_timer", newTimer).Msg("Failed to change disappearing timer")
+		portal.MainIntent().SendNotice(portal.MXID, fmt.Sprintf("Failed to change disappearing message timer: %v", err))
+		// Revert the state event to the timer that's actually in use
+		portal.updateDisappearingTimerState(uint32(portal.ExpirationTime))
+	}
+}
+
 type DisappearingMessagesManager struct {
 	DB                *database.Database
 	Log               zerolog.Logger
@@ -35,15 +110,22 @@ type DisappearingMessagesManager struct {
 	checkMessagesChan chan struct{}
 }
 
-func (dmm *DisappearingMessagesManager) ScheduleDisappearingForRoom(ctx context.Context, roomID id.RoomID) {
-	log := dmm.Log.With().Str("room_id", roomID.String()).Logger()
-	disappearingMessages, err := dmm.DB.DisappearingMessage.GetUnscheduledForRoom(ctx, roomID)
+// StartTimersForRead starts the timers of all messages in the room that were sent at or before the given
+// Signal timestamp, as the user has read them. Signal only starts timers of incoming messages once they're read.
+func (dmm *DisappearingMessagesManager) StartTimersForRead(ctx context.Context, roomID id.RoomID, readUpTo uint64, readAt time.Time) {
+	log := dmm.Log.With().Str("room_id", roomID.String()).Uint64("read_up_to", readUpTo).Logger()
+	disappearingMessages, err := dmm.DB.DisappearingMessage.GetUnscheduledForRoomBefore(ctx, roomID, readUpTo)
 	if err != nil {
 		log.Err(err).Msg("Failed to get unscheduled disappearing messages")
 		return
+	} else if len(disappearingMessages) == 0 {
+		return
+	}
+	if now := time.Now(); readAt.IsZero() || readAt.After(now) {
+		readAt = now
 	}
 	for _, disappearingMessage := range disappearingMessages {
-		err = disappearingMessage.StartExpirationTimer(ctx)
+		err = disappearingMessage.StartExpirationTimer(ctx, readAt)
 		if err != nil {
 			log.Err(err).Msg("Failed to schedule disappearing message")
 		} else {
@@ -54,8 +136,16 @@ func (dmm *DisappearingMessagesManager) ScheduleDisappearingForRoom(ctx context.
 		}
 	}
 
-	// Tell the disappearing messages loop to check again
-	dmm.checkMessagesChan <- struct{}{}
+	dmm.wakeLoop()
+}
+
+// wakeLoop tells the disappearing messages loop to check again.
+func (dmm *DisappearingMessagesManager) wakeLoop() {
+	select {
+	case dmm.checkMessagesChan <- struct{}{}:
+	default:
+		// The loop will already check again
+	}
 }
 
 func (dmm *DisappearingMessagesManager) StartDisappearingLoop(ctx context.Context) {
@@ -102,6 +192,7 @@ func (dmm *DisappearingMessagesManager) redactExpiredMessages(ctx context.Contex
 			log.Warn().Str("event_id", msg.EventID.String()).Str("room_id", msg.RoomID.String()).Msg("Failed to redact message: portal not found")
 			continue
 		}
+		dmm.redactReactionsToMessage(ctx, portal, msg.EventID)
 		_, err = portal.MainIntent().RedactEvent(msg.RoomID, msg.EventID, mautrix.ReqRedact{
 			Reason: "Message expired",
 			TxnID:  fmt.Sprintf("mxsg_disappear_%s", msg.EventID),
@@ -123,18 +214,62 @@ func (dmm *DisappearingMessagesManager) redactExpiredMessages(ctx context.Contex
 				Str("event_id", msg.EventID.String()).
 				Msg("Failed to delete disappearing message row in database")
 		}
+		dmm.dropFailedAttachment(ctx, msg.EventID)
 	}
 }
 
-func (dmm *DisappearingMessagesManager) AddDisappearingMessage(ctx context.Context, eventID id.EventID, roomID id.RoomID, expireIn time.Duration, startTimerNow bool) {
-	if expireIn == 0 {
+// dropFailedAttachment stops retrying the attachment of an expired message,
+// as a later retry would edit the media back into the room.
+func (dmm *DisappearingMessagesManager) dropFailedAttachment(ctx context.Context, eventID id.EventID) {
+	failed, err := dmm.DB.FailedAttachment.GetByMXID(ctx, eventID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("event_id", eventID.String()).Msg("Failed to get failed attachment of expired message")
+	} else if failed != nil {
+		err = failed.Delete(ctx)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Str("event_id", eventID.String()).Msg("Failed to delete failed attachment of expired message")
+		}
+	}
+}
+
+// redactReactionsToMessage redacts the bridged reactions to an expired message,
+// so they don't linger in the room after the message itself is gone.
+func (dmm *DisappearingMessagesManager) redactReactionsToMessage(ctx context.Context, portal *Portal, eventID id.EventID) {
+	log := zerolog.Ctx(ctx).With().Str("event_id", eventID.String()).Logger()
+	dbMessage, err := dmm.DB.Message.GetByMXID(ctx, eventID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get expired message from database")
+		return
+	} else if dbMessage == nil {
+		return
+	}
+	reactions, err := dmm.DB.Reaction.GetAllToMessage(ctx, dbMessage.Sender, dbMessage.Timestamp, dbMessage.SignalReceiver)
+	if err != nil {
+		log.Err(err).Msg("Failed to get reactions to expired message")
 		return
 	}
-	var expireAt time.Time
-	if startTimerNow {
-		expireAt = time.Now().Add(expireIn)
+	for _, reaction := range reactions {
+		_, err = portal.MainIntent().RedactEvent(reaction.RoomID, reaction.MXID, mautrix.ReqRedact{
+			Reason: "Message expired",
+			TxnID:  fmt.Sprintf("mxsg_disappear_%s", reaction.MXID),
+		})
+		if err != nil {
+			log.Err(err).Str("reaction_event_id", reaction.MXID.String()).Msg("Failed to redact reaction to expired message")
+		}
+		err = reaction.Delete(ctx)
+		if err != nil {
+			log.Err(err).Str("reaction_event_id", reaction.MXID.String()).Msg("Failed to delete reaction to expired message")
+		}
 	}
-	disappearingMessage := dmm.DB.DisappearingMessage.NewWithValues(roomID, eventID, expireIn, expireAt)
+}
+
+// AddDisappearingMessage stores a message that should be redacted after expireIn. If expireStart is zero,
+// the timer is started later by StartTimersForRead.
+func (dmm *DisappearingMessagesManager) AddDisappearingMessage(ctx context.Context, eventID id.EventID, roomID id.RoomID, expireIn time.Duration, expireStart time.Time) {
+	if expireIn == 0 {
+		return
+	}
+	disappearingMessage := dmm.DB.DisappearingMessage.NewWithValues(roomID, eventID, expireIn, expireStart)
 	err := disappearingMessage.Insert(ctx)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Str("event_id", eventID.String()).
@@ -143,8 +278,31 @@ func (dmm *DisappearingMessagesManager) AddDisappearingMessage(ctx context.Conte
 	}
 	zerolog.Ctx(ctx).Debug().Str("event_id", eventID.String()).
 		Msg("Added disappearing message row to database")
-	if startTimerNow {
-		// Tell the disappearing messages loop to check again
-		dmm.checkMessagesChan <- struct{}{}
+	if !expireStart.IsZero() {
+		dmm.wakeLoop()
+	}
+}
+
+// AddEdit stores an edit of a disappearing message, so that the edit is redacted together with the original.
+// Redacting only the original would leave the edited content visible in the edit event.
+func (dmm *DisappearingMessagesManager) AddEdit(ctx context.Context, editID, originalID id.EventID) {
+	log := zerolog.Ctx(ctx).With().Str("event_id", editID.String()).Str("edit_of", originalID.String()).Logger()
+	original, err := dmm.DB.DisappearingMessage.GetByMXID(ctx, originalID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get edited disappearing message from database")
+		return
+	} else if original == nil {
+		return
+	}
+	edit := dmm.DB.DisappearingMessage.NewWithValues(original.RoomID, editID, original.ExpireIn, original.ExpireStart)
+	edit.EditOf = originalID
+	err = edit.Insert(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to add edit of disappearing message to database")
+		return
+	}
+	log.Debug().Msg("Added edit of disappearing message to database")
+	if !edit.ExpireStart.IsZero() {
+		dmm.wakeLoop()
 	}
 }
@@ -0,0 +1,163 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/database"
+)
+
+const testRoomID = id.RoomID("!room:example.com")
+
+func newTestDisappearingMessagesManager(t *testing.T) *DisappearingMessagesManager {
+	rawDB, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = rawDB.Close() })
+	db := database.New(rawDB)
+	require.NoError(t, db.Upgrade())
+	return &DisappearingMessagesManager{
+		DB:                db,
+		Log:               zerolog.Nop(),
+		checkMessagesChan: make(chan struct{}, 1),
+	}
+}
+
+func addTestMessage(t *testing.T, dmm *DisappearingMessagesManager, eventID id.EventID, timestamp uint64) {
+	msg := dmm.DB.Message.New()
+	msg.Sender = uuid.New()
+	msg.Timestamp = timestamp
+	msg.SignalChatID = "chat"
+	msg.SignalReceiver = uuid.New()
+	msg.MXID = eventID
+	msg.RoomID = testRoomID
+	require.NoError(t, msg.Insert(context.Background()))
+	dmm.AddDisappearingMessage(context.Background(), eventID, testRoomID, time.Minute, time.Time{})
+}
+
+func woken(dmm *DisappearingMessagesManager) bool {
+	select {
+	case <-dmm.checkMessagesChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestStartTimersForRead(t *testing.T) {
+	ctx := context.Background()
+	dmm := newTestDisappearingMessagesManager(t)
+	addTestMessage(t, dmm, "$read", 1000)
+	addTestMessage(t, dmm, "$unread", 3000)
+	assert.False(t, woken(dmm), "unread messages shouldn't wake the loop")
+
+	readAt := time.UnixMilli(time.Now().Add(-time.Second).UnixMilli())
+	dmm.StartTimersForRead(ctx, testRoomID, 2000, readAt)
+	assert.True(t, woken(dmm))
+
+	read, err := dmm.DB.DisappearingMessage.GetByMXID(ctx, "$read")
+	require.NoError(t, err)
+	assert.Equal(t, readAt, read.ExpireStart)
+	assert.Equal(t, readAt.Add(time.Minute).Unix(), read.ExpireAt.Unix())
+	unread, err := dmm.DB.DisappearingMessage.GetByMXID(ctx, "$unread")
+	require.NoError(t, err)
+	assert.True(t, unread.ExpireAt.IsZero())
+
+	// Nothing new was read, so the loop doesn't need to check again
+	dmm.StartTimersForRead(ctx, testRoomID, 2000, readAt)
+	assert.False(t, woken(dmm))
+}
+
+func TestStartTimersForReadInFuture(t *testing.T) {
+	ctx := context.Background()
+	dmm := newTestDisappearingMessagesManager(t)
+	addTestMessage(t, dmm, "$read", 1000)
+
+	before := time.Now()
+	dmm.StartTimersForRead(ctx, testRoomID, 1000, before.Add(time.Hour))
+	read, err := dmm.DB.DisappearingMessage.GetByMXID(ctx, "$read")
+	require.NoError(t, err)
+	assert.False(t, read.ExpireStart.Before(before.Truncate(time.Millisecond)))
+	assert.False(t, read.ExpireStart.After(time.Now()), "read receipts from the future should start the timer now")
+}
+
+func TestStartTimersForReadEdit(t *testing.T) {
+	ctx := context.Background()
+	dmm := newTestDisappearingMessagesManager(t)
+	addTestMessage(t, dmm, "$original", 1000)
+	dmm.AddEdit(ctx, "$edit", "$original")
+	dmm.AddEdit(ctx, "$other-edit", "$not-disappearing")
+	assert.False(t, woken(dmm))
+
+	dmm.StartTimersForRead(ctx, testRoomID, 1000, time.Now())
+	assert.True(t, woken(dmm))
+	original, err := dmm.DB.DisappearingMessage.GetByMXID(ctx, "$original")
+	require.NoError(t, err)
+	edit, err := dmm.DB.DisappearingMessage.GetByMXID(ctx, "$edit")
+	require.NoError(t, err)
+	require.NotNil(t, edit)
+	assert.Equal(t, original.ExpireAt, edit.ExpireAt)
+	otherEdit, err := dmm.DB.DisappearingMessage.GetByMXID(ctx, "$other-edit")
+	require.NoError(t, err)
+	assert.Nil(t, otherEdit)
+
+	// Edits of messages whose timer already started are scheduled immediately
+	dmm.AddEdit(ctx, "$late-edit", "$original")
+	assert.True(t, woken(dmm))
+	lateEdit, err := dmm.DB.DisappearingMessage.GetByMXID(ctx, "$late-edit")
+	require.NoError(t, err)
+	assert.Equal(t, original.ExpireAt, lateEdit.ExpireAt)
+}
+
+func TestWakeLoopDoesNotBlock(t *testing.T) {
+	dmm := newTestDisappearingMessagesManager(t)
+	done := make(chan struct{})
+	go func() {
+		dmm.wakeLoop()
+		dmm.wakeLoop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wakeLoop blocked with a pending wakeup")
+	}
+	assert.True(t, woken(dmm))
+	assert.False(t, woken(dmm), "pending wakeups should be coalesced")
+}
+
+func TestDisappearingLoopWakesUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dmm := newTestDisappearingMessagesManager(t)
+	dmm.StartDisappearingLoop(ctx)
+	// Let the loop reach its select, then wake it up and check that it consumes the wakeup
+	require.Eventually(t, func() bool {
+		dmm.wakeLoop()
+		return len(dmm.checkMessagesChan) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -14,19 +14,22 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package signalmeow
+package main
 
 import (
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 )
 
-// Below is a lot of boilerplate to have a nice ADTish type for incoming Signal messages
+// Below is a lot of boilerplate to have a nice ADTish type for the Signal messages that portals bridge.
+// They're created from the events of signalmeow in signalevents.go.
 
 type IncomingSignalMessageBase struct {
 	// When uniquely identifiying a chat, use GroupID if it is not nil, otherwise use SenderUUID.
 	SenderUUID    string                          // Always the UUID of the sender of the message
 	RecipientUUID string                          // Usually our UUID, unless this is a message we sent on another device
-	GroupID       *GroupIdentifier                // Unique identifier for the group chat, or nil for 1:1 chats
+	GroupID       *signalmeow.GroupIdentifier     // Unique identifier for the group chat, or nil for 1:1 chats
 	Timestamp     uint64                          // With SenderUUID, treated as a unique identifier for a specific Signal message
 	PartIndex     int                             //
 	Quote         *IncomingSignalMessageQuoteData // If this message is a quote (reply), this will be non-nil
@@ -108,7 +111,7 @@ func (i IncomingSignalMessageText) Base() IncomingSignalMessageBase {
 type IncomingSignalMessageAttachment struct {
 	IncomingSignalMessageBase
 	Caption     string
-	Attachment  []byte
+	Attachment  *signalmeow.IncomingAttachment
 	Filename    string
 	ContentType string
 	Size        uint64
@@ -116,6 +119,11 @@ type IncomingSignalMessageAttachment struct {
 	Height      uint32
 	BlurHash    string
 
+	// Position of this attachment in the album it was sent in, and the total number of attachments.
+	// The album parts share the timestamp of the original message and only the first part has the caption.
+	AlbumIndex int
+	AlbumSize  int
+
 	CaptionRanges []*signalpb.BodyRange
 }
 
@@ -216,6 +224,9 @@ func (i IncomingSignalMessageExpireTimerChange) Base() IncomingSignalMessageBase
 // ** IncomingSignalMessageGroupChange **
 type IncomingSignalMessageGroupChange struct {
 	IncomingSignalMessageBase
+	// Change is the decrypted change if the group was updated from the group change log.
+	// If it's nil, the group was refetched and only the current state is known.
+	Change *events.GroupRevision
 }
 
 func (IncomingSignalMessageGroupChange) MessageType() IncomingSignalMessageType {
@@ -228,8 +239,8 @@ func (i IncomingSignalMessageGroupChange) Base() IncomingSignalMessageBase {
 // ** IncomingSignalMessageContactChange **
 type IncomingSignalMessageContactChange struct {
 	IncomingSignalMessageBase
-	Contact Contact
-	Avatar  *ContactAvatar
+	Contact *signalpb.ContactDetails
+	Avatar  *signalmeow.ContactAvatar
 }
 
 func (IncomingSignalMessageContactChange) MessageType() IncomingSignalMessageType {
@@ -250,6 +261,11 @@ type IncomingSignalMessageContactCard struct {
 	Emails       []string
 	Addresses    []string
 	Organization string
+
+	// The original contact, for converting into other formats like vCard
+	Contact           *signalpb.DataMessage_Contact
+	Avatar            []byte
+	AvatarContentType string
 }
 
 func (IncomingSignalMessageContactCard) MessageType() IncomingSignalMessageType {
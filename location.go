@@ -0,0 +1,262 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const locationMapZoom = 15
+
+// Signal clients share locations as a plain text message with the name and address of the place
+// on their own lines (both optional), followed by a Google Maps link on the last line.
+var signalLocationURLRegex = regexp.MustCompile(`^https://maps\.google\.com/maps\?q=(-?\d{1,3}(?:\.\d+)?)(?:%2C|,)(-?\d{1,3}(?:\.\d+)?)$`)
+
+const signalLocationMaxDescriptionLines = 2
+
+func parseGeoURI(uri string) (lat, long float64, err error) {
+	if !strings.HasPrefix(uri, "geo:") {
+		return 0, 0, fmt.Errorf("%w: missing geo: prefix", errInvalidGeoURI)
+	}
+	coordinates := strings.TrimPrefix(uri, "geo:")
+	// Strip the optional uncertainty and other parameters
+	if paramIndex := strings.IndexRune(coordinates, ';'); paramIndex >= 0 {
+		coordinates = coordinates[:paramIndex]
+	}
+	parts := strings.Split(coordinates, ",")
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("%w: expected at least two coordinates", errInvalidGeoURI)
+	}
+	lat, err = strconv.ParseFloat(parts[0], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, fmt.Errorf("%w: invalid latitude %q", errInvalidGeoURI, parts[0])
+	}
+	long, err = strconv.ParseFloat(parts[1], 64)
+	if err != nil || long < -180 || long > 180 {
+		return 0, 0, fmt.Errorf("%w: invalid longitude %q", errInvalidGeoURI, parts[1])
+	}
+	return lat, long, nil
+}
+
+func formatGeoURI(lat, long float64) string {
+	return fmt.Sprintf("geo:%s,%s", formatCoordinate(lat), formatCoordinate(long))
+}
+
+func formatCoordinate(coord float64) string {
+	return strconv.FormatFloat(coord, 'f', -1, 64)
+}
+
+func signalLocationURL(lat, long float64) string {
+	return fmt.Sprintf("https://maps.google.com/maps?q=%s%%2C%s", formatCoordinate(lat), formatCoordinate(long))
+}
+
+// parseSignalLocation checks if a text message from Signal is a location share,
+// and returns the description and coordinates if it is. Only messages in the exact format that
+// Signal clients generate count, so that normal messages which happen to end in a map link keep
+// their text and formatting.
+func parseSignalLocation(text string, ranges []*signalpb.BodyRange) (description string, lat, long float64, ok bool) {
+	if len(ranges) > 0 {
+		// Location shares never have formatting or mentions
+		return "", 0, 0, false
+	}
+	lines := strings.Split(text, "\n")
+	descriptionLines := lines[:len(lines)-1]
+	if len(descriptionLines) > signalLocationMaxDescriptionLines {
+		return "", 0, 0, false
+	}
+	for _, line := range descriptionLines {
+		if strings.TrimSpace(line) == "" {
+			return "", 0, 0, false
+		}
+	}
+	match := signalLocationURLRegex.FindStringSubmatch(lines[len(lines)-1])
+	if match == nil {
+		return "", 0, 0, false
+	}
+	var err error
+	lat, err = strconv.ParseFloat(match[1], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return "", 0, 0, false
+	}
+	long, err = strconv.ParseFloat(match[2], 64)
+	if err != nil || long < -180 || long > 180 {
+		return "", 0, 0, false
+	}
+	return strings.Join(descriptionLines, "\n"), lat, long, true
+}
+
+// signalLocationDescription fits a Matrix location description into the lines available in Signal's format.
+func signalLocationDescription(description string) string {
+	var lines []string
+	for _, line := range strings.Split(description, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > signalLocationMaxDescriptionLines {
+		lines = append(lines[:signalLocationMaxDescriptionLines-1], strings.Join(lines[signalLocationMaxDescriptionLines-1:], ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (portal *Portal) convertMatrixLocation(ctx context.Context, sender *User, content *event.MessageEventContent) (*signalmeow.SignalContent, error) {
+	lat, long, err := parseGeoURI(content.GeoURI)
+	if err != nil {
+		return nil, err
+	}
+	mapURL := signalLocationURL(lat, long)
+	description := content.Body
+	// Most clients put the geo URI in the body, which isn't useful to Signal users
+	if strings.Contains(description, "geo:") {
+		description = ""
+	}
+	// Use the same format as Signal clients, so other bridges can recognize the location too
+	body := mapURL
+	if description = signalLocationDescription(description); description != "" {
+		body = description + "\n" + mapURL
+	}
+	outgoingMessage := signalmeow.DataMessageForText(body, nil)
+
+	if portal.bridge.Config.Bridge.LocationTileURL == "" {
+		return outgoingMessage, nil
+	}
+	thumbnail, bounds, err := portal.renderLocationThumbnail(ctx, lat, long)
+	if err != nil {
+		// The map link is still useful on its own, so don't fail the whole message
+		portal.log.Warn().Err(err).Msg("Failed to render static map for location message")
+		return outgoingMessage, nil
+	}
+	attachmentPointer, err := sender.Client.UploadAttachment(ctx, thumbnail, "image/png", "map.png")
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to upload static map for location message")
+		return outgoingMessage, nil
+	}
+	attachmentPointer.Width = proto.Uint32(uint32(bounds.Dx()))
+	attachmentPointer.Height = proto.Uint32(uint32(bounds.Dy()))
+	title := description
+	if title == "" {
+		title = "Location"
+	}
+	outgoingMessage.DataMessage.Preview = []*signalpb.Preview{{
+		Url:   proto.String(mapURL),
+		Title: proto.String(title),
+		Image: (*signalpb.AttachmentPointer)(attachmentPointer),
+	}}
+	return outgoingMessage, nil
+}
+
+// maxMercatorLatitude is the latitude where the Web Mercator projection is cut off to make the map square.
+const maxMercatorLatitude = 85.05112878
+
+// locationTilePosition projects the given coordinates to Web Mercator tile coordinates at the given zoom level.
+// The integer parts are the tile that contains the position, the fractional parts are the position within it.
+func locationTilePosition(lat, long float64, zoom int) (x, y float64) {
+	// The projection goes to infinity at the poles, so positions beyond the edge of the map are drawn on the edge
+	lat = math.Max(-maxMercatorLatitude, math.Min(maxMercatorLatitude, lat))
+	n := math.Exp2(float64(zoom))
+	// Keep the far edges within the last tile rather than in a tile that doesn't exist
+	maxPos := math.Nextafter(n, 0)
+	x = math.Max(0, math.Min(maxPos, (long+180)/360*n))
+	latRad := lat * math.Pi / 180
+	y = (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n
+	y = math.Max(0, math.Min(maxPos, y))
+	return x, y
+}
+
+// renderLocationThumbnail fetches the map tile containing the given coordinates
+// from the configured tile source and draws a marker on the exact position.
+func (portal *Portal) renderLocationThumbnail(ctx context.Context, lat, long float64) ([]byte, image.Rectangle, error) {
+	x, y := locationTilePosition(lat, long, locationMapZoom)
+	tileX, tileY := int(math.Floor(x)), int(math.Floor(y))
+
+	tileURL := strings.NewReplacer(
+		"{z}", strconv.Itoa(locationMapZoom),
+		"{x}", strconv.Itoa(tileX),
+		"{y}", strconv.Itoa(tileY),
+	).Replace(portal.bridge.Config.Bridge.LocationTileURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tileURL, nil)
+	if err != nil {
+		return nil, image.Rectangle{}, fmt.Errorf("failed to prepare tile request: %w", err)
+	}
+	req.Header.Set("User-Agent", portal.bridge.Name+"/"+portal.bridge.Version)
+	resp, err := portal.bridge.AS.HTTPClient.Do(req)
+	if err != nil {
+		return nil, image.Rectangle{}, fmt.Errorf("failed to fetch map tile: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, image.Rectangle{}, fmt.Errorf("unexpected status code %d fetching map tile", resp.StatusCode)
+	}
+	tileData, err := io.ReadAll(io.LimitReader(resp.Body, 4*1024*1024))
+	if err != nil {
+		return nil, image.Rectangle{}, fmt.Errorf("failed to read map tile: %w", err)
+	}
+	tile, _, err := image.Decode(bytes.NewReader(tileData))
+	if err != nil {
+		return nil, image.Rectangle{}, fmt.Errorf("failed to decode map tile: %w", err)
+	}
+
+	bounds := tile.Bounds()
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, tile, bounds.Min, draw.Src)
+	markerX := bounds.Min.X + int((x-float64(tileX))*float64(bounds.Dx()))
+	markerY := bounds.Min.Y + int((y-float64(tileY))*float64(bounds.Dy()))
+	drawLocationMarker(canvas, markerX, markerY)
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, canvas)
+	if err != nil {
+		return nil, image.Rectangle{}, fmt.Errorf("failed to encode static map: %w", err)
+	}
+	return buf.Bytes(), bounds, nil
+}
+
+func drawLocationMarker(img *image.RGBA, centerX, centerY int) {
+	const outerRadius = 9
+	const innerRadius = 6
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	red := color.RGBA{R: 220, G: 40, B: 40, A: 255}
+	for dy := -outerRadius; dy <= outerRadius; dy++ {
+		for dx := -outerRadius; dx <= outerRadius; dx++ {
+			distSquared := dx*dx + dy*dy
+			if distSquared <= innerRadius*innerRadius {
+				img.SetRGBA(centerX+dx, centerY+dy, red)
+			} else if distSquared <= outerRadius*outerRadius {
+				img.SetRGBA(centerX+dx, centerY+dy, white)
+			}
+		}
+	}
+}
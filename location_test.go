@@ -0,0 +1,134 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func TestParseGeoURI(t *testing.T) {
+	lat, long, err := parseGeoURI("geo:60.1699,24.9384")
+	require.NoError(t, err)
+	assert.Equal(t, 60.1699, lat)
+	assert.Equal(t, 24.9384, long)
+
+	lat, long, err = parseGeoURI("geo:-33.8568,151.2153,12;u=35")
+	require.NoError(t, err)
+	assert.Equal(t, -33.8568, lat)
+	assert.Equal(t, 151.2153, long)
+
+	for _, uri := range []string{
+		"60.1699,24.9384",
+		"geo:60.1699",
+		"geo:91,24.9384",
+		"geo:60.1699,-181",
+		"geo:north,east",
+	} {
+		_, _, err = parseGeoURI(uri)
+		assert.ErrorIs(t, err, errInvalidGeoURI, uri)
+	}
+}
+
+func TestFormatGeoURIRoundTrip(t *testing.T) {
+	lat, long, err := parseGeoURI(formatGeoURI(-33.8568, 151.2153))
+	require.NoError(t, err)
+	assert.Equal(t, -33.8568, lat)
+	assert.Equal(t, 151.2153, long)
+}
+
+func TestParseSignalLocation(t *testing.T) {
+	description, lat, long, ok := parseSignalLocation("Helsinki Central Station\nKaivokatu 1, Helsinki\nhttps://maps.google.com/maps?q=60.1712%2C24.9413", nil)
+	require.True(t, ok)
+	assert.Equal(t, "Helsinki Central Station\nKaivokatu 1, Helsinki", description)
+	assert.Equal(t, 60.1712, lat)
+	assert.Equal(t, 24.9413, long)
+
+	description, lat, long, ok = parseSignalLocation("https://maps.google.com/maps?q=-33.8568,151.2153", nil)
+	require.True(t, ok)
+	assert.Empty(t, description)
+	assert.Equal(t, -33.8568, lat)
+	assert.Equal(t, 151.2153, long)
+
+	description, _, _, ok = parseSignalLocation(signalLocationURL(60.1712, 24.9413), nil)
+	require.True(t, ok)
+	assert.Empty(t, description)
+}
+
+func TestParseSignalLocationRejectsOtherMessages(t *testing.T) {
+	const mapURL = "https://maps.google.com/maps?q=60.1712%2C24.9413"
+	for name, text := range map[string]string{
+		"inline link":       "meet me here " + mapURL,
+		"trailing text":     mapURL + " see you there",
+		"trailing newline":  "Station\n" + mapURL + "\n",
+		"too many lines":    "Let's meet at\nthe station\nKaivokatu 1\n" + mapURL,
+		"blank line":        "Station\n\n" + mapURL,
+		"latitude range":    "https://maps.google.com/maps?q=95%2C24.9413",
+		"longitude range":   "https://maps.google.com/maps?q=60.1712%2C-190",
+		"other maps link":   "https://www.google.com/maps/place/60.1712,24.9413",
+		"extra query param": mapURL + "&z=15",
+	} {
+		_, _, _, ok := parseSignalLocation(text, nil)
+		assert.False(t, ok, name)
+	}
+
+	ranges := []*signalpb.BodyRange{{
+		Start:           proto.Uint32(0),
+		Length:          proto.Uint32(7),
+		AssociatedValue: &signalpb.BodyRange_Style_{Style: signalpb.BodyRange_BOLD},
+	}}
+	_, _, _, ok := parseSignalLocation("Station\n"+mapURL, ranges)
+	assert.False(t, ok)
+}
+
+func TestSignalLocationDescription(t *testing.T) {
+	assert.Equal(t, "", signalLocationDescription(" \n "))
+	assert.Equal(t, "Station\nKaivokatu 1", signalLocationDescription("Station\n\n Kaivokatu 1 "))
+	assert.Equal(t, "Station\nKaivokatu 1, Helsinki", signalLocationDescription("Station\nKaivokatu 1\nHelsinki"))
+}
+
+func TestLocationTilePosition(t *testing.T) {
+	x, y := locationTilePosition(0, 0, 1)
+	assert.InDelta(t, 1, x, 1e-9)
+	assert.InDelta(t, 1, y, 1e-9)
+	x, y = locationTilePosition(60.1699, 24.9384, 15)
+	assert.Equal(t, 18653, int(x))
+	assert.Equal(t, 9484, int(y))
+
+	// The poles are drawn on the top and bottom edges of the map instead of going to infinity
+	for _, zoom := range []int{0, 15} {
+		n := math.Exp2(float64(zoom))
+		x, y = locationTilePosition(90, 180, zoom)
+		assert.False(t, math.IsNaN(y) || math.IsInf(y, 0))
+		assert.Equal(t, 0, int(math.Floor(y)))
+		assert.Equal(t, int(n)-1, int(math.Floor(x)))
+		x, y = locationTilePosition(-90, -180, zoom)
+		assert.False(t, math.IsNaN(y) || math.IsInf(y, 0))
+		assert.Equal(t, int(n)-1, int(math.Floor(y)))
+		assert.Equal(t, 0, int(math.Floor(x)))
+		_, top := locationTilePosition(maxMercatorLatitude, 0, zoom)
+		_, bottom := locationTilePosition(-maxMercatorLatitude, 0, zoom)
+		assert.InDelta(t, 0, top, 1e-6)
+		assert.InDelta(t, n, bottom, 1e-6)
+	}
+}
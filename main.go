@@ -39,6 +39,7 @@ import (
 	"go.mau.fi/mautrix-signal/msgconv/matrixfmt"
 	"go.mau.fi/mautrix-signal/msgconv/signalfmt"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
 )
 
 //go:embed example-config.yaml
@@ -59,6 +60,8 @@ type SignalBridge struct {
 	DB        *database.Database
 	Metrics   *MetricsHandler
 	MeowStore *signalmeow.StoreContainer
+	// WebClient talks to the Signal servers configured in the signal section of the config
+	WebClient *web.Client
 
 	provisioning *ProvisioningAPI
 
@@ -79,6 +82,7 @@ type SignalBridge struct {
 	puppetsLock         sync.Mutex
 
 	disappearingMessagesManager *DisappearingMessagesManager
+	mediaRetryManager           *MediaRetryManager
 }
 
 var _ bridge.ChildOverride = (*SignalBridge)(nil)
@@ -99,8 +103,14 @@ func (br *SignalBridge) Init() {
 	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
 	br.RegisterCommands()
 
-	signalmeow.SetLogger(br.ZLog.With().Str("component", "signalmeow").Logger().Level(zerolog.DebugLevel))
+	signalmeow.SetLogger(br.ZLog.With().Str("component", "libsignal").Logger().Level(zerolog.DebugLevel))
 	//signalmeow.SetLogger(br.ZLog.With().Str("component", "signalmeow").Caller().Logger())
+	var err error
+	br.WebClient, err = web.NewClient(br.Config.Signal.WebConfig())
+	if err != nil {
+		br.Log.Fatalln("Invalid Signal connection config:", err)
+		os.Exit(11)
+	}
 
 	br.DB = database.New(br.Bridge.DB)
 	br.MeowStore = signalmeow.NewStore(br.Bridge.DB, dbutil.ZeroLogger(br.ZLog.With().Str("db_section", "signalmeow").Logger()))
@@ -114,9 +124,11 @@ func (br *SignalBridge) Init() {
 		Log:    br.ZLog.With().Str("component", "disappearing messages").Logger(),
 		Bridge: br,
 	}
+	br.mediaRetryManager = NewMediaRetryManager(br.DB, br.ZLog.With().Str("component", "media retry").Logger(), br)
 
 	br.Metrics = NewMetricsHandler(br.Config.Metrics.Listen, br.Log.Sub("Metrics"), br.DB)
 	br.MatrixHandler.TrackEventDuration = br.Metrics.TrackMatrixEvent
+	br.EventProcessor.On(TypeDisappearingTimer, br.HandleDisappearingTimerEvent)
 
 	signalFormatParams = &signalfmt.FormatParams{
 		GetUserInfo: func(u uuid.UUID) signalfmt.UserInfo {
@@ -151,8 +163,6 @@ func (br *SignalBridge) Init() {
 			return uuid.Nil
 		},
 	}
-
-	signalmeow.HackyCaptionToggle = br.Config.Bridge.CaptionInMessage
 }
 
 func (br *SignalBridge) logLostPortals(ctx context.Context) {
@@ -186,10 +196,12 @@ func (br *SignalBridge) Start() {
 		br.provisioning.Init()
 	}
 	go br.StartUsers()
+	go br.WakeOutboxes(context.TODO(), false)
 	if br.Config.Metrics.Enabled {
 		go br.Metrics.Start()
 	}
 	go br.disappearingMessagesManager.StartDisappearingLoop(context.TODO())
+	go br.mediaRetryManager.StartRetryLoop(context.TODO())
 }
 
 func (br *SignalBridge) Stop() {
@@ -0,0 +1,235 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/database"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const (
+	mediaRetryInitialDelay = 1 * time.Minute
+	mediaRetryMaxDelay     = 6 * time.Hour
+	// After this many automatic attempts, the attachment can only be retried with the retry-media command
+	mediaRetryMaxAttempts = 10
+)
+
+// MediaRetryManager keeps track of attachments that failed to download from Signal and retries
+// them in the background. When a retry succeeds, the placeholder notice is edited into the media.
+type MediaRetryManager struct {
+	DB           *database.Database
+	Log          zerolog.Logger
+	Bridge       *SignalBridge
+	checkNowChan chan struct{}
+}
+
+func NewMediaRetryManager(db *database.Database, log zerolog.Logger, bridge *SignalBridge) *MediaRetryManager {
+	return &MediaRetryManager{
+		DB:     db,
+		Log:    log,
+		Bridge: bridge,
+		// Created here rather than in StartRetryLoop, as attachments can fail before the loop is started
+		checkNowChan: make(chan struct{}, 1),
+	}
+}
+
+func mediaRetryDelay(attempts int) time.Duration {
+	delay := mediaRetryInitialDelay
+	for i := 1; i < attempts && delay < mediaRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > mediaRetryMaxDelay {
+		delay = mediaRetryMaxDelay
+	}
+	return delay
+}
+
+// isRetryableMediaError checks if retrying the download could help. Attachments that are too large
+// or fail integrity checks will fail the same way every time.
+func isRetryableMediaError(err error) bool {
+	return errors.Is(err, errMediaDownloadFailed) &&
+		!errors.Is(err, signalmeow.ErrInvalidDigestForAttachment) &&
+		!errors.Is(err, signalmeow.ErrInvalidMACForAttachment) &&
+		!errors.Is(err, signalmeow.ErrInvalidPaddingForAttachment)
+}
+
+func (mrm *MediaRetryManager) AddFailedAttachment(ctx context.Context, roomID id.RoomID, placeholder id.EventID, sender uuid.UUID, content *event.MessageEventContent, pointer *signalpb.AttachmentPointer, downloadErr error) {
+	log := zerolog.Ctx(ctx).With().Str("placeholder_event_id", placeholder.String()).Logger()
+	pointerBytes, err := proto.Marshal(pointer)
+	if err != nil {
+		log.Err(err).Msg("Failed to marshal attachment pointer for retrying")
+		return
+	}
+	failed := mrm.DB.FailedAttachment.New()
+	failed.MXID = placeholder
+	failed.RoomID = roomID
+	failed.Sender = sender
+	failed.Content = content
+	failed.Pointer = pointerBytes
+	failed.Attempts = 1
+	failed.NextAttempt = time.Now().Add(mediaRetryDelay(failed.Attempts))
+	failed.LastError = downloadErr.Error()
+	err = failed.Insert(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to save failed attachment to database")
+		return
+	}
+	log.Debug().Time("next_attempt", failed.NextAttempt).Msg("Scheduled retry for failed attachment")
+	mrm.checkNow()
+}
+
+func (mrm *MediaRetryManager) checkNow() {
+	select {
+	case mrm.checkNowChan <- struct{}{}:
+	default:
+	}
+}
+
+func (mrm *MediaRetryManager) StartRetryLoop(ctx context.Context) {
+	go func() {
+		log := mrm.Log.With().Str("action", "loop").Logger()
+		ctx = log.WithContext(ctx)
+		for {
+			mrm.retryDueAttachments(ctx)
+
+			duration := 10 * time.Minute // Check again in 10 minutes just in case
+			next, err := mrm.DB.FailedAttachment.GetNextScheduled(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Err(err).Msg("Failed to get next failed attachment")
+			} else if next != nil {
+				duration = time.Until(next.NextAttempt)
+			}
+
+			select {
+			case <-time.After(duration):
+			case <-mrm.checkNowChan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (mrm *MediaRetryManager) retryDueAttachments(ctx context.Context) {
+	due, err := mrm.DB.FailedAttachment.GetDue(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get failed attachments to retry")
+		return
+	}
+	for _, failed := range due {
+		_ = mrm.Retry(ctx, failed)
+	}
+}
+
+// RetryRoom immediately retries all failed attachments in the given room.
+func (mrm *MediaRetryManager) RetryRoom(ctx context.Context, roomID id.RoomID) (succeeded, failed int, err error) {
+	attachments, err := mrm.DB.FailedAttachment.GetAllForRoom(ctx, roomID)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, attachment := range attachments {
+		if mrm.Retry(ctx, attachment) == nil {
+			succeeded++
+		} else {
+			failed++
+		}
+	}
+	return
+}
+
+// Retry tries to download a failed attachment again. If it succeeds, the placeholder is edited
+// to contain the media and the attachment is removed from the database. Otherwise, the next
+// attempt is scheduled with exponential backoff.
+func (mrm *MediaRetryManager) Retry(ctx context.Context, failed *database.FailedAttachment) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("room_id", failed.RoomID.String()).
+		Str("placeholder_event_id", failed.MXID.String()).
+		Int("attempt", failed.Attempts+1).
+		Logger()
+	err := mrm.retry(ctx, failed)
+	if err == nil {
+		log.Info().Msg("Successfully bridged previously failed attachment")
+		err = failed.Delete(ctx)
+		if err != nil {
+			log.Err(err).Msg("Failed to delete failed attachment from database")
+		}
+		return nil
+	}
+
+	failed.Attempts++
+	failed.LastError = err.Error()
+	if !isRetryableMediaError(err) || failed.Attempts >= mediaRetryMaxAttempts {
+		failed.NextAttempt = time.Time{}
+	} else {
+		failed.NextAttempt = time.Now().Add(mediaRetryDelay(failed.Attempts))
+	}
+	log.Warn().Err(err).Time("next_attempt", failed.NextAttempt).Msg("Failed to retry attachment download")
+	if dbErr := failed.Update(ctx); dbErr != nil {
+		log.Err(dbErr).Msg("Failed to update failed attachment in database")
+	}
+	return err
+}
+
+func (mrm *MediaRetryManager) retry(ctx context.Context, failed *database.FailedAttachment) error {
+	portal := mrm.Bridge.GetPortalByMXID(failed.RoomID)
+	if portal == nil {
+		return errors.New("portal not found")
+	}
+	var pointer signalpb.AttachmentPointer
+	err := proto.Unmarshal(failed.Pointer, &pointer)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal attachment pointer: %w", err)
+	}
+	puppet := mrm.Bridge.GetPuppetBySignalID(failed.Sender)
+	if puppet == nil {
+		return errors.New("sender puppet not found")
+	}
+	intent := puppet.IntentFor(portal)
+
+	content := failed.Content
+	if content.Info == nil {
+		content.Info = &event.FileInfo{}
+	}
+	err = portal.downloadAndUploadSignalAttachment(intent, &signalmeow.IncomingAttachment{Pointer: &pointer}, content)
+	if err != nil {
+		return err
+	}
+	// Replies can't be changed with edits
+	content.RelatesTo = nil
+	content.SetEdit(failed.MXID)
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, content, nil, 0)
+	if err != nil {
+		return fmt.Errorf("failed to send edit: %w", err)
+	}
+	mrm.Bridge.disappearingMessagesManager.AddEdit(ctx, resp.EventID, failed.MXID)
+	return nil
+}
@@ -37,11 +37,13 @@ var (
 	errMNoticeDisabled             = errors.New("bridging m.notice messages is disabled")
 	errUnexpectedParsedContentType = errors.New("unexpected parsed content type")
 	errInvalidGeoURI               = errors.New("invalid `geo:` URI in message")
+	errInvalidVCard                = errors.New("invalid vCard in message")
 	errUnknownMsgType              = errors.New("unknown msgtype")
 	errMediaDownloadFailed         = errors.New("failed to download media")
 	errMediaDecryptFailed          = errors.New("failed to decrypt media")
 	errMediaConvertFailed          = errors.New("failed to convert media")
 	errMediaUnsupportedType        = errors.New("unsupported media type")
+	errMediaTooLarge               = errors.New("media is too large")
 	errTargetNotFound              = errors.New("target event not found")
 	errReactionDatabaseNotFound    = errors.New("reaction database entry not found")
 	errReactionTargetNotFound      = errors.New("reaction target message not found")
@@ -60,11 +62,14 @@ var (
 	errBroadcastSendDisabled         = errors.New("sending status messages is disabled")
 
 	errMessageTakingLong     = errors.New("bridging the message is taking longer than usual")
+	errMessageQueued         = errors.New("sending the message failed, it will be retried automatically")
 	errTimeoutBeforeHandling = errors.New("message timed out before handling was started")
 )
 
 func errorToStatusReason(err error) (reason event.MessageStatusReason, status event.MessageStatus, isCertain, sendNotice bool, humanMessage string) {
 	switch {
+	case errors.Is(err, errMessageQueued):
+		return event.MessageStatusGenericError, event.MessageStatusPending, false, false, "sending the message failed, it will be retried automatically"
 	case errors.Is(err, errUnexpectedParsedContentType),
 		errors.Is(err, errUnknownMsgType),
 		errors.Is(err, errInvalidGeoURI),
@@ -74,6 +79,7 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 	case errors.Is(err, errMNoticeDisabled):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, false, ""
 	case errors.Is(err, errMediaUnsupportedType),
+		errors.Is(err, errMediaTooLarge),
 		errors.Is(err, errPollMissingQuestion),
 		errors.Is(err, errPollDuplicateOption),
 		errors.Is(err, errEditDifferentSender),
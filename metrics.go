@@ -32,6 +32,7 @@ import (
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-signal/database"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
 )
 
 type MetricsHandler struct {
@@ -59,6 +60,17 @@ type MetricsHandler struct {
 	unencryptedGroupCount   prometheus.Gauge
 	unencryptedPrivateCount prometheus.Gauge
 
+	signalDecryption      *prometheus.CounterVec
+	signalSend            *prometheus.HistogramVec
+	signalGroupFanOut     prometheus.Histogram
+	signalPreKeysMin      *prometheus.GaugeVec
+	signalPreKeysLow      *prometheus.GaugeVec
+	preKeyCounts          map[preKeyCountKey]preKeyCount
+	preKeyCountsLock      sync.Mutex
+	websocketReconnects   *prometheus.CounterVec
+	websocketRequests     *prometheus.HistogramVec
+	attachmentTransferred *prometheus.CounterVec
+
 	connected          prometheus.Gauge
 	connectedState     map[string]bool
 	connectedStateLock sync.Mutex
@@ -135,6 +147,41 @@ func NewMetricsHandler(address string, log log.Logger, db *database.Database) *M
 			Help: "Bridge users connected to Signal",
 		}),
 		connectedState: make(map[string]bool),
+
+		signalDecryption: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "signal_decrypted_envelopes_total",
+			Help: "Number of incoming Signal envelopes by type and decryption result",
+		}, []string{"envelope_type", "result"}),
+		signalSend: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "signal_message_send",
+			Help: "Time spent sending messages to Signal by sealed sender use and response status",
+		}, []string{"sealed_sender", "status"}),
+		signalGroupFanOut: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "signal_group_send_recipients",
+			Help:    "Number of recipients group messages are sent to",
+			Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+		}),
+		signalPreKeysMin: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "signal_prekeys_remaining_min",
+			Help: "Lowest number of one-time prekeys left on the Signal server for any account",
+		}, []string{"identity", "key_type"}),
+		signalPreKeysLow: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "signal_prekeys_low_accounts",
+			Help: "Number of accounts with few one-time prekeys left on the Signal server",
+		}, []string{"identity", "key_type"}),
+		preKeyCounts: make(map[preKeyCountKey]preKeyCount),
+		websocketReconnects: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "signal_websocket_reconnects_total",
+			Help: "Number of times a Signal websocket has reconnected",
+		}, []string{"websocket"}),
+		websocketRequests: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "signal_websocket_request",
+			Help: "Round-trip time of requests sent over Signal websockets",
+		}, []string{"websocket", "status"}),
+		attachmentTransferred: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "signal_attachment_bytes_total",
+			Help: "Number of encrypted attachment bytes transferred to and from the Signal CDN",
+		}, []string{"direction"}),
 	}
 }
 
@@ -226,6 +273,130 @@ func (mh *MetricsHandler) TrackConnectionState(signalID string, connected bool)
 	}
 }
 
+func (mh *MetricsHandler) DecryptedEnvelope(envelopeType string, errorClass string) {
+	if !mh.running {
+		return
+	}
+	result := errorClass
+	if result == "" {
+		result = "success"
+	}
+	mh.signalDecryption.With(prometheus.Labels{"envelope_type": envelopeType, "result": result}).Inc()
+}
+
+func (mh *MetricsHandler) SentMessage(sealedSender bool, status int, duration time.Duration) {
+	if !mh.running {
+		return
+	}
+	mh.signalSend.With(prometheus.Labels{
+		"sealed_sender": strconv.FormatBool(sealedSender),
+		"status":        strconv.Itoa(status),
+	}).Observe(duration.Seconds())
+}
+
+func (mh *MetricsHandler) SentGroupMessage(recipients int) {
+	if !mh.running {
+		return
+	}
+	mh.signalGroupFanOut.Observe(float64(recipients))
+}
+
+const (
+	// Accounts with fewer one-time prekeys than this are counted in signal_prekeys_low_accounts
+	preKeyLowThreshold = 20
+	// Counts that haven't been reported for this long belong to accounts that were logged out or removed.
+	// signalmeow checks the counts of connected accounts every hour.
+	preKeyCountExpiry = 3 * time.Hour
+)
+
+type preKeyCountKey struct {
+	aciUUID  string
+	uuidKind signalmeow.UUIDKind
+}
+
+type preKeyCount struct {
+	ec, kyber int
+	updatedAt time.Time
+}
+
+// PreKeysRemaining remembers the counts of every account, but only exports the lowest count
+// and the number of accounts running low, so that account identifiers don't end up in labels.
+func (mh *MetricsHandler) PreKeysRemaining(aciUUID string, uuidKind signalmeow.UUIDKind, ecCount, kyberCount int) {
+	if !mh.running {
+		return
+	}
+	mh.preKeyCountsLock.Lock()
+	defer mh.preKeyCountsLock.Unlock()
+	now := time.Now()
+	mh.preKeyCounts[preKeyCountKey{aciUUID, uuidKind}] = preKeyCount{ec: ecCount, kyber: kyberCount, updatedAt: now}
+
+	for _, kind := range []signalmeow.UUIDKind{signalmeow.UUID_KIND_ACI, signalmeow.UUID_KIND_PNI} {
+		minEC, minKyber := -1, -1
+		var lowEC, lowKyber int
+		for key, count := range mh.preKeyCounts {
+			if now.Sub(count.updatedAt) > preKeyCountExpiry {
+				delete(mh.preKeyCounts, key)
+				continue
+			} else if key.uuidKind != kind {
+				continue
+			}
+			if minEC < 0 || count.ec < minEC {
+				minEC = count.ec
+			}
+			if minKyber < 0 || count.kyber < minKyber {
+				minKyber = count.kyber
+			}
+			if count.ec < preKeyLowThreshold {
+				lowEC++
+			}
+			if count.kyber < preKeyLowThreshold {
+				lowKyber++
+			}
+		}
+		ecLabels := prometheus.Labels{"identity": string(kind), "key_type": "ec"}
+		kyberLabels := prometheus.Labels{"identity": string(kind), "key_type": "kyber"}
+		if minEC < 0 {
+			mh.signalPreKeysMin.Delete(ecLabels)
+			mh.signalPreKeysMin.Delete(kyberLabels)
+		} else {
+			mh.signalPreKeysMin.With(ecLabels).Set(float64(minEC))
+			mh.signalPreKeysMin.With(kyberLabels).Set(float64(minKyber))
+		}
+		mh.signalPreKeysLow.With(ecLabels).Set(float64(lowEC))
+		mh.signalPreKeysLow.With(kyberLabels).Set(float64(lowKyber))
+	}
+}
+
+func (mh *MetricsHandler) AttachmentTransfer(upload bool, bytes int64) {
+	if !mh.running {
+		return
+	}
+	direction := "download"
+	if upload {
+		direction = "upload"
+	}
+	mh.attachmentTransferred.With(prometheus.Labels{"direction": direction}).Add(float64(bytes))
+}
+
+func (mh *MetricsHandler) WebsocketReconnect(name string) {
+	if !mh.running {
+		return
+	}
+	mh.websocketReconnects.With(prometheus.Labels{"websocket": name}).Inc()
+}
+
+func (mh *MetricsHandler) WebsocketRequest(name string, status int, roundTrip time.Duration) {
+	if !mh.running {
+		return
+	}
+	mh.websocketRequests.With(prometheus.Labels{
+		"websocket": name,
+		"status":    strconv.Itoa(status),
+	}).Observe(roundTrip.Seconds())
+}
+
+var _ signalmeow.Metrics = (*MetricsHandler)(nil)
+
 func (mh *MetricsHandler) updateStats() {
 	start := time.Now()
 	var puppetCount int
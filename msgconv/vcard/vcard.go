@@ -0,0 +1,375 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2023 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package vcard converts between vCard files and Signal contact card messages.
+package vcard
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+var (
+	ErrNoCard        = errors.New("no vCard found in file")
+	ErrMultipleCards = errors.New("file contains more than one vCard")
+)
+
+// Avatar is a photo embedded in a vCard.
+type Avatar struct {
+	Data     []byte
+	MimeType string
+}
+
+type property struct {
+	name   string
+	params map[string][]string
+	value  string
+}
+
+func (p *property) hasType(typ string) bool {
+	for _, t := range p.params["TYPE"] {
+		if strings.EqualFold(t, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// unfoldLines splits the file into logical lines, joining folded continuation lines.
+func unfoldLines(data string) []string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	var lines []string
+	for _, line := range strings.Split(data, "\n") {
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func parseProperty(line string) (prop property, ok bool) {
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return
+	}
+	prop.value = line[colon+1:]
+	nameAndParams := strings.Split(line[:colon], ";")
+	prop.name = strings.ToUpper(nameAndParams[0])
+	// Strip group prefixes like "item1.TEL"
+	if dot := strings.LastIndexByte(prop.name, '.'); dot >= 0 {
+		prop.name = prop.name[dot+1:]
+	}
+	prop.params = make(map[string][]string)
+	for _, param := range nameAndParams[1:] {
+		key, value, found := strings.Cut(param, "=")
+		if !found {
+			// vCard 2.1 allows bare types like TEL;CELL:...
+			key, value = "TYPE", param
+		}
+		key = strings.ToUpper(key)
+		for _, v := range strings.Split(value, ",") {
+			prop.params[key] = append(prop.params[key], strings.Trim(v, `"`))
+		}
+	}
+	return prop, true
+}
+
+// splitComponents splits a structured value on unescaped semicolons and unescapes each component.
+func splitComponents(value string) []string {
+	var parts []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			if r == 'n' || r == 'N' {
+				current.WriteRune('\n')
+			} else {
+				current.WriteRune(r)
+			}
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ';':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(parts, current.String())
+}
+
+func unescape(value string) string {
+	return strings.Join(splitComponents(value), ";")
+}
+
+func component(parts []string, index int) string {
+	if index < len(parts) {
+		return strings.TrimSpace(parts[index])
+	}
+	return ""
+}
+
+func optionalString(val string) *string {
+	if val == "" {
+		return nil
+	}
+	return proto.String(val)
+}
+
+func parsePhoto(prop property) *Avatar {
+	if strings.HasPrefix(prop.value, "data:") {
+		// vCard 4.0: data:image/jpeg;base64,...
+		header, encoded, found := strings.Cut(strings.TrimPrefix(prop.value, "data:"), ",")
+		if !found || !strings.HasSuffix(header, ";base64") {
+			return nil
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil
+		}
+		return &Avatar{Data: data, MimeType: strings.TrimSuffix(header, ";base64")}
+	}
+	encoding := strings.ToUpper(strings.Join(prop.params["ENCODING"], ""))
+	if encoding != "B" && encoding != "BASE64" {
+		// External URLs aren't fetched
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(prop.value, " ", ""))
+	if err != nil {
+		return nil
+	}
+	mimeType := "image/jpeg"
+	if types := prop.params["TYPE"]; len(types) > 0 {
+		mimeType = "image/" + strings.ToLower(types[0])
+	}
+	return &Avatar{Data: data, MimeType: mimeType}
+}
+
+// Parse parses a vCard file into a Signal contact. Signal clients only show one contact per message,
+// so files with several cards are rejected with ErrMultipleCards.
+// The avatar is returned separately, as it has to be uploaded before it can be attached to the contact.
+func Parse(data []byte) (*signalpb.DataMessage_Contact, *Avatar, error) {
+	contact := &signalpb.DataMessage_Contact{Name: &signalpb.DataMessage_Contact_Name{}}
+	var avatar *Avatar
+	inCard := false
+	found := false
+	for _, line := range unfoldLines(string(data)) {
+		prop, ok := parseProperty(line)
+		if !ok {
+			continue
+		}
+		if prop.name == "BEGIN" && strings.EqualFold(prop.value, "VCARD") {
+			if found {
+				return nil, nil, ErrMultipleCards
+			}
+			inCard = true
+			continue
+		} else if prop.name == "END" && strings.EqualFold(prop.value, "VCARD") {
+			if inCard {
+				found = true
+				inCard = false
+			}
+			continue
+		} else if !inCard {
+			continue
+		}
+		switch prop.name {
+		case "FN":
+			contact.Name.DisplayName = optionalString(strings.TrimSpace(unescape(prop.value)))
+		case "N":
+			parts := splitComponents(prop.value)
+			contact.Name.FamilyName = optionalString(component(parts, 0))
+			contact.Name.GivenName = optionalString(component(parts, 1))
+			contact.Name.MiddleName = optionalString(component(parts, 2))
+			contact.Name.Prefix = optionalString(component(parts, 3))
+			contact.Name.Suffix = optionalString(component(parts, 4))
+		case "ORG":
+			contact.Organization = optionalString(component(splitComponents(prop.value), 0))
+		case "TEL":
+			value := strings.TrimPrefix(strings.TrimSpace(unescape(prop.value)), "tel:")
+			if value == "" {
+				continue
+			}
+			phoneType := signalpb.DataMessage_Contact_Phone_HOME
+			if prop.hasType("CELL") {
+				phoneType = signalpb.DataMessage_Contact_Phone_MOBILE
+			} else if prop.hasType("WORK") {
+				phoneType = signalpb.DataMessage_Contact_Phone_WORK
+			}
+			contact.Number = append(contact.Number, &signalpb.DataMessage_Contact_Phone{
+				Value: proto.String(value),
+				Type:  phoneType.Enum(),
+			})
+		case "EMAIL":
+			value := strings.TrimSpace(unescape(prop.value))
+			if value == "" {
+				continue
+			}
+			emailType := signalpb.DataMessage_Contact_Email_HOME
+			if prop.hasType("WORK") {
+				emailType = signalpb.DataMessage_Contact_Email_WORK
+			}
+			contact.Email = append(contact.Email, &signalpb.DataMessage_Contact_Email{
+				Value: proto.String(value),
+				Type:  emailType.Enum(),
+			})
+		case "ADR":
+			parts := splitComponents(prop.value)
+			addressType := signalpb.DataMessage_Contact_PostalAddress_HOME
+			if prop.hasType("WORK") {
+				addressType = signalpb.DataMessage_Contact_PostalAddress_WORK
+			}
+			address := &signalpb.DataMessage_Contact_PostalAddress{
+				Type:         addressType.Enum(),
+				Pobox:        optionalString(component(parts, 0)),
+				Neighborhood: optionalString(component(parts, 1)),
+				Street:       optionalString(component(parts, 2)),
+				City:         optionalString(component(parts, 3)),
+				Region:       optionalString(component(parts, 4)),
+				Postcode:     optionalString(component(parts, 5)),
+				Country:      optionalString(component(parts, 6)),
+			}
+			if proto.Equal(address, &signalpb.DataMessage_Contact_PostalAddress{Type: addressType.Enum()}) {
+				continue
+			}
+			contact.Address = append(contact.Address, address)
+		case "PHOTO":
+			if avatar == nil {
+				avatar = parsePhoto(prop)
+			}
+		}
+	}
+	if !found {
+		return nil, nil, ErrNoCard
+	}
+	if contact.Name.DisplayName == nil {
+		nameParts := []string{
+			contact.Name.GetPrefix(),
+			contact.Name.GetGivenName(),
+			contact.Name.GetMiddleName(),
+			contact.Name.GetFamilyName(),
+			contact.Name.GetSuffix(),
+		}
+		nameParts = nonEmpty(nameParts)
+		contact.Name.DisplayName = optionalString(strings.Join(nameParts, " "))
+	}
+	return contact, avatar, nil
+}
+
+func nonEmpty(parts []string) []string {
+	filtered := parts[:0]
+	for _, part := range parts {
+		if part != "" {
+			filtered = append(filtered, part)
+		}
+	}
+	return filtered
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\n", `\n`)
+
+func writeLine(b *strings.Builder, line string) {
+	// Fold lines longer than 75 octets as required by RFC 6350.
+	// The space at the start of continuation lines counts towards the limit.
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		// Don't split UTF-8 sequences
+		for cut > 1 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func joinComponents(values ...string) string {
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = escaper.Replace(value)
+	}
+	return strings.Join(escaped, ";")
+}
+
+// Format converts a Signal contact into a vCard 3.0 file.
+func Format(contact *signalpb.DataMessage_Contact, avatar *Avatar) []byte {
+	var b strings.Builder
+	writeLine(&b, "BEGIN:VCARD")
+	writeLine(&b, "VERSION:3.0")
+	name := contact.GetName()
+	displayName := name.GetDisplayName()
+	if displayName == "" {
+		displayName = strings.Join(nonEmpty([]string{name.GetGivenName(), name.GetFamilyName()}), " ")
+	}
+	writeLine(&b, "FN:"+escaper.Replace(displayName))
+	writeLine(&b, "N:"+joinComponents(name.GetFamilyName(), name.GetGivenName(), name.GetMiddleName(), name.GetPrefix(), name.GetSuffix()))
+	if contact.GetOrganization() != "" {
+		writeLine(&b, "ORG:"+escaper.Replace(contact.GetOrganization()))
+	}
+	for _, phone := range contact.GetNumber() {
+		var typ string
+		switch phone.GetType() {
+		case signalpb.DataMessage_Contact_Phone_MOBILE:
+			typ = "CELL"
+		case signalpb.DataMessage_Contact_Phone_WORK:
+			typ = "WORK"
+		default:
+			typ = "HOME"
+		}
+		writeLine(&b, "TEL;TYPE="+typ+":"+escaper.Replace(phone.GetValue()))
+	}
+	for _, email := range contact.GetEmail() {
+		typ := "HOME"
+		if email.GetType() == signalpb.DataMessage_Contact_Email_WORK {
+			typ = "WORK"
+		}
+		writeLine(&b, "EMAIL;TYPE="+typ+":"+escaper.Replace(email.GetValue()))
+	}
+	for _, address := range contact.GetAddress() {
+		typ := "HOME"
+		if address.GetType() == signalpb.DataMessage_Contact_PostalAddress_WORK {
+			typ = "WORK"
+		}
+		writeLine(&b, "ADR;TYPE="+typ+":"+joinComponents(
+			address.GetPobox(),
+			address.GetNeighborhood(),
+			address.GetStreet(),
+			address.GetCity(),
+			address.GetRegion(),
+			address.GetPostcode(),
+			address.GetCountry(),
+		))
+	}
+	if avatar != nil && len(avatar.Data) > 0 {
+		photoType := strings.ToUpper(strings.TrimPrefix(avatar.MimeType, "image/"))
+		writeLine(&b, "PHOTO;ENCODING=b;TYPE="+photoType+":"+base64.StdEncoding.EncodeToString(avatar.Data))
+	}
+	writeLine(&b, "END:VCARD")
+	return []byte(b.String())
+}
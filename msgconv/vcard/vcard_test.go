@@ -0,0 +1,127 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2023 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package vcard_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.mau.fi/mautrix-signal/msgconv/vcard"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func TestParse_Basic(t *testing.T) {
+	contact, avatar, err := vcard.Parse([]byte("BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"FN:Alice Example\r\n" +
+		"N:Example;Alice;;;\r\n" +
+		"ORG:Example Inc.;Engineering\r\n" +
+		"TEL;TYPE=CELL:+12025550123\r\n" +
+		"TEL;TYPE=WORK,VOICE:+12025550199\r\n" +
+		"EMAIL;TYPE=INTERNET:alice@example.com\r\n" +
+		"ADR;TYPE=HOME:;;123 Main St;Springfield;IL;62701;USA\r\n" +
+		"END:VCARD\r\n"))
+	require.NoError(t, err)
+	assert.Nil(t, avatar)
+	assert.Equal(t, "Alice Example", contact.GetName().GetDisplayName())
+	assert.Equal(t, "Alice", contact.GetName().GetGivenName())
+	assert.Equal(t, "Example", contact.GetName().GetFamilyName())
+	assert.Equal(t, "Example Inc.", contact.GetOrganization())
+	require.Len(t, contact.GetNumber(), 2)
+	assert.Equal(t, "+12025550123", contact.GetNumber()[0].GetValue())
+	assert.Equal(t, signalpb.DataMessage_Contact_Phone_MOBILE, contact.GetNumber()[0].GetType())
+	assert.Equal(t, signalpb.DataMessage_Contact_Phone_WORK, contact.GetNumber()[1].GetType())
+	require.Len(t, contact.GetEmail(), 1)
+	assert.Equal(t, "alice@example.com", contact.GetEmail()[0].GetValue())
+	require.Len(t, contact.GetAddress(), 1)
+	assert.Equal(t, "123 Main St", contact.GetAddress()[0].GetStreet())
+	assert.Equal(t, "Springfield", contact.GetAddress()[0].GetCity())
+	assert.Equal(t, "62701", contact.GetAddress()[0].GetPostcode())
+	assert.Nil(t, contact.GetAddress()[0].Pobox)
+}
+
+func TestParse_FoldedAndEscaped(t *testing.T) {
+	contact, _, err := vcard.Parse([]byte("BEGIN:VCARD\n" +
+		"VERSION:3.0\n" +
+		"FN:Bob\\, the\n" +
+		"  Builder\n" +
+		"END:VCARD\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "Bob, the Builder", contact.GetName().GetDisplayName())
+}
+
+func TestParse_NameFallback(t *testing.T) {
+	contact, _, err := vcard.Parse([]byte("BEGIN:VCARD\nVERSION:2.1\nN:Doe;Jane;;Dr.;\nTEL;CELL:555\nEND:VCARD\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "Dr. Jane Doe", contact.GetName().GetDisplayName())
+	assert.Equal(t, signalpb.DataMessage_Contact_Phone_MOBILE, contact.GetNumber()[0].GetType())
+}
+
+func TestParse_Photo(t *testing.T) {
+	_, avatar, err := vcard.Parse([]byte("BEGIN:VCARD\nVERSION:4.0\nFN:X\nPHOTO:data:image/png;base64,aGVsbG8=\nEND:VCARD\n"))
+	require.NoError(t, err)
+	require.NotNil(t, avatar)
+	assert.Equal(t, "image/png", avatar.MimeType)
+	assert.Equal(t, []byte("hello"), avatar.Data)
+}
+
+func TestParse_NoCard(t *testing.T) {
+	_, _, err := vcard.Parse([]byte("not a vcard"))
+	assert.ErrorIs(t, err, vcard.ErrNoCard)
+}
+
+func TestParse_MultipleCards(t *testing.T) {
+	card := "BEGIN:VCARD\nVERSION:3.0\nFN:X\nEND:VCARD\n"
+	_, _, err := vcard.Parse([]byte(card + card))
+	assert.ErrorIs(t, err, vcard.ErrMultipleCards)
+}
+
+func TestFormat_LineFolding(t *testing.T) {
+	longName := strings.Repeat("Ä", 100) + strings.Repeat("a", 100)
+	formatted := vcard.Format(&signalpb.DataMessage_Contact{
+		Name: &signalpb.DataMessage_Contact_Name{DisplayName: &longName},
+	}, nil)
+	for _, line := range strings.Split(strings.TrimSuffix(string(formatted), "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), 75, "line %q is too long", line)
+	}
+	parsed, _, err := vcard.Parse(formatted)
+	require.NoError(t, err)
+	assert.Equal(t, longName, parsed.GetName().GetDisplayName())
+}
+
+func TestFormat_RoundTrip(t *testing.T) {
+	original, _, err := vcard.Parse([]byte("BEGIN:VCARD\nVERSION:3.0\nFN:Carol; Semicolon\nN:Semicolon;Carol;;;\n" +
+		"ORG:Acme\nTEL;TYPE=HOME:+441234567890\nEMAIL;TYPE=WORK:carol@acme.test\n" +
+		"ADR;TYPE=WORK:PO 12;;1 Road;Town;;AB1 2CD;UK\nEND:VCARD\n"))
+	require.NoError(t, err)
+	avatar := &vcard.Avatar{Data: []byte("imagedata"), MimeType: "image/jpeg"}
+	formatted := vcard.Format(original, avatar)
+	parsed, parsedAvatar, err := vcard.Parse(formatted)
+	require.NoError(t, err)
+	assert.Equal(t, original.GetName().GetDisplayName(), parsed.GetName().GetDisplayName())
+	assert.Equal(t, original.GetOrganization(), parsed.GetOrganization())
+	assert.Equal(t, original.GetNumber()[0].GetValue(), parsed.GetNumber()[0].GetValue())
+	assert.Equal(t, signalpb.DataMessage_Contact_Email_WORK, parsed.GetEmail()[0].GetType())
+	assert.Equal(t, "PO 12", parsed.GetAddress()[0].GetPobox())
+	assert.Equal(t, "AB1 2CD", parsed.GetAddress()[0].GetPostcode())
+	require.NotNil(t, parsedAvatar)
+	assert.Equal(t, avatar.Data, parsedAvatar.Data)
+	assert.Equal(t, "image/jpeg", parsedAvatar.MimeType)
+}
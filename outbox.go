@@ -0,0 +1,441 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/database"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const (
+	outboxInitialDelay = 2 * time.Second
+	outboxMaxDelay     = 5 * time.Minute
+	// Messages that still couldn't be sent after this long are marked as failed
+	outboxMaxAge      = 24 * time.Hour
+	outboxSendTimeout = 2 * time.Minute
+)
+
+// outboxLiveMessage holds the Matrix events of a queued message that was received since the bridge started,
+// so that status updates can refer to the real events. Messages restored after a restart don't have one.
+type outboxLiveMessage struct {
+	evts  []*event.Event
+	ms    *metricSender
+	start time.Time
+}
+
+func outboxRetryDelay(attempts int, retryAfter time.Duration) time.Duration {
+	delay := outboxInitialDelay
+	for i := 1; i < attempts && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxDelay {
+		delay = outboxMaxDelay
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+// queueOutgoingMessage stores a converted Matrix message in the outbox and wakes up the outbox loop to send it.
+// Messages are sent in order, so the message waits if older ones in the same portal haven't been sent yet.
+// If albumPending is true, the message is an image that may be merged with the images queued after it.
+func (portal *Portal) queueOutgoingMessage(ctx context.Context, msg *signalmeow.SignalContent, evt *event.Event, ms *metricSender, albumPending bool) error {
+	content, err := proto.Marshal((*signalpb.Content)(msg))
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	item := portal.bridge.DB.OutboxMessage.New()
+	item.MXID = evt.ID
+	item.RoomID = portal.MXID
+	item.Sender = evt.Sender
+	item.Timestamp = msg.DataMessage.GetTimestamp()
+	item.Content = content
+	item.QueuedAt = time.Now()
+	item.AlbumPending = albumPending
+	err = item.Insert(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save message to outbox: %w", err)
+	}
+	portal.outboxLock.Lock()
+	if portal.outboxLive == nil {
+		portal.outboxLive = make(map[id.EventID]*outboxLiveMessage)
+	}
+	portal.outboxLive[item.MXID] = &outboxLiveMessage{evts: []*event.Event{evt}, ms: ms, start: time.Now()}
+	portal.outboxLock.Unlock()
+	portal.wakeOutbox(false)
+	return nil
+}
+
+// wakeOutbox starts the outbox loop if it isn't running yet and makes it check for messages to send.
+// If skipDelay is true, a message waiting for a retry is sent immediately instead of after the backoff delay.
+func (portal *Portal) wakeOutbox(skipDelay bool) {
+	if skipDelay {
+		portal.outboxSkipDelay.Store(true)
+	}
+	portal.outboxOnce.Do(func() {
+		portal.outboxWake = make(chan struct{}, 1)
+		go portal.outboxLoop()
+	})
+	select {
+	case portal.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func (portal *Portal) outboxLoop() {
+	log := portal.log.With().Str("action", "outbox loop").Logger()
+	ctx := log.WithContext(context.Background())
+	for {
+		var wait <-chan time.Time
+		item, err := portal.bridge.DB.OutboxMessage.GetNextForRoom(ctx, portal.MXID)
+		if err != nil {
+			log.Err(err).Msg("Failed to get next message from outbox")
+			wait = time.After(outboxInitialDelay)
+		} else if item == nil {
+			// Nothing to send, wait until something is queued
+		} else if delay := time.Until(item.NextAttempt); delay > 0 && !portal.outboxSkipDelay.Swap(false) {
+			wait = time.After(delay)
+		} else if item.AlbumPending {
+			delay, err = portal.mergeOutboxAlbum(ctx, item)
+			if err != nil {
+				log.Err(err).Str("event_id", item.MXID.String()).Msg("Failed to merge queued images into an album")
+				wait = time.After(outboxInitialDelay)
+			} else if delay > 0 {
+				wait = time.After(delay)
+			} else {
+				continue
+			}
+		} else {
+			portal.sendOutboxMessage(ctx, item)
+			continue
+		}
+		select {
+		case <-portal.outboxWake:
+		case <-wait:
+		}
+	}
+}
+
+func (portal *Portal) popOutboxLiveMessage(eventID id.EventID) *outboxLiveMessage {
+	portal.outboxLock.Lock()
+	defer portal.outboxLock.Unlock()
+	live := portal.outboxLive[eventID]
+	delete(portal.outboxLive, eventID)
+	return live
+}
+
+func (portal *Portal) getOutboxLiveMessage(item *database.OutboxMessage) *outboxLiveMessage {
+	portal.outboxLock.Lock()
+	defer portal.outboxLock.Unlock()
+	live, ok := portal.outboxLive[item.MXID]
+	if !ok {
+		// The message was queued before a restart, so only the basic info of the events is known
+		live = &outboxLiveMessage{start: item.QueuedAt}
+		for _, eventID := range append([]id.EventID{item.MXID}, item.ExtraMXIDs...) {
+			live.evts = append(live.evts, outboxPlaceholderEvent(item, eventID))
+		}
+		if portal.outboxLive == nil {
+			portal.outboxLive = make(map[id.EventID]*outboxLiveMessage)
+		}
+		portal.outboxLive[item.MXID] = live
+	}
+	return live
+}
+
+func outboxPlaceholderEvent(item *database.OutboxMessage, eventID id.EventID) *event.Event {
+	return &event.Event{
+		ID:        eventID,
+		RoomID:    item.RoomID,
+		Sender:    item.Sender,
+		Type:      event.EventMessage,
+		Timestamp: item.QueuedAt.UnixMilli(),
+		Content:   event.Content{Parsed: &event.MessageEventContent{}},
+	}
+}
+
+// outboxAlbumParts returns the queued images that can be merged into an album with the first queued message.
+// If mayGrow is true, no message that can't be part of the album has been queued after them,
+// so more images may still be added.
+func outboxAlbumParts(queued []*database.OutboxMessage) (parts []*database.OutboxMessage, mayGrow bool) {
+	first := queued[0]
+	for _, item := range queued[1:] {
+		if !item.AlbumPending || item.Sender != first.Sender || len(parts)+1 >= maxAlbumSize {
+			return parts, false
+		}
+		parts = append(parts, item)
+	}
+	return parts, len(parts)+1 < maxAlbumSize
+}
+
+// mergeOutboxAlbum merges the images queued after item into it, so that they're sent as one album.
+// The album is merged when no more images have been queued for albumCoalesceWindow, when it's full,
+// or when anything that can't be part of it is queued. Until then, the time left to wait is returned.
+func (portal *Portal) mergeOutboxAlbum(ctx context.Context, item *database.OutboxMessage) (time.Duration, error) {
+	portal.outboxSendLock.Lock()
+	defer portal.outboxSendLock.Unlock()
+	queued, err := portal.bridge.DB.OutboxMessage.GetManyFrom(ctx, portal.MXID, item.Timestamp, maxAlbumSize+1)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get queued messages: %w", err)
+	}
+	for len(queued) > 0 && queued[0].MXID != item.MXID {
+		queued = queued[1:]
+	}
+	if len(queued) == 0 {
+		// The image was redacted while waiting for the lock
+		return 0, nil
+	}
+	item = queued[0]
+	parts, mayGrow := outboxAlbumParts(queued)
+	if mayGrow {
+		last := queued[len(parts)]
+		if delay := albumCoalesceWindow - time.Since(last.QueuedAt); delay > 0 {
+			return delay, nil
+		}
+	}
+
+	var content signalpb.Content
+	if err = proto.Unmarshal(item.Content, &content); err != nil || content.DataMessage == nil {
+		// Sending will fail the same way, so just let the message be sent as-is
+		parts = nil
+	}
+	for i, part := range parts {
+		var partContent signalpb.Content
+		if err = proto.Unmarshal(part.Content, &partContent); err != nil {
+			parts = parts[:i]
+			break
+		}
+		content.DataMessage.Attachments = append(content.DataMessage.Attachments, partContent.GetDataMessage().GetAttachments()...)
+		item.ExtraMXIDs = append(item.ExtraMXIDs, part.MXID)
+	}
+	if len(parts) > 0 {
+		item.Content, err = proto.Marshal(&content)
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal album: %w", err)
+		}
+		zerolog.Ctx(ctx).Debug().
+			Str("album_event_id", item.MXID.String()).
+			Int("album_size", len(parts)+1).
+			Msg("Merging queued images into an album")
+	}
+	if err = item.MergeAlbum(ctx, parts); err != nil {
+		return 0, fmt.Errorf("failed to save album: %w", err)
+	}
+
+	portal.outboxLock.Lock()
+	defer portal.outboxLock.Unlock()
+	live, isLive := portal.outboxLive[item.MXID]
+	for _, part := range parts {
+		partLive, isPartLive := portal.outboxLive[part.MXID]
+		delete(portal.outboxLive, part.MXID)
+		if !isLive {
+			continue
+		} else if isPartLive {
+			live.evts = append(live.evts, partLive.evts...)
+		} else {
+			live.evts = append(live.evts, outboxPlaceholderEvent(item, part.MXID))
+		}
+	}
+	return 0, nil
+}
+
+func (portal *Portal) sendOutboxMessage(ctx context.Context, item *database.OutboxMessage) {
+	portal.outboxSendLock.Lock()
+	defer portal.outboxSendLock.Unlock()
+	log := zerolog.Ctx(ctx).With().
+		Str("event_id", item.MXID.String()).
+		Int("attempt", item.Attempts+1).
+		Bool("partial_retry", item.Recipients != nil).
+		Logger()
+	ctx = log.WithContext(ctx)
+	if item.Recipients != nil {
+		portal.retryOutboxMembers(ctx, item)
+		return
+	}
+	live := portal.getOutboxLiveMessage(item)
+
+	sender, content, retryMembers, err := portal.sendOutboxContent(ctx, item)
+	if err != nil && signalmeow.IsRetryableSendError(err) && time.Since(item.QueuedAt) < outboxMaxAge {
+		portal.scheduleOutboxRetry(ctx, item, err, signalmeow.SendRetryAfter(err))
+		queuedErr := fmt.Errorf("%w: %s", errMessageQueued, item.LastError)
+		if live.ms != nil {
+			go live.ms.sendMessageMetrics(live.evts[0], queuedErr, "Retrying", false)
+		} else {
+			go portal.sendMessageMetrics(live.evts[0], queuedErr, "Retrying", nil)
+		}
+		return
+	}
+
+	portal.popOutboxLiveMessage(item.MXID)
+	if err == nil && len(retryMembers) > 0 && time.Since(item.QueuedAt) < outboxMaxAge {
+		// The message reached the group, so it's bridged as sent and only the failed members are retried
+		portal.scheduleOutboxMemberRetry(ctx, item, retryMembers)
+	} else if dbErr := item.Delete(ctx); dbErr != nil {
+		log.Err(dbErr).Msg("Failed to delete message from outbox")
+	}
+	if live.ms != nil {
+		live.ms.timings.totalSend = time.Since(live.start)
+		go live.ms.sendMessageMetrics(live.evts[0], err, "Error sending", true)
+	} else {
+		go portal.sendMessageMetrics(live.evts[0], err, "Error sending", nil)
+	}
+	for _, partEvt := range live.evts[1:] {
+		go portal.sendMessageMetrics(partEvt, err, "Error sending", nil)
+	}
+	if err != nil {
+		return
+	}
+	for partIndex, partEvt := range live.evts {
+		portal.storeMessageInDB(ctx, partEvt.ID, sender.SignalID, item.Timestamp, partIndex)
+		if expireTimer := content.GetDataMessage().GetExpireTimer(); expireTimer > 0 {
+			// Timers of outgoing messages start when they're sent
+			portal.addDisappearingMessage(ctx, partEvt.ID, int64(expireTimer), time.Now())
+		}
+	}
+}
+
+// sendOutboxContent sends a queued message to Signal, only to item.Recipients if it's a partial retry.
+func (portal *Portal) sendOutboxContent(ctx context.Context, item *database.OutboxMessage) (sender *User, content *signalpb.Content, retry []signalmeow.FailedSendResult, err error) {
+	sender = portal.bridge.GetUserByMXID(item.Sender)
+	if sender == nil || !sender.IsLoggedIn() {
+		sender = portal.GetRelayUser()
+	}
+	content = &signalpb.Content{}
+	if sender == nil || !sender.IsLoggedIn() {
+		err = errUserNotLoggedIn
+	} else if err = proto.Unmarshal(item.Content, content); err != nil {
+		err = fmt.Errorf("failed to unmarshal queued message: %w", err)
+	} else {
+		sendCtx, cancel := context.WithTimeout(ctx, outboxSendTimeout)
+		retry, err = portal.sendSignalMessageTo(sendCtx, (*signalmeow.SignalContent)(content), sender, item.MXID, item.Recipients)
+		cancel()
+	}
+	return
+}
+
+// retryOutboxMembers sends a message that was already bridged as sent to the group members it couldn't be sent to.
+// Matrix already considers the message sent, so no status updates are sent.
+func (portal *Portal) retryOutboxMembers(ctx context.Context, item *database.OutboxMessage) {
+	log := zerolog.Ctx(ctx)
+	var retryMembers []signalmeow.FailedSendResult
+	var err error
+	if time.Since(item.QueuedAt) < outboxMaxAge {
+		_, _, retryMembers, err = portal.sendOutboxContent(ctx, item)
+	} else {
+		err = fmt.Errorf("message is older than %s", outboxMaxAge)
+	}
+	if err != nil && signalmeow.IsRetryableSendError(err) && time.Since(item.QueuedAt) < outboxMaxAge {
+		portal.scheduleOutboxRetry(ctx, item, err, signalmeow.SendRetryAfter(err))
+	} else if err == nil && len(retryMembers) > 0 && time.Since(item.QueuedAt) < outboxMaxAge {
+		portal.scheduleOutboxMemberRetry(ctx, item, retryMembers)
+	} else {
+		if err != nil {
+			log.Err(err).Strs("members", item.Recipients).Msg("Failed to send message to remaining group members, giving up")
+		} else {
+			log.Debug().Msg("Finished sending message to remaining group members")
+		}
+		if dbErr := item.Delete(ctx); dbErr != nil {
+			log.Err(dbErr).Msg("Failed to delete message from outbox")
+		}
+	}
+}
+
+func (portal *Portal) scheduleOutboxRetry(ctx context.Context, item *database.OutboxMessage, sendErr error, retryAfter time.Duration) {
+	log := zerolog.Ctx(ctx)
+	item.Attempts++
+	item.LastError = sendErr.Error()
+	item.NextAttempt = time.Now().Add(outboxRetryDelay(item.Attempts, retryAfter))
+	log.Warn().Err(sendErr).Time("next_attempt", item.NextAttempt).Msg("Failed to send message, will retry")
+	err := item.Update(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to update message in outbox")
+	}
+}
+
+// scheduleOutboxMemberRetry keeps a message that was sent to some group members in the outbox to retry the others.
+func (portal *Portal) scheduleOutboxMemberRetry(ctx context.Context, item *database.OutboxMessage, failed []signalmeow.FailedSendResult) {
+	var retryAfter time.Duration
+	errs := make([]error, len(failed))
+	item.Recipients = make([]string, len(failed))
+	for i, member := range failed {
+		item.Recipients[i] = member.RecipientUuid
+		errs[i] = fmt.Errorf("%s: %w", member.RecipientUuid, member.Error)
+		if memberRetryAfter := signalmeow.SendRetryAfter(member.Error); memberRetryAfter > retryAfter {
+			retryAfter = memberRetryAfter
+		}
+	}
+	portal.scheduleOutboxRetry(ctx, item, fmt.Errorf("failed to send to %d group members: %w", len(failed), errors.Join(errs...)), retryAfter)
+}
+
+// cancelOutboxMessage removes a message that hasn't been sent yet from the outbox, e.g. because it was redacted.
+// If the event is part of a merged album, the whole album is removed and the other parts are redacted on Matrix,
+// as Signal albums can only be deleted as a whole. Returns false if the message isn't in the outbox.
+// If the message is currently being sent, this waits until it's done, so the redaction isn't lost if it was sent.
+// Messages that were already sent to some group members are removed from the outbox, but false is returned,
+// as the message has to be deleted on Signal like any other sent message.
+func (portal *Portal) cancelOutboxMessage(ctx context.Context, eventID id.EventID) (bool, error) {
+	portal.outboxSendLock.Lock()
+	defer portal.outboxSendLock.Unlock()
+	item, err := portal.bridge.DB.OutboxMessage.GetByMXID(ctx, eventID)
+	if err != nil || item == nil {
+		return false, err
+	}
+	portal.popOutboxLiveMessage(item.MXID)
+	err = item.Delete(ctx)
+	if err != nil {
+		return true, err
+	} else if item.Recipients != nil {
+		return false, nil
+	}
+	if len(item.ExtraMXIDs) > 0 {
+		zerolog.Ctx(ctx).Debug().
+			Str("album_event_id", item.MXID.String()).
+			Int("album_size", len(item.ExtraMXIDs)+1).
+			Msg("Redaction target is part of a queued album, cancelling the whole album")
+		portal.redactOtherAlbumParts(ctx, eventID, append([]id.EventID{item.MXID}, item.ExtraMXIDs...))
+	}
+	return true, nil
+}
+
+// WakeOutboxes starts sending messages that were queued before the bridge was restarted,
+// or retries them immediately when the connection to Signal is restored.
+func (br *SignalBridge) WakeOutboxes(ctx context.Context, skipDelay bool) {
+	roomIDs, err := br.DB.OutboxMessage.GetRooms(ctx)
+	if err != nil {
+		br.ZLog.Err(err).Msg("Failed to get rooms with queued messages")
+		return
+	}
+	for _, roomID := range roomIDs {
+		portal := br.GetPortalByMXID(roomID)
+		if portal == nil {
+			br.ZLog.Warn().Str("room_id", roomID.String()).Msg("Portal for queued messages not found")
+			continue
+		}
+		portal.wakeOutbox(skipDelay)
+	}
+}
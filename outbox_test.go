@@ -0,0 +1,73 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/database"
+)
+
+func TestOutboxRetryDelay(t *testing.T) {
+	assert.Equal(t, outboxInitialDelay, outboxRetryDelay(1, 0))
+	assert.Equal(t, 2*outboxInitialDelay, outboxRetryDelay(2, 0))
+	assert.Equal(t, 4*outboxInitialDelay, outboxRetryDelay(3, 0))
+	assert.Equal(t, outboxMaxDelay, outboxRetryDelay(50, 0))
+	// The delay requested by the server takes precedence if it's longer
+	assert.Equal(t, time.Minute, outboxRetryDelay(1, time.Minute))
+	assert.Equal(t, 4*outboxInitialDelay, outboxRetryDelay(3, time.Second))
+	assert.Equal(t, time.Hour, outboxRetryDelay(50, time.Hour))
+}
+
+func TestOutboxAlbumParts(t *testing.T) {
+	image := func(sender id.UserID) *database.OutboxMessage {
+		return &database.OutboxMessage{Sender: sender, AlbumPending: true}
+	}
+	const alice, bob = id.UserID("@alice:example.com"), id.UserID("@bob:example.com")
+	first, second, third := image(alice), image(alice), image(alice)
+
+	parts, mayGrow := outboxAlbumParts([]*database.OutboxMessage{first})
+	assert.Empty(t, parts)
+	assert.True(t, mayGrow)
+	parts, mayGrow = outboxAlbumParts([]*database.OutboxMessage{first, second, third})
+	assert.Equal(t, []*database.OutboxMessage{second, third}, parts)
+	assert.True(t, mayGrow)
+
+	// Anything else queued after the images ends the album
+	text := &database.OutboxMessage{Sender: alice}
+	parts, mayGrow = outboxAlbumParts([]*database.OutboxMessage{first, second, text, third})
+	assert.Equal(t, []*database.OutboxMessage{second}, parts)
+	assert.False(t, mayGrow)
+	parts, mayGrow = outboxAlbumParts([]*database.OutboxMessage{first, image(bob), second})
+	assert.Empty(t, parts)
+	assert.False(t, mayGrow)
+
+	queued := []*database.OutboxMessage{first}
+	for i := 0; i < maxAlbumSize; i++ {
+		queued = append(queued, image(alice))
+	}
+	parts, mayGrow = outboxAlbumParts(queued)
+	assert.Len(t, parts, maxAlbumSize-1)
+	assert.False(t, mayGrow)
+	parts, mayGrow = outboxAlbumParts(queued[:maxAlbumSize])
+	assert.Len(t, parts, maxAlbumSize-1)
+	assert.False(t, mayGrow)
+}
@@ -107,3 +107,17 @@ func CreateAuthCredentialWithPniPresentation(
 	result := AuthCredentialPresentation(CopySignalOwnedBufferToBytes(c_result))
 	return &result, nil
 }
+
+func (acp AuthCredentialPresentation) GetUUIDCiphertext() (*UUIDCiphertext, error) {
+	var c_result [C.SignalUUID_CIPHERTEXT_LEN]C.uchar
+	signalFfiError := C.signal_auth_credential_presentation_get_uuid_ciphertext(
+		&c_result,
+		BytesToBuffer(acp),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result UUIDCiphertext
+	copy(result[:], C.GoBytes(unsafe.Pointer(&c_result), C.int(C.SignalUUID_CIPHERTEXT_LEN)))
+	return &result, nil
+}
@@ -147,3 +147,58 @@ func (gsp *GroupSecretParams) DecryptProfileKey(ciphertextProfileKey ProfileKeyC
 	copy(result[:], C.GoBytes(unsafe.Pointer(&profileKey), C.int(C.SignalPROFILE_KEY_LEN)))
 	return &result, nil
 }
+
+func (gsp *GroupSecretParams) EncryptBlobWithPaddingDeterministic(randomness Randomness, plaintext []byte, paddingLen uint32) ([]byte, error) {
+	var ciphertext C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	borrowedPlaintext := BytesToBuffer(plaintext)
+	signalFfiError := C.signal_group_secret_params_encrypt_blob_with_padding_deterministic(
+		&ciphertext,
+		(*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gsp)),
+		(*[C.SignalRANDOMNESS_LEN]C.uint8_t)(unsafe.Pointer(&randomness)),
+		borrowedPlaintext,
+		C.uint32_t(paddingLen),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return CopySignalOwnedBufferToBytes(ciphertext), nil
+}
+
+func (gsp *GroupSecretParams) EncryptUUID(u uuid.UUID) (*UUIDCiphertext, error) {
+	var c_result [C.SignalUUID_CIPHERTEXT_LEN]C.uchar
+	serviceId, err := SignalServiceIDFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	signalFfiError := C.signal_group_secret_params_encrypt_service_id(
+		&c_result,
+		(*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gsp)),
+		serviceId,
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result UUIDCiphertext
+	copy(result[:], C.GoBytes(unsafe.Pointer(&c_result), C.int(C.SignalUUID_CIPHERTEXT_LEN)))
+	return &result, nil
+}
+
+func (gsp *GroupSecretParams) EncryptProfileKey(profileKey ProfileKey, u uuid.UUID) (*ProfileKeyCiphertext, error) {
+	var c_result [C.SignalPROFILE_KEY_CIPHERTEXT_LEN]C.uchar
+	serviceId, err := SignalServiceIDFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	signalFfiError := C.signal_group_secret_params_encrypt_profile_key(
+		&c_result,
+		(*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gsp)),
+		(*[C.SignalPROFILE_KEY_LEN]C.uint8_t)(unsafe.Pointer(&profileKey)),
+		serviceId,
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result ProfileKeyCiphertext
+	copy(result[:], C.GoBytes(unsafe.Pointer(&c_result), C.int(C.SignalPROFILE_KEY_CIPHERTEXT_LEN)))
+	return &result, nil
+}
@@ -0,0 +1,114 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package libsignalgo
+
+/*
+#cgo LDFLAGS: -lsignal_ffi -ldl
+#include "./libsignal-ffi.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"unsafe"
+
+	"github.com/google/uuid"
+)
+
+// ServerSecretParams are the zkgroup parameters held by the Signal server.
+// Real clients never have these, they're only used by fake servers in tests.
+type ServerSecretParams [C.SignalSERVER_SECRET_PARAMS_LEN]byte
+
+func GenerateServerSecretParams() (*ServerSecretParams, error) {
+	randomness, err := GenerateRandomness()
+	if err != nil {
+		return nil, err
+	}
+	return GenerateServerSecretParamsWithRandomness(randomness)
+}
+
+func GenerateServerSecretParamsWithRandomness(randomness Randomness) (*ServerSecretParams, error) {
+	var c_result [C.SignalSERVER_SECRET_PARAMS_LEN]C.uchar
+	signalFfiError := C.signal_server_secret_params_generate_deterministic(
+		&c_result,
+		(*[C.SignalRANDOMNESS_LEN]C.uint8_t)(unsafe.Pointer(&randomness)),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result ServerSecretParams
+	copy(result[:], C.GoBytes(unsafe.Pointer(&c_result), C.int(C.SignalSERVER_SECRET_PARAMS_LEN)))
+	return &result, nil
+}
+
+func (ssp *ServerSecretParams) GetPublicParams() (*ServerPublicParams, error) {
+	var c_result [C.SignalSERVER_PUBLIC_PARAMS_LEN]C.uchar
+	signalFfiError := C.signal_server_secret_params_get_public_params(
+		&c_result,
+		(*[C.SignalSERVER_SECRET_PARAMS_LEN]C.uchar)(unsafe.Pointer(ssp)),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result ServerPublicParams
+	copy(result[:], C.GoBytes(unsafe.Pointer(&c_result), C.int(C.SignalSERVER_PUBLIC_PARAMS_LEN)))
+	return &result, nil
+}
+
+// IssueAuthCredentialWithPni issues a group auth credential in the format
+// that ReceiveAuthCredentialWithPni expects.
+func (ssp *ServerSecretParams) IssueAuthCredentialWithPni(aci, pni uuid.UUID, redemptionTime uint64) (*AuthCredentialWithPniResponse, error) {
+	randomness, err := GenerateRandomness()
+	if err != nil {
+		return nil, err
+	}
+	c_aci, err := SignalServiceIDFromUUID(aci)
+	if err != nil {
+		return nil, err
+	}
+	c_pni, err := SignalPNIServiceIDFromUUID(pni)
+	if err != nil {
+		return nil, err
+	}
+	var c_result [C.SignalAUTH_CREDENTIAL_WITH_PNI_RESPONSE_LEN]C.uchar
+	signalFfiError := C.signal_server_secret_params_issue_auth_credential_with_pni_as_aci_deterministic(
+		&c_result,
+		(*[C.SignalSERVER_SECRET_PARAMS_LEN]C.uchar)(unsafe.Pointer(ssp)),
+		(*[C.SignalRANDOMNESS_LEN]C.uint8_t)(unsafe.Pointer(&randomness)),
+		c_aci,
+		c_pni,
+		C.uint64_t(redemptionTime),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result AuthCredentialWithPniResponse
+	copy(result[:], C.GoBytes(unsafe.Pointer(&c_result), C.int(C.SignalAUTH_CREDENTIAL_WITH_PNI_RESPONSE_LEN)))
+	return &result, nil
+}
+
+func (ssp *ServerSecretParams) VerifyAuthCredentialPresentation(groupPublicParams GroupPublicParams, presentation AuthCredentialPresentation, currentTimeSeconds uint64) error {
+	signalFfiError := C.signal_server_secret_params_verify_auth_credential_presentation(
+		(*[C.SignalSERVER_SECRET_PARAMS_LEN]C.uchar)(unsafe.Pointer(ssp)),
+		(*[C.SignalGROUP_PUBLIC_PARAMS_LEN]C.uchar)(unsafe.Pointer(&groupPublicParams)),
+		BytesToBuffer(presentation),
+		C.uint64_t(currentTimeSeconds),
+	)
+	if signalFfiError != nil {
+		return wrapError(signalFfiError)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalbackup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+)
+
+// Backup is a decrypted backup. The Signal Android database is recreated in a temporary SQLite
+// database and the attachments are written to files next to it.
+type Backup struct {
+	DB              *sql.DB
+	DatabaseVersion uint32
+
+	dir         string
+	attachments map[uint64]string
+	columnCache map[string]map[string]bool
+}
+
+// Open decrypts the whole backup from r into a new temporary directory inside tempDir.
+// The backup must be closed to delete the temporary files.
+func Open(ctx context.Context, r io.Reader, passphrase, tempDir string) (*Backup, error) {
+	reader, err := NewReader(r, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(tempDir, "signalbackup-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	backup := &Backup{
+		dir:         dir,
+		attachments: make(map[uint64]string),
+		columnCache: make(map[string]map[string]bool),
+	}
+	backup.DB, err = sql.Open("sqlite3", "file:"+filepath.Join(dir, "signal.db")+"?_journal_mode=OFF&_synchronous=OFF")
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to open temp database: %w", err)
+	}
+	err = backup.read(ctx, reader)
+	if err != nil {
+		_ = backup.Close()
+		return nil, err
+	}
+	return backup, nil
+}
+
+func (b *Backup) Close() error {
+	err := b.DB.Close()
+	_ = os.RemoveAll(b.dir)
+	return err
+}
+
+// shouldSkipStatement filters out statements that can't or don't need to be replayed.
+// Full-text search tables need SQLite extensions and are useless for importing,
+// and internal SQLite tables are created automatically.
+func shouldSkipStatement(stmt string) bool {
+	upper := strings.ToUpper(stmt)
+	return strings.HasPrefix(upper, "CREATE VIRTUAL TABLE") ||
+		strings.HasPrefix(upper, "CREATE TRIGGER") ||
+		strings.Contains(upper, "SQLITE_") ||
+		strings.Contains(upper, "_FTS")
+}
+
+func (b *Backup) read(ctx context.Context, reader *Reader) error {
+	log := zerolog.Ctx(ctx)
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	var failedStatements, frames int
+	for {
+		frame, err := reader.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("backup ended without end frame: %w", err)
+		} else if err != nil {
+			if frames == 0 && errors.Is(err, ErrBadMAC) {
+				return fmt.Errorf("%w (is the passphrase correct?)", err)
+			}
+			return err
+		} else if err = ctx.Err(); err != nil {
+			return err
+		}
+		frames++
+		switch {
+		case frame.End:
+			log.Debug().Int("frames", frames).Int("failed_statements", failedStatements).Msg("Finished reading backup")
+			return tx.Commit()
+		case frame.DatabaseVersion != 0:
+			b.DatabaseVersion = frame.DatabaseVersion
+		case frame.Statement != nil:
+			if shouldSkipStatement(frame.Statement.Statement) {
+				continue
+			}
+			_, err = tx.ExecContext(ctx, frame.Statement.Statement, frame.Statement.Parameters...)
+			if err != nil {
+				// Keep going, a single broken row shouldn't prevent importing everything else
+				failedStatements++
+				log.Debug().Err(err).Str("statement", frame.Statement.Statement).Msg("Failed to execute statement from backup")
+			}
+		case frame.BlobType == BlobTypeAttachment:
+			path := filepath.Join(b.dir, fmt.Sprintf("attachment-%d", frame.Blob.RowID))
+			err = b.writeBlob(reader, path)
+			if err != nil {
+				return fmt.Errorf("failed to read attachment %d: %w", frame.Blob.RowID, err)
+			}
+			b.attachments[frame.Blob.RowID] = path
+		}
+		// Avatars and stickers are skipped by the next Next call, which still verifies their MACs
+	}
+}
+
+func (b *Backup) writeBlob(reader *Reader, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = reader.ReadBlob(file)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// AttachmentPath returns the path of the decrypted attachment with the given row ID,
+// or an empty string if the attachment wasn't included in the backup.
+func (b *Backup) AttachmentPath(rowID uint64) string {
+	return b.attachments[rowID]
+}
@@ -0,0 +1,221 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalbackup
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The frames are defined in Backups.proto in Signal Android. Only a handful of fields are needed,
+// so they're decoded by hand instead of generating code for the whole file.
+
+type Header struct {
+	IV      []byte
+	Salt    []byte
+	Version uint32
+}
+
+// SQLStatement is a statement that recreates the Signal Android database, e.g. CREATE TABLE or INSERT.
+type SQLStatement struct {
+	Statement  string
+	Parameters []any
+}
+
+// Blob is the metadata of an attachment, avatar or sticker frame. The encrypted data follows the frame.
+type Blob struct {
+	RowID        uint64
+	AttachmentID uint64
+	Length       uint32
+	// AvatarRecipientID is only set for avatars
+	AvatarRecipientID string
+}
+
+type BlobType int
+
+const (
+	BlobTypeNone BlobType = iota
+	BlobTypeAttachment
+	BlobTypeAvatar
+	BlobTypeSticker
+)
+
+type Frame struct {
+	Header          *Header
+	Statement       *SQLStatement
+	DatabaseVersion uint32
+	End             bool
+
+	BlobType BlobType
+	Blob     *Blob
+}
+
+var errInvalidProtobuf = errors.New("invalid protobuf")
+
+// protoFields iterates over the top-level fields of a protobuf message.
+func protoFields(data []byte, fn func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errInvalidProtobuf
+		}
+		data = data[n:]
+		var value []byte
+		var varint uint64
+		switch typ {
+		case protowire.VarintType:
+			varint, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			varint, n = protowire.ConsumeFixed64(data)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(data)
+			varint = uint64(v32)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return errInvalidProtobuf
+		}
+		data = data[n:]
+		if err := fn(num, typ, value, varint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseFrame(data []byte) (*Frame, error) {
+	var frame Frame
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) (err error) {
+		switch num {
+		case 1:
+			frame.Header, err = parseHeader(value)
+		case 2:
+			frame.Statement, err = parseStatement(value)
+		case 4:
+			frame.BlobType = BlobTypeAttachment
+			frame.Blob, err = parseBlob(value, 1, 2, 3, 0)
+		case 5:
+			err = protoFields(value, func(num protowire.Number, _ protowire.Type, _ []byte, varint uint64) error {
+				if num == 1 {
+					frame.DatabaseVersion = uint32(varint)
+				}
+				return nil
+			})
+		case 6:
+			frame.End = varint != 0
+		case 7:
+			frame.BlobType = BlobTypeAvatar
+			frame.Blob, err = parseBlob(value, 0, 0, 2, 3)
+		case 8:
+			frame.BlobType = BlobTypeSticker
+			frame.Blob, err = parseBlob(value, 1, 0, 2, 0)
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &frame, nil
+}
+
+func parseHeader(data []byte) (*Header, error) {
+	var header Header
+	err := protoFields(data, func(num protowire.Number, _ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case 1:
+			header.IV = value
+		case 2:
+			header.Salt = value
+		case 3:
+			header.Version = uint32(varint)
+		}
+		return nil
+	})
+	return &header, err
+}
+
+func parseStatement(data []byte) (*SQLStatement, error) {
+	var stmt SQLStatement
+	err := protoFields(data, func(num protowire.Number, _ protowire.Type, value []byte, _ uint64) error {
+		switch num {
+		case 1:
+			stmt.Statement = string(value)
+		case 2:
+			param, err := parseParameter(value)
+			if err != nil {
+				return err
+			}
+			stmt.Parameters = append(stmt.Parameters, param)
+		}
+		return nil
+	})
+	return &stmt, err
+}
+
+func parseParameter(data []byte) (any, error) {
+	var param any
+	err := protoFields(data, func(num protowire.Number, _ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case 1:
+			param = string(value)
+		case 2:
+			// Java longs are sent as uint64
+			param = int64(varint)
+		case 3:
+			param = math.Float64frombits(varint)
+		case 4:
+			if value == nil {
+				value = []byte{}
+			}
+			param = value
+		case 5:
+			param = nil
+		default:
+			return fmt.Errorf("unknown SQL parameter type %d", num)
+		}
+		return nil
+	})
+	return param, err
+}
+
+// parseBlob parses attachment, avatar and sticker frames, which have the same fields with different numbers.
+// Field numbers that are zero don't exist in the given message type.
+func parseBlob(data []byte, rowIDField, attachmentIDField, lengthField, recipientField protowire.Number) (*Blob, error) {
+	var blob Blob
+	err := protoFields(data, func(num protowire.Number, _ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case 0:
+		case rowIDField:
+			blob.RowID = varint
+		case attachmentIDField:
+			blob.AttachmentID = varint
+		case lengthField:
+			blob.Length = uint32(varint)
+		case recipientField:
+			blob.AvatarRecipientID = string(value)
+		}
+		return nil
+	})
+	return &blob, err
+}
@@ -0,0 +1,351 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalbackup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ErrUnsupportedSchema is returned when the backup is from a Signal Android version that
+// doesn't have the merged message table (before mid-2023).
+var ErrUnsupportedSchema = errors.New("unsupported backup database schema, please update Signal and create a new backup")
+
+// Message types from MessageTypes.java in Signal Android
+const (
+	baseTypeMask  = 0x1F
+	baseInboxType = 20
+	// Outbox (21), sending (22), sent (23) and failed (24) are all outgoing messages
+	baseFailedType = 24
+
+	// Key exchanges, group updates, timer changes, session resets and so on are not normal messages
+	specialTypeMask = 0x8000 | 0x10000 | 0x20000 | 0x40000 | 0x80000 | 0x400000
+)
+
+const groupV2IDPrefix = "__signal_group__v2__!"
+
+type Recipient struct {
+	ID   int64
+	ACI  uuid.UUID
+	E164 string
+	// GroupID is the base64 group identifier used by signalmeow, only set for v2 groups
+	GroupID string
+}
+
+type Thread struct {
+	ID        int64
+	Recipient *Recipient
+}
+
+type Attachment struct {
+	RowID       uint64
+	ContentType string
+	FileName    string
+	Size        int64
+	Width       int
+	Height      int
+	Caption     string
+	// Path is the decrypted file, or empty if the attachment wasn't in the backup
+	Path string
+}
+
+type Reaction struct {
+	Author   *Recipient
+	Emoji    string
+	DateSent uint64
+}
+
+type Message struct {
+	ID       int64
+	DateSent uint64
+	Outgoing bool
+	// Sender is nil for outgoing messages
+	Sender *Recipient
+	Body   string
+
+	QuoteTimestamp uint64
+	QuoteAuthor    *Recipient
+
+	Attachments []*Attachment
+	Reactions   []*Reaction
+}
+
+func (b *Backup) columns(ctx context.Context, table string) (map[string]bool, error) {
+	if cols, ok := b.columnCache[table]; ok {
+		return cols, nil
+	}
+	rows, err := b.DB.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%q)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var cid int
+		var name, typ string
+		var notNull, pk int
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	b.columnCache[table] = cols
+	return cols, rows.Err()
+}
+
+// pickColumn returns the first of the given columns that exists in the table, or the given
+// fallback expression if none of them do. Column names have changed between Signal versions.
+func (b *Backup) pickColumn(ctx context.Context, table, fallback string, names ...string) (string, error) {
+	cols, err := b.columns(ctx, table)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if cols[name] {
+			return name, nil
+		}
+	}
+	if fallback == "" {
+		return "", fmt.Errorf("%w: %s table doesn't have any of %s", ErrUnsupportedSchema, table, strings.Join(names, ", "))
+	}
+	return fallback, nil
+}
+
+// Recipients returns all recipients in the backup by their row ID.
+func (b *Backup) Recipients(ctx context.Context) (map[int64]*Recipient, error) {
+	aciCol, err := b.pickColumn(ctx, "recipient", "NULL", "aci", "uuid")
+	if err != nil {
+		return nil, err
+	}
+	e164Col, err := b.pickColumn(ctx, "recipient", "NULL", "e164", "phone")
+	if err != nil {
+		return nil, err
+	}
+	groupCol, err := b.pickColumn(ctx, "recipient", "NULL", "group_id")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.DB.QueryContext(ctx, fmt.Sprintf("SELECT _id, %s, %s, %s FROM recipient", aciCol, e164Col, groupCol))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recipients := make(map[int64]*Recipient)
+	for rows.Next() {
+		var recipient Recipient
+		var aci, e164, groupID sql.NullString
+		if err = rows.Scan(&recipient.ID, &aci, &e164, &groupID); err != nil {
+			return nil, err
+		}
+		recipient.ACI, _ = uuid.Parse(aci.String)
+		recipient.E164 = e164.String
+		if strings.HasPrefix(groupID.String, groupV2IDPrefix) {
+			rawGroupID, err := hex.DecodeString(strings.TrimPrefix(groupID.String, groupV2IDPrefix))
+			if err == nil {
+				recipient.GroupID = base64.StdEncoding.EncodeToString(rawGroupID)
+			}
+		}
+		recipients[recipient.ID] = &recipient
+	}
+	return recipients, rows.Err()
+}
+
+// Threads returns all conversations in the backup.
+func (b *Backup) Threads(ctx context.Context, recipients map[int64]*Recipient) ([]*Thread, error) {
+	recipientCol, err := b.pickColumn(ctx, "thread", "", "recipient_id", "thread_recipient_id")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.DB.QueryContext(ctx, fmt.Sprintf("SELECT _id, %s FROM thread ORDER BY _id", recipientCol))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var threads []*Thread
+	for rows.Next() {
+		var thread Thread
+		var recipientID int64
+		if err = rows.Scan(&thread.ID, &recipientID); err != nil {
+			return nil, err
+		}
+		thread.Recipient = recipients[recipientID]
+		if thread.Recipient != nil {
+			threads = append(threads, &thread)
+		}
+	}
+	return threads, rows.Err()
+}
+
+// Messages returns the normal messages in the given thread sorted by the time they were sent,
+// along with their attachments and reactions.
+func (b *Backup) Messages(ctx context.Context, threadID int64, recipients map[int64]*Recipient) ([]*Message, error) {
+	if cols, err := b.columns(ctx, "message"); err != nil {
+		return nil, err
+	} else if len(cols) == 0 {
+		return nil, ErrUnsupportedSchema
+	}
+	senderCol, err := b.pickColumn(ctx, "message", "", "from_recipient_id", "recipient_id")
+	if err != nil {
+		return nil, err
+	}
+	deletedCol, err := b.pickColumn(ctx, "message", "0", "remote_deleted")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.DB.QueryContext(ctx, fmt.Sprintf(`
+		SELECT _id, date_sent, type, %s, body, quote_id, quote_author FROM message
+		WHERE thread_id=$1 AND %s=0 ORDER BY date_sent, _id
+	`, senderCol, deletedCol), threadID)
+	if err != nil {
+		return nil, err
+	}
+	var messages []*Message
+	messagesByID := make(map[int64]*Message)
+	for rows.Next() {
+		var msg Message
+		var msgType, senderID int64
+		var body sql.NullString
+		var quoteID, quoteAuthor sql.NullInt64
+		if err = rows.Scan(&msg.ID, &msg.DateSent, &msgType, &senderID, &body, &quoteID, &quoteAuthor); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		baseType := msgType & baseTypeMask
+		if msgType&specialTypeMask != 0 || baseType < baseInboxType || baseType > baseFailedType {
+			continue
+		}
+		msg.Outgoing = baseType != baseInboxType
+		if !msg.Outgoing {
+			msg.Sender = recipients[senderID]
+			if msg.Sender == nil || msg.Sender.ACI == uuid.Nil {
+				continue
+			}
+		}
+		msg.Body = body.String
+		if quoteID.Valid && quoteID.Int64 > 0 {
+			msg.QuoteTimestamp = uint64(quoteID.Int64)
+			msg.QuoteAuthor = recipients[quoteAuthor.Int64]
+		}
+		messages = append(messages, &msg)
+		messagesByID[msg.ID] = &msg
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if err = b.addAttachments(ctx, threadID, messagesByID); err != nil {
+		return nil, fmt.Errorf("failed to get attachments: %w", err)
+	}
+	if err = b.addReactions(ctx, threadID, messagesByID, recipients); err != nil {
+		return nil, fmt.Errorf("failed to get reactions: %w", err)
+	}
+	return messages, nil
+}
+
+func (b *Backup) addAttachments(ctx context.Context, threadID int64, messages map[int64]*Message) error {
+	table := "attachment"
+	if cols, err := b.columns(ctx, table); err != nil {
+		return err
+	} else if len(cols) == 0 {
+		table = "part"
+	}
+	messageCol, err := b.pickColumn(ctx, table, "", "message_id", "mid")
+	if err != nil {
+		return err
+	}
+	typeCol, err := b.pickColumn(ctx, table, "", "content_type", "ct")
+	if err != nil {
+		return err
+	}
+	fileNameCol, err := b.pickColumn(ctx, table, "NULL", "file_name")
+	if err != nil {
+		return err
+	}
+	captionCol, err := b.pickColumn(ctx, table, "NULL", "caption")
+	if err != nil {
+		return err
+	}
+	rows, err := b.DB.QueryContext(ctx, fmt.Sprintf(`
+		SELECT a._id, a.%[1]s, a.%[2]s, a.%[3]s, a.data_size, a.width, a.height, a.%[4]s
+		FROM %[5]s a JOIN message m ON m._id = a.%[1]s
+		WHERE m.thread_id=$1 ORDER BY a._id
+	`, messageCol, typeCol, fileNameCol, captionCol, table), threadID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var att Attachment
+		var messageID int64
+		var contentType, fileName, caption sql.NullString
+		var size, width, height sql.NullInt64
+		err = rows.Scan(&att.RowID, &messageID, &contentType, &fileName, &size, &width, &height, &caption)
+		if err != nil {
+			return err
+		}
+		msg, ok := messages[messageID]
+		if !ok {
+			continue
+		}
+		att.ContentType = contentType.String
+		att.FileName = fileName.String
+		att.Size = size.Int64
+		att.Width = int(width.Int64)
+		att.Height = int(height.Int64)
+		att.Caption = caption.String
+		att.Path = b.AttachmentPath(att.RowID)
+		msg.Attachments = append(msg.Attachments, &att)
+	}
+	return rows.Err()
+}
+
+func (b *Backup) addReactions(ctx context.Context, threadID int64, messages map[int64]*Message, recipients map[int64]*Recipient) error {
+	if cols, err := b.columns(ctx, "reaction"); err != nil || len(cols) == 0 {
+		return err
+	}
+	rows, err := b.DB.QueryContext(ctx, `
+		SELECT r.message_id, r.author_id, r.emoji, r.date_sent
+		FROM reaction r JOIN message m ON m._id = r.message_id
+		WHERE m.thread_id=$1 ORDER BY r.date_sent
+	`, threadID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var reaction Reaction
+		var messageID, authorID int64
+		if err = rows.Scan(&messageID, &authorID, &reaction.Emoji, &reaction.DateSent); err != nil {
+			return err
+		}
+		msg, ok := messages[messageID]
+		reaction.Author = recipients[authorID]
+		if !ok || reaction.Author == nil {
+			continue
+		}
+		msg.Reactions = append(msg.Reactions, &reaction)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,234 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package signalbackup reads the encrypted .backup files created by Signal Android.
+package signalbackup
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrInvalidPassphrase = errors.New("invalid backup passphrase")
+	ErrBadMAC            = errors.New("bad MAC in backup frame")
+	ErrNoHeader          = errors.New("backup doesn't start with a header")
+)
+
+const (
+	passphraseDigits = 30
+	keyDigestRounds  = 250000
+	frameMACLength   = 10
+	// Frames are small protobufs (SQL statements and metadata), attachments are streamed separately
+	maxFrameLength = 64 * 1024 * 1024
+)
+
+// NormalizePassphrase removes the spaces and dashes that are usually used to group the passphrase digits.
+func NormalizePassphrase(passphrase string) (string, error) {
+	passphrase = strings.NewReplacer(" ", "", "-", "").Replace(passphrase)
+	if len(passphrase) != passphraseDigits {
+		return "", fmt.Errorf("%w: expected %d digits", ErrInvalidPassphrase, passphraseDigits)
+	}
+	for _, char := range passphrase {
+		if char < '0' || char > '9' {
+			return "", fmt.Errorf("%w: expected only digits", ErrInvalidPassphrase)
+		}
+	}
+	return passphrase, nil
+}
+
+// DeriveKeys derives the frame cipher and MAC keys from the passphrase and the salt in the backup header.
+func DeriveKeys(passphrase string, salt []byte) (cipherKey, macKey []byte) {
+	input := []byte(passphrase)
+	digest := sha512.New()
+	key := input
+	digest.Write(salt)
+	for i := 0; i < keyDigestRounds; i++ {
+		digest.Write(key)
+		digest.Write(input)
+		key = digest.Sum(key[:0:0])
+		digest.Reset()
+	}
+	derived := make([]byte, 64)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key[:32], nil, []byte("Backup Export")), derived)
+	if err != nil {
+		panic(err)
+	}
+	return derived[:32], derived[32:]
+}
+
+// Reader decrypts the frames of a backup file one by one.
+type Reader struct {
+	r       *bufio.Reader
+	header  *Header
+	block   cipher.Block
+	mac     hash.Hash
+	iv      []byte
+	counter uint32
+
+	pendingBlob *Blob
+}
+
+// NewReader reads the backup header from r and derives the keys using the passphrase.
+func NewReader(r io.Reader, passphrase string) (*Reader, error) {
+	passphrase, err := NormalizePassphrase(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	br := &Reader{r: bufio.NewReaderSize(r, 64*1024)}
+	var headerLength uint32
+	err = binary.Read(br.r, binary.BigEndian, &headerLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header length: %w", err)
+	} else if headerLength > maxFrameLength {
+		return nil, fmt.Errorf("%w (header too long)", ErrNoHeader)
+	}
+	headerData := make([]byte, headerLength)
+	_, err = io.ReadFull(br.r, headerData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	frame, err := parseFrame(headerData)
+	if err != nil || frame.Header == nil {
+		return nil, ErrNoHeader
+	}
+	br.header = frame.Header
+	if len(br.header.IV) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV length %d in backup header", len(br.header.IV))
+	}
+	br.iv = make([]byte, aes.BlockSize)
+	copy(br.iv, br.header.IV)
+	br.counter = binary.BigEndian.Uint32(br.iv)
+
+	cipherKey, macKey := DeriveKeys(passphrase, br.header.Salt)
+	br.block, err = aes.NewCipher(cipherKey)
+	if err != nil {
+		return nil, err
+	}
+	br.mac = hmac.New(sha256.New, macKey)
+	return br, nil
+}
+
+// Version returns the backup format version from the header.
+func (br *Reader) Version() uint32 {
+	return br.header.Version
+}
+
+func (br *Reader) nextCipher() cipher.Stream {
+	binary.BigEndian.PutUint32(br.iv, br.counter)
+	br.counter++
+	br.mac.Reset()
+	return cipher.NewCTR(br.block, br.iv)
+}
+
+func (br *Reader) checkMAC(theirMAC []byte) error {
+	if !hmac.Equal(br.mac.Sum(nil)[:frameMACLength], theirMAC) {
+		return ErrBadMAC
+	}
+	return nil
+}
+
+// Next reads and decrypts the next frame. If the previous frame had a blob which wasn't read
+// with ReadBlob, it's skipped automatically.
+func (br *Reader) Next() (*Frame, error) {
+	if br.pendingBlob != nil {
+		if err := br.ReadBlob(io.Discard); err != nil {
+			return nil, err
+		}
+	}
+	stream := br.nextCipher()
+	lengthBytes := make([]byte, 4)
+	_, err := io.ReadFull(br.r, lengthBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame length: %w", err)
+	}
+	// Since version 1, the frame length is encrypted too
+	if br.header.Version >= 1 {
+		br.mac.Write(lengthBytes)
+		stream.XORKeyStream(lengthBytes, lengthBytes)
+	}
+	frameLength := binary.BigEndian.Uint32(lengthBytes)
+	if frameLength < frameMACLength || frameLength > maxFrameLength {
+		// A wrong passphrase usually shows up here first, as the decrypted length is garbage
+		return nil, fmt.Errorf("%w (invalid frame length %d)", ErrBadMAC, frameLength)
+	}
+	data := make([]byte, frameLength)
+	_, err = io.ReadFull(br.r, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame: %w", err)
+	}
+	ciphertext, theirMAC := data[:frameLength-frameMACLength], data[frameLength-frameMACLength:]
+	br.mac.Write(ciphertext)
+	if err = br.checkMAC(theirMAC); err != nil {
+		return nil, err
+	}
+	stream.XORKeyStream(ciphertext, ciphertext)
+	frame, err := parseFrame(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse frame: %w", err)
+	}
+	if frame.Blob != nil {
+		br.pendingBlob = frame.Blob
+	}
+	return frame, nil
+}
+
+// ReadBlob decrypts the attachment, avatar or sticker that follows the previous frame into w.
+func (br *Reader) ReadBlob(w io.Writer) error {
+	blob := br.pendingBlob
+	if blob == nil {
+		return errors.New("previous frame doesn't have a blob")
+	}
+	br.pendingBlob = nil
+	stream := br.nextCipher()
+	br.mac.Write(br.iv)
+	buf := make([]byte, 32*1024)
+	remaining := int64(blob.Length)
+	for remaining > 0 {
+		chunk := buf
+		if int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := io.ReadFull(br.r, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to read blob: %w", err)
+		}
+		br.mac.Write(chunk[:n])
+		stream.XORKeyStream(chunk[:n], chunk[:n])
+		if _, err = w.Write(chunk[:n]); err != nil {
+			return err
+		}
+		remaining -= int64(n)
+	}
+	theirMAC := make([]byte, frameMACLength)
+	_, err := io.ReadFull(br.r, theirMAC)
+	if err != nil {
+		return fmt.Errorf("failed to read blob MAC: %w", err)
+	}
+	return br.checkMAC(theirMAC)
+}
@@ -0,0 +1,301 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const testPassphrase = "12345 67890 12345 67890 12345 67890"
+
+func TestNormalizePassphrase(t *testing.T) {
+	normalized, err := NormalizePassphrase("12345-67890 12345 67890 12345 67890")
+	require.NoError(t, err)
+	assert.Equal(t, "123456789012345678901234567890", normalized)
+	_, err = NormalizePassphrase("12345")
+	assert.ErrorIs(t, err, ErrInvalidPassphrase)
+	_, err = NormalizePassphrase("12345 67890 12345 67890 12345 6789a")
+	assert.ErrorIs(t, err, ErrInvalidPassphrase)
+}
+
+func TestDeriveKeys_KnownAnswer(t *testing.T) {
+	// Generated with a Python port of BackupRecordInputStream.getBackupKey and HKDF
+	salt := make([]byte, 32)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	normalized, err := NormalizePassphrase(testPassphrase)
+	require.NoError(t, err)
+	cipherKey, macKey := DeriveKeys(normalized, salt)
+	assert.Equal(t, "bca8e1dc9cc9f2d7bd1dc3fe1018633019cabf7bb810bbcecb0b4a92018d4ec7", hex.EncodeToString(cipherKey))
+	assert.Equal(t, "e5943bd4bb63eb518263b841a5a86f68cec871093ff4055773345934a8cb5f4c", hex.EncodeToString(macKey))
+}
+
+// testBackupWriter creates backups the same way BackupRecordOutputStream in Signal Android does.
+type testBackupWriter struct {
+	buf     bytes.Buffer
+	block   cipher.Block
+	macKey  []byte
+	iv      []byte
+	counter uint32
+	version uint32
+}
+
+func newTestBackupWriter(t *testing.T, version uint32) *testBackupWriter {
+	salt := bytes.Repeat([]byte{0x42}, 32)
+	iv := bytes.Repeat([]byte{0x01}, 16)
+	normalized, err := NormalizePassphrase(testPassphrase)
+	require.NoError(t, err)
+	cipherKey, macKey := DeriveKeys(normalized, salt)
+	block, err := aes.NewCipher(cipherKey)
+	require.NoError(t, err)
+	w := &testBackupWriter{block: block, macKey: macKey, iv: iv, counter: binary.BigEndian.Uint32(iv), version: version}
+
+	var header []byte
+	header = protowire.AppendTag(header, 1, protowire.BytesType)
+	header = protowire.AppendBytes(header, iv)
+	header = protowire.AppendTag(header, 2, protowire.BytesType)
+	header = protowire.AppendBytes(header, salt)
+	header = protowire.AppendTag(header, 3, protowire.VarintType)
+	header = protowire.AppendVarint(header, uint64(version))
+	var frame []byte
+	frame = protowire.AppendTag(frame, 1, protowire.BytesType)
+	frame = protowire.AppendBytes(frame, header)
+	_ = binary.Write(&w.buf, binary.BigEndian, uint32(len(frame)))
+	w.buf.Write(frame)
+	return w
+}
+
+func (w *testBackupWriter) nextCipher() (cipher.Stream, []byte) {
+	iv := make([]byte, 16)
+	copy(iv, w.iv)
+	binary.BigEndian.PutUint32(iv, w.counter)
+	w.counter++
+	return cipher.NewCTR(w.block, iv), iv
+}
+
+func (w *testBackupWriter) writeFrame(frame []byte) {
+	stream, _ := w.nextCipher()
+	mac := hmac.New(sha256.New, w.macKey)
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(frame)+frameMACLength))
+	if w.version >= 1 {
+		stream.XORKeyStream(length, length)
+		mac.Write(length)
+	}
+	w.buf.Write(length)
+	ciphertext := make([]byte, len(frame))
+	stream.XORKeyStream(ciphertext, frame)
+	mac.Write(ciphertext)
+	w.buf.Write(ciphertext)
+	w.buf.Write(mac.Sum(nil)[:frameMACLength])
+}
+
+func (w *testBackupWriter) writeBlob(data []byte) {
+	stream, iv := w.nextCipher()
+	mac := hmac.New(sha256.New, w.macKey)
+	mac.Write(iv)
+	ciphertext := make([]byte, len(data))
+	stream.XORKeyStream(ciphertext, data)
+	mac.Write(ciphertext)
+	w.buf.Write(ciphertext)
+	w.buf.Write(mac.Sum(nil)[:frameMACLength])
+}
+
+func (w *testBackupWriter) writeStatement(stmt string, params ...any) {
+	var msg []byte
+	msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+	msg = protowire.AppendString(msg, stmt)
+	for _, param := range params {
+		var p []byte
+		switch typed := param.(type) {
+		case string:
+			p = protowire.AppendTag(p, 1, protowire.BytesType)
+			p = protowire.AppendString(p, typed)
+		case int:
+			p = protowire.AppendTag(p, 2, protowire.VarintType)
+			p = protowire.AppendVarint(p, uint64(typed))
+		case nil:
+			p = protowire.AppendTag(p, 5, protowire.VarintType)
+			p = protowire.AppendVarint(p, 1)
+		}
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, p)
+	}
+	var frame []byte
+	frame = protowire.AppendTag(frame, 2, protowire.BytesType)
+	frame = protowire.AppendBytes(frame, msg)
+	w.writeFrame(frame)
+}
+
+func (w *testBackupWriter) writeAttachment(rowID uint64, data []byte) {
+	var msg []byte
+	msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, rowID)
+	msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, rowID*10)
+	msg = protowire.AppendTag(msg, 3, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, uint64(len(data)))
+	var frame []byte
+	frame = protowire.AppendTag(frame, 4, protowire.BytesType)
+	frame = protowire.AppendBytes(frame, msg)
+	w.writeFrame(frame)
+	w.writeBlob(data)
+}
+
+func (w *testBackupWriter) writeAvatar(data []byte) {
+	var msg []byte
+	msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, uint64(len(data)))
+	msg = protowire.AppendTag(msg, 3, protowire.BytesType)
+	msg = protowire.AppendString(msg, "1")
+	var frame []byte
+	frame = protowire.AppendTag(frame, 7, protowire.BytesType)
+	frame = protowire.AppendBytes(frame, msg)
+	w.writeFrame(frame)
+	w.writeBlob(data)
+}
+
+func (w *testBackupWriter) writeEnd() {
+	var frame []byte
+	frame = protowire.AppendTag(frame, 6, protowire.VarintType)
+	frame = protowire.AppendVarint(frame, 1)
+	w.writeFrame(frame)
+}
+
+var (
+	testSelfACI   = uuid.MustParse("11111111-1111-1111-1111-111111111111")
+	testFriendACI = uuid.MustParse("22222222-2222-2222-2222-222222222222")
+)
+
+func writeTestBackup(t *testing.T, version uint32) []byte {
+	w := newTestBackupWriter(t, version)
+	w.writeStatement("CREATE TABLE recipient (_id INTEGER PRIMARY KEY, aci TEXT, e164 TEXT, group_id TEXT)")
+	w.writeStatement("CREATE TABLE thread (_id INTEGER PRIMARY KEY, recipient_id INTEGER)")
+	w.writeStatement("CREATE TABLE message (_id INTEGER PRIMARY KEY, date_sent INTEGER, type INTEGER, thread_id INTEGER, from_recipient_id INTEGER, body TEXT, quote_id INTEGER, quote_author INTEGER, remote_deleted INTEGER DEFAULT 0)")
+	w.writeStatement("CREATE TABLE attachment (_id INTEGER PRIMARY KEY, message_id INTEGER, content_type TEXT, file_name TEXT, data_size INTEGER, width INTEGER, height INTEGER, caption TEXT)")
+	w.writeStatement("CREATE TABLE reaction (_id INTEGER PRIMARY KEY, message_id INTEGER, author_id INTEGER, emoji TEXT, date_sent INTEGER)")
+	w.writeStatement("CREATE VIRTUAL TABLE message_fts USING fts5(body)")
+	w.writeStatement("INSERT INTO recipient VALUES (?, ?, ?, ?)", 1, testSelfACI.String(), "+12025550100", nil)
+	w.writeStatement("INSERT INTO recipient VALUES (?, ?, ?, ?)", 2, testFriendACI.String(), "+12025550199", nil)
+	w.writeStatement("INSERT INTO recipient VALUES (?, ?, ?, ?)", 3, nil, nil, "__signal_group__v2__!0102ff")
+	w.writeStatement("INSERT INTO thread VALUES (?, ?)", 1, 2)
+	w.writeStatement("INSERT INTO thread VALUES (?, ?)", 2, 3)
+	w.writeStatement("INSERT INTO message (_id, date_sent, type, thread_id, from_recipient_id, body) VALUES (?, ?, ?, ?, ?, ?)", 1, 1000, 10485780, 1, 2, "hello")
+	w.writeStatement("INSERT INTO message (_id, date_sent, type, thread_id, from_recipient_id, body, quote_id, quote_author) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", 2, 2000, 10485783, 1, 1, "hi!", 1000, 2)
+	// Expiration timer update, should be skipped
+	w.writeStatement("INSERT INTO message (_id, date_sent, type, thread_id, from_recipient_id, body) VALUES (?, ?, ?, ?, ?, ?)", 3, 3000, 10485780|0x40000, 1, 2, nil)
+	w.writeStatement("INSERT INTO message (_id, date_sent, type, thread_id, from_recipient_id, body) VALUES (?, ?, ?, ?, ?, ?)", 4, 4000, 10485780, 1, 2, nil)
+	w.writeStatement("INSERT INTO message_fts VALUES (?)", "hello")
+	w.writeStatement("INSERT INTO attachment VALUES (?, ?, ?, ?, ?, ?, ?, ?)", 7, 4, "image/png", "cat.png", 9, 1, 1, "a cat")
+	w.writeAttachment(7, []byte("not a png"))
+	w.writeStatement("INSERT INTO reaction VALUES (?, ?, ?, ?, ?)", 1, 1, 1, "👍", 2500)
+	w.writeAvatar([]byte("avatar data"))
+	w.writeEnd()
+	return w.buf.Bytes()
+}
+
+func testOpenBackup(t *testing.T, version uint32) {
+	data := writeTestBackup(t, version)
+	backup, err := Open(context.Background(), bytes.NewReader(data), testPassphrase, t.TempDir())
+	require.NoError(t, err)
+	defer backup.Close()
+
+	ctx := context.Background()
+	recipients, err := backup.Recipients(ctx)
+	require.NoError(t, err)
+	require.Len(t, recipients, 3)
+	assert.Equal(t, testFriendACI, recipients[2].ACI)
+	assert.Equal(t, "AQL/", recipients[3].GroupID)
+
+	threads, err := backup.Threads(ctx, recipients)
+	require.NoError(t, err)
+	require.Len(t, threads, 2)
+	assert.Equal(t, recipients[2], threads[0].Recipient)
+
+	messages, err := backup.Messages(ctx, threads[0].ID, recipients)
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+
+	assert.Equal(t, "hello", messages[0].Body)
+	assert.False(t, messages[0].Outgoing)
+	assert.Equal(t, testFriendACI, messages[0].Sender.ACI)
+	require.Len(t, messages[0].Reactions, 1)
+	assert.Equal(t, "👍", messages[0].Reactions[0].Emoji)
+	assert.Equal(t, testSelfACI, messages[0].Reactions[0].Author.ACI)
+
+	assert.Equal(t, "hi!", messages[1].Body)
+	assert.True(t, messages[1].Outgoing)
+	assert.Nil(t, messages[1].Sender)
+	assert.EqualValues(t, 1000, messages[1].QuoteTimestamp)
+	assert.Equal(t, testFriendACI, messages[1].QuoteAuthor.ACI)
+
+	require.Len(t, messages[2].Attachments, 1)
+	att := messages[2].Attachments[0]
+	assert.Equal(t, "image/png", att.ContentType)
+	assert.Equal(t, "cat.png", att.FileName)
+	assert.Equal(t, "a cat", att.Caption)
+	require.NotEmpty(t, att.Path)
+	attData, err := os.ReadFile(att.Path)
+	require.NoError(t, err)
+	assert.Equal(t, "not a png", string(attData))
+}
+
+func TestOpen_Version0(t *testing.T) {
+	testOpenBackup(t, 0)
+}
+
+func TestOpen_Version1(t *testing.T) {
+	testOpenBackup(t, 1)
+}
+
+func TestOpen_WrongPassphrase(t *testing.T) {
+	data := writeTestBackup(t, 1)
+	_, err := Open(context.Background(), bytes.NewReader(data), "00000 00000 00000 00000 00000 00000", t.TempDir())
+	assert.ErrorIs(t, err, ErrBadMAC)
+}
+
+func TestOpen_Truncated(t *testing.T) {
+	data := writeTestBackup(t, 1)
+	_, err := Open(context.Background(), bytes.NewReader(data[:len(data)-20]), testPassphrase, t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestReader_TamperedFrame(t *testing.T) {
+	data := writeTestBackup(t, 0)
+	// Flip a byte inside the first encrypted frame (after the header and the plaintext length)
+	headerLength := binary.BigEndian.Uint32(data)
+	data[4+headerLength+4+2] ^= 0x01
+	reader, err := NewReader(bytes.NewReader(data), testPassphrase)
+	require.NoError(t, err)
+	_, err = reader.Next()
+	assert.ErrorIs(t, err, ErrBadMAC)
+}
@@ -0,0 +1,173 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var _ AccountSettingsStore = (*SQLStore)(nil)
+
+type AccountSettingsStore interface {
+	// LoadAccountSettings loads the settings synced from the primary device.
+	// If nothing has been synced yet, nil is returned.
+	LoadAccountSettings(ctx context.Context) (*AccountSettings, error)
+	StoreAccountSettings(ctx context.Context, settings *AccountSettings) error
+}
+
+// AccountSettings contains the configuration, keys and block list synced from the primary device.
+type AccountSettings struct {
+	// ConfigurationSynced is false until the primary device has sent its configuration
+	ConfigurationSynced            bool
+	ReadReceipts                   bool
+	TypingIndicators               bool
+	LinkPreviews                   bool
+	UnidentifiedDeliveryIndicators bool
+
+	MasterKey         []byte
+	StorageServiceKey []byte
+
+	BlockedACIs    []string
+	BlockedNumbers []string
+	BlockedGroups  []GroupIdentifier
+}
+
+// DefaultAccountSettings are the settings used before the primary device has sent its configuration,
+// which match the defaults of the official apps.
+func DefaultAccountSettings() *AccountSettings {
+	return &AccountSettings{
+		ReadReceipts:     true,
+		TypingIndicators: true,
+		LinkPreviews:     true,
+	}
+}
+
+// Copy returns a copy of the settings that can be modified without affecting the original.
+func (s *AccountSettings) Copy() *AccountSettings {
+	cp := *s
+	cp.BlockedACIs = append([]string(nil), s.BlockedACIs...)
+	cp.BlockedNumbers = append([]string(nil), s.BlockedNumbers...)
+	cp.BlockedGroups = append([]GroupIdentifier(nil), s.BlockedGroups...)
+	return &cp
+}
+
+const (
+	blockedKindACI    = "aci"
+	blockedKindNumber = "e164"
+	blockedKindGroup  = "group"
+)
+
+const (
+	loadAccountSettingsQuery = `
+		SELECT configuration_synced, read_receipts, typing_indicators, link_previews, unidentified_delivery_indicators,
+		       master_key, storage_service_key
+		FROM signalmeow_account_settings WHERE our_aci_uuid=$1
+	`
+	storeAccountSettingsQuery = `
+		INSERT INTO signalmeow_account_settings (
+			our_aci_uuid, configuration_synced, read_receipts, typing_indicators, link_previews,
+			unidentified_delivery_indicators, master_key, storage_service_key
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (our_aci_uuid) DO UPDATE SET
+			configuration_synced=excluded.configuration_synced,
+			read_receipts=excluded.read_receipts,
+			typing_indicators=excluded.typing_indicators,
+			link_previews=excluded.link_previews,
+			unidentified_delivery_indicators=excluded.unidentified_delivery_indicators,
+			master_key=excluded.master_key,
+			storage_service_key=excluded.storage_service_key
+	`
+	loadBlockedQuery   = `SELECT kind, identifier FROM signalmeow_blocked WHERE our_aci_uuid=$1`
+	clearBlockedQuery  = `DELETE FROM signalmeow_blocked WHERE our_aci_uuid=$1`
+	insertBlockedQuery = `INSERT INTO signalmeow_blocked (our_aci_uuid, kind, identifier) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+)
+
+func (s *SQLStore) LoadAccountSettings(ctx context.Context) (*AccountSettings, error) {
+	var settings AccountSettings
+	err := s.db.QueryRowContext(ctx, loadAccountSettingsQuery, s.AciUuid).Scan(
+		&settings.ConfigurationSynced, &settings.ReadReceipts, &settings.TypingIndicators, &settings.LinkPreviews,
+		&settings.UnidentifiedDeliveryIndicators, &settings.MasterKey, &settings.StorageServiceKey,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, loadBlockedQuery, s.AciUuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, identifier string
+		if err = rows.Scan(&kind, &identifier); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case blockedKindACI:
+			settings.BlockedACIs = append(settings.BlockedACIs, identifier)
+		case blockedKindNumber:
+			settings.BlockedNumbers = append(settings.BlockedNumbers, identifier)
+		case blockedKindGroup:
+			settings.BlockedGroups = append(settings.BlockedGroups, GroupIdentifier(identifier))
+		}
+	}
+	return &settings, rows.Err()
+}
+
+func (s *SQLStore) StoreAccountSettings(ctx context.Context, settings *AccountSettings) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, storeAccountSettingsQuery,
+		s.AciUuid, settings.ConfigurationSynced, settings.ReadReceipts, settings.TypingIndicators, settings.LinkPreviews,
+		settings.UnidentifiedDeliveryIndicators, settings.MasterKey, settings.StorageServiceKey,
+	)
+	if err != nil {
+		return err
+	}
+	// The block list is always synced as a whole, so replace the old one
+	_, err = tx.ExecContext(ctx, clearBlockedQuery, s.AciUuid)
+	if err != nil {
+		return err
+	}
+	insertBlocked := func(kind, identifier string) error {
+		_, err := tx.ExecContext(ctx, insertBlockedQuery, s.AciUuid, kind, identifier)
+		return err
+	}
+	for _, aci := range settings.BlockedACIs {
+		if err = insertBlocked(blockedKindACI, aci); err != nil {
+			return err
+		}
+	}
+	for _, number := range settings.BlockedNumbers {
+		if err = insertBlocked(blockedKindNumber, number); err != nil {
+			return err
+		}
+	}
+	for _, group := range settings.BlockedGroups {
+		if err = insertBlocked(blockedKindGroup, string(group)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -17,18 +17,23 @@
 package signalmeow
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"math"
+	"os"
 
-	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
 
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
@@ -36,11 +41,70 @@ import (
 
 // *** Attachments! ***
 
-// Attachment represents an attachment received from a peer
-type Attachment struct {
-	R        io.Reader
-	MimeType string
-	FileName string
+// AttachmentFile is a decrypted attachment spilled to a temporary file.
+// The file is deleted when it's closed.
+type AttachmentFile struct {
+	*os.File
+	Size int64
+}
+
+func (f *AttachmentFile) Close() error {
+	err := f.File.Close()
+	_ = os.Remove(f.File.Name())
+	return err
+}
+
+// IncomingAttachment is an attachment received from a peer that hasn't been downloaded yet.
+type IncomingAttachment struct {
+	Pointer *signalpb.AttachmentPointer
+
+	localPath string
+	client    *web.Client
+}
+
+// NewLocalIncomingAttachment wraps an attachment that is already decrypted on disk, like the ones
+// extracted from backups. The file is handed over to the AttachmentFile returned by Download,
+// so it will be deleted when that is closed.
+func NewLocalIncomingAttachment(path string, size uint32) *IncomingAttachment {
+	return &IncomingAttachment{
+		Pointer:   &signalpb.AttachmentPointer{Size: &size},
+		localPath: path,
+	}
+}
+
+// IsLocal returns true if the attachment is read from a local file rather than downloaded from the Signal CDN.
+func (a *IncomingAttachment) IsLocal() bool {
+	return a.localPath != ""
+}
+
+// Size returns the plaintext size of the attachment as claimed by the sender.
+func (a *IncomingAttachment) Size() uint64 {
+	return uint64(a.Pointer.GetSize())
+}
+
+// Download fetches and decrypts the attachment into a temporary file. If maxSize is positive, attachments
+// larger than it fail with ErrAttachmentTooLarge. The caller must close the returned file to delete it.
+func (a *IncomingAttachment) Download(maxSize int64) (*AttachmentFile, error) {
+	if maxSize > 0 && int64(a.Size()) > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit is %d", ErrAttachmentTooLarge, a.Size(), maxSize)
+	}
+	if a.IsLocal() {
+		file, err := os.Open(a.localPath)
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		} else if maxSize > 0 && info.Size() > maxSize {
+			_ = file.Close()
+			return nil, fmt.Errorf("%w: %d bytes, limit is %d", ErrAttachmentTooLarge, info.Size(), maxSize)
+		}
+		return &AttachmentFile{File: file, Size: info.Size()}, nil
+	}
+	// The download itself is limited to the claimed size, which was checked against maxSize above
+	return downloadAttachmentToFile(a.client, a.Pointer)
 }
 
 func getAttachmentPath(id uint64, key string, cdnNumber uint32) (string, error) {
@@ -57,196 +121,434 @@ func getAttachmentPath(id uint64, key string, cdnNumber uint32) (string, error)
 // ErrInvalidMACForAttachment signals that the downloaded attachment has an invalid MAC.
 var ErrInvalidMACForAttachment = errors.New("invalid MAC for attachment")
 
-func fetchAndDecryptAttachment(a *signalpb.AttachmentPointer) ([]byte, error) {
+// ErrInvalidDigestForAttachment signals that the downloaded attachment doesn't match the digest in the attachment pointer.
+var ErrInvalidDigestForAttachment = errors.New("invalid digest for attachment")
+
+// ErrInvalidPaddingForAttachment signals that the decrypted attachment has invalid PKCS#7 padding.
+var ErrInvalidPaddingForAttachment = errors.New("invalid padding for attachment")
+
+// ErrAttachmentTooLarge signals that the attachment is larger than allowed,
+// or that the downloaded data is longer than the size in the attachment pointer allows.
+var ErrAttachmentTooLarge = errors.New("attachment too large")
+
+func openAttachmentStream(client *web.Client, a *signalpb.AttachmentPointer) (io.ReadCloser, error) {
 	path, err := getAttachmentPath(a.GetCdnId(), a.GetCdnKey(), a.GetCdnNumber())
 	if err != nil {
 		return nil, err
 	}
-	resp, err := web.GetAttachment(path, a.GetCdnNumber(), nil)
+	resp, err := client.GetAttachment(path, a.GetCdnNumber(), nil)
 	if err != nil {
 		return nil, err
 	}
-	bodyReader := resp.Body
-	defer bodyReader.Close()
-
-	body, err := io.ReadAll(bodyReader)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d fetching attachment", resp.StatusCode)
 	}
+	// Don't trust the CDN to send only as much data as the attachment pointer claims
+	body := limitAttachmentStream(resp.Body, encryptedAttachmentLength(paddedAttachmentLength(int64(a.GetSize()))))
+	return &countingReadCloser{ReadCloser: body, metrics: client.Metrics()}, nil
+}
 
-	return decryptAttachment(body, a.Key, *a.Size)
+// attachmentSizeLimiter fails reads once more than limit bytes have been read from the underlying stream.
+type attachmentSizeLimiter struct {
+	io.Reader
+	closer io.Closer
+	limit  int64
+	n      int64
 }
 
-func decryptAttachment(body, key []byte, size uint32) ([]byte, error) {
-	l := len(body) - 32
-	if !verifyMAC(key[32:], body[:l], body[l:]) {
-		return nil, ErrInvalidMACForAttachment
-	}
+// limitAttachmentStream limits an encrypted attachment stream to limit bytes. Reading more than that
+// fails with ErrAttachmentTooLarge instead of silently truncating the stream.
+func limitAttachmentStream(r io.ReadCloser, limit int64) io.ReadCloser {
+	// Allow reading one extra byte to detect when the stream is too long
+	return &attachmentSizeLimiter{Reader: io.LimitReader(r, limit+1), closer: r, limit: limit}
+}
 
-	// TODO: verify digest?
-	decrypted, err := aesDecrypt(key[:32], body[:l])
-	if err != nil {
-		return nil, err
+func (asl *attachmentSizeLimiter) Read(p []byte) (int, error) {
+	n, err := asl.Reader.Read(p)
+	asl.n += int64(n)
+	if asl.n > asl.limit {
+		return n, fmt.Errorf("%w: encrypted data is longer than %d bytes", ErrAttachmentTooLarge, asl.limit)
 	}
-	if len(decrypted) < int(size) {
-		return nil, fmt.Errorf("decrypted attachment length %v < expected %v", len(decrypted), size)
-	}
-	return decrypted[:size], nil
+	return n, err
 }
 
-type attachmentV3UploadAttributes struct {
-	Cdn                  uint32            `json:"cdn"`
-	Key                  string            `json:"key"`
-	Headers              map[string]string `json:"headers"`
-	SignedUploadLocation string            `json:"signedUploadLocation"`
+func (asl *attachmentSizeLimiter) Close() error {
+	return asl.closer.Close()
 }
 
-func encryptAndUploadAttachment(device *Device, body []byte, mimeType, filename string) (*signalpb.AttachmentPointer, error) {
-	keys := make([]byte, 64) // combined AES and MAC keys
-	randBytes(keys)
-	plaintextLength := uint32(len(body))
+// countingReadCloser reports the number of bytes read to the metrics hook when it's closed.
+type countingReadCloser struct {
+	io.ReadCloser
+	metrics web.Metrics
+	n       int64
+}
 
-	// Padded length uses exponential bracketing
-	paddedLen := int(math.Max(541, math.Floor(math.Pow(1.05, math.Ceil(math.Log(float64(len(body)))/math.Log(1.05))))))
-	if paddedLen < len(body) {
-		log.Debug().Msgf("encryptAndUploadAttachment paddedLen %v < len %v. Continuing with a privacy risk.", paddedLen, len(body))
-	} else {
-		body = append(body, bytes.Repeat([]byte{0}, int(paddedLen)-len(body))...)
-	}
+func (crc *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := crc.ReadCloser.Read(p)
+	crc.n += int64(n)
+	return n, err
+}
+
+func (crc *countingReadCloser) Close() error {
+	crc.metrics.AttachmentTransfer(false, crc.n)
+	return crc.ReadCloser.Close()
+}
 
-	encrypted, err := aesEncrypt(keys[:32], body)
+// fetchAndDecryptAttachment downloads a small attachment (like avatars or sync blobs) into memory.
+// Message attachments should use downloadAttachmentToFile instead.
+func fetchAndDecryptAttachment(client *web.Client, a *signalpb.AttachmentPointer) ([]byte, error) {
+	body, err := openAttachmentStream(client, a)
 	if err != nil {
 		return nil, err
 	}
-	encryptedWithMAC := appendMAC(keys[32:], encrypted)
+	defer body.Close()
 
-	// Get upload attributes from Signal server
-	attributesPath := "/v3/attachments/form/upload"
-	username, password := device.Data.BasicAuthCreds()
-	opts := &web.HTTPReqOpt{Username: &username, Password: &password}
-	resp, err := web.SendHTTPRequest("GET", attributesPath, opts)
+	var buf bytes.Buffer
+	err = decryptAttachmentStream(&buf, body, a.GetKey(), a.GetDigest(), a.GetSize())
 	if err != nil {
-		log.Err(err).Msg("Error sending request fetching upload attributes")
 		return nil, err
 	}
-	var uploadAttributes attachmentV3UploadAttributes
-	err = web.DecodeHTTPResponseBody(&uploadAttributes, resp)
+	return buf.Bytes(), nil
+}
+
+func downloadAttachmentToFile(client *web.Client, a *signalpb.AttachmentPointer) (*AttachmentFile, error) {
+	body, err := openAttachmentStream(client, a)
 	if err != nil {
-		log.Err(err).Msg("Error decoding response body fetching upload attributes")
 		return nil, err
 	}
+	defer body.Close()
 
-	// Allocate attachment on CDN
-	resp, err = web.SendHTTPRequest("POST", "", &web.HTTPReqOpt{
-		OverrideURL: uploadAttributes.SignedUploadLocation,
-		ContentType: web.ContentTypeOctetStream,
-		Headers:     uploadAttributes.Headers,
-		Username:    &username,
-		Password:    &password,
-	})
+	file, err := os.CreateTemp("", "signalmeow-attachment-*")
 	if err != nil {
-		log.Err(err).Msg("Error sending request allocating attachment")
-		return nil, err
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		err := fmt.Errorf("Error allocating attachment: %v", resp.Status)
-		log.Err(err).Msg("Error allocating attachment")
+	attachmentFile := &AttachmentFile{File: file, Size: int64(a.GetSize())}
+	// Buffer writes, the decrypter writes at most one AES block at a time at the end
+	writer := bufio.NewWriterSize(file, 64*1024)
+	err = decryptAttachmentStream(writer, body, a.GetKey(), a.GetDigest(), a.GetSize())
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = attachmentFile.Close()
 		return nil, err
 	}
+	return attachmentFile, nil
+}
 
-	// Upload attachment to CDN
-	resp, err = web.SendHTTPRequest("PUT", "", &web.HTTPReqOpt{
-		OverrideURL: resp.Header.Get("Location"),
-		Body:        encryptedWithMAC,
-		ContentType: web.ContentTypeOctetStream,
-		Username:    &username,
-		Password:    &password,
-	})
+func decryptAttachment(body, key, digest []byte, size uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	err := decryptAttachmentStream(&buf, bytes.NewReader(body), key, digest, size)
 	if err != nil {
-		log.Err(err).Msg("Error sending request uploading attachment")
 		return nil, err
 	}
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		err := fmt.Errorf("Error uploading attachment: %v", resp.Status)
-		log.Err(err).Msg("Error uploading attachment")
-		return nil, err
+	return buf.Bytes(), nil
+}
+
+const attachmentMACLength = sha256.Size
+const attachmentChunkSize = 32 * 1024
+
+// decryptAttachmentStream decrypts an attachment (IV || AES-256-CBC ciphertext || HMAC-SHA256) from r
+// and writes the first size bytes of the plaintext to w. The MAC and the SHA-256 digest of the whole
+// encrypted blob are calculated on the fly and verified at the end. The digest is only checked if one is given.
+//
+// The plaintext is written before the MAC can be checked, so callers must discard the output if this returns an error.
+func decryptAttachmentStream(w io.Writer, r io.Reader, key, expectedDigest []byte, size uint32) error {
+	if len(key) != 64 {
+		return fmt.Errorf("invalid attachment key length %d", len(key))
 	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, key[32:])
+	digestHasher := sha256.New()
 
-	// Calculate digest
-	hasher := sha256.New()
-	hasher.Write(encryptedWithMAC)
-	digest := hasher.Sum(nil)
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(r, iv); err != nil {
+		return fmt.Errorf("failed to read attachment IV: %w", err)
+	}
+	mac.Write(iv)
+	digestHasher.Write(iv)
+	mode := cipher.NewCBCDecrypter(block, iv)
 
-	attachmentPointer := &signalpb.AttachmentPointer{
-		AttachmentIdentifier: &signalpb.AttachmentPointer_CdnKey{
-			CdnKey: uploadAttributes.Key,
-		},
-		Key:         keys,
-		Digest:      digest,
-		Size:        &plaintextLength,
-		FileName:    &filename,
-		ContentType: &mimeType,
-		CdnNumber:   &uploadAttributes.Cdn,
+	remaining := int64(size)
+	writePlaintext := func(plaintext []byte) error {
+		if int64(len(plaintext)) > remaining {
+			plaintext = plaintext[:remaining]
+		}
+		if len(plaintext) == 0 {
+			return nil
+		}
+		remaining -= int64(len(plaintext))
+		_, err := w.Write(plaintext)
+		return err
 	}
 
-	return attachmentPointer, nil
+	// The last AES block and the MAC are always held back, as the block needs to be unpadded
+	// and the MAC must not be fed to the decrypter.
+	const holdBack = aes.BlockSize + attachmentMACLength
+	buf := make([]byte, 0, attachmentChunkSize+holdBack)
+	for {
+		n, readErr := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if processable := (len(buf) - holdBack) / aes.BlockSize * aes.BlockSize; processable > 0 {
+			chunk := buf[:processable]
+			mac.Write(chunk)
+			digestHasher.Write(chunk)
+			mode.CryptBlocks(chunk, chunk)
+			if err = writePlaintext(chunk); err != nil {
+				return err
+			}
+			buf = buf[:copy(buf, buf[processable:])]
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+
+	if len(buf) < holdBack || (len(buf)-attachmentMACLength)%aes.BlockSize != 0 {
+		return errors.New("ciphertext not multiple of AES blocksize")
+	}
+	lastBlock := buf[:len(buf)-attachmentMACLength]
+	theirMAC := buf[len(buf)-attachmentMACLength:]
+	mac.Write(lastBlock)
+	digestHasher.Write(lastBlock)
+	digestHasher.Write(theirMAC)
+	if !hmac.Equal(mac.Sum(nil), theirMAC) {
+		return ErrInvalidMACForAttachment
+	}
+	if len(expectedDigest) > 0 && subtle.ConstantTimeCompare(digestHasher.Sum(nil), expectedDigest) != 1 {
+		return ErrInvalidDigestForAttachment
+	}
+	mode.CryptBlocks(lastBlock, lastBlock)
+	pad := lastBlock[len(lastBlock)-1]
+	if pad == 0 || pad > aes.BlockSize {
+		return fmt.Errorf("%w: pad value %d out of range", ErrInvalidPaddingForAttachment, pad)
+	}
+	for _, padByte := range lastBlock[len(lastBlock)-int(pad):] {
+		if padByte != pad {
+			return fmt.Errorf("%w: inconsistent pad bytes", ErrInvalidPaddingForAttachment)
+		}
+	}
+	if err = writePlaintext(lastBlock[:len(lastBlock)-int(pad)]); err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return fmt.Errorf("decrypted attachment length %v < expected %v", int64(size)-remaining, size)
+	}
+	return nil
+}
+
+// paddedAttachmentLength uses exponential bracketing to hide the exact size of attachments.
+func paddedAttachmentLength(size int64) int64 {
+	return int64(math.Max(541, math.Floor(math.Pow(1.05, math.Ceil(math.Log(float64(size))/math.Log(1.05))))))
 }
 
-func verifyMAC(key, body, mac []byte) bool {
-	m := hmac.New(sha256.New, key)
-	m.Write(body)
-	return hmac.Equal(m.Sum(nil), mac)
+// encryptedAttachmentLength is the length of the encrypted blob for a padded plaintext of the given length.
+func encryptedAttachmentLength(paddedLength int64) int64 {
+	return aes.BlockSize + (paddedLength/aes.BlockSize+1)*aes.BlockSize + attachmentMACLength
 }
 
-func aesDecrypt(key, ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// encryptAttachmentStream encrypts size bytes from r, padded to paddedSize with zeroes, and writes
+// IV || AES-256-CBC ciphertext || HMAC-SHA256 to w. The digest of the written data is returned.
+func encryptAttachmentStream(w io.Writer, r io.Reader, keys, iv []byte, size, paddedSize int64) (digest []byte, err error) {
+	block, err := aes.NewCipher(keys[:32])
 	if err != nil {
 		return nil, err
 	}
+	mac := hmac.New(sha256.New, keys[32:])
+	digestHasher := sha256.New()
+	out := io.MultiWriter(w, mac, digestHasher)
 
-	if len(ciphertext)%aes.BlockSize != 0 {
-		length := len(ciphertext) % aes.BlockSize
-		log.Debug().Msgf("aesDecrypt ciphertext not multiple of AES blocksize: %v", length)
-		return nil, errors.New("ciphertext not multiple of AES blocksize")
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV length %d", len(iv))
 	}
+	if _, err = out.Write(iv); err != nil {
+		return nil, err
+	}
+	mode := cipher.NewCBCEncrypter(block, iv)
 
-	iv := ciphertext[:aes.BlockSize]
-	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(ciphertext, ciphertext)
-	pad := ciphertext[len(ciphertext)-1]
-	if pad > aes.BlockSize {
-		return nil, fmt.Errorf("pad value (%d) larger than AES blocksize (%d)", pad, aes.BlockSize)
+	if paddedSize < size {
+		paddedSize = size
 	}
-	return ciphertext[aes.BlockSize : len(ciphertext)-int(pad)], nil
+	plaintext := io.MultiReader(
+		&io.LimitedReader{R: r, N: size},
+		io.LimitReader(zeroReader{}, paddedSize-size),
+	)
+	buf := make([]byte, attachmentChunkSize)
+	var read int64
+	for {
+		n, readErr := io.ReadFull(plaintext, buf)
+		read += int64(n)
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			// Final chunk: add PKCS#7 padding
+			pad := aes.BlockSize - n%aes.BlockSize
+			chunk := append(buf[:n], bytes.Repeat([]byte{byte(pad)}, pad)...)
+			mode.CryptBlocks(chunk, chunk)
+			if _, err = out.Write(chunk); err != nil {
+				return nil, err
+			}
+			break
+		} else if readErr != nil {
+			return nil, readErr
+		}
+		mode.CryptBlocks(buf, buf)
+		if _, err = out.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+	if read != paddedSize {
+		return nil, fmt.Errorf("attachment reader ended after %d bytes, expected %d", read-(paddedSize-size), size)
+	}
+	ourMAC := mac.Sum(nil)
+	digestHasher.Write(ourMAC)
+	if _, err = w.Write(ourMAC); err != nil {
+		return nil, err
+	}
+	return digestHasher.Sum(nil), nil
 }
 
-func randBytes(data []byte) {
-	if _, err := io.ReadFull(rand.Reader, data); err != nil {
-		panic(err)
+const (
+	incrementalMACMinChunkSize    = 64 * 1024
+	incrementalMACMaxChunkSize    = 2 * 1024 * 1024
+	incrementalMACTargetChunkSize = 8 * 1024 / sha256.Size
+)
+
+// incrementalMACChunkSize picks the chunk size for the incremental MAC of an encrypted blob of
+// the given length, the same way libsignal does: aim for 256 chunks within the allowed bounds.
+func incrementalMACChunkSize(encryptedLength int64) int64 {
+	if encryptedLength < incrementalMACTargetChunkSize*incrementalMACMinChunkSize {
+		return incrementalMACMinChunkSize
+	} else if encryptedLength < incrementalMACTargetChunkSize*incrementalMACMaxChunkSize {
+		return (encryptedLength + incrementalMACTargetChunkSize - 1) / incrementalMACTargetChunkSize
 	}
+	return incrementalMACMaxChunkSize
 }
 
-func appendMAC(key, body []byte) []byte {
-	m := hmac.New(sha256.New, key)
-	m.Write(body)
-	return m.Sum(body)
+// incrementalMACWriter calculates the incremental MAC of the data written to it, which lets
+// receivers verify streamed attachments chunk by chunk. After every full chunk the HMAC of all
+// data so far is appended to the digest, and Sum appends the HMAC of the whole stream.
+// Like libsignal, the final HMAC is appended even if the stream ends on a chunk boundary.
+type incrementalMACWriter struct {
+	mac       hash.Hash
+	chunkSize int64
+	unused    int64
+	digest    []byte
 }
 
-func aesEncrypt(key, plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+func newIncrementalMACWriter(macKey []byte, chunkSize int64) *incrementalMACWriter {
+	return &incrementalMACWriter{
+		mac:       hmac.New(sha256.New, macKey),
+		chunkSize: chunkSize,
+		unused:    chunkSize,
+	}
+}
+
+func (imw *incrementalMACWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := int64(len(p))
+		if n > imw.unused {
+			n = imw.unused
+		}
+		imw.mac.Write(p[:n])
+		p = p[n:]
+		imw.unused -= n
+		if imw.unused == 0 {
+			imw.digest = imw.mac.Sum(imw.digest)
+			imw.unused = imw.chunkSize
+		}
+	}
+	return written, nil
+}
+
+// Sum returns the concatenated chunk MACs, ending with the MAC of the whole stream.
+func (imw *incrementalMACWriter) Sum() []byte {
+	return imw.mac.Sum(imw.digest)
+}
+
+func encryptAndUploadAttachment(ctx context.Context, device *Device, body io.Reader, size int64, mimeType, filename string) (*signalpb.AttachmentPointer, error) {
+	keys := make([]byte, 64) // combined AES and MAC keys
+	randBytes(keys)
+	plaintextLength := uint32(size)
+
+	paddedLen := paddedAttachmentLength(size)
+	if paddedLen < size {
+		device.log().Debug().Msgf("encryptAndUploadAttachment paddedLen %v < len %v. Continuing with a privacy risk.", paddedLen, size)
+		paddedLen = size
+	}
+
+	// Spill the encrypted attachment to a temp file so that the whole file never needs to be in memory
+	encryptedFile, err := os.CreateTemp("", "signalmeow-upload-*")
 	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		_ = encryptedFile.Close()
+		_ = os.Remove(encryptedFile.Name())
+	}()
+	encryptedLength := encryptedAttachmentLength(paddedLen)
+	incrementalMACChunk := incrementalMACChunkSize(encryptedLength)
+	incrementalMAC := newIncrementalMACWriter(keys[32:], incrementalMACChunk)
+	writer := bufio.NewWriterSize(encryptedFile, 64*1024)
+	iv := make([]byte, aes.BlockSize)
+	randBytes(iv)
+	digest, err := encryptAttachmentStream(io.MultiWriter(writer, incrementalMAC), body, keys, iv, size, paddedLen)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt attachment: %w", err)
+	}
+	if _, err = encryptedFile.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
 
-	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
-	plaintext = append(plaintext, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	uploadForm, err := getAttachmentUploadForm(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	err = newResumableUpload(device.web(), uploadForm, encryptedFile, encryptedLength).Upload(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload attachment to CDN%d: %w", uploadForm.Cdn, err)
+	}
+	device.metrics().AttachmentTransfer(true, encryptedLength)
 
-	ciphertext := make([]byte, len(plaintext))
-	iv := make([]byte, 16)
-	randBytes(iv)
+	attachmentPointer := &signalpb.AttachmentPointer{
+		AttachmentIdentifier: &signalpb.AttachmentPointer_CdnKey{
+			CdnKey: uploadForm.Key,
+		},
+		Key:                     keys,
+		Digest:                  digest,
+		IncrementalMac:          incrementalMAC.Sum(),
+		IncrementalMacChunkSize: proto.Uint32(uint32(incrementalMACChunk)),
+		Size:                    &plaintextLength,
+		FileName:                &filename,
+		ContentType:             &mimeType,
+		CdnNumber:               &uploadForm.Cdn,
+	}
 
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(ciphertext, plaintext)
+	return attachmentPointer, nil
+}
 
-	return append(iv, ciphertext...), nil
+func randBytes(data []byte) {
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		panic(err)
+	}
 }
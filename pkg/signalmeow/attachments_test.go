@@ -0,0 +1,250 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return data
+}
+
+func sequentialBytes(start, length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(start + i)
+	}
+	return data
+}
+
+// Known answer generated with openssl enc -aes-256-cbc and Python's hmac/hashlib
+var (
+	testAttachmentKeys      = sequentialBytes(0, 64)
+	testAttachmentIV        = sequentialBytes(0xa0, 16)
+	testAttachmentPlaintext = []byte("Hello, Signal!")
+	testAttachmentPadded    = 24
+	testAttachmentBlob      = "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf8a9b50ad9d79ab7ecb77b55d4218e2aa3cc5d31b17316119739b23dc95d934ff43bfc96e46ff6ec3c410daf03eabcd242396b938ba9932a2564da34120a1379e"
+	testAttachmentDigest    = "c447cf9cef28c7e258076a7f556815445789b86c007bbbdeaba2ca30454aa593"
+)
+
+func TestEncryptAttachmentStream_KnownAnswer(t *testing.T) {
+	var buf bytes.Buffer
+	digest, err := encryptAttachmentStream(
+		&buf, bytes.NewReader(testAttachmentPlaintext), testAttachmentKeys, testAttachmentIV,
+		int64(len(testAttachmentPlaintext)), int64(testAttachmentPadded),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, testAttachmentBlob, hex.EncodeToString(buf.Bytes()))
+	assert.Equal(t, testAttachmentDigest, hex.EncodeToString(digest))
+	assert.EqualValues(t, encryptedAttachmentLength(int64(testAttachmentPadded)), buf.Len())
+}
+
+func TestDecryptAttachment_KnownAnswer(t *testing.T) {
+	blob := mustDecodeHex(t, testAttachmentBlob)
+	digest := mustDecodeHex(t, testAttachmentDigest)
+	plaintext, err := decryptAttachment(blob, testAttachmentKeys, digest, uint32(len(testAttachmentPlaintext)))
+	require.NoError(t, err)
+	assert.Equal(t, testAttachmentPlaintext, plaintext)
+}
+
+func TestDecryptAttachment_NoDigest(t *testing.T) {
+	blob := mustDecodeHex(t, testAttachmentBlob)
+	plaintext, err := decryptAttachment(blob, testAttachmentKeys, nil, uint32(len(testAttachmentPlaintext)))
+	require.NoError(t, err)
+	assert.Equal(t, testAttachmentPlaintext, plaintext)
+}
+
+func TestDecryptAttachment_WrongDigest(t *testing.T) {
+	blob := mustDecodeHex(t, testAttachmentBlob)
+	digest := mustDecodeHex(t, testAttachmentDigest)
+	digest[0] ^= 0xff
+	_, err := decryptAttachment(blob, testAttachmentKeys, digest, uint32(len(testAttachmentPlaintext)))
+	assert.ErrorIs(t, err, ErrInvalidDigestForAttachment)
+}
+
+func TestDecryptAttachment_TamperedCiphertext(t *testing.T) {
+	blob := mustDecodeHex(t, testAttachmentBlob)
+	blob[20] ^= 0x01
+	_, err := decryptAttachment(blob, testAttachmentKeys, mustDecodeHex(t, testAttachmentDigest), uint32(len(testAttachmentPlaintext)))
+	assert.ErrorIs(t, err, ErrInvalidMACForAttachment)
+}
+
+func TestDecryptAttachment_InvalidPadding(t *testing.T) {
+	// A correctly MACed blob whose last block ends in ... 0x01 0x03 0x03 rather than three 0x03 bytes
+	plaintext := append(bytes.Repeat([]byte{'A'}, 13), 0x01, 0x03, 0x03)
+	block, err := aes.NewCipher(testAttachmentKeys[:32])
+	require.NoError(t, err)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, testAttachmentIV).CryptBlocks(ciphertext, plaintext)
+	blob := append(append([]byte{}, testAttachmentIV...), ciphertext...)
+	mac := hmac.New(sha256.New, testAttachmentKeys[32:])
+	mac.Write(blob)
+	blob = mac.Sum(blob)
+	digest := sha256.Sum256(blob)
+
+	_, err = decryptAttachment(blob, testAttachmentKeys, digest[:], 13)
+	assert.ErrorIs(t, err, ErrInvalidPaddingForAttachment)
+}
+
+func TestAttachmentRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 15, 16, 17, attachmentChunkSize - 1, attachmentChunkSize, attachmentChunkSize*3 + 5} {
+		plaintext := sequentialBytes(size, size)
+		paddedSize := paddedAttachmentLength(int64(size))
+		var buf bytes.Buffer
+		digest, err := encryptAttachmentStream(&buf, bytes.NewReader(plaintext), testAttachmentKeys, testAttachmentIV, int64(size), paddedSize)
+		require.NoError(t, err, "size %d", size)
+		require.EqualValues(t, encryptedAttachmentLength(paddedSize), buf.Len(), "size %d", size)
+		decrypted, err := decryptAttachment(buf.Bytes(), testAttachmentKeys, digest, uint32(size))
+		require.NoError(t, err, "size %d", size)
+		assert.True(t, bytes.Equal(plaintext, decrypted), "size %d", size)
+	}
+}
+
+func TestDecryptAttachment_StreamLongerThanClaimed(t *testing.T) {
+	plaintext := sequentialBytes(1, 10000)
+	paddedSize := paddedAttachmentLength(int64(len(plaintext)))
+	var buf bytes.Buffer
+	digest, err := encryptAttachmentStream(&buf, bytes.NewReader(plaintext), testAttachmentKeys, testAttachmentIV, int64(len(plaintext)), paddedSize)
+	require.NoError(t, err)
+
+	limitFor := func(size int) io.Reader {
+		limit := encryptedAttachmentLength(paddedAttachmentLength(int64(size)))
+		return limitAttachmentStream(io.NopCloser(bytes.NewReader(buf.Bytes())), limit)
+	}
+	var out bytes.Buffer
+	require.NoError(t, decryptAttachmentStream(&out, limitFor(len(plaintext)), testAttachmentKeys, digest, uint32(len(plaintext))))
+	assert.Equal(t, plaintext, out.Bytes())
+
+	// A sender claiming a smaller size must not be able to make the whole stream be downloaded
+	out.Reset()
+	err = decryptAttachmentStream(&out, limitFor(100), testAttachmentKeys, digest, 100)
+	assert.ErrorIs(t, err, ErrAttachmentTooLarge)
+	assert.Less(t, out.Len(), len(plaintext))
+}
+
+func TestIncomingAttachmentDownloadLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attachment")
+	require.NoError(t, os.WriteFile(path, make([]byte, 1000), 0600))
+
+	_, err := NewLocalIncomingAttachment(path, 1000).Download(999)
+	assert.ErrorIs(t, err, ErrAttachmentTooLarge)
+	// The size of the file counts even if the claimed size is smaller
+	_, err = NewLocalIncomingAttachment(path, 100).Download(999)
+	assert.ErrorIs(t, err, ErrAttachmentTooLarge)
+
+	file, err := NewLocalIncomingAttachment(path, 1000).Download(1000)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1000, file.Size)
+	require.NoError(t, file.Close())
+}
+
+// expectedIncrementalMAC calculates the incremental MAC the way libsignal's Incremental does:
+// the HMAC of all data up to the end of every full chunk, followed by the HMAC of all data.
+func expectedIncrementalMAC(key, data []byte, chunkSize int) []byte {
+	var expected []byte
+	for end := chunkSize; end <= len(data); end += chunkSize {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data[:end])
+		expected = mac.Sum(expected)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(expected)
+}
+
+func TestIncrementalMACWriter(t *testing.T) {
+	key := sequentialBytes(32, 32)
+	for _, size := range []int{0, 1, 15, 16, 17, 31, 32, 33, 40, 160} {
+		data := sequentialBytes(0, size)
+		imw := newIncrementalMACWriter(key, 16)
+		// Write in uneven pieces to make sure chunk boundaries are handled across writes
+		for written := 0; written < size; written += 7 {
+			end := written + 7
+			if end > size {
+				end = size
+			}
+			_, _ = imw.Write(data[written:end])
+		}
+		assert.Equal(t, expectedIncrementalMAC(key, data, 16), imw.Sum(), "size %d", size)
+	}
+}
+
+func TestIncrementalMACWriter_ChunkBoundary(t *testing.T) {
+	key := sequentialBytes(32, 32)
+	data := sequentialBytes(0, 32)
+	imw := newIncrementalMACWriter(key, 16)
+	_, _ = imw.Write(data)
+	sum := imw.Sum()
+	// Two chunk MACs and the final MAC, which is the same as the last chunk MAC
+	require.Len(t, sum, 3*sha256.Size)
+	assert.Equal(t, sum[sha256.Size:2*sha256.Size], sum[2*sha256.Size:])
+	fullMAC := hmac.New(sha256.New, key)
+	fullMAC.Write(data)
+	assert.Equal(t, fullMAC.Sum(nil), sum[2*sha256.Size:])
+}
+
+func TestIncrementalMACChunkSize(t *testing.T) {
+	assert.EqualValues(t, 64*1024, incrementalMACChunkSize(1000))
+	assert.EqualValues(t, 64*1024, incrementalMACChunkSize(256*64*1024-1))
+	assert.EqualValues(t, 100000, incrementalMACChunkSize(256*100000))
+	assert.EqualValues(t, 100001, incrementalMACChunkSize(256*100000+1))
+	assert.EqualValues(t, 2*1024*1024, incrementalMACChunkSize(1024*1024*1024))
+}
+
+func TestAttachmentTransferWithServer(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestPhone(t, server, "+15550000001")
+	client := linkTestClient(t, server, alice)
+	data := bytes.Repeat([]byte("signalmeow attachment "), 10000)
+
+	pointer, err := client.UploadAttachment(context.Background(), data, "text/plain", "attachment.txt")
+	require.NoError(t, err)
+	assert.Equal(t, 1, server.AttachmentCount())
+	ap := (*signalpb.AttachmentPointer)(pointer)
+	assert.Equal(t, uint32(len(data)), ap.GetSize())
+	downloaded, err := alice.DownloadAttachment(ap)
+	require.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+
+	phonePointer, err := alice.UploadAttachment(data, "text/plain")
+	require.NoError(t, err)
+	file, err := downloadAttachmentToFile(client.Device.web(), phonePointer)
+	require.NoError(t, err)
+	defer file.Close()
+	assert.Equal(t, int64(len(data)), file.Size)
+	fileData, err := io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t, data, fileData)
+}
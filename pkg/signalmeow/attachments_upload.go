@@ -0,0 +1,278 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// attachmentUploadForm is the response of the upload form endpoint. It tells which CDN to
+// upload to and how to authenticate with it.
+type attachmentUploadForm struct {
+	Cdn                  uint32            `json:"cdn"`
+	Key                  string            `json:"key"`
+	Headers              map[string]string `json:"headers"`
+	SignedUploadLocation string            `json:"signedUploadLocation"`
+}
+
+const attachmentUploadFormPath = "/v4/attachments/form/upload"
+
+const (
+	maxAttachmentUploadAttempts = 5
+	attachmentUploadRetryDelay  = 2 * time.Second
+	tusVersion                  = "1.0.0"
+)
+
+var errUploadIncomplete = errors.New("upload incomplete")
+
+func getAttachmentUploadForm(ctx context.Context, device *Device) (*attachmentUploadForm, error) {
+	username, password := device.Data.BasicAuthCreds()
+	opts := &web.HTTPReqOpt{Username: &username, Password: &password, Context: ctx}
+	resp, err := device.web().SendHTTPRequest("GET", attachmentUploadFormPath, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request upload form: %w", err)
+	}
+	var form attachmentUploadForm
+	err = web.DecodeHTTPResponseBody(&form, resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode upload form: %w", err)
+	}
+	return &form, nil
+}
+
+// resumableUpload uploads a blob to the CDN chosen by the upload form. Both CDN2 (Google Cloud
+// Storage resumable uploads) and CDN3 (TUS) support resuming, so if the connection breaks
+// halfway through, the current offset is queried from the CDN and the upload continues from there.
+type resumableUpload struct {
+	client *web.Client
+	form   *attachmentUploadForm
+	body   io.ReadSeeker
+	length int64
+
+	uploadURL string
+	// retryDelay is a field so that tests don't have to wait
+	retryDelay time.Duration
+}
+
+func newResumableUpload(client *web.Client, form *attachmentUploadForm, body io.ReadSeeker, length int64) *resumableUpload {
+	return &resumableUpload{
+		client:     client,
+		form:       form,
+		body:       body,
+		length:     length,
+		retryDelay: attachmentUploadRetryDelay,
+	}
+}
+
+// Upload uploads the body, retrying with a delay if the connection breaks. Cancelling the context stops the upload.
+func (ru *resumableUpload) Upload(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	err := ru.create(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create upload session: %w", err)
+	}
+	var offset int64
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			offset, err = ru.getOffset(ctx)
+			if err != nil {
+				log.Warn().Err(err).Int("attempt", attempt).Msg("Failed to get attachment upload offset")
+				offset = -1
+			}
+		}
+		if offset == ru.length {
+			return nil
+		} else if offset >= 0 {
+			err = ru.send(ctx, offset)
+			if err == nil {
+				return nil
+			}
+		}
+		if attempt >= maxAttachmentUploadAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		log.Warn().Err(err).
+			Int("attempt", attempt).
+			Int64("offset", offset).
+			Int64("length", ru.length).
+			Msg("Attachment upload interrupted, resuming")
+		timer := time.NewTimer(ru.retryDelay * time.Duration(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (ru *resumableUpload) isTUS() bool {
+	return ru.form.Cdn == 3
+}
+
+func (ru *resumableUpload) create(ctx context.Context) error {
+	headers := make(map[string]string, len(ru.form.Headers)+2)
+	for key, value := range ru.form.Headers {
+		headers[key] = value
+	}
+	if ru.isTUS() {
+		headers["Tus-Resumable"] = tusVersion
+		headers["Upload-Length"] = strconv.FormatInt(ru.length, 10)
+	}
+	resp, err := ru.client.SendHTTPRequest(http.MethodPost, "", &web.HTTPReqOpt{
+		OverrideURL: ru.form.SignedUploadLocation,
+		ContentType: web.ContentTypeOctetStream,
+		Headers:     headers,
+		Context:     ctx,
+	})
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" && ru.isTUS() {
+		// TUS servers should return a location, but the upload URL is well-known anyway
+		location = ru.form.SignedUploadLocation + "/" + ru.form.Key
+	} else if location == "" {
+		return errors.New("no upload location in response")
+	}
+	base, err := url.Parse(ru.form.SignedUploadLocation)
+	if err != nil {
+		return fmt.Errorf("failed to parse upload location: %w", err)
+	}
+	uploadURL, err := base.Parse(location)
+	if err != nil {
+		return fmt.Errorf("failed to parse upload session location: %w", err)
+	}
+	ru.uploadURL = uploadURL.String()
+	return nil
+}
+
+func (ru *resumableUpload) requestHeaders() map[string]string {
+	if !ru.isTUS() {
+		return nil
+	}
+	headers := make(map[string]string, len(ru.form.Headers)+1)
+	for key, value := range ru.form.Headers {
+		headers[key] = value
+	}
+	headers["Tus-Resumable"] = tusVersion
+	return headers
+}
+
+var gcsRangeRegex = regexp.MustCompile(`^bytes=0-(\d+)$`)
+
+// getOffset asks the CDN how many bytes of the upload it has received.
+func (ru *resumableUpload) getOffset(ctx context.Context) (int64, error) {
+	if ru.isTUS() {
+		resp, err := ru.client.SendHTTPRequest(http.MethodHead, "", &web.HTTPReqOpt{
+			OverrideURL: ru.uploadURL,
+			Headers:     ru.requestHeaders(),
+			Context:     ctx,
+		})
+		if err != nil {
+			return 0, err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	}
+
+	resp, err := ru.client.SendHTTPRequest(http.MethodPut, "", &web.HTTPReqOpt{
+		OverrideURL: ru.uploadURL,
+		ContentType: web.ContentTypeOctetStream,
+		Headers:     map[string]string{"Content-Range": fmt.Sprintf("bytes */%d", ru.length)},
+		Context:     ctx,
+	})
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return ru.length, nil
+	case http.StatusPermanentRedirect:
+		// GCS uses 308 to mean "resume incomplete"
+		match := gcsRangeRegex.FindStringSubmatch(resp.Header.Get("Range"))
+		if match == nil {
+			return 0, nil
+		}
+		lastByte, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return lastByte + 1, nil
+	default:
+		return 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
+
+// send uploads the rest of the body starting from the given offset.
+func (ru *resumableUpload) send(ctx context.Context, offset int64) error {
+	_, err := ru.body.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek upload body: %w", err)
+	}
+	opts := &web.HTTPReqOpt{
+		OverrideURL:   ru.uploadURL,
+		BodyReader:    io.LimitReader(ru.body, ru.length-offset),
+		ContentLength: ru.length - offset,
+		Headers:       ru.requestHeaders(),
+		Context:       ctx,
+	}
+	method := http.MethodPut
+	if ru.isTUS() {
+		method = http.MethodPatch
+		opts.ContentType = web.ContentTypeOffsetOctetStream
+		opts.Headers["Upload-Offset"] = strconv.FormatInt(offset, 10)
+	} else {
+		opts.ContentType = web.ContentTypeOctetStream
+		if offset > 0 {
+			opts.Headers = map[string]string{
+				"Content-Range": fmt.Sprintf("bytes %d-%d/%d", offset, ru.length-1, ru.length),
+			}
+		}
+	}
+	resp, err := ru.client.SendHTTPRequest(method, "", opts)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusPermanentRedirect {
+		return errUploadIncomplete
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// fakeCDN is a minimal stand-in for the CDN2 (GCS) and CDN3 (TUS) resumable upload APIs.
+// The first upload request is cut off after failAfter bytes to simulate a broken connection.
+type fakeCDN struct {
+	t         *testing.T
+	tus       bool
+	failAfter int64
+
+	lock     sync.Mutex
+	length   int64
+	received bytes.Buffer
+	failed   bool
+	requests []string
+}
+
+func (fc *fakeCDN) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.requests = append(fc.requests, r.Method)
+	if fc.tus && r.Method != http.MethodPost {
+		assert.Equal(fc.t, tusVersion, r.Header.Get("Tus-Resumable"))
+		assert.Equal(fc.t, "Bearer test", r.Header.Get("Authorization"))
+	}
+	switch {
+	case r.Method == http.MethodPost:
+		if fc.tus {
+			fc.length, _ = strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+			w.Header().Set("Location", "/upload/session")
+		} else {
+			w.Header().Set("Location", "/upload/session?upload_id=1")
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead && fc.tus:
+		w.Header().Set("Upload-Offset", strconv.Itoa(fc.received.Len()))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPatch && fc.tus:
+		assert.Equal(fc.t, strconv.Itoa(fc.received.Len()), r.Header.Get("Upload-Offset"))
+		fc.receive(w, r)
+	case r.Method == http.MethodPut && !fc.tus:
+		contentRange := r.Header.Get("Content-Range")
+		var total int64
+		if _, err := fmt.Sscanf(contentRange, "bytes */%d", &total); err == nil {
+			fc.length = total
+			if int64(fc.received.Len()) == total {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				if fc.received.Len() > 0 {
+					w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", fc.received.Len()-1))
+				}
+				w.WriteHeader(http.StatusPermanentRedirect)
+			}
+			return
+		} else if contentRange != "" {
+			var start, end int64
+			_, err = fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total)
+			require.NoError(fc.t, err)
+			assert.EqualValues(fc.t, fc.received.Len(), start)
+		}
+		fc.receive(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (fc *fakeCDN) receive(w http.ResponseWriter, r *http.Request) {
+	if !fc.failed {
+		fc.failed = true
+		_, _ = io.CopyN(&fc.received, r.Body, fc.failAfter)
+		// Drop the connection halfway through the upload
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(fc.t, err)
+		_ = conn.Close()
+		return
+	}
+	_, err := io.Copy(&fc.received, r.Body)
+	require.NoError(fc.t, err)
+	w.WriteHeader(http.StatusOK)
+}
+
+func testResumableUpload(t *testing.T, cdn uint32) {
+	fc := &fakeCDN{t: t, tus: cdn == 3, failAfter: 100 * 1024}
+	server := httptest.NewServer(fc)
+	defer server.Close()
+
+	data := sequentialBytes(0, 300*1024)
+	form := &attachmentUploadForm{
+		Cdn:                  cdn,
+		Key:                  "abc",
+		Headers:              map[string]string{"Authorization": "Bearer test"},
+		SignedUploadLocation: server.URL + "/upload",
+	}
+	client, err := web.NewClient(web.Config{})
+	require.NoError(t, err)
+	upload := newResumableUpload(client, form, bytes.NewReader(data), int64(len(data)))
+	upload.retryDelay = 0
+	err = upload.Upload(context.Background())
+	require.NoError(t, err)
+	assert.True(t, fc.failed)
+	assert.EqualValues(t, len(data), fc.length)
+	assert.True(t, bytes.Equal(data, fc.received.Bytes()), "uploaded data doesn't match")
+}
+
+func TestResumableUpload_CDN2(t *testing.T) {
+	testResumableUpload(t, 2)
+}
+
+func TestResumableUpload_CDN3(t *testing.T) {
+	testResumableUpload(t, 3)
+}
+
+func TestResumableUploadCancelledWhileWaiting(t *testing.T) {
+	var requests int
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		if r.Method == http.MethodPost {
+			w.Header().Set("Location", "/upload/session")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		// Every upload attempt fails, so the upload has to wait before retrying
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	form := &attachmentUploadForm{Cdn: 2, Key: "abc", SignedUploadLocation: server.URL + "/upload"}
+	client, err := web.NewClient(web.Config{})
+	require.NoError(t, err)
+	upload := newResumableUpload(client, form, bytes.NewReader([]byte("data")), 4)
+	upload.retryDelay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = upload.Upload(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 10*time.Second, "upload kept waiting after the context was done")
+	lock.Lock()
+	assert.Equal(t, 2, requests, "no retries should be made after the context is done")
+	lock.Unlock()
+}
@@ -0,0 +1,140 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"io"
+
+	"github.com/rs/zerolog"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// Client is a single Signal account. It owns the device along with a logger and an HTTP client
+// that are only used for that account, so that several clients can run in the same process
+// without interleaving their logs or sharing connection state.
+type Client struct {
+	Device *Device
+}
+
+// NewClient creates a client for the given device, which talks to the servers of webClient.
+// The account's ACI and device ID are added to the logger. metrics may be nil.
+func NewClient(device *Device, log zerolog.Logger, webClient *web.Client, metrics Metrics) *Client {
+	log = log.With().
+		Str("account_id", device.Data.AciUuid).
+		Int("device_id", device.Data.DeviceId).
+		Logger()
+	webLog := log.With().Str("component", "signalmeow/web").Logger()
+	if metrics == nil {
+		metrics = NoopMetrics{}
+	}
+	device.Connection.log = &log
+	device.Connection.metrics = metrics
+	device.Connection.webClient = webClient.WithOwnTransport().WithLogger(webLog).WithMetrics(metrics)
+	return &Client{Device: device}
+}
+
+// IsDeviceLoggedIn is like Device.IsDeviceLoggedIn, but is also safe to call on a nil client.
+func (cli *Client) IsDeviceLoggedIn() bool {
+	return cli != nil && cli.Device.IsDeviceLoggedIn()
+}
+
+// Log returns the logger of the client.
+func (cli *Client) Log() *zerolog.Logger {
+	return cli.Device.log()
+}
+
+func (cli *Client) StartReceiveLoops(ctx context.Context) (chan SignalConnectionStatus, error) {
+	return startReceiveLoops(ctx, cli.Device)
+}
+
+func (cli *Client) StopReceiveLoops() error {
+	return stopReceiveLoops(cli.Device)
+}
+
+func (cli *Client) SendMessage(ctx context.Context, recipientID string, message *SignalContent) SendMessageResult {
+	return sendMessage(ctx, cli.Device, recipientID, message)
+}
+
+func (cli *Client) SendGroupMessage(ctx context.Context, gid GroupIdentifier, message *SignalContent) (*GroupMessageSendResult, error) {
+	return sendGroupMessage(ctx, cli.Device, gid, message, nil)
+}
+
+// SendGroupMessageToMembers sends a group message only to the given members, e.g. to retry sending it
+// to the members that it couldn't be sent to. Members who have left the group are skipped.
+func (cli *Client) SendGroupMessageToMembers(ctx context.Context, gid GroupIdentifier, message *SignalContent, members []string) (*GroupMessageSendResult, error) {
+	if members == nil {
+		members = []string{}
+	}
+	return sendGroupMessage(ctx, cli.Device, gid, message, members)
+}
+
+func (cli *Client) UploadAttachment(ctx context.Context, data []byte, mimeType, filename string) (*AttachmentPointer, error) {
+	return uploadAttachment(ctx, cli.Device, data, mimeType, filename)
+}
+
+func (cli *Client) UploadAttachmentStream(ctx context.Context, r io.Reader, size int64, mimeType, filename string) (*AttachmentPointer, error) {
+	return uploadAttachmentStream(ctx, cli.Device, r, size, mimeType, filename)
+}
+
+// NewIncomingAttachment wraps an attachment pointer from an incoming message, so that it can be downloaded later.
+func (cli *Client) NewIncomingAttachment(pointer *signalpb.AttachmentPointer) *IncomingAttachment {
+	return &IncomingAttachment{Pointer: pointer, client: cli.Device.web()}
+}
+
+// DownloadAttachment downloads and decrypts a small attachment, like a sticker or a contact card avatar, into memory.
+func (cli *Client) DownloadAttachment(ctx context.Context, pointer *signalpb.AttachmentPointer) ([]byte, error) {
+	return fetchAndDecryptAttachment(cli.Device.web(), pointer)
+}
+
+func (cli *Client) RetrieveGroupByID(ctx context.Context, gid GroupIdentifier) (*Group, error) {
+	return retrieveGroupByID(ctx, cli.Device, gid)
+}
+
+func (cli *Client) RetrieveGroupAndAvatarByID(ctx context.Context, gid GroupIdentifier) (*Group, []byte, error) {
+	return retrieveGroupAndAvatarByID(ctx, cli.Device, gid)
+}
+
+func (cli *Client) UpdateGroupDisappearingTimer(ctx context.Context, gid GroupIdentifier, expiresInSeconds uint32) error {
+	return updateGroupDisappearingTimer(ctx, cli.Device, gid, expiresInSeconds)
+}
+
+func (cli *Client) RetrieveProfileByID(ctx context.Context, signalID string) (*Profile, error) {
+	return retrieveProfileByID(ctx, cli.Device, signalID)
+}
+
+func (cli *Client) RetrieveProfileAndAvatarByID(ctx context.Context, signalID string) (*Profile, []byte, error) {
+	return retrieveProfileAndAvatarByID(ctx, cli.Device, signalID)
+}
+
+func (cli *Client) SubmitCaptcha(ctx context.Context, captcha string) error {
+	return submitCaptcha(ctx, cli.Device, captcha)
+}
+
+func (cli *Client) SendContactSyncRequest(ctx context.Context) error {
+	return sendContactSyncRequest(ctx, cli.Device)
+}
+
+func (cli *Client) SendFullSyncRequest(ctx context.Context) error {
+	return sendFullSyncRequest(ctx, cli.Device)
+}
+
+func (cli *Client) SendSyncRequests(ctx context.Context, requestTypes ...signalpb.SyncMessage_Request_Type) error {
+	return sendSyncRequests(ctx, cli.Device, requestTypes...)
+}
@@ -0,0 +1,59 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+func TestClientLoggersAreSeparate(t *testing.T) {
+	webClient, err := web.NewClient(web.Config{ChatURL: "http://localhost:8080"})
+	require.NoError(t, err)
+	var bufA, bufB bytes.Buffer
+	clientA := NewClient(&Device{Data: DeviceData{AciUuid: "aci-a", DeviceId: 2}}, zerolog.New(&bufA), webClient, nil)
+	clientB := NewClient(&Device{Data: DeviceData{AciUuid: "aci-b", DeviceId: 3}}, zerolog.New(&bufB), webClient, nil)
+
+	clientA.Device.log().Info().Msg("hello")
+	assert.Contains(t, bufA.String(), `"account_id":"aci-a"`)
+	assert.Contains(t, bufA.String(), `"device_id":2`)
+	assert.Empty(t, bufB.String())
+
+	clientB.Log().Info().Msg("hello")
+	assert.Contains(t, bufB.String(), `"account_id":"aci-b"`)
+	assert.NotContains(t, bufA.String(), "aci-b")
+
+	assert.NotSame(t, clientA.Device.web(), clientB.Device.web())
+	assert.Equal(t, "http://localhost:8080", clientA.Device.web().Config.ChatURL)
+}
+
+func TestDeviceWithoutClient(t *testing.T) {
+	var device *Device
+	assert.Same(t, &nopLog, device.log())
+	assert.Nil(t, device.web())
+	assert.False(t, (*Client)(nil).IsDeviceLoggedIn())
+
+	device = &Device{}
+	assert.Same(t, &nopLog, device.log())
+	assert.Nil(t, device.web())
+}
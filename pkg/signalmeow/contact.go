@@ -55,20 +55,35 @@ type ContactAvatar struct {
 	Hash        string
 }
 
-func StoreContactDetailsAsContact(d *Device, contactDetails *signalpb.ContactDetails, avatar *[]byte) (Contact, *ContactAvatar, error) {
+// NewContactAvatar creates a ContactAvatar from a contact avatar image received in a contact sync.
+// The content type is detected from the image if the contact details don't have a specific one.
+func NewContactAvatar(contactDetails *signalpb.ContactDetails, image []byte) *ContactAvatar {
+	contentType := contactDetails.GetAvatar().GetContentType()
+	if contentType == "" || strings.HasSuffix(contentType, "/*") {
+		contentType = http.DetectContentType(image)
+	}
+	rawHash := sha256.Sum256(image)
+	return &ContactAvatar{
+		Image:       image,
+		ContentType: contentType,
+		Hash:        hex.EncodeToString(rawHash[:]),
+	}
+}
+
+func storeContactDetailsAsContact(d *Device, contactDetails *signalpb.ContactDetails, avatar *[]byte) (Contact, *ContactAvatar, error) {
 	ctx := context.TODO()
 	existingContact, err := d.ContactStore.LoadContact(ctx, contactDetails.GetAci())
 	if err != nil {
-		zlog.Err(err).Msg("StoreContactDetailsAsContact error loading contact")
+		d.log().Err(err).Msg("storeContactDetailsAsContact error loading contact")
 		return Contact{}, nil, err
 	}
 	if existingContact == nil {
-		zlog.Debug().Msgf("StoreContactDetailsAsContact: creating new contact for uuid: %v", contactDetails.GetAci())
+		d.log().Debug().Msgf("storeContactDetailsAsContact: creating new contact for uuid: %v", contactDetails.GetAci())
 		existingContact = &Contact{
 			UUID: contactDetails.GetAci(),
 		}
 	} else {
-		zlog.Debug().Msgf("StoreContactDetailsAsContact: updating existing contact for uuid: %v", contactDetails.GetAci())
+		d.log().Debug().Msgf("storeContactDetailsAsContact: updating existing contact for uuid: %v", contactDetails.GetAci())
 	}
 
 	existingContact.E164 = contactDetails.GetNumber()
@@ -78,7 +93,7 @@ func StoreContactDetailsAsContact(d *Device, contactDetails *signalpb.ContactDet
 		profileKey := libsignalgo.ProfileKey(profileKeyString)
 		err = d.ProfileKeyStore.StoreProfileKey(existingContact.UUID, profileKey, ctx)
 		if err != nil {
-			zlog.Err(err).Msg("StoreContactDetailsAsContact error storing profile key")
+			d.log().Err(err).Msg("storeContactDetailsAsContact error storing profile key")
 			//return *existingContact, nil, err
 		}
 	}
@@ -87,38 +102,26 @@ func StoreContactDetailsAsContact(d *Device, contactDetails *signalpb.ContactDet
 	var contactAvatar *ContactAvatar
 	avatarHash := ""
 	if avatar != nil && *avatar != nil && len(*avatar) > 0 {
-		zlog.Debug().Msgf("StoreContactDetailsAsContact: found avatar for uuid: %v", contactDetails.GetAci())
+		d.log().Debug().Msgf("storeContactDetailsAsContact: found avatar for uuid: %v", contactDetails.GetAci())
 		rawHash := sha256.Sum256(*avatar)
 		avatarHash = hex.EncodeToString(rawHash[:])
 		if existingContact.ContactAvatarHash != avatarHash {
-			zlog.Debug().Msgf("StoreContactDetailsAsContact: avatar changed for uuid: %v", contactDetails.GetAci())
-			var contentType string
-			if avatarDetails := contactDetails.GetAvatar(); avatarDetails != nil && !strings.HasSuffix(avatarDetails.GetContentType(), "/*") {
-				contentType = *avatarDetails.ContentType
-				zlog.Debug().Msgf("StoreContactDetailsAsContact: using contentType from details: %v", contentType)
-			} else {
-				contentType = http.DetectContentType(*avatar)
-				zlog.Debug().Msgf("StoreContactDetailsAsContact: using autodetected contentType: %v", contentType)
-			}
-			contactAvatar = &ContactAvatar{
-				Image:       *avatar,
-				ContentType: contentType,
-				Hash:        avatarHash,
-			}
+			d.log().Debug().Msgf("storeContactDetailsAsContact: avatar changed for uuid: %v", contactDetails.GetAci())
+			contactAvatar = NewContactAvatar(contactDetails, *avatar)
 			existingContact.ContactAvatarHash = avatarHash
 		}
 	} else {
 		// Avatar has been removed
-		zlog.Debug().Msgf("StoreContactDetailsAsContact: no avatar found for uuid: %v", contactDetails.GetAci())
+		d.log().Debug().Msgf("storeContactDetailsAsContact: no avatar found for uuid: %v", contactDetails.GetAci())
 		if existingContact.ContactAvatarHash != "" {
 			existingContact.ContactAvatarHash = ""
 		}
 	}
 
-	zlog.Debug().Msgf("StoreContactDetailsAsContact: storing contact for uuid: %v", contactDetails.GetAci())
+	d.log().Debug().Msgf("storeContactDetailsAsContact: storing contact for uuid: %v", contactDetails.GetAci())
 	storeErr := d.ContactStore.StoreContact(ctx, *existingContact)
 	if storeErr != nil {
-		zlog.Err(storeErr).Msg("StoreContactDetailsAsContact: error storing contact")
+		d.log().Err(storeErr).Msg("storeContactDetailsAsContact: error storing contact")
 		return *existingContact, nil, storeErr
 	}
 	return *existingContact, contactAvatar, nil
@@ -130,51 +133,51 @@ func fetchContactThenTryAndUpdateWithProfile(d *Device, profileUuid string, fetc
 
 	existingContact, err := d.ContactStore.LoadContact(ctx, profileUuid)
 	if err != nil {
-		zlog.Err(err).Msg("fetchContactThenTryAndUpdateWithProfile: error loading contact")
+		d.log().Err(err).Msg("fetchContactThenTryAndUpdateWithProfile: error loading contact")
 		return nil, nil, err
 	}
 	if existingContact == nil {
-		zlog.Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: creating new contact for uuid: %v", profileUuid)
+		d.log().Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: creating new contact for uuid: %v", profileUuid)
 		existingContact = &Contact{
 			UUID: profileUuid,
 		}
 		contactChanged = true
 	} else {
-		zlog.Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: updating existing contact for uuid: %v", profileUuid)
+		d.log().Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: updating existing contact for uuid: %v", profileUuid)
 	}
 	var profile *Profile
 	var profileAvatarImage []byte
 	if fetchProfileAvatar && existingContact.ContactAvatarHash == "" {
 		// We only care about profile avatar if there is no contact avatar
-		profile, profileAvatarImage, err = RetrieveProfileAndAvatarByID(ctx, d, profileUuid)
+		profile, profileAvatarImage, err = retrieveProfileAndAvatarByID(ctx, d, profileUuid)
 	} else {
-		profile, err = RetrieveProfileByID(ctx, d, profileUuid)
+		profile, err = retrieveProfileByID(ctx, d, profileUuid)
 	}
 	if err != nil {
-		zlog.Err(err).Msgf("fetchContactThenTryAndUpdateWithProfile: error retrieving profile for uuid: %v", profileUuid)
+		d.log().Err(err).Msgf("fetchContactThenTryAndUpdateWithProfile: error retrieving profile for uuid: %v", profileUuid)
 		//return nil, nil, err
 		// Don't return here, we still want to return what we have
 	}
 
 	if profile != nil {
 		if existingContact.ProfileName != profile.Name {
-			zlog.Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: profile name changed for uuid: %v", profileUuid)
+			d.log().Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: profile name changed for uuid: %v", profileUuid)
 			existingContact.ProfileName = profile.Name
 			contactChanged = true
 		}
 		if existingContact.ProfileAbout != profile.About {
-			zlog.Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: profile about changed for uuid: %v", profileUuid)
+			d.log().Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: profile about changed for uuid: %v", profileUuid)
 			existingContact.ProfileAbout = profile.About
 			contactChanged = true
 		}
 		if existingContact.ProfileAboutEmoji != profile.AboutEmoji {
-			zlog.Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: profile about emoji changed for uuid: %v", profileUuid)
+			d.log().Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: profile about emoji changed for uuid: %v", profileUuid)
 			existingContact.ProfileAboutEmoji = profile.AboutEmoji
 			contactChanged = true
 		}
 		newProfileKey := profile.Key.Slice()
 		if !bytes.Equal(existingContact.ProfileKey, newProfileKey) {
-			zlog.Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: profile key changed for uuid: %v", profileUuid)
+			d.log().Debug().Msgf("fetchContactThenTryAndUpdateWithProfile: profile key changed for uuid: %v", profileUuid)
 			existingContact.ProfileKey = newProfileKey
 			contactChanged = true
 		}
@@ -199,7 +202,7 @@ func fetchContactThenTryAndUpdateWithProfile(d *Device, profileUuid string, fetc
 	if contactChanged {
 		storeErr := d.ContactStore.StoreContact(ctx, *existingContact)
 		if storeErr != nil {
-			zlog.Err(storeErr).Msg("fetchContactThenTryAndUpdateWithProfile: error storing contact")
+			d.log().Err(storeErr).Msg("fetchContactThenTryAndUpdateWithProfile: error storing contact")
 		}
 	}
 	return existingContact, profileAvatar, nil
@@ -209,23 +212,23 @@ func (d *Device) UpdateContactE164(uuid string, e164 string) error {
 	ctx := context.TODO()
 	existingContact, err := d.ContactStore.LoadContact(ctx, uuid)
 	if err != nil {
-		zlog.Err(err).Msg("UpdateContactE164: error loading contact")
+		d.log().Err(err).Msg("UpdateContactE164: error loading contact")
 		return err
 	}
 	if existingContact == nil {
-		zlog.Debug().Msgf("UpdateContactE164: creating new contact for uuid: %v", uuid)
+		d.log().Debug().Msgf("UpdateContactE164: creating new contact for uuid: %v", uuid)
 		existingContact = &Contact{
 			UUID: uuid,
 		}
 	} else {
-		zlog.Debug().Msgf("UpdateContactE164: found existing contact for uuid: %v", uuid)
+		d.log().Debug().Msgf("UpdateContactE164: found existing contact for uuid: %v", uuid)
 	}
 	if existingContact.E164 != e164 {
-		zlog.Debug().Msgf("UpdateContactE164: e164 changed for uuid: %v", uuid)
+		d.log().Debug().Msgf("UpdateContactE164: e164 changed for uuid: %v", uuid)
 		existingContact.E164 = e164
 		storeErr := d.ContactStore.StoreContact(ctx, *existingContact)
 		if storeErr != nil {
-			zlog.Err(storeErr).Msg("UpdateContactE164: error storing contact")
+			d.log().Err(storeErr).Msg("UpdateContactE164: error storing contact")
 			return storeErr
 		}
 	}
@@ -250,7 +253,7 @@ func (d *Device) ContactByE164(e164 string) (*Contact, error) {
 	ctx := context.TODO()
 	contact, err := d.ContactStore.LoadContactByE164(ctx, e164)
 	if err != nil {
-		zlog.Err(err).Msg("ContactByE164 error loading contact")
+		d.log().Err(err).Msg("ContactByE164 error loading contact")
 		return nil, err
 	}
 	if contact == nil {
@@ -23,6 +23,8 @@ import (
 	"net/url"
 	"sync"
 
+	"github.com/rs/zerolog"
+
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
 )
@@ -56,16 +58,67 @@ type DeviceConnection struct {
 	ProfileCache           *ProfileCache
 	GroupCallCache         *map[string]bool
 	LastContactRequestTime *int64
+	knownOwnDevices        map[int]struct{}
+	accountSettings        *AccountSettings
+	inbox                  *inboxQueue
+	rateLimit              rateLimitState
 
 	// mutexes
-	EncryptionMutex sync.Mutex
+	EncryptionMutex     sync.Mutex
+	knownOwnDevicesLock sync.Mutex
+	accountSettingsLock sync.Mutex
+	// cacheLock protects GroupCache and ProfileCache, which are used by several inbox workers at once
+	cacheLock         sync.Mutex
+	eventHandlersLock sync.RWMutex
 
 	// Network interfaces
 	AuthedWS   *web.SignalWebsocket
 	UnauthedWS *web.SignalWebsocket
 	WSCancel   context.CancelFunc
 
-	IncomingSignalMessageHandler func(IncomingSignalMessage) error
+	// Set by NewClient. Nothing is logged if log is nil. There's no default web client,
+	// so a device can only talk to the servers through a Client.
+	log       *zerolog.Logger
+	webClient *web.Client
+	metrics   Metrics
+
+	eventHandlers      []wrappedEventHandler
+	lastEventHandlerID uint32
+	// NewOwnDeviceHandler is called when a session with a previously unseen device on our own account appears
+	NewOwnDeviceHandler func(deviceID int)
+	// CaptchaRequiredHandler is called when the server stops accepting messages until a captcha
+	// is submitted with Client.SubmitCaptcha
+	CaptchaRequiredHandler func()
+}
+
+func (d *DeviceConnection) logger() *zerolog.Logger {
+	if d == nil || d.log == nil {
+		return &nopLog
+	}
+	return d.log
+}
+
+func (d *DeviceConnection) web() *web.Client {
+	if d == nil {
+		return nil
+	}
+	return d.webClient
+}
+
+// log returns the logger of the client that owns the device.
+func (d *Device) log() *zerolog.Logger {
+	if d == nil {
+		return &nopLog
+	}
+	return d.Connection.logger()
+}
+
+// web returns the web client of the client that owns the device.
+func (d *Device) web() *web.Client {
+	if d == nil {
+		return nil
+	}
+	return d.Connection.web()
 }
 
 func (d *DeviceConnection) IsConnected() bool {
@@ -85,7 +138,7 @@ func (d *DeviceConnection) ConnectAuthedWS(ctx context.Context, data DeviceData,
 	path := web.WebsocketPath +
 		"?login=" + username +
 		"&password=" + password
-	authedWS := web.NewSignalWebsocket(ctx, "authed", path, &username, &password)
+	authedWS := d.web().NewSignalWebsocket(ctx, "authed", path, &username, &password)
 	statusChan := authedWS.Connect(ctx, &requestHandler)
 	d.AuthedWS = authedWS
 	return statusChan, nil
@@ -95,7 +148,7 @@ func (d *DeviceConnection) ConnectUnauthedWS(ctx context.Context, data DeviceDat
 	if d.UnauthedWS != nil {
 		return nil, errors.New("unauthed websocket already connected")
 	}
-	unauthedWS := web.NewSignalWebsocket(ctx, "unauthed", web.WebsocketPath, nil, nil)
+	unauthedWS := d.web().NewSignalWebsocket(ctx, "unauthed", web.WebsocketPath, nil, nil)
 	statusChan := unauthedWS.Connect(ctx, nil)
 	d.UnauthedWS = unauthedWS
 
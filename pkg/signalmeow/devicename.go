@@ -48,14 +48,14 @@ func (d *Device) UpdateDeviceName(name string) error {
 	if err != nil {
 		return fmt.Errorf("failed to encrypt device name: %w", err)
 	}
-	err = UpdateDeviceName(d, encryptedName)
+	err = putEncryptedDeviceName(d, encryptedName)
 	if err != nil {
 		return fmt.Errorf("failed to update device name: %w", err)
 	}
 	return nil
 }
 
-func UpdateDeviceName(device *Device, encryptedName []byte) error {
+func putEncryptedDeviceName(device *Device, encryptedName []byte) error {
 	reqData, err := json.Marshal(map[string]any{
 		"deviceName": encryptedName,
 	})
@@ -63,7 +63,7 @@ func UpdateDeviceName(device *Device, encryptedName []byte) error {
 		return fmt.Errorf("failed to marshal device name update request: %w", err)
 	}
 	username, password := device.Data.BasicAuthCreds()
-	resp, err := web.SendHTTPRequest(http.MethodPut, "/v1/accounts/name", &web.HTTPReqOpt{
+	resp, err := device.web().SendHTTPRequest(http.MethodPut, "/v1/accounts/name", &web.HTTPReqOpt{
 		Body:     reqData,
 		Username: &username,
 		Password: &password,
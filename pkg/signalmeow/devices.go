@@ -0,0 +1,188 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+const PrimaryDeviceID = 1
+
+var (
+	ErrCantUnlinkOwnDevice = errors.New("can't unlink the bridge's own device, log out instead")
+	// ErrNotPrimaryDevice is returned by the server when a linked device tries to unlink other devices.
+	ErrNotPrimaryDevice = errors.New("only the primary device can unlink other devices")
+)
+
+// LinkedDevice is a device registered to the account, as returned by the server.
+type LinkedDevice struct {
+	ID       int
+	Name     string
+	Created  time.Time
+	LastSeen time.Time
+}
+
+type linkedDeviceJSON struct {
+	ID int `json:"id"`
+	// Name is an encrypted DeviceName protobuf
+	Name     []byte `json:"name"`
+	Created  int64  `json:"created"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+// ListDevices returns all devices on the account, including the primary device and the bridge itself.
+func (d *Device) ListDevices(ctx context.Context) ([]*LinkedDevice, error) {
+	username, password := d.Data.BasicAuthCreds()
+	resp, err := d.web().SendHTTPRequest(http.MethodGet, "/v1/devices", &web.HTTPReqOpt{
+		Username: &username,
+		Password: &password,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send device list request: %w", err)
+	}
+	var respData struct {
+		Devices []linkedDeviceJSON `json:"devices"`
+	}
+	err = web.DecodeHTTPResponseBody(&respData, resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode device list: %w", err)
+	}
+	devices := make([]*LinkedDevice, len(respData.Devices))
+	for i, device := range respData.Devices {
+		devices[i] = &LinkedDevice{
+			ID:       device.ID,
+			Created:  time.UnixMilli(device.Created),
+			LastSeen: time.UnixMilli(device.LastSeen),
+		}
+		if len(device.Name) > 0 {
+			devices[i].Name, err = DecryptDeviceName(device.Name, d.Data.AciIdentityKeyPair.GetPrivateKey())
+			if err != nil {
+				d.log().Warn().Err(err).Int("device_id", device.ID).Msg("Failed to decrypt device name")
+			}
+		}
+	}
+	return devices, nil
+}
+
+// UnlinkDevice removes the given device from the account.
+func (d *Device) UnlinkDevice(ctx context.Context, deviceID int) error {
+	if deviceID == d.Data.DeviceId {
+		return ErrCantUnlinkOwnDevice
+	}
+	username, password := d.Data.BasicAuthCreds()
+	resp, err := d.web().SendHTTPRequest(http.MethodDelete, fmt.Sprintf("/v1/devices/%d", deviceID), &web.HTTPReqOpt{
+		Username: &username,
+		Password: &password,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send unlink device request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return ErrNotPrimaryDevice
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unlink device request returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordOwnDevices replaces the known devices with the ones currently on the account.
+// It's called right after linking, when every device on the account belongs to the user.
+func (d *Device) recordOwnDevices(ctx context.Context) error {
+	devices, err := d.ListDevices(ctx)
+	if err != nil {
+		return err
+	}
+	deviceIDs := make([]int, len(devices))
+	for i, device := range devices {
+		deviceIDs[i] = device.ID
+	}
+	d.Connection.knownOwnDevicesLock.Lock()
+	defer d.Connection.knownOwnDevicesLock.Unlock()
+	if err = d.KnownDeviceStore.ResetKnownDevices(ctx, deviceIDs); err != nil {
+		return fmt.Errorf("failed to save known devices: %w", err)
+	}
+	d.Connection.knownOwnDevices = make(map[int]struct{}, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		d.Connection.knownOwnDevices[deviceID] = struct{}{}
+	}
+	return nil
+}
+
+// checkOwnDeviceList fetches the device list of the account and reports devices that haven't been seen before.
+func (d *Device) checkOwnDeviceList(ctx context.Context) error {
+	devices, err := d.ListDevices(ctx)
+	if err != nil {
+		return err
+	}
+	deviceIDs := make([]int, len(devices))
+	for i, device := range devices {
+		deviceIDs[i] = device.ID
+	}
+	return d.checkNewOwnDevices(ctx, deviceIDs)
+}
+
+// checkNewOwnDevices calls NewOwnDeviceHandler for own device IDs that haven't been seen before.
+// If no devices have been recorded, e.g. for accounts linked before devices were recorded,
+// the current devices are recorded without reporting them, as there's nothing to compare them to.
+func (d *Device) checkNewOwnDevices(ctx context.Context, deviceIDs []int) error {
+	d.Connection.knownOwnDevicesLock.Lock()
+	defer d.Connection.knownOwnDevicesLock.Unlock()
+	firstCheck := false
+	if d.Connection.knownOwnDevices == nil {
+		knownDeviceIDs, err := d.KnownDeviceStore.GetKnownDevices(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load known devices: %w", err)
+		}
+		firstCheck = knownDeviceIDs == nil
+		d.Connection.knownOwnDevices = make(map[int]struct{}, len(knownDeviceIDs))
+		for _, deviceID := range knownDeviceIDs {
+			d.Connection.knownOwnDevices[deviceID] = struct{}{}
+		}
+		if firstCheck {
+			// Our own device must be in the list, otherwise every check would count as the first one
+			deviceIDs = append(deviceIDs, d.Data.DeviceId)
+			d.log().Info().Ints("device_ids", deviceIDs).Msg("No known devices stored, recording the current devices")
+		}
+	}
+	var newDeviceIDs []int
+	for _, deviceID := range deviceIDs {
+		if _, known := d.Connection.knownOwnDevices[deviceID]; !known {
+			newDeviceIDs = append(newDeviceIDs, deviceID)
+		}
+	}
+	if len(newDeviceIDs) == 0 {
+		return nil
+	}
+	if err := d.KnownDeviceStore.PutKnownDevices(ctx, newDeviceIDs); err != nil {
+		// Don't remember the devices either, so that they're reported again the next time
+		return fmt.Errorf("failed to save known devices: %w", err)
+	}
+	for _, deviceID := range newDeviceIDs {
+		d.Connection.knownOwnDevices[deviceID] = struct{}{}
+		if !firstCheck && d.Connection.NewOwnDeviceHandler != nil {
+			go d.Connection.NewOwnDeviceHandler(deviceID)
+		}
+	}
+	return nil
+}
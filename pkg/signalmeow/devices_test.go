@@ -0,0 +1,97 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryKnownDeviceStore struct {
+	deviceIDs map[int]struct{}
+}
+
+func (s *memoryKnownDeviceStore) GetKnownDevices(ctx context.Context) ([]int, error) {
+	if s.deviceIDs == nil {
+		return nil, nil
+	}
+	deviceIDs := make([]int, 0, len(s.deviceIDs))
+	for deviceID := range s.deviceIDs {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Ints(deviceIDs)
+	return deviceIDs, nil
+}
+
+func (s *memoryKnownDeviceStore) PutKnownDevices(ctx context.Context, deviceIDs []int) error {
+	if s.deviceIDs == nil {
+		s.deviceIDs = make(map[int]struct{})
+	}
+	for _, deviceID := range deviceIDs {
+		s.deviceIDs[deviceID] = struct{}{}
+	}
+	return nil
+}
+
+func (s *memoryKnownDeviceStore) ResetKnownDevices(ctx context.Context, deviceIDs []int) error {
+	s.deviceIDs = nil
+	return s.PutKnownDevices(ctx, deviceIDs)
+}
+
+func TestCheckNewOwnDevices(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryKnownDeviceStore{}
+	device := &Device{KnownDeviceStore: store}
+	device.Data.DeviceId = 2
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var newDevices []int
+	device.Connection.NewOwnDeviceHandler = func(deviceID int) {
+		lock.Lock()
+		newDevices = append(newDevices, deviceID)
+		lock.Unlock()
+		wg.Done()
+	}
+
+	// Without stored devices, the first check is the baseline and shouldn't alert about anything
+	require.NoError(t, device.checkNewOwnDevices(ctx, []int{1, 3}))
+	knownDevices, _ := store.GetKnownDevices(ctx)
+	assert.Equal(t, []int{1, 2, 3}, knownDevices, "our own device must be recorded too")
+	wg.Add(2)
+	require.NoError(t, device.checkNewOwnDevices(ctx, []int{1, 3, 4, 5}))
+	require.NoError(t, device.checkNewOwnDevices(ctx, []int{1, 3, 4, 5}))
+	wg.Wait()
+	sort.Ints(newDevices)
+	assert.Equal(t, []int{4, 5}, newDevices)
+
+	// After a restart, the stored devices are used instead of making a new baseline
+	restarted := &Device{KnownDeviceStore: store}
+	restarted.Data.DeviceId = 2
+	newDevices = nil
+	restarted.Connection.NewOwnDeviceHandler = device.Connection.NewOwnDeviceHandler
+	wg.Add(1)
+	require.NoError(t, restarted.checkNewOwnDevices(ctx, []int{1, 3, 4, 5, 6}))
+	wg.Wait()
+	assert.Equal(t, []int{6}, newDevices)
+	knownDevices, _ = store.GetKnownDevices(ctx)
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, knownDevices)
+}
@@ -0,0 +1,350 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"runtime/debug"
+
+	"github.com/google/uuid"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// EventHandler receives the events from the events package. Incoming messages are handled by a worker
+// per conversation, so events from the same chat are delivered in order, but events from different chats
+// may be delivered concurrently and handlers must be safe to call from multiple goroutines.
+// Receipts and read syncs are delivered after the messages received before them.
+// Handlers should ignore the types they don't know.
+//
+// If the bridge restarts while a message is being handled, the message is handled again after
+// the restart, so message events may be delivered more than once. Use the sender and timestamp
+// in events.MessageInfo to deduplicate them.
+type EventHandler func(evt any)
+
+// EventHandlerWithSuccessStatus is an EventHandler that returns false if handling the event failed.
+// If a handler fails for an event of an incoming message, the message is kept in the inbox and
+// the event is delivered again later, but only to the handlers that failed. Panics count as failures.
+type EventHandlerWithSuccessStatus func(evt any) bool
+
+// errEventHandlerFailed is returned for incoming messages that an event handler failed to handle.
+var errEventHandlerFailed = errors.New("event handler failed")
+
+type wrappedEventHandler struct {
+	id      uint32
+	handler EventHandlerWithSuccessStatus
+}
+
+// AddEventHandler registers a handler for events and returns an ID that can be used to remove it.
+func (d *Device) AddEventHandler(handler EventHandler) uint32 {
+	return d.AddEventHandlerWithSuccessStatus(func(evt any) bool {
+		handler(evt)
+		return true
+	})
+}
+
+// AddEventHandlerWithSuccessStatus registers a handler that can make incoming messages be retried
+// and returns an ID that can be used to remove it with RemoveEventHandler.
+func (d *Device) AddEventHandlerWithSuccessStatus(handler EventHandlerWithSuccessStatus) uint32 {
+	d.Connection.eventHandlersLock.Lock()
+	defer d.Connection.eventHandlersLock.Unlock()
+	d.Connection.lastEventHandlerID++
+	id := d.Connection.lastEventHandlerID
+	d.Connection.eventHandlers = append(d.Connection.eventHandlers, wrappedEventHandler{id: id, handler: handler})
+	return id
+}
+
+// RemoveEventHandler removes a handler added with AddEventHandler. Returns false if there was no such handler.
+func (d *Device) RemoveEventHandler(id uint32) bool {
+	d.Connection.eventHandlersLock.Lock()
+	defer d.Connection.eventHandlersLock.Unlock()
+	for i, wrapped := range d.Connection.eventHandlers {
+		if wrapped.id == id {
+			d.Connection.eventHandlers = append(d.Connection.eventHandlers[:i:i], d.Connection.eventHandlers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchEvent calls all event handlers with the event and returns false if any of them failed.
+func (d *Device) dispatchEvent(evt any) bool {
+	d.Connection.eventHandlersLock.RLock()
+	handlers := d.Connection.eventHandlers
+	d.Connection.eventHandlersLock.RUnlock()
+	success := true
+	for _, wrapped := range handlers {
+		if !d.callEventHandler(wrapped.handler, evt) {
+			success = false
+		}
+	}
+	return success
+}
+
+// contentDispatch is the progress of handling an incoming message. It's kept between retries,
+// so that the side effects of the message only happen once and events are only delivered again
+// to the handlers that failed.
+type contentDispatch struct {
+	// prepared is true once the side effects of the message are done and events has been filled
+	prepared bool
+	events   []any
+	// handled has the handlers that have successfully handled each event
+	handled map[contentDispatchKey]struct{}
+}
+
+type contentDispatchKey struct {
+	event   int
+	handler uint32
+}
+
+// dispatch delivers the prepared events to the handlers that haven't handled them yet
+// and returns false if any of them failed.
+func (cd *contentDispatch) dispatch(d *Device) bool {
+	d.Connection.eventHandlersLock.RLock()
+	handlers := d.Connection.eventHandlers
+	d.Connection.eventHandlersLock.RUnlock()
+	if cd.handled == nil {
+		cd.handled = make(map[contentDispatchKey]struct{})
+	}
+	success := true
+	for i, evt := range cd.events {
+		for _, wrapped := range handlers {
+			key := contentDispatchKey{event: i, handler: wrapped.id}
+			if _, ok := cd.handled[key]; ok {
+				continue
+			} else if d.callEventHandler(wrapped.handler, evt) {
+				cd.handled[key] = struct{}{}
+			} else {
+				success = false
+			}
+		}
+	}
+	return success
+}
+
+func (d *Device) callEventHandler(handler EventHandlerWithSuccessStatus, evt any) (success bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			d.log().Error().Any("panic", err).Bytes("stack", debug.Stack()).Msgf("Event handler panicked while handling %T", evt)
+			success = false
+		}
+	}()
+	return handler(evt)
+}
+
+// contentEvents converts decrypted content into events. Contact syncs are dispatched separately,
+// because the contacts are in an attachment that has to be downloaded first.
+func (d *Device) contentEvents(theirUUID string, content *signalpb.Content) []any {
+	sender, err := uuid.Parse(theirUUID)
+	if err != nil {
+		d.log().Warn().Err(err).Str("sender", theirUUID).Msg("Not dispatching events for content with invalid sender")
+		return nil
+	}
+	ownACI, _ := uuid.Parse(d.Data.AciUuid)
+	var evts []any
+	if dm := content.GetDataMessage(); dm != nil {
+		info := messageInfo(sender, theirUUID, dm.GetGroupV2(), dm.GetTimestamp())
+		evts = append(evts, dataMessageEvents(info, dm)...)
+	}
+	if edit := content.GetEditMessage(); edit != nil {
+		info := messageInfo(sender, theirUUID, edit.GetDataMessage().GetGroupV2(), edit.GetDataMessage().GetTimestamp())
+		evts = append(evts, &events.Edit{Info: info, TargetTimestamp: edit.GetTargetSentTimestamp(), Edit: edit})
+	}
+	if story := content.GetStoryMessage(); story != nil {
+		evts = append(evts, &events.Story{Info: messageInfo(sender, theirUUID, story.GetGroup(), 0), Story: story})
+	}
+	if sent := content.GetSyncMessage().GetSent(); sent != nil && sender == ownACI {
+		destination := sent.GetDestinationServiceId()
+		if dm := sent.GetMessage(); dm != nil {
+			info := messageInfo(ownACI, destination, dm.GetGroupV2(), dm.GetTimestamp())
+			info.IsFromMe = true
+			evts = append(evts, dataMessageEvents(info, dm)...)
+		}
+		if edit := sent.GetEditMessage(); edit != nil {
+			info := messageInfo(ownACI, destination, edit.GetDataMessage().GetGroupV2(), edit.GetDataMessage().GetTimestamp())
+			info.IsFromMe = true
+			evts = append(evts, &events.Edit{Info: info, TargetTimestamp: edit.GetTargetSentTimestamp(), Edit: edit})
+		}
+		if story := sent.GetStoryMessage(); story != nil {
+			info := messageInfo(ownACI, destination, story.GetGroup(), sent.GetTimestamp())
+			info.IsFromMe = true
+			evts = append(evts, &events.Story{Info: info, Story: story})
+		}
+	}
+	if reads := content.GetSyncMessage().GetRead(); len(reads) > 0 && sender == ownACI {
+		evts = append(evts, &events.ReadSelf{Messages: reads})
+	}
+	if typing := content.GetTypingMessage(); typing != nil {
+		info := typingMessageInfo(sender, typing)
+		evts = append(evts, &events.Typing{Info: info, Typing: typing})
+	}
+	if call := content.GetCallMessage(); call != nil {
+		evts = append(evts, &events.Call{Info: messageInfo(sender, theirUUID, nil, 0), CallMessage: call})
+	}
+	if receipt := content.GetReceiptMessage(); receipt != nil {
+		evts = append(evts, &events.Receipt{Sender: sender, ReceiptMessage: receipt})
+	}
+	return evts
+}
+
+func dataMessageEvents(info events.MessageInfo, dm *signalpb.DataMessage) []any {
+	var evts []any
+	if dm.GetGroupV2().GetGroupChange() != nil {
+		evts = append(evts, &events.GroupChange{Info: info, Group: dm.GetGroupV2()})
+	}
+	if dm.GetFlags()&uint32(signalpb.DataMessage_EXPIRATION_TIMER_UPDATE) != 0 {
+		evts = append(evts, &events.DisappearingTimer{Info: info, Timer: dm.GetExpireTimer(), Message: dm})
+	}
+	if dm.GetReaction() != nil {
+		evts = append(evts, &events.Reaction{Info: info, Reaction: dm.GetReaction()})
+	}
+	if dm.GetDelete() != nil {
+		evts = append(evts, &events.Delete{Info: info, Delete: dm.GetDelete()})
+	}
+	if dm.GetGroupCallUpdate() != nil {
+		evts = append(evts, &events.Call{Info: info, GroupCallUpdate: dm.GetGroupCallUpdate()})
+	}
+	if dm.Body != nil || len(dm.GetAttachments()) > 0 || dm.GetSticker() != nil || len(dm.GetContact()) > 0 {
+		evts = append(evts, &events.Message{Info: info, Message: dm})
+	}
+	return evts
+}
+
+// groupRevisionEvent converts a change from the group change log into an event.
+// The info refers to the message that made us fetch the change.
+func groupRevisionEvent(sender string, timestamp uint64, change *GroupChange) *events.GroupRevision {
+	senderUUID, _ := uuid.Parse(sender)
+	author, _ := uuid.Parse(change.SourceACI)
+	evt := &events.GroupRevision{
+		Info: events.MessageInfo{
+			Sender:    senderUUID,
+			Chat:      string(change.GroupIdentifier),
+			IsGroup:   true,
+			Timestamp: timestamp,
+		},
+		Author:               author,
+		Revision:             change.Revision,
+		NewTitle:             change.ModifyTitle,
+		NewDescription:       change.ModifyDescription,
+		NewAvatarPath:        change.ModifyAvatar,
+		NewDisappearingTimer: change.ModifyDisappearingMessagesDuration,
+		NewAnnouncementsOnly: change.ModifyAnnouncementsOnly,
+		Actions:              change.actions,
+	}
+	for _, member := range change.AddMembers {
+		if userID, err := uuid.Parse(member.UserId); err == nil {
+			evt.AddedMembers = append(evt.AddedMembers, userID)
+			if member.Role == GroupMember_ADMINISTRATOR {
+				evt.AddedAdmins = append(evt.AddedAdmins, userID)
+			}
+		}
+	}
+	for _, memberID := range change.DeleteMembers {
+		if userID, err := uuid.Parse(memberID); err == nil {
+			evt.RemovedMembers = append(evt.RemovedMembers, userID)
+		}
+	}
+	if len(change.ModifyMemberRoles) > 0 {
+		evt.ChangedRoles = make(map[uuid.UUID]signalpb.Member_Role, len(change.ModifyMemberRoles))
+		for _, member := range change.ModifyMemberRoles {
+			if userID, err := uuid.Parse(member.UserId); err == nil {
+				evt.ChangedRoles[userID] = signalpb.Member_Role(member.Role)
+			}
+		}
+	}
+	evt.NewAttributesAccess = accessRequired(change.ModifyAttributesAccess)
+	evt.NewMemberAccess = accessRequired(change.ModifyMemberAccess)
+	evt.NewAddFromInviteLinkAccess = accessRequired(change.ModifyAddFromInviteLinkAccess)
+	return evt
+}
+
+func accessRequired(access *AccessControl) *signalpb.AccessControl_AccessRequired {
+	if access == nil {
+		return nil
+	}
+	return signalpb.AccessControl_AccessRequired(*access).Enum()
+}
+
+// messageInfo creates the info for a message. The chat is the group if there's a group context,
+// otherwise it's the given private chat.
+func messageInfo(sender uuid.UUID, privateChat string, group *signalpb.GroupContextV2, timestamp uint64) events.MessageInfo {
+	info := events.MessageInfo{
+		Sender:    sender,
+		Chat:      privateChat,
+		Timestamp: timestamp,
+	}
+	if masterKey := group.GetMasterKey(); len(masterKey) == len(libsignalgo.GroupMasterKey{}) {
+		gid, err := groupIdentifierFromMasterKey(masterKeyFromBytes(libsignalgo.GroupMasterKey(masterKey)))
+		if err == nil {
+			info.Chat = string(gid)
+			info.IsGroup = true
+		}
+	}
+	return info
+}
+
+// typingMessageInfo creates the info for a typing notification, which refers to groups by identifier instead of master key.
+func typingMessageInfo(sender uuid.UUID, typing *signalpb.TypingMessage) events.MessageInfo {
+	info := events.MessageInfo{
+		Sender:    sender,
+		Chat:      sender.String(),
+		Timestamp: typing.GetTimestamp(),
+	}
+	if groupID := typing.GetGroupId(); groupID != nil {
+		info.Chat = base64.StdEncoding.EncodeToString(groupID)
+		info.IsGroup = true
+	}
+	return info
+}
+
+var connectionStatusEvents = map[SignalConnectionEvent]events.ConnectionStatus{
+	SignalConnectionEventConnected:    events.ConnectionStatusConnected,
+	SignalConnectionEventDisconnected: events.ConnectionStatusDisconnected,
+	SignalConnectionEventLoggedOut:    events.ConnectionStatusLoggedOut,
+	SignalConnectionEventError:        events.ConnectionStatusError,
+	SignalConnectionCleanShutdown:     events.ConnectionStatusCleanShutdown,
+}
+
+// identityChangeNotifier dispatches an IdentityChange event when an identity key is replaced.
+type identityChangeNotifier struct {
+	libsignalgo.IdentityKeyStore
+	device *Device
+}
+
+func (icn *identityChangeNotifier) SaveIdentityKey(address *libsignalgo.Address, identityKey *libsignalgo.IdentityKey, ctx context.Context) (bool, error) {
+	replaced, err := icn.IdentityKeyStore.SaveIdentityKey(address, identityKey, ctx)
+	if err != nil || !replaced {
+		return replaced, err
+	}
+	name, _ := address.Name()
+	deviceID, _ := address.DeviceID()
+	serviceID, parseErr := uuid.Parse(name)
+	serialized, serializeErr := identityKey.Serialize()
+	if parseErr == nil && serializeErr == nil {
+		// This is called from inside libsignal, so don't let event handlers block it
+		go icn.device.dispatchEvent(&events.IdentityChange{
+			ServiceID:   serviceID,
+			DeviceID:    deviceID,
+			IdentityKey: serialized,
+		})
+	}
+	return replaced, err
+}
@@ -0,0 +1,133 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func TestEventHandlers(t *testing.T) {
+	var device Device
+	var first, second []any
+	firstID := device.AddEventHandler(func(evt any) {
+		first = append(first, evt)
+	})
+	device.AddEventHandler(func(evt any) {
+		second = append(second, evt)
+		panic("handler panics shouldn't break other handlers")
+	})
+	device.dispatchEvent(&events.ReadSelf{})
+	assert.True(t, device.RemoveEventHandler(firstID))
+	assert.False(t, device.RemoveEventHandler(firstID))
+	device.dispatchEvent(&events.ReadSelf{})
+	assert.Len(t, first, 1)
+	assert.Len(t, second, 2)
+}
+
+func TestEventHandlerSuccessStatus(t *testing.T) {
+	var device Device
+	var calls int
+	device.AddEventHandler(func(evt any) {
+		calls++
+	})
+	assert.True(t, device.dispatchEvent(&events.ReadSelf{}), "handlers without a status always succeed")
+	failID := device.AddEventHandlerWithSuccessStatus(func(evt any) bool {
+		_, isReadSelf := evt.(*events.ReadSelf)
+		return !isReadSelf
+	})
+	assert.False(t, device.dispatchEvent(&events.ReadSelf{}))
+	assert.True(t, device.dispatchEvent(&events.Receipt{}))
+	assert.Equal(t, 3, calls, "a failing handler mustn't stop the others")
+	require.True(t, device.RemoveEventHandler(failID))
+	device.AddEventHandlerWithSuccessStatus(func(evt any) bool {
+		panic("panics count as failures")
+	})
+	assert.False(t, device.dispatchEvent(&events.Receipt{}))
+}
+
+func TestContentDispatchRetriesOnlyFailedHandlers(t *testing.T) {
+	var device Device
+	var okCalls, flakyCalls []any
+	device.AddEventHandler(func(evt any) {
+		okCalls = append(okCalls, evt)
+	})
+	failReceipts := true
+	device.AddEventHandlerWithSuccessStatus(func(evt any) bool {
+		flakyCalls = append(flakyCalls, evt)
+		_, isReceipt := evt.(*events.Receipt)
+		return !isReceipt || !failReceipts
+	})
+	readSelf, receipt := &events.ReadSelf{}, &events.Receipt{}
+	cd := &contentDispatch{prepared: true, events: []any{readSelf, receipt}}
+	assert.False(t, cd.dispatch(&device))
+	assert.Equal(t, []any{readSelf, receipt}, okCalls)
+	assert.Equal(t, []any{readSelf, receipt}, flakyCalls)
+
+	failReceipts = false
+	assert.True(t, cd.dispatch(&device))
+	assert.Equal(t, []any{readSelf, receipt}, okCalls, "successful handlers mustn't get the events again")
+	assert.Equal(t, []any{readSelf, receipt, receipt}, flakyCalls, "only the failed event should be redelivered")
+
+	assert.True(t, cd.dispatch(&device))
+	assert.Len(t, flakyCalls, 3)
+}
+
+func TestContentEvents(t *testing.T) {
+	var device Device
+	device.Data.AciUuid = uuid.New().String()
+	sender := uuid.New()
+	content := &signalpb.Content{
+		DataMessage: &signalpb.DataMessage{
+			Body:      proto.String("hello"),
+			Timestamp: proto.Uint64(1234),
+			Reaction: &signalpb.DataMessage_Reaction{
+				Emoji:               proto.String("👍"),
+				TargetSentTimestamp: proto.Uint64(1000),
+			},
+		},
+		TypingMessage: &signalpb.TypingMessage{
+			Timestamp: proto.Uint64(1235),
+			Action:    signalpb.TypingMessage_STARTED.Enum(),
+		},
+		// Sync messages from other users must be ignored
+		SyncMessage: &signalpb.SyncMessage{
+			Read: []*signalpb.SyncMessage_Read{{Timestamp: proto.Uint64(1000)}},
+		},
+	}
+	evts := device.contentEvents(sender.String(), content)
+	require.Len(t, evts, 3)
+	expectedInfo := events.MessageInfo{Sender: sender, Chat: sender.String(), Timestamp: 1234}
+	reaction, ok := evts[0].(*events.Reaction)
+	require.True(t, ok)
+	assert.Equal(t, expectedInfo, reaction.Info)
+	assert.Equal(t, "👍", reaction.Reaction.GetEmoji())
+	message, ok := evts[1].(*events.Message)
+	require.True(t, ok)
+	assert.Equal(t, expectedInfo, message.Info)
+	assert.Equal(t, "hello", message.Message.GetBody())
+	typing, ok := evts[2].(*events.Typing)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1235), typing.Info.Timestamp)
+}
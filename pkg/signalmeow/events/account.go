@@ -0,0 +1,38 @@
+package events
+
+import (
+	"github.com/google/uuid"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// ContactChange is sent for every contact in a contact sync from the primary device.
+type ContactChange struct {
+	Contact *signalpb.ContactDetails
+	// Avatar is the raw avatar image from the contact sync, if the contact has one
+	Avatar []byte
+}
+
+// IdentityChange is sent when the identity key of a contact changes, e.g. because they reinstalled Signal.
+type IdentityChange struct {
+	ServiceID uuid.UUID
+	DeviceID  uint
+	// IdentityKey is the serialized new identity key
+	IdentityKey []byte
+}
+
+type ConnectionStatus int
+
+const (
+	ConnectionStatusConnected ConnectionStatus = iota + 1
+	ConnectionStatusDisconnected
+	ConnectionStatusLoggedOut
+	ConnectionStatusError
+	ConnectionStatusCleanShutdown
+)
+
+// ConnectionState is sent when the connection to the Signal servers changes.
+type ConnectionState struct {
+	Status ConnectionStatus
+	Err    error
+}
@@ -1,3 +1,7 @@
+// Package events contains the events that signalmeow dispatches to handlers registered with Device.AddEventHandler.
+//
+// Every event carries the raw protobuf it was created from, so handlers can access fields
+// that aren't exposed in a more convenient form.
 package events
 
 import (
@@ -6,11 +10,119 @@ import (
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 )
 
+// MessageInfo contains the metadata shared by all events about a message in a chat.
 type MessageInfo struct {
+	// Sender is the ACI of the user who sent the message. It's our own ACI for messages sent from our other devices.
 	Sender uuid.UUID
-	Chat   string
+	// Chat is the group identifier for group messages and the ACI of the other user for private chats.
+	Chat    string
+	IsGroup bool
+	// IsFromMe is true for messages sent from our other devices.
+	IsFromMe bool
+	// Timestamp identifies the message together with Sender.
+	Timestamp uint64
 }
 
+// Message is a normal message with a body, attachments, a sticker or shared contacts.
+type Message struct {
+	Info    MessageInfo
+	Message *signalpb.DataMessage
+}
+
+// Edit is an edit of a previous message.
+type Edit struct {
+	Info MessageInfo
+	// TargetTimestamp is the timestamp of the original message, the edit has its own timestamp in Info
+	TargetTimestamp uint64
+	Edit            *signalpb.EditMessage
+}
+
+// Reaction is a reaction being added to or removed from a message.
+type Reaction struct {
+	Info     MessageInfo
+	Reaction *signalpb.DataMessage_Reaction
+}
+
+// Delete is a message being deleted for everyone.
+type Delete struct {
+	Info   MessageInfo
+	Delete *signalpb.DataMessage_Delete
+}
+
+// DisappearingTimer is a change of the disappearing message timer in a private chat.
+// Group timers are changed with a GroupChange.
+type DisappearingTimer struct {
+	Info MessageInfo
+	// Timer is the new timer in seconds, zero means disappearing messages were turned off
+	Timer   uint32
+	Message *signalpb.DataMessage
+}
+
+// Typing is a typing notification.
+type Typing struct {
+	Info   MessageInfo
+	Typing *signalpb.TypingMessage
+}
+
+// Call is a private call message (offer, answer, hangup...) or a group call update.
+// Exactly one of CallMessage and GroupCallUpdate is set.
+type Call struct {
+	Info            MessageInfo
+	CallMessage     *signalpb.CallMessage
+	GroupCallUpdate *signalpb.DataMessage_GroupCallUpdate
+}
+
+// GroupChange is sent when a message says a group was changed. Group contains the new revision
+// and the signed, encrypted change that can be applied to the previous state of the group.
+// It's also sent when a message has a newer revision of the group than we know about but the
+// changes in between couldn't be fetched, in which case only the new state of the group is known.
+type GroupChange struct {
+	Info  MessageInfo
+	Group *signalpb.GroupContextV2
+}
+
+// Story is a story posted by a contact or in a group.
+type Story struct {
+	Info  MessageInfo
+	Story *signalpb.StoryMessage
+}
+
+// Receipt is a delivery, read or viewed receipt for messages we sent.
 type Receipt struct {
+	Sender uuid.UUID
 	*signalpb.ReceiptMessage
 }
+
+// ReadSelf is sent when we read messages on another device.
+type ReadSelf struct {
+	Messages []*signalpb.SyncMessage_Read
+}
+
+// GroupRevision is a single change to a group from the group change log. When a message says a group
+// has a newer revision than we know about, one GroupRevision is sent for every revision in between,
+// in order, including changes that happened while we were offline.
+type GroupRevision struct {
+	Info MessageInfo
+	// Author is the user who made the change. It's the zero UUID if the author couldn't be decrypted.
+	Author   uuid.UUID
+	Revision uint32
+
+	AddedMembers []uuid.UUID
+	// AddedAdmins are the added members who joined as admins
+	AddedAdmins    []uuid.UUID
+	RemovedMembers []uuid.UUID
+	ChangedRoles   map[uuid.UUID]signalpb.Member_Role
+
+	// The fields below are only set if they were changed in this revision
+	NewTitle             *string
+	NewDescription       *string
+	NewAvatarPath        *string
+	NewDisappearingTimer *uint32
+	NewAnnouncementsOnly *bool
+
+	NewAttributesAccess        *signalpb.AccessControl_AccessRequired
+	NewMemberAccess            *signalpb.AccessControl_AccessRequired
+	NewAddFromInviteLinkAccess *signalpb.AccessControl_AccessRequired
+
+	Actions *signalpb.GroupChange_Actions
+}
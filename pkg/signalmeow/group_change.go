@@ -0,0 +1,145 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// ErrGroupChangeForbidden is returned when the server rejects a group change,
+// usually because only admins are allowed to change the group attributes.
+var ErrGroupChangeForbidden = errors.New("not allowed to change the group")
+
+// ErrGroupChangeNotSent is returned when a group change was applied on the server,
+// but telling the other members about it failed.
+var ErrGroupChangeNotSent = errors.New("group was changed, but sending the change to members failed")
+
+func encryptGroupPropertyBlob(groupSecretParams libsignalgo.GroupSecretParams, blob *signalpb.GroupAttributeBlob) ([]byte, error) {
+	plaintext, err := proto.Marshal(blob)
+	if err != nil {
+		return nil, err
+	}
+	randomness, err := libsignalgo.GenerateRandomness()
+	if err != nil {
+		return nil, err
+	}
+	return groupSecretParams.EncryptBlobWithPaddingDeterministic(randomness, plaintext, 0)
+}
+
+// errGroupRevisionConflict is returned by sendGroupPatch when someone else changed the group at the same time.
+var errGroupRevisionConflict = errors.New("group revision is outdated")
+
+// patchGroup applies the given actions to the group on the server and returns the signed group change.
+// If someone else changed the group at the same time, the actions are applied again on top of their change.
+func patchGroup(ctx context.Context, d *Device, group *Group, actions *signalpb.GroupChange_Actions) ([]byte, error) {
+	signedChange, err := sendGroupPatch(ctx, d, group, actions)
+	if errors.Is(err, errGroupRevisionConflict) {
+		d.log().Debug().Str("group_id", string(group.GroupIdentifier)).Uint32("revision", group.Revision).
+			Msg("Group changed while patching it, retrying with the latest revision")
+		group, err = retrieveGroupByID(ctx, d, group.GroupIdentifier)
+		if err != nil {
+			return nil, fmt.Errorf("failed to refetch group after conflict: %w", err)
+		}
+		signedChange, err = sendGroupPatch(ctx, d, group, actions)
+	}
+	return signedChange, err
+}
+
+func sendGroupPatch(ctx context.Context, d *Device, group *Group, actions *signalpb.GroupChange_Actions) ([]byte, error) {
+	actions.Revision = group.Revision + 1
+	body, err := proto.Marshal(actions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal group change: %w", err)
+	}
+	groupAuth, err := getAuthorizationForToday(ctx, d, masterKeyToBytes(group.groupMasterKey))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.web().SendHTTPRequest(http.MethodPatch, "/v1/groups", &web.HTTPReqOpt{
+		Body:        body,
+		Username:    &groupAuth.Username,
+		Password:    &groupAuth.Password,
+		ContentType: web.ContentTypeProtobuf,
+		Host:        web.StorageUrlHost,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send group change request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden {
+		return nil, ErrGroupChangeForbidden
+	} else if resp.StatusCode == http.StatusConflict {
+		// The next attempt will fetch the new revision
+		invalidateGroupCache(ctx, d, group.GroupIdentifier)
+		return nil, fmt.Errorf("%w: %d", errGroupRevisionConflict, group.Revision)
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("group change request returned status %d", resp.StatusCode)
+	}
+	signedChange, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read group change response: %w", err)
+	}
+	invalidateGroupCache(ctx, d, group.GroupIdentifier)
+	return signedChange, nil
+}
+
+// updateGroupDisappearingTimer changes the disappearing message timer of a group
+// and tells the other members about the change.
+func updateGroupDisappearingTimer(ctx context.Context, d *Device, gid GroupIdentifier, expiresInSeconds uint32) error {
+	group, err := retrieveGroupByID(ctx, d, gid)
+	if err != nil {
+		return fmt.Errorf("failed to get group: %w", err)
+	}
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyToBytes(group.groupMasterKey))
+	if err != nil {
+		return err
+	}
+	encryptedTimer, err := encryptGroupPropertyBlob(groupSecretParams, &signalpb.GroupAttributeBlob{
+		Content: &signalpb.GroupAttributeBlob_DisappearingMessagesDuration{
+			DisappearingMessagesDuration: expiresInSeconds,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encrypt timer: %w", err)
+	}
+	signedChange, err := patchGroup(ctx, d, group, &signalpb.GroupChange_Actions{
+		ModifyDisappearingMessagesTimer: &signalpb.GroupChange_Actions_ModifyDisappearingMessagesTimerAction{
+			Timer: encryptedTimer,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	content := DataMessageForExpireTimerUpdate(expiresInSeconds)
+	content.DataMessage.GroupV2 = &signalpb.GroupContextV2{GroupChange: signedChange}
+	_, err = sendGroupMessage(ctx, d, gid, content, nil)
+	if err != nil {
+		// The change was already applied, so other members will still see it when they next fetch the group
+		return fmt.Errorf("%w: %w", ErrGroupChangeNotSent, err)
+	}
+	return nil
+}
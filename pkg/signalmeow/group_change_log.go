@@ -0,0 +1,403 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// The highest group change epoch we know how to apply. Changes from newer epochs may contain
+// actions we don't understand, so the whole group is refetched instead.
+const groupChangeMaxSupportedEpoch = 5
+
+// GroupChange is a decrypted change to a group, which moved it to Revision.
+//
+// Pending, requesting and banned members and invite links aren't tracked in Group,
+// so only promotions from those lists to full members are included.
+type GroupChange struct {
+	GroupIdentifier GroupIdentifier
+	// SourceACI is the user who made the change. It's empty if it couldn't be decrypted.
+	SourceACI string
+	Revision  uint32
+
+	// AddMembers includes members that were added directly as well as promoted pending and requesting members
+	AddMembers              []*GroupMember
+	DeleteMembers           []string
+	ModifyMemberRoles       []*GroupMember
+	ModifyMemberProfileKeys []*GroupMember
+
+	ModifyTitle                        *string
+	ModifyDescription                  *string
+	ModifyAvatar                       *string
+	ModifyDisappearingMessagesDuration *uint32
+	ModifyAnnouncementsOnly            *bool
+	ModifyAttributesAccess             *AccessControl
+	ModifyMemberAccess                 *AccessControl
+	ModifyAddFromInviteLinkAccess      *AccessControl
+
+	actions *signalpb.GroupChange_Actions
+}
+
+func decryptGroupMember(groupSecretParams libsignalgo.GroupSecretParams, encryptedUserID, encryptedProfileKey []byte) (*GroupMember, error) {
+	if len(encryptedUserID) != len(libsignalgo.UUIDCiphertext{}) {
+		return nil, fmt.Errorf("invalid user ID ciphertext length %d", len(encryptedUserID))
+	}
+	userID, err := groupSecretParams.DecryptUUID(libsignalgo.UUIDCiphertext(encryptedUserID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt user ID: %w", err)
+	}
+	member := &GroupMember{UserId: userID.String()}
+	if len(encryptedProfileKey) > 0 {
+		if len(encryptedProfileKey) != len(libsignalgo.ProfileKeyCiphertext{}) {
+			return nil, fmt.Errorf("invalid profile key ciphertext length %d", len(encryptedProfileKey))
+		}
+		profileKey, err := groupSecretParams.DecryptProfileKey(libsignalgo.ProfileKeyCiphertext(encryptedProfileKey), *userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt profile key: %w", err)
+		}
+		member.ProfileKey = *profileKey
+	}
+	return member, nil
+}
+
+func decryptGroupChange(groupSecretParams libsignalgo.GroupSecretParams, gid GroupIdentifier, actions *signalpb.GroupChange_Actions) (*GroupChange, error) {
+	change := &GroupChange{
+		GroupIdentifier: gid,
+		Revision:        actions.GetRevision(),
+		actions:         actions,
+	}
+	// The source may also be a PNI, which can't be decrypted as an ACI, so errors aren't fatal here
+	if source, err := decryptGroupMember(groupSecretParams, actions.GetSourceServiceId(), nil); err == nil {
+		change.SourceACI = source.UserId
+	}
+
+	for _, add := range actions.GetAddMembers() {
+		member, err := decryptGroupMember(groupSecretParams, add.GetAdded().GetUserId(), add.GetAdded().GetProfileKey())
+		if err != nil {
+			return nil, fmt.Errorf("added member: %w", err)
+		}
+		member.Role = GroupMemberRole(add.GetAdded().GetRole())
+		change.AddMembers = append(change.AddMembers, member)
+	}
+	for _, promote := range actions.GetPromotePendingMembers() {
+		member, err := decryptGroupMember(groupSecretParams, promote.GetUserId(), promote.GetProfileKey())
+		if err != nil {
+			return nil, fmt.Errorf("promoted pending member: %w", err)
+		}
+		member.Role = GroupMember_DEFAULT
+		change.AddMembers = append(change.AddMembers, member)
+	}
+	for _, promote := range actions.GetPromotePendingPniAciMembers() {
+		member, err := decryptGroupMember(groupSecretParams, promote.GetUserId(), promote.GetProfileKey())
+		if err != nil {
+			return nil, fmt.Errorf("promoted pending PNI member: %w", err)
+		}
+		member.Role = GroupMember_DEFAULT
+		change.AddMembers = append(change.AddMembers, member)
+	}
+	for _, promote := range actions.GetPromoteRequestingMembers() {
+		member, err := decryptGroupMember(groupSecretParams, promote.GetUserId(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("promoted requesting member: %w", err)
+		}
+		member.Role = GroupMemberRole(promote.GetRole())
+		change.AddMembers = append(change.AddMembers, member)
+	}
+	for _, del := range actions.GetDeleteMembers() {
+		member, err := decryptGroupMember(groupSecretParams, del.GetDeletedUserId(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("deleted member: %w", err)
+		}
+		change.DeleteMembers = append(change.DeleteMembers, member.UserId)
+	}
+	for _, modify := range actions.GetModifyMemberRoles() {
+		member, err := decryptGroupMember(groupSecretParams, modify.GetUserId(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("modified member role: %w", err)
+		}
+		member.Role = GroupMemberRole(modify.GetRole())
+		change.ModifyMemberRoles = append(change.ModifyMemberRoles, member)
+	}
+	for _, modify := range actions.GetModifyMemberProfileKeys() {
+		member, err := decryptGroupMember(groupSecretParams, modify.GetUserId(), modify.GetProfileKey())
+		if err != nil {
+			return nil, fmt.Errorf("modified member profile key: %w", err)
+		}
+		change.ModifyMemberProfileKeys = append(change.ModifyMemberProfileKeys, member)
+	}
+
+	if modify := actions.GetModifyTitle(); modify != nil {
+		blob, err := decryptGroupPropertyIntoBlob(groupSecretParams, modify.GetTitle())
+		if err != nil {
+			return nil, fmt.Errorf("title: %w", err)
+		}
+		title := cleanupStringProperty(blob.GetTitle())
+		change.ModifyTitle = &title
+	}
+	if modify := actions.GetModifyDescription(); modify != nil {
+		// A removed description is sent as an empty ciphertext, which can't be decrypted
+		var description string
+		if len(modify.GetDescription()) > 0 {
+			blob, err := decryptGroupPropertyIntoBlob(groupSecretParams, modify.GetDescription())
+			if err != nil {
+				return nil, fmt.Errorf("description: %w", err)
+			}
+			description = cleanupStringProperty(blob.GetDescription())
+		}
+		change.ModifyDescription = &description
+	}
+	if modify := actions.GetModifyAvatar(); modify != nil {
+		avatar := modify.GetAvatar()
+		change.ModifyAvatar = &avatar
+	}
+	if modify := actions.GetModifyDisappearingMessagesTimer(); modify != nil {
+		var duration uint32
+		if len(modify.GetTimer()) > 0 {
+			blob, err := decryptGroupPropertyIntoBlob(groupSecretParams, modify.GetTimer())
+			if err != nil {
+				return nil, fmt.Errorf("disappearing messages timer: %w", err)
+			}
+			duration = blob.GetDisappearingMessagesDuration()
+		}
+		change.ModifyDisappearingMessagesDuration = &duration
+	}
+	if modify := actions.GetModifyAnnouncementsOnly(); modify != nil {
+		announcementsOnly := modify.GetAnnouncementsOnly()
+		change.ModifyAnnouncementsOnly = &announcementsOnly
+	}
+	if modify := actions.GetModifyAttributesAccess(); modify != nil {
+		access := AccessControl(modify.GetAttributesAccess())
+		change.ModifyAttributesAccess = &access
+	}
+	if modify := actions.GetModifyMemberAccess(); modify != nil {
+		access := AccessControl(modify.GetMembersAccess())
+		change.ModifyMemberAccess = &access
+	}
+	if modify := actions.GetModifyAddFromInviteLinkAccess(); modify != nil {
+		access := AccessControl(modify.GetAddFromInviteLinkAccess())
+		change.ModifyAddFromInviteLinkAccess = &access
+	}
+	return change, nil
+}
+
+// applyChange returns a copy of the group with the change applied. The original group isn't modified.
+func (group *Group) applyChange(change *GroupChange) *Group {
+	updated := *group
+	updated.Revision = change.Revision
+
+	deleted := make(map[string]struct{}, len(change.DeleteMembers))
+	for _, userID := range change.DeleteMembers {
+		deleted[userID] = struct{}{}
+	}
+	updated.Members = make([]*GroupMember, 0, len(group.Members)+len(change.AddMembers))
+	memberIndex := make(map[string]int, len(group.Members)+len(change.AddMembers))
+	for _, member := range group.Members {
+		if _, isDeleted := deleted[member.UserId]; isDeleted {
+			continue
+		}
+		memberCopy := *member
+		memberIndex[member.UserId] = len(updated.Members)
+		updated.Members = append(updated.Members, &memberCopy)
+	}
+	for _, member := range change.AddMembers {
+		if _, alreadyMember := memberIndex[member.UserId]; alreadyMember {
+			continue
+		}
+		memberCopy := *member
+		memberCopy.JoinedAtRevision = change.Revision
+		memberIndex[member.UserId] = len(updated.Members)
+		updated.Members = append(updated.Members, &memberCopy)
+	}
+	for _, modify := range change.ModifyMemberRoles {
+		if i, ok := memberIndex[modify.UserId]; ok {
+			updated.Members[i].Role = modify.Role
+		}
+	}
+	for _, modify := range change.ModifyMemberProfileKeys {
+		if i, ok := memberIndex[modify.UserId]; ok {
+			updated.Members[i].ProfileKey = modify.ProfileKey
+		}
+	}
+
+	if change.ModifyTitle != nil {
+		updated.Title = *change.ModifyTitle
+	}
+	if change.ModifyDescription != nil {
+		updated.Description = *change.ModifyDescription
+	}
+	if change.ModifyAvatar != nil {
+		updated.AvatarPath = *change.ModifyAvatar
+	}
+	if change.ModifyDisappearingMessagesDuration != nil {
+		updated.DisappearingMessagesDuration = *change.ModifyDisappearingMessagesDuration
+	}
+	if change.ModifyAnnouncementsOnly != nil {
+		updated.AnnouncementsOnly = *change.ModifyAnnouncementsOnly
+	}
+	if change.ModifyAttributesAccess != nil || change.ModifyMemberAccess != nil || change.ModifyAddFromInviteLinkAccess != nil {
+		var accessControl GroupAccessControl
+		if group.AccessControl != nil {
+			accessControl = *group.AccessControl
+		}
+		if change.ModifyAttributesAccess != nil {
+			accessControl.Attributes = *change.ModifyAttributesAccess
+		}
+		if change.ModifyMemberAccess != nil {
+			accessControl.Members = *change.ModifyMemberAccess
+		}
+		if change.ModifyAddFromInviteLinkAccess != nil {
+			accessControl.AddFromInviteLink = *change.ModifyAddFromInviteLinkAccess
+		}
+		updated.AccessControl = &accessControl
+	}
+	return &updated
+}
+
+// fetchGroupChanges fetches the changes made to a group after the given revision from the group change log.
+// If the server includes the state of the group after the last change, it's returned too.
+func fetchGroupChanges(ctx context.Context, d *Device, group *Group) ([]*GroupChange, *Group, error) {
+	masterKeyBytes := masterKeyToBytes(group.groupMasterKey)
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive group secret params: %w", err)
+	}
+	groupAuth, err := getAuthorizationForToday(ctx, d, masterKeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := &web.HTTPReqOpt{
+		Username:    &groupAuth.Username,
+		Password:    &groupAuth.Password,
+		ContentType: web.ContentTypeProtobuf,
+		Host:        web.StorageUrlHost,
+	}
+
+	var changes []*GroupChange
+	var latestState *signalpb.Group
+	fromRevision := group.Revision + 1
+	for {
+		path := fmt.Sprintf(
+			"/v1/groups/logs/%d?maxSupportedChangeEpoch=%d&includeFirstState=false&includeLastState=true",
+			fromRevision, groupChangeMaxSupportedEpoch,
+		)
+		response, err := d.web().SendHTTPRequest(http.MethodGet, path, opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to request group changes: %w", err)
+		}
+		body, err := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read group changes: %w", err)
+		} else if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+			return nil, nil, fmt.Errorf("group changes request returned status %d", response.StatusCode)
+		}
+		var groupChanges signalpb.GroupChanges
+		if err = proto.Unmarshal(body, &groupChanges); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal group changes: %w", err)
+		}
+		for _, changeState := range groupChanges.GetGroupChanges() {
+			if changeState.GetGroupState() != nil {
+				latestState = changeState.GetGroupState()
+			}
+			encryptedChange := changeState.GetGroupChange()
+			if encryptedChange == nil {
+				continue
+			} else if encryptedChange.GetChangeEpoch() > groupChangeMaxSupportedEpoch {
+				return nil, nil, fmt.Errorf("unsupported group change epoch %d", encryptedChange.GetChangeEpoch())
+			}
+			var actions signalpb.GroupChange_Actions
+			if err = proto.Unmarshal(encryptedChange.GetActions(), &actions); err != nil {
+				return nil, nil, fmt.Errorf("failed to unmarshal group change actions: %w", err)
+			}
+			change, err := decryptGroupChange(groupSecretParams, group.GroupIdentifier, &actions)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to decrypt group change to revision %d: %w", actions.GetRevision(), err)
+			}
+			changes = append(changes, change)
+		}
+		// A partial response means there are more changes, starting after the last one in this response
+		if response.StatusCode != http.StatusPartialContent || len(changes) == 0 {
+			break
+		}
+		nextRevision := changes[len(changes)-1].Revision + 1
+		if nextRevision <= fromRevision {
+			break
+		}
+		fromRevision = nextRevision
+	}
+
+	var latest *Group
+	if latestState != nil {
+		latest, err = decryptGroup(latestState, group.groupMasterKey)
+		if err != nil {
+			d.log().Warn().Err(err).Msg("Failed to decrypt latest group state from change log")
+			latest = nil
+		}
+	}
+	return changes, latest, nil
+}
+
+// updateGroupFromChangeLog brings a stored group up to date by applying the changes from the group change log,
+// instead of fetching the whole group. The changes that were applied are returned in order.
+func updateGroupFromChangeLog(ctx context.Context, d *Device, group *Group) ([]*GroupChange, error) {
+	changes, latest, err := fetchGroupChanges(ctx, d, group)
+	if err != nil {
+		return nil, err
+	}
+	updated := group
+	applied := changes[:0]
+	for _, change := range changes {
+		if change.Revision <= updated.Revision {
+			continue
+		}
+		updated = updated.applyChange(change)
+		applied = append(applied, change)
+	}
+	// The server's copy of the group is authoritative, e.g. for actions that aren't tracked in Group
+	if latest != nil && latest.Revision >= updated.Revision {
+		updated = latest
+	}
+	if updated == group {
+		return nil, nil
+	}
+
+	for _, member := range updated.Members {
+		err = d.ProfileKeyStore.StoreProfileKey(member.UserId, member.ProfileKey, ctx)
+		if err != nil {
+			d.log().Err(err).Msg("StoreProfileKey error")
+		}
+	}
+	if err = d.GroupStore.StoreGroup(ctx, updated); err != nil {
+		d.log().Err(err).Str("gid", string(group.GroupIdentifier)).Msg("Failed to store group")
+	}
+	d.Connection.cacheLock.Lock()
+	d.initGroupCache()
+	d.Connection.GroupCache.groups[group.GroupIdentifier] = updated
+	d.Connection.GroupCache.lastFetched[group.GroupIdentifier] = time.Now()
+	d.Connection.cacheLock.Unlock()
+	return applied, nil
+}
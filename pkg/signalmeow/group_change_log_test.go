@@ -0,0 +1,185 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func TestGroupApplyChange(t *testing.T) {
+	alice, bob, carol := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	group := &Group{
+		GroupIdentifier: "group-id",
+		Title:           "Old title",
+		Description:     "Description",
+		Revision:        4,
+		Members: []*GroupMember{
+			{UserId: alice, Role: GroupMember_ADMINISTRATOR},
+			{UserId: bob, Role: GroupMember_DEFAULT},
+		},
+	}
+	title := "New title"
+	timer := uint32(3600)
+	access := AccessControl_ADMINISTRATOR
+	change := &GroupChange{
+		GroupIdentifier:                    "group-id",
+		SourceACI:                          alice,
+		Revision:                           5,
+		AddMembers:                         []*GroupMember{{UserId: carol, Role: GroupMember_DEFAULT}, {UserId: alice}},
+		DeleteMembers:                      []string{bob},
+		ModifyMemberRoles:                  []*GroupMember{{UserId: carol, Role: GroupMember_ADMINISTRATOR}},
+		ModifyTitle:                        &title,
+		ModifyDisappearingMessagesDuration: &timer,
+		ModifyAttributesAccess:             &access,
+	}
+
+	updated := group.applyChange(change)
+	assert.EqualValues(t, 5, updated.Revision)
+	assert.Equal(t, "New title", updated.Title)
+	assert.Equal(t, "Description", updated.Description)
+	assert.EqualValues(t, 3600, updated.DisappearingMessagesDuration)
+	require.NotNil(t, updated.AccessControl)
+	assert.Equal(t, AccessControl_ADMINISTRATOR, updated.AccessControl.Attributes)
+	require.Len(t, updated.Members, 2)
+	assert.Equal(t, alice, updated.Members[0].UserId)
+	assert.Equal(t, GroupMember_ADMINISTRATOR, updated.Members[0].Role, "existing member must not be re-added")
+	assert.Equal(t, carol, updated.Members[1].UserId)
+	assert.Equal(t, GroupMember_ADMINISTRATOR, updated.Members[1].Role)
+	assert.EqualValues(t, 5, updated.Members[1].JoinedAtRevision)
+
+	// The original group must not be modified
+	assert.EqualValues(t, 4, group.Revision)
+	assert.Equal(t, "Old title", group.Title)
+	assert.Nil(t, group.AccessControl)
+	require.Len(t, group.Members, 2)
+	assert.Equal(t, bob, group.Members[1].UserId)
+}
+
+func TestGroupRevisionEvent(t *testing.T) {
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	title := "Title"
+	adminsOnly := AccessControl_ADMINISTRATOR
+	change := &GroupChange{
+		GroupIdentifier:        "group-id",
+		SourceACI:              alice.String(),
+		Revision:               7,
+		AddMembers:             []*GroupMember{{UserId: bob.String()}, {UserId: carol.String(), Role: GroupMember_ADMINISTRATOR}},
+		ModifyMemberRoles:      []*GroupMember{{UserId: bob.String(), Role: GroupMember_ADMINISTRATOR}},
+		ModifyTitle:            &title,
+		ModifyAttributesAccess: &adminsOnly,
+	}
+
+	evt := groupRevisionEvent(bob.String(), 1234, change)
+	assert.Equal(t, bob, evt.Info.Sender)
+	assert.Equal(t, "group-id", evt.Info.Chat)
+	assert.True(t, evt.Info.IsGroup)
+	assert.EqualValues(t, 1234, evt.Info.Timestamp)
+	assert.Equal(t, alice, evt.Author)
+	assert.EqualValues(t, 7, evt.Revision)
+	assert.Equal(t, []uuid.UUID{bob, carol}, evt.AddedMembers)
+	assert.Equal(t, []uuid.UUID{carol}, evt.AddedAdmins)
+	assert.Empty(t, evt.RemovedMembers)
+	assert.Equal(t, signalpb.Member_ADMINISTRATOR, evt.ChangedRoles[bob])
+	assert.Equal(t, &title, evt.NewTitle)
+	assert.Nil(t, evt.NewDescription)
+	assert.Equal(t, signalpb.AccessControl_ADMINISTRATOR.Enum(), evt.NewAttributesAccess)
+	assert.Nil(t, evt.NewMemberAccess)
+}
+
+func TestUpdateGroupFromChangeLog(t *testing.T) {
+	server := newTestServer(t)
+	// Force the change log to be fetched in several pages
+	server.GroupLogPageSize = 2
+	phone := newTestPhone(t, server, "+15550000001")
+	client := linkTestClient(t, server, phone)
+	ctx := newTestContext(t)
+
+	masterKey, err := phone.CreateGroup(ctx, "Revision 0")
+	require.NoError(t, err)
+	gid, err := storeMasterKey(ctx, client.Device, masterKeyFromBytes(masterKey))
+	require.NoError(t, err)
+	group, err := retrieveGroupByID(ctx, client.Device, gid)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, group.Revision)
+	assert.Equal(t, "Revision 0", group.Title)
+
+	for i := 1; i <= 4; i++ {
+		revision, _, err := phone.ChangeGroupTitle(ctx, masterKey, fmt.Sprintf("Revision %d", i))
+		require.NoError(t, err)
+		require.EqualValues(t, i, revision)
+	}
+	revision, _, err := phone.ChangeGroupDescription(ctx, masterKey, "Description")
+	require.NoError(t, err)
+	require.EqualValues(t, 5, revision)
+
+	changes, err := updateGroupFromChangeLog(ctx, client.Device, group)
+	require.NoError(t, err)
+	require.Len(t, changes, 5, "all pages must be fetched")
+	for i, change := range changes {
+		assert.EqualValues(t, i+1, change.Revision)
+		assert.Equal(t, gid, change.GroupIdentifier)
+		assert.Equal(t, phone.ACI.String(), change.SourceACI)
+	}
+	require.NotNil(t, changes[0].ModifyTitle)
+	assert.Equal(t, "Revision 1", *changes[0].ModifyTitle)
+	require.NotNil(t, changes[3].ModifyTitle)
+	assert.Equal(t, "Revision 4", *changes[3].ModifyTitle)
+	assert.Nil(t, changes[4].ModifyTitle)
+	require.NotNil(t, changes[4].ModifyDescription)
+	assert.Equal(t, "Description", *changes[4].ModifyDescription)
+
+	// The original group is left alone, the updated one is cached and stored
+	assert.EqualValues(t, 0, group.Revision)
+	updated, err := retrieveGroupByID(ctx, client.Device, gid)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, updated.Revision)
+	assert.Equal(t, "Revision 4", updated.Title)
+	assert.Equal(t, "Description", updated.Description)
+	require.Len(t, updated.Members, 1)
+	assert.Equal(t, phone.ACI.String(), updated.Members[0].UserId)
+	stored, _, err := client.Device.GroupStore.LoadGroup(ctx, gid)
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.EqualValues(t, 5, stored.Revision)
+	assert.Equal(t, "Revision 4", stored.Title)
+
+	// Up to date groups don't have any changes
+	changes, err = updateGroupFromChangeLog(ctx, client.Device, updated)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	// Only the changes after the stored revision are fetched
+	revision, _, err = phone.ChangeGroupTitle(ctx, masterKey, "Revision 6")
+	require.NoError(t, err)
+	require.EqualValues(t, 6, revision)
+	changes, err = updateGroupFromChangeLog(ctx, client.Device, updated)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.EqualValues(t, 6, changes[0].Revision)
+	updated, err = retrieveGroupByID(ctx, client.Device, gid)
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, updated.Revision)
+	assert.Equal(t, "Revision 6", updated.Title)
+	assert.Equal(t, "Description", updated.Description)
+}
@@ -0,0 +1,52 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateGroupDisappearingTimerConflict(t *testing.T) {
+	server := newTestServer(t)
+	phone := newTestPhone(t, server, "+15550000001")
+	client := linkTestClient(t, server, phone)
+	ctx := newTestContext(t)
+	startTestClient(t, client)
+
+	masterKey, err := phone.CreateGroup(ctx, "Group")
+	require.NoError(t, err)
+	gid, err := storeMasterKey(ctx, client.Device, masterKeyFromBytes(masterKey))
+	require.NoError(t, err)
+	group, err := retrieveGroupByID(ctx, client.Device, gid)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, group.Revision)
+
+	// The cached group is now outdated, so the first attempt gets a conflict
+	_, _, err = phone.ChangeGroupTitle(ctx, masterKey, "New title")
+	require.NoError(t, err)
+	require.NoError(t, client.UpdateGroupDisappearingTimer(ctx, gid, 3600))
+
+	invalidateGroupCache(ctx, client.Device, gid)
+	group, err = retrieveGroupByID(ctx, client.Device, gid)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, group.Revision)
+	assert.Equal(t, "New title", group.Title)
+	assert.EqualValues(t, 3600, group.DisappearingMessagesDuration)
+}
@@ -19,7 +19,9 @@ package signalmeow
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"time"
 )
 
 var _ GroupStore = (*SQLStore)(nil)
@@ -33,6 +35,14 @@ type dbGroup struct {
 type GroupStore interface {
 	MasterKeyFromGroupIdentifier(groupIdentifier GroupIdentifier, ctx context.Context) (SerializedGroupMasterKey, error)
 	StoreMasterKey(groupIdentifier GroupIdentifier, key SerializedGroupMasterKey, ctx context.Context) error
+	// LoadGroup returns the stored state of a group and when it was fetched,
+	// or nil if it hasn't been stored since it last changed.
+	LoadGroup(ctx context.Context, groupIdentifier GroupIdentifier) (*Group, time.Time, error)
+	// StoreGroup saves the decrypted state of a group whose master key has been stored,
+	// marking it as fetched now. State older than what's already stored is ignored.
+	StoreGroup(ctx context.Context, group *Group) error
+	// ClearGroup removes the stored state of a group, but keeps the master key.
+	ClearGroup(ctx context.Context, groupIdentifier GroupIdentifier) error
 }
 
 func scanGroup(row scannable) (*dbGroup, error) {
@@ -80,3 +90,56 @@ func (s *SQLStore) StoreMasterKey(groupIdentifier GroupIdentifier, key Serialize
 	err = tx.Commit()
 	return err
 }
+
+const (
+	loadGroupStateQuery = `
+		SELECT master_key, group_info, fetched_ts FROM signalmeow_groups
+		WHERE our_aci_uuid=$1 AND group_identifier=$2 AND group_info IS NOT NULL
+	`
+	storeGroupStateQuery = `
+		UPDATE signalmeow_groups SET revision=$3, group_info=$4, fetched_ts=$5
+		WHERE our_aci_uuid=$1 AND group_identifier=$2 AND (revision IS NULL OR revision<=$3)
+	`
+	clearGroupStateQuery = `
+		UPDATE signalmeow_groups SET revision=NULL, group_info=NULL, fetched_ts=NULL
+		WHERE our_aci_uuid=$1 AND group_identifier=$2
+	`
+)
+
+func (s *SQLStore) LoadGroup(ctx context.Context, groupIdentifier GroupIdentifier) (*Group, time.Time, error) {
+	var masterKey SerializedGroupMasterKey
+	var groupInfo string
+	var fetchedAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx, loadGroupStateQuery, s.AciUuid, groupIdentifier).Scan(&masterKey, &groupInfo, &fetchedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, nil
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	var group Group
+	if err = json.Unmarshal([]byte(groupInfo), &group); err != nil {
+		return nil, time.Time{}, err
+	}
+	group.groupMasterKey = masterKey
+	group.GroupIdentifier = groupIdentifier
+	// State stored before fetch times were tracked is treated as never fetched
+	var fetchedTime time.Time
+	if fetchedAt.Valid {
+		fetchedTime = time.UnixMicro(fetchedAt.Int64)
+	}
+	return &group, fetchedTime, nil
+}
+
+func (s *SQLStore) StoreGroup(ctx context.Context, group *Group) error {
+	groupInfo, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, storeGroupStateQuery, s.AciUuid, group.GroupIdentifier, group.Revision, string(groupInfo), time.Now().UnixMicro())
+	return err
+}
+
+func (s *SQLStore) ClearGroup(ctx context.Context, groupIdentifier GroupIdentifier) error {
+	_, err := s.db.ExecContext(ctx, clearGroupStateQuery, s.AciUuid, groupIdentifier)
+	return err
+}
@@ -0,0 +1,117 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+)
+
+func newTestSQLStore(t *testing.T) *SQLStore {
+	db, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	container := NewStore(db, dbutil.NoopLogger)
+	require.NoError(t, container.Upgrade())
+	return newSQLStore(container, "our-aci")
+}
+
+func TestGroupStoreState(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLStore(t)
+	gid := GroupIdentifier("group-id")
+
+	group, _, err := store.LoadGroup(ctx, gid)
+	require.NoError(t, err)
+	assert.Nil(t, group, "group without master key")
+
+	require.NoError(t, store.StoreMasterKey(gid, "master-key", ctx))
+	group, _, err = store.LoadGroup(ctx, gid)
+	require.NoError(t, err)
+	assert.Nil(t, group, "group that hasn't been fetched")
+
+	stored := &Group{
+		groupMasterKey:  "master-key",
+		GroupIdentifier: gid,
+		Title:           "Group",
+		AvatarPath:      "groups/avatar",
+		Revision:        5,
+		Members: []*GroupMember{
+			{UserId: "alice", Role: GroupMember_ADMINISTRATOR, JoinedAtRevision: 0},
+			{UserId: "bob", Role: GroupMember_DEFAULT, JoinedAtRevision: 5},
+		},
+		AccessControl: &GroupAccessControl{
+			Attributes: AccessControl_ADMINISTRATOR,
+			Members:    AccessControl_MEMBER,
+		},
+	}
+	require.NoError(t, store.StoreGroup(ctx, stored))
+	group, fetchedAt, err := store.LoadGroup(ctx, gid)
+	require.NoError(t, err)
+	assert.Equal(t, stored, group)
+	assert.WithinDuration(t, time.Now(), fetchedAt, time.Minute)
+
+	// Older revisions don't replace newer ones
+	older := *stored
+	older.Revision = 4
+	older.Title = "Old title"
+	require.NoError(t, store.StoreGroup(ctx, &older))
+	group, _, err = store.LoadGroup(ctx, gid)
+	require.NoError(t, err)
+	assert.Equal(t, "Group", group.Title)
+
+	require.NoError(t, store.ClearGroup(ctx, gid))
+	group, _, err = store.LoadGroup(ctx, gid)
+	require.NoError(t, err)
+	assert.Nil(t, group)
+	masterKey, err := store.MasterKeyFromGroupIdentifier(gid, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, SerializedGroupMasterKey("master-key"), masterKey)
+}
+
+func TestGroupStoreFetchedAt(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLStore(t)
+	gid := GroupIdentifier("group-id")
+	require.NoError(t, store.StoreMasterKey(gid, "master-key", ctx))
+	require.NoError(t, store.StoreGroup(ctx, &Group{GroupIdentifier: gid, Revision: 3}))
+
+	// Storing the same revision again marks it as fetched now
+	_, err := store.db.Exec(`UPDATE signalmeow_groups SET fetched_ts=$1`, time.Now().Add(-48*time.Hour).UnixMicro())
+	require.NoError(t, err)
+	_, fetchedAt, err := store.LoadGroup(ctx, gid)
+	require.NoError(t, err)
+	assert.Greater(t, time.Since(fetchedAt), groupStateMaxAge)
+	require.NoError(t, store.StoreGroup(ctx, &Group{GroupIdentifier: gid, Revision: 3}))
+	_, fetchedAt, err = store.LoadGroup(ctx, gid)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(fetchedAt), groupStateMaxAge)
+
+	// State stored before fetch times were tracked counts as never fetched
+	_, err = store.db.Exec(`UPDATE signalmeow_groups SET fetched_ts=NULL`)
+	require.NoError(t, err)
+	group, fetchedAt, err := store.LoadGroup(ctx, gid)
+	require.NoError(t, err)
+	require.NotNil(t, group)
+	assert.True(t, fetchedAt.IsZero())
+}
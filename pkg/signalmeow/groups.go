@@ -46,25 +46,45 @@ const (
 )
 
 type GroupMember struct {
-	UserId           string
-	Role             GroupMemberRole
-	ProfileKey       libsignalgo.ProfileKey
-	JoinedAtRevision uint32
+	UserId           string                 `json:"user_id"`
+	Role             GroupMemberRole        `json:"role"`
+	ProfileKey       libsignalgo.ProfileKey `json:"profile_key"`
+	JoinedAtRevision uint32                 `json:"joined_at_revision"`
 	//Presentation     []byte
 }
+
+type AccessControl int32
+
+const (
+	// Note: right now we assume these match the equivalent values in the protobuf (signalpb.AccessControl_AccessRequired)
+	AccessControl_UNKNOWN       AccessControl = 0
+	AccessControl_ANY           AccessControl = 1
+	AccessControl_MEMBER        AccessControl = 2
+	AccessControl_ADMINISTRATOR AccessControl = 3
+	AccessControl_UNSATISFIABLE AccessControl = 4
+)
+
+// GroupAccessControl is the role required to change different parts of a group.
+type GroupAccessControl struct {
+	Attributes        AccessControl `json:"attributes"`
+	Members           AccessControl `json:"members"`
+	AddFromInviteLink AccessControl `json:"add_from_invite_link"`
+}
+
+// Group is the decrypted state of a group. It's stored in the database as JSON, so the JSON tags shouldn't be changed.
 type Group struct {
 	groupMasterKey  SerializedGroupMasterKey // We should keep this relatively private
-	GroupIdentifier GroupIdentifier          // This is what we should use to identify a group outside this file
-
-	Title                        string
-	AvatarPath                   string
-	Members                      []*GroupMember
-	Description                  string
-	AnnouncementsOnly            bool
-	Revision                     uint32
-	DisappearingMessagesDuration uint32
+	GroupIdentifier GroupIdentifier          `json:"-"` // This is what we should use to identify a group outside this file
+
+	Title                        string              `json:"title"`
+	AvatarPath                   string              `json:"avatar_path"`
+	Members                      []*GroupMember      `json:"members"`
+	Description                  string              `json:"description"`
+	AnnouncementsOnly            bool                `json:"announcements_only"`
+	Revision                     uint32              `json:"revision"`
+	DisappearingMessagesDuration uint32              `json:"disappearing_messages_duration"`
+	AccessControl                *GroupAccessControl `json:"access_control,omitempty"`
 	//PublicKey                  *libsignalgo.PublicKey
-	//AccessControl              *AccessControl
 	//PendingMembers             []*PendingMember
 	//RequestingMembers          []*RequestingMember
 	//InviteLinkPassword         []byte
@@ -88,25 +108,25 @@ func fetchNewGroupCreds(ctx context.Context, d *Device, today time.Time) (*Group
 	authRequest := web.CreateWSRequest("GET", path, nil, nil, nil)
 	resp, err := d.Connection.AuthedWS.SendRequest(ctx, authRequest)
 	if err != nil {
-		zlog.Err(err).Msg("SendRequest error")
+		d.log().Err(err).Msg("SendRequest error")
 		return nil, err
 	}
 	if *resp.Status != 200 {
 		err := fmt.Errorf("bad status code: %d", *resp.Status)
-		zlog.Err(err).Msg("bad status code fetching group creds")
+		d.log().Err(err).Msg("bad status code fetching group creds")
 		return nil, err
 	}
 
 	var creds GroupCredentials
 	err = json.Unmarshal(resp.Body, &creds)
 	if err != nil {
-		zlog.Err(err).Msg("json.Unmarshal error")
+		d.log().Err(err).Msg("json.Unmarshal error")
 		return nil, err
 	}
 	// make sure pni matches device pni
 	if creds.Pni != d.Data.PniUuid {
 		err := fmt.Errorf("creds.Pni != d.PniUuid")
-		zlog.Err(err).Msg("creds.Pni != d.PniUuid")
+		d.log().Err(err).Msg("creds.Pni != d.PniUuid")
 		return nil, err
 	}
 	return &creds, nil
@@ -124,11 +144,11 @@ func getCachedAuthorizationForToday(d *Device, today time.Time) *GroupCredential
 			return &cred
 		}
 	}
-	zlog.Info().Msg("No cached credential found for today")
+	d.log().Info().Msg("No cached credential found for today")
 	return nil
 }
 
-func GetAuthorizationForToday(ctx context.Context, d *Device, masterKey libsignalgo.GroupMasterKey) (*GroupAuth, error) {
+func getAuthorizationForToday(ctx context.Context, d *Device, masterKey libsignalgo.GroupMasterKey) (*GroupAuth, error) {
 	// Timestamps for the start of today, and 7 days later
 	today := time.Now().Truncate(24 * time.Hour)
 
@@ -136,7 +156,7 @@ func GetAuthorizationForToday(ctx context.Context, d *Device, masterKey libsigna
 	if todayCred == nil {
 		creds, err := fetchNewGroupCreds(ctx, d, today)
 		if err != nil {
-			zlog.Err(err).Msg("fetchNewGroupCreds error")
+			d.log().Err(err).Msg("fetchNewGroupCreds error")
 			return nil, err
 		}
 		d.Connection.GroupCredentials = creds
@@ -144,7 +164,7 @@ func GetAuthorizationForToday(ctx context.Context, d *Device, masterKey libsigna
 	}
 	if todayCred == nil {
 		err := errors.New("Couldn't get credential for today")
-		zlog.Err(err).Msg("GetAuthorizationForToday error")
+		d.log().Err(err).Msg("getAuthorizationForToday error")
 		return nil, err
 	}
 
@@ -153,53 +173,53 @@ func GetAuthorizationForToday(ctx context.Context, d *Device, masterKey libsigna
 	credential := todayCred.Credential
 	authCredentialResponse, err := libsignalgo.NewAuthCredentialWithPniResponse(credential)
 	if err != nil {
-		zlog.Err(err).Msg("NewAuthCredentialWithPniResponse error")
+		d.log().Err(err).Msg("NewAuthCredentialWithPniResponse error")
 		return nil, err
 	}
 
 	// Receive the auth credential
 	aciUuidBytes, err := uuid.Parse(d.Data.AciUuid)
 	if err != nil {
-		zlog.Err(err).Msg("aci convertUUIDToBytes error")
+		d.log().Err(err).Msg("aci convertUUIDToBytes error")
 		return nil, err
 	}
 	pniUuidBytes, err := uuid.Parse(d.Data.PniUuid)
 	if err != nil {
-		zlog.Err(err).Msg("pni convertUUIDToBytes error")
+		d.log().Err(err).Msg("pni convertUUIDToBytes error")
 		return nil, err
 	}
 	authCredential, err := libsignalgo.ReceiveAuthCredentialWithPni(
-		serverPublicParams(),
+		d.serverPublicParams(),
 		aciUuidBytes,
 		pniUuidBytes,
 		redemptionTime,
 		*authCredentialResponse,
 	)
 	if err != nil {
-		zlog.Err(err).Msg("ReceiveAuthCredentialWithPni error")
+		d.log().Err(err).Msg("ReceiveAuthCredentialWithPni error")
 		return nil, err
 	}
 
 	// get auth presentation
 	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKey)
 	if err != nil {
-		zlog.Err(err).Msg("DeriveGroupSecretParamsFromMasterKey error")
+		d.log().Err(err).Msg("DeriveGroupSecretParamsFromMasterKey error")
 		return nil, err
 	}
 	randomness, err := libsignalgo.GenerateRandomness()
 	authCredentialPresentation, err := libsignalgo.CreateAuthCredentialWithPniPresentation(
-		serverPublicParams(),
+		d.serverPublicParams(),
 		randomness,
 		groupSecretParams,
 		*authCredential,
 	)
 	if err != nil {
-		zlog.Err(err).Msg("CreateAuthCredentialWithPniPresentation error")
+		d.log().Err(err).Msg("CreateAuthCredentialWithPniPresentation error")
 		return nil, err
 	}
 	groupPublicParams, err := groupSecretParams.GetPublicParams()
 	if err != nil {
-		zlog.Err(err).Msg("GetPublicParams error")
+		d.log().Err(err).Msg("GetPublicParams error")
 		return nil, err
 	}
 
@@ -213,8 +233,7 @@ func masterKeyToBytes(groupMasterKey SerializedGroupMasterKey) libsignalgo.Group
 	// We are very tricksy, groupMasterKey is just base64 encoded group master key :O
 	masterKeyBytes, err := base64.StdEncoding.DecodeString(string(groupMasterKey))
 	if err != nil {
-		//zlog.Err(err).Msg("")
-		zlog.Fatal().Err(err).Msg("We should always be able to decode groupMasterKey into masterKeyBytes")
+		panic(fmt.Errorf("we should always be able to decode groupMasterKey into masterKeyBytes: %w", err))
 	}
 	return libsignalgo.GroupMasterKey(masterKeyBytes)
 }
@@ -226,19 +245,16 @@ func masterKeyFromBytes(masterKey libsignalgo.GroupMasterKey) SerializedGroupMas
 func groupIdentifierFromMasterKey(masterKey SerializedGroupMasterKey) (GroupIdentifier, error) {
 	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyToBytes(masterKey))
 	if err != nil {
-		zlog.Err(err).Msg("DeriveGroupSecretParamsFromMasterKey error")
-		return "", err
+		return "", fmt.Errorf("failed to derive group secret params: %w", err)
 	}
 	// Get the "group identifier" that isn't just the master key
 	groupPublicParams, err := groupSecretParams.GetPublicParams()
 	if err != nil {
-		zlog.Err(err).Msg("GetPublicParams error")
-		return "", err
+		return "", fmt.Errorf("failed to get group public params: %w", err)
 	}
 	groupIdentifier, err := libsignalgo.GetGroupIdentifier(*groupPublicParams)
 	if err != nil {
-		zlog.Err(err).Msg("GetGroupIdentifier error")
-		return "", err
+		return "", fmt.Errorf("failed to get group identifier: %w", err)
 	}
 	base64GroupIdentifier := base64.StdEncoding.EncodeToString(groupIdentifier[:])
 	gid := GroupIdentifier(base64GroupIdentifier)
@@ -252,14 +268,12 @@ func decryptGroup(encryptedGroup *signalpb.Group, groupMasterKey SerializedGroup
 
 	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyToBytes(groupMasterKey))
 	if err != nil {
-		zlog.Err(err).Msg("DeriveGroupSecretParamsFromMasterKey error")
-		return nil, err
+		return nil, fmt.Errorf("failed to derive group secret params: %w", err)
 	}
 
 	gid, err := groupIdentifierFromMasterKey(groupMasterKey)
 	if err != nil {
-		zlog.Err(err).Msg("groupIdentifierFromMasterKey error")
-		return nil, err
+		return nil, fmt.Errorf("failed to get group identifier: %w", err)
 	}
 	decryptedGroup.GroupIdentifier = gid
 
@@ -287,6 +301,14 @@ func decryptGroup(encryptedGroup *signalpb.Group, groupMasterKey SerializedGroup
 	// These aren't encrypted
 	decryptedGroup.AvatarPath = encryptedGroup.Avatar
 	decryptedGroup.Revision = encryptedGroup.Revision
+	decryptedGroup.AnnouncementsOnly = encryptedGroup.AnnouncementsOnly
+	if accessControl := encryptedGroup.AccessControl; accessControl != nil {
+		decryptedGroup.AccessControl = &GroupAccessControl{
+			Attributes:        AccessControl(accessControl.Attributes),
+			Members:           AccessControl(accessControl.Members),
+			AddFromInviteLink: AccessControl(accessControl.AddFromInviteLink),
+		}
+	}
 
 	// Decrypt members
 	decryptedGroup.Members = make([]*GroupMember, 0)
@@ -294,24 +316,13 @@ func decryptGroup(encryptedGroup *signalpb.Group, groupMasterKey SerializedGroup
 		if member == nil {
 			continue
 		}
-		encryptedUserID := libsignalgo.UUIDCiphertext(member.UserId)
-		userID, err := groupSecretParams.DecryptUUID(encryptedUserID)
-		if err != nil {
-			zlog.Err(err).Msg("DecryptUUID UserId error")
-			return nil, err
-		}
-		encryptedProfileKey := libsignalgo.ProfileKeyCiphertext(member.ProfileKey)
-		profileKey, err := groupSecretParams.DecryptProfileKey(encryptedProfileKey, *userID)
+		decryptedMember, err := decryptGroupMember(groupSecretParams, member.UserId, member.ProfileKey)
 		if err != nil {
-			zlog.Err(err).Msg("DecryptProfileKey ProfileKey error")
-			return nil, err
+			return nil, fmt.Errorf("failed to decrypt member: %w", err)
 		}
-		decryptedGroup.Members = append(decryptedGroup.Members, &GroupMember{
-			UserId:           userID.String(),
-			ProfileKey:       *profileKey,
-			Role:             GroupMemberRole(member.Role),
-			JoinedAtRevision: member.JoinedAtRevision,
-		})
+		decryptedMember.Role = GroupMemberRole(member.Role)
+		decryptedMember.JoinedAtRevision = member.JoinedAtRevision
+		decryptedGroup.Members = append(decryptedGroup.Members, decryptedMember)
 	}
 
 	return decryptedGroup, nil
@@ -320,14 +331,12 @@ func decryptGroup(encryptedGroup *signalpb.Group, groupMasterKey SerializedGroup
 func decryptGroupPropertyIntoBlob(groupSecretParams libsignalgo.GroupSecretParams, encryptedProperty []byte) (*signalpb.GroupAttributeBlob, error) {
 	decryptedProperty, err := groupSecretParams.DecryptBlobWithPadding(encryptedProperty)
 	if err != nil {
-		zlog.Err(err).Msg("DecryptBlobWithPadding error")
-		return nil, err
+		return nil, fmt.Errorf("failed to decrypt property: %w", err)
 	}
 	propertyBlob := &signalpb.GroupAttributeBlob{}
 	err = proto.Unmarshal(decryptedProperty, propertyBlob)
 	if err != nil {
-		zlog.Err(err).Msg("Unmarshal error")
-		return nil, err
+		return nil, fmt.Errorf("failed to unmarshal property: %w", err)
 	}
 	return propertyBlob, nil
 }
@@ -349,8 +358,7 @@ func cleanupStringMapping(r rune) rune {
 func decryptGroupAvatar(encryptedAvatar []byte, groupMasterKey SerializedGroupMasterKey) ([]byte, error) {
 	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyToBytes(groupMasterKey))
 	if err != nil {
-		zlog.Err(err).Msg("DeriveGroupSecretParamsFromMasterKey error")
-		return nil, err
+		return nil, fmt.Errorf("failed to derive group secret params: %w", err)
 	}
 	avatarBlob, err := decryptGroupPropertyIntoBlob(groupSecretParams, encryptedAvatar)
 	if err != nil {
@@ -362,26 +370,6 @@ func decryptGroupAvatar(encryptedAvatar []byte, groupMasterKey SerializedGroupMa
 	return decryptedImage, nil
 }
 
-func printGroupMember(member *GroupMember) {
-	if member == nil {
-		zlog.Debug().Msg("GroupMember is nil")
-		return
-	}
-	zlog.Debug().Msgf("UserID: %v", member.UserId)
-	zlog.Debug().Msgf("ProfileKey: %v", member.ProfileKey)
-	zlog.Debug().Msgf("Role: %v", member.Role)
-	zlog.Debug().Msgf("JoinedAtRevision: %v", member.JoinedAtRevision)
-}
-func printGroup(group *Group) {
-	zlog.Debug().Msgf("GroupIdentifier: %v", group.GroupIdentifier)
-	zlog.Debug().Msgf("Title: %v", group.Title)
-	zlog.Debug().Msgf("AvatarPath: %v", group.AvatarPath)
-	zlog.Debug().Msgf("Members len: %v", len(group.Members))
-	for _, member := range group.Members {
-		printGroupMember(member)
-	}
-}
-
 func groupMetadataForDataMessage(group Group) *signalpb.GroupContextV2 {
 	masterKey := masterKeyToBytes(group.groupMasterKey)
 	masterKeyBytes := masterKey[:]
@@ -394,16 +382,16 @@ func groupMetadataForDataMessage(group Group) *signalpb.GroupContextV2 {
 func fetchGroupByID(ctx context.Context, d *Device, gid GroupIdentifier) (*Group, error) {
 	groupMasterKey, err := d.GroupStore.MasterKeyFromGroupIdentifier(gid, ctx)
 	if err != nil {
-		zlog.Err(err).Msg("Failed to get group master key")
+		d.log().Err(err).Msg("Failed to get group master key")
 		return nil, err
 	}
 	if groupMasterKey == "" {
 		err := fmt.Errorf("No group master key found for group identifier")
-		zlog.Err(err).Str("gid", string(gid)).Msg("")
+		d.log().Err(err).Str("gid", string(gid)).Msg("")
 		return nil, err
 	}
 	masterKeyBytes := masterKeyToBytes(groupMasterKey)
-	groupAuth, err := GetAuthorizationForToday(ctx, d, masterKeyBytes)
+	groupAuth, err := getAuthorizationForToday(ctx, d, masterKeyBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -413,31 +401,31 @@ func fetchGroupByID(ctx context.Context, d *Device, gid GroupIdentifier) (*Group
 		ContentType: web.ContentTypeProtobuf,
 		Host:        web.StorageUrlHost,
 	}
-	response, err := web.SendHTTPRequest("GET", "/v1/groups", opts)
+	response, err := d.web().SendHTTPRequest("GET", "/v1/groups", opts)
 	if err != nil {
-		zlog.Err(err).Msg("RetrieveGroupById SendHTTPRequest error")
+		d.log().Err(err).Msg("RetrieveGroupById SendHTTPRequest error")
 		return nil, err
 	}
 	if response.StatusCode != 200 {
 		err := fmt.Errorf("RetrieveGroupById SendHTTPRequest bad status: %v", response.StatusCode)
-		zlog.Err(err).Msg("")
+		d.log().Err(err).Msg("")
 		return nil, err
 	}
 	encryptedGroup := &signalpb.Group{}
 	groupBytes, err := io.ReadAll(response.Body)
 	if err != nil {
-		zlog.Err(err).Msg("RetrieveGroupById ReadAll error")
+		d.log().Err(err).Msg("RetrieveGroupById ReadAll error")
 		return nil, err
 	}
 	err = proto.Unmarshal(groupBytes, encryptedGroup)
 	if err != nil {
-		zlog.Err(err).Msg("RetrieveGroupById Unmarshal error")
+		d.log().Err(err).Msg("RetrieveGroupById Unmarshal error")
 		return nil, err
 	}
 
 	group, err := decryptGroup(encryptedGroup, groupMasterKey)
 	if err != nil {
-		zlog.Err(err).Msg("RetrieveGroupById decryptGroup error")
+		d.log().Err(err).Msg("RetrieveGroupById decryptGroup error")
 		return nil, err
 	}
 
@@ -445,7 +433,7 @@ func fetchGroupByID(ctx context.Context, d *Device, gid GroupIdentifier) (*Group
 	for _, member := range group.Members {
 		err = d.ProfileKeyStore.StoreProfileKey(member.UserId, member.ProfileKey, ctx)
 		if err != nil {
-			zlog.Err(err).Msg("DecryptGroup StoreProfileKey error")
+			d.log().Err(err).Msg("DecryptGroup StoreProfileKey error")
 			//return nil, err
 		}
 	}
@@ -460,20 +448,20 @@ func fetchAndDecryptGroupAvatarImage(d *Device, path string, masterKey Serialize
 		Username: &username,
 		Password: &password,
 	}
-	zlog.Info().Msgf("Fetching group avatar from %v", path)
-	resp, err := web.SendHTTPRequest("GET", path, opts)
+	d.log().Info().Msgf("Fetching group avatar from %v", path)
+	resp, err := d.web().SendHTTPRequest("GET", path, opts)
 	if err != nil {
-		zlog.Err(err).Msg("error fetching group avatar")
+		d.log().Err(err).Msg("error fetching group avatar")
 		return nil, err
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		err := errors.New(fmt.Sprintf("%v (unsuccessful status code)", resp.Status))
-		zlog.Err(err).Msg("bad status fetching group avatar")
+		d.log().Err(err).Msg("bad status fetching group avatar")
 		return nil, err
 	}
 	encryptedAvatar, err := io.ReadAll(resp.Body)
 	if err != nil {
-		zlog.Err(err).Msg("error reading group avatar")
+		d.log().Err(err).Msg("error reading group avatar")
 		return nil, err
 	}
 
@@ -484,27 +472,45 @@ func fetchAndDecryptGroupAvatarImage(d *Device, path string, masterKey Serialize
 	return decryptedBytes, nil
 }
 
-func RetrieveGroupByID(ctx context.Context, d *Device, gid GroupIdentifier) (*Group, error) {
-	d.initGroupCache()
+// groupStateMaxAge is how long the state of a group is used before it's fetched again. Groups are normally
+// refetched when they change, this is a backstop in case a change was missed.
+const groupStateMaxAge = 24 * time.Hour
 
-	lastFetched, ok := d.Connection.GroupCache.lastFetched[gid]
-	if ok && time.Since(lastFetched) < 1*time.Hour {
-		group, ok := d.Connection.GroupCache.groups[gid]
-		if ok {
-			return group, nil
-		}
+// retrieveGroupByID returns the current state of a group. The group is only fetched from the server
+// if it hasn't been stored since it last changed (see invalidateGroupCache) or the stored state is too old.
+func retrieveGroupByID(ctx context.Context, d *Device, gid GroupIdentifier) (*Group, error) {
+	d.Connection.cacheLock.Lock()
+	d.initGroupCache()
+	group, ok := d.Connection.GroupCache.groups[gid]
+	fetchedAt := d.Connection.GroupCache.lastFetched[gid]
+	d.Connection.cacheLock.Unlock()
+	if ok && time.Since(fetchedAt) < groupStateMaxAge {
+		return group, nil
 	}
-	group, err := fetchGroupByID(ctx, d, gid)
+
+	group, fetchedAt, err := d.GroupStore.LoadGroup(ctx, gid)
 	if err != nil {
-		return nil, err
+		d.log().Warn().Err(err).Str("gid", string(gid)).Msg("Failed to load stored group, fetching it instead")
 	}
+	if group == nil || time.Since(fetchedAt) >= groupStateMaxAge {
+		group, err = fetchGroupByID(ctx, d, gid)
+		if err != nil {
+			return nil, err
+		}
+		fetchedAt = time.Now()
+		if err = d.GroupStore.StoreGroup(ctx, group); err != nil {
+			d.log().Err(err).Str("gid", string(gid)).Msg("Failed to store group")
+		}
+	}
+	d.Connection.cacheLock.Lock()
 	d.Connection.GroupCache.groups[gid] = group
-	d.Connection.GroupCache.lastFetched[gid] = time.Now()
+	d.Connection.GroupCache.lastFetched[gid] = fetchedAt
+	d.Connection.cacheLock.Unlock()
 	return group, nil
 }
 
-func RetrieveGroupAndAvatarByID(ctx context.Context, d *Device, gid GroupIdentifier) (*Group, []byte, error) {
-	group, err := RetrieveGroupByID(ctx, d, gid)
+func retrieveGroupAndAvatarByID(ctx context.Context, d *Device, gid GroupIdentifier) (*Group, []byte, error) {
+	group, err := retrieveGroupByID(ctx, d, gid)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -513,49 +519,61 @@ func RetrieveGroupAndAvatarByID(ctx context.Context, d *Device, gid GroupIdentif
 	// If there is an avatarPath, and it's different from the cached one, fetch it
 	// (we only return the avatar if it's different from the cached one)
 	var avatarImage []byte
+	d.Connection.cacheLock.Lock()
 	cachedAvatarPath, _ := d.Connection.GroupCache.avatarPaths[gid]
+	d.Connection.cacheLock.Unlock()
 	if group.AvatarPath != "" && cachedAvatarPath != group.AvatarPath {
 		avatarImage, err = fetchAndDecryptGroupAvatarImage(d, group.AvatarPath, group.groupMasterKey)
 		if err != nil {
-			zlog.Err(err).Msg("error fetching group avatarImage")
+			d.log().Err(err).Msg("error fetching group avatarImage")
 			return nil, nil, err
 		}
 	}
+	d.Connection.cacheLock.Lock()
 	d.Connection.GroupCache.avatarPaths[gid] = group.AvatarPath
+	d.Connection.cacheLock.Unlock()
 
 	return group, avatarImage, nil
 }
 
-func InvalidateGroupCache(d *Device, gid GroupIdentifier) {
-	if d.Connection.GroupCache == nil {
-		return
+// invalidateGroupCache makes the next retrieveGroupByID call fetch the group from the server.
+// It should be called when the group is known to have changed.
+func invalidateGroupCache(ctx context.Context, d *Device, gid GroupIdentifier) {
+	d.Connection.cacheLock.Lock()
+	if d.Connection.GroupCache != nil {
+		delete(d.Connection.GroupCache.groups, gid)
+		delete(d.Connection.GroupCache.lastFetched, gid)
+		// Don't delete avatarPaths, they can stay cached
+	}
+	d.Connection.cacheLock.Unlock()
+	if err := d.GroupStore.ClearGroup(ctx, gid); err != nil {
+		d.log().Err(err).Str("gid", string(gid)).Msg("Failed to clear stored group")
 	}
-	delete(d.Connection.GroupCache.groups, gid)
-	delete(d.Connection.GroupCache.lastFetched, gid)
-	// Don't delete avatarPaths, they can stay cached
 }
 
 // We should store the group master key in the group store as soon as we see it,
 // then use the group identifier to refer to groups. As a convenience, we return
 // the group identifier, which is derived from the group master key.
-func StoreMasterKey(ctx context.Context, d *Device, groupMasterKey SerializedGroupMasterKey) (GroupIdentifier, error) {
+func storeMasterKey(ctx context.Context, d *Device, groupMasterKey SerializedGroupMasterKey) (GroupIdentifier, error) {
 	groupIdentifier, err := groupIdentifierFromMasterKey(groupMasterKey)
 	if err != nil {
-		zlog.Err(err).Msg("groupIdentifierFromMasterKey error")
+		d.log().Err(err).Msg("groupIdentifierFromMasterKey error")
 		return "", err
 	}
 	err = d.GroupStore.StoreMasterKey(groupIdentifier, groupMasterKey, ctx)
 	if err != nil {
-		zlog.Err(err).Msg("StoreMasterKey error")
+		d.log().Err(err).Msg("storeMasterKey error")
 		return "", err
 	}
 	return groupIdentifier, nil
 }
 
-// We need to track active calls so we don't send too many IncomingSignalMessageCalls
+// We need to track active calls so we don't bridge too many ringing group calls
 // Of course for group calls Signal doesn't tell us *anything* so we're mostly just inferring
 // So we just jam a new call ID in, and return true if we *think* this is a new incoming call
 func (d *Device) UpdateActiveCalls(gid GroupIdentifier, callID string) (isActive bool) {
+	d.Connection.cacheLock.Lock()
+	defer d.Connection.cacheLock.Unlock()
 	d.initGroupCache()
 	// Check to see if we currently have an active call for this group
 	currentCallID, ok := d.Connection.GroupCache.activeCalls[gid]
@@ -570,6 +588,7 @@ func (d *Device) UpdateActiveCalls(gid GroupIdentifier, callID string) (isActive
 	return true
 }
 
+// initGroupCache must be called with cacheLock held.
 func (d *Device) initGroupCache() {
 	if d.Connection.GroupCache == nil {
 		d.Connection.GroupCache = &GroupCache{
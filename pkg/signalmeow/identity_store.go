@@ -39,7 +39,6 @@ func scanIdentityKeyPair(row scannable) (*libsignalgo.IdentityKeyPair, error) {
 	var keyPair []byte
 	err := row.Scan(&keyPair)
 	if errors.Is(err, sql.ErrNoRows) {
-		zlog.Info().Msg("no identity key pair found")
 		return nil, nil
 	} else if err != nil {
 		return nil, err
@@ -51,7 +50,6 @@ func scanIdentityKey(row scannable) (*libsignalgo.IdentityKey, error) {
 	var key []byte
 	err := row.Scan(&key)
 	if errors.Is(err, sql.ErrNoRows) {
-		zlog.Info().Msg("no identity key found")
 		return nil, nil
 	} else if err != nil {
 		return nil, err
@@ -63,7 +61,6 @@ func (s *SQLStore) GetIdentityKeyPair(ctx context.Context) (*libsignalgo.Identit
 	keyPair, err := scanIdentityKeyPair(s.db.QueryRow(getIdentityKeyPairQuery, s.AciUuid))
 	if err != nil {
 		err = fmt.Errorf("failed to get identity key pair: %w", err)
-		zlog.Error().Err(err).Msg("")
 		return nil, err
 	} else if keyPair == nil {
 		return nil, nil
@@ -76,7 +73,6 @@ func (s *SQLStore) GetLocalRegistrationID(ctx context.Context) (uint32, error) {
 	err := s.db.QueryRow(getRegistrationLocalIDQuery, s.AciUuid).Scan(&regID)
 	if err != nil {
 		err = fmt.Errorf("failed to get local registration ID: %w", err)
-		zlog.Error().Err(err).Msg("")
 		return 0, err
 	}
 	return uint32(regID.Int64), nil
@@ -86,37 +82,34 @@ func (s *SQLStore) SaveIdentityKey(address *libsignalgo.Address, identityKey *li
 	trustLevel := "TRUSTED_UNVERIFIED" // TODO: this should be hard coded here
 	serialized, err := identityKey.Serialize()
 	if err != nil {
-		zlog.Err(err).Msg("error serializing identityKey")
-		return false, err
+		return false, fmt.Errorf("serializing identityKey: %w", err)
 	}
 	theirUuid, err := address.Name()
 	if err != nil {
-		zlog.Err(err).Msg("error getting theirUuid")
-		return false, err
+		return false, fmt.Errorf("getting theirUuid: %w", err)
 	}
 	deviceId, err := address.DeviceID()
 	if err != nil {
-		zlog.Err(err).Msg("error getting deviceId")
-		return false, err
+		return false, fmt.Errorf("getting deviceId: %w", err)
 	}
 	oldKey, err := scanIdentityKey(s.db.QueryRow(getIdentityKeyQuery, s.AciUuid, theirUuid, deviceId))
 	if err != nil {
-		zlog.Err(err).Msg("error getting old identity key")
+		return false, fmt.Errorf("getting old identity key: %w", err)
 	}
 	replacing := false
 	if oldKey != nil {
 		equal, err := oldKey.Equal(identityKey)
 		if err != nil {
-			zlog.Err(err).Msg("error comparing old and new identity keys")
+			return false, fmt.Errorf("comparing old and new identity keys: %w", err)
 		}
 		// We are replacing the old key iff the old key exists and it is not equal to the new key
 		replacing = !equal
 	}
 	_, err = s.db.Exec(insertIdentityKeyQuery, s.AciUuid, theirUuid, deviceId, serialized, trustLevel)
 	if err != nil {
-		zlog.Err(err).Msg("error inserting identity")
+		return false, fmt.Errorf("inserting identity: %w", err)
 	}
-	return replacing, err
+	return replacing, nil
 }
 func (s *SQLStore) IsTrustedIdentity(
 	address *libsignalgo.Address,
@@ -127,49 +120,35 @@ func (s *SQLStore) IsTrustedIdentity(
 	// TODO: this should check direction, and probably some other stuff (though whisperfish is pretty basic)
 	theirUuid, err := address.Name()
 	if err != nil {
-		zlog.Err(err).Msg("error getting theirUuid")
-		zlog.Info().Msg("RETURNING NOT TRUSTED")
-		return false, err
+		return false, fmt.Errorf("getting theirUuid: %w", err)
 	}
 	deviceId, err := address.DeviceID()
 	if err != nil {
-		zlog.Err(err).Msg("error getting deviceId")
-		zlog.Info().Msg("RETURNING NOT TRUSTED")
-		return false, err
+		return false, fmt.Errorf("getting deviceId: %w", err)
 	}
 	var trustLevel string
 	err = s.db.QueryRow(getIdentityKeyTrustLevelQuery, s.AciUuid, theirUuid, deviceId).Scan(&trustLevel)
 	// If no rows, they are a new identity, so trust by default
 	if errors.Is(err, sql.ErrNoRows) {
-		zlog.Info().Msg("no rows, TRUSTING BY DEFAULT")
 		return true, nil
 	} else if err != nil {
-		zlog.Err(err).Msg("error getting trust level")
-		zlog.Info().Msg("RETURNING NOT TRUSTED")
-		return false, err
+		return false, fmt.Errorf("getting trust level: %w", err)
 	}
-	trusted := trustLevel == "TRUSTED_UNVERIFIED" || trustLevel == "TRUSTED_VERIFIED"
-	if !trusted {
-		zlog.Info().Msg("RETURNING NOT TRUSTED")
-	}
-	return trusted, nil
+	return trustLevel == "TRUSTED_UNVERIFIED" || trustLevel == "TRUSTED_VERIFIED", nil
 }
 
 func (s *SQLStore) GetIdentityKey(address *libsignalgo.Address, ctx context.Context) (*libsignalgo.IdentityKey, error) {
 	theirUuid, err := address.Name()
 	if err != nil {
-		zlog.Err(err).Msg("error getting theirUuid")
-		return nil, err
+		return nil, fmt.Errorf("getting theirUuid: %w", err)
 	}
 	deviceId, err := address.DeviceID()
 	if err != nil {
-		zlog.Err(err).Msg("error getting deviceId")
-		return nil, err
+		return nil, fmt.Errorf("getting deviceId: %w", err)
 	}
 	key, err := scanIdentityKey(s.db.QueryRow(getIdentityKeyQuery, s.AciUuid, theirUuid, deviceId))
 	if err != nil {
-		zlog.Err(err).Msg("error getting identity key")
-		return nil, err
+		return nil, fmt.Errorf("getting identity key: %w", err)
 	}
 	return key, err
 }
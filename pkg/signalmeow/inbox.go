@@ -0,0 +1,342 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const (
+	inboxBatchSize  = 50
+	inboxRetryDelay = 30 * time.Second
+	// The delay between retries of a failed message doubles after every attempt up to this limit
+	inboxMaxRetryDelay = 5 * time.Minute
+	// Messages that fail this many times are given up on and marked as processed
+	inboxMaxAttempts = 5
+	// Handled messages are remembered for this long to ignore replays from the server
+	inboxRetention = 7 * 24 * time.Hour
+	// At most this many messages are queued in memory. When the queue is full, incoming envelopes
+	// aren't acknowledged until some messages have been handled, which makes the server wait too.
+	inboxMaxQueued = 256
+)
+
+// inboxHandler handles a message from the queue. If it returns true, the message is handled again after a delay.
+type inboxHandler func(ctx context.Context, entry *InboxEntry, content *signalpb.Content) (retry bool)
+
+// inboxQueue distributes messages from the inbox to a worker per conversation. Messages in the same
+// conversation are handled one at a time in the order they were received, while different conversations
+// are handled in parallel, so that e.g. a slow attachment download doesn't hold up every other chat.
+//
+// Receipts and read syncs refer to messages in other conversations, so they act as barriers:
+// they're only handled after every message queued before them has been handled.
+//
+// A message that fails is retried before anything after it in the same conversation, so the order is kept
+// even when retrying. The handler decides when to give up, see Device.processInboxEntry.
+type inboxQueue struct {
+	ctx    context.Context
+	handle inboxHandler
+	// retryDelay is how long a failed message waits before it's handled again the first time
+	retryDelay time.Duration
+	// slots has a value for every message that has been queued but not handled yet
+	slots chan struct{}
+	// loaded is closed when the messages left over from before the queue was created have been queued
+	loaded chan struct{}
+
+	lock sync.Mutex
+	// conversations has the pending messages of every conversation that has a running worker
+	conversations map[string][]inboxItem
+	// lastSeq is the sequence number of the last queued message
+	lastSeq uint64
+	// unhandled has the sequence numbers of queued messages that haven't been handled yet
+	unhandled map[uint64]struct{}
+	// handled is closed and replaced whenever a message has been handled
+	handled chan struct{}
+}
+
+type inboxItem struct {
+	entry   *InboxEntry
+	content *signalpb.Content
+	seq     uint64
+	barrier bool
+}
+
+func newInboxQueue(ctx context.Context, handle inboxHandler) *inboxQueue {
+	return &inboxQueue{
+		ctx:           ctx,
+		handle:        handle,
+		retryDelay:    inboxRetryDelay,
+		slots:         make(chan struct{}, inboxMaxQueued),
+		loaded:        make(chan struct{}),
+		conversations: make(map[string][]inboxItem),
+		unhandled:     make(map[uint64]struct{}),
+		handled:       make(chan struct{}),
+	}
+}
+
+// push queues a message for its conversation's worker. It blocks while the queue is full.
+func (q *inboxQueue) push(ctx context.Context, entry *InboxEntry, content *signalpb.Content) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-q.ctx.Done():
+		return q.ctx.Err()
+	}
+	key := inboxConversationKey(entry.SenderACI, content)
+	barrier := inboxIsBarrier(content)
+	if barrier {
+		key = inboxBarrierKey
+	}
+	q.lock.Lock()
+	q.lastSeq++
+	item := inboxItem{entry: entry, content: content, seq: q.lastSeq, barrier: barrier}
+	q.unhandled[item.seq] = struct{}{}
+	pending, running := q.conversations[key]
+	q.conversations[key] = append(pending, item)
+	q.lock.Unlock()
+	if !running {
+		go q.work(key)
+	}
+	return nil
+}
+
+// pushReceived queues a message that was just received. Messages left over from before are queued first
+// to keep the order of messages within conversations.
+func (q *inboxQueue) pushReceived(ctx context.Context, entry *InboxEntry, content *signalpb.Content) error {
+	select {
+	case <-q.loaded:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-q.ctx.Done():
+		return q.ctx.Err()
+	}
+	return q.push(ctx, entry, content)
+}
+
+// work handles the messages of one conversation until there are none left.
+func (q *inboxQueue) work(key string) {
+	for {
+		q.lock.Lock()
+		pending := q.conversations[key]
+		if len(pending) == 0 || q.ctx.Err() != nil {
+			delete(q.conversations, key)
+			q.lock.Unlock()
+			// Anything that wasn't handled stays in the inbox for the next time the queue is loaded
+			for _, item := range pending {
+				q.done(item)
+			}
+			return
+		}
+		item := pending[0]
+		// The key stays in the map while the message is handled, so that new messages are added to this worker
+		q.conversations[key] = pending[1:]
+		q.lock.Unlock()
+
+		if !item.barrier || q.waitForEarlier(item.seq) {
+			for attempt := 1; q.handle(q.ctx, item.entry, item.content); attempt++ {
+				// The message stays unhandled while waiting, so barriers queued after it keep waiting too
+				if !q.waitRetry(attempt) {
+					// If the queue was stopped, the message is still in the inbox and will be handled after reconnecting
+					break
+				}
+			}
+		}
+		q.done(item)
+	}
+}
+
+// waitRetry waits before the given retry of a failed message. Returns false if the queue was stopped while waiting.
+func (q *inboxQueue) waitRetry(attempt int) bool {
+	timer := time.NewTimer(inboxRetryBackoff(q.retryDelay, attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-q.ctx.Done():
+		return false
+	}
+}
+
+// inboxRetryBackoff returns how long to wait before retrying a message that has failed the given number of times.
+func inboxRetryBackoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < inboxMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > inboxMaxRetryDelay {
+		delay = inboxMaxRetryDelay
+	}
+	return delay
+}
+
+// done frees the slot of a message that was handled or dropped.
+func (q *inboxQueue) done(item inboxItem) {
+	q.lock.Lock()
+	delete(q.unhandled, item.seq)
+	close(q.handled)
+	q.handled = make(chan struct{})
+	q.lock.Unlock()
+	<-q.slots
+}
+
+// waitForEarlier waits until every message queued before the given sequence number has been handled.
+// Returns false if the queue was stopped while waiting.
+func (q *inboxQueue) waitForEarlier(seq uint64) bool {
+	for {
+		q.lock.Lock()
+		waiting := false
+		for unhandledSeq := range q.unhandled {
+			if unhandledSeq < seq {
+				waiting = true
+				break
+			}
+		}
+		handled := q.handled
+		q.lock.Unlock()
+		if !waiting {
+			return true
+		}
+		select {
+		case <-handled:
+		case <-q.ctx.Done():
+			return false
+		}
+	}
+}
+
+// inboxBarrierKey is the conversation key used for all barrier messages, see inboxIsBarrier.
+const inboxBarrierKey = "barrier"
+
+// inboxIsBarrier returns true for content that refers to messages in other conversations,
+// like receipts and read syncs. The messages they refer to must be handled before them,
+// otherwise e.g. a read sync for a message that hasn't been bridged yet would be lost.
+func inboxIsBarrier(content *signalpb.Content) bool {
+	return content.GetReceiptMessage() != nil ||
+		len(content.GetSyncMessage().GetRead()) > 0 ||
+		len(content.GetSyncMessage().GetViewed()) > 0
+}
+
+// inboxConversationKey returns the conversation a message belongs to. Messages with the same key
+// are handled in order, messages with different keys may be handled in any order.
+func inboxConversationKey(senderACI string, content *signalpb.Content) string {
+	dataMessage := content.GetDataMessage()
+	if dataMessage == nil {
+		dataMessage = content.GetEditMessage().GetDataMessage()
+	}
+	if sent := content.GetSyncMessage().GetSent(); sent != nil {
+		dataMessage = sent.GetMessage()
+		if dataMessage == nil {
+			dataMessage = sent.GetEditMessage().GetDataMessage()
+		}
+		if dataMessage.GetGroupV2() == nil && sent.GetDestinationServiceId() != "" {
+			return "user:" + sent.GetDestinationServiceId()
+		}
+	}
+	if masterKey := dataMessage.GetGroupV2().GetMasterKey(); masterKey != nil {
+		return "group:" + base64.StdEncoding.EncodeToString(masterKey)
+	} else if masterKey = content.GetStoryMessage().GetGroup().GetMasterKey(); masterKey != nil {
+		return "group:" + base64.StdEncoding.EncodeToString(masterKey)
+	}
+	return "user:" + senderACI
+}
+
+// loadInbox queues the messages that were saved in the inbox before receivedBefore, i.e. the ones
+// left over from before a restart or reconnect. Newer messages are queued as they're received.
+func (d *Device) loadInbox(q *inboxQueue, receivedBefore time.Time) {
+	defer close(q.loaded)
+	log := d.log().With().Str("action", "load inbox").Logger()
+	ctx := log.WithContext(q.ctx)
+	if err := d.InboxStore.DeleteProcessedInboxEntries(ctx, time.Now().Add(-inboxRetention)); err != nil {
+		log.Err(err).Msg("Failed to delete old inbox entries")
+	}
+	receivedBefore = receivedBefore.Truncate(time.Microsecond)
+	var after *InboxEntry
+	for ctx.Err() == nil {
+		entries, err := d.InboxStore.GetPendingInboxEntries(ctx, after, inboxBatchSize)
+		if err != nil {
+			log.Err(err).Msg("Failed to get pending inbox entries, retrying")
+			select {
+			case <-ctx.Done():
+			case <-time.After(inboxRetryDelay):
+			}
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.ReceivedAt.Before(receivedBefore) {
+				return
+			} else if err = d.queueInboxEntry(ctx, q, entry); err != nil {
+				return
+			}
+		}
+		if len(entries) < inboxBatchSize {
+			return
+		}
+		after = entries[len(entries)-1]
+	}
+}
+
+// queueInboxEntry queues a message that has been saved in the inbox to be handled.
+func (d *Device) queueInboxEntry(ctx context.Context, q *inboxQueue, entry *InboxEntry) error {
+	var content signalpb.Content
+	if err := proto.Unmarshal(entry.Content, &content); err != nil {
+		d.log().Err(err).
+			Str("sender_aci", entry.SenderACI).
+			Uint64("timestamp", entry.Timestamp).
+			Msg("Failed to unmarshal inbox entry, dropping it")
+		return d.InboxStore.MarkInboxEntryProcessed(ctx, entry)
+	}
+	return q.push(ctx, entry, &content)
+}
+
+// processInboxEntry handles a message from the inbox. If handling fails, it's retried a few times
+// before giving up, see inboxQueue.work.
+func (d *Device) processInboxEntry(ctx context.Context, entry *InboxEntry, content *signalpb.Content) (retry bool) {
+	log := d.log().With().
+		Str("sender_aci", entry.SenderACI).
+		Int("sender_device", entry.SenderDevice).
+		Uint64("timestamp", entry.Timestamp).
+		Logger()
+	if entry.dispatch == nil {
+		entry.dispatch = &contentDispatch{}
+	}
+	err := d.handleDecryptedContent(ctx, entry.SenderACI, content, entry.dispatch)
+	if err != nil && ctx.Err() != nil {
+		// Stopping doesn't count as a failure, the message will be handled after reconnecting
+		return false
+	} else if err != nil {
+		entry.Attempts++
+		if entry.Attempts < inboxMaxAttempts {
+			log.Warn().Err(err).Int("attempt", entry.Attempts).Msg("Failed to handle message, will retry")
+			if err = d.InboxStore.UpdateInboxEntryAttempts(ctx, entry); err != nil {
+				log.Err(err).Msg("Failed to update inbox entry")
+			}
+			return true
+		}
+		log.Err(err).Int("attempt", entry.Attempts).Msg("Failed to handle message, giving up")
+	}
+	if err = d.InboxStore.MarkInboxEntryProcessed(ctx, entry); err != nil {
+		log.Err(err).Msg("Failed to mark inbox entry as processed")
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+)
+
+var _ InboxStore = (*SQLStore)(nil)
+
+// InboxStore holds decrypted messages between acknowledging them to the server and handling them,
+// so that they aren't lost if handling fails or the process exits in between.
+type InboxStore interface {
+	// PutInboxEntry saves a decrypted message. If a message with the same sender, device and timestamp
+	// has already been saved, nothing is changed and false is returned.
+	PutInboxEntry(ctx context.Context, entry *InboxEntry) (bool, error)
+	// GetPendingInboxEntries returns messages that haven't been handled yet in the order they were received.
+	// If after is set, only messages received after it are returned.
+	GetPendingInboxEntries(ctx context.Context, after *InboxEntry, limit int) ([]*InboxEntry, error)
+	UpdateInboxEntryAttempts(ctx context.Context, entry *InboxEntry) error
+	// MarkInboxEntryProcessed clears the content of a handled message.
+	// The entry itself is kept until DeleteProcessedInboxEntries to detect replays.
+	MarkInboxEntryProcessed(ctx context.Context, entry *InboxEntry) error
+	DeleteProcessedInboxEntries(ctx context.Context, receivedBefore time.Time) error
+}
+
+// InboxEntry is a decrypted message waiting to be handled.
+type InboxEntry struct {
+	SenderACI    string
+	SenderDevice int
+	// Timestamp is the envelope timestamp, which identifies the message together with the sender and device
+	Timestamp uint64
+	// Content is a serialized signalpb.Content
+	Content    []byte
+	ReceivedAt time.Time
+	Attempts   int
+
+	// dispatch keeps the progress of handling the entry between retries
+	dispatch *contentDispatch
+}
+
+const (
+	putInboxEntryQuery = `
+		INSERT INTO signalmeow_inbox (our_aci_uuid, sender_aci, timestamp, sender_device, content, received_ts)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (our_aci_uuid, sender_aci, sender_device, timestamp) DO NOTHING
+	`
+	getPendingInboxEntriesQuery = `
+		SELECT sender_aci, timestamp, sender_device, content, received_ts, attempts
+		FROM signalmeow_inbox WHERE our_aci_uuid=$1 AND processed=false
+		ORDER BY received_ts, timestamp, sender_aci, sender_device
+		LIMIT $2
+	`
+	getPendingInboxEntriesAfterQuery = `
+		SELECT sender_aci, timestamp, sender_device, content, received_ts, attempts
+		FROM signalmeow_inbox
+		WHERE our_aci_uuid=$1 AND processed=false
+			AND (received_ts>$3 OR (received_ts=$3 AND (timestamp>$4 OR (timestamp=$4 AND
+				(sender_aci>$5 OR (sender_aci=$5 AND sender_device>$6))))))
+		ORDER BY received_ts, timestamp, sender_aci, sender_device
+		LIMIT $2
+	`
+	updateInboxEntryAttemptsQuery = `
+		UPDATE signalmeow_inbox SET attempts=$5
+		WHERE our_aci_uuid=$1 AND sender_aci=$2 AND sender_device=$3 AND timestamp=$4
+	`
+	markInboxEntryProcessedQuery = `
+		UPDATE signalmeow_inbox SET processed=true, content=NULL
+		WHERE our_aci_uuid=$1 AND sender_aci=$2 AND sender_device=$3 AND timestamp=$4
+	`
+	deleteProcessedInboxEntriesQuery = `DELETE FROM signalmeow_inbox WHERE our_aci_uuid=$1 AND processed=true AND received_ts<$2`
+)
+
+func (s *SQLStore) PutInboxEntry(ctx context.Context, entry *InboxEntry) (bool, error) {
+	res, err := s.db.ExecContext(ctx, putInboxEntryQuery,
+		s.AciUuid, entry.SenderACI, int64(entry.Timestamp), entry.SenderDevice, entry.Content, entry.ReceivedAt.UnixMicro(),
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *SQLStore) GetPendingInboxEntries(ctx context.Context, after *InboxEntry, limit int) ([]*InboxEntry, error) {
+	var rows dbutil.Rows
+	var err error
+	if after == nil {
+		rows, err = s.db.QueryContext(ctx, getPendingInboxEntriesQuery, s.AciUuid, limit)
+	} else {
+		rows, err = s.db.QueryContext(ctx, getPendingInboxEntriesAfterQuery,
+			s.AciUuid, limit, after.ReceivedAt.UnixMicro(), int64(after.Timestamp), after.SenderACI, after.SenderDevice,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*InboxEntry
+	for rows.Next() {
+		var entry InboxEntry
+		var timestamp, receivedAt int64
+		err = rows.Scan(&entry.SenderACI, &timestamp, &entry.SenderDevice, &entry.Content, &receivedAt, &entry.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		entry.Timestamp = uint64(timestamp)
+		entry.ReceivedAt = time.UnixMicro(receivedAt)
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLStore) UpdateInboxEntryAttempts(ctx context.Context, entry *InboxEntry) error {
+	_, err := s.db.ExecContext(ctx, updateInboxEntryAttemptsQuery,
+		s.AciUuid, entry.SenderACI, entry.SenderDevice, int64(entry.Timestamp), entry.Attempts,
+	)
+	return err
+}
+
+func (s *SQLStore) MarkInboxEntryProcessed(ctx context.Context, entry *InboxEntry) error {
+	_, err := s.db.ExecContext(ctx, markInboxEntryProcessedQuery, s.AciUuid, entry.SenderACI, entry.SenderDevice, int64(entry.Timestamp))
+	return err
+}
+
+func (s *SQLStore) DeleteProcessedInboxEntries(ctx context.Context, receivedBefore time.Time) error {
+	_, err := s.db.ExecContext(ctx, deleteProcessedInboxEntriesQuery, s.AciUuid, receivedBefore.UnixMicro())
+	return err
+}
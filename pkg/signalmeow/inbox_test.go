@@ -0,0 +1,305 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func TestInboxConversationKey(t *testing.T) {
+	masterKey := []byte("master key")
+	groupMessage := &signalpb.DataMessage{GroupV2: &signalpb.GroupContextV2{MasterKey: masterKey}}
+
+	assert.Equal(t, "user:alice", inboxConversationKey("alice", &signalpb.Content{
+		DataMessage: &signalpb.DataMessage{Body: proto.String("hi")},
+	}))
+	groupKey := inboxConversationKey("alice", &signalpb.Content{DataMessage: groupMessage})
+	assert.Equal(t, groupKey, inboxConversationKey("bob", &signalpb.Content{
+		EditMessage: &signalpb.EditMessage{DataMessage: groupMessage},
+	}))
+	assert.Equal(t, groupKey, inboxConversationKey("me", &signalpb.Content{
+		SyncMessage: &signalpb.SyncMessage{Sent: &signalpb.SyncMessage_Sent{Message: groupMessage}},
+	}))
+	assert.Equal(t, "user:bob", inboxConversationKey("me", &signalpb.Content{
+		SyncMessage: &signalpb.SyncMessage{Sent: &signalpb.SyncMessage_Sent{
+			DestinationServiceId: proto.String("bob"),
+			Message:              &signalpb.DataMessage{Body: proto.String("hi")},
+		}},
+	}))
+	assert.Equal(t, "user:me", inboxConversationKey("me", &signalpb.Content{
+		SyncMessage: &signalpb.SyncMessage{Contacts: &signalpb.SyncMessage_Contacts{}},
+	}))
+}
+
+func TestInboxQueueOrderPerConversation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lock sync.Mutex
+	handled := make(map[string][]uint64)
+	var wg sync.WaitGroup
+	q := newInboxQueue(ctx, func(ctx context.Context, entry *InboxEntry, content *signalpb.Content) bool {
+		defer wg.Done()
+		lock.Lock()
+		handled[entry.SenderACI] = append(handled[entry.SenderACI], entry.Timestamp)
+		lock.Unlock()
+		return false
+	})
+	close(q.loaded)
+
+	var expected []uint64
+	for ts := uint64(1); ts <= 100; ts++ {
+		expected = append(expected, ts)
+		for _, sender := range []string{"alice", "bob", "carol"} {
+			wg.Add(1)
+			require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: sender, Timestamp: ts}, &signalpb.Content{}))
+		}
+	}
+	wg.Wait()
+	for _, sender := range []string{"alice", "bob", "carol"} {
+		assert.Equal(t, expected, handled[sender], sender)
+	}
+}
+
+func TestInboxQueueSlowConversationDoesNotBlockOthers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unblock := make(chan struct{})
+	fastHandled := make(chan struct{})
+	q := newInboxQueue(ctx, func(ctx context.Context, entry *InboxEntry, content *signalpb.Content) bool {
+		if entry.SenderACI == "slow" {
+			<-unblock
+		} else {
+			close(fastHandled)
+		}
+		return false
+	})
+	close(q.loaded)
+
+	require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: "slow", Timestamp: 1}, &signalpb.Content{}))
+	require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: "fast", Timestamp: 2}, &signalpb.Content{}))
+	select {
+	case <-fastHandled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message in another conversation wasn't handled while the first one was blocked")
+	}
+	close(unblock)
+}
+
+func TestInboxQueueBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unblock := make(chan struct{})
+	q := newInboxQueue(ctx, func(ctx context.Context, entry *InboxEntry, content *signalpb.Content) bool {
+		<-unblock
+		return false
+	})
+	close(q.loaded)
+
+	for i := 0; i < inboxMaxQueued; i++ {
+		require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: "alice", Timestamp: uint64(i)}, &signalpb.Content{}))
+	}
+	pushCtx, pushCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer pushCancel()
+	err := q.pushReceived(pushCtx, &InboxEntry{SenderACI: "bob", Timestamp: 1}, &signalpb.Content{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(unblock)
+	require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: "bob", Timestamp: 1}, &signalpb.Content{}))
+}
+
+func TestInboxQueueWaitsForLoad(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := newInboxQueue(ctx, func(ctx context.Context, entry *InboxEntry, content *signalpb.Content) bool { return false })
+	pushCtx, pushCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer pushCancel()
+	err := q.pushReceived(pushCtx, &InboxEntry{SenderACI: "alice", Timestamp: 1}, &signalpb.Content{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestInboxQueueReceiptWaitsForEarlierMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unblock := make(chan struct{})
+	var lock sync.Mutex
+	var handled []string
+	receiptHandled := make(chan struct{})
+	q := newInboxQueue(ctx, func(ctx context.Context, entry *InboxEntry, content *signalpb.Content) bool {
+		if entry.SenderACI == "alice" {
+			<-unblock
+		}
+		lock.Lock()
+		handled = append(handled, entry.SenderACI)
+		lock.Unlock()
+		if content.GetReceiptMessage() != nil {
+			close(receiptHandled)
+		}
+		return false
+	})
+	close(q.loaded)
+
+	require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: "alice", Timestamp: 1}, &signalpb.Content{
+		DataMessage: &signalpb.DataMessage{Body: proto.String("hi")},
+	}))
+	require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: "me", Timestamp: 2}, &signalpb.Content{
+		ReceiptMessage: &signalpb.ReceiptMessage{Type: signalpb.ReceiptMessage_READ.Enum(), Timestamp: []uint64{1}},
+	}))
+	select {
+	case <-receiptHandled:
+		t.Fatal("receipt was handled before the message it refers to")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(unblock)
+	select {
+	case <-receiptHandled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receipt wasn't handled after the earlier message")
+	}
+	lock.Lock()
+	assert.Equal(t, []string{"alice", "me"}, handled)
+	lock.Unlock()
+}
+
+func TestInboxQueueRetryKeepsOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lock sync.Mutex
+	var handled []uint64
+	failures := 2
+	allHandled := make(chan struct{})
+	q := newInboxQueue(ctx, func(ctx context.Context, entry *InboxEntry, content *signalpb.Content) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		if entry.Timestamp == 1 && failures > 0 {
+			failures--
+			return true
+		}
+		handled = append(handled, entry.Timestamp)
+		if len(handled) == 4 {
+			close(allHandled)
+		}
+		return false
+	})
+	q.retryDelay = 20 * time.Millisecond
+	close(q.loaded)
+
+	for ts := uint64(1); ts <= 3; ts++ {
+		require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: "alice", Timestamp: ts}, &signalpb.Content{}))
+	}
+	require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: "me", Timestamp: 4}, &signalpb.Content{
+		ReceiptMessage: &signalpb.ReceiptMessage{Type: signalpb.ReceiptMessage_READ.Enum(), Timestamp: []uint64{1}},
+	}))
+	select {
+	case <-allHandled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed message wasn't retried")
+	}
+	lock.Lock()
+	assert.Equal(t, []uint64{1, 2, 3, 4}, handled, "the failed message must be retried before later messages and receipts")
+	assert.Equal(t, 0, failures)
+	lock.Unlock()
+}
+
+func TestInboxQueueStopWhileWaitingForRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := make(chan struct{}, 10)
+	q := newInboxQueue(ctx, func(ctx context.Context, entry *InboxEntry, content *signalpb.Content) bool {
+		attempts <- struct{}{}
+		return true
+	})
+	q.retryDelay = time.Hour
+	close(q.loaded)
+
+	require.NoError(t, q.pushReceived(ctx, &InboxEntry{SenderACI: "alice", Timestamp: 1}, &signalpb.Content{}))
+	<-attempts
+	cancel()
+	// The slot of the message is freed, so the worker has stopped
+	require.Eventually(t, func() bool { return len(q.slots) == 0 }, 5*time.Second, 5*time.Millisecond)
+	assert.Len(t, attempts, 0)
+}
+
+func TestInboxRetryBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, inboxRetryBackoff(30*time.Second, 1))
+	assert.Equal(t, 60*time.Second, inboxRetryBackoff(30*time.Second, 2))
+	assert.Equal(t, 4*time.Minute, inboxRetryBackoff(30*time.Second, 4))
+	assert.Equal(t, inboxMaxRetryDelay, inboxRetryBackoff(30*time.Second, 5))
+	assert.Equal(t, inboxMaxRetryDelay, inboxRetryBackoff(30*time.Second, 100))
+	assert.Equal(t, inboxMaxRetryDelay, inboxRetryBackoff(time.Hour, 1))
+}
+
+func TestInboxIsBarrier(t *testing.T) {
+	assert.True(t, inboxIsBarrier(&signalpb.Content{ReceiptMessage: &signalpb.ReceiptMessage{}}))
+	assert.True(t, inboxIsBarrier(&signalpb.Content{SyncMessage: &signalpb.SyncMessage{
+		Read: []*signalpb.SyncMessage_Read{{Timestamp: proto.Uint64(1)}},
+	}}))
+	assert.False(t, inboxIsBarrier(&signalpb.Content{DataMessage: &signalpb.DataMessage{Body: proto.String("hi")}}))
+}
+
+func TestInboxStoreSenderDevice(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLStore(t)
+	receivedAt := time.UnixMilli(1700000000000)
+	newEntry := func(device int) *InboxEntry {
+		return &InboxEntry{SenderACI: "bob", SenderDevice: device, Timestamp: 1000, Content: []byte("content"), ReceivedAt: receivedAt}
+	}
+
+	// Different devices of the same user can send messages with the same timestamp
+	for _, device := range []int{2, 1} {
+		inserted, err := store.PutInboxEntry(ctx, newEntry(device))
+		require.NoError(t, err)
+		assert.True(t, inserted, device)
+	}
+	inserted, err := store.PutInboxEntry(ctx, newEntry(1))
+	require.NoError(t, err)
+	assert.False(t, inserted, "replayed message must be ignored")
+
+	entries, err := store.GetPendingInboxEntries(ctx, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 1, entries[0].SenderDevice)
+	assert.Equal(t, 2, entries[1].SenderDevice)
+	entries, err = store.GetPendingInboxEntries(ctx, entries[0], 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, 2, entries[0].SenderDevice)
+
+	failed := newEntry(2)
+	failed.Attempts = 3
+	require.NoError(t, store.UpdateInboxEntryAttempts(ctx, failed))
+	require.NoError(t, store.MarkInboxEntryProcessed(ctx, newEntry(1)))
+	entries, err = store.GetPendingInboxEntries(ctx, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, 2, entries[0].SenderDevice)
+	assert.Equal(t, 3, entries[0].Attempts)
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
@@ -34,7 +35,7 @@ type GeneratedPreKeys struct {
 	IdentityKey  []uint8
 }
 
-func GenerateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
+func generateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
 	var identityKeyPair *libsignalgo.IdentityKeyPair
 	if uuidKind == UUID_KIND_PNI {
 		identityKeyPair = device.Data.PniIdentityKeyPair
@@ -45,12 +46,12 @@ func GenerateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
 	// Generate prekeys
 	nextPreKeyId, err := device.PreKeyStoreExtras.GetNextPreKeyID(uuidKind)
 	if err != nil {
-		zlog.Err(err).Msg("Error getting next prekey id")
+		device.log().Err(err).Msg("Error getting next prekey id")
 		return err
 	}
 	nextKyberPreKeyId, err := device.PreKeyStoreExtras.GetNextKyberPreKeyID(uuidKind)
 	if err != nil {
-		zlog.Err(err).Msg("Error getting next kyber prekey id")
+		device.log().Err(err).Msg("Error getting next kyber prekey id")
 		return err
 	}
 	preKeys := GeneratePreKeys(nextPreKeyId, 100, uuidKind)
@@ -67,7 +68,7 @@ func GenerateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
 	// Register prekeys
 	identityKey, err := identityKeyPair.GetPublicKey().Serialize()
 	if err != nil {
-		zlog.Err(err).Msg("Error serializing identity key")
+		device.log().Err(err).Msg("Error serializing identity key")
 		return err
 	}
 	generatedPreKeys := GeneratedPreKeys{
@@ -80,9 +81,9 @@ func GenerateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
 		preKeyUsername = device.Data.AciUuid
 	}
 	preKeyUsername = preKeyUsername + "." + fmt.Sprint(device.Data.DeviceId)
-	err = RegisterPreKeys(&generatedPreKeys, uuidKind, preKeyUsername, device.Data.Password)
+	err = registerPreKeys(device.web(), &generatedPreKeys, uuidKind, preKeyUsername, device.Data.Password)
 	if err != nil {
-		zlog.Err(err).Msg("RegisterPreKeys error")
+		device.log().Err(err).Msg("registerPreKeys error")
 		return err
 	}
 
@@ -92,7 +93,7 @@ func GenerateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
 	err = device.PreKeyStoreExtras.MarkPreKeysAsUploaded(uuidKind, lastPreKeyId)
 
 	if err != nil {
-		zlog.Err(err).Msg("Error marking prekeys as uploaded")
+		device.log().Err(err).Msg("Error marking prekeys as uploaded")
 	}
 
 	return err
@@ -103,13 +104,11 @@ func GeneratePreKeys(startKeyId uint, count uint, uuidKind UUIDKind) *[]libsigna
 	for i := startKeyId; i < startKeyId+count; i++ {
 		privateKey, err := libsignalgo.GeneratePrivateKey()
 		if err != nil {
-			zlog.Err(err).Msg("Error generating private key")
-			panic(err)
+			panic(fmt.Errorf("failed to generate private key: %w", err))
 		}
 		preKey, err := libsignalgo.NewPreKeyRecordFromPrivateKey(uint32(i), privateKey)
 		if err != nil {
-			zlog.Err(err).Msg("Error creating preKey record")
-			panic(err)
+			panic(fmt.Errorf("failed to create prekey record: %w", err))
 		}
 		generatedPreKeys = append(generatedPreKeys, *preKey)
 	}
@@ -121,28 +120,23 @@ func GenerateKyberPreKeys(startKeyId uint, count uint, uuidKind UUIDKind, identi
 	for i := startKeyId; i < startKeyId+count; i++ {
 		kyberPreKeyPair, err := libsignalgo.KyberKeyPairGenerate()
 		if err != nil {
-			zlog.Err(err).Msg("Error generating kyber key pair")
-			panic(err)
+			panic(fmt.Errorf("failed to generate kyber key pair: %w", err))
 		}
 		publicKey, err := kyberPreKeyPair.GetPublicKey()
 		if err != nil {
-			zlog.Err(err).Msg("Error getting kyber public key")
-			panic(err)
+			panic(fmt.Errorf("failed to get kyber public key: %w", err))
 		}
 		serializedPublicKey, err := publicKey.Serialize()
 		if err != nil {
-			zlog.Err(err).Msg("Error serializing kyber public key")
-			panic(err)
+			panic(fmt.Errorf("failed to serialize kyber public key: %w", err))
 		}
 		signature, err := identityKeyPair.GetPrivateKey().Sign(serializedPublicKey)
 		if err != nil {
-			zlog.Err(err).Msg("Error signing kyber public key")
-			panic(err)
+			panic(fmt.Errorf("failed to sign kyber public key: %w", err))
 		}
 		preKey, err := libsignalgo.NewKyberPreKeyRecord(uint32(i), time.Now(), kyberPreKeyPair, signature)
 		if err != nil {
-			zlog.Err(err).Msg("Error creating kyber preKey record")
-			panic(err)
+			panic(fmt.Errorf("failed to create kyber prekey record: %w", err))
 
 		}
 		generatedKyberPreKeys = append(generatedKyberPreKeys, *preKey)
@@ -154,42 +148,37 @@ func GenerateSignedPreKey(startSignedKeyId uint32, uuidKind UUIDKind, identityKe
 	// Generate a signed prekey
 	privateKey, err := libsignalgo.GeneratePrivateKey()
 	if err != nil {
-		zlog.Err(err).Msg("Error generating private key")
-		panic(err)
+		panic(fmt.Errorf("failed to generate private key: %w", err))
 	}
 	timestamp := time.Now()
 	publicKey, err := privateKey.GetPublicKey()
 	if err != nil {
-		zlog.Err(err).Msg("Error getting public key")
-		panic(err)
+		panic(fmt.Errorf("failed to get public key: %w", err))
 	}
 	serializedPublicKey, err := publicKey.Serialize()
 	if err != nil {
-		zlog.Err(err).Msg("Error serializing public key")
-		panic(err)
+		panic(fmt.Errorf("failed to serialize public key: %w", err))
 	}
 	signature, err := identityKeyPair.GetPrivateKey().Sign(serializedPublicKey)
 	if err != nil {
-		zlog.Err(err).Msg("Error signing public key")
-		panic(err)
+		panic(fmt.Errorf("failed to sign public key: %w", err))
 	}
 	signedPreKey, err := libsignalgo.NewSignedPreKeyRecordFromPrivateKey(startSignedKeyId, timestamp, privateKey, signature)
 	if err != nil {
-		zlog.Err(err).Msg("Error creating signed preKey record")
-		panic(err)
+		panic(fmt.Errorf("failed to create signed prekey record: %w", err))
 	}
 
 	return signedPreKey
 }
 
-func StoreSignedPreKey(device *Device, signedPreKey *libsignalgo.SignedPreKeyRecord, uuidKind UUIDKind) {
+func storeSignedPreKey(device *Device, signedPreKey *libsignalgo.SignedPreKeyRecord, uuidKind UUIDKind) {
 	// Note: marking as uploaded right now because we're about to upload as part of
 	// provisioning, and if provisioning fails, we'll just generate a new one
 	// Also we don't really use the uploaded for anything
 	device.PreKeyStoreExtras.SaveSignedPreKey(uuidKind, signedPreKey, true)
 }
 
-func StoreKyberLastResortPreKey(device *Device, kyberPreKey *libsignalgo.KyberPreKeyRecord, uuidKind UUIDKind) {
+func storeKyberLastResortPreKey(device *Device, kyberPreKey *libsignalgo.KyberPreKeyRecord, uuidKind UUIDKind) {
 	device.PreKeyStoreExtras.SaveKyberPreKey(uuidKind, kyberPreKey, true)
 }
 
@@ -230,7 +219,7 @@ func KyberPreKeyToJSON(kyberPreKey *libsignalgo.KyberPreKeyRecord) map[string]in
 	return kyberPreKeyJson
 }
 
-func RegisterPreKeys(generatedPreKeys *GeneratedPreKeys, uuidKind UUIDKind, username string, password string) error {
+func registerPreKeys(client *web.Client, generatedPreKeys *GeneratedPreKeys, uuidKind UUIDKind, username string, password string) error {
 	// Convert generated prekeys to JSON
 	preKeysJson := []map[string]interface{}{}
 	kyberPreKeysJson := []map[string]interface{}{}
@@ -254,25 +243,47 @@ func RegisterPreKeys(generatedPreKeys *GeneratedPreKeys, uuidKind UUIDKind, user
 	keysPath := "/v2/keys?identity=" + string(uuidKind)
 	jsonBytes, err := json.Marshal(register_json)
 	if err != nil {
-		zlog.Err(err).Msg("Error marshalling register JSON")
-		return err
+		return fmt.Errorf("failed to marshal register JSON: %w", err)
 	}
 	opts := &web.HTTPReqOpt{Body: jsonBytes, Username: &username, Password: &password}
-	resp, err := web.SendHTTPRequest("PUT", keysPath, opts)
+	resp, err := client.SendHTTPRequest("PUT", keysPath, opts)
 	if err != nil {
-		zlog.Err(err).Msg("Error sending request")
-		return err
+		return fmt.Errorf("failed to send request: %w", err)
 	}
 	// status code not 2xx
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		err := fmt.Errorf("Error registering prekeys: %v", resp.Status)
-		zlog.Err(err).Msg("Error registering prekeys")
-		return err
+		return fmt.Errorf("error registering prekeys: %v", resp.Status)
 	}
 	defer resp.Body.Close()
 	return err
 }
 
+// preKeyCountCheckInterval is how often checkPreKeyCount is called while connected.
+const preKeyCountCheckInterval = time.Hour
+
+// checkPreKeyCount asks the server how many one-time prekeys are left for the given identity
+// and reports them to the metrics hook.
+func checkPreKeyCount(device *Device, uuidKind UUIDKind) error {
+	username, password := device.Data.BasicAuthCreds()
+	resp, err := device.web().SendHTTPRequest(http.MethodGet, "/v2/keys?identity="+string(uuidKind), &web.HTTPReqOpt{
+		Username: &username,
+		Password: &password,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send prekey count request: %w", err)
+	}
+	var respData struct {
+		Count   int `json:"count"`
+		PQCount int `json:"pqCount"`
+	}
+	err = web.DecodeHTTPResponseBody(&respData, resp)
+	if err != nil {
+		return fmt.Errorf("failed to decode prekey count: %w", err)
+	}
+	device.metrics().PreKeysRemaining(device.Data.AciUuid, uuidKind, respData.Count, respData.PQCount)
+	return nil
+}
+
 type prekeyResponse struct {
 	IdentityKey string         `json:"identityKey"`
 	Devices     []prekeyDevice `json:"devices"`
@@ -300,7 +311,7 @@ func addBase64PaddingAndDecode(data string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(data)
 }
 
-func FetchAndProcessPreKey(ctx context.Context, device *Device, theirUuid string, specificDeviceID int) error {
+func fetchAndProcessPreKey(ctx context.Context, device *Device, theirUuid string, specificDeviceID int) error {
 	// Fetch prekey
 	deviceIDPath := "/*"
 	if specificDeviceID >= 0 {
@@ -308,27 +319,27 @@ func FetchAndProcessPreKey(ctx context.Context, device *Device, theirUuid string
 	}
 	path := "/v2/keys/" + theirUuid + deviceIDPath + "?pq=true"
 	username, password := device.Data.BasicAuthCreds()
-	resp, err := web.SendHTTPRequest("GET", path, &web.HTTPReqOpt{Username: &username, Password: &password})
+	resp, err := device.web().SendHTTPRequest("GET", path, &web.HTTPReqOpt{Username: &username, Password: &password})
 	if err != nil {
-		zlog.Err(err).Msg("Error sending request")
+		device.log().Err(err).Msg("Error sending request")
 		return err
 	}
 	var prekeyResponse prekeyResponse
 	err = web.DecodeHTTPResponseBody(&prekeyResponse, resp)
 	if err != nil {
-		zlog.Err(err).Msg("Fetching prekeys, error with response body")
+		device.log().Err(err).Msg("Fetching prekeys, error with response body")
 		return err
 	}
 
 	rawIdentityKey, err := addBase64PaddingAndDecode(prekeyResponse.IdentityKey)
 	identityKey, err := libsignalgo.DeserializeIdentityKey([]byte(rawIdentityKey))
 	if err != nil {
-		zlog.Err(err).Msg("Error deserializing identity key")
+		device.log().Err(err).Msg("Error deserializing identity key")
 		return err
 	}
 	if identityKey == nil {
 		err := fmt.Errorf("Deserializing identity key returned nil with no error")
-		zlog.Err(err).Msg("")
+		device.log().Err(err).Msg("")
 		return err
 	}
 
@@ -340,24 +351,24 @@ func FetchAndProcessPreKey(ctx context.Context, device *Device, theirUuid string
 			preKeyId = uint32(d.PreKey.KeyID)
 			rawPublicKey, err := addBase64PaddingAndDecode(d.PreKey.PublicKey)
 			if err != nil {
-				zlog.Err(err).Msg("Error decoding public key")
+				device.log().Err(err).Msg("Error decoding public key")
 				return err
 			}
 			publicKey, err = libsignalgo.DeserializePublicKey(rawPublicKey)
 			if err != nil {
-				zlog.Err(err).Msg("Error deserializing public key")
+				device.log().Err(err).Msg("Error deserializing public key")
 				return err
 			}
 		}
 
 		rawSignedPublicKey, err := addBase64PaddingAndDecode(d.SignedPreKey.PublicKey)
 		if err != nil {
-			zlog.Err(err).Msg("Error decoding signed public key")
+			device.log().Err(err).Msg("Error decoding signed public key")
 			return err
 		}
 		signedPublicKey, err := libsignalgo.DeserializePublicKey(rawSignedPublicKey)
 		if err != nil {
-			zlog.Err(err).Msg("Error deserializing signed public key")
+			device.log().Err(err).Msg("Error deserializing signed public key")
 			return err
 		}
 
@@ -368,12 +379,12 @@ func FetchAndProcessPreKey(ctx context.Context, device *Device, theirUuid string
 			kyberPreKeyId = uint32(d.PQPreKey.KeyID)
 			rawKyberPublicKey, err := addBase64PaddingAndDecode(d.PQPreKey.PublicKey)
 			if err != nil {
-				zlog.Err(err).Msg("Error decoding kyber public key")
+				device.log().Err(err).Msg("Error decoding kyber public key")
 				return err
 			}
 			kyberPublicKey, err = libsignalgo.DeserializeKyberPublicKey(rawKyberPublicKey)
 			if err != nil {
-				zlog.Err(err).Msg("Error deserializing kyber public key")
+				device.log().Err(err).Msg("Error deserializing kyber public key")
 				return err
 			}
 			kyberPreKeySignature, err = addBase64PaddingAndDecode(d.PQPreKey.Signature)
@@ -381,7 +392,7 @@ func FetchAndProcessPreKey(ctx context.Context, device *Device, theirUuid string
 
 		rawSignature, err := addBase64PaddingAndDecode(d.SignedPreKey.Signature)
 		if err != nil {
-			zlog.Err(err).Msg("Error decoding signature")
+			device.log().Err(err).Msg("Error decoding signature")
 			return err
 		}
 
@@ -399,12 +410,12 @@ func FetchAndProcessPreKey(ctx context.Context, device *Device, theirUuid string
 			identityKey,
 		)
 		if err != nil {
-			zlog.Err(err).Msg("Error creating prekey bundle")
+			device.log().Err(err).Msg("Error creating prekey bundle")
 			return err
 		}
 		address, err := libsignalgo.NewAddress(theirUuid, uint(d.DeviceID))
 		if err != nil {
-			zlog.Err(err).Msg("Error creating address")
+			device.log().Err(err).Msg("Error creating address")
 			return err
 		}
 		err = libsignalgo.ProcessPreKeyBundle(
@@ -416,7 +427,7 @@ func FetchAndProcessPreKey(ctx context.Context, device *Device, theirUuid string
 		)
 
 		if err != nil {
-			zlog.Err(err).Msg("Error processing prekey bundle")
+			device.log().Err(err).Msg("Error processing prekey bundle")
 			return err
 		}
 	}
@@ -0,0 +1,88 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+)
+
+var _ KnownDeviceStore = (*SQLStore)(nil)
+
+// KnownDeviceStore remembers which devices have been seen on our own account,
+// so that devices linked later can be reported even across restarts.
+type KnownDeviceStore interface {
+	// GetKnownDevices returns the IDs of the known devices. If none have been recorded yet, nil is returned.
+	GetKnownDevices(ctx context.Context) ([]int, error)
+	// PutKnownDevices adds devices to the known devices.
+	PutKnownDevices(ctx context.Context, deviceIDs []int) error
+	// ResetKnownDevices replaces all known devices with the given ones.
+	ResetKnownDevices(ctx context.Context, deviceIDs []int) error
+}
+
+const (
+	getKnownDevicesQuery   = `SELECT device_id FROM signalmeow_known_devices WHERE our_aci_uuid=$1`
+	putKnownDeviceQuery    = `INSERT INTO signalmeow_known_devices (our_aci_uuid, device_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	clearKnownDevicesQuery = `DELETE FROM signalmeow_known_devices WHERE our_aci_uuid=$1`
+)
+
+func (s *SQLStore) GetKnownDevices(ctx context.Context) ([]int, error) {
+	rows, err := s.db.QueryContext(ctx, getKnownDevicesQuery, s.AciUuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deviceIDs []int
+	for rows.Next() {
+		var deviceID int
+		if err = rows.Scan(&deviceID); err != nil {
+			return nil, err
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs, rows.Err()
+}
+
+func (s *SQLStore) PutKnownDevices(ctx context.Context, deviceIDs []int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, deviceID := range deviceIDs {
+		if _, err = tx.ExecContext(ctx, putKnownDeviceQuery, s.AciUuid, deviceID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) ResetKnownDevices(ctx context.Context, deviceIDs []int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, clearKnownDevicesQuery, s.AciUuid); err != nil {
+		return err
+	}
+	for _, deviceID := range deviceIDs {
+		if _, err = tx.ExecContext(ctx, putKnownDeviceQuery, s.AciUuid, deviceID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
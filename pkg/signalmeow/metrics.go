@@ -0,0 +1,83 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"errors"
+	"time"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// Metrics is a hook for measuring the Signal protocol layer, e.g. to export Prometheus metrics.
+// The methods are called synchronously, so they must not block.
+type Metrics interface {
+	web.Metrics
+
+	// DecryptedEnvelope is called for every incoming envelope that needed decrypting.
+	// errorClass is empty if decryption succeeded, see decryptionErrorClass for the possible values.
+	DecryptedEnvelope(envelopeType string, errorClass string)
+	// SentMessage is called for every message send request. status is 0 if the server didn't respond.
+	SentMessage(sealedSender bool, status int, duration time.Duration)
+	// SentGroupMessage is called with the number of recipients a group message was fanned out to.
+	SentGroupMessage(recipients int)
+	// PreKeysRemaining is called with the number of one-time prekeys left on the server for an identity of an account.
+	PreKeysRemaining(aciUUID string, uuidKind UUIDKind, ecCount, kyberCount int)
+}
+
+// NoopMetrics is a Metrics implementation that discards everything.
+type NoopMetrics struct {
+	web.NoopMetrics
+}
+
+func (NoopMetrics) DecryptedEnvelope(envelopeType string, errorClass string)                    {}
+func (NoopMetrics) SentMessage(sealedSender bool, status int, duration time.Duration)           {}
+func (NoopMetrics) SentGroupMessage(recipients int)                                             {}
+func (NoopMetrics) PreKeysRemaining(aciUUID string, uuidKind UUIDKind, ecCount, kyberCount int) {}
+
+// metrics returns the metrics hook of the client that owns the device.
+func (d *Device) metrics() Metrics {
+	if d == nil || d.Connection.metrics == nil {
+		return NoopMetrics{}
+	}
+	return d.Connection.metrics
+}
+
+// decryptionErrorClass groups decryption errors into a few classes that are useful as metric labels.
+func decryptionErrorClass(err error) string {
+	var signalErr *libsignalgo.SignalError
+	if err == nil {
+		return ""
+	} else if !errors.As(err, &signalErr) {
+		return "other"
+	}
+	switch signalErr.Code {
+	case libsignalgo.ErrorCodeDuplicatedMessage:
+		return "duplicate"
+	case libsignalgo.ErrorCodeSealedSenderSelfSend:
+		return "self_send"
+	case libsignalgo.ErrorCodeUntrustedIdentity:
+		return "untrusted_identity"
+	case libsignalgo.ErrorCodeSessionNotFound, libsignalgo.ErrorCodeInvalidSession, libsignalgo.ErrorCodeInvalidSenderKeySession:
+		return "no_session"
+	case libsignalgo.ErrorCodeInvalidMessage, libsignalgo.ErrorCodeInvalidKeyIdentifier:
+		return "invalid_message"
+	default:
+		return "libsignal"
+	}
+}
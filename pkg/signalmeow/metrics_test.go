@@ -0,0 +1,37 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+)
+
+func TestDecryptionErrorClass(t *testing.T) {
+	assert.Equal(t, "", decryptionErrorClass(nil))
+	assert.Equal(t, "other", decryptionErrorClass(errors.New("usmc is nil")))
+	duplicate := &libsignalgo.SignalError{Code: libsignalgo.ErrorCodeDuplicatedMessage}
+	assert.Equal(t, "duplicate", decryptionErrorClass(fmt.Errorf("decrypt: %w", duplicate)))
+	noSession := &libsignalgo.SignalError{Code: libsignalgo.ErrorCodeSessionNotFound}
+	assert.Equal(t, "no_session", decryptionErrorClass(noSession))
+	assert.Equal(t, "libsignal", decryptionErrorClass(&libsignalgo.SignalError{Code: libsignalgo.ErrorCodeInvalidKey}))
+}
@@ -22,17 +22,21 @@ import (
 	"github.com/rs/zerolog"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
-	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
 )
 
 // signalmeow Logging
 
-var zlog zerolog.Logger = zerolog.New(zerolog.ConsoleWriter{}).With().Timestamp().Logger()
+// nopLog is used by devices that aren't attached to a client.
+var nopLog = zerolog.Nop()
 
+// zlog is only used for libsignal's logs, which are process-wide.
+// Everything else is logged through the logger of the client that owns the device.
+var zlog = zerolog.Nop()
+
+// SetLogger sets the logger that receives libsignal's logs.
 func SetLogger(l zerolog.Logger) {
 	zlog = l
 	setupFFILogging()
-	web.SetLogger(l.With().Str("component", "signalmeow/web").Logger())
 }
 
 // libsignalgo Logging
@@ -81,9 +85,9 @@ func setupFFILogging() {
 
 // Other misc things
 
-func serverPublicParams() libsignalgo.ServerPublicParams {
-	serverPublicParamsBase64 := "AMhf5ywVwITZMsff/eCyudZx9JDmkkkbV6PInzG4p8x3VqVJSFiMvnvlEKWuRob/1eaIetR31IYeAbm0NdOuHH8Qi+Rexi1wLlpzIo1gstHWBfZzy1+qHRV5A4TqPp15YzBPm0WSggW6PbSn+F4lf57VCnHF7p8SvzAA2ZZJPYJURt8X7bbg+H3i+PEjH9DXItNEqs2sNcug37xZQDLm7X36nOoGPs54XsEGzPdEV+itQNGUFEjY6X9Uv+Acuks7NpyGvCoKxGwgKgE5XyJ+nNKlyHHOLb6N1NuHyBrZrgtY/JYJHRooo5CEqYKBqdFnmbTVGEkCvJKxLnjwKWf+fEPoWeQFj5ObDjcKMZf2Jm2Ae69x+ikU5gBXsRmoF94GXTLfN0/vLt98KDPnxwAQL9j5V1jGOY8jQl6MLxEs56cwXN0dqCnImzVH3TZT1cJ8SW1BRX6qIVxEzjsSGx3yxF3suAilPMqGRp4ffyopjMD1JXiKR2RwLKzizUe5e8XyGOy9fplzhw3jVzTRyUZTRSZKkMLWcQ/gv0E4aONNqs4P"
-	serverPublicParamsBytes, err := base64.StdEncoding.DecodeString(serverPublicParamsBase64)
+// serverPublicParams returns the zkgroup parameters of the server the device is connected to.
+func (d *Device) serverPublicParams() libsignalgo.ServerPublicParams {
+	serverPublicParamsBytes, err := base64.StdEncoding.DecodeString(d.web().Config.ServerPublicParams)
 	if err != nil {
 		panic(err)
 	}
@@ -97,7 +97,6 @@ func (s *SQLStore) KyberPreKey(uuidKind UUIDKind, preKeyId int) (*libsignalgo.Ky
 	var isLastResort bool
 	err := s.db.QueryRow(getKyberPreKeyQuery, s.AciUuid, preKeyId, uuidKind).Scan(&record, &isLastResort)
 	if errors.Is(err, sql.ErrNoRows) {
-		zlog.Info().Msg("scanKyberPreKey: no rows")
 		return nil, nil
 	}
 	if err != nil {
@@ -118,9 +117,9 @@ func (s *SQLStore) SaveKyberPreKey(uuidKind UUIDKind, kyberPreKeyRecord *libsign
 	}
 	_, err = s.db.Exec(insertKyberPreKeyQuery, s.AciUuid, id, uuidKind, serialized, lastResort)
 	if err != nil {
-		zlog.Err(err).Msg("error inserting kyberPreKeyRecord")
+		return fmt.Errorf("inserting kyberPreKeyRecord: %w", err)
 	}
-	return err
+	return nil
 }
 
 func (s *SQLStore) DeleteKyberPreKey(uuidKind UUIDKind, preKeyId int) error {
@@ -164,7 +163,6 @@ func scanPreKey(row scannable) (*libsignalgo.PreKeyRecord, error) {
 	var record []byte
 	err := row.Scan(&id, &record)
 	if errors.Is(err, sql.ErrNoRows) {
-		zlog.Info().Msg("scanPreKey: no rows")
 		return nil, nil
 	} else if err != nil {
 		return nil, err
@@ -177,7 +175,6 @@ func scanSignedPreKey(row scannable) (*libsignalgo.SignedPreKeyRecord, error) {
 	var record []byte
 	err := row.Scan(&id, &record)
 	if errors.Is(err, sql.ErrNoRows) {
-		zlog.Info().Msg("scanSignedPreKey: no rows")
 		return nil, nil
 	} else if err != nil {
 		return nil, err
@@ -197,28 +194,26 @@ func (s *SQLStore) SavePreKey(uuidKind UUIDKind, preKey *libsignalgo.PreKeyRecor
 	id, err := preKey.GetID()
 	serialized, err := preKey.Serialize()
 	if err != nil {
-		zlog.Err(err).Msg("error serializing prekey")
-		return err
+		return fmt.Errorf("serializing prekey: %w", err)
 	}
 	_, err = s.db.Exec(insertPreKeyQuery, s.AciUuid, id, uuidKind, false, serialized, markUploaded)
 	if err != nil {
-		zlog.Err(err).Msg("error inserting prekey")
+		return fmt.Errorf("inserting prekey: %w", err)
 	}
-	return err
+	return nil
 }
 
 func (s *SQLStore) SaveSignedPreKey(uuidKind UUIDKind, preKey *libsignalgo.SignedPreKeyRecord, markUploaded bool) error {
 	id, err := preKey.GetID()
 	serialized, err := preKey.Serialize()
 	if err != nil {
-		zlog.Err(err).Msg("error serializing signed prekey")
-		return err
+		return fmt.Errorf("serializing signed prekey: %w", err)
 	}
 	_, err = s.db.Exec(insertPreKeyQuery, s.AciUuid, id, uuidKind, true, serialized, markUploaded)
 	if err != nil {
-		zlog.Err(err).Msg("error inserting signed prekey")
+		return fmt.Errorf("inserting signed prekey: %w", err)
 	}
-	return err
+	return nil
 }
 
 func (s *SQLStore) DeletePreKey(uuidKind UUIDKind, preKeyId int) error {
@@ -63,14 +63,14 @@ type ProfileCache struct {
 	avatarPaths map[string]string
 }
 
-func ProfileKeyCredentialRequest(ctx context.Context, d *Device, signalId string) ([]byte, error) {
-	profileKey, err := ProfileKeyForSignalID(ctx, d, signalId)
+func profileKeyCredentialRequest(ctx context.Context, d *Device, signalId string) ([]byte, error) {
+	profileKey, err := profileKeyForSignalID(ctx, d, signalId)
 	if err != nil {
-		zlog.Err(err).Msg("ProfileKey error")
+		d.log().Err(err).Msg("ProfileKey error")
 		return nil, err
 	}
 	parsedUUID, err := uuid.Parse(signalId)
-	serverPublicParams := serverPublicParams()
+	serverPublicParams := d.serverPublicParams()
 
 	requestContext, err := libsignalgo.CreateProfileKeyCredentialRequestContext(
 		serverPublicParams,
@@ -78,13 +78,13 @@ func ProfileKeyCredentialRequest(ctx context.Context, d *Device, signalId string
 		*profileKey,
 	)
 	if err != nil {
-		zlog.Err(err).Msg("CreateProfileKeyCredentialRequestContext error")
+		d.log().Err(err).Msg("CreateProfileKeyCredentialRequestContext error")
 		return nil, err
 	}
 
 	request, err := requestContext.ProfileKeyCredentialRequestContextGetRequest()
 	if err != nil {
-		zlog.Err(err).Msg("CreateProfileKeyCredentialRequest error")
+		d.log().Err(err).Msg("CreateProfileKeyCredentialRequest error")
 		return nil, err
 	}
 
@@ -93,10 +93,10 @@ func ProfileKeyCredentialRequest(ctx context.Context, d *Device, signalId string
 	return []byte(hexRequest), nil
 }
 
-func ProfileKeyForSignalID(ctx context.Context, d *Device, signalId string) (*libsignalgo.ProfileKey, error) {
+func profileKeyForSignalID(ctx context.Context, d *Device, signalId string) (*libsignalgo.ProfileKey, error) {
 	profileKey, err := d.ProfileKeyStore.LoadProfileKey(signalId, ctx)
 	if err != nil {
-		zlog.Err(err).Msg("GetProfileKey error")
+		d.log().Err(err).Msg("GetProfileKey error")
 		return nil, err
 	}
 	return profileKey, nil
@@ -104,7 +104,8 @@ func ProfileKeyForSignalID(ctx context.Context, d *Device, signalId string) (*li
 
 var errProfileKeyNotFound = errors.New("profile key not found")
 
-func RetrieveProfileByID(ctx context.Context, d *Device, signalID string) (*Profile, error) {
+func retrieveProfileByID(ctx context.Context, d *Device, signalID string) (*Profile, error) {
+	d.Connection.cacheLock.Lock()
 	if d.Connection.ProfileCache == nil {
 		d.Connection.ProfileCache = &ProfileCache{
 			profiles:    make(map[string]*Profile),
@@ -120,21 +121,26 @@ func RetrieveProfileByID(ctx context.Context, d *Device, signalID string) (*Prof
 	if ok && time.Since(lastFetched) < 1*time.Hour {
 		profile, ok := d.Connection.ProfileCache.profiles[string(signalID)]
 		if ok {
+			d.Connection.cacheLock.Unlock()
 			return profile, nil
 		}
 		err, ok := d.Connection.ProfileCache.errors[string(signalID)]
 		if ok {
+			d.Connection.cacheLock.Unlock()
 			return nil, *err
 		}
 	}
+	d.Connection.cacheLock.Unlock()
 
 	// If we get here, we don't have a cached profile, so fetch it
 	profile, err := fetchProfileByID(ctx, d, signalID)
 	if err != nil {
 		// If we get a 401 or 5xx error, we should not retry until the cache expires
 		if strings.HasPrefix(err.Error(), "401") || strings.HasPrefix(err.Error(), "5") {
+			d.Connection.cacheLock.Lock()
 			d.Connection.ProfileCache.errors[string(signalID)] = &err
 			d.Connection.ProfileCache.lastFetched[string(signalID)] = time.Now()
+			d.Connection.cacheLock.Unlock()
 		}
 		return nil, err
 	}
@@ -143,14 +149,16 @@ func RetrieveProfileByID(ctx context.Context, d *Device, signalID string) (*Prof
 	}
 
 	// If we get here, we have a valid profile, so cache it
+	d.Connection.cacheLock.Lock()
 	d.Connection.ProfileCache.profiles[string(signalID)] = profile
 	d.Connection.ProfileCache.lastFetched[string(signalID)] = time.Now()
+	d.Connection.cacheLock.Unlock()
 
 	return profile, nil
 }
 
-func RetrieveProfileAndAvatarByID(ctx context.Context, d *Device, signalID string) (*Profile, []byte, error) {
-	profile, err := RetrieveProfileByID(ctx, d, signalID)
+func retrieveProfileAndAvatarByID(ctx context.Context, d *Device, signalID string) (*Profile, []byte, error) {
+	profile, err := retrieveProfileByID(ctx, d, signalID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -158,58 +166,62 @@ func RetrieveProfileAndAvatarByID(ctx context.Context, d *Device, signalID strin
 	// If there is an avatarPath, and it's different from the cached one, fetch it
 	// (we only return the avatar if it's different from the cached one)
 	var avatarImage []byte
+	d.Connection.cacheLock.Lock()
 	cachedAvatarPath, _ := d.Connection.ProfileCache.avatarPaths[string(signalID)]
+	d.Connection.cacheLock.Unlock()
 	if profile.AvatarPath != "" && cachedAvatarPath != profile.AvatarPath {
 		avatarImage, err = fetchAndDecryptAvatarImage(d, profile.AvatarPath, &profile.Key)
 		if err != nil {
-			zlog.Err(err).Msg("error fetching profile avatarImage")
+			d.log().Err(err).Msg("error fetching profile avatarImage")
 			return nil, nil, err
 		}
 	}
+	d.Connection.cacheLock.Lock()
 	d.Connection.ProfileCache.avatarPaths[string(signalID)] = profile.AvatarPath
+	d.Connection.cacheLock.Unlock()
 
 	return profile, avatarImage, nil
 }
 
 func fetchProfileByID(ctx context.Context, d *Device, signalID string) (*Profile, error) {
-	profileKey, err := ProfileKeyForSignalID(ctx, d, signalID)
+	profileKey, err := profileKeyForSignalID(ctx, d, signalID)
 	if err != nil {
-		zlog.Err(err).Msg("ProfileKey error")
+		d.log().Err(err).Msg("ProfileKey error")
 		return nil, err
 	}
 	if profileKey == nil {
-		zlog.Err(err).Msg("profileKey is nil")
+		d.log().Err(err).Msg("profileKey is nil")
 		return nil, nil
 	}
 	u, err := uuid.Parse(signalID)
 	if err != nil {
-		zlog.Err(err).Msg("UUIDFromString error")
+		d.log().Err(err).Msg("UUIDFromString error")
 		return nil, err
 	}
 
 	profileKeyVersion, err := profileKey.GetProfileKeyVersion(u)
 	if err != nil {
-		zlog.Err(err).Msg("profileKey error")
+		d.log().Err(err).Msg("profileKey error")
 		return nil, err
 	}
 
 	accessKey, err := profileKey.DeriveAccessKey()
 	if err != nil {
-		zlog.Err(err).Msg("DeriveAccessKey error")
+		d.log().Err(err).Msg("DeriveAccessKey error")
 		return nil, err
 	}
 	base64AccessKey := base64.StdEncoding.EncodeToString(accessKey[:])
 
-	credentialRequest, err := ProfileKeyCredentialRequest(ctx, d, signalID)
+	credentialRequest, err := profileKeyCredentialRequest(ctx, d, signalID)
 	if err != nil {
-		zlog.Err(err).Msg("ProfileKeyCredentialRequest error")
+		d.log().Err(err).Msg("profileKeyCredentialRequest error")
 		return nil, err
 	}
 
 	path := "/v1/profile/" + signalID
 	useUnidentified := profileKeyVersion != nil && accessKey != nil
 	if useUnidentified {
-		zlog.Trace().Msgf("Using unidentified profile request with profileKeyVersion: %v", profileKeyVersion)
+		d.log().Trace().Msgf("Using unidentified profile request with profileKeyVersion: %v", profileKeyVersion)
 		// Assuming we can just make the version bytes into a string
 		path += "/" + profileKeyVersion.String()
 	}
@@ -230,27 +242,27 @@ func fetchProfileByID(ctx context.Context, d *Device, signalID string) (*Profile
 	}
 	resp, err := d.Connection.UnauthedWS.SendRequest(ctx, profileRequest)
 	if err != nil {
-		zlog.Err(err).Msg("SendRequest error")
+		d.log().Err(err).Msg("SendRequest error")
 		return nil, err
 	}
-	zlog.Trace().Msg("Got profile response")
+	d.log().Trace().Msg("Got profile response")
 	if *resp.Status < 200 || *resp.Status >= 300 {
 		err := errors.New(fmt.Sprintf("%v (unsuccessful status code)", *resp.Status))
-		zlog.Err(err).Msg("profile response error")
+		d.log().Err(err).Msg("profile response error")
 		return nil, err
 	}
 	var profileResponse ProfileResponse
 	var profile Profile
 	err = json.Unmarshal(resp.Body, &profileResponse)
 	if err != nil {
-		zlog.Err(err).Msg("json.Unmarshal error")
+		d.log().Err(err).Msg("json.Unmarshal error")
 		return nil, err
 	}
 	if profileResponse.Name != "" {
 		base64Name, err := base64.StdEncoding.DecodeString(profileResponse.Name)
 		decryptedName, err := decryptString(*profileKey, base64Name)
 		if err != nil {
-			zlog.Err(err).Msg("error decrypting profile name")
+			d.log().Err(err).Msg("error decrypting profile name")
 		}
 		profile.Name = *decryptedName
 		// I've seen profile names come in with a null byte instead of a space
@@ -261,7 +273,7 @@ func fetchProfileByID(ctx context.Context, d *Device, signalID string) (*Profile
 		base64About, err := base64.StdEncoding.DecodeString(profileResponse.About)
 		decryptedAbout, err := decryptString(*profileKey, base64About)
 		if err != nil {
-			zlog.Err(err).Msg("error decrypting profile about")
+			d.log().Err(err).Msg("error decrypting profile about")
 		}
 		profile.About = *decryptedAbout
 	}
@@ -269,7 +281,7 @@ func fetchProfileByID(ctx context.Context, d *Device, signalID string) (*Profile
 		base64AboutEmoji, err := base64.StdEncoding.DecodeString(profileResponse.AboutEmoji)
 		decryptedAboutEmoji, err := decryptString(*profileKey, base64AboutEmoji)
 		if err != nil {
-			zlog.Err(err).Msg("error decrypting profile aboutEmoji")
+			d.log().Err(err).Msg("error decrypting profile aboutEmoji")
 		}
 		profile.AboutEmoji = *decryptedAboutEmoji
 	}
@@ -286,25 +298,25 @@ func fetchAndDecryptAvatarImage(d *Device, avatarPath string, profileKey *libsig
 		Username: &username,
 		Password: &password,
 	}
-	zlog.Info().Msgf("Fetching profile avatar from %v", avatarPath)
-	resp, err := web.SendHTTPRequest("GET", avatarPath, opts)
+	d.log().Info().Msgf("Fetching profile avatar from %v", avatarPath)
+	resp, err := d.web().SendHTTPRequest("GET", avatarPath, opts)
 	if err != nil {
-		zlog.Err(err).Msg("error fetching profile avatar")
+		d.log().Err(err).Msg("error fetching profile avatar")
 		return nil, err
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		err := errors.New(fmt.Sprintf("%v (unsuccessful status code)", resp.Status))
-		zlog.Err(err).Msg("bad status fetching profile avatar")
+		d.log().Err(err).Msg("bad status fetching profile avatar")
 		return nil, err
 	}
 	encryptedAvatar, err := io.ReadAll(resp.Body)
 	if err != nil {
-		zlog.Err(err).Msg("error reading profile avatar")
+		d.log().Err(err).Msg("error reading profile avatar")
 		return nil, err
 	}
 	avatar, err := decryptBytes(*profileKey, encryptedAvatar)
 	if err != nil {
-		zlog.Err(err).Msg("error decrypting profile avatar")
+		d.log().Err(err).Msg("error decrypting profile avatar")
 		return nil, err
 	}
 	return avatar, nil
@@ -27,6 +27,7 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/rs/zerolog"
 	"google.golang.org/protobuf/proto"
 	"nhooyr.io/websocket"
 
@@ -71,16 +72,17 @@ type ProvisioningResponse struct {
 	Err              error
 }
 
-func PerformProvisioning(incomingCtx context.Context, deviceStore DeviceStore, deviceName string) chan ProvisioningResponse {
+// PerformProvisioning links a new device to an account on the servers of webClient.
+func PerformProvisioning(incomingCtx context.Context, webClient *web.Client, deviceStore DeviceStore, deviceName string) chan ProvisioningResponse {
 	c := make(chan ProvisioningResponse)
 	go func() {
 		defer close(c)
 
 		ctx, cancel := context.WithTimeout(incomingCtx, 2*time.Minute)
 		defer cancel()
-		ws, err := openProvisioningWebsocket(ctx)
+		ws, err := openProvisioningWebsocket(ctx, webClient)
 		if err != nil {
-			zlog.Err(err).Msg("openProvisioningWebsocket error")
+			zerolog.Ctx(ctx).Err(err).Msg("openProvisioningWebsocket error")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
 			return
 		}
@@ -89,7 +91,7 @@ func PerformProvisioning(incomingCtx context.Context, deviceStore DeviceStore, d
 
 		provisioningUrl, err := startProvisioning(ctx, ws, provisioningCipher)
 		if err != nil {
-			zlog.Err(err).Msg("startProvisioning error")
+			zerolog.Ctx(ctx).Err(err).Msg("startProvisioning error")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
 			return
 		}
@@ -97,7 +99,7 @@ func PerformProvisioning(incomingCtx context.Context, deviceStore DeviceStore, d
 
 		provisioningMessage, err := continueProvisioning(ctx, ws, provisioningCipher)
 		if err != nil {
-			zlog.Err(err).Msg("continueProvisioning error")
+			zerolog.Ctx(ctx).Err(err).Msg("continueProvisioning error")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
 			return
 		}
@@ -134,6 +136,7 @@ func PerformProvisioning(incomingCtx context.Context, deviceStore DeviceStore, d
 		pniPQLastResortPreKey := (*pniPQLastResortPreKeys)[0]
 		deviceResponse, err := confirmDevice(
 			ctx,
+			webClient,
 			username,
 			password,
 			*code,
@@ -147,7 +150,7 @@ func PerformProvisioning(incomingCtx context.Context, deviceStore DeviceStore, d
 			deviceName,
 		)
 		if err != nil {
-			zlog.Err(err).Msg("confirmDevice error")
+			zerolog.Ctx(ctx).Err(err).Msg("confirmDevice error")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
 			return
 		}
@@ -172,14 +175,14 @@ func PerformProvisioning(incomingCtx context.Context, deviceStore DeviceStore, d
 		// Store the provisioning data
 		err = deviceStore.PutDevice(data)
 		if err != nil {
-			zlog.Err(err).Msg("error storing new device")
+			zerolog.Ctx(ctx).Err(err).Msg("error storing new device")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
 			return
 		}
 
 		device, err := deviceStore.DeviceByAci(data.AciUuid)
 		if err != nil {
-			zlog.Err(err).Msg("error retrieving new device")
+			zerolog.Ctx(ctx).Err(err).Msg("error retrieving new device")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
 			return
 		}
@@ -191,21 +194,21 @@ func PerformProvisioning(incomingCtx context.Context, deviceStore DeviceStore, d
 		address, err := libsignalgo.NewAddress(device.Data.AciUuid, uint(device.Data.DeviceId))
 		_, err = device.IdentityStore.SaveIdentityKey(address, device.Data.AciIdentityKeyPair.GetIdentityKey(), ctx)
 		if err != nil {
-			zlog.Err(err).Msg("error saving identity key")
+			zerolog.Ctx(ctx).Err(err).Msg("error saving identity key")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
 			return
 		}
 
 		// Store signed prekeys (now that we have a device)
-		StoreSignedPreKey(device, aciSignedPreKey, UUID_KIND_ACI)
-		StoreSignedPreKey(device, pniSignedPreKey, UUID_KIND_PNI)
-		StoreKyberLastResortPreKey(device, &aciPQLastResortPreKey, UUID_KIND_ACI)
-		StoreKyberLastResortPreKey(device, &pniPQLastResortPreKey, UUID_KIND_PNI)
+		storeSignedPreKey(device, aciSignedPreKey, UUID_KIND_ACI)
+		storeSignedPreKey(device, pniSignedPreKey, UUID_KIND_PNI)
+		storeKyberLastResortPreKey(device, &aciPQLastResortPreKey, UUID_KIND_ACI)
+		storeKyberLastResortPreKey(device, &pniPQLastResortPreKey, UUID_KIND_PNI)
 
 		// Store our profile key
 		err = device.ProfileKeyStore.StoreProfileKey(data.AciUuid, profileKey, ctx)
 		if err != nil {
-			zlog.Err(err).Msg("error storing profile key")
+			zerolog.Ctx(ctx).Err(err).Msg("error storing profile key")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
 			return
 		}
@@ -213,25 +216,33 @@ func PerformProvisioning(incomingCtx context.Context, deviceStore DeviceStore, d
 		// Return the provisioning data
 		c <- ProvisioningResponse{State: StateProvisioningDataReceived, ProvisioningData: data}
 
-		// Generate, store, and register prekeys
-		err = GenerateAndRegisterPreKeys(device, UUID_KIND_ACI)
-		err = GenerateAndRegisterPreKeys(device, UUID_KIND_PNI)
+		// Generate, store, and register prekeys. The new device isn't owned by a Client yet,
+		// so it needs the web client for that.
+		device.Connection.webClient = webClient
+		err = generateAndRegisterPreKeys(device, UUID_KIND_ACI)
+		err = generateAndRegisterPreKeys(device, UUID_KIND_PNI)
 
 		if err != nil {
-			zlog.Err(err).Msg("error generating and registering prekeys")
+			zerolog.Ctx(ctx).Err(err).Msg("error generating and registering prekeys")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
 			return
 		}
 
+		// Every device on the account at this point belongs to the user, the ones linked later are reported
+		err = device.recordOwnDevices(ctx)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("error recording devices on account")
+		}
+
 		c <- ProvisioningResponse{State: StateProvisioningPreKeysRegistered}
 	}()
 	return c
 }
 
-func openProvisioningWebsocket(ctx context.Context) (*websocket.Conn, error) {
-	ws, resp, err := web.OpenWebsocket(ctx, web.WebsocketProvisioningPath)
+func openProvisioningWebsocket(ctx context.Context, webClient *web.Client) (*websocket.Conn, error) {
+	ws, resp, err := webClient.OpenWebsocket(ctx, web.WebsocketProvisioningPath)
 	if err != nil {
-		zlog.Err(err).Msgf("openWebsocket error, resp : %v", resp)
+		zerolog.Ctx(ctx).Err(err).Msgf("openWebsocket error, resp : %v", resp)
 		return nil, err
 	}
 	return ws, nil
@@ -246,7 +257,7 @@ func startProvisioning(ctx context.Context, ws *websocket.Conn, provisioningCiph
 	msg := &signalpb.WebSocketMessage{}
 	err := wspb.Read(ctx, ws, msg)
 	if err != nil {
-		zlog.Err(err).Msg("error reading websocket message")
+		zerolog.Ctx(ctx).Err(err).Msg("error reading websocket message")
 		return "", err
 	}
 
@@ -270,7 +281,7 @@ func startProvisioning(ctx context.Context, ws *websocket.Conn, provisioningCiph
 		response := web.CreateWSResponse(*msg.Request.Id, 200)
 		err = wspb.Write(ctx, ws, response)
 		if err != nil {
-			zlog.Err(err).Msg("error writing websocket message")
+			zerolog.Ctx(ctx).Err(err).Msg("error writing websocket message")
 			return "", err
 		}
 	}
@@ -282,7 +293,7 @@ func continueProvisioning(ctx context.Context, ws *websocket.Conn, provisioningC
 	msg := &signalpb.WebSocketMessage{}
 	err := wspb.Read(ctx, ws, msg)
 	if err != nil {
-		zlog.Err(err).Msg("error reading websocket message")
+		zerolog.Ctx(ctx).Err(err).Msg("error reading websocket message")
 		return nil, err
 	}
 
@@ -299,12 +310,12 @@ func continueProvisioning(ctx context.Context, ws *websocket.Conn, provisioningC
 		response := web.CreateWSResponse(*msg.Request.Id, 200)
 		err = wspb.Write(ctx, ws, response)
 		if err != nil {
-			zlog.Err(err).Msg("error writing websocket message")
+			zerolog.Ctx(ctx).Err(err).Msg("error writing websocket message")
 			return nil, err
 		}
 	} else {
 		err = fmt.Errorf("invalid provisioning message, type: %v, verb: %v, path: %v", *msg.Type, *msg.Request.Verb, *msg.Request.Path)
-		zlog.Err(err).Msg("problem reading websocket message")
+		zerolog.Ctx(ctx).Err(err).Msg("problem reading websocket message")
 		return nil, err
 	}
 	provisioningMessage, err := provisioningCipher.Decrypt(envelope)
@@ -313,6 +324,7 @@ func continueProvisioning(ctx context.Context, ws *websocket.Conn, provisioningC
 
 func confirmDevice(
 	ctx context.Context,
+	webClient *web.Client,
 	username string,
 	password string,
 	code string,
@@ -330,9 +342,9 @@ func confirmDevice(
 		return nil, fmt.Errorf("failed to encrypt device name: %w", err)
 	}
 
-	ws, resp, err := web.OpenWebsocket(ctx, web.WebsocketPath)
+	ws, resp, err := webClient.OpenWebsocket(ctx, web.WebsocketPath)
 	if err != nil {
-		zlog.Err(err).Msgf("openWebsocket error, resp : %v", resp)
+		zerolog.Ctx(ctx).Err(err).Msgf("openWebsocket error, resp : %v", resp)
 		return nil, err
 	}
 	defer ws.Close(websocket.StatusInternalError, "Websocket StatusInternalError")
@@ -364,7 +376,7 @@ func confirmDevice(
 
 	jsonBytes, err := json.Marshal(data)
 	if err != nil {
-		zlog.Err(err).Msgf("failed to marshal json: %v", resp)
+		zerolog.Ctx(ctx).Err(err).Msgf("failed to marshal json: %v", resp)
 		return nil, err
 	}
 
@@ -379,21 +391,21 @@ func confirmDevice(
 	}
 	err = wspb.Write(ctx, ws, message)
 	if err != nil {
-		zlog.Err(err).Msgf("failed on write %v", resp)
+		zerolog.Ctx(ctx).Err(err).Msgf("failed on write %v", resp)
 		return nil, err
 	}
 
 	receivedMsg := &signalpb.WebSocketMessage{}
 	err = wspb.Read(ctx, ws, receivedMsg)
 	if err != nil {
-		zlog.Err(err).Msgf("failed to read after devices call: %v", resp)
+		zerolog.Ctx(ctx).Err(err).Msgf("failed to read after devices call: %v", resp)
 		return nil, err
 	}
 
 	status := int(*receivedMsg.Response.Status)
 	if status < 200 || status >= 300 {
 		err := fmt.Errorf("problem with devices response - status: %d, message: %s", status, *receivedMsg.Response.Message)
-		zlog.Err(err).Msg("")
+		zerolog.Ctx(ctx).Err(err).Msg("")
 		return nil, err
 	}
 
@@ -401,7 +413,7 @@ func confirmDevice(
 	deviceResp := ConfirmDeviceResponse{}
 	err = json.Unmarshal(receivedMsg.Response.Body, &deviceResp)
 	if err != nil {
-		zlog.Err(err).Msgf("failed to unmarshal json: %v", receivedMsg.Response.Body)
+		zerolog.Ctx(ctx).Err(err).Msgf("failed to unmarshal json: %v", receivedMsg.Response.Body)
 		return nil, err
 	}
 
@@ -44,8 +44,7 @@ func (c *ProvisioningCipher) GetPublicKey() *libsignalgo.PublicKey {
 	if c.keyPair == nil {
 		keyPair, err := libsignalgo.GenerateIdentityKeyPair()
 		if err != nil {
-			zlog.Err(err).Msg("")
-			zlog.Fatal().Msg("Unable to generate key pair")
+			panic(fmt.Errorf("unable to generate key pair: %w", err))
 		}
 		c.keyPair = keyPair
 	}
@@ -65,23 +64,19 @@ const CIPHERTEXT_OFFSET uint = IV_OFFSET + IV_LENGTH
 func (c *ProvisioningCipher) Decrypt(env *signalpb.ProvisionEnvelope) (*signalpb.ProvisionMessage, error) {
 	masterEphemeral, err := libsignalgo.DeserializePublicKey(env.GetPublicKey())
 	if err != nil {
-		zlog.Err(err).Msg("Unable to deserialize public key")
-		return nil, err
+		return nil, fmt.Errorf("unable to deserialize public key: %w", err)
 	}
 	if masterEphemeral == nil {
 		err = fmt.Errorf("No public key: %v", env)
-		zlog.Err(err).Msg("")
 		return nil, err
 	}
 	body := env.GetBody()
 	if body == nil {
 		err = fmt.Errorf("No body: %v", env)
-		zlog.Err(err).Msg("")
 		return nil, err
 	}
 	if body[0] != 1 {
 		err = fmt.Errorf("Invalid ProvisionMessage version: %v", body[0])
-		zlog.Err(err).Msg("")
 		return nil, err
 	}
 	bodyLen := uint(len(body))
@@ -89,12 +84,10 @@ func (c *ProvisioningCipher) Decrypt(env *signalpb.ProvisionEnvelope) (*signalpb
 	mac := body[bodyLen-MAC_SIZE : bodyLen]
 	if uint(len(mac)) != MAC_SIZE {
 		err = fmt.Errorf("Invalid MAC size: %v", len(mac))
-		zlog.Err(err).Msg("")
 		return nil, err
 	}
 	if uint(len(iv)) != IV_LENGTH {
 		err = fmt.Errorf("Invalid IV size: %v", len(iv))
-		zlog.Err(err).Msg("")
 		return nil, err
 	}
 	cipherText := body[CIPHERTEXT_OFFSET : bodyLen-CIPHER_KEY_SIZE]
@@ -102,15 +95,14 @@ func (c *ProvisioningCipher) Decrypt(env *signalpb.ProvisionEnvelope) (*signalpb
 
 	agreement, err := c.keyPair.GetPrivateKey().Agree(masterEphemeral)
 	if err != nil {
-		zlog.Err(err).Msg("Unable to agree on key")
-		return nil, err
+		return nil, fmt.Errorf("unable to agree on key: %w", err)
 	}
 
 	sharedSecrets := make([]byte, 64)
 	hkdfReader := hkdf.New(sha256.New, agreement, nil, []byte("TextSecure Provisioning Message"))
 
 	if _, err := io.ReadFull(hkdfReader, sharedSecrets); err != nil {
-		zlog.Err(err).Msg("Unable to read from hkdfReader")
+		return nil, fmt.Errorf("unable to read from hkdfReader: %w", err)
 	}
 
 	parts1 := sharedSecrets[:32]
@@ -120,18 +112,15 @@ func (c *ProvisioningCipher) Decrypt(env *signalpb.ProvisionEnvelope) (*signalpb
 	verifier.Write(ivAndCipherText)
 	ourMac := verifier.Sum(nil)
 	if len(ourMac) != len(mac) {
-		err = fmt.Errorf("Invalid MAC length: ourmac:%v mac:%v", len(ourMac), len(mac))
-		zlog.Err(err).Msg("")
+		return nil, fmt.Errorf("Invalid MAC length: ourmac:%v mac:%v", len(ourMac), len(mac))
 	}
 	if !hmac.Equal(ourMac[:32], mac) {
-		err = fmt.Errorf("Invalid MAC: %v", ourMac)
-		zlog.Err(err).Msg("")
+		return nil, fmt.Errorf("Invalid MAC: %v", ourMac)
 	}
 
 	block, err := aes.NewCipher(parts1)
 	if err != nil {
-		zlog.Err(err).Msg("Unable to create cipher")
-		return nil, err
+		return nil, fmt.Errorf("unable to create cipher: %w", err)
 	}
 
 	mode := cipher.NewCBCDecrypter(block, iv)
@@ -140,14 +129,13 @@ func (c *ProvisioningCipher) Decrypt(env *signalpb.ProvisionEnvelope) (*signalpb
 
 	decrypted, err := UnpadPKCS7(decryptedWithPadding)
 	if err != nil {
-		zlog.Err(err).Msg("Unable to unpad")
+		return nil, fmt.Errorf("unable to unpad: %w", err)
 	}
 
 	message := &signalpb.ProvisionMessage{}
 	err = proto.Unmarshal(decrypted, message)
 	if err != nil {
-		zlog.Err(err).Msg("Unable to unmarshal ProvisionMessage")
-		return nil, err
+		return nil, fmt.Errorf("unable to unmarshal ProvisionMessage: %w", err)
 	}
 
 	return message, nil
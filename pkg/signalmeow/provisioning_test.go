@@ -0,0 +1,84 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPerformProvisioning(t *testing.T) {
+	server := newTestServer(t)
+	phone := newTestPhone(t, server, "+15550000001")
+	client := linkTestClient(t, server, phone)
+	ctx := newTestContext(t)
+
+	data := client.Device.Data
+	assert.Equal(t, phone.ACI.String(), data.AciUuid)
+	assert.Equal(t, phone.PNI.String(), data.PniUuid)
+	assert.Equal(t, phone.Number, data.Number)
+	assert.NotEqual(t, 1, data.DeviceId, "the phone is the primary device")
+	assert.ElementsMatch(t, []int{1, data.DeviceId}, server.DeviceIDs(phone.ACI))
+	assert.True(t, client.IsDeviceLoggedIn())
+
+	// The keys from the phone are stored, and prekeys were uploaded for both identities
+	require.NotNil(t, data.AciIdentityKeyPair)
+	ourKey, err := data.AciIdentityKeyPair.GetPublicKey().Serialize()
+	require.NoError(t, err)
+	phoneKeyPair, err := phone.Store.GetIdentityKeyPair(ctx)
+	require.NoError(t, err)
+	phoneKey, err := phoneKeyPair.GetPublicKey().Serialize()
+	require.NoError(t, err)
+	assert.Equal(t, phoneKey, ourKey)
+	profileKey, err := client.Device.ProfileKeyStore.MyProfileKey(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, profileKey)
+	assert.Equal(t, phone.ProfileKey, *profileKey)
+	metrics := &preKeyCountMetrics{counts: make(map[UUIDKind][2]int)}
+	client.Device.Connection.metrics = metrics
+	for _, uuidKind := range []UUIDKind{UUID_KIND_ACI, UUID_KIND_PNI} {
+		require.NoError(t, checkPreKeyCount(client.Device, uuidKind))
+		assert.Greater(t, metrics.counts[uuidKind][0], 0, "no %s prekeys uploaded", uuidKind)
+		assert.Greater(t, metrics.counts[uuidKind][1], 0, "no %s kyber prekeys uploaded", uuidKind)
+	}
+
+	// The devices on the account when linking are known, so only devices linked later are reported
+	knownDevices, err := client.Device.KnownDeviceStore.GetKnownDevices(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, server.DeviceIDs(phone.ACI), knownDevices)
+	newDevices := make(chan int, 10)
+	client.Device.Connection.NewOwnDeviceHandler = func(deviceID int) {
+		newDevices <- deviceID
+	}
+	secondClient := linkTestClient(t, server, phone)
+	require.NoError(t, client.Device.checkOwnDeviceList(ctx))
+	assert.Equal(t, secondClient.Device.Data.DeviceId, waitForEvent(t, newDevices))
+
+	// The stored device can log in
+	startTestClient(t, client)
+}
+
+type preKeyCountMetrics struct {
+	NoopMetrics
+	counts map[UUIDKind][2]int
+}
+
+func (m *preKeyCountMetrics) PreKeysRemaining(aciUUID string, uuidKind UUIDKind, ecCount, kyberCount int) {
+	m.counts[uuidKind] = [2]int{ecCount, kyberCount}
+}
@@ -0,0 +1,208 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// CaptchaURL is where users can solve a captcha to get a token for Client.SubmitCaptcha.
+const CaptchaURL = "https://signalcaptchas.org/challenge/generate.html"
+
+const (
+	rateLimitInitialBackoff = 5 * time.Second
+	rateLimitMaxBackoff     = time.Hour
+)
+
+var (
+	// ErrNoPendingChallenge is returned by Client.SubmitCaptcha if the server hasn't asked for a captcha.
+	ErrNoPendingChallenge = errors.New("there's no pending captcha challenge")
+	// ErrCaptchaRejected is returned by Client.SubmitCaptcha if the server didn't accept the captcha token.
+	ErrCaptchaRejected = errors.New("the captcha token was rejected")
+)
+
+// RateLimitError is returned when sending is paused because the server rate limited us
+// or asked for a captcha. Messages aren't sent to the server while sending is paused.
+type RateLimitError struct {
+	// Until is when sending will be attempted again. It's zero if a captcha has to be solved first.
+	Until           time.Time
+	CaptchaRequired bool
+}
+
+func (e *RateLimitError) Error() string {
+	if e.CaptchaRequired {
+		return "sending is paused until a captcha is solved"
+	}
+	return fmt.Sprintf("rate limited by Signal, sending is paused until %s", e.Until.Format(time.TimeOnly))
+}
+
+// rateLimitState tracks rate limits and push challenges for all sends of a device, so that
+// a rate limited account stops hammering the server with requests that are going to fail.
+type rateLimitState struct {
+	lock           sync.Mutex
+	pausedUntil    time.Time
+	consecutive    int
+	challengeToken string
+}
+
+// check returns a RateLimitError if sending is currently paused.
+func (rl *rateLimitState) check() error {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.challengeToken != "" {
+		return &RateLimitError{CaptchaRequired: true}
+	} else if time.Now().Before(rl.pausedUntil) {
+		return &RateLimitError{Until: rl.pausedUntil}
+	}
+	return nil
+}
+
+// limited pauses sending after a rate limit response. If the server didn't say how long to wait,
+// the pause is doubled after every consecutive rate limit. Returns the length of the pause.
+func (rl *rateLimitState) limited(retryAfter time.Duration) time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.consecutive++
+	if retryAfter <= 0 {
+		retryAfter = rateLimitInitialBackoff
+		for i := 1; i < rl.consecutive && retryAfter < rateLimitMaxBackoff; i++ {
+			retryAfter *= 2
+		}
+		if retryAfter > rateLimitMaxBackoff {
+			retryAfter = rateLimitMaxBackoff
+		}
+	}
+	rl.pausedUntil = time.Now().Add(retryAfter)
+	return retryAfter
+}
+
+// succeeded resets the backoff after a successful send.
+func (rl *rateLimitState) succeeded() {
+	rl.lock.Lock()
+	rl.consecutive = 0
+	rl.lock.Unlock()
+}
+
+// challenged pauses sending until the given challenge is solved. Returns true if the challenge is new.
+func (rl *rateLimitState) challenged(token string) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	isNew := rl.challengeToken != token
+	rl.challengeToken = token
+	return isNew
+}
+
+func (rl *rateLimitState) pendingChallenge() string {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.challengeToken
+}
+
+// resume clears the challenge and any pause.
+func (rl *rateLimitState) resume() {
+	rl.lock.Lock()
+	rl.challengeToken = ""
+	rl.pausedUntil = time.Time{}
+	rl.consecutive = 0
+	rl.lock.Unlock()
+}
+
+// CaptchaRequired returns true if sending is paused until a captcha is submitted with Client.SubmitCaptcha.
+func (d *DeviceConnection) CaptchaRequired() bool {
+	return d.rateLimit.pendingChallenge() != ""
+}
+
+// A 428 means the server wants us to solve a challenge before sending more messages.
+// Push challenges can only be answered by phones, so only captchas are supported.
+func handle428(device *Device, response *signalpb.WebSocketResponseMessage) error {
+	// Sample response:
+	//id:25 status:428 message:"Precondition Required" headers:"Retry-After:86400"
+	//headers:"Content-Type:application/json" headers:"Content-Length:88"
+	//body:"{\"token\":\"07af0d73-e05d-42c3-9634-634922061966\",\"options\":[\"recaptcha\",\"pushChallenge\"]}"
+	var body struct {
+		Token   string   `json:"token"`
+		Options []string `json:"options"`
+	}
+	err := json.Unmarshal(response.Body, &body)
+	if err != nil {
+		return fmt.Errorf("failed to parse challenge: %w", err)
+	}
+	retryAfter := retryAfterFromHeaders(response.Headers)
+	canCaptcha := false
+	for _, option := range body.Options {
+		if option == "recaptcha" || option == "captcha" {
+			canCaptcha = true
+		}
+	}
+	if body.Token == "" || !canCaptcha {
+		pause := device.Connection.rateLimit.limited(retryAfter)
+		device.log().Warn().Strs("options", body.Options).Dur("pause", pause).Msg("Got unsupported challenge, pausing sending")
+		return &SendStatusError{StatusCode: http.StatusPreconditionRequired, RetryAfter: pause}
+	}
+	if device.Connection.rateLimit.challenged(body.Token) {
+		device.log().Warn().Msg("Server requires a captcha before sending more messages")
+		if device.Connection.CaptchaRequiredHandler != nil {
+			go device.Connection.CaptchaRequiredHandler()
+		}
+	}
+	return &RateLimitError{CaptchaRequired: true}
+}
+
+// submitCaptcha answers the pending challenge with a captcha token from CaptchaURL.
+// The token may include the signalcaptcha:// prefix. Sending resumes if the server accepts it.
+func submitCaptcha(ctx context.Context, device *Device, captcha string) error {
+	token := device.Connection.rateLimit.pendingChallenge()
+	if token == "" {
+		return ErrNoPendingChallenge
+	}
+	captcha = strings.TrimPrefix(strings.TrimSpace(captcha), "signalcaptcha://")
+	reqData, err := json.Marshal(map[string]string{
+		"type":    "captcha",
+		"token":   token,
+		"captcha": captcha,
+	})
+	if err != nil {
+		return err
+	}
+	username, password := device.Data.BasicAuthCreds()
+	resp, err := device.web().SendHTTPRequest(http.MethodPut, "/v1/challenge", &web.HTTPReqOpt{
+		Body:     reqData,
+		Username: &username,
+		Password: &password,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send challenge response: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionRequired || resp.StatusCode == http.StatusBadRequest {
+		return ErrCaptchaRejected
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("challenge response returned status %d", resp.StatusCode)
+	}
+	device.Connection.rateLimit.resume()
+	return nil
+}
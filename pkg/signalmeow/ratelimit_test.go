@@ -0,0 +1,62 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitBackoff(t *testing.T) {
+	var rl rateLimitState
+	assert.NoError(t, rl.check())
+
+	assert.Equal(t, rateLimitInitialBackoff, rl.limited(0))
+	assert.Equal(t, 2*rateLimitInitialBackoff, rl.limited(0))
+	assert.Equal(t, 4*rateLimitInitialBackoff, rl.limited(0))
+	// Retry-After from the server takes precedence over the backoff
+	assert.Equal(t, time.Minute, rl.limited(time.Minute))
+	var rateLimitErr *RateLimitError
+	assert.ErrorAs(t, rl.check(), &rateLimitErr)
+	assert.False(t, rateLimitErr.CaptchaRequired)
+	assert.True(t, IsRetryableSendError(rateLimitErr))
+	assert.InDelta(t, time.Minute, SendRetryAfter(rateLimitErr), float64(time.Second))
+
+	for i := 0; i < 20; i++ {
+		rl.limited(0)
+	}
+	assert.Equal(t, rateLimitMaxBackoff, rl.limited(0))
+	rl.succeeded()
+	assert.Equal(t, rateLimitInitialBackoff, rl.limited(0))
+}
+
+func TestRateLimitChallenge(t *testing.T) {
+	var rl rateLimitState
+	assert.True(t, rl.challenged("token"))
+	assert.False(t, rl.challenged("token"))
+	assert.Equal(t, "token", rl.pendingChallenge())
+	var rateLimitErr *RateLimitError
+	assert.ErrorAs(t, rl.check(), &rateLimitErr)
+	assert.True(t, rateLimitErr.CaptchaRequired)
+	assert.Zero(t, SendRetryAfter(rateLimitErr))
+
+	rl.resume()
+	assert.NoError(t, rl.check())
+	assert.Empty(t, rl.pendingChallenge())
+}
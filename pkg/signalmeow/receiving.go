@@ -24,10 +24,12 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
 )
@@ -63,21 +65,24 @@ type SignalConnectionStatus struct {
 	Err   error
 }
 
-func StartReceiveLoops(ctx context.Context, d *Device) (chan SignalConnectionStatus, error) {
+func startReceiveLoops(ctx context.Context, d *Device) (chan SignalConnectionStatus, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	d.Connection.WSCancel = cancel
+	// Start handling messages that were received before, and the ones that will be received
+	d.Connection.inbox = newInboxQueue(ctx, d.processInboxEntry)
+	go d.loadInbox(d.Connection.inbox, time.Now())
 	authChan, err := d.Connection.ConnectAuthedWS(ctx, d.Data, d.incomingRequestHandler)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
-	zlog.Info().Msg("Authed websocket connecting")
+	d.log().Info().Msg("Authed websocket connecting")
 	unauthChan, err := d.Connection.ConnectUnauthedWS(ctx, d.Data)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
-	zlog.Info().Msg("Unauthed websocket connecting")
+	d.log().Info().Msg("Unauthed websocket connecting")
 	statusChan := make(chan SignalConnectionStatus, 10000)
 
 	initialConnectChan := make(chan struct{})
@@ -90,45 +95,45 @@ func StartReceiveLoops(ctx context.Context, d *Device) (chan SignalConnectionSta
 		var lastSentStatus SignalConnectionStatus
 		for {
 			if d == nil {
-				zlog.Info().Msg("Device is nil, exiting websocket status loop")
+				d.log().Info().Msg("Device is nil, exiting websocket status loop")
 				return
 			}
 			select {
 			case <-ctx.Done():
-				zlog.Info().Msg("Context done, exiting websocket status loop")
+				d.log().Info().Msg("Context done, exiting websocket status loop")
 				return
 			case status := <-authChan:
 				lastAuthStatus = status
 				currentStatus = status
 
 				if status.Event == web.SignalWebsocketConnectionEventConnected {
-					zlog.Info().Msg("Authed websocket connected")
+					d.log().Info().Msg("Authed websocket connected")
 				} else if status.Event == web.SignalWebsocketConnectionEventDisconnected {
-					zlog.Err(status.Err).Msg("Authed websocket disconnected")
+					d.log().Err(status.Err).Msg("Authed websocket disconnected")
 				} else if status.Event == web.SignalWebsocketConnectionEventLoggedOut {
-					zlog.Err(status.Err).Msg("Authed websocket logged out")
+					d.log().Err(status.Err).Msg("Authed websocket logged out")
 					// TODO: Also make sure unauthed websocket is disconnected
-					//StopReceiveLoops(d)
+					//stopReceiveLoops(d)
 				} else if status.Event == web.SignalWebsocketConnectionEventError {
-					zlog.Err(status.Err).Msg("Authed websocket error")
+					d.log().Err(status.Err).Msg("Authed websocket error")
 				} else if status.Event == web.SignalWebsocketConnectionEventCleanShutdown {
-					zlog.Info().Msg("Authed websocket clean shutdown")
+					d.log().Info().Msg("Authed websocket clean shutdown")
 				}
 			case status := <-unauthChan:
 				lastUnauthStatus = status
 				currentStatus = status
 
 				if status.Event == web.SignalWebsocketConnectionEventConnected {
-					zlog.Info().Msg("Unauthed websocket connected")
-					zlog.Info().Msgf("lastUnauthStatus: %v, lastAuthStatus: %v, currentStatus: %v", lastUnauthStatus, lastAuthStatus, currentStatus)
+					d.log().Info().Msg("Unauthed websocket connected")
+					d.log().Info().Msgf("lastUnauthStatus: %v, lastAuthStatus: %v, currentStatus: %v", lastUnauthStatus, lastAuthStatus, currentStatus)
 				} else if status.Event == web.SignalWebsocketConnectionEventDisconnected {
-					zlog.Err(status.Err).Msg("Unauthed websocket disconnected")
+					d.log().Err(status.Err).Msg("Unauthed websocket disconnected")
 				} else if status.Event == web.SignalWebsocketConnectionEventLoggedOut {
-					zlog.Err(status.Err).Msg("Unauthed websocket logged out ** THIS SHOULD BE IMPOSSIBLE **")
+					d.log().Err(status.Err).Msg("Unauthed websocket logged out ** THIS SHOULD BE IMPOSSIBLE **")
 				} else if status.Event == web.SignalWebsocketConnectionEventError {
-					zlog.Err(status.Err).Msg("Unauthed websocket error")
+					d.log().Err(status.Err).Msg("Unauthed websocket error")
 				} else if status.Event == web.SignalWebsocketConnectionEventCleanShutdown {
-					zlog.Info().Msg("Unauthed websocket clean shutdown")
+					d.log().Info().Msg("Unauthed websocket clean shutdown")
 				}
 			}
 
@@ -162,7 +167,11 @@ func StartReceiveLoops(ctx context.Context, d *Device) (chan SignalConnectionSta
 				}
 			}
 			if statusToSend.Event != 0 && statusToSend.Event != lastSentStatus.Event {
-				zlog.Info().Msgf("Sending connection status: %v", statusToSend)
+				d.log().Info().Msgf("Sending connection status: %v", statusToSend)
+				d.dispatchEvent(&events.ConnectionState{
+					Status: connectionStatusEvents[statusToSend.Event],
+					Err:    statusToSend.Err,
+				})
 				statusChan <- statusToSend
 				lastSentStatus = statusToSend
 			}
@@ -176,9 +185,32 @@ func StartReceiveLoops(ctx context.Context, d *Device) (chan SignalConnectionSta
 			case <-ctx.Done():
 				return
 			case <-initialConnectChan:
-				zlog.Info().Msg("Both websockets connected, sending contacts sync request")
-				SendContactSyncRequest(ctx, d)
-				return
+				if !d.AccountSettings(ctx).ConfigurationSynced {
+					// Probably the first connection after linking, so ask for everything
+					d.log().Info().Msg("Both websockets connected, sending full sync request")
+					sendFullSyncRequest(ctx, d)
+				} else {
+					d.log().Info().Msg("Both websockets connected, sending contacts sync request")
+					sendContactSyncRequest(ctx, d)
+				}
+				if err := d.checkOwnDeviceList(ctx); err != nil {
+					d.log().Warn().Err(err).Msg("Failed to check for new own devices")
+				}
+				// Check the prekey counts now and then, as they're used up by incoming sessions
+				ticker := time.NewTicker(preKeyCountCheckInterval)
+				defer ticker.Stop()
+				for {
+					for _, uuidKind := range []UUIDKind{UUID_KIND_ACI, UUID_KIND_PNI} {
+						if err := checkPreKeyCount(d, uuidKind); err != nil {
+							d.log().Warn().Err(err).Str("uuid_kind", string(uuidKind)).Msg("Failed to check prekey count")
+						}
+					}
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+				}
 			}
 		}
 	}()
@@ -186,7 +218,7 @@ func StartReceiveLoops(ctx context.Context, d *Device) (chan SignalConnectionSta
 	return statusChan, nil
 }
 
-func StopReceiveLoops(d *Device) error {
+func stopReceiveLoops(d *Device) error {
 	defer func() {
 		d.Connection.AuthedWS = nil
 		d.Connection.UnauthedWS = nil
@@ -210,10 +242,10 @@ func checkDecryptionErrorAndDisconnect(err error, device *Device) {
 	if err != nil {
 		if strings.Contains(err.Error(), "30: invalid PreKey message: decryption failed") ||
 			strings.Contains(err.Error(), "70: invalid signed prekey identifier") {
-			zlog.Warn().Msg("Failed decrypting a PreKey message, probably our prekeys are broken, force re-registration")
+			device.log().Warn().Msg("Failed decrypting a PreKey message, probably our prekeys are broken, force re-registration")
 			disconnectErr := device.ClearKeysAndDisconnect()
 			if disconnectErr != nil {
-				zlog.Err(disconnectErr).Msg("ClearKeysAndDisconnect error")
+				device.log().Err(disconnectErr).Msg("ClearKeysAndDisconnect error")
 			}
 		}
 	}
@@ -223,9 +255,9 @@ func (d *Device) incomingRequestHandler(ctx context.Context, req *signalpb.WebSo
 	if *req.Verb == "PUT" && *req.Path == "/api/v1/message" {
 		return d.incomingAPIMessageHandler(ctx, req)
 	} else if *req.Verb == "PUT" && *req.Path == "/api/v1/queue/empty" {
-		zlog.Trace().Msgf("Received queue empty. verb: %v, path: %v", *req.Verb, *req.Path)
+		d.log().Trace().Msgf("Received queue empty. verb: %v, path: %v", *req.Verb, *req.Path)
 	} else {
-		zlog.Warn().Msgf("######## Don't know what I received ########## req: %v", req)
+		d.log().Warn().Msgf("######## Don't know what I received ########## req: %v", req)
 	}
 	return &web.SimpleResponse{
 		Status: 200,
@@ -237,14 +269,15 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 	envelope := &signalpb.Envelope{}
 	err := proto.Unmarshal(req.Body, envelope)
 	if err != nil {
-		zlog.Err(err).Msg("Unmarshal error")
+		d.log().Err(err).Msg("Unmarshal error")
 		return nil, err
 	}
 	var result *DecryptionResult
+	var decryptErr error
 
 	switch *envelope.Type {
 	case signalpb.Envelope_UNIDENTIFIED_SENDER:
-		zlog.Trace().Msgf("Received envelope type UNIDENTIFIED_SENDER, verb: %v, path: %v", *req.Verb, *req.Path)
+		d.log().Trace().Msgf("Received envelope type UNIDENTIFIED_SENDER, verb: %v, path: %v", *req.Verb, *req.Path)
 		ctx := context.Background()
 		usmc, err := libsignalgo.SealedSenderDecryptToUSMC(
 			envelope.GetContent(),
@@ -255,45 +288,46 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 			if err == nil {
 				err = fmt.Errorf("usmc is nil")
 			}
-			zlog.Err(err).Msg("SealedSenderDecryptToUSMC error")
+			d.log().Err(err).Msg("SealedSenderDecryptToUSMC error")
+			d.metrics().DecryptedEnvelope(envelope.Type.String(), decryptionErrorClass(err))
 			return nil, err
 		}
 
 		messageType, err := usmc.GetMessageType()
 		if err != nil {
-			zlog.Err(err).Msg("GetMessageType error")
+			d.log().Err(err).Msg("GetMessageType error")
 		}
 		senderCertificate, err := usmc.GetSenderCertificate()
 		if err != nil {
-			zlog.Err(err).Msg("GetSenderCertificate error")
+			d.log().Err(err).Msg("GetSenderCertificate error")
 		}
 		senderUUID, err := senderCertificate.GetSenderUUID()
 		if err != nil {
-			zlog.Err(err).Msg("GetSenderUUID error")
+			d.log().Err(err).Msg("GetSenderUUID error")
 		}
 		senderDeviceID, err := senderCertificate.GetDeviceID()
 		if err != nil {
-			zlog.Err(err).Msg("GetDeviceID error")
+			d.log().Err(err).Msg("GetDeviceID error")
 		}
 		senderAddress, err := libsignalgo.NewAddress(senderUUID.String(), uint(senderDeviceID))
 		if err != nil {
-			zlog.Err(err).Msg("NewAddress error")
+			d.log().Err(err).Msg("NewAddress error")
 		}
 		senderE164, err := senderCertificate.GetSenderE164()
 		if err != nil {
-			zlog.Err(err).Msg("GetSenderE164 error")
+			d.log().Err(err).Msg("GetSenderE164 error")
 		}
 		usmcContents, err := usmc.GetContents()
 		if err != nil {
-			zlog.Err(err).Msg("GetContents error")
+			d.log().Err(err).Msg("GetContents error")
 		}
-		zlog.Trace().Msgf("SealedSender senderUUID: %v, senderDeviceID: %v", senderUUID, senderDeviceID)
+		d.log().Trace().Msgf("SealedSender senderUUID: %v, senderDeviceID: %v", senderUUID, senderDeviceID)
 
 		d.UpdateContactE164(senderUUID.String(), senderE164)
 
 		switch messageType {
 		case libsignalgo.CiphertextMessageTypeSenderKey:
-			zlog.Trace().Msg("SealedSender messageType is CiphertextMessageTypeSenderKey ")
+			d.log().Trace().Msg("SealedSender messageType is CiphertextMessageTypeSenderKey ")
 			decryptedText, err := libsignalgo.GroupDecrypt(
 				usmcContents,
 				senderAddress,
@@ -302,9 +336,9 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 			)
 			if err != nil {
 				if strings.Contains(err.Error(), "message with old counter") {
-					zlog.Warn().Msg("Duplicate message, ignoring")
+					d.log().Warn().Msg("Duplicate message, ignoring")
 				} else {
-					zlog.Err(err).Msg("GroupDecrypt error")
+					d.log().Err(err).Msg("GroupDecrypt error")
 				}
 			} else {
 				err = stripPadding(&decryptedText)
@@ -314,7 +348,7 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 				content := signalpb.Content{}
 				err = proto.Unmarshal(decryptedText, &content)
 				if err != nil {
-					zlog.Err(err).Msg("Unmarshal error")
+					d.log().Err(err).Msg("Unmarshal error")
 				}
 				result = &DecryptionResult{
 					SenderAddress: *senderAddress,
@@ -324,17 +358,17 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 			}
 
 		case libsignalgo.CiphertextMessageTypePreKey:
-			zlog.Trace().Msg("SealedSender messageType is CiphertextMessageTypePreKey")
+			d.log().Trace().Msg("SealedSender messageType is CiphertextMessageTypePreKey")
 			result, err = prekeyDecrypt(*senderAddress, usmcContents, d, ctx)
 			if err != nil {
-				zlog.Err(err).Msg("prekeyDecrypt error")
+				d.log().Err(err).Msg("prekeyDecrypt error")
 			}
 
 		case libsignalgo.CiphertextMessageTypeWhisper:
-			zlog.Trace().Msg("SealedSender messageType is CiphertextMessageTypeWhisper")
+			d.log().Trace().Msg("SealedSender messageType is CiphertextMessageTypeWhisper")
 			message, err := libsignalgo.DeserializeMessage(usmcContents)
 			if err != nil {
-				zlog.Err(err).Msg("DeserializeMessage error")
+				d.log().Err(err).Msg("DeserializeMessage error")
 			}
 			decryptedText, err := libsignalgo.Decrypt(
 				message,
@@ -344,7 +378,7 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 				libsignalgo.NewCallbackContext(ctx),
 			)
 			if err != nil {
-				zlog.Err(err).Msg("Sealed sender Whisper Decryption error")
+				d.log().Err(err).Msg("Sealed sender Whisper Decryption error")
 			} else {
 				err = stripPadding(&decryptedText)
 				if err != nil {
@@ -353,7 +387,7 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 				content := signalpb.Content{}
 				err = proto.Unmarshal(decryptedText, &content)
 				if err != nil {
-					zlog.Err(err).Msg("Unmarshal error")
+					d.log().Err(err).Msg("Unmarshal error")
 				}
 				result = &DecryptionResult{
 					SenderAddress: *senderAddress,
@@ -363,22 +397,22 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 			}
 
 		case libsignalgo.CiphertextMessageTypePlaintext:
-			zlog.Debug().Msg("SealedSender messageType is CiphertextMessageTypePlaintext")
+			d.log().Debug().Msg("SealedSender messageType is CiphertextMessageTypePlaintext")
 			// TODO: handle plaintext (usually DecryptionErrorMessage) and retries
 			// when implementing SenderKey groups
 
 			//plaintextContent, err := libsignalgo.DeserializePlaintextContent(usmcContents)
 			//if err != nil {
-			//	zlog.Err(err).Msg("DeserializePlaintextContent error")
+			//	d.log().Err(err).Msg("DeserializePlaintextContent error")
 			//}
 			//body, err := plaintextContent.GetBody()
 			//if err != nil {
-			//	zlog.Err(err).Msg("PlaintextContent GetBody error")
+			//	d.log().Err(err).Msg("PlaintextContent GetBody error")
 			//}
 			//content := signalpb.Content{}
 			//err = proto.Unmarshal(body, &content)
 			//if err != nil {
-			//	zlog.Err(err).Msg("PlaintextContent Unmarshal error")
+			//	d.log().Err(err).Msg("PlaintextContent Unmarshal error")
 			//}
 			//result = &DecryptionResult{
 			//	SenderAddress: *senderAddress,
@@ -391,28 +425,29 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 			}, nil
 
 		default:
-			zlog.Warn().Msg("SealedSender messageType is unknown")
+			d.log().Warn().Msg("SealedSender messageType is unknown")
 		}
 
 		// If we couldn't decrypt with specific decryption methods, try sealedSenderDecrypt
 		if result == nil || responseCode != 200 {
-			zlog.Debug().Msg("Didn't decrypt with specific methods, trying sealedSenderDecrypt")
+			d.log().Debug().Msg("Didn't decrypt with specific methods, trying sealedSenderDecrypt")
 			var err error
 			result, err = sealedSenderDecrypt(envelope, d, ctx)
+			decryptErr = err
 			if err != nil {
 				if strings.Contains(err.Error(), "self send of a sealed sender message") {
-					zlog.Debug().Msg("Message sent by us, ignoring")
+					d.log().Debug().Msg("Message sent by us, ignoring")
 				} else {
-					zlog.Err(err).Msg("sealedSenderDecrypt error")
+					d.log().Err(err).Msg("sealedSenderDecrypt error")
 					checkDecryptionErrorAndDisconnect(err, d)
 				}
 			} else {
-				zlog.Trace().Msgf("SealedSender decrypt result - address: %v, content: %v", result.SenderAddress, result.Content)
+				d.log().Trace().Msgf("SealedSender decrypt result - address: %v, content: %v", result.SenderAddress, result.Content)
 			}
 		}
 
 	case signalpb.Envelope_PREKEY_BUNDLE:
-		zlog.Debug().Msgf("Received envelope type PREKEY_BUNDLE, verb: %v, path: %v", *req.Verb, *req.Path)
+		d.log().Debug().Msgf("Received envelope type PREKEY_BUNDLE, verb: %v, path: %v", *req.Verb, *req.Path)
 		sender, err := libsignalgo.NewAddress(
 			*envelope.SourceServiceId,
 			uint(*envelope.SourceDevice),
@@ -421,21 +456,22 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 			return nil, fmt.Errorf("NewAddress error: %v", err)
 		}
 		result, err = prekeyDecrypt(*sender, envelope.Content, d, ctx)
+		decryptErr = err
 		if err != nil {
-			zlog.Err(err).Msg("prekeyDecrypt error")
+			d.log().Err(err).Msg("prekeyDecrypt error")
 			checkDecryptionErrorAndDisconnect(err, d)
 		} else {
-			zlog.Trace().Msgf("prekey decrypt result -  address: %v, data: %v", result.SenderAddress, result.Content)
+			d.log().Trace().Msgf("prekey decrypt result -  address: %v, data: %v", result.SenderAddress, result.Content)
 		}
 
 	case signalpb.Envelope_PLAINTEXT_CONTENT:
-		zlog.Debug().Msgf("Received envelope type PLAINTEXT_CONTENT, verb: %v, path: %v", *req.Verb, *req.Path)
+		d.log().Debug().Msgf("Received envelope type PLAINTEXT_CONTENT, verb: %v, path: %v", *req.Verb, *req.Path)
 
 	case signalpb.Envelope_CIPHERTEXT:
-		zlog.Debug().Msgf("Received envelope type CIPHERTEXT, verb: %v, path: %v", *req.Verb, *req.Path)
+		d.log().Debug().Msgf("Received envelope type CIPHERTEXT, verb: %v, path: %v", *req.Verb, *req.Path)
 		message, err := libsignalgo.DeserializeMessage(envelope.Content)
 		if err != nil {
-			zlog.Err(err).Msg("DeserializeMessage error")
+			d.log().Err(err).Msg("DeserializeMessage error")
 		}
 		senderAddress, err := libsignalgo.NewAddress(
 			*envelope.SourceServiceId,
@@ -448,11 +484,12 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 			d.IdentityStore,
 			libsignalgo.NewCallbackContext(ctx),
 		)
+		decryptErr = err
 		if err != nil {
 			if strings.Contains(err.Error(), "message with old counter") {
-				zlog.Info().Msg("Duplicate message, ignoring")
+				d.log().Info().Msg("Duplicate message, ignoring")
 			} else {
-				zlog.Err(err).Msg("Whisper Decryption error")
+				d.log().Err(err).Msg("Whisper Decryption error")
 			}
 		} else {
 			err = stripPadding(&decryptedText)
@@ -462,7 +499,7 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 			content := signalpb.Content{}
 			err = proto.Unmarshal(decryptedText, &content)
 			if err != nil {
-				zlog.Err(err).Msg("Unmarshal error")
+				d.log().Err(err).Msg("Unmarshal error")
 			}
 			result = &DecryptionResult{
 				SenderAddress: *senderAddress,
@@ -471,38 +508,47 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 		}
 
 	case signalpb.Envelope_RECEIPT:
-		zlog.Debug().Msgf("Received envelope type RECEIPT, verb: %v, path: %v", *req.Verb, *req.Path)
+		d.log().Debug().Msgf("Received envelope type RECEIPT, verb: %v, path: %v", *req.Verb, *req.Path)
 		// TODO: handle receipt
 
 	case signalpb.Envelope_KEY_EXCHANGE:
-		zlog.Debug().Msgf("Received envelope type KEY_EXCHANGE, verb: %v, path: %v", *req.Verb, *req.Path)
+		d.log().Debug().Msgf("Received envelope type KEY_EXCHANGE, verb: %v, path: %v", *req.Verb, *req.Path)
 		responseCode = 400
 
 	case signalpb.Envelope_UNKNOWN:
-		zlog.Warn().Msgf("Received envelope type UNKNOWN, verb: %v, path: %v", *req.Verb, *req.Path)
+		d.log().Warn().Msgf("Received envelope type UNKNOWN, verb: %v, path: %v", *req.Verb, *req.Path)
 		responseCode = 400
 
 	default:
-		zlog.Warn().Msgf("Received actual unknown envelope type, verb: %v, path: %v", *req.Verb, *req.Path)
+		d.log().Warn().Msgf("Received actual unknown envelope type, verb: %v, path: %v", *req.Verb, *req.Path)
 		responseCode = 400
 	}
 
+	switch *envelope.Type {
+	case signalpb.Envelope_UNIDENTIFIED_SENDER, signalpb.Envelope_PREKEY_BUNDLE, signalpb.Envelope_CIPHERTEXT:
+		errorClass := decryptionErrorClass(decryptErr)
+		if errorClass == "" && (result == nil || result.Content == nil) {
+			errorClass = "other"
+		}
+		d.metrics().DecryptedEnvelope(envelope.Type.String(), errorClass)
+	}
+
 	// Handle content that is now decrypted
 	if result != nil && result.Content != nil {
 		content := result.Content
 
 		name, _ := result.SenderAddress.Name()
 		deviceId, _ := result.SenderAddress.DeviceID()
-		zlog.Debug().Msgf("Decrypted message from %v:%v", name, deviceId)
+		d.log().Debug().Msgf("Decrypted message from %v:%v", name, deviceId)
 		printMessage := fmt.Sprintf("Decrypted content fields (%v:%v)", name, deviceId)
-		printContentFieldString(content, printMessage)
+		printContentFieldString(d.log(), content, printMessage)
 
 		// If there's a sender key distribution message, process it
 		if content.GetSenderKeyDistributionMessage() != nil {
-			zlog.Debug().Msg("content includes sender key distribution message")
+			d.log().Debug().Msg("content includes sender key distribution message")
 			skdm, err := libsignalgo.DeserializeSenderKeyDistributionMessage(content.GetSenderKeyDistributionMessage())
 			if err != nil {
-				zlog.Err(err).Msg("DeserializeSenderKeyDistributionMessage error")
+				d.log().Err(err).Msg("DeserializeSenderKeyDistributionMessage error")
 				return nil, err
 			}
 			err = libsignalgo.ProcessSenderKeyDistributionMessage(
@@ -512,186 +558,59 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 				libsignalgo.NewCallbackContext(ctx),
 			)
 			if err != nil {
-				zlog.Err(err).Msg("ProcessSenderKeyDistributionMessage error")
+				d.log().Err(err).Msg("ProcessSenderKeyDistributionMessage error")
 				return nil, err
 			}
 		}
 
 		theirUuid, err := result.SenderAddress.Name()
 		if err != nil {
-			zlog.Err(err).Msg("Name error")
+			d.log().Err(err).Msg("Name error")
 			return nil, err
 		}
 
-		// TODO: handle more sync messages
-		if content.SyncMessage != nil {
-			if content.SyncMessage.Sent != nil {
-				if content.SyncMessage.Sent.Message != nil {
-					destination := content.SyncMessage.Sent.DestinationServiceId
-					if content.SyncMessage.Sent.Message.GroupV2 != nil {
-						zlog.Debug().Msgf("sync message sent group: %v", content.SyncMessage.Sent.Message.GroupV2)
-						masterKeyBytes := libsignalgo.GroupMasterKey(content.SyncMessage.Sent.Message.GroupV2.MasterKey)
-						masterKey := masterKeyFromBytes(masterKeyBytes)
-						gid, err := StoreMasterKey(ctx, d, masterKey)
-						if err != nil {
-							zlog.Err(err).Msg("StoreMasterKey error")
-							return nil, err
-						}
-						g := string(gid)
-						destination = &g
-					}
-					if destination == nil {
-						zlog.Warn().Msg("sync message sent destination is nil")
-					} else if _, err = incomingDataMessage(ctx, d, content.SyncMessage.Sent.Message, d.Data.AciUuid, *destination); err != nil {
-						zlog.Err(err).Msg("incomingDataMessage error")
-						return nil, err
-					}
-				}
-			}
-			if content.SyncMessage.Contacts != nil {
-				zlog.Debug().Msgf("Recieved sync message contacts")
-				blob := content.SyncMessage.Contacts.Blob
-				if blob != nil {
-					contactsBytes, err := fetchAndDecryptAttachment(blob)
-					if err != nil {
-						zlog.Err(err).Msg("Contacts Sync fetchAndDecryptAttachment error")
-					}
-					// unmarshall contacts
-					contacts, avatars, err := unmarshalContactDetailsMessages(contactsBytes)
-					if err != nil {
-						zlog.Err(err).Msg("Contacts Sync unmarshalContactDetailsMessages error")
-					}
-					zlog.Debug().Msgf("Contacts Sync received %v contacts", len(contacts))
-					for i, signalContact := range contacts {
-						if signalContact.Aci == nil || *signalContact.Aci == "" {
-							zlog.Info().Msgf("Signal Contact UUID is nil, skipping: %v", signalContact)
-							continue
-						}
-						if _, err := uuid.Parse(*signalContact.Aci); err != nil {
-							zlog.Info().Msgf("Signal Contact UUID is not a UUID, skipping: %v", signalContact)
-							continue
-						}
-						contact, contactAvatar, err := StoreContactDetailsAsContact(d, signalContact, &avatars[i])
-						if err != nil {
-							zlog.Err(err).Msg("StoreContactDetailsAsContact error")
-							continue
-						}
-						// Model each contact as an incoming contact change message
-						contactChange := IncomingSignalMessageContactChange{
-							IncomingSignalMessageBase: IncomingSignalMessageBase{
-								SenderUUID:    contact.UUID,
-								RecipientUUID: d.Data.AciUuid,
-								Timestamp:     currentMessageTimestamp(),
-							},
-							Contact: contact,
-							Avatar:  contactAvatar,
-						}
-						d.Connection.IncomingSignalMessageHandler(contactChange)
-					}
-				}
+		if theirUuid == d.Data.AciUuid {
+			// Sync messages come from our other devices, which may have been linked while we were offline
+			if err = d.checkNewOwnDevices(ctx, []int{int(deviceId)}); err != nil {
+				d.log().Err(err).Msg("Failed to check for new own devices")
 			}
-			if content.SyncMessage.Read != nil {
-				zlog.Debug().Msgf("Recieved sync message read")
-				currentTimestamp := currentMessageTimestamp()
-				for _, read := range content.SyncMessage.Read {
-					var receiptMessage = IncomingSignalMessageReceipt{
-						IncomingSignalMessageBase: IncomingSignalMessageBase{
-							SenderUUID:    d.Data.AciUuid,
-							RecipientUUID: theirUuid,
-							Timestamp:     currentTimestamp, // there is no timestmap on a receiptMessage
-						},
-						ReceiptType:       IncomingSignalMessageReceiptTypeRead,
-						OriginalTimestamp: *read.Timestamp,
-						OriginalSender:    *read.SenderAci,
-					}
-					d.Connection.IncomingSignalMessageHandler(receiptMessage)
-				}
-			}
-
 		}
 
-		if content.DataMessage != nil {
-			deliveredTimestamps, err := incomingDataMessage(ctx, d, content.DataMessage, theirUuid, d.Data.AciUuid)
-			if err != nil {
-				zlog.Err(err).Msg("incomingDataMessage error")
-				return nil, err
-			}
-			if len(deliveredTimestamps) > 0 {
-				err := sendDeliveryReceipts(ctx, d, deliveredTimestamps, theirUuid)
-				if err != nil {
-					zlog.Err(err).Msg("sendDeliveryReceipts error")
-				}
+		if content.GetTypingMessage() != nil {
+			// Typing notifications are stale by the time a retry would happen, so they're handled right away
+			// without saving them. Losing one only means the typing status isn't shown.
+			if err = d.handleDecryptedContent(ctx, theirUuid, content, &contentDispatch{}); err != nil {
+				d.log().Err(err).Msg("Failed to handle typing notification")
 			}
+			return &web.SimpleResponse{Status: responseCode}, nil
 		}
 
-		if content.TypingMessage != nil {
-			var isTyping = content.TypingMessage.GetAction() == signalpb.TypingMessage_STARTED
-			var typingMessage = IncomingSignalMessageTyping{
-				IncomingSignalMessageBase: IncomingSignalMessageBase{
-					SenderUUID:    theirUuid,
-					RecipientUUID: d.Data.AciUuid,
-					Timestamp:     content.TypingMessage.GetTimestamp(),
-				},
-				IsTyping: isTyping,
-			}
-			if content.TypingMessage.GetGroupId() != nil {
-				gidBytes := content.TypingMessage.GetGroupId()
-				gid := GroupIdentifier(base64.StdEncoding.EncodeToString(gidBytes))
-				typingMessage.GroupID = &gid
-			}
-
-			d.Connection.IncomingSignalMessageHandler(typingMessage)
+		// Save the content before acknowledging it, so it isn't lost if handling it fails
+		contentBytes, err := proto.Marshal(content)
+		if err != nil {
+			d.log().Err(err).Msg("Marshal error")
+			return nil, err
 		}
-
-		// DM call message (group call is an opaque callMessage and a groupCallUpdate in a dataMessage)
-		if content.CallMessage != nil && (content.CallMessage.Offer != nil || content.CallMessage.Hangup != nil) {
-			callMessage := IncomingSignalMessageCall{
-				IncomingSignalMessageBase: IncomingSignalMessageBase{
-					SenderUUID:    theirUuid,
-					RecipientUUID: d.Data.AciUuid,
-					Timestamp:     currentMessageTimestamp(), // there is no timestmap on a callMessage
-				},
-			}
-			if content.CallMessage.Offer != nil {
-				callMessage.IsRinging = true
-			} else if content.CallMessage.Hangup != nil {
-				callMessage.IsRinging = false
-			}
-			d.Connection.IncomingSignalMessageHandler(callMessage)
+		entry := &InboxEntry{
+			SenderACI:    theirUuid,
+			SenderDevice: int(deviceId),
+			Timestamp:    envelope.GetTimestamp(),
+			Content:      contentBytes,
+			ReceivedAt:   time.Now(),
 		}
-
-		// Read and delivery receipts
-		if content.ReceiptMessage != nil {
-			zlog.Debug().Msgf("Received receipt message: %v", content.ReceiptMessage)
-			// If this is a delivery receipt from one of our other devices, ignore it
-			if !(*content.ReceiptMessage.Type == signalpb.ReceiptMessage_DELIVERY && theirUuid == d.Data.AciUuid) {
-				var receiptType IncomingSignalMessageReceiptType
-				switch *content.ReceiptMessage.Type {
-				case signalpb.ReceiptMessage_READ:
-					receiptType = IncomingSignalMessageReceiptTypeRead
-				case signalpb.ReceiptMessage_DELIVERY:
-					receiptType = IncomingSignalMessageReceiptTypeDelivery
-				default:
-					zlog.Warn().Msgf("Unknown receipt type: %v", *content.ReceiptMessage.Type)
-				}
-				currentTimestamp := currentMessageTimestamp()
-				// Send one incoming message for each timestamp, so they can be sent to different portals if necessary
-				for _, timestamp := range content.ReceiptMessage.Timestamp {
-					var receiptMessage = IncomingSignalMessageReceipt{
-						IncomingSignalMessageBase: IncomingSignalMessageBase{
-							SenderUUID:    theirUuid,
-							RecipientUUID: d.Data.AciUuid,
-							Timestamp:     currentTimestamp, // there is no timestmap on a receiptMessage
-						},
-						ReceiptType:       receiptType,
-						OriginalTimestamp: timestamp,
-						OriginalSender:    d.Data.AciUuid, // this is a receipt for a message we sent
-					}
-					d.Connection.IncomingSignalMessageHandler(receiptMessage)
-				}
-			} else {
-				zlog.Debug().Msgf("Ignoring delivery receipt from self")
-			}
+		inserted, err := d.InboxStore.PutInboxEntry(ctx, entry)
+		if err != nil {
+			// The session has already advanced past this message, so it couldn't be decrypted again if the
+			// server resent it. Handle it from memory instead, which only loses it if the process exits first.
+			d.log().Err(err).Msg("Failed to save message to inbox, handling it without saving")
+		} else if !inserted {
+			d.log().Debug().Msgf("Message from %v at %v was already received, ignoring", theirUuid, envelope.GetTimestamp())
+			return &web.SimpleResponse{Status: responseCode}, nil
+		}
+		if err = d.Connection.inbox.pushReceived(ctx, entry, content); err != nil {
+			// The queue is only stopped when disconnecting, the saved message will be handled after reconnecting
+			d.log().Err(err).Msg("Failed to queue message")
+			return nil, err
 		}
 	}
 	return &web.SimpleResponse{
@@ -699,6 +618,114 @@ func (d *Device) incomingAPIMessageHandler(ctx context.Context, req *signalpb.We
 	}, nil
 }
 
+// handleDecryptedContent handles a message from the inbox. If an error is returned, handling the message
+// is retried later with the same dispatch, so the side effects of the message aren't repeated and
+// only the handlers that failed are called again.
+func (d *Device) handleDecryptedContent(ctx context.Context, theirUuid string, content *signalpb.Content, cd *contentDispatch) error {
+	if d.isBlockedContent(ctx, theirUuid, content) {
+		d.log().Debug().Str("sender", theirUuid).Msg("Dropping content from blocked user or group")
+		return nil
+	}
+	if !cd.prepared {
+		evts, err := d.prepareContent(ctx, theirUuid, content)
+		if err != nil {
+			return err
+		}
+		cd.events = evts
+		cd.prepared = true
+	}
+	if !cd.dispatch(d) {
+		return errEventHandlerFailed
+	}
+	// Messages are only acknowledged as delivered once they've been handled
+	if dataMessage := content.GetDataMessage(); dataMessage != nil && len(cd.events) > 0 {
+		err := sendDeliveryReceipts(ctx, d, []uint64{dataMessage.GetTimestamp()}, theirUuid)
+		if err != nil {
+			d.log().Err(err).Msg("sendDeliveryReceipts error")
+		}
+	}
+	return nil
+}
+
+// prepareContent does everything an incoming message needs besides calling event handlers, like storing
+// keys and catching up with group changes, and returns the events to dispatch for the message.
+func (d *Device) prepareContent(ctx context.Context, theirUuid string, content *signalpb.Content) ([]any, error) {
+	var evts []any
+	if sentMessage := content.GetSyncMessage().GetSent().GetMessage(); sentMessage != nil {
+		groupEvts, err := d.prepareDataMessage(ctx, sentMessage, d.Data.AciUuid)
+		if err != nil {
+			d.log().Err(err).Msg("prepareDataMessage error for sync message")
+			return nil, err
+		}
+		evts = append(evts, groupEvts...)
+	}
+	if content.DataMessage != nil {
+		groupEvts, err := d.prepareDataMessage(ctx, content.DataMessage, theirUuid)
+		if err != nil {
+			d.log().Err(err).Msg("prepareDataMessage error")
+			return nil, err
+		}
+		evts = append(evts, groupEvts...)
+	}
+	evts = append(evts, d.contentEvents(theirUuid, content)...)
+
+	// TODO: handle more sync messages
+	if syncMessage := content.GetSyncMessage(); syncMessage != nil {
+		if syncMessage.Contacts != nil {
+			evts = append(evts, d.syncContactEvents(syncMessage.Contacts)...)
+		}
+		if syncMessage.Blocked != nil {
+			handleSyncBlocked(ctx, d, syncMessage.Blocked)
+		}
+		if syncMessage.Configuration != nil {
+			handleSyncConfiguration(ctx, d, syncMessage.Configuration)
+		}
+		if syncMessage.Keys != nil {
+			handleSyncKeys(ctx, d, syncMessage.Keys)
+		}
+		if syncMessage.FetchLatest != nil {
+			handleSyncFetchLatest(ctx, d, syncMessage.FetchLatest)
+		}
+	}
+	return evts, nil
+}
+
+// syncContactEvents stores the contacts from a contact sync and returns a ContactChange event for each of them.
+func (d *Device) syncContactEvents(syncContacts *signalpb.SyncMessage_Contacts) []any {
+	d.log().Debug().Msgf("Recieved sync message contacts")
+	if syncContacts.Blob == nil {
+		return nil
+	}
+	contactsBytes, err := fetchAndDecryptAttachment(d.web(), syncContacts.Blob)
+	if err != nil {
+		d.log().Err(err).Msg("Contacts Sync fetchAndDecryptAttachment error")
+		return nil
+	}
+	contacts, avatars, err := unmarshalContactDetailsMessages(contactsBytes)
+	if err != nil {
+		d.log().Err(err).Msg("Contacts Sync unmarshalContactDetailsMessages error")
+	}
+	d.log().Debug().Msgf("Contacts Sync received %v contacts", len(contacts))
+	var evts []any
+	for i, signalContact := range contacts {
+		if signalContact.Aci == nil || *signalContact.Aci == "" {
+			d.log().Info().Msgf("Signal Contact UUID is nil, skipping: %v", signalContact)
+			continue
+		}
+		if _, err := uuid.Parse(*signalContact.Aci); err != nil {
+			d.log().Info().Msgf("Signal Contact UUID is not a UUID, skipping: %v", signalContact)
+			continue
+		}
+		_, _, err := storeContactDetailsAsContact(d, signalContact, &avatars[i])
+		if err != nil {
+			d.log().Err(err).Msg("storeContactDetailsAsContact error")
+			continue
+		}
+		evts = append(evts, &events.ContactChange{Contact: signalContact, Avatar: avatars[i]})
+	}
+	return evts
+}
+
 func printStructFields(message protoreflect.Message, parent string, builder *strings.Builder) {
 	message.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
 		fieldName := string(fd.Name())
@@ -731,15 +758,15 @@ func printStructFields(message protoreflect.Message, parent string, builder *str
 	})
 }
 
-func printContentFieldString(c *signalpb.Content, message string) {
+func printContentFieldString(log *zerolog.Logger, c *signalpb.Content, message string) {
 	go func() {
 		// catch panic
 		defer func() {
 			if r := recover(); r != nil {
-				zlog.Warn().Msgf("Panic in contentFieldsString: %v", r)
+				log.Warn().Msgf("Panic in contentFieldsString: %v", r)
 			}
 		}()
-		zlog.Debug().Msgf("%v: %v", message, contentFieldsString(c))
+		log.Debug().Msgf("%v: %v", message, contentFieldsString(c))
 	}()
 }
 
@@ -749,313 +776,79 @@ func contentFieldsString(c *signalpb.Content) string {
 	return builder.String()
 }
 
-// HackyCaptionToggle is a hack to pass the bridge caption_in_message config option to the library.
-// This won't be necessary after the redundant DataMessage -> custom struct conversion is removed
-// (messages should just be converted DataMessage -> Matrix instead of DataMessage -> custom struct -> Matrix).
-var HackyCaptionToggle bool
-
-func incomingDataMessage(ctx context.Context, device *Device, dataMessage *signalpb.DataMessage, senderUUID string, recipientUUID string) ([]uint64, error) {
-	deliveredTimestamps := make([]uint64, 0)
-
+// prepareDataMessage stores the keys in a data message and catches up with the group if the message says
+// it has changed. The events for the changes to the group are returned, the rest of the message is
+// converted into events by contentEvents.
+func (d *Device) prepareDataMessage(ctx context.Context, dataMessage *signalpb.DataMessage, senderUUID string) ([]any, error) {
 	// If there's a profile key, save it
 	if dataMessage.ProfileKey != nil {
 		profileKey := libsignalgo.ProfileKey(dataMessage.ProfileKey)
-		err := device.ProfileKeyStore.StoreProfileKey(senderUUID, profileKey, ctx)
-		if err != nil {
-			zlog.Err(err).Msg("StoreProfileKey error")
-			return deliveredTimestamps, err
-		}
-	}
-
-	var incomingMessages []IncomingSignalMessage
-
-	// If it's a group message, get the ID and invalidate cache if necessary
-	var gidPointer *GroupIdentifier
-	if dataMessage.GetGroupV2() != nil {
-		// Pull out the master key then store it ASAP - we should pass around GroupIdentifier
-		groupMasterKeyBytes := dataMessage.GetGroupV2().GetMasterKey()
-		masterKey := masterKeyFromBytes(libsignalgo.GroupMasterKey(groupMasterKeyBytes))
-		gidValue, err := StoreMasterKey(ctx, device, masterKey)
+		err := d.ProfileKeyStore.StoreProfileKey(senderUUID, profileKey, ctx)
 		if err != nil {
-			zlog.Err(err).Msg("StoreMasterKey error")
-			return deliveredTimestamps, err
-		}
-		gidPointer = &gidValue
-
-		var groupHasChanged = false
-		if dataMessage.GetGroupV2().GroupChange != nil {
-			// TODO: don't parse the change	for now, just invalidate our cache
-			zlog.Debug().Msgf("Invalidating group %v due to change: %v", gidValue, dataMessage.GetGroupV2().GroupChange)
-			InvalidateGroupCache(device, gidValue)
-			groupHasChanged = true
-		} else if dataMessage.GetGroupV2().GetRevision() > 0 {
-			// Compare revision, and if it's newer, invalidate our cache
-			ourGroup, err := RetrieveGroupByID(ctx, device, gidValue)
-			if err != nil {
-				zlog.Err(err).Msg("RetrieveGroupByID error")
-			} else if dataMessage.GetGroupV2().GetRevision() > ourGroup.Revision {
-				zlog.Debug().Msgf("Invalidating group %v due to new revision %v > our revision: %v", gidValue, dataMessage.GetGroupV2().GetRevision(), ourGroup.Revision)
-				InvalidateGroupCache(device, gidValue)
-				groupHasChanged = true
-			}
-		}
-		if groupHasChanged {
-			// Send a group change message to trigger a group update in the portal
-			groupChangeMessage := &IncomingSignalMessageGroupChange{
-				IncomingSignalMessageBase: IncomingSignalMessageBase{
-					SenderUUID:    senderUUID,
-					RecipientUUID: recipientUUID,
-					GroupID:       gidPointer,
-					Timestamp:     dataMessage.GetTimestamp(),
-				},
-			}
-			incomingMessages = append(incomingMessages, groupChangeMessage)
-		}
-	}
-
-	// Grab quote (reply) info if it exists
-	var quoteData *IncomingSignalMessageQuoteData
-	if dataMessage.Quote != nil {
-		quoteData = &IncomingSignalMessageQuoteData{
-			QuotedSender:    dataMessage.GetQuote().GetAuthorAci(),
-			QuotedTimestamp: dataMessage.GetQuote().GetId(),
+			d.log().Err(err).Msg("StoreProfileKey error")
+			return nil, err
 		}
 	}
-
-	// If this message is disappearing, set ExpiresIn
-	expiresIn := int64(0)
-	if dataMessage.ExpireTimer != nil {
-		expiresIn = int64(dataMessage.GetExpireTimer())
+	if dataMessage.GetGroupV2() == nil {
+		return nil, nil
 	}
 
-	partIndex := 0
-	// If there's attachements, handle them (one at a time for now)
-	if dataMessage.Attachments != nil {
-		for index, attachmentPointer := range dataMessage.Attachments {
-			bytes, err := fetchAndDecryptAttachment(attachmentPointer)
-			if err != nil {
-				zlog.Err(err).Msg("fetchAndDecryptAttachment error")
-				continue
-			}
-			// TODO: right now this will be one message per image, each with the same caption
-			incomingMessage := IncomingSignalMessageAttachment{
-				IncomingSignalMessageBase: IncomingSignalMessageBase{
-					SenderUUID:    senderUUID,
-					RecipientUUID: recipientUUID,
-					GroupID:       gidPointer,
-					Timestamp:     dataMessage.GetTimestamp(),
-					PartIndex:     partIndex,
-					Quote:         quoteData,
-					ExpiresIn:     expiresIn,
-				},
-				Attachment:  bytes,
-				Filename:    attachmentPointer.GetFileName(),
-				ContentType: attachmentPointer.GetContentType(),
-				Size:        uint64(attachmentPointer.GetSize()),
-				Width:       attachmentPointer.GetWidth(),
-				Height:      attachmentPointer.GetHeight(),
-				BlurHash:    attachmentPointer.GetBlurHash(),
-			}
-			partIndex++
-			if HackyCaptionToggle && index == 0 {
-				incomingMessage.Caption = dataMessage.GetBody()
-				incomingMessage.CaptionRanges = dataMessage.GetBodyRanges()
-			}
-			incomingMessages = append(incomingMessages, incomingMessage)
-		}
+	// Pull out the master key then store it ASAP - we should pass around GroupIdentifier
+	groupMasterKeyBytes := dataMessage.GetGroupV2().GetMasterKey()
+	masterKey := masterKeyFromBytes(libsignalgo.GroupMasterKey(groupMasterKeyBytes))
+	gid, err := storeMasterKey(ctx, d, masterKey)
+	if err != nil {
+		d.log().Err(err).Msg("storeMasterKey error")
+		return nil, err
 	}
 
-	// If there's a body but no attachments, pass along as a text message
-	if dataMessage.Body != nil && (dataMessage.Attachments == nil || !HackyCaptionToggle) {
-		incomingMessage := IncomingSignalMessageText{
-			IncomingSignalMessageBase: IncomingSignalMessageBase{
-				SenderUUID:    senderUUID,
-				RecipientUUID: recipientUUID,
-				GroupID:       gidPointer,
-				Timestamp:     dataMessage.GetTimestamp(),
-				PartIndex:     partIndex,
-				Quote:         quoteData,
-				ExpiresIn:     expiresIn,
-			},
-			Content:       dataMessage.GetBody(),
-			ContentRanges: dataMessage.GetBodyRanges(),
+	// Compare revision, and if it's newer than the stored group, catch up using the group change log.
+	// Group changes we already know about (e.g. ones we made ourselves) don't need a refetch.
+	groupHasChanged := dataMessage.GetGroupV2().GroupChange != nil
+	var groupChanges []*GroupChange
+	ourGroup, err := retrieveGroupByID(ctx, d, gid)
+	if err != nil {
+		d.log().Err(err).Msg("retrieveGroupByID error")
+		if groupHasChanged {
+			invalidateGroupCache(ctx, d, gid)
 		}
-		partIndex++
-		incomingMessages = append(incomingMessages, incomingMessage)
-	}
-
-	// if a sticker and has data, send it
-	if dataMessage.Sticker != nil && dataMessage.Sticker.Data != nil {
-		bytes, err := fetchAndDecryptAttachment(dataMessage.Sticker.Data)
+	} else if dataMessage.GetGroupV2().GetRevision() > ourGroup.Revision {
+		d.log().Debug().Msgf("Updating group %v due to new revision %v > our revision: %v", gid, dataMessage.GetGroupV2().GetRevision(), ourGroup.Revision)
+		groupChanges, err = updateGroupFromChangeLog(ctx, d, ourGroup)
 		if err != nil {
-			zlog.Error().Err(err).Msgf("failed to decrypt sticker: %v", dataMessage.Sticker.Data)
-		} else {
-			incomingMessage := IncomingSignalMessageSticker{
-				IncomingSignalMessageBase: IncomingSignalMessageBase{
-					SenderUUID:    senderUUID,
-					RecipientUUID: recipientUUID,
-					GroupID:       gidPointer,
-					Timestamp:     dataMessage.GetTimestamp(),
-					PartIndex:     partIndex,
-					Quote:         quoteData,
-					ExpiresIn:     expiresIn,
-				},
-				Width:       dataMessage.Sticker.Data.GetWidth(),
-				Height:      dataMessage.Sticker.Data.GetHeight(),
-				ContentType: dataMessage.Sticker.Data.GetContentType(),
-				Filename:    dataMessage.Sticker.Data.GetFileName(),
-				Sticker:     bytes,
-				Emoji:       dataMessage.GetSticker().GetEmoji(),
-			}
-			incomingMessages = append(incomingMessages, incomingMessage)
-			partIndex++
+			d.log().Warn().Err(err).Str("gid", string(gid)).Msg("Failed to apply group change log, refetching whole group")
+			invalidateGroupCache(ctx, d, gid)
 		}
+		groupHasChanged = true
 	}
 
-	// Pass along reactions
-	if dataMessage.Reaction != nil {
-		// make sure target author UUID is lowercase
-		targetAuthor := strings.ToLower(dataMessage.GetReaction().GetTargetAuthorAci())
-		incomingMessage := IncomingSignalMessageReaction{
-			IncomingSignalMessageBase: IncomingSignalMessageBase{
-				SenderUUID:    senderUUID,
-				RecipientUUID: recipientUUID,
-				GroupID:       gidPointer,
-				Timestamp:     dataMessage.GetTimestamp(),
-				Quote:         quoteData,
-				ExpiresIn:     expiresIn,
-			},
-			Emoji:                  dataMessage.GetReaction().GetEmoji(),
-			Remove:                 dataMessage.GetReaction().GetRemove(),
-			TargetAuthorUUID:       targetAuthor,
-			TargetMessageTimestamp: dataMessage.GetReaction().GetTargetSentTimestamp(),
+	// Send one event per revision, so that who changed what can be bridged
+	var evts []any
+	for _, change := range groupChanges {
+		changeSender := change.SourceACI
+		if changeSender == "" {
+			changeSender = senderUUID
 		}
-		incomingMessages = append(incomingMessages, incomingMessage)
+		evts = append(evts, groupRevisionEvent(changeSender, dataMessage.GetTimestamp(), change))
 	}
-
-	// Pass along deletions
-	if dataMessage.Delete != nil {
-		incomingMessage := IncomingSignalMessageDelete{
-			IncomingSignalMessageBase: IncomingSignalMessageBase{
-				SenderUUID:    senderUUID,
-				RecipientUUID: recipientUUID,
-				GroupID:       gidPointer,
-				Timestamp:     dataMessage.GetTimestamp(),
-				Quote:         quoteData,
-				ExpiresIn:     expiresIn,
-			},
-			TargetMessageTimestamp: dataMessage.GetDelete().GetTargetSentTimestamp(),
-		}
-		incomingMessages = append(incomingMessages, incomingMessage)
-	}
-
-	// Pass along group calls
-	if dataMessage.GroupCallUpdate != nil {
-		isRinging := device.UpdateActiveCalls(*gidPointer, *dataMessage.GroupCallUpdate.EraId)
-		incomingMessage := IncomingSignalMessageCall{
-			IncomingSignalMessageBase: IncomingSignalMessageBase{
-				SenderUUID:    senderUUID,
-				RecipientUUID: recipientUUID,
-				GroupID:       gidPointer,
-				Timestamp:     dataMessage.GetTimestamp(),
-			},
-			IsRinging: isRinging,
-		}
-		incomingMessages = append(incomingMessages, incomingMessage)
-	}
-
-	// If there's a contact card share, pass it along
-	if dataMessage.Contact != nil {
-		for _, contactCard := range dataMessage.GetContact() {
-			incomingMessage := IncomingSignalMessageContactCard{
-				IncomingSignalMessageBase: IncomingSignalMessageBase{
-					SenderUUID:    senderUUID,
-					RecipientUUID: recipientUUID,
-					GroupID:       gidPointer,
-					Timestamp:     dataMessage.GetTimestamp(),
-					PartIndex:     partIndex,
-				},
-				DisplayName:  contactCard.GetName().GetDisplayName(),
-				Organization: contactCard.GetOrganization(),
-				PhoneNumbers: make([]string, 0),
-				Emails:       make([]string, 0),
-				Addresses:    make([]string, 0),
-			}
-			for _, phone := range contactCard.Number {
-				incomingMessage.PhoneNumbers = append(incomingMessage.PhoneNumbers, *phone.Value)
-			}
-			for _, email := range contactCard.Email {
-				incomingMessage.Emails = append(incomingMessage.Emails, *email.Value)
-			}
-			for _, address := range contactCard.Address {
-				addressParts := make([]string, 0)
-				if address.Pobox != nil {
-					addressParts = append(addressParts, "P.O. Box: "+*address.Pobox)
-				}
-				if address.Street != nil {
-					addressParts = append(addressParts, *address.Street)
-				}
-				if address.Neighborhood != nil {
-					addressParts = append(addressParts, *address.Neighborhood)
-				}
-				if address.City != nil {
-					addressParts = append(addressParts, *address.City)
-				}
-				if address.Region != nil {
-					addressParts = append(addressParts, *address.Region)
-				}
-				if address.Postcode != nil {
-					addressParts = append(addressParts, *address.Postcode)
-				}
-				if address.Country != nil {
-					addressParts = append(addressParts, *address.Country)
-				}
-				addressString := strings.Join(addressParts, ", ")
-				incomingMessage.Addresses = append(incomingMessage.Addresses, addressString)
-			}
-			partIndex++
-			incomingMessages = append(incomingMessages, incomingMessage)
-		}
-	}
-
-	// If it's a expireTimer change, send that along (DMs only)
-	if dataMessage.Flags != nil && dataMessage.GetFlags()&uint32(signalpb.DataMessage_EXPIRATION_TIMER_UPDATE) != 0 {
-		newTime := uint32(0)
-		if dataMessage.ExpireTimer != nil {
-			newTime = dataMessage.GetExpireTimer()
-		}
-		incomingMessage := IncomingSignalMessageExpireTimerChange{
-			IncomingSignalMessageBase: IncomingSignalMessageBase{
-				SenderUUID:    senderUUID,
-				RecipientUUID: recipientUUID,
-				GroupID:       gidPointer,
-				Timestamp:     dataMessage.GetTimestamp(),
-			},
-			NewExpireTimer: newTime,
-		}
-		incomingMessages = append(incomingMessages, incomingMessage)
-	}
-
-	if device.Connection.IncomingSignalMessageHandler != nil {
-		for _, incomingMessage := range incomingMessages {
-			err := device.Connection.IncomingSignalMessageHandler(incomingMessage)
-			if err != nil {
-				zlog.Err(err).Msg("IncomingSignalMessageHandler error")
-			} else {
-				deliveredTimestamps = append(deliveredTimestamps, incomingMessage.Base().Timestamp)
-			}
-		}
+	// contentEvents only sends a GroupChange for messages that include the change,
+	// but the group has to be synced whenever it has changed without known revisions
+	if groupHasChanged && len(groupChanges) == 0 && dataMessage.GetGroupV2().GroupChange == nil {
+		sender, _ := uuid.Parse(senderUUID)
+		info := messageInfo(sender, senderUUID, dataMessage.GetGroupV2(), dataMessage.GetTimestamp())
+		info.IsFromMe = senderUUID == d.Data.AciUuid
+		evts = append(evts, &events.GroupChange{Info: info, Group: dataMessage.GetGroupV2()})
 	}
-	return deliveredTimestamps, nil
+	return evts, nil
 }
 
 func sendDeliveryReceipts(ctx context.Context, device *Device, deliveredTimestamps []uint64, senderUUID string) error {
 	// Send delivery receipts
 	if len(deliveredTimestamps) > 0 {
 		receipt := DeliveredReceiptMessageForTimestamps(deliveredTimestamps)
-		result := SendMessage(ctx, device, senderUUID, receipt)
+		result := sendMessage(ctx, device, senderUUID, receipt)
 		if !result.WasSuccessful {
-			zlog.Error().Msgf("Failed to send delivery receipts: %v", result)
+			device.log().Error().Msgf("Failed to send delivery receipts: %v", result)
 		}
 	}
 	return nil
@@ -1067,17 +860,16 @@ type DecryptionResult struct {
 	SealedSender  bool
 }
 
-func serverTrustRootKey() *libsignalgo.PublicKey {
-	// TODO: put this server's trust root in the config or DB or something
-	serverTrustRoot := "BXu6QIKVz5MA8gstzfOgRQGqyLqOwNKHL6INkv3IHWMF"
-	serverTrustRootBytes, err := base64.StdEncoding.DecodeString(serverTrustRoot)
+// serverTrustRootKey returns the key that sealed sender certificates from the device's server must be signed with.
+func (d *Device) serverTrustRootKey() *libsignalgo.PublicKey {
+	serverTrustRootBytes, err := base64.StdEncoding.DecodeString(d.web().Config.TrustRoot)
 	if err != nil {
-		zlog.Err(err).Msg("DecodeString error")
+		d.log().Err(err).Msg("DecodeString error")
 		panic(err)
 	}
 	serverTrustRootKey, err := libsignalgo.DeserializePublicKey(serverTrustRootBytes)
 	if err != nil {
-		zlog.Err(err).Msg("DeserializePublicKey error")
+		d.log().Err(err).Msg("DeserializePublicKey error")
 		panic(err)
 	}
 	return serverTrustRootKey
@@ -1093,7 +885,7 @@ func sealedSenderDecrypt(envelope *signalpb.Envelope, device *Device, ctx contex
 	result, err := libsignalgo.SealedSenderDecrypt(
 		envelope.Content,
 		localAddress,
-		serverTrustRootKey(),
+		device.serverTrustRootKey(),
 		timestamp,
 		device.SessionStore,
 		device.IdentityStore,
@@ -1103,13 +895,13 @@ func sealedSenderDecrypt(envelope *signalpb.Envelope, device *Device, ctx contex
 	)
 
 	if err != nil {
-		zlog.Err(err).Msg("SealedSenderDecrypt error")
+		device.log().Err(err).Msg("SealedSenderDecrypt error")
 		return nil, err
 	}
 	msg := result.Message
 	err = stripPadding(&msg)
 	if err != nil {
-		zlog.Err(err).Msg("stripPadding error")
+		device.log().Err(err).Msg("stripPadding error")
 		return nil, err
 	}
 	address, err := libsignalgo.NewAddress(
@@ -1117,13 +909,13 @@ func sealedSenderDecrypt(envelope *signalpb.Envelope, device *Device, ctx contex
 		uint(result.Sender.DeviceID),
 	)
 	if err != nil {
-		zlog.Err(err).Msg("NewAddress error")
+		device.log().Err(err).Msg("NewAddress error")
 		return nil, err
 	}
 	content := &signalpb.Content{}
 	err = proto.Unmarshal(msg, content)
 	if err != nil {
-		zlog.Err(err).Msg("Unmarshal error")
+		device.log().Err(err).Msg("Unmarshal error")
 		return nil, err
 	}
 	DecryptionResult := &DecryptionResult{
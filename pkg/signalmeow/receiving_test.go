@@ -0,0 +1,130 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/signaltest"
+)
+
+// receiveUntil calls Receive on the phone until it gets a message that matches the filter.
+func receiveUntil(ctx context.Context, t *testing.T, phone *signaltest.Phone, filter func(*signaltest.ReceivedMessage) bool) *signaltest.ReceivedMessage {
+	for {
+		msg, err := phone.Receive(ctx)
+		require.NoError(t, err)
+		if filter(msg) {
+			return msg
+		}
+	}
+}
+
+func TestReceiveMessage(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestPhone(t, server, "+15550000001")
+	bob := newTestPhone(t, server, "+15550000002")
+	client := linkTestClient(t, server, alice)
+	ctx := newTestContext(t)
+	messages := collectEvents[*events.Message](client)
+	startTestClient(t, client)
+
+	ts, err := bob.SendText(ctx, alice.ACI, "hello signalmeow")
+	require.NoError(t, err)
+
+	evt := waitForEvent(t, messages)
+	assert.Equal(t, bob.ACI, evt.Info.Sender)
+	assert.Equal(t, bob.ACI.String(), evt.Info.Chat)
+	assert.False(t, evt.Info.IsFromMe)
+	assert.Equal(t, ts, evt.Info.Timestamp)
+	assert.Equal(t, "hello signalmeow", evt.Message.GetBody())
+
+	receipt := receiveUntil(ctx, t, bob, func(msg *signaltest.ReceivedMessage) bool {
+		return msg.Content.GetReceiptMessage() != nil
+	})
+	assert.Equal(t, alice.ACI, receipt.Sender)
+	assert.Equal(t, signalpb.ReceiptMessage_DELIVERY, receipt.Content.GetReceiptMessage().GetType())
+	assert.Equal(t, []uint64{ts}, receipt.Content.GetReceiptMessage().GetTimestamp())
+
+	// The envelope must be acknowledged once the handlers are done with it
+	assert.Eventually(t, func() bool {
+		return server.PendingEnvelopes(alice.ACI, client.Device.Data.DeviceId) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestReceiveTypingNotSavedToInbox(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestPhone(t, server, "+15550000001")
+	bob := newTestPhone(t, server, "+15550000002")
+	client := linkTestClient(t, server, alice)
+	ctx := newTestContext(t)
+	typing := collectEvents[*events.Typing](client)
+	startTestClient(t, client)
+
+	err := bob.SendContent(ctx, alice.ACI, &signalpb.Content{
+		TypingMessage: &signalpb.TypingMessage{
+			Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+			Action:    signalpb.TypingMessage_STARTED.Enum(),
+		},
+	})
+	require.NoError(t, err)
+
+	evt := waitForEvent(t, typing)
+	assert.Equal(t, bob.ACI, evt.Info.Sender)
+	assert.Equal(t, signalpb.TypingMessage_STARTED, evt.Typing.GetAction())
+	assert.Eventually(t, func() bool {
+		return server.PendingEnvelopes(alice.ACI, client.Device.Data.DeviceId) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+	var count int
+	err = client.Device.InboxStore.(*SQLStore).db.QueryRowContext(ctx, "SELECT COUNT(*) FROM signalmeow_inbox").Scan(&count)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestReceiveMessageHandlerFailure(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestPhone(t, server, "+15550000001")
+	bob := newTestPhone(t, server, "+15550000002")
+	client := linkTestClient(t, server, alice)
+	ctx := newTestContext(t)
+	client.Device.AddEventHandlerWithSuccessStatus(func(rawEvt any) bool {
+		_, isMessage := rawEvt.(*events.Message)
+		return !isMessage
+	})
+	startTestClient(t, client)
+
+	ts, err := bob.SendText(ctx, alice.ACI, "this fails")
+	require.NoError(t, err)
+
+	// The envelope is acknowledged as soon as it's saved, the failed message stays in the inbox to be retried
+	var entries []*InboxEntry
+	require.Eventually(t, func() bool {
+		entries, err = client.Device.InboxStore.GetPendingInboxEntries(ctx, nil, 10)
+		require.NoError(t, err)
+		return len(entries) == 1 && entries[0].Attempts > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, bob.ACI.String(), entries[0].SenderACI)
+	assert.Equal(t, ts, entries[0].Timestamp)
+	assert.Equal(t, 0, server.PendingEnvelopes(alice.ACI, client.Device.Data.DeviceId))
+}
@@ -17,16 +17,22 @@
 package signalmeow
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
 	"google.golang.org/protobuf/proto"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
@@ -53,7 +59,7 @@ func senderCertificate(d *Device) (*libsignalgo.SenderCertificate, error) {
 
 	username, password := d.Data.BasicAuthCreds()
 	opts := &web.HTTPReqOpt{Username: &username, Password: &password}
-	resp, err := web.SendHTTPRequest("GET", "/v1/certificate/delivery", opts)
+	resp, err := d.web().SendHTTPRequest("GET", "/v1/certificate/delivery", opts)
 	if err != nil {
 		return nil, err
 	}
@@ -147,16 +153,21 @@ func howManyOtherDevicesDoWeHave(ctx context.Context, d *Device) int {
 	}
 	// Filter out our deviceID
 	otherDevices := 0
+	deviceIDs := make([]int, 0, len(addresses))
 	for _, address := range addresses {
 		deviceID, err := address.DeviceID()
 		if err != nil {
-			zlog.Err(err).Msg("Error getting deviceID from address")
+			d.log().Err(err).Msg("Error getting deviceID from address")
 			continue
 		}
 		if deviceID != uint(d.Data.DeviceId) {
 			otherDevices++
+			deviceIDs = append(deviceIDs, int(deviceID))
 		}
 	}
+	if err = d.checkNewOwnDevices(ctx, deviceIDs); err != nil {
+		d.log().Err(err).Msg("Failed to check for new own devices")
+	}
 	return otherDevices
 }
 
@@ -170,7 +181,9 @@ func buildMessagesToSend(ctx context.Context, d *Device, recipientUuid string, c
 	addresses, sessionRecords, err := d.SessionStoreExtras.AllSessionsForUUID(recipientUuid, ctx)
 	if err == nil && (len(addresses) == 0 || len(sessionRecords) == 0) {
 		// No sessions, make one with prekey
-		FetchAndProcessPreKey(ctx, d, recipientUuid, -1)
+		if preKeyErr := fetchAndProcessPreKey(ctx, d, recipientUuid, -1); preKeyErr != nil {
+			return nil, fmt.Errorf("%w: %w", ErrPreKeyFetchFailed, preKeyErr)
+		}
 		addresses, sessionRecords, err = d.SessionStoreExtras.AllSessionsForUUID(recipientUuid, ctx)
 	}
 	err = checkForErrorWithSessions(err, addresses, sessionRecords)
@@ -186,7 +199,7 @@ func buildMessagesToSend(ctx context.Context, d *Device, recipientUuid string, c
 
 		// Don't send to this device that we are sending from
 		if recipientUuid == d.Data.AciUuid && recipientDeviceID == uint(d.Data.DeviceId) {
-			zlog.Debug().Msgf("Not sending to the device I'm sending from (%v:%v)", recipientUuid, recipientDeviceID)
+			d.log().Debug().Msgf("Not sending to the device I'm sending from (%v:%v)", recipientUuid, recipientDeviceID)
 			continue
 		}
 
@@ -325,19 +338,9 @@ func syncMessageFromSoloDataMessage(dataMessage *signalpb.DataMessage, result Su
 	}
 }
 
-func syncMessageForContactRequest() *signalpb.Content {
-	return &signalpb.Content{
-		SyncMessage: &signalpb.SyncMessage{
-			Request: &signalpb.SyncMessage_Request{
-				Type: signalpb.SyncMessage_Request_CONTACTS.Enum(),
-			},
-		},
-	}
-}
-
-func syncMessageFromReadReceiptMessage(receiptMessage *signalpb.ReceiptMessage, messageSender string) *signalpb.Content {
+func syncMessageFromReadReceiptMessage(ctx context.Context, receiptMessage *signalpb.ReceiptMessage, messageSender string) *signalpb.Content {
 	if *receiptMessage.Type != signalpb.ReceiptMessage_READ {
-		zlog.Warn().Msgf("syncMessageFromReadReceiptMessage called with non-read receipt message: %v", receiptMessage.Type)
+		zerolog.Ctx(ctx).Warn().Msgf("syncMessageFromReadReceiptMessage called with non-read receipt message: %v", receiptMessage.Type)
 		return nil
 	}
 	read := []*signalpb.SyncMessage_Read{}
@@ -354,28 +357,28 @@ func syncMessageFromReadReceiptMessage(receiptMessage *signalpb.ReceiptMessage,
 	}
 }
 
-func SendContactSyncRequest(ctx context.Context, d *Device) error {
+func sendContactSyncRequest(ctx context.Context, d *Device) error {
 	currentUnixTime := time.Now().Unix()
 	lastRequestTime := d.Connection.LastContactRequestTime
 	// If we've requested in the last minute, don't request again
 	if lastRequestTime != nil && currentUnixTime-*lastRequestTime < 60 {
-		zlog.Warn().Msgf("Not sending contact sync request, already sent %v seconds ago", currentUnixTime-*lastRequestTime)
+		d.log().Warn().Msgf("Not sending contact sync request, already sent %v seconds ago", currentUnixTime-*lastRequestTime)
 		return nil
 	}
 
-	groupRequest := syncMessageForContactRequest()
+	groupRequest := syncMessageForRequest(signalpb.SyncMessage_Request_CONTACTS)
 	_, err := sendContent(ctx, d, d.Data.AciUuid, uint64(currentUnixTime), groupRequest, 0)
 	if err != nil {
-		zlog.Err(err).Msg("Failed to send contact sync request message to myself (%v)")
+		d.log().Err(err).Msg("Failed to send contact sync request message to myself (%v)")
 		return err
 	}
 	d.Connection.LastContactRequestTime = &currentUnixTime
 	return nil
 }
 
+// TypingMessage creates a typing notification. It can be sent with Client.SendMessage or Client.SendGroupMessage,
+// which fills in the group ID.
 func TypingMessage(isTyping bool) *SignalContent {
-	// Note: not handling sending to a group ATM since that will require
-	// SenderKey sending to not be terrible
 	timestamp := currentMessageTimestamp()
 	var action signalpb.TypingMessage_Action
 	if isTyping {
@@ -438,6 +441,15 @@ func DataMessageForAttachment(attachmentPointer *AttachmentPointer, caption stri
 	return wrapDataMessageInContent(dm)
 }
 
+func DataMessageForContact(contact *signalpb.DataMessage_Contact) *SignalContent {
+	timestamp := currentMessageTimestamp()
+	dm := &signalpb.DataMessage{
+		Timestamp: &timestamp,
+		Contact:   []*signalpb.DataMessage_Contact{contact},
+	}
+	return wrapDataMessageInContent(dm)
+}
+
 func DataMessageForReaction(reaction string, targetMessageSender uuid.UUID, targetMessageTimestamp uint64, removing bool) *SignalContent {
 	timestamp := currentMessageTimestamp()
 	dm := &signalpb.DataMessage{
@@ -463,6 +475,18 @@ func DataMessageForDelete(targetMessageTimestamp uint64) *SignalContent {
 	return wrapDataMessageInContent(dm)
 }
 
+// DataMessageForExpireTimerUpdate creates a message that changes the disappearing message timer of a chat.
+// Zero disables disappearing messages.
+func DataMessageForExpireTimerUpdate(expiresInSeconds uint32) *SignalContent {
+	timestamp := currentMessageTimestamp()
+	dm := &signalpb.DataMessage{
+		Timestamp:   &timestamp,
+		ExpireTimer: proto.Uint32(expiresInSeconds),
+		Flags:       proto.Uint32(uint32(signalpb.DataMessage_EXPIRATION_TIMER_UPDATE)),
+	}
+	return wrapDataMessageInContent(dm)
+}
+
 func AddQuoteToDataMessage(content *SignalContent, quotedMessageSender uuid.UUID, quotedMessageTimestamp uint64) {
 	content.DataMessage.Quote = &signalpb.DataMessage_Quote{
 		AuthorAci: proto.String(quotedMessageSender.String()),
@@ -480,8 +504,14 @@ func AddExpiryToDataMessage(content *SignalContent, expiresInSeconds uint32) {
 	content.DataMessage.ExpireTimer = proto.Uint32(expiresInSeconds)
 }
 
-func UploadAttachment(d *Device, image []byte, mimeType string, filename string) (*AttachmentPointer, error) {
-	ap, err := encryptAndUploadAttachment(d, image, mimeType, filename)
+func uploadAttachment(ctx context.Context, d *Device, image []byte, mimeType string, filename string) (*AttachmentPointer, error) {
+	ap, err := encryptAndUploadAttachment(ctx, d, bytes.NewReader(image), int64(len(image)), mimeType, filename)
+	return (*AttachmentPointer)(ap), err
+}
+
+// uploadAttachmentStream uploads size bytes read from r as an attachment, without reading the whole file into memory.
+func uploadAttachmentStream(ctx context.Context, d *Device, r io.Reader, size int64, mimeType string, filename string) (*AttachmentPointer, error) {
+	ap, err := encryptAndUploadAttachment(ctx, d, r, size, mimeType, filename)
 	return (*AttachmentPointer)(ap), err
 }
 
@@ -491,26 +521,49 @@ func wrapDataMessageInContent(dm *signalpb.DataMessage) *SignalContent {
 	}
 }
 
-func SendGroupMessage(ctx context.Context, device *Device, gid GroupIdentifier, message *SignalContent) (*GroupMessageSendResult, error) {
-	group, err := RetrieveGroupByID(ctx, device, gid)
+// sendGroupMessage sends a message to the group. If onlyTo is non-nil, it's only sent to those members,
+// e.g. to retry a message that couldn't be sent to some members, and the sync message to our other devices is skipped.
+func sendGroupMessage(ctx context.Context, device *Device, gid GroupIdentifier, message *SignalContent, onlyTo []string) (*GroupMessageSendResult, error) {
+	group, err := retrieveGroupByID(ctx, device, gid)
 	if err != nil {
 		return nil, err
 	}
 
 	content := (*signalpb.Content)(message)
 	dataMessage := content.DataMessage
-	messageTimestamp := *dataMessage.Timestamp
-	dataMessage.GroupV2 = groupMetadataForDataMessage(*group)
-
-	// Send to each member of the group
 	result := &GroupMessageSendResult{
 		SuccessfullySentTo: []SuccessfulSendResult{},
 		FailedToSendTo:     []FailedSendResult{},
 	}
+	settings := device.AccountSettings(ctx)
+	var messageTimestamp uint64
+	if content.TypingMessage != nil {
+		if !settings.TypingIndicators {
+			return result, nil
+		}
+		groupID, err := base64.StdEncoding.DecodeString(string(gid))
+		if err != nil {
+			return nil, fmt.Errorf("invalid group identifier: %w", err)
+		}
+		content.TypingMessage.GroupId = groupID
+		messageTimestamp = content.TypingMessage.GetTimestamp()
+	} else {
+		messageTimestamp = *dataMessage.Timestamp
+		groupChange := dataMessage.GetGroupV2().GetGroupChange()
+		dataMessage.GroupV2 = groupMetadataForDataMessage(*group)
+		dataMessage.GroupV2.GroupChange = groupChange
+		if !settings.LinkPreviews {
+			dataMessage.Preview = nil
+		}
+	}
+
+	// Send to each member of the group
 	for _, member := range group.Members {
 		if member.UserId == device.Data.AciUuid {
 			// Don't send normal DataMessages to ourselves
 			continue
+		} else if onlyTo != nil && !slices.Contains(onlyTo, member.UserId) {
+			continue
 		}
 		sentUnidentified, err := sendContent(ctx, device, member.UserId, messageTimestamp, content, 0)
 		if err != nil {
@@ -518,22 +571,23 @@ func SendGroupMessage(ctx context.Context, device *Device, gid GroupIdentifier,
 				RecipientUuid: member.UserId,
 				Error:         err,
 			})
-			zlog.Err(err).Msgf("Failed to send to %v", member.UserId)
+			device.log().Err(err).Msgf("Failed to send to %v", member.UserId)
 		} else {
 			result.SuccessfullySentTo = append(result.SuccessfullySentTo, SuccessfulSendResult{
 				RecipientUuid: member.UserId,
 				Unidentified:  sentUnidentified,
 			})
-			zlog.Trace().Msgf("Successfully sent to %v", member.UserId)
+			device.log().Trace().Msgf("Successfully sent to %v", member.UserId)
 		}
 	}
+	device.metrics().SentGroupMessage(len(result.SuccessfullySentTo) + len(result.FailedToSendTo))
 
-	// No need to send to ourselves if we don't have any other devices
-	if howManyOtherDevicesDoWeHave(ctx, device) > 0 {
+	// No need to send to ourselves if we don't have any other devices, and typing notifications aren't synced
+	if dataMessage != nil && onlyTo == nil && howManyOtherDevicesDoWeHave(ctx, device) > 0 {
 		syncContent := syncMessageFromGroupDataMessage(dataMessage, result.SuccessfullySentTo)
 		_, selfSendErr := sendContent(ctx, device, device.Data.AciUuid, messageTimestamp, syncContent, 0)
 		if selfSendErr != nil {
-			zlog.Err(selfSendErr).Msg("Failed to send sync message to myself (%v)")
+			device.log().Err(selfSendErr).Msg("Failed to send sync message to myself (%v)")
 		}
 	}
 
@@ -542,13 +596,13 @@ func SendGroupMessage(ctx context.Context, device *Device, gid GroupIdentifier,
 	}
 	if len(result.SuccessfullySentTo) == 0 {
 		lastError := result.FailedToSendTo[len(result.FailedToSendTo)-1].Error
-		return nil, fmt.Errorf("Failed to send to any group members: %v", lastError)
+		return nil, fmt.Errorf("Failed to send to any group members: %w", lastError)
 	}
 
 	return result, nil
 }
 
-func SendMessage(ctx context.Context, device *Device, recipientID string, message *SignalContent) SendMessageResult {
+func sendMessage(ctx context.Context, device *Device, recipientID string, message *SignalContent) SendMessageResult {
 	// Assemble the content to send
 	content := (*signalpb.Content)(message)
 	dataMessage := content.DataMessage
@@ -559,15 +613,34 @@ func SendMessage(ctx context.Context, device *Device, recipientID string, messag
 		messageTimestamp = currentMessageTimestamp()
 	}
 
-	// Send to the recipient
-	sentUnidentified, err := sendContent(ctx, device, recipientID, messageTimestamp, content, 0)
-	if err != nil {
+	// Respect the privacy settings synced from the primary device
+	settings := device.AccountSettings(ctx)
+	skipRecipient := false
+	if content.TypingMessage != nil && !settings.TypingIndicators {
 		return SendMessageResult{
-			WasSuccessful: false,
-			FailedSendResult: &FailedSendResult{
-				RecipientUuid: recipientID,
-				Error:         err,
-			},
+			WasSuccessful:        true,
+			SuccessfulSendResult: &SuccessfulSendResult{RecipientUuid: recipientID},
+		}
+	} else if content.ReceiptMessage.GetType() == signalpb.ReceiptMessage_READ && !settings.ReadReceipts {
+		// The read state is still synced to our other devices below
+		skipRecipient = true
+	} else if dataMessage != nil && !settings.LinkPreviews {
+		dataMessage.Preview = nil
+	}
+
+	// Send to the recipient
+	var sentUnidentified bool
+	if !skipRecipient {
+		var err error
+		sentUnidentified, err = sendContent(ctx, device, recipientID, messageTimestamp, content, 0)
+		if err != nil {
+			return SendMessageResult{
+				WasSuccessful: false,
+				FailedSendResult: &FailedSendResult{
+					RecipientUuid: recipientID,
+					Error:         err,
+				},
+			}
 		}
 	}
 	result := SendMessageResult{
@@ -581,7 +654,7 @@ func SendMessage(ctx context.Context, device *Device, recipientID string, messag
 	// TODO: don't fetch every time
 	// (But for now this makes sure we know about all our other devices)
 	// ((Actually I don't think this is necessary?))
-	//FetchAndProcessPreKey(ctx, device, device.Data.AciUuid, -1)
+	//fetchAndProcessPreKey(ctx, device, device.Data.AciUuid, -1)
 
 	// If we have other devices, send Sync messages to them too
 	if howManyOtherDevicesDoWeHave(ctx, device) > 0 {
@@ -590,18 +663,96 @@ func SendMessage(ctx context.Context, device *Device, recipientID string, messag
 			syncContent = syncMessageFromSoloDataMessage(dataMessage, *result.SuccessfulSendResult)
 		}
 		if content.ReceiptMessage != nil && *content.ReceiptMessage.Type == signalpb.ReceiptMessage_READ {
-			syncContent = syncMessageFromReadReceiptMessage(content.ReceiptMessage, recipientID)
+			syncContent = syncMessageFromReadReceiptMessage(ctx, content.ReceiptMessage, recipientID)
 		}
 		if syncContent != nil {
 			_, selfSendErr := sendContent(ctx, device, device.Data.AciUuid, messageTimestamp, syncContent, 0)
 			if selfSendErr != nil {
-				zlog.Err(selfSendErr).Msg("Failed to send sync message to myself")
+				device.log().Err(selfSendErr).Msg("Failed to send sync message to myself")
 			}
 		}
 	}
 	return result
 }
 
+// ErrSendConnectionFailed is returned when a message couldn't be sent because no response was received
+// from the server, e.g. because the websocket is disconnected.
+var ErrSendConnectionFailed = errors.New("failed to send request to server")
+
+// ErrPreKeyFetchFailed is returned when a session with a recipient couldn't be created,
+// because fetching their prekeys from the server failed.
+var ErrPreKeyFetchFailed = errors.New("failed to fetch prekeys")
+
+// SendStatusError is returned when the server responds to a message send with an unexpected status code.
+type SendStatusError struct {
+	StatusCode int
+	// RetryAfter is the delay requested by the server in the Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func (e *SendStatusError) Error() string {
+	return fmt.Sprintf("Unexpected status code while sending: %d", e.StatusCode)
+}
+
+// IsRetryableSendError returns true if sending the message again later could succeed,
+// e.g. when the connection dropped, the server had an error or we were rate limited.
+// Sends that fail because of a pending captcha are retryable too, they go through once it's solved.
+// HTTP requests made while sending, like fetching prekeys, are retryable if they failed temporarily.
+func IsRetryableSendError(err error) bool {
+	var statusErr *SendStatusError
+	var rateLimitErr *RateLimitError
+	if errors.Is(err, ErrSendConnectionFailed) || errors.As(err, &rateLimitErr) {
+		return true
+	} else if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.StatusCode)
+	}
+	return isTransientHTTPError(err)
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode >= 500 ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode == http.StatusPreconditionRequired
+}
+
+// isTransientHTTPError returns true if an HTTP request failed because of the network or a server error,
+// rather than because the server rejected the request.
+func isTransientHTTPError(err error) bool {
+	var httpErr *web.HTTPStatusError
+	var netErr net.Error
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// SendRetryAfter returns the delay the server asked for before retrying, or zero if it didn't ask for one.
+func SendRetryAfter(err error) time.Duration {
+	var statusErr *SendStatusError
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	} else if errors.As(err, &rateLimitErr) && !rateLimitErr.Until.IsZero() {
+		return time.Until(rateLimitErr.Until)
+	}
+	return 0
+}
+
+func retryAfterFromHeaders(headers []string) time.Duration {
+	for _, header := range headers {
+		key, value, ok := strings.Cut(header, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "Retry-After") {
+			seconds, err := strconv.Atoi(strings.TrimSpace(value))
+			if err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
 func currentMessageTimestamp() uint64 {
 	return uint64(time.Now().UnixMilli())
 }
@@ -614,21 +765,25 @@ func sendContent(
 	content *signalpb.Content,
 	retryCount int, // For ending recursive retries
 ) (sentUnidentified bool, err error) {
-	printContentFieldString(content, "Outgoing message")
+	printContentFieldString(d.log(), content, "Outgoing message")
 
 	// If it's a data message, add our profile key
 	if content.DataMessage != nil {
-		profileKey, err := ProfileKeyForSignalID(ctx, d, d.Data.AciUuid)
+		profileKey, err := profileKeyForSignalID(ctx, d, d.Data.AciUuid)
 		if err != nil {
-			zlog.Err(err).Msg("Error getting profile key, not adding to outgoing message")
+			d.log().Err(err).Msg("Error getting profile key, not adding to outgoing message")
 		} else {
 			content.DataMessage.ProfileKey = profileKey.Slice()
 		}
 	}
 
+	if err := d.Connection.rateLimit.check(); err != nil {
+		return false, err
+	}
+
 	if retryCount > 3 {
 		err := fmt.Errorf("Too many retries")
-		zlog.Err(err).Msgf("sendContent too many retries: %v", retryCount)
+		d.log().Err(err).Msgf("sendContent too many retries: %v", retryCount)
 		return false, err
 	}
 
@@ -637,18 +792,18 @@ func sendContent(
 	if recipientUuid == d.Data.AciUuid {
 		useUnidentifiedSender = false
 	}
-	profileKey, err := ProfileKeyForSignalID(ctx, d, recipientUuid)
+	profileKey, err := profileKeyForSignalID(ctx, d, recipientUuid)
 	if err != nil || profileKey == nil {
-		zlog.Err(err).Msg("Error getting profile key")
+		d.log().Err(err).Msg("Error getting profile key")
 		useUnidentifiedSender = false
 		// Try to self heal by requesting contact sync, though this is slow and not guaranteed to help
-		SendContactSyncRequest(ctx, d)
+		sendContactSyncRequest(ctx, d)
 	}
 	var accessKey *libsignalgo.AccessKey
 	if profileKey != nil {
 		accessKey, err = profileKey.DeriveAccessKey()
 		if err != nil {
-			zlog.Err(err).Msg("Error deriving access key")
+			d.log().Err(err).Msg("Error deriving access key")
 			useUnidentifiedSender = false
 		}
 	}
@@ -663,7 +818,7 @@ func sendContent(
 	var messages []MyMessage
 	messages, err = buildMessagesToSend(ctx, d, recipientUuid, content, useUnidentifiedSender)
 	if err != nil {
-		zlog.Err(err).Msg("Error building messages to send")
+		d.log().Err(err).Msg("Error building messages to send")
 		return false, err
 	}
 
@@ -681,22 +836,36 @@ func sendContent(
 	request := web.CreateWSRequest("PUT", path, jsonBytes, nil, nil)
 
 	var response *signalpb.WebSocketResponseMessage
+	sendStart := time.Now()
 	if useUnidentifiedSender {
-		zlog.Trace().Msgf("Sending message to %v over unidentified WS", recipientUuid)
+		d.log().Trace().Msgf("Sending message to %v over unidentified WS", recipientUuid)
 		base64AccessKey := base64.StdEncoding.EncodeToString(accessKey[:])
 		request.Headers = append(request.Headers, "unidentified-access-key:"+base64AccessKey)
 		response, err = d.Connection.UnauthedWS.SendRequest(ctx, request)
 	} else {
-		zlog.Trace().Msgf("Sending message to %v over authed WS", recipientUuid)
+		d.log().Trace().Msgf("Sending message to %v over authed WS", recipientUuid)
 		response, err = d.Connection.AuthedWS.SendRequest(ctx, request)
 	}
 	sentUnidentified = useUnidentifiedSender
+	d.metrics().SentMessage(useUnidentifiedSender, int(response.GetStatus()), time.Since(sendStart))
 	if err != nil {
-		return sentUnidentified, err
+		return sentUnidentified, fmt.Errorf("%w: %w", ErrSendConnectionFailed, err)
 	}
-	zlog.Trace().Msgf("Received a response to a message send from: %v, id: %v, code: %v", recipientUuid, *response.Id, *response.Status)
+	d.log().Trace().Msgf("Received a response to a message send from: %v, id: %v, code: %v", recipientUuid, *response.Id, *response.Status)
 
-	retryableStatuses := []uint32{409, 410, 428, 500, 503}
+	switch *response.Status {
+	case http.StatusOK:
+		d.Connection.rateLimit.succeeded()
+	case http.StatusTooManyRequests, http.StatusRequestEntityTooLarge:
+		// 413 is what older servers used for rate limits
+		pause := d.Connection.rateLimit.limited(retryAfterFromHeaders(response.Headers))
+		d.log().Warn().Uint32("status", *response.Status).Dur("pause", pause).Msg("Rate limited, pausing sending")
+		return false, &SendStatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: pause}
+	case http.StatusPreconditionRequired:
+		return false, handle428(d, response)
+	}
+
+	retryableStatuses := []uint32{409, 410, 500, 503}
 
 	// Check to see if our status is retryable
 	needToRetry := false
@@ -708,13 +877,14 @@ func sendContent(
 	}
 
 	if needToRetry {
+		if retryCount >= 3 {
+			return false, &SendStatusError{StatusCode: int(*response.Status), RetryAfter: retryAfterFromHeaders(response.Headers)}
+		}
 		var err error
 		if *response.Status == 409 {
 			err = handle409(ctx, d, recipientUuid, response)
 		} else if *response.Status == 410 {
 			err = handle410(ctx, d, recipientUuid, response)
-		} else if *response.Status == 428 {
-			err = handle428(ctx, d, recipientUuid, response)
 		}
 		if err != nil {
 			return false, err
@@ -722,12 +892,12 @@ func sendContent(
 		// Try to send again (**RECURSIVELY**)
 		sentUnidentified, err = sendContent(ctx, d, recipientUuid, messageTimestamp, content, retryCount+1)
 		if err != nil {
-			zlog.Err(err).Msg("2nd try sendMessage error")
+			d.log().Err(err).Msg("2nd try sendMessage error")
 			return sentUnidentified, err
 		}
 	} else if *response.Status != 200 {
-		err := fmt.Errorf("Unexpected status code while sending: %v", *response.Status)
-		zlog.Err(err).Msg("")
+		err := &SendStatusError{StatusCode: int(*response.Status), RetryAfter: retryAfterFromHeaders(response.Headers)}
+		d.log().Err(err).Msg("")
 		return sentUnidentified, err
 	}
 
@@ -740,21 +910,24 @@ func handle409(ctx context.Context, device *Device, recipientUuid string, respon
 	var body map[string]interface{}
 	err := json.Unmarshal(response.Body, &body)
 	if err != nil {
-		zlog.Err(err).Msg("Unmarshal error")
+		device.log().Err(err).Msg("Unmarshal error")
 		return err
 	}
 	// check for missingDevices and extraDevices
 	if body["missingDevices"] != nil {
 		missingDevices := body["missingDevices"].([]interface{})
-		zlog.Debug().Msgf("missing devices found in 409 response: %v", missingDevices)
+		device.log().Debug().Msgf("missing devices found in 409 response: %v", missingDevices)
 		// TODO: establish session with missing devices
 		for _, missingDevice := range missingDevices {
-			FetchAndProcessPreKey(ctx, device, recipientUuid, int(missingDevice.(float64)))
+			err = fetchAndProcessPreKey(ctx, device, recipientUuid, int(missingDevice.(float64)))
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrPreKeyFetchFailed, err)
+			}
 		}
 	}
 	if body["extraDevices"] != nil {
 		extraDevices := body["extraDevices"].([]interface{})
-		zlog.Debug().Msgf("extra devices found in 409 response: %v", extraDevices)
+		device.log().Debug().Msgf("extra devices found in 409 response: %v", extraDevices)
 		for _, extraDevice := range extraDevices {
 			// Remove extra device from the sessionstore
 			recipient, err := libsignalgo.NewAddress(
@@ -762,12 +935,12 @@ func handle409(ctx context.Context, device *Device, recipientUuid string, respon
 				uint(extraDevice.(float64)),
 			)
 			if err != nil {
-				zlog.Err(err).Msg("NewAddress error")
+				device.log().Err(err).Msg("NewAddress error")
 				return err
 			}
 			err = device.SessionStoreExtras.RemoveSession(recipient, ctx)
 			if err != nil {
-				zlog.Err(err).Msg("RemoveSession error")
+				device.log().Err(err).Msg("RemoveSession error")
 				return err
 			}
 		}
@@ -781,13 +954,13 @@ func handle410(ctx context.Context, device *Device, recipientUuid string, respon
 	var body map[string]interface{}
 	err := json.Unmarshal(response.Body, &body)
 	if err != nil {
-		zlog.Err(err).Msg("Unmarshal error")
+		device.log().Err(err).Msg("Unmarshal error")
 		return err
 	}
 	// check for staleDevices and make new sessions with them
 	if body["staleDevices"] != nil {
 		staleDevices := body["staleDevices"].([]interface{})
-		zlog.Debug().Msgf("stale devices found in 410 response: %v", staleDevices)
+		device.log().Debug().Msgf("stale devices found in 410 response: %v", staleDevices)
 		for _, staleDevice := range staleDevices {
 			recipient, err := libsignalgo.NewAddress(
 				recipientUuid,
@@ -795,73 +968,14 @@ func handle410(ctx context.Context, device *Device, recipientUuid string, respon
 			)
 			err = device.SessionStoreExtras.RemoveSession(recipient, ctx)
 			if err != nil {
-				zlog.Err(err).Msg("RemoveSession error")
+				device.log().Err(err).Msg("RemoveSession error")
 				return err
 			}
-			FetchAndProcessPreKey(ctx, device, recipientUuid, int(staleDevice.(float64)))
-		}
-	}
-	return err
-}
-
-// We got rate limited.
-// We ~~will~~ could try sending a "pushChallenge" response, but if that doesn't work we just gotta wait.
-// TODO: explore captcha response
-func handle428(ctx context.Context, device *Device, recipientUuid string, response *signalpb.WebSocketResponseMessage) error {
-	// Decode json body
-	var body map[string]interface{}
-	err := json.Unmarshal(response.Body, &body)
-	if err != nil {
-		zlog.Err(err).Msg("Unmarshal error")
-		return err
-	}
-
-	// Sample response:
-	//id:25 status:428 message:"Precondition Required" headers:"Retry-After:86400"
-	//headers:"Content-Type:application/json" headers:"Content-Length:88"
-	//body:"{\"token\":\"07af0d73-e05d-42c3-9634-634922061966\",\"options\":[\"recaptcha\",\"pushChallenge\"]}"
-	var retryAfterSeconds uint64 = 0
-	// Find retry after header
-	for _, header := range response.Headers {
-		key, value := strings.Split(header, ":")[0], strings.Split(header, ":")[1]
-		if key == "Retry-After" {
-			retryAfterSeconds, err = strconv.ParseUint(value, 10, 64)
+			err = fetchAndProcessPreKey(ctx, device, recipientUuid, int(staleDevice.(float64)))
 			if err != nil {
-				zlog.Err(err).Msg("ParseUint error")
+				return fmt.Errorf("%w: %w", ErrPreKeyFetchFailed, err)
 			}
 		}
 	}
-	if retryAfterSeconds > 0 {
-		zlog.Warn().Msgf("Got rate limited, need to wait %v seconds", retryAfterSeconds)
-	}
-	// TODO: responding to a pushChallenge this way doesn't work, server just returns 422
-	// Luckily challenges seem rare when sending with sealed sender
-	//if body["options"] != nil {
-	//	options := body["options"].([]interface{})
-	//	for _, option := range options {
-	//		if option == "pushChallenge" {
-	//			zlog.Info().Msg("Got pushChallenge, sending response")
-	//			token := body["token"].(string)
-	//			username, password := device.Data.BasicAuthCreds()
-	//			response, err := web.SendHTTPRequest(
-	//				"PUT",
-	//				"/v1/challenge",
-	//				&web.HTTPReqOpt{
-	//					Body:     []byte(fmt.Sprintf("{\"token\":\"%v\",\"type\":\"pushChallenge\"}", token)),
-	//					Username: &username,
-	//					Password: &password,
-	//				},
-	//			)
-	//			if err != nil {
-	//				zlog.Err(err).Msg("SendHTTPRequest error")
-	//				return err
-	//			}
-	//			if response.StatusCode != 200 {
-	//				zlog.Info().Msg("Unexpected status code: %v", response.StatusCode)
-	//				return fmt.Errorf("Unexpected status code: %v", response.StatusCode)
-	//			}
-	//		}
-	//	}
-	//}
-	return nil
+	return err
 }
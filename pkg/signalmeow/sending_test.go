@@ -0,0 +1,137 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+func TestSendMessage(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestPhone(t, server, "+15550000001")
+	bob := newTestPhone(t, server, "+15550000002")
+	client := linkTestClient(t, server, alice)
+	ctx := newTestContext(t)
+	require.NoError(t, client.Device.ProfileKeyStore.StoreProfileKey(bob.ACI.String(), bob.ProfileKey, ctx))
+	startTestClient(t, client)
+
+	send := func(text string) {
+		t.Helper()
+		result := client.SendMessage(ctx, bob.ACI.String(), DataMessageForText(text, nil))
+		require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+		assert.True(t, result.Unidentified, "the message must be sent with sealed sender")
+		msg, err := bob.ReceiveDataMessage(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, alice.ACI, msg.Sender)
+		assert.Equal(t, client.Device.Data.DeviceId, msg.SenderDevice)
+		assert.True(t, msg.Sealed)
+		assert.Equal(t, text, msg.Content.GetDataMessage().GetBody())
+		assert.Equal(t, alice.ProfileKey[:], msg.Content.GetDataMessage().GetProfileKey())
+	}
+	send("first message")
+
+	// The sent message is synced to our own phone
+	sync, err := alice.Receive(ctx)
+	require.NoError(t, err)
+	for sync.Content.GetSyncMessage().GetSent() == nil {
+		sync, err = alice.Receive(ctx)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, bob.ACI.String(), sync.Content.GetSyncMessage().GetSent().GetDestinationServiceId())
+	assert.Equal(t, "first message", sync.Content.GetSyncMessage().GetSent().GetMessage().GetBody())
+
+	// Linking a new device makes the server reject the next send with 409 until it's included
+	bobLinked := linkTestClient(t, server, bob)
+	send("after linking")
+	assert.Equal(t, 1, server.PendingEnvelopes(bob.ACI, bobLinked.Device.Data.DeviceId))
+
+	// A changed registration ID makes the server reject the next send with 410 until the session is replaced
+	require.True(t, server.ChangeRegistrationID(bob.ACI, 1))
+	send("after reregistering")
+	assert.Equal(t, 2, server.PendingEnvelopes(bob.ACI, bobLinked.Device.Data.DeviceId))
+}
+
+func TestIsRetryableSendError(t *testing.T) {
+	dialErr := &url.Error{Op: "Get", URL: "https://chat.signal.org/v2/keys", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	for _, tc := range []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"connection failed", fmt.Errorf("%w: %w", ErrSendConnectionFailed, io.EOF), true},
+		{"rate limited", &RateLimitError{Until: time.Now().Add(time.Minute)}, true},
+		{"captcha", &SendStatusError{StatusCode: http.StatusPreconditionRequired}, true},
+		{"server error", &SendStatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"too many requests", &SendStatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"unregistered recipient", &SendStatusError{StatusCode: http.StatusNotFound}, false},
+		{"stale devices after retries", &SendStatusError{StatusCode: http.StatusGone}, false},
+		{"prekey fetch network error", fmt.Errorf("%w: %w", ErrPreKeyFetchFailed, dialErr), true},
+		{"prekey fetch server error", fmt.Errorf("%w: %w", ErrPreKeyFetchFailed, &web.HTTPStatusError{StatusCode: http.StatusBadGateway}), true},
+		{"prekey fetch rate limited", fmt.Errorf("%w: %w", ErrPreKeyFetchFailed, &web.HTTPStatusError{StatusCode: http.StatusTooManyRequests}), true},
+		{"prekey fetch unknown user", fmt.Errorf("%w: %w", ErrPreKeyFetchFailed, &web.HTTPStatusError{StatusCode: http.StatusNotFound}), false},
+		{"group fetch network error", fmt.Errorf("failed to fetch group: %w", dialErr), true},
+		{"truncated response", fmt.Errorf("JSON decoding failed: %w", io.ErrUnexpectedEOF), true},
+		{"timeout", fmt.Errorf("failed to fetch group: %w", context.DeadlineExceeded), true},
+		{"canceled", context.Canceled, false},
+		{"encryption error", errors.New("No addresses or session records"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.retryable, IsRetryableSendError(tc.err))
+		})
+	}
+}
+
+func TestSendRetryAfter(t *testing.T) {
+	assert.Equal(t, 30*time.Second, SendRetryAfter(fmt.Errorf("wrapped: %w", &SendStatusError{StatusCode: 503, RetryAfter: 30 * time.Second})))
+	assert.InDelta(t, time.Minute, SendRetryAfter(&RateLimitError{Until: time.Now().Add(time.Minute)}), float64(time.Second))
+	assert.Zero(t, SendRetryAfter(&RateLimitError{CaptchaRequired: true}))
+	assert.Zero(t, SendRetryAfter(ErrSendConnectionFailed))
+}
+
+func TestRetryAfterFromHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		headers  []string
+		expected time.Duration
+	}{
+		{"missing", []string{"Content-Type:application/json"}, 0},
+		{"seconds", []string{"Content-Type:application/json", "Retry-After:30"}, 30 * time.Second},
+		{"case and whitespace", []string{"retry-after: 5 "}, 5 * time.Second},
+		{"http date", []string{"Retry-After:Wed, 21 Oct 2015 07:28:00 GMT"}, 0},
+		{"zero", []string{"Retry-After:0"}, 0},
+		{"negative", []string{"Retry-After:-5"}, 0},
+		{"no colon", []string{"Retry-After 30"}, 0},
+		{"first valid", []string{"Retry-After:invalid", "Retry-After:10"}, 10 * time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, retryAfterFromHeaders(tc.headers))
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// upload is an in-progress TUS upload to the fake CDN.
+type upload struct {
+	length int64
+	data   []byte
+}
+
+// handleUploadForm implements GET /v4/attachments/form/upload. The fake CDN only speaks TUS, like CDN3.
+func (s *Server) handleUploadForm(w http.ResponseWriter, r *http.Request) {
+	_, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	keyBytes := make([]byte, 15)
+	_, _ = rand.Read(keyBytes)
+	key := base64.RawURLEncoding.EncodeToString(keyBytes)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"cdn":                  3,
+		"key":                  key,
+		"headers":              map[string]string{"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(key))},
+		"signedUploadLocation": s.cdn.URL + "/upload",
+	})
+}
+
+// AttachmentCount returns the number of attachments that have been fully uploaded to the CDN.
+func (s *Server) AttachmentCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.attachments)
+}
+
+func (s *Server) cdnHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", s.handleCreateUpload)
+	mux.HandleFunc("/upload/", s.handleUpload)
+	mux.HandleFunc("/attachments/", s.handleDownloadAttachment)
+	return mux
+}
+
+func uploadKeyFromMetadata(metadata string) string {
+	name, value, _ := strings.Cut(metadata, " ")
+	if name != "filename" {
+		return ""
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return ""
+	}
+	return string(key)
+}
+
+// handleCreateUpload implements the TUS creation request (POST /upload)
+func (s *Server) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	key := uploadKeyFromMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil || length < 0 || key == "" || r.Header.Get("Tus-Resumable") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	s.uploads[key] = &upload{length: length}
+	s.lock.Unlock()
+	w.Header().Set("Location", "/upload/"+key)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleUpload implements TUS offset (HEAD) and data (PATCH) requests.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/upload/")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	up, ok := s.uploads[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(up.data)))
+		w.Header().Set("Upload-Length", strconv.FormatInt(up.length, 10))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if offset != int64(len(up.data)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		// Keep whatever was received even if the connection breaks, so that the upload can be resumed
+		data, _ := io.ReadAll(io.LimitReader(r.Body, up.length-offset))
+		up.data = append(up.data, data...)
+		if int64(len(up.data)) == up.length {
+			s.attachments[key] = up.data
+		}
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(up.data)))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDownloadAttachment implements GET /attachments/{key}
+func (s *Server) handleDownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.lock.Lock()
+	data, ok := s.attachments[strings.TrimPrefix(r.URL.Path, "/attachments/")]
+	s.lock.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,273 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+type deviceJSON struct {
+	ID       int    `json:"id"`
+	Name     []byte `json:"name,omitempty"`
+	Created  int64  `json:"created"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+type linkDeviceRequest struct {
+	VerificationCode  string `json:"verificationCode"`
+	AccountAttributes struct {
+		FetchesMessages   bool   `json:"fetchesMessages"`
+		Name              []byte `json:"name"`
+		RegistrationID    int    `json:"registrationId"`
+		PNIRegistrationID int    `json:"pniRegistrationId"`
+	} `json:"accountAttributes"`
+	ACISignedPreKey       *preKeyJSON `json:"aciSignedPreKey"`
+	PNISignedPreKey       *preKeyJSON `json:"pniSignedPreKey"`
+	ACIPQLastResortPreKey *preKeyJSON `json:"aciPqLastResortPreKey"`
+	PNIPQLastResortPreKey *preKeyJSON `json:"pniPqLastResortPreKey"`
+}
+
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/v1/devices" && r.Method == http.MethodGet:
+		s.handleListDevices(w, r)
+	case path == "/v1/devices/link" && r.Method == http.MethodPut:
+		s.handleLinkDevice(w, r)
+	case path == "/v1/devices/provisioning/code" && r.Method == http.MethodGet:
+		s.handleProvisioningCode(w, r)
+	case strings.HasPrefix(path, "/v1/devices/") && r.Method == http.MethodDelete:
+		s.handleDeleteDevice(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// handleListDevices implements GET /v1/devices
+func (s *Server) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	account, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.lock.Lock()
+	devices := make([]deviceJSON, 0, len(account.devices))
+	for _, device := range account.devices {
+		devices = append(devices, deviceJSON{
+			ID:       device.id,
+			Name:     device.name,
+			Created:  device.created.UnixMilli(),
+			LastSeen: device.lastSeen.UnixMilli(),
+		})
+	}
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
+
+// handleDeleteDevice implements DELETE /v1/devices/{id}, which is only allowed for the primary device.
+func (s *Server) handleDeleteDevice(w http.ResponseWriter, r *http.Request) {
+	account, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if device.id != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	deviceID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/v1/devices/"))
+	if err != nil || deviceID == 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	delete(account.devices, deviceID)
+	s.lock.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleProvisioningCode implements GET /v1/devices/provisioning/code, which returns
+// a one-time code for linking a new device to the account.
+func (s *Server) handleProvisioningCode(w http.ResponseWriter, r *http.Request) {
+	account, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if device.id != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	code := make([]byte, 16)
+	_, _ = rand.Read(code)
+	codeStr := hex.EncodeToString(code)
+	s.lock.Lock()
+	s.linkCodes[codeStr] = account
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"verificationCode": codeStr})
+}
+
+// handleLinkDevice implements PUT /v1/devices/link. The request is authenticated with
+// the phone number of the account and the password of the new device.
+func (s *Server) handleLinkDevice(w http.ResponseWriter, r *http.Request) {
+	number, password, ok := r.BasicAuth()
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req linkDeviceRequest
+	if err := readJSON(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if req.ACISignedPreKey == nil || req.PNISignedPreKey == nil ||
+		req.ACIPQLastResortPreKey == nil || req.PNIPQLastResortPreKey == nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.linkCodes[req.VerificationCode]
+	if !ok || account.Number != number {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	delete(s.linkCodes, req.VerificationCode)
+	device := &accountDevice{
+		name:              req.AccountAttributes.Name,
+		password:          password,
+		registrationID:    req.AccountAttributes.RegistrationID,
+		pniRegistrationID: req.AccountAttributes.PNIRegistrationID,
+		keys: map[string]*deviceKeys{
+			identityACI: {
+				signedPreKey:       req.ACISignedPreKey,
+				pqLastResortPreKey: req.ACIPQLastResortPreKey,
+			},
+			identityPNI: {
+				signedPreKey:       req.PNISignedPreKey,
+				pqLastResortPreKey: req.PNIPQLastResortPreKey,
+			},
+		},
+	}
+	s.addDevice(account, device)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"uuid":     account.ACI.String(),
+		"pni":      account.PNI.String(),
+		"deviceId": device.id,
+	})
+}
+
+// handleDeviceName implements PUT /v1/accounts/name
+func (s *Server) handleDeviceName(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	_, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		DeviceName []byte `json:"deviceName"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	device.name = req.DeviceName
+	s.lock.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleProvisioningWebsocket accepts a websocket from a device that wants to be linked
+// and tells it the provisioning address, which is included in the linking QR code.
+func (s *Server) handleProvisioningWebsocket(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") == "" {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := s.acceptWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.close()
+	address := uuid.NewString()
+	s.lock.Lock()
+	s.provisioning[address] = conn
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.provisioning, address)
+		s.lock.Unlock()
+	}()
+	body, err := proto.Marshal(&signalpb.ProvisioningUuid{Uuid: &address})
+	if err != nil {
+		return
+	}
+	if conn.sendRequest(http.MethodPut, "/v1/address", body, nil) != nil {
+		return
+	}
+	conn.readLoop()
+}
+
+// handleProvisioningMessage implements PUT /v1/provisioning/{address}, which forwards
+// an encrypted ProvisionEnvelope from the primary device to the new device.
+func (s *Server) handleProvisioningMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	_, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, err := base64.StdEncoding.DecodeString(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	conn, ok := s.provisioning[strings.TrimPrefix(r.URL.Path, "/v1/provisioning/")]
+	s.lock.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if conn.sendRequest(http.MethodPut, "/v1/message", body, nil) != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,247 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+type storedGroup struct {
+	group   *signalpb.Group
+	changes []*signalpb.GroupChange
+}
+
+// authenticateGroup checks the zkgroup auth credential presentation of a groups service
+// request and returns the group public params and the encrypted ACI of the requester.
+func (s *Server) authenticateGroup(r *http.Request) (string, *libsignalgo.UUIDCiphertext, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil, false
+	}
+	publicParamsBytes, err := hex.DecodeString(username)
+	if err != nil || len(publicParamsBytes) != len(libsignalgo.GroupPublicParams{}) {
+		return "", nil, false
+	}
+	presentation, err := hex.DecodeString(password)
+	if err != nil {
+		return "", nil, false
+	}
+	var publicParams libsignalgo.GroupPublicParams
+	copy(publicParams[:], publicParamsBytes)
+	err = s.zkSecretParams.VerifyAuthCredentialPresentation(publicParams, presentation, uint64(time.Now().Unix()))
+	if err != nil {
+		return "", nil, false
+	}
+	userID, err := libsignalgo.AuthCredentialPresentation(presentation).GetUUIDCiphertext()
+	if err != nil {
+		return "", nil, false
+	}
+	return username, userID, true
+}
+
+func findMember(group *signalpb.Group, userID []byte) *signalpb.Member {
+	for _, member := range group.Members {
+		if bytes.Equal(member.UserId, userID) {
+			return member
+		}
+	}
+	return nil
+}
+
+// handleGroups implements GET, PUT and PATCH /v1/groups on the storage service. Unlike the
+// real server, members are added with their encrypted ACI and profile key directly
+// instead of a profile key credential presentation.
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	groupKey, userID, ok := s.authenticateGroup(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored, exists := s.groups[groupKey]
+	if r.Method == http.MethodPut {
+		if exists {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		group := &signalpb.Group{}
+		if proto.Unmarshal(body, group) != nil || group.Revision != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if findMember(group, userID[:]) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		s.groups[groupKey] = &storedGroup{group: group}
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if findMember(stored.group, userID[:]) == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeProto(w, stored.group)
+	case http.MethodPatch:
+		actions := &signalpb.GroupChange_Actions{}
+		if proto.Unmarshal(body, actions) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if actions.Revision != stored.group.Revision+1 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		actions.SourceServiceId = userID[:]
+		change, err := s.applyGroupChange(stored, actions)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeProto(w, change)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleGroupLogs implements GET /v1/groups/logs/{fromRevision}. At most GroupLogPageSize changes are
+// returned, with status 206 if there are more. The current group state is always included with the
+// last change of the last page.
+func (s *Server) handleGroupLogs(w http.ResponseWriter, r *http.Request) {
+	groupKey, userID, ok := s.authenticateGroup(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fromRevision, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/v1/groups/logs/"), 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored, exists := s.groups[groupKey]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if findMember(stored.group, userID[:]) == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// The change at index i moved the group to revision i+1
+	start := int(fromRevision) - 1
+	if start < 0 {
+		start = 0
+	}
+	end := len(stored.changes)
+	if s.GroupLogPageSize > 0 && start+s.GroupLogPageSize < end {
+		end = start + s.GroupLogPageSize
+	}
+	response := &signalpb.GroupChanges{}
+	for i := start; i < end; i++ {
+		response.GroupChanges = append(response.GroupChanges, &signalpb.GroupChanges_GroupChangeState{
+			GroupChange: stored.changes[i],
+		})
+	}
+	if end < len(stored.changes) {
+		writeProtoStatus(w, http.StatusPartialContent, response)
+		return
+	}
+	if len(response.GroupChanges) > 0 {
+		response.GroupChanges[len(response.GroupChanges)-1].GroupState = stored.group
+	}
+	writeProto(w, response)
+}
+
+// applyGroupChange applies the supported subset of group change actions. The caller must hold the server lock.
+func (s *Server) applyGroupChange(stored *storedGroup, actions *signalpb.GroupChange_Actions) (*signalpb.GroupChange, error) {
+	group := stored.group
+	if actions.ModifyTitle != nil {
+		group.Title = actions.ModifyTitle.Title
+	}
+	if actions.ModifyDescription != nil {
+		group.Description = actions.ModifyDescription.Description
+	}
+	if actions.ModifyAvatar != nil {
+		group.Avatar = actions.ModifyAvatar.Avatar
+	}
+	if actions.ModifyDisappearingMessagesTimer != nil {
+		group.DisappearingMessagesTimer = actions.ModifyDisappearingMessagesTimer.Timer
+	}
+	for _, add := range actions.AddMembers {
+		if add.GetAdded() != nil && findMember(group, add.Added.UserId) == nil {
+			add.Added.JoinedAtRevision = actions.Revision
+			group.Members = append(group.Members, add.Added)
+		}
+	}
+	for _, del := range actions.DeleteMembers {
+		for i, member := range group.Members {
+			if bytes.Equal(member.UserId, del.DeletedUserId) {
+				group.Members = append(group.Members[:i], group.Members[i+1:]...)
+				break
+			}
+		}
+	}
+	group.Revision = actions.Revision
+	actionBytes, err := proto.Marshal(actions)
+	if err != nil {
+		return nil, err
+	}
+	change := &signalpb.GroupChange{Actions: actionBytes}
+	stored.changes = append(stored.changes, change)
+	return change, nil
+}
+
+func writeProto(w http.ResponseWriter, msg proto.Message) {
+	writeProtoStatus(w, http.StatusOK, msg)
+}
+
+func writeProtoStatus(w http.ResponseWriter, status int, msg proto.Message) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,299 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+)
+
+type preKeyJSON struct {
+	KeyID     uint32 `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature,omitempty"`
+}
+
+type deviceKeys struct {
+	signedPreKey       *preKeyJSON
+	preKeys            []preKeyJSON
+	pqPreKeys          []preKeyJSON
+	pqLastResortPreKey *preKeyJSON
+}
+
+type setKeysRequest struct {
+	IdentityKey        string       `json:"identityKey"`
+	PreKeys            []preKeyJSON `json:"preKeys"`
+	PQPreKeys          []preKeyJSON `json:"pqPreKeys"`
+	SignedPreKey       *preKeyJSON  `json:"signedPreKey"`
+	PQLastResortPreKey *preKeyJSON  `json:"pqLastResortPreKey"`
+}
+
+type preKeyResponseDevice struct {
+	DeviceID       int         `json:"deviceId"`
+	RegistrationID int         `json:"registrationId"`
+	SignedPreKey   *preKeyJSON `json:"signedPreKey"`
+	PreKey         *preKeyJSON `json:"preKey,omitempty"`
+	PQPreKey       *preKeyJSON `json:"pqPreKey,omitempty"`
+}
+
+type preKeyResponse struct {
+	IdentityKey string                 `json:"identityKey"`
+	Devices     []preKeyResponseDevice `json:"devices"`
+}
+
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		s.handleSetKeys(w, r)
+	case http.MethodGet:
+		if r.URL.Path == "/v2/keys" {
+			s.handleKeyCount(w, r)
+		} else {
+			s.handleGetKeys(w, r)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSetKeys implements PUT /v2/keys?identity={aci,pni}
+func (s *Server) handleSetKeys(w http.ResponseWriter, r *http.Request) {
+	account, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	identity := r.URL.Query().Get("identity")
+	if identity == "" {
+		identity = identityACI
+	} else if identity != identityACI && identity != identityPNI {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var req setKeysRequest
+	if err := readJSON(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	identityKey, err := base64.StdEncoding.DecodeString(req.IdentityKey)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if string(account.identityKeys[identity]) != string(identityKey) {
+		// Only the primary device can change the identity key, which isn't supported here
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	keys := device.keysFor(identity)
+	keys.preKeys = append(keys.preKeys, req.PreKeys...)
+	keys.pqPreKeys = append(keys.pqPreKeys, req.PQPreKeys...)
+	if req.SignedPreKey != nil {
+		keys.signedPreKey = req.SignedPreKey
+	}
+	if req.PQLastResortPreKey != nil {
+		keys.pqLastResortPreKey = req.PQLastResortPreKey
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleKeyCount implements GET /v2/keys?identity={aci,pni}, which returns how many
+// one-time prekeys the authenticated device has left.
+func (s *Server) handleKeyCount(w http.ResponseWriter, r *http.Request) {
+	_, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	identity := r.URL.Query().Get("identity")
+	if identity == "" {
+		identity = identityACI
+	}
+	s.lock.Lock()
+	keys := device.keysFor(identity)
+	resp := map[string]int{"count": len(keys.preKeys), "pqCount": len(keys.pqPreKeys)}
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleGetKeys implements GET /v2/keys/{serviceID}/{deviceID or *}. Every fetched
+// one-time prekey is removed, the last resort kyber prekey is used when they run out.
+func (s *Server) handleGetKeys(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/keys/"), "/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	serviceID, err := uuid.Parse(parts[0])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	deviceID := -1
+	if parts[1] != "*" {
+		deviceID, err = strconv.Atoi(parts[1])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account := s.accountByServiceID(serviceID)
+	if account == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	identity := identityACI
+	if serviceID == account.PNI {
+		identity = identityPNI
+	}
+	resp := preKeyResponse{
+		IdentityKey: base64.StdEncoding.EncodeToString(account.identityKeys[identity]),
+		Devices:     []preKeyResponseDevice{},
+	}
+	for id, device := range account.devices {
+		if deviceID >= 0 && id != deviceID {
+			continue
+		}
+		keys := device.keysFor(identity)
+		if keys.signedPreKey == nil {
+			continue
+		}
+		respDevice := preKeyResponseDevice{
+			DeviceID:       id,
+			RegistrationID: device.registrationIDFor(identity == identityPNI),
+			SignedPreKey:   keys.signedPreKey,
+			PQPreKey:       keys.pqLastResortPreKey,
+		}
+		if len(keys.preKeys) > 0 {
+			respDevice.PreKey = &keys.preKeys[0]
+			keys.preKeys = keys.preKeys[1:]
+		}
+		if len(keys.pqPreKeys) > 0 {
+			respDevice.PQPreKey = &keys.pqPreKeys[0]
+			keys.pqPreKeys = keys.pqPreKeys[1:]
+		}
+		resp.Devices = append(resp.Devices, respDevice)
+	}
+	if len(resp.Devices) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+func (d *accountDevice) keysFor(identity string) *deviceKeys {
+	keys, ok := d.keys[identity]
+	if !ok {
+		keys = &deviceKeys{}
+		d.keys[identity] = keys
+	}
+	return keys
+}
+
+// handleDeliveryCertificate implements GET /v1/certificate/delivery, which returns
+// a sender certificate for sealed sender messages.
+func (s *Server) handleDeliveryCertificate(w http.ResponseWriter, r *http.Request) {
+	account, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	certificate, err := s.senderCertificate(account, device)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	serialized, err := certificate.Serialize()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"certificate": base64.StdEncoding.EncodeToString(serialized),
+	})
+}
+
+func (s *Server) senderCertificate(account *Account, device *accountDevice) (*libsignalgo.SenderCertificate, error) {
+	s.lock.Lock()
+	identityKey := account.identityKeys[identityACI]
+	s.lock.Unlock()
+	publicKey, err := libsignalgo.DeserializePublicKey(identityKey)
+	if err != nil {
+		return nil, err
+	}
+	return libsignalgo.NewSenderCertificate(
+		libsignalgo.NewSealedSenderAddress(account.Number, account.ACI, uint32(device.id)),
+		publicKey,
+		time.Now().Add(24*time.Hour),
+		s.serverCertificate,
+		s.serverKey,
+	)
+}
+
+type groupCredential struct {
+	Credential     []byte `json:"credential"`
+	RedemptionTime int64  `json:"redemptionTime"`
+}
+
+// handleGroupAuthCredentials implements GET /v1/certificate/auth/group, which returns
+// one zkgroup auth credential for each day in the requested range.
+func (s *Server) handleGroupAuthCredentials(w http.ResponseWriter, r *http.Request) {
+	account, device := s.authenticate(r)
+	if device == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	start, err := strconv.ParseInt(r.URL.Query().Get("redemptionStartSeconds"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	end, err := strconv.ParseInt(r.URL.Query().Get("redemptionEndSeconds"), 10, 64)
+	if err != nil || end < start || start%86400 != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	credentials := []groupCredential{}
+	for redemptionTime := start; redemptionTime <= end; redemptionTime += 86400 {
+		credential, err := s.zkSecretParams.IssueAuthCredentialWithPni(account.ACI, account.PNI, uint64(redemptionTime))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		credentials = append(credentials, groupCredential{
+			Credential:     credential[:],
+			RedemptionTime: redemptionTime,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"credentials": credentials,
+		"pni":         account.PNI.String(),
+	})
+}
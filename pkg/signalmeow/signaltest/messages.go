@@ -0,0 +1,148 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+type outgoingMessages struct {
+	Timestamp uint64            `json:"timestamp"`
+	Online    bool              `json:"online"`
+	Urgent    bool              `json:"urgent"`
+	Messages  []outgoingMessage `json:"messages"`
+}
+
+type outgoingMessage struct {
+	Type                      int    `json:"type"`
+	DestinationDeviceID       int    `json:"destinationDeviceId"`
+	DestinationRegistrationID int    `json:"destinationRegistrationId"`
+	Content                   string `json:"content"`
+}
+
+type mismatchedDevices struct {
+	MissingDevices []int `json:"missingDevices"`
+	ExtraDevices   []int `json:"extraDevices"`
+}
+
+type staleDevices struct {
+	StaleDevices []int `json:"staleDevices"`
+}
+
+// handleSendMessages implements PUT /v1/messages/{destination}. Senders either authenticate
+// normally, or use sealed sender with the unidentified access key of the recipient.
+func (s *Server) handleSendMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	destinationID, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, "/v1/messages/"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	senderAccount, senderDevice := s.authenticate(r)
+	var req outgoingMessages
+	if err = readJSON(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	destination := s.accountByServiceID(destinationID)
+	if destination == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if senderDevice == nil {
+		accessKey, err := base64.StdEncoding.DecodeString(r.Header.Get("Unidentified-Access-Key"))
+		if err != nil || len(destination.unidentifiedAccessKey) == 0 ||
+			subtle.ConstantTimeCompare(accessKey, destination.unidentifiedAccessKey) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Messages must be sent to every device of the recipient (except the sending device itself)
+	var mismatched mismatchedDevices
+	var stale staleDevices
+	included := make(map[int]bool, len(req.Messages))
+	for _, msg := range req.Messages {
+		included[msg.DestinationDeviceID] = true
+		device, ok := destination.devices[msg.DestinationDeviceID]
+		if !ok || (senderAccount == destination && device == senderDevice) {
+			mismatched.ExtraDevices = append(mismatched.ExtraDevices, msg.DestinationDeviceID)
+		} else if device.registrationIDFor(destinationID == destination.PNI) != msg.DestinationRegistrationID {
+			stale.StaleDevices = append(stale.StaleDevices, msg.DestinationDeviceID)
+		}
+	}
+	for id, device := range destination.devices {
+		if !included[id] && !(senderAccount == destination && device == senderDevice) {
+			mismatched.MissingDevices = append(mismatched.MissingDevices, id)
+		}
+	}
+	if len(mismatched.MissingDevices) > 0 || len(mismatched.ExtraDevices) > 0 {
+		writeJSON(w, http.StatusConflict, &mismatched)
+		return
+	} else if len(stale.StaleDevices) > 0 {
+		writeJSON(w, http.StatusGone, &stale)
+		return
+	}
+
+	serverTimestamp := uint64(time.Now().UnixMilli())
+	destinationServiceID := destinationID.String()
+	for _, msg := range req.Messages {
+		content, err := base64.StdEncoding.DecodeString(msg.Content)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		envelopeType := signalpb.Envelope_Type(msg.Type)
+		envelope := &signalpb.Envelope{
+			Type:                 &envelopeType,
+			DestinationServiceId: &destinationServiceID,
+			Timestamp:            &req.Timestamp,
+			ServerTimestamp:      &serverTimestamp,
+			ServerGuid:           proto.String(uuid.NewString()),
+			Content:              content,
+			Urgent:               &req.Urgent,
+		}
+		if senderDevice != nil {
+			envelope.SourceServiceId = proto.String(senderAccount.ACI.String())
+			envelope.SourceDevice = proto.Uint32(uint32(senderDevice.id))
+		}
+		s.enqueue(destination.devices[msg.DestinationDeviceID], envelope)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"needsSync": false})
+}
+
+func (d *accountDevice) registrationIDFor(pni bool) int {
+	if pni {
+		return d.pniRegistrationID
+	}
+	return d.registrationID
+}
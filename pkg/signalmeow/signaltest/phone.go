@@ -0,0 +1,384 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// Phone simulates the primary device of a Signal account. It can link new devices and
+// exchange real end-to-end encrypted messages with other phones and linked devices.
+type Phone struct {
+	server *Server
+	client *web.Client
+	device *accountDevice
+
+	ACI        uuid.UUID
+	PNI        uuid.UUID
+	Number     string
+	ProfileKey libsignalgo.ProfileKey
+
+	// Store contains the ACI identity, sessions and prekeys of the phone.
+	Store    *Store
+	pniStore *Store
+
+	password    string
+	aciIdentity *libsignalgo.IdentityKeyPair
+	pniIdentity *libsignalgo.IdentityKeyPair
+
+	// sendLock prevents concurrent sends from racing on session ratchets
+	sendLock sync.Mutex
+}
+
+const phonePreKeyCount = 10
+
+// NewPhone registers a new account on the server with the phone as its primary device.
+func NewPhone(server *Server, number string) (*Phone, error) {
+	client, err := server.NewWebClient()
+	if err != nil {
+		return nil, err
+	}
+	aciIdentity, err := libsignalgo.GenerateIdentityKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	pniIdentity, err := libsignalgo.GenerateIdentityKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	aciPublicKey, err := aciIdentity.GetPublicKey().Serialize()
+	if err != nil {
+		return nil, err
+	}
+	pniPublicKey, err := pniIdentity.GetPublicKey().Serialize()
+	if err != nil {
+		return nil, err
+	}
+	p := &Phone{
+		server:      server,
+		client:      client,
+		Number:      number,
+		aciIdentity: aciIdentity,
+		pniIdentity: pniIdentity,
+		password:    randomHex(16),
+	}
+	if _, err = rand.Read(p.ProfileKey[:]); err != nil {
+		return nil, err
+	}
+	accessKey, err := p.ProfileKey.DeriveAccessKey()
+	if err != nil {
+		return nil, err
+	}
+	p.device = &accountDevice{
+		password:          p.password,
+		registrationID:    randomRegistrationID(),
+		pniRegistrationID: randomRegistrationID(),
+	}
+	account := server.registerAccount(number, accessKey[:], aciPublicKey, pniPublicKey, p.device)
+	p.ACI = account.ACI
+	p.PNI = account.PNI
+	p.Store = NewStore(aciIdentity, uint32(p.device.registrationID))
+	p.pniStore = NewStore(pniIdentity, uint32(p.device.pniRegistrationID))
+
+	if err = p.uploadKeys(identityACI, p.Store, aciIdentity); err != nil {
+		return nil, fmt.Errorf("failed to upload ACI keys: %w", err)
+	}
+	if err = p.uploadKeys(identityPNI, p.pniStore, pniIdentity); err != nil {
+		return nil, fmt.Errorf("failed to upload PNI keys: %w", err)
+	}
+	return p, nil
+}
+
+func randomHex(length int) string {
+	data := make([]byte, length)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func randomRegistrationID() int {
+	var data [2]byte
+	_, _ = rand.Read(data[:])
+	return int(binary.BigEndian.Uint16(data[:]))%16380 + 1
+}
+
+func (p *Phone) request(method, path string, body any, opts *web.HTTPReqOpt) (*http.Response, error) {
+	if opts == nil {
+		opts = &web.HTTPReqOpt{}
+	}
+	if opts.Username == nil && opts.Headers["Unidentified-Access-Key"] == "" {
+		username := p.ACI.String()
+		opts.Username, opts.Password = &username, &p.password
+	}
+	if body != nil {
+		var err error
+		opts.Body, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p.client.SendHTTPRequest(method, path, opts)
+}
+
+func (p *Phone) requestJSON(method, path string, body, into any) error {
+	resp, err := p.request(method, path, body, nil)
+	if err != nil {
+		return err
+	} else if into == nil {
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+	return web.DecodeHTTPResponseBody(into, resp)
+}
+
+func encodeKey(key interface{ Serialize() ([]byte, error) }) string {
+	serialized, err := key.Serialize()
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(serialized)
+}
+
+// uploadKeys generates a signed prekey, one-time prekeys and kyber prekeys, and uploads them like a phone would.
+func (p *Phone) uploadKeys(identity string, store *Store, identityKeyPair *libsignalgo.IdentityKeyPair) error {
+	ctx := context.Background()
+	req := setKeysRequest{
+		IdentityKey: encodeKey(identityKeyPair.GetPublicKey()),
+	}
+	for id := uint32(1); id <= phonePreKeyCount; id++ {
+		privateKey, err := libsignalgo.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		preKey, err := libsignalgo.NewPreKeyRecordFromPrivateKey(id, privateKey)
+		if err != nil {
+			return err
+		}
+		publicKey, err := privateKey.GetPublicKey()
+		if err != nil {
+			return err
+		}
+		if err = store.StorePreKey(id, preKey, ctx); err != nil {
+			return err
+		}
+		req.PreKeys = append(req.PreKeys, preKeyJSON{KeyID: id, PublicKey: encodeKey(publicKey)})
+	}
+	// The last kyber prekey is the last resort key
+	for id := uint32(1); id <= phonePreKeyCount+1; id++ {
+		keyPair, err := libsignalgo.KyberKeyPairGenerate()
+		if err != nil {
+			return err
+		}
+		publicKey, err := keyPair.GetPublicKey()
+		if err != nil {
+			return err
+		}
+		serializedPublicKey, err := publicKey.Serialize()
+		if err != nil {
+			return err
+		}
+		signature, err := identityKeyPair.GetPrivateKey().Sign(serializedPublicKey)
+		if err != nil {
+			return err
+		}
+		record, err := libsignalgo.NewKyberPreKeyRecord(id, time.Now(), keyPair, signature)
+		if err != nil {
+			return err
+		}
+		if err = store.StoreKyberPreKey(id, record, ctx); err != nil {
+			return err
+		}
+		key := preKeyJSON{
+			KeyID:     id,
+			PublicKey: base64.StdEncoding.EncodeToString(serializedPublicKey),
+			Signature: base64.StdEncoding.EncodeToString(signature),
+		}
+		if id > phonePreKeyCount {
+			req.PQLastResortPreKey = &key
+		} else {
+			req.PQPreKeys = append(req.PQPreKeys, key)
+		}
+	}
+	privateKey, err := libsignalgo.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	publicKey, err := privateKey.GetPublicKey()
+	if err != nil {
+		return err
+	}
+	serializedPublicKey, err := publicKey.Serialize()
+	if err != nil {
+		return err
+	}
+	signature, err := identityKeyPair.GetPrivateKey().Sign(serializedPublicKey)
+	if err != nil {
+		return err
+	}
+	signedPreKey, err := libsignalgo.NewSignedPreKeyRecordFromPrivateKey(1, time.Now(), privateKey, signature)
+	if err != nil {
+		return err
+	}
+	if err = store.StoreSignedPreKey(1, signedPreKey, ctx); err != nil {
+		return err
+	}
+	req.SignedPreKey = &preKeyJSON{
+		KeyID:     1,
+		PublicKey: base64.StdEncoding.EncodeToString(serializedPublicKey),
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	}
+	return p.requestJSON(http.MethodPut, "/v2/keys?identity="+identity, &req, nil)
+}
+
+// LinkDevice scans the given sgnl://linkdevice URL and sends the account keys to the new device,
+// the same way the primary device does when scanning a QR code.
+func (p *Phone) LinkDevice(ctx context.Context, provisioningURL string) error {
+	parsed, err := url.Parse(provisioningURL)
+	if err != nil {
+		return err
+	} else if parsed.Scheme != "sgnl" || parsed.Host != "linkdevice" {
+		return fmt.Errorf("unexpected provisioning URL %q", provisioningURL)
+	}
+	address := parsed.Query().Get("uuid")
+	publicKeyBytes, err := base64.StdEncoding.DecodeString(parsed.Query().Get("pub_key"))
+	if err != nil {
+		return fmt.Errorf("failed to decode provisioning public key: %w", err)
+	}
+	publicKey, err := libsignalgo.DeserializePublicKey(publicKeyBytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse provisioning public key: %w", err)
+	}
+	var code struct {
+		VerificationCode string `json:"verificationCode"`
+	}
+	if err = p.requestJSON(http.MethodGet, "/v1/devices/provisioning/code", nil, &code); err != nil {
+		return fmt.Errorf("failed to get provisioning code: %w", err)
+	}
+
+	aciPrivateKey, err := p.aciIdentity.GetPrivateKey().Serialize()
+	if err != nil {
+		return err
+	}
+	pniPrivateKey, err := p.pniIdentity.GetPrivateKey().Serialize()
+	if err != nil {
+		return err
+	}
+	aciPublicKey, err := p.aciIdentity.GetPublicKey().Serialize()
+	if err != nil {
+		return err
+	}
+	pniPublicKey, err := p.pniIdentity.GetPublicKey().Serialize()
+	if err != nil {
+		return err
+	}
+	message, err := proto.Marshal(&signalpb.ProvisionMessage{
+		AciIdentityKeyPublic:  aciPublicKey,
+		AciIdentityKeyPrivate: aciPrivateKey,
+		PniIdentityKeyPublic:  pniPublicKey,
+		PniIdentityKeyPrivate: pniPrivateKey,
+		Aci:                   proto.String(p.ACI.String()),
+		Pni:                   proto.String(p.PNI.String()),
+		Number:                proto.String(p.Number),
+		ProvisioningCode:      proto.String(code.VerificationCode),
+		ProfileKey:            p.ProfileKey[:],
+		ReadReceipts:          proto.Bool(true),
+		ProvisioningVersion:   proto.Uint32(1),
+	})
+	if err != nil {
+		return err
+	}
+	envelope, err := encryptProvisionMessage(publicKey, message)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt provisioning message: %w", err)
+	}
+	envelopeBytes, err := proto.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return p.requestJSON(http.MethodPut, "/v1/provisioning/"+url.PathEscape(address), map[string]string{
+		"body": base64.StdEncoding.EncodeToString(envelopeBytes),
+	}, nil)
+}
+
+// encryptProvisionMessage is the inverse of signalmeow.ProvisioningCipher.Decrypt
+func encryptProvisionMessage(theirPublicKey *libsignalgo.PublicKey, message []byte) (*signalpb.ProvisionEnvelope, error) {
+	ourKeyPair, err := libsignalgo.GenerateIdentityKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	agreement, err := ourKeyPair.GetPrivateKey().Agree(theirPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]byte, 64)
+	_, err = io.ReadFull(hkdf.New(sha256.New, agreement, nil, []byte("TextSecure Provisioning Message")), keys)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(message)%aes.BlockSize
+	padded := append(bytes.Clone(message), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	body := make([]byte, 1+aes.BlockSize, 1+aes.BlockSize+len(padded)+sha256.Size)
+	body[0] = 1
+	if _, err = rand.Read(body[1:]); err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, body[1:]).CryptBlocks(ciphertext, padded)
+	body = append(body, ciphertext...)
+	mac := hmac.New(sha256.New, keys[32:])
+	mac.Write(body)
+	body = mac.Sum(body)
+
+	publicKey, err := ourKeyPair.GetPublicKey().Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return &signalpb.ProvisionEnvelope{
+		PublicKey: publicKey,
+		Body:      body,
+	}, nil
+}
@@ -0,0 +1,167 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// UploadAttachment encrypts the given data and uploads it to the fake CDN with TUS.
+func (p *Phone) UploadAttachment(data []byte, contentType string) (*signalpb.AttachmentPointer, error) {
+	keys := make([]byte, 64)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(keys); err != nil {
+		return nil, err
+	} else if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	encrypted, digest, err := encryptAttachment(data, keys, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	var form struct {
+		CDN                  uint32            `json:"cdn"`
+		Key                  string            `json:"key"`
+		Headers              map[string]string `json:"headers"`
+		SignedUploadLocation string            `json:"signedUploadLocation"`
+	}
+	if err = p.requestJSON(http.MethodGet, "/v4/attachments/form/upload", nil, &form); err != nil {
+		return nil, fmt.Errorf("failed to get upload form: %w", err)
+	}
+	headers := map[string]string{
+		"Tus-Resumable": "1.0.0",
+		"Upload-Length": strconv.Itoa(len(encrypted)),
+	}
+	for key, value := range form.Headers {
+		headers[key] = value
+	}
+	resp, err := p.client.SendHTTPRequest(http.MethodPost, "", &web.HTTPReqOpt{
+		OverrideURL: form.SignedUploadLocation,
+		ContentType: web.ContentTypeOctetStream,
+		Headers:     headers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status code %d creating upload", resp.StatusCode)
+	}
+	resp, err = p.client.SendHTTPRequest(http.MethodPatch, "", &web.HTTPReqOpt{
+		OverrideURL: p.server.cdn.URL + resp.Header.Get("Location"),
+		ContentType: web.ContentTypeOffsetOctetStream,
+		Body:        encrypted,
+		Headers: map[string]string{
+			"Tus-Resumable": "1.0.0",
+			"Upload-Offset": "0",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code %d uploading", resp.StatusCode)
+	}
+	return &signalpb.AttachmentPointer{
+		AttachmentIdentifier: &signalpb.AttachmentPointer_CdnKey{CdnKey: form.Key},
+		CdnNumber:            proto.Uint32(form.CDN),
+		ContentType:          proto.String(contentType),
+		Key:                  keys,
+		Digest:               digest,
+		Size:                 proto.Uint32(uint32(len(data))),
+	}, nil
+}
+
+// DownloadAttachment downloads and decrypts an attachment that was uploaded to the fake CDN.
+func (p *Phone) DownloadAttachment(pointer *signalpb.AttachmentPointer) ([]byte, error) {
+	resp, err := p.client.GetAttachment("/attachments/"+pointer.GetCdnKey(), pointer.GetCdnNumber(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	encrypted, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decryptAttachment(encrypted, pointer.GetKey(), pointer.GetDigest(), pointer.GetSize())
+}
+
+// encryptAttachment returns IV || AES-256-CBC ciphertext || HMAC-SHA256 and the SHA-256 digest of it.
+func encryptAttachment(plaintext, keys, iv []byte) (encrypted, digest []byte, err error) {
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(bytes.Clone(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted = make([]byte, aes.BlockSize+len(padded), aes.BlockSize+len(padded)+sha256.Size)
+	copy(encrypted, iv)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted[aes.BlockSize:], padded)
+	mac := hmac.New(sha256.New, keys[32:])
+	mac.Write(encrypted)
+	encrypted = mac.Sum(encrypted)
+	hash := sha256.Sum256(encrypted)
+	return encrypted, hash[:], nil
+}
+
+func decryptAttachment(encrypted, keys, digest []byte, size uint32) ([]byte, error) {
+	if len(keys) != 64 {
+		return nil, errors.New("invalid attachment key length")
+	} else if len(encrypted) < aes.BlockSize*2+sha256.Size || (len(encrypted)-sha256.Size)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid attachment length")
+	}
+	hash := sha256.Sum256(encrypted)
+	if digest != nil && !hmac.Equal(hash[:], digest) {
+		return nil, errors.New("attachment digest mismatch")
+	}
+	body, theirMAC := encrypted[:len(encrypted)-sha256.Size], encrypted[len(encrypted)-sha256.Size:]
+	mac := hmac.New(sha256.New, keys[32:])
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), theirMAC) {
+		return nil, errors.New("attachment MAC mismatch")
+	}
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(body)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, body[:aes.BlockSize]).CryptBlocks(plaintext, body[aes.BlockSize:])
+	if int(size) > len(plaintext) {
+		return nil, errors.New("attachment is shorter than expected")
+	}
+	return plaintext[:size], nil
+}
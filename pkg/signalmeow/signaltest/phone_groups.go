@@ -0,0 +1,222 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// groupAuth creates the basic auth credentials for the groups service from today's auth credential.
+func (p *Phone) groupAuth(groupSecretParams libsignalgo.GroupSecretParams) (username, password string, err error) {
+	today := time.Now().Truncate(24 * time.Hour).Unix()
+	var resp struct {
+		Credentials []groupCredential `json:"credentials"`
+	}
+	path := fmt.Sprintf("/v1/certificate/auth/group?redemptionStartSeconds=%d&redemptionEndSeconds=%d", today, today)
+	if err = p.requestJSON(http.MethodGet, path, nil, &resp); err != nil {
+		return "", "", fmt.Errorf("failed to get group auth credentials: %w", err)
+	} else if len(resp.Credentials) == 0 {
+		return "", "", fmt.Errorf("no group auth credentials in response")
+	}
+	response, err := libsignalgo.NewAuthCredentialWithPniResponse(resp.Credentials[0].Credential)
+	if err != nil {
+		return "", "", err
+	}
+	credential, err := libsignalgo.ReceiveAuthCredentialWithPni(*p.server.zkPublicParams, p.ACI, p.PNI, uint64(today), *response)
+	if err != nil {
+		return "", "", err
+	}
+	randomness, err := libsignalgo.GenerateRandomness()
+	if err != nil {
+		return "", "", err
+	}
+	presentation, err := libsignalgo.CreateAuthCredentialWithPniPresentation(*p.server.zkPublicParams, randomness, groupSecretParams, *credential)
+	if err != nil {
+		return "", "", err
+	}
+	publicParams, err := groupSecretParams.GetPublicParams()
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(publicParams[:]), hex.EncodeToString(*presentation), nil
+}
+
+func (p *Phone) groupRequest(masterKey libsignalgo.GroupMasterKey, method string, body []byte) ([]byte, error) {
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	username, password, err := p.groupAuth(groupSecretParams)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.SendHTTPRequest(method, "/v1/groups", &web.HTTPReqOpt{
+		Body:        body,
+		Username:    &username,
+		Password:    &password,
+		ContentType: web.ContentTypeProtobuf,
+		Host:        web.StorageUrlHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func encryptGroupAttribute(groupSecretParams libsignalgo.GroupSecretParams, blob *signalpb.GroupAttributeBlob) ([]byte, error) {
+	plaintext, err := proto.Marshal(blob)
+	if err != nil {
+		return nil, err
+	}
+	randomness, err := libsignalgo.GenerateRandomness()
+	if err != nil {
+		return nil, err
+	}
+	return groupSecretParams.EncryptBlobWithPaddingDeterministic(randomness, plaintext, 0)
+}
+
+// CreateGroup creates a new group with the phone as the admin and the given phones as
+// other members, and returns the master key of the group.
+func (p *Phone) CreateGroup(ctx context.Context, title string, members ...*Phone) (libsignalgo.GroupMasterKey, error) {
+	var masterKey libsignalgo.GroupMasterKey
+	if _, err := rand.Read(masterKey[:]); err != nil {
+		return masterKey, err
+	}
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKey)
+	if err != nil {
+		return masterKey, err
+	}
+	publicParams, err := groupSecretParams.GetPublicParams()
+	if err != nil {
+		return masterKey, err
+	}
+	encryptedTitle, err := encryptGroupAttribute(groupSecretParams, &signalpb.GroupAttributeBlob{
+		Content: &signalpb.GroupAttributeBlob_Title{Title: title},
+	})
+	if err != nil {
+		return masterKey, err
+	}
+	group := &signalpb.Group{
+		PublicKey: publicParams[:],
+		Title:     encryptedTitle,
+		AccessControl: &signalpb.AccessControl{
+			Attributes: signalpb.AccessControl_MEMBER,
+			Members:    signalpb.AccessControl_MEMBER,
+		},
+	}
+	for _, member := range append([]*Phone{p}, members...) {
+		userID, err := groupSecretParams.EncryptUUID(member.ACI)
+		if err != nil {
+			return masterKey, err
+		}
+		profileKey, err := groupSecretParams.EncryptProfileKey(member.ProfileKey, member.ACI)
+		if err != nil {
+			return masterKey, err
+		}
+		role := signalpb.Member_DEFAULT
+		if member == p {
+			role = signalpb.Member_ADMINISTRATOR
+		}
+		group.Members = append(group.Members, &signalpb.Member{
+			UserId:     userID[:],
+			ProfileKey: profileKey[:],
+			Role:       role,
+		})
+	}
+	body, err := proto.Marshal(group)
+	if err != nil {
+		return masterKey, err
+	}
+	_, err = p.groupRequest(masterKey, http.MethodPut, body)
+	return masterKey, err
+}
+
+// ChangeGroupTitle changes the title of a group and returns the signed group change,
+// which can be included in a GroupContextV2 to tell the other members about it.
+func (p *Phone) ChangeGroupTitle(ctx context.Context, masterKey libsignalgo.GroupMasterKey, title string) (revision uint32, signedChange []byte, err error) {
+	return p.changeGroupAttribute(masterKey, &signalpb.GroupAttributeBlob{
+		Content: &signalpb.GroupAttributeBlob_Title{Title: title},
+	}, func(actions *signalpb.GroupChange_Actions, encrypted []byte) {
+		actions.ModifyTitle = &signalpb.GroupChange_Actions_ModifyTitleAction{Title: encrypted}
+	})
+}
+
+// ChangeGroupDescription changes the description of a group like ChangeGroupTitle.
+func (p *Phone) ChangeGroupDescription(ctx context.Context, masterKey libsignalgo.GroupMasterKey, description string) (revision uint32, signedChange []byte, err error) {
+	return p.changeGroupAttribute(masterKey, &signalpb.GroupAttributeBlob{
+		Content: &signalpb.GroupAttributeBlob_Description{Description: description},
+	}, func(actions *signalpb.GroupChange_Actions, encrypted []byte) {
+		actions.ModifyDescription = &signalpb.GroupChange_Actions_ModifyDescriptionAction{Description: encrypted}
+	})
+}
+
+// changeGroupAttribute encrypts an attribute of a group and sends a change that sets it
+// to the next revision of the group.
+func (p *Phone) changeGroupAttribute(
+	masterKey libsignalgo.GroupMasterKey,
+	blob *signalpb.GroupAttributeBlob,
+	setAction func(actions *signalpb.GroupChange_Actions, encrypted []byte),
+) (revision uint32, signedChange []byte, err error) {
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	groupBytes, err := p.groupRequest(masterKey, http.MethodGet, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get group: %w", err)
+	}
+	var group signalpb.Group
+	if err = proto.Unmarshal(groupBytes, &group); err != nil {
+		return 0, nil, err
+	}
+	encrypted, err := encryptGroupAttribute(groupSecretParams, blob)
+	if err != nil {
+		return 0, nil, err
+	}
+	actions := &signalpb.GroupChange_Actions{Revision: group.Revision + 1}
+	setAction(actions, encrypted)
+	body, err := proto.Marshal(actions)
+	if err != nil {
+		return 0, nil, err
+	}
+	signedChange, err = p.groupRequest(masterKey, http.MethodPatch, body)
+	return group.Revision + 1, signedChange, err
+}
+
+// GroupContext returns the group context to include in data messages sent to the given group.
+func GroupContext(masterKey libsignalgo.GroupMasterKey, revision uint32) *signalpb.GroupContextV2 {
+	return &signalpb.GroupContextV2{
+		MasterKey: masterKey[:],
+		Revision:  &revision,
+	}
+}
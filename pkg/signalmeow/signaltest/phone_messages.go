@@ -0,0 +1,474 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// ReceivedMessage is a message decrypted by a Phone.
+type ReceivedMessage struct {
+	Sender       uuid.UUID
+	SenderDevice int
+	// Sealed is true if the message was sent with sealed sender
+	Sealed    bool
+	Timestamp uint64
+	Content   *signalpb.Content
+}
+
+const maxSendAttempts = 3
+
+// SendContent sends a message to all devices of the recipient. Messages to other
+// accounts use sealed sender, while messages to the phone's own linked devices
+// are sent normally like sync messages are.
+func (p *Phone) SendContent(ctx context.Context, recipient uuid.UUID, content *signalpb.Content) error {
+	var accessKey *libsignalgo.AccessKey
+	if recipient != p.ACI {
+		p.server.lock.Lock()
+		account := p.server.accounts[recipient]
+		p.server.lock.Unlock()
+		if account == nil {
+			return fmt.Errorf("unknown recipient %s", recipient)
+		}
+		// A real phone would derive this from the recipient's profile key
+		accessKey = (*libsignalgo.AccessKey)(account.unidentifiedAccessKey)
+	}
+	return p.sendContent(ctx, recipient, content, accessKey)
+}
+
+// SendUnsealedContent sends a message to all devices of the recipient without sealed sender.
+func (p *Phone) SendUnsealedContent(ctx context.Context, recipient uuid.UUID, content *signalpb.Content) error {
+	return p.sendContent(ctx, recipient, content, nil)
+}
+
+// SendText sends a plain text message and returns its timestamp.
+func (p *Phone) SendText(ctx context.Context, recipient uuid.UUID, text string) (uint64, error) {
+	timestamp := uint64(time.Now().UnixMilli())
+	return timestamp, p.SendContent(ctx, recipient, &signalpb.Content{
+		DataMessage: &signalpb.DataMessage{
+			Body:      &text,
+			Timestamp: &timestamp,
+		},
+	})
+}
+
+func (p *Phone) sendContent(ctx context.Context, recipient uuid.UUID, content *signalpb.Content, accessKey *libsignalgo.AccessKey) error {
+	plaintext, err := proto.Marshal(content)
+	if err != nil {
+		return err
+	}
+	plaintext = addPadding(plaintext)
+	var senderCertificate *libsignalgo.SenderCertificate
+	if accessKey != nil {
+		senderCertificate, err = p.senderCertificate()
+		if err != nil {
+			return fmt.Errorf("failed to get sender certificate: %w", err)
+		}
+	}
+
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	timestamp := uint64(time.Now().UnixMilli())
+	if content.GetDataMessage().GetTimestamp() != 0 {
+		timestamp = content.GetDataMessage().GetTimestamp()
+	}
+	for attempt := 1; ; attempt++ {
+		if len(p.Store.SessionDeviceIDs(recipient.String())) == 0 {
+			if err = p.fetchPreKeys(ctx, recipient, -1); err != nil {
+				return fmt.Errorf("failed to fetch prekeys: %w", err)
+			}
+		}
+		messages, err := p.encryptForDevices(ctx, recipient, plaintext, senderCertificate)
+		if err != nil {
+			return err
+		}
+		opts := &web.HTTPReqOpt{}
+		if accessKey != nil {
+			opts.Headers = map[string]string{
+				"Unidentified-Access-Key": base64.StdEncoding.EncodeToString(accessKey[:]),
+			}
+		}
+		resp, err := p.request(http.MethodPut, "/v1/messages/"+recipient.String(), &outgoingMessages{
+			Timestamp: timestamp,
+			Urgent:    true,
+			Messages:  messages,
+		}, opts)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusConflict:
+			var mismatched mismatchedDevices
+			if err = json.Unmarshal(body, &mismatched); err != nil {
+				return err
+			}
+			for _, deviceID := range mismatched.ExtraDevices {
+				if err = p.removeSession(recipient, deviceID); err != nil {
+					return err
+				}
+			}
+			for _, deviceID := range mismatched.MissingDevices {
+				if err = p.fetchPreKeys(ctx, recipient, deviceID); err != nil {
+					return fmt.Errorf("failed to fetch prekeys for missing device: %w", err)
+				}
+			}
+		case http.StatusGone:
+			var stale staleDevices
+			if err = json.Unmarshal(body, &stale); err != nil {
+				return err
+			}
+			for _, deviceID := range stale.StaleDevices {
+				if err = p.removeSession(recipient, deviceID); err != nil {
+					return err
+				}
+				if err = p.fetchPreKeys(ctx, recipient, deviceID); err != nil {
+					return fmt.Errorf("failed to fetch prekeys for stale device: %w", err)
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		if attempt >= maxSendAttempts {
+			return fmt.Errorf("giving up after %d attempts, last status code %d", attempt, resp.StatusCode)
+		}
+	}
+}
+
+func (p *Phone) removeSession(recipient uuid.UUID, deviceID int) error {
+	address, err := libsignalgo.NewAddress(recipient.String(), uint(deviceID))
+	if err != nil {
+		return err
+	}
+	return p.Store.RemoveSession(address)
+}
+
+func (p *Phone) encryptForDevices(ctx context.Context, recipient uuid.UUID, plaintext []byte, senderCertificate *libsignalgo.SenderCertificate) ([]outgoingMessage, error) {
+	callbackCtx := libsignalgo.NewCallbackContext(ctx)
+	var messages []outgoingMessage
+	for _, deviceID := range p.Store.SessionDeviceIDs(recipient.String()) {
+		if recipient == p.ACI && deviceID == p.device.id {
+			continue
+		}
+		address, err := libsignalgo.NewAddress(recipient.String(), uint(deviceID))
+		if err != nil {
+			return nil, err
+		}
+		session, err := p.Store.LoadSession(address, ctx)
+		if err != nil {
+			return nil, err
+		}
+		registrationID, err := session.GetRemoteRegistrationID()
+		if err != nil {
+			return nil, err
+		}
+		var envelopeType signalpb.Envelope_Type
+		var encrypted []byte
+		if senderCertificate != nil {
+			envelopeType = signalpb.Envelope_UNIDENTIFIED_SENDER
+			encrypted, err = libsignalgo.SealedSenderEncryptPlaintext(plaintext, address, senderCertificate, p.Store, p.Store, callbackCtx)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			ciphertext, err := libsignalgo.Encrypt(plaintext, address, p.Store, p.Store, callbackCtx)
+			if err != nil {
+				return nil, err
+			}
+			messageType, err := ciphertext.MessageType()
+			if err != nil {
+				return nil, err
+			}
+			switch messageType {
+			case libsignalgo.CiphertextMessageTypePreKey:
+				envelopeType = signalpb.Envelope_PREKEY_BUNDLE
+			case libsignalgo.CiphertextMessageTypeWhisper:
+				envelopeType = signalpb.Envelope_CIPHERTEXT
+			default:
+				return nil, fmt.Errorf("unexpected ciphertext message type %d", messageType)
+			}
+			encrypted, err = ciphertext.Serialize()
+			if err != nil {
+				return nil, err
+			}
+		}
+		messages = append(messages, outgoingMessage{
+			Type:                      int(envelopeType),
+			DestinationDeviceID:       deviceID,
+			DestinationRegistrationID: int(registrationID),
+			Content:                   base64.StdEncoding.EncodeToString(encrypted),
+		})
+	}
+	return messages, nil
+}
+
+func (p *Phone) senderCertificate() (*libsignalgo.SenderCertificate, error) {
+	var resp struct {
+		Certificate []byte `json:"certificate"`
+	}
+	err := p.requestJSON(http.MethodGet, "/v1/certificate/delivery", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return libsignalgo.DeserializeSenderCertificate(resp.Certificate)
+}
+
+func decodeKey(encoded string) []byte {
+	decoded, _ := base64.StdEncoding.DecodeString(encoded)
+	return decoded
+}
+
+// fetchPreKeys fetches the prekey bundles of the recipient's devices and starts sessions with them.
+// A negative device ID fetches all devices.
+func (p *Phone) fetchPreKeys(ctx context.Context, recipient uuid.UUID, deviceID int) error {
+	devicePath := "*"
+	if deviceID >= 0 {
+		devicePath = fmt.Sprint(deviceID)
+	}
+	var resp preKeyResponse
+	err := p.requestJSON(http.MethodGet, fmt.Sprintf("/v2/keys/%s/%s?pq=true", recipient, devicePath), nil, &resp)
+	if err != nil {
+		return err
+	}
+	identityKey, err := libsignalgo.DeserializeIdentityKey(decodeKey(resp.IdentityKey))
+	if err != nil {
+		return err
+	}
+	for _, device := range resp.Devices {
+		if recipient == p.ACI && device.DeviceID == p.device.id {
+			continue
+		}
+		var preKeyID uint32
+		var preKey *libsignalgo.PublicKey
+		if device.PreKey != nil {
+			preKeyID = device.PreKey.KeyID
+			preKey, err = libsignalgo.DeserializePublicKey(decodeKey(device.PreKey.PublicKey))
+			if err != nil {
+				return err
+			}
+		}
+		signedPreKey, err := libsignalgo.DeserializePublicKey(decodeKey(device.SignedPreKey.PublicKey))
+		if err != nil {
+			return err
+		}
+		var kyberPreKeyID uint32
+		var kyberPreKey *libsignalgo.KyberPublicKey
+		var kyberSignature []byte
+		if device.PQPreKey != nil {
+			kyberPreKeyID = device.PQPreKey.KeyID
+			kyberSignature = decodeKey(device.PQPreKey.Signature)
+			kyberPreKey, err = libsignalgo.DeserializeKyberPublicKey(decodeKey(device.PQPreKey.PublicKey))
+			if err != nil {
+				return err
+			}
+		}
+		bundle, err := libsignalgo.NewPreKeyBundle(
+			uint32(device.RegistrationID),
+			uint32(device.DeviceID),
+			preKeyID,
+			preKey,
+			device.SignedPreKey.KeyID,
+			signedPreKey,
+			decodeKey(device.SignedPreKey.Signature),
+			kyberPreKeyID,
+			kyberPreKey,
+			kyberSignature,
+			identityKey,
+		)
+		if err != nil {
+			return err
+		}
+		address, err := libsignalgo.NewAddress(recipient.String(), uint(device.DeviceID))
+		if err != nil {
+			return err
+		}
+		err = libsignalgo.ProcessPreKeyBundle(bundle, address, p.Store, p.Store, libsignalgo.NewCallbackContext(ctx))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receive waits for the next message sent to the phone, decrypts it and acknowledges it.
+func (p *Phone) Receive(ctx context.Context) (*ReceivedMessage, error) {
+	for {
+		p.server.lock.Lock()
+		var envelope *signalpb.Envelope
+		if len(p.device.queue) > 0 {
+			envelope = p.device.queue[0]
+			p.device.queue = p.device.queue[1:]
+		}
+		p.server.lock.Unlock()
+		if envelope != nil {
+			return p.decryptEnvelope(ctx, envelope)
+		}
+		select {
+		case <-p.device.wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ReceiveDataMessage calls Receive until it gets a message that contains a DataMessage.
+func (p *Phone) ReceiveDataMessage(ctx context.Context) (*ReceivedMessage, error) {
+	for {
+		msg, err := p.Receive(ctx)
+		if err != nil {
+			return nil, err
+		} else if msg.Content.GetDataMessage() != nil {
+			return msg, nil
+		}
+	}
+}
+
+func (p *Phone) decryptEnvelope(ctx context.Context, envelope *signalpb.Envelope) (*ReceivedMessage, error) {
+	msg := &ReceivedMessage{
+		Timestamp: envelope.GetTimestamp(),
+	}
+	messageType := envelope.GetType()
+	ciphertext := envelope.GetContent()
+	if messageType == signalpb.Envelope_UNIDENTIFIED_SENDER {
+		usmc, err := libsignalgo.SealedSenderDecryptToUSMC(ciphertext, p.Store, libsignalgo.NewCallbackContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt sealed sender message: %w", err)
+		}
+		senderCertificate, err := usmc.GetSenderCertificate()
+		if err != nil {
+			return nil, err
+		}
+		trustRoot, err := p.server.trustRoot.GetPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if valid, err := senderCertificate.Validate(trustRoot, time.Now()); err != nil || !valid {
+			return nil, fmt.Errorf("invalid sender certificate: %w", err)
+		}
+		msg.Sender, err = senderCertificate.GetSenderUUID()
+		if err != nil {
+			return nil, err
+		}
+		deviceID, err := senderCertificate.GetDeviceID()
+		if err != nil {
+			return nil, err
+		}
+		msg.SenderDevice = int(deviceID)
+		msg.Sealed = true
+		ciphertext, err = usmc.GetContents()
+		if err != nil {
+			return nil, err
+		}
+		innerType, err := usmc.GetMessageType()
+		if err != nil {
+			return nil, err
+		}
+		switch innerType {
+		case libsignalgo.CiphertextMessageTypePreKey:
+			messageType = signalpb.Envelope_PREKEY_BUNDLE
+		case libsignalgo.CiphertextMessageTypeWhisper:
+			messageType = signalpb.Envelope_CIPHERTEXT
+		default:
+			return nil, fmt.Errorf("unsupported sealed sender message type %d", innerType)
+		}
+	} else {
+		var err error
+		msg.Sender, err = uuid.Parse(envelope.GetSourceServiceId())
+		if err != nil {
+			return nil, fmt.Errorf("invalid source service ID: %w", err)
+		}
+		msg.SenderDevice = int(envelope.GetSourceDevice())
+	}
+
+	address, err := libsignalgo.NewAddress(msg.Sender.String(), uint(msg.SenderDevice))
+	if err != nil {
+		return nil, err
+	}
+	callbackCtx := libsignalgo.NewCallbackContext(ctx)
+	var plaintext []byte
+	switch messageType {
+	case signalpb.Envelope_PREKEY_BUNDLE:
+		preKeyMessage, err := libsignalgo.DeserializePreKeyMessage(ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err = libsignalgo.DecryptPreKey(preKeyMessage, address, p.Store, p.Store, p.Store, p.Store, p.Store, callbackCtx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt prekey message: %w", err)
+		}
+	case signalpb.Envelope_CIPHERTEXT:
+		message, err := libsignalgo.DeserializeMessage(ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err = libsignalgo.Decrypt(message, address, p.Store, p.Store, callbackCtx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt message: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported envelope type %s", messageType)
+	}
+	plaintext, err = stripPadding(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	msg.Content = &signalpb.Content{}
+	if err = proto.Unmarshal(plaintext, msg.Content); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// addPadding pads message contents to a multiple of 160 bytes the same way Signal clients do.
+func addPadding(contents []byte) []byte {
+	paddedLength := (len(contents)/160 + 1) * 160
+	padded := make([]byte, paddedLength)
+	copy(padded, contents)
+	padded[len(contents)] = 0x80
+	return padded
+}
+
+func stripPadding(contents []byte) ([]byte, error) {
+	for i := len(contents) - 1; i >= 0; i-- {
+		if contents[i] == 0x80 {
+			return contents[:i], nil
+		} else if contents[i] != 0 {
+			break
+		}
+	}
+	return nil, errors.New("invalid message padding")
+}
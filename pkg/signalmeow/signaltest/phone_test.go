@@ -0,0 +1,141 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func newTestServer(t *testing.T) *Server {
+	server, err := NewServer()
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPhoneMessages(t *testing.T) {
+	server := newTestServer(t)
+	alice, err := NewPhone(server, "+15550000001")
+	require.NoError(t, err)
+	bob, err := NewPhone(server, "+15550000002")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The first message is a prekey message, the reply and the one after that are normal messages
+	timestamp, err := alice.SendText(ctx, bob.ACI, "hello")
+	require.NoError(t, err)
+	msg, err := bob.ReceiveDataMessage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, alice.ACI, msg.Sender)
+	assert.Equal(t, 1, msg.SenderDevice)
+	assert.True(t, msg.Sealed)
+	assert.Equal(t, timestamp, msg.Content.GetDataMessage().GetTimestamp())
+	assert.Equal(t, "hello", msg.Content.GetDataMessage().GetBody())
+
+	_, err = bob.SendText(ctx, alice.ACI, "hi")
+	require.NoError(t, err)
+	msg, err = alice.ReceiveDataMessage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, bob.ACI, msg.Sender)
+	assert.Equal(t, "hi", msg.Content.GetDataMessage().GetBody())
+
+	body := "unsealed"
+	err = alice.SendUnsealedContent(ctx, bob.ACI, &signalpb.Content{
+		DataMessage: &signalpb.DataMessage{Body: &body},
+	})
+	require.NoError(t, err)
+	msg, err = bob.ReceiveDataMessage(ctx)
+	require.NoError(t, err)
+	assert.False(t, msg.Sealed)
+	assert.Equal(t, alice.ACI, msg.Sender)
+	assert.Equal(t, body, msg.Content.GetDataMessage().GetBody())
+	assert.Equal(t, 0, server.PendingEnvelopes(bob.ACI, 1))
+}
+
+func TestPhoneStaleSession(t *testing.T) {
+	server := newTestServer(t)
+	alice, err := NewPhone(server, "+15550000001")
+	require.NoError(t, err)
+	bob, err := NewPhone(server, "+15550000002")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = alice.SendText(ctx, bob.ACI, "first")
+	require.NoError(t, err)
+	_, err = bob.ReceiveDataMessage(ctx)
+	require.NoError(t, err)
+
+	// Changing the registration ID makes the server reject the old session with 410 Gone,
+	// so alice has to fetch a new prekey bundle and start a new session.
+	server.lock.Lock()
+	bob.device.registrationID++
+	server.lock.Unlock()
+	_, err = alice.SendText(ctx, bob.ACI, "second")
+	require.NoError(t, err)
+	msg, err := bob.ReceiveDataMessage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "second", msg.Content.GetDataMessage().GetBody())
+}
+
+func TestPhoneAttachments(t *testing.T) {
+	server := newTestServer(t)
+	alice, err := NewPhone(server, "+15550000001")
+	require.NoError(t, err)
+
+	data := []byte("not really an image")
+	pointer, err := alice.UploadAttachment(data, "image/png")
+	require.NoError(t, err)
+	assert.Equal(t, 1, server.AttachmentCount())
+	downloaded, err := alice.DownloadAttachment(pointer)
+	require.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+
+	pointer.Digest[0]++
+	_, err = alice.DownloadAttachment(pointer)
+	assert.Error(t, err)
+}
+
+func TestPhoneGroups(t *testing.T) {
+	server := newTestServer(t)
+	alice, err := NewPhone(server, "+15550000001")
+	require.NoError(t, err)
+	bob, err := NewPhone(server, "+15550000002")
+	require.NoError(t, err)
+	carol, err := NewPhone(server, "+15550000003")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	masterKey, err := alice.CreateGroup(ctx, "Test group", bob)
+	require.NoError(t, err)
+	revision, signedChange, err := bob.ChangeGroupTitle(ctx, masterKey, "Renamed")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), revision)
+	assert.NotEmpty(t, signedChange)
+
+	// Only members can access the group
+	_, _, err = carol.ChangeGroupTitle(ctx, masterKey, "Hijacked")
+	assert.Error(t, err)
+}
@@ -0,0 +1,378 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package signaltest contains an in-process fake Signal server and a simulated phone,
+// so that signalmeow can be tested end-to-end without talking to the real servers.
+//
+// The server implements the parts of the chat server (websockets, message delivery,
+// keys, certificates, devices and provisioning), the CDN and the groups service
+// that signalmeow uses. Message contents are never decrypted by the server, the
+// phone and signalmeow do real libsignal encryption between each other.
+package signaltest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// Server is a fake Signal server listening on localhost.
+type Server struct {
+	chat *httptest.Server
+	cdn  *httptest.Server
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	trustRoot         *libsignalgo.PrivateKey
+	serverKey         *libsignalgo.PrivateKey
+	serverCertificate *libsignalgo.ServerCertificate
+	zkSecretParams    *libsignalgo.ServerSecretParams
+	zkPublicParams    *libsignalgo.ServerPublicParams
+	config            web.Config
+
+	// GroupLogPageSize is the maximum number of changes returned by one group change log request.
+	// If there are more, the response has status 206 and the client has to request the rest.
+	// Zero means all changes are returned at once.
+	GroupLogPageSize int
+
+	lock          sync.Mutex
+	accounts      map[uuid.UUID]*Account
+	accountsByPNI map[uuid.UUID]*Account
+	linkCodes     map[string]*Account
+	provisioning  map[string]*wsConn
+	groups        map[string]*storedGroup
+	attachments   map[string][]byte
+	uploads       map[string]*upload
+}
+
+// Account is a Signal account registered on the fake server.
+type Account struct {
+	ACI    uuid.UUID
+	PNI    uuid.UUID
+	Number string
+
+	unidentifiedAccessKey []byte
+	identityKeys          map[string][]byte
+	devices               map[int]*accountDevice
+	nextDeviceID          int
+}
+
+type accountDevice struct {
+	id                int
+	name              []byte
+	password          string
+	registrationID    int
+	pniRegistrationID int
+	created           time.Time
+	lastSeen          time.Time
+
+	keys  map[string]*deviceKeys
+	queue []*signalpb.Envelope
+	// wake is signaled when envelopes are added to the queue
+	wake chan struct{}
+}
+
+const (
+	identityACI = "aci"
+	identityPNI = "pni"
+)
+
+// NewServer generates new server keys and starts the fake chat and CDN servers.
+func NewServer() (*Server, error) {
+	trustRoot, err := libsignalgo.GeneratePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate trust root: %w", err)
+	}
+	serverKey, err := libsignalgo.GeneratePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate server key: %w", err)
+	}
+	serverPublicKey, err := serverKey.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	serverCertificate, err := libsignalgo.NewServerCertificate(1, serverPublicKey, trustRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server certificate: %w", err)
+	}
+	zkSecretParams, err := libsignalgo.GenerateServerSecretParams()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate zkgroup params: %w", err)
+	}
+	zkPublicParams, err := zkSecretParams.GetPublicParams()
+	if err != nil {
+		return nil, err
+	}
+	trustRootPublicKey, err := trustRoot.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	trustRootBytes, err := trustRootPublicKey.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		trustRoot:         trustRoot,
+		serverKey:         serverKey,
+		serverCertificate: serverCertificate,
+		zkSecretParams:    zkSecretParams,
+		zkPublicParams:    zkPublicParams,
+
+		accounts:      make(map[uuid.UUID]*Account),
+		accountsByPNI: make(map[uuid.UUID]*Account),
+		linkCodes:     make(map[string]*Account),
+		provisioning:  make(map[string]*wsConn),
+		groups:        make(map[string]*storedGroup),
+		attachments:   make(map[string][]byte),
+		uploads:       make(map[string]*upload),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.chat = httptest.NewServer(s.chatHandler())
+	s.cdn = httptest.NewServer(s.cdnHandler())
+	s.config = web.Config{
+		ChatURL:    s.chat.URL,
+		StorageURL: s.chat.URL,
+		CDNURLs: map[uint32]string{
+			0: s.cdn.URL,
+			2: s.cdn.URL,
+			3: s.cdn.URL,
+		},
+		TrustRoot:          base64.StdEncoding.EncodeToString(trustRootBytes),
+		ServerPublicParams: base64.StdEncoding.EncodeToString(zkPublicParams[:]),
+	}
+	return s, nil
+}
+
+// Close stops the server and disconnects all websockets.
+func (s *Server) Close() {
+	s.cancel()
+	s.chat.CloseClientConnections()
+	s.chat.Close()
+	s.cdn.Close()
+}
+
+// Config returns the web config for connecting to this server.
+func (s *Server) Config() web.Config {
+	return s.config
+}
+
+// NewWebClient creates a web client that talks to this server, e.g. for a signalmeow.Client.
+func (s *Server) NewWebClient() (*web.Client, error) {
+	return web.NewClient(s.config)
+}
+
+func (s *Server) chatHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(web.WebsocketPath, s.handleWebsocket)
+	mux.HandleFunc(web.WebsocketProvisioningPath, s.handleProvisioningWebsocket)
+	mux.HandleFunc("/v1/keepalive", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v1/messages/", s.handleSendMessages)
+	mux.HandleFunc("/v2/keys", s.handleKeys)
+	mux.HandleFunc("/v2/keys/", s.handleKeys)
+	mux.HandleFunc("/v1/certificate/delivery", s.handleDeliveryCertificate)
+	mux.HandleFunc("/v1/certificate/auth/group", s.handleGroupAuthCredentials)
+	mux.HandleFunc("/v1/devices", s.handleDevices)
+	mux.HandleFunc("/v1/devices/", s.handleDevices)
+	mux.HandleFunc("/v1/provisioning/", s.handleProvisioningMessage)
+	mux.HandleFunc("/v1/accounts/name", s.handleDeviceName)
+	mux.HandleFunc("/v4/attachments/form/upload", s.handleUploadForm)
+	mux.HandleFunc("/v1/groups", s.handleGroups)
+	mux.HandleFunc("/v1/groups/logs/", s.handleGroupLogs)
+	return mux
+}
+
+// Account returns the account with the given ACI or PNI, or nil if there's no such account.
+func (s *Server) Account(serviceID uuid.UUID) *Account {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accountByServiceID(serviceID)
+}
+
+func (s *Server) accountByServiceID(serviceID uuid.UUID) *Account {
+	if account, ok := s.accounts[serviceID]; ok {
+		return account
+	}
+	return s.accountsByPNI[serviceID]
+}
+
+// PendingEnvelopes returns the number of envelopes that haven't been acknowledged by the given device yet.
+func (s *Server) PendingEnvelopes(aci uuid.UUID, deviceID int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.accounts[aci]
+	if !ok {
+		return 0
+	}
+	device, ok := account.devices[deviceID]
+	if !ok {
+		return 0
+	}
+	return len(device.queue)
+}
+
+// ChangeRegistrationID gives a device a new ACI registration ID, like reinstalling would. Senders that
+// still have a session with the old registration ID get 410 Gone and have to start a new session.
+// Returns false if there's no such device.
+func (s *Server) ChangeRegistrationID(aci uuid.UUID, deviceID int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.accounts[aci]
+	if !ok {
+		return false
+	}
+	device, ok := account.devices[deviceID]
+	if !ok {
+		return false
+	}
+	device.registrationID++
+	return true
+}
+
+// DeviceIDs returns the IDs of the devices registered to the given account.
+func (s *Server) DeviceIDs(aci uuid.UUID) []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.accounts[aci]
+	if !ok {
+		return nil
+	}
+	ids := make([]int, 0, len(account.devices))
+	for id := range account.devices {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *Server) registerAccount(number string, unidentifiedAccessKey []byte, aciIdentityKey, pniIdentityKey []byte, primary *accountDevice) *Account {
+	account := &Account{
+		ACI:    uuid.New(),
+		PNI:    uuid.New(),
+		Number: number,
+
+		unidentifiedAccessKey: unidentifiedAccessKey,
+		identityKeys: map[string][]byte{
+			identityACI: aciIdentityKey,
+			identityPNI: pniIdentityKey,
+		},
+		devices:      make(map[int]*accountDevice),
+		nextDeviceID: 1,
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addDevice(account, primary)
+	s.accounts[account.ACI] = account
+	s.accountsByPNI[account.PNI] = account
+	return account
+}
+
+func (s *Server) addDevice(account *Account, device *accountDevice) {
+	device.id = account.nextDeviceID
+	account.nextDeviceID++
+	device.created = time.Now()
+	device.lastSeen = device.created
+	if device.keys == nil {
+		device.keys = make(map[string]*deviceKeys)
+	}
+	device.wake = make(chan struct{}, 1)
+	account.devices[device.id] = device
+}
+
+// enqueue adds an envelope to the queue of a device. The caller must hold the server lock.
+func (s *Server) enqueue(device *accountDevice, envelope *signalpb.Envelope) {
+	device.queue = append(device.queue, envelope)
+	select {
+	case device.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ack removes a delivered envelope from the queue of a device.
+func (s *Server) ack(device *accountDevice, serverGUID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, envelope := range device.queue {
+		if envelope.GetServerGuid() == serverGUID {
+			device.queue = append(device.queue[:i], device.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// authenticate checks the basic auth credentials of a request. The username is
+// either the ACI (for the primary device) or ACI.deviceID.
+func (s *Server) authenticate(r *http.Request) (*Account, *accountDevice) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	return s.checkCredentials(username, password)
+}
+
+func (s *Server) checkCredentials(username, password string) (*Account, *accountDevice) {
+	aciStr, deviceIDStr, found := strings.Cut(username, ".")
+	deviceID := 1
+	if found {
+		var err error
+		deviceID, err = strconv.Atoi(deviceIDStr)
+		if err != nil {
+			return nil, nil
+		}
+	}
+	aci, err := uuid.Parse(aciStr)
+	if err != nil {
+		return nil, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.accounts[aci]
+	if !ok {
+		return nil, nil
+	}
+	device, ok := account.devices[deviceID]
+	if !ok || device.password != password {
+		return nil, nil
+	}
+	device.lastSeen = time.Now()
+	return account, device
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func readJSON(r *http.Request, into any) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(into)
+}
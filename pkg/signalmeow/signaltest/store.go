@@ -0,0 +1,323 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+)
+
+type addressKey struct {
+	Name     string
+	DeviceID uint
+}
+
+func newAddressKey(address *libsignalgo.Address) (addressKey, error) {
+	name, err := address.Name()
+	if err != nil {
+		return addressKey{}, err
+	}
+	deviceID, err := address.DeviceID()
+	if err != nil {
+		return addressKey{}, err
+	}
+	return addressKey{Name: name, DeviceID: deviceID}, nil
+}
+
+type senderKeyName struct {
+	addressKey
+	DistributionID uuid.UUID
+}
+
+// Store is an in-memory implementation of all the libsignalgo protocol stores.
+// Records are kept in serialized form, so every load returns a fresh copy like the SQL store does.
+type Store struct {
+	lock sync.Mutex
+
+	identityKeyPair *libsignalgo.IdentityKeyPair
+	registrationID  uint32
+
+	identityKeys  map[addressKey][]byte
+	sessions      map[addressKey][]byte
+	senderKeys    map[senderKeyName][]byte
+	preKeys       map[uint32][]byte
+	signedPreKeys map[uint32][]byte
+	kyberPreKeys  map[uint32][]byte
+}
+
+var _ libsignalgo.SessionStore = (*Store)(nil)
+var _ libsignalgo.IdentityKeyStore = (*Store)(nil)
+var _ libsignalgo.PreKeyStore = (*Store)(nil)
+var _ libsignalgo.SignedPreKeyStore = (*Store)(nil)
+var _ libsignalgo.KyberPreKeyStore = (*Store)(nil)
+var _ libsignalgo.SenderKeyStore = (*Store)(nil)
+
+func NewStore(identityKeyPair *libsignalgo.IdentityKeyPair, registrationID uint32) *Store {
+	return &Store{
+		identityKeyPair: identityKeyPair,
+		registrationID:  registrationID,
+
+		identityKeys:  make(map[addressKey][]byte),
+		sessions:      make(map[addressKey][]byte),
+		senderKeys:    make(map[senderKeyName][]byte),
+		preKeys:       make(map[uint32][]byte),
+		signedPreKeys: make(map[uint32][]byte),
+		kyberPreKeys:  make(map[uint32][]byte),
+	}
+}
+
+// SessionStore
+
+func (s *Store) LoadSession(address *libsignalgo.Address, ctx context.Context) (*libsignalgo.SessionRecord, error) {
+	key, err := newAddressKey(address)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	serialized, ok := s.sessions[key]
+	s.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeSessionRecord(serialized)
+}
+
+func (s *Store) StoreSession(address *libsignalgo.Address, record *libsignalgo.SessionRecord, ctx context.Context) error {
+	key, err := newAddressKey(address)
+	if err != nil {
+		return err
+	}
+	serialized, err := record.Serialize()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.sessions[key] = serialized
+	s.lock.Unlock()
+	return nil
+}
+
+// RemoveSession deletes the session with the given address, e.g. to simulate a reinstalled device.
+func (s *Store) RemoveSession(address *libsignalgo.Address) error {
+	key, err := newAddressKey(address)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	delete(s.sessions, key)
+	s.lock.Unlock()
+	return nil
+}
+
+// HasSession returns true if there's a session with the given address.
+func (s *Store) HasSession(address *libsignalgo.Address) bool {
+	key, err := newAddressKey(address)
+	if err != nil {
+		return false
+	}
+	s.lock.Lock()
+	_, ok := s.sessions[key]
+	s.lock.Unlock()
+	return ok
+}
+
+// SessionDeviceIDs returns the device IDs of the given name that there are sessions with.
+func (s *Store) SessionDeviceIDs(name string) []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var deviceIDs []int
+	for key := range s.sessions {
+		if key.Name == name {
+			deviceIDs = append(deviceIDs, int(key.DeviceID))
+		}
+	}
+	sort.Ints(deviceIDs)
+	return deviceIDs
+}
+
+// IdentityKeyStore
+
+func (s *Store) GetIdentityKeyPair(ctx context.Context) (*libsignalgo.IdentityKeyPair, error) {
+	return s.identityKeyPair, nil
+}
+
+func (s *Store) GetLocalRegistrationID(ctx context.Context) (uint32, error) {
+	return s.registrationID, nil
+}
+
+func (s *Store) SaveIdentityKey(address *libsignalgo.Address, identityKey *libsignalgo.IdentityKey, ctx context.Context) (bool, error) {
+	key, err := newAddressKey(address)
+	if err != nil {
+		return false, err
+	}
+	serialized, err := identityKey.Serialize()
+	if err != nil {
+		return false, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	existing, ok := s.identityKeys[key]
+	s.identityKeys[key] = serialized
+	return ok && string(existing) != string(serialized), nil
+}
+
+func (s *Store) GetIdentityKey(address *libsignalgo.Address, ctx context.Context) (*libsignalgo.IdentityKey, error) {
+	key, err := newAddressKey(address)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	serialized, ok := s.identityKeys[key]
+	s.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeIdentityKey(serialized)
+}
+
+func (s *Store) IsTrustedIdentity(address *libsignalgo.Address, identityKey *libsignalgo.IdentityKey, direction libsignalgo.SignalDirection, ctx context.Context) (bool, error) {
+	key, err := newAddressKey(address)
+	if err != nil {
+		return false, err
+	}
+	serialized, err := identityKey.Serialize()
+	if err != nil {
+		return false, err
+	}
+	s.lock.Lock()
+	existing, ok := s.identityKeys[key]
+	s.lock.Unlock()
+	// Trust on first use
+	return !ok || string(existing) == string(serialized), nil
+}
+
+// PreKeyStore
+
+func (s *Store) LoadPreKey(id uint32, ctx context.Context) (*libsignalgo.PreKeyRecord, error) {
+	s.lock.Lock()
+	serialized, ok := s.preKeys[id]
+	s.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializePreKeyRecord(serialized)
+}
+
+func (s *Store) StorePreKey(id uint32, preKeyRecord *libsignalgo.PreKeyRecord, ctx context.Context) error {
+	serialized, err := preKeyRecord.Serialize()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.preKeys[id] = serialized
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) RemovePreKey(id uint32, ctx context.Context) error {
+	s.lock.Lock()
+	delete(s.preKeys, id)
+	s.lock.Unlock()
+	return nil
+}
+
+// SignedPreKeyStore
+
+func (s *Store) LoadSignedPreKey(id uint32, ctx context.Context) (*libsignalgo.SignedPreKeyRecord, error) {
+	s.lock.Lock()
+	serialized, ok := s.signedPreKeys[id]
+	s.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeSignedPreKeyRecord(serialized)
+}
+
+func (s *Store) StoreSignedPreKey(id uint32, signedPreKeyRecord *libsignalgo.SignedPreKeyRecord, ctx context.Context) error {
+	serialized, err := signedPreKeyRecord.Serialize()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.signedPreKeys[id] = serialized
+	s.lock.Unlock()
+	return nil
+}
+
+// KyberPreKeyStore
+
+func (s *Store) LoadKyberPreKey(id uint32, ctx context.Context) (*libsignalgo.KyberPreKeyRecord, error) {
+	s.lock.Lock()
+	serialized, ok := s.kyberPreKeys[id]
+	s.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeKyberPreKeyRecord(serialized)
+}
+
+func (s *Store) StoreKyberPreKey(id uint32, kyberPreKeyRecord *libsignalgo.KyberPreKeyRecord, ctx context.Context) error {
+	serialized, err := kyberPreKeyRecord.Serialize()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.kyberPreKeys[id] = serialized
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) MarkKyberPreKeyUsed(id uint32, ctx context.Context) error {
+	// Kyber prekeys are only uploaded as last resort keys, which can be used multiple times
+	return nil
+}
+
+// SenderKeyStore
+
+func (s *Store) LoadSenderKey(sender libsignalgo.Address, distributionID uuid.UUID, ctx context.Context) (*libsignalgo.SenderKeyRecord, error) {
+	key, err := newAddressKey(&sender)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	serialized, ok := s.senderKeys[senderKeyName{key, distributionID}]
+	s.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeSenderKeyRecord(serialized)
+}
+
+func (s *Store) StoreSenderKey(sender libsignalgo.Address, distributionID uuid.UUID, record *libsignalgo.SenderKeyRecord, ctx context.Context) error {
+	key, err := newAddressKey(&sender)
+	if err != nil {
+		return err
+	}
+	serialized, err := record.Serialize()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.senderKeys[senderKeyName{key, distributionID}] = serialized
+	s.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,230 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signaltest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"nhooyr.io/websocket"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/wspb"
+)
+
+// wsConn is a websocket connection from a client. Requests sent by the client are
+// served by the same handlers as plain HTTP requests.
+type wsConn struct {
+	server *Server
+	ws     *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Credentials from the connection URL, used for requests that don't have their own
+	username string
+	password string
+
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	nextID    uint64
+	pending   map[uint64]func(*signalpb.WebSocketResponseMessage)
+}
+
+func (s *Server) acceptWebsocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	ws, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetReadLimit(1 << 20)
+	ctx, cancel := context.WithCancel(s.ctx)
+	return &wsConn{
+		server:  s,
+		ws:      ws,
+		ctx:     ctx,
+		cancel:  cancel,
+		pending: make(map[uint64]func(*signalpb.WebSocketResponseMessage)),
+	}, nil
+}
+
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") == "" {
+		http.NotFound(w, r)
+		return
+	}
+	var device *accountDevice
+	login := r.URL.Query().Get("login")
+	if login != "" {
+		_, device = s.checkCredentials(login, r.URL.Query().Get("password"))
+		if device == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	conn, err := s.acceptWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.close()
+	if device != nil {
+		conn.username, conn.password = login, r.URL.Query().Get("password")
+		go s.deliveryLoop(conn, device)
+	}
+	conn.readLoop()
+}
+
+// deliveryLoop pushes the queued envelopes of a device to the client. Envelopes stay in
+// the queue until the client acknowledges them, so anything that isn't acknowledged
+// is sent again when the client reconnects.
+func (s *Server) deliveryLoop(conn *wsConn, device *accountDevice) {
+	sent := make(map[string]bool)
+	queueEmptySent := false
+	for {
+		var toSend []*signalpb.Envelope
+		s.lock.Lock()
+		for _, envelope := range device.queue {
+			if !sent[envelope.GetServerGuid()] {
+				sent[envelope.GetServerGuid()] = true
+				toSend = append(toSend, envelope)
+			}
+		}
+		s.lock.Unlock()
+		for _, envelope := range toSend {
+			body, err := proto.Marshal(envelope)
+			if err != nil {
+				panic(err)
+			}
+			serverGUID := envelope.GetServerGuid()
+			err = conn.sendRequest(http.MethodPut, "/api/v1/message", body, func(resp *signalpb.WebSocketResponseMessage) {
+				if resp.GetStatus() == http.StatusOK {
+					s.ack(device, serverGUID)
+				}
+			})
+			if err != nil {
+				return
+			}
+		}
+		if !queueEmptySent {
+			if conn.sendRequest(http.MethodPut, "/api/v1/queue/empty", nil, nil) != nil {
+				return
+			}
+			queueEmptySent = true
+		}
+		select {
+		case <-device.wake:
+		case <-conn.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *wsConn) close() {
+	c.cancel()
+	_ = c.ws.Close(websocket.StatusNormalClosure, "")
+}
+
+func (c *wsConn) write(msg *signalpb.WebSocketMessage) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return wspb.Write(c.ctx, c.ws, msg)
+}
+
+// sendRequest sends a request to the client. The response callback is called from the read loop.
+func (c *wsConn) sendRequest(verb, path string, body []byte, onResponse func(*signalpb.WebSocketResponseMessage)) error {
+	c.lock.Lock()
+	c.nextID++
+	id := c.nextID
+	if onResponse != nil {
+		c.pending[id] = onResponse
+	}
+	c.lock.Unlock()
+	msgType := signalpb.WebSocketMessage_REQUEST
+	return c.write(&signalpb.WebSocketMessage{
+		Type: &msgType,
+		Request: &signalpb.WebSocketRequestMessage{
+			Verb: &verb,
+			Path: &path,
+			Body: body,
+			Id:   &id,
+		},
+	})
+}
+
+func (c *wsConn) readLoop() {
+	for {
+		msg := &signalpb.WebSocketMessage{}
+		err := wspb.Read(c.ctx, c.ws, msg)
+		if err != nil {
+			return
+		}
+		switch msg.GetType() {
+		case signalpb.WebSocketMessage_REQUEST:
+			go c.handleRequest(msg.GetRequest())
+		case signalpb.WebSocketMessage_RESPONSE:
+			c.lock.Lock()
+			onResponse, ok := c.pending[msg.GetResponse().GetId()]
+			delete(c.pending, msg.GetResponse().GetId())
+			c.lock.Unlock()
+			if ok {
+				onResponse(msg.GetResponse())
+			}
+		default:
+			return
+		}
+	}
+}
+
+// handleRequest converts a websocket request into a HTTP request and sends the result back as a response.
+func (c *wsConn) handleRequest(req *signalpb.WebSocketRequestMessage) {
+	httpReq := httptest.NewRequest(req.GetVerb(), req.GetPath(), bytes.NewReader(req.GetBody())).WithContext(c.ctx)
+	for _, header := range req.GetHeaders() {
+		key, value, ok := strings.Cut(header, ":")
+		if ok {
+			httpReq.Header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+	}
+	if httpReq.Header.Get("Authorization") == "" && c.username != "" {
+		httpReq.SetBasicAuth(c.username, c.password)
+	}
+	recorder := httptest.NewRecorder()
+	c.server.chat.Config.Handler.ServeHTTP(recorder, httpReq)
+
+	status := uint32(recorder.Code)
+	message := http.StatusText(recorder.Code)
+	headers := make([]string, 0, len(recorder.Header()))
+	for key, values := range recorder.Header() {
+		for _, value := range values {
+			headers = append(headers, fmt.Sprintf("%s:%s", key, value))
+		}
+	}
+	msgType := signalpb.WebSocketMessage_RESPONSE
+	_ = c.write(&signalpb.WebSocketMessage{
+		Type: &msgType,
+		Response: &signalpb.WebSocketResponseMessage{
+			Id:      req.Id,
+			Status:  &status,
+			Message: &message,
+			Headers: headers,
+			Body:    recorder.Body.Bytes(),
+		},
+	})
+}
@@ -0,0 +1,125 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/signaltest"
+)
+
+func newTestServer(t *testing.T) *signaltest.Server {
+	server, err := signaltest.NewServer()
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestPhone(t *testing.T, server *signaltest.Server, number string) *signaltest.Phone {
+	phone, err := signaltest.NewPhone(server, number)
+	require.NoError(t, err)
+	return phone
+}
+
+func newTestContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// linkTestClient links a new signalmeow device to the account of the phone through the real
+// provisioning flow and returns a client for it. The device is stored in an in-memory database.
+func linkTestClient(t *testing.T, server *signaltest.Server, phone *signaltest.Phone) *Client {
+	ctx := newTestContext(t)
+	db, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	// Every connection to :memory: is a separate database
+	db.RawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	container := NewStore(db, dbutil.NoopLogger)
+	require.NoError(t, container.Upgrade())
+	webClient, err := server.NewWebClient()
+	require.NoError(t, err)
+
+	provChan := PerformProvisioning(ctx, webClient, container, "signalmeow test")
+	resp := <-provChan
+	require.Equal(t, StateProvisioningURLReceived, resp.State, "provisioning error: %v", resp.Err)
+	require.NoError(t, phone.LinkDevice(ctx, resp.ProvisioningUrl))
+	resp = <-provChan
+	require.Equal(t, StateProvisioningDataReceived, resp.State, "provisioning error: %v", resp.Err)
+	data := resp.ProvisioningData
+	require.Equal(t, phone.ACI.String(), data.AciUuid)
+	resp = <-provChan
+	require.Equal(t, StateProvisioningPreKeysRegistered, resp.State, "provisioning error: %v", resp.Err)
+
+	device, err := container.DeviceByAci(data.AciUuid)
+	require.NoError(t, err)
+	require.NotNil(t, device)
+	return NewClient(device, zerolog.Nop(), webClient, nil)
+}
+
+// startTestClient starts the receive loops of the client and waits until both websockets are connected.
+func startTestClient(t *testing.T, client *Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	statusChan, err := client.StartReceiveLoops(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.StopReceiveLoops()
+		cancel()
+	})
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case status := <-statusChan:
+			if status.Event == SignalConnectionEventConnected {
+				return
+			}
+			require.NotEqual(t, SignalConnectionEventLoggedOut, status.Event, "client was logged out: %v", status.Err)
+		case <-timeout:
+			t.Fatal("timed out waiting for the client to connect")
+		}
+	}
+}
+
+// collectEvents registers an event handler that sends all events of type T to the returned channel.
+func collectEvents[T any](client *Client) <-chan T {
+	ch := make(chan T, 100)
+	client.Device.AddEventHandler(func(rawEvt any) {
+		if evt, ok := rawEvt.(T); ok {
+			ch <- evt
+		}
+	})
+	return ch
+}
+
+func waitForEvent[T any](t *testing.T, ch <-chan T) T {
+	select {
+	case evt := <-ch:
+		return evt
+	case <-time.After(10 * time.Second):
+		var zero T
+		t.Fatalf("timed out waiting for %T", zero)
+		return zero
+	}
+}
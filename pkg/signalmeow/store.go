@@ -58,12 +58,15 @@ type Device struct {
 	SenderKeyStore    libsignalgo.SenderKeyStore
 
 	// internal store interfaces
-	PreKeyStoreExtras  PreKeyStoreExtras
-	SessionStoreExtras SessionStoreExtras
-	ProfileKeyStore    ProfileKeyStore
-	GroupStore         GroupStore
-	ContactStore       ContactStore
-	DeviceStore        DeviceStore
+	PreKeyStoreExtras    PreKeyStoreExtras
+	SessionStoreExtras   SessionStoreExtras
+	ProfileKeyStore      ProfileKeyStore
+	GroupStore           GroupStore
+	ContactStore         ContactStore
+	DeviceStore          DeviceStore
+	AccountSettingsStore AccountSettingsStore
+	InboxStore           InboxStore
+	KnownDeviceStore     KnownDeviceStore
 }
 
 func NewStore(db *dbutil.Database, log dbutil.DatabaseLogger) *StoreContainer {
@@ -110,7 +113,7 @@ func (c *StoreContainer) scanDevice(row scannable) (*Device, error) {
 	device.PreKeyStoreExtras = innerStore
 	device.SignedPreKeyStore = innerStore
 	device.KyberPreKeyStore = innerStore
-	device.IdentityStore = innerStore
+	device.IdentityStore = &identityChangeNotifier{IdentityKeyStore: innerStore, device: &device}
 	device.SessionStore = innerStore
 	device.SessionStoreExtras = innerStore
 	device.ProfileKeyStore = innerStore
@@ -118,6 +121,9 @@ func (c *StoreContainer) scanDevice(row scannable) (*Device, error) {
 	device.GroupStore = innerStore
 	device.ContactStore = innerStore
 	device.DeviceStore = innerStore
+	device.AccountSettingsStore = innerStore
+	device.InboxStore = innerStore
+	device.KnownDeviceStore = innerStore
 
 	return &device, nil
 }
@@ -182,8 +188,7 @@ func (c *StoreContainer) PutDevice(device *DeviceData) error {
 	aciIdentityKeyPair, err := device.AciIdentityKeyPair.Serialize()
 	pniIdentityKeyPair, err := device.PniIdentityKeyPair.Serialize()
 	if err != nil {
-		zlog.Err(err).Msg("failed to serialize identity key pair")
-		return err
+		return fmt.Errorf("failed to serialize identity key pair: %w", err)
 	}
 	_, err = c.db.Exec(insertDeviceQuery,
 		device.AciUuid, aciIdentityKeyPair, device.RegistrationId,
@@ -191,9 +196,9 @@ func (c *StoreContainer) PutDevice(device *DeviceData) error {
 		device.DeviceId, device.Number, device.Password,
 	)
 	if err != nil {
-		zlog.Err(err).Msg("failed to insert device")
+		return fmt.Errorf("failed to insert device: %w", err)
 	}
-	return err
+	return nil
 }
 
 // DeleteDevice deletes the given device from this database
@@ -208,7 +213,7 @@ func (c *StoreContainer) DeleteDevice(device *DeviceData) error {
 func (d *Device) ClearDeviceKeys() error {
 	// We need to clear out keys associated with the Signal device that no longer has valid credentials
 	if d == nil {
-		zlog.Warn().Msg("ClearDeviceKeys called with nil device")
+		d.log().Warn().Msg("ClearDeviceKeys called with nil device")
 		return nil
 	}
 	err := d.PreKeyStoreExtras.DeleteAllPreKeys()
@@ -231,7 +236,7 @@ func (d *Device) ClearKeysAndDisconnect() error {
 	clearErr := d.ClearDeviceKeys()
 	d.Data.Password = ""
 	saveDeviceErr := d.DeviceStore.PutDevice(&d.Data)
-	stopLoopErr := StopReceiveLoops(d)
+	stopLoopErr := stopReceiveLoops(d)
 
 	if clearErr != nil {
 		return clearErr
@@ -0,0 +1,250 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// FullSyncRequestTypes are the sync requests sent to the primary device after linking and by Client.SendFullSyncRequest.
+var FullSyncRequestTypes = []signalpb.SyncMessage_Request_Type{
+	signalpb.SyncMessage_Request_CONTACTS,
+	signalpb.SyncMessage_Request_BLOCKED,
+	signalpb.SyncMessage_Request_CONFIGURATION,
+	signalpb.SyncMessage_Request_KEYS,
+}
+
+func syncMessageForRequest(requestType signalpb.SyncMessage_Request_Type) *signalpb.Content {
+	return &signalpb.Content{
+		SyncMessage: &signalpb.SyncMessage{
+			Request: &signalpb.SyncMessage_Request{
+				Type: requestType.Enum(),
+			},
+		},
+	}
+}
+
+// sendSyncRequests asks the primary device to send the given types of data.
+// Unlike sendContactSyncRequest, this isn't rate limited.
+func sendSyncRequests(ctx context.Context, d *Device, requestTypes ...signalpb.SyncMessage_Request_Type) error {
+	var errs []error
+	for _, requestType := range requestTypes {
+		_, err := sendContent(ctx, d, d.Data.AciUuid, currentMessageTimestamp(), syncMessageForRequest(requestType), 0)
+		if err != nil {
+			d.log().Err(err).Str("request_type", requestType.String()).Msg("Failed to send sync request message to myself")
+			errs = append(errs, fmt.Errorf("failed to request %s: %w", requestType, err))
+		}
+	}
+	if requestTypesContain(requestTypes, signalpb.SyncMessage_Request_CONTACTS) && len(errs) == 0 {
+		lastRequestTime := time.Now().Unix()
+		d.Connection.LastContactRequestTime = &lastRequestTime
+	}
+	return errors.Join(errs...)
+}
+
+// sendFullSyncRequest asks the primary device to send contacts, the block list, configuration and keys.
+func sendFullSyncRequest(ctx context.Context, d *Device) error {
+	return sendSyncRequests(ctx, d, FullSyncRequestTypes...)
+}
+
+func requestTypesContain(requestTypes []signalpb.SyncMessage_Request_Type, target signalpb.SyncMessage_Request_Type) bool {
+	for _, requestType := range requestTypes {
+		if requestType == target {
+			return true
+		}
+	}
+	return false
+}
+
+// AccountSettings returns the settings synced from the primary device, or the defaults if nothing has been synced.
+// The returned value must not be modified.
+func (d *Device) AccountSettings(ctx context.Context) *AccountSettings {
+	d.Connection.accountSettingsLock.Lock()
+	defer d.Connection.accountSettingsLock.Unlock()
+	return d.loadAccountSettings(ctx)
+}
+
+func (d *Device) loadAccountSettings(ctx context.Context) *AccountSettings {
+	if d.Connection.accountSettings != nil {
+		return d.Connection.accountSettings
+	}
+	settings, err := d.AccountSettingsStore.LoadAccountSettings(ctx)
+	if err != nil {
+		// Don't cache the defaults, so the next call tries loading again
+		d.log().Err(err).Msg("Failed to load account settings")
+		return DefaultAccountSettings()
+	} else if settings == nil {
+		settings = DefaultAccountSettings()
+	}
+	d.Connection.accountSettings = settings
+	return settings
+}
+
+func (d *Device) updateAccountSettings(ctx context.Context, update func(settings *AccountSettings)) error {
+	d.Connection.accountSettingsLock.Lock()
+	defer d.Connection.accountSettingsLock.Unlock()
+	settings := d.loadAccountSettings(ctx).Copy()
+	update(settings)
+	err := d.AccountSettingsStore.StoreAccountSettings(ctx, settings)
+	if err != nil {
+		return fmt.Errorf("failed to save account settings: %w", err)
+	}
+	d.Connection.accountSettings = settings
+	return nil
+}
+
+// IsBlocked returns true if the given ACI or group is on the block list synced from the primary device.
+func (d *Device) IsBlocked(ctx context.Context, aciOrGroupID string) bool {
+	settings := d.AccountSettings(ctx)
+	for _, aci := range settings.BlockedACIs {
+		if aci == aciOrGroupID {
+			return true
+		}
+	}
+	for _, group := range settings.BlockedGroups {
+		if string(group) == aciOrGroupID {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlockedContent returns true if the content was sent by a blocked user or to a blocked group.
+// Content from our own devices is never blocked.
+func (d *Device) isBlockedContent(ctx context.Context, senderACI string, content *signalpb.Content) bool {
+	if senderACI == d.Data.AciUuid {
+		return false
+	} else if d.IsBlocked(ctx, senderACI) {
+		return true
+	}
+	var gid GroupIdentifier
+	dataMessage := content.GetDataMessage()
+	if dataMessage == nil {
+		dataMessage = content.GetEditMessage().GetDataMessage()
+	}
+	masterKey := dataMessage.GetGroupV2().GetMasterKey()
+	if masterKey == nil {
+		masterKey = content.GetStoryMessage().GetGroup().GetMasterKey()
+	}
+	if groupID := content.GetTypingMessage().GetGroupId(); groupID != nil {
+		gid = GroupIdentifier(base64.StdEncoding.EncodeToString(groupID))
+	} else if len(masterKey) == len(libsignalgo.GroupMasterKey{}) {
+		var err error
+		gid, err = groupIdentifierFromMasterKey(masterKeyFromBytes(libsignalgo.GroupMasterKey(masterKey)))
+		if err != nil {
+			d.log().Warn().Err(err).Msg("Failed to get group identifier to check block list")
+			return false
+		}
+	}
+	return gid != "" && d.IsBlocked(ctx, string(gid))
+}
+
+func handleSyncBlocked(ctx context.Context, d *Device, blocked *signalpb.SyncMessage_Blocked) {
+	groups := make([]GroupIdentifier, len(blocked.GetGroupIds()))
+	for i, groupID := range blocked.GetGroupIds() {
+		groups[i] = GroupIdentifier(base64.StdEncoding.EncodeToString(groupID))
+	}
+	err := d.updateAccountSettings(ctx, func(settings *AccountSettings) {
+		settings.BlockedACIs = blocked.GetAcis()
+		settings.BlockedNumbers = blocked.GetNumbers()
+		settings.BlockedGroups = groups
+	})
+	if err != nil {
+		d.log().Err(err).Msg("Failed to save synced block list")
+		return
+	}
+	d.log().Debug().
+		Int("acis", len(blocked.GetAcis())).
+		Int("numbers", len(blocked.GetNumbers())).
+		Int("groups", len(groups)).
+		Msg("Received block list sync")
+}
+
+func handleSyncConfiguration(ctx context.Context, d *Device, config *signalpb.SyncMessage_Configuration) {
+	err := d.updateAccountSettings(ctx, func(settings *AccountSettings) {
+		settings.ConfigurationSynced = true
+		// Fields that aren't set keep their previous values
+		if config.ReadReceipts != nil {
+			settings.ReadReceipts = config.GetReadReceipts()
+		}
+		if config.TypingIndicators != nil {
+			settings.TypingIndicators = config.GetTypingIndicators()
+		}
+		if config.LinkPreviews != nil {
+			settings.LinkPreviews = config.GetLinkPreviews()
+		}
+		if config.UnidentifiedDeliveryIndicators != nil {
+			settings.UnidentifiedDeliveryIndicators = config.GetUnidentifiedDeliveryIndicators()
+		}
+	})
+	if err != nil {
+		d.log().Err(err).Msg("Failed to save synced configuration")
+		return
+	}
+	d.log().Debug().
+		Bool("read_receipts", config.GetReadReceipts()).
+		Bool("typing_indicators", config.GetTypingIndicators()).
+		Bool("link_previews", config.GetLinkPreviews()).
+		Bool("unidentified_delivery_indicators", config.GetUnidentifiedDeliveryIndicators()).
+		Msg("Received configuration sync")
+}
+
+func handleSyncKeys(ctx context.Context, d *Device, keys *signalpb.SyncMessage_Keys) {
+	err := d.updateAccountSettings(ctx, func(settings *AccountSettings) {
+		if keys.Master != nil {
+			settings.MasterKey = keys.GetMaster()
+		}
+		if keys.StorageService != nil {
+			settings.StorageServiceKey = keys.GetStorageService()
+		}
+	})
+	if err != nil {
+		d.log().Err(err).Msg("Failed to save synced keys")
+		return
+	}
+	d.log().Debug().Bool("has_master_key", keys.Master != nil).Msg("Received keys sync")
+}
+
+func handleSyncFetchLatest(ctx context.Context, d *Device, fetchLatest *signalpb.SyncMessage_FetchLatest) {
+	d.log().Debug().Str("type", fetchLatest.GetType().String()).Msg("Received fetch latest sync")
+	switch fetchLatest.GetType() {
+	case signalpb.SyncMessage_FetchLatest_LOCAL_PROFILE:
+		// Our own profile changed on another device, so drop the cached copy and fetch it again
+		d.Connection.cacheLock.Lock()
+		if d.Connection.ProfileCache != nil {
+			delete(d.Connection.ProfileCache.lastFetched, d.Data.AciUuid)
+		}
+		d.Connection.cacheLock.Unlock()
+		_, err := retrieveProfileByID(ctx, d, d.Data.AciUuid)
+		if err != nil {
+			d.log().Err(err).Msg("Failed to refresh own profile")
+		}
+	case signalpb.SyncMessage_FetchLatest_STORAGE_MANIFEST:
+		// Storage service isn't supported, but the keys for it may have changed
+		err := sendSyncRequests(ctx, d, signalpb.SyncMessage_Request_KEYS)
+		if err != nil {
+			d.log().Err(err).Msg("Failed to request keys after storage manifest change")
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func TestHandleDecryptedContentBlocked(t *testing.T) {
+	ctx := context.Background()
+	blockedUser, otherUser := uuid.NewString(), uuid.NewString()
+	blockedGroupID := []byte("blocked group identifier 32 byte")
+	var device Device
+	device.Data.AciUuid = uuid.NewString()
+	device.Connection.accountSettings = &AccountSettings{
+		BlockedACIs:   []string{blockedUser},
+		BlockedGroups: []GroupIdentifier{GroupIdentifier(base64.StdEncoding.EncodeToString(blockedGroupID))},
+	}
+	var delivered []any
+	device.AddEventHandler(func(evt any) {
+		delivered = append(delivered, evt)
+	})
+
+	message := &signalpb.Content{
+		DataMessage: &signalpb.DataMessage{
+			Body:      proto.String("hello"),
+			Timestamp: proto.Uint64(1234),
+		},
+	}
+	require.NoError(t, device.handleDecryptedContent(ctx, blockedUser, message, &contentDispatch{}))
+	assert.Empty(t, delivered, "message from blocked user must not be delivered")
+
+	typing := &signalpb.Content{
+		TypingMessage: &signalpb.TypingMessage{
+			Timestamp: proto.Uint64(1235),
+			Action:    signalpb.TypingMessage_STARTED.Enum(),
+			GroupId:   blockedGroupID,
+		},
+	}
+	require.NoError(t, device.handleDecryptedContent(ctx, otherUser, typing, &contentDispatch{}))
+	assert.Empty(t, delivered, "content in blocked group must not be delivered")
+
+	assert.True(t, device.isBlockedContent(ctx, blockedUser, message))
+	assert.False(t, device.isBlockedContent(ctx, otherUser, message))
+	assert.False(t, device.isBlockedContent(ctx, device.Data.AciUuid, typing), "own content is never blocked")
+}
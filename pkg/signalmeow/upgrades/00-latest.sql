@@ -1,4 +1,4 @@
--- v0 -> v5: Latest revision
+-- v0 -> v11: Latest revision
 CREATE TABLE signalmeow_device (
     aci_uuid              TEXT PRIMARY KEY,
 
@@ -71,6 +71,12 @@ CREATE TABLE signalmeow_groups (
     our_aci_uuid     TEXT NOT NULL,
     group_identifier TEXT NOT NULL,
     master_key       TEXT NOT NULL,
+    -- revision and group_info are null if the group hasn't been fetched since it last changed
+    revision         INTEGER,
+    -- group_info is the decrypted group as JSON
+    group_info       TEXT,
+    -- fetched_ts is when group_info was last confirmed with the server, in microseconds
+    fetched_ts       BIGINT,
 
     PRIMARY KEY (our_aci_uuid, group_identifier)
 );
@@ -101,3 +107,50 @@ CREATE TABLE signalmeow_kyber_pre_keys (
     PRIMARY KEY (aci_uuid, uuid_kind, key_id),
     FOREIGN KEY (aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
 );
+
+CREATE TABLE signalmeow_account_settings (
+    our_aci_uuid                     TEXT    PRIMARY KEY,
+    configuration_synced             BOOLEAN NOT NULL DEFAULT false,
+    read_receipts                    BOOLEAN NOT NULL DEFAULT true,
+    typing_indicators                BOOLEAN NOT NULL DEFAULT true,
+    link_previews                    BOOLEAN NOT NULL DEFAULT true,
+    unidentified_delivery_indicators BOOLEAN NOT NULL DEFAULT false,
+    master_key                       bytea,
+    storage_service_key              bytea,
+
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE signalmeow_blocked (
+    our_aci_uuid TEXT NOT NULL,
+    kind         TEXT NOT NULL,
+    identifier   TEXT NOT NULL,
+
+    PRIMARY KEY (our_aci_uuid, kind, identifier),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE signalmeow_inbox (
+    our_aci_uuid  TEXT    NOT NULL,
+    sender_aci    TEXT    NOT NULL,
+    timestamp     BIGINT  NOT NULL,
+    sender_device INTEGER NOT NULL,
+    -- content is cleared once the message has been handled, the row is only kept to ignore replays
+    content       bytea,
+    received_ts   BIGINT  NOT NULL,
+    attempts      INTEGER NOT NULL DEFAULT 0,
+    processed     BOOLEAN NOT NULL DEFAULT false,
+
+    PRIMARY KEY (our_aci_uuid, sender_aci, sender_device, timestamp),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX signalmeow_inbox_pending_idx ON signalmeow_inbox (our_aci_uuid, processed, received_ts);
+
+CREATE TABLE signalmeow_known_devices (
+    our_aci_uuid TEXT    NOT NULL,
+    device_id    INTEGER NOT NULL,
+
+    PRIMARY KEY (our_aci_uuid, device_id),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,22 @@
+-- v6: Add tables for account settings and block list synced from the primary device
+CREATE TABLE signalmeow_account_settings (
+    our_aci_uuid                     TEXT    PRIMARY KEY,
+    configuration_synced             BOOLEAN NOT NULL DEFAULT false,
+    read_receipts                    BOOLEAN NOT NULL DEFAULT true,
+    typing_indicators                BOOLEAN NOT NULL DEFAULT true,
+    link_previews                    BOOLEAN NOT NULL DEFAULT true,
+    unidentified_delivery_indicators BOOLEAN NOT NULL DEFAULT false,
+    master_key                       bytea,
+    storage_service_key              bytea,
+
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE signalmeow_blocked (
+    our_aci_uuid TEXT NOT NULL,
+    kind         TEXT NOT NULL,
+    identifier   TEXT NOT NULL,
+
+    PRIMARY KEY (our_aci_uuid, kind, identifier),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,17 @@
+-- v7: Add inbox for decrypted messages that haven't been handled yet
+CREATE TABLE signalmeow_inbox (
+    our_aci_uuid  TEXT    NOT NULL,
+    sender_aci    TEXT    NOT NULL,
+    timestamp     BIGINT  NOT NULL,
+    sender_device INTEGER NOT NULL,
+    -- content is cleared once the message has been handled, the row is only kept to ignore replays
+    content       bytea,
+    received_ts   BIGINT  NOT NULL,
+    attempts      INTEGER NOT NULL DEFAULT 0,
+    processed     BOOLEAN NOT NULL DEFAULT false,
+
+    PRIMARY KEY (our_aci_uuid, sender_aci, timestamp),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX signalmeow_inbox_pending_idx ON signalmeow_inbox (our_aci_uuid, processed, received_ts);
@@ -0,0 +1,3 @@
+-- v8: Store decrypted group state to avoid refetching groups after restarts
+ALTER TABLE signalmeow_groups ADD COLUMN revision INTEGER;
+ALTER TABLE signalmeow_groups ADD COLUMN group_info TEXT;
@@ -0,0 +1,8 @@
+-- v9: Remember the devices on our own account to detect newly linked ones
+CREATE TABLE signalmeow_known_devices (
+    our_aci_uuid TEXT    NOT NULL,
+    device_id    INTEGER NOT NULL,
+
+    PRIMARY KEY (our_aci_uuid, device_id),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,2 @@
+-- v10: Track when group state was fetched to refetch it periodically
+ALTER TABLE signalmeow_groups ADD COLUMN fetched_ts BIGINT;
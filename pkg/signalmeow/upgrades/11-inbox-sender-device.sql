@@ -0,0 +1,28 @@
+-- v11: Include the sender device in the inbox key, as different devices can send messages with the same timestamp
+-- only: postgres for next 2 lines
+ALTER TABLE signalmeow_inbox DROP CONSTRAINT signalmeow_inbox_pkey;
+ALTER TABLE signalmeow_inbox ADD PRIMARY KEY (our_aci_uuid, sender_aci, sender_device, timestamp);
+
+-- only: sqlite until "end only"
+CREATE TABLE signalmeow_inbox_new (
+    our_aci_uuid  TEXT    NOT NULL,
+    sender_aci    TEXT    NOT NULL,
+    timestamp     BIGINT  NOT NULL,
+    sender_device INTEGER NOT NULL,
+    -- content is cleared once the message has been handled, the row is only kept to ignore replays
+    content       bytea,
+    received_ts   BIGINT  NOT NULL,
+    attempts      INTEGER NOT NULL DEFAULT 0,
+    processed     BOOLEAN NOT NULL DEFAULT false,
+
+    PRIMARY KEY (our_aci_uuid, sender_aci, sender_device, timestamp),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO signalmeow_inbox_new (our_aci_uuid, sender_aci, timestamp, sender_device, content, received_ts, attempts, processed)
+SELECT our_aci_uuid, sender_aci, timestamp, sender_device, content, received_ts, attempts, processed FROM signalmeow_inbox;
+
+DROP TABLE signalmeow_inbox;
+ALTER TABLE signalmeow_inbox_new RENAME TO signalmeow_inbox;
+CREATE INDEX signalmeow_inbox_pending_idx ON signalmeow_inbox (our_aci_uuid, processed, received_ts);
+-- end only sqlite
@@ -0,0 +1,273 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	DefaultChatURL    = "https://" + UrlHost
+	DefaultStorageURL = "https://" + StorageUrlHost
+
+	// DefaultTrustRoot is the public key that signs the sender certificates of sealed sender messages.
+	DefaultTrustRoot = "BXu6QIKVz5MA8gstzfOgRQGqyLqOwNKHL6INkv3IHWMF"
+	// DefaultServerPublicParams are the zkgroup parameters of the server, used for group and profile credentials.
+	DefaultServerPublicParams = "AMhf5ywVwITZMsff/eCyudZx9JDmkkkbV6PInzG4p8x3VqVJSFiMvnvlEKWuRob/1eaIetR31IYeAbm0NdOuHH8Qi+Rexi1wLlpzIo1gstHWBfZzy1+qHRV5A4TqPp15YzBPm0WSggW6PbSn+F4lf57VCnHF7p8SvzAA2ZZJPYJURt8X7bbg+H3i+PEjH9DXItNEqs2sNcug37xZQDLm7X36nOoGPs54XsEGzPdEV+itQNGUFEjY6X9Uv+Acuks7NpyGvCoKxGwgKgE5XyJ+nNKlyHHOLb6N1NuHyBrZrgtY/JYJHRooo5CEqYKBqdFnmbTVGEkCvJKxLnjwKWf+fEPoWeQFj5ObDjcKMZf2Jm2Ae69x+ikU5gBXsRmoF94GXTLfN0/vLt98KDPnxwAQL9j5V1jGOY8jQl6MLxEs56cwXN0dqCnImzVH3TZT1cJ8SW1BRX6qIVxEzjsSGx3yxF3suAilPMqGRp4ffyopjMD1JXiKR2RwLKzizUe5e8XyGOy9fplzhw3jVzTRyUZTRSZKkMLWcQ/gv0E4aONNqs4P"
+)
+
+// DefaultCDNURLs maps CDN numbers in attachment pointers to the CDN base URLs.
+var DefaultCDNURLs = map[uint32]string{
+	0: "https://" + CDNUrlHost,
+	2: "https://" + CDN2UrlHost,
+	3: "https://" + CDN3UrlHost,
+}
+
+// Config contains the server endpoints and network settings used to talk to Signal.
+// Empty fields use the default values of the official Signal servers.
+type Config struct {
+	ChatURL    string
+	StorageURL string
+	CDNURLs    map[uint32]string
+
+	// ProxyURL is a http://, https:// or socks5:// proxy that all requests are sent through.
+	ProxyURL string
+	// TLSProxy is the address of a Signal TLS proxy (https://signal.org/blog/help-iran-reconnect/).
+	// It can't be combined with ProxyURL.
+	TLSProxy string
+	// CACertPath is a PEM file with extra root certificates to trust, e.g. for a staging server or a debugging proxy.
+	CACertPath string
+
+	// TrustRoot is the base64-encoded public key that sealed sender certificates must be signed with.
+	TrustRoot string
+	// ServerPublicParams are the base64-encoded zkgroup server parameters.
+	ServerPublicParams string
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.ChatURL == "" {
+		cfg.ChatURL = DefaultChatURL
+	}
+	if cfg.StorageURL == "" {
+		cfg.StorageURL = DefaultStorageURL
+	}
+	cdnURLs := make(map[uint32]string, len(DefaultCDNURLs))
+	for number, cdnURL := range DefaultCDNURLs {
+		cdnURLs[number] = cdnURL
+	}
+	for number, cdnURL := range cfg.CDNURLs {
+		cdnURLs[number] = cdnURL
+	}
+	cfg.CDNURLs = cdnURLs
+	if cfg.TrustRoot == "" {
+		cfg.TrustRoot = DefaultTrustRoot
+	}
+	if cfg.ServerPublicParams == "" {
+		cfg.ServerPublicParams = DefaultServerPublicParams
+	}
+	return cfg
+}
+
+// Client sends requests to the Signal servers described by a Config.
+type Client struct {
+	Config     Config
+	HTTPClient *http.Client
+
+	hostURLs map[string]string
+	log      *zerolog.Logger
+	metrics  Metrics
+}
+
+// NewClient creates a client for the given config. Empty config fields are filled with the defaults.
+func NewClient(cfg Config) (*Client, error) {
+	cfg = cfg.withDefaults()
+	for _, baseURL := range []string{cfg.ChatURL, cfg.StorageURL} {
+		if _, err := parseBaseURL(baseURL); err != nil {
+			return nil, err
+		}
+	}
+	for _, baseURL := range cfg.CDNURLs {
+		if _, err := parseBaseURL(baseURL); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := base64.StdEncoding.DecodeString(cfg.TrustRoot); err != nil {
+		return nil, fmt.Errorf("invalid trust root: %w", err)
+	} else if _, err = base64.StdEncoding.DecodeString(cfg.ServerPublicParams); err != nil {
+		return nil, fmt.Errorf("invalid server public params: %w", err)
+	}
+
+	rootCAs := x509.NewCertPool()
+	signalRootCert, err := x509.ParseCertificate(signalRootCertBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Signal root certificate: %w", err)
+	}
+	rootCAs.AddCert(signalRootCert)
+	if cfg.CACertPath != "" {
+		caCert, err := os.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		} else if !rootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACertPath)
+		}
+	}
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig: &tls.Config{
+			RootCAs: rootCAs,
+		},
+	}
+	if cfg.ProxyURL != "" && cfg.TLSProxy != "" {
+		return nil, errors.New("a proxy URL and a TLS proxy can't be used at the same time")
+	} else if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	} else if cfg.TLSProxy != "" {
+		transport.DialContext = tlsProxyDialer(cfg.TLSProxy)
+	}
+
+	return &Client{
+		Config:     cfg,
+		HTTPClient: &http.Client{Transport: transport},
+		hostURLs: map[string]string{
+			UrlHost:        cfg.ChatURL,
+			StorageUrlHost: cfg.StorageURL,
+			CDNUrlHost:     cfg.CDNURLs[0],
+			CDN2UrlHost:    cfg.CDNURLs[2],
+			CDN3UrlHost:    cfg.CDNURLs[3],
+		},
+	}, nil
+}
+
+func parseBaseURL(baseURL string) (*url.URL, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL %q: %w", baseURL, err)
+	} else if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return nil, fmt.Errorf("invalid server URL %q: scheme must be http or https", baseURL)
+	}
+	return parsed, nil
+}
+
+// tlsProxyDialer returns a dialer that tunnels connections through a Signal TLS proxy.
+// The proxy forwards the inner TLS connection based on its SNI, so the transport still
+// does its own TLS handshake with the real server over the returned connection.
+func tlsProxyDialer(proxyAddr string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(proxyAddr)
+	if err != nil {
+		host, port = proxyAddr, "443"
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 30 * time.Second},
+		Config:    &tls.Config{ServerName: host},
+	}
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(host, port))
+	}
+}
+
+// WithLogger returns a copy of the client that logs to the given logger.
+// The copy shares the HTTP client and config with the original.
+func (c *Client) WithLogger(log zerolog.Logger) *Client {
+	clone := *c
+	clone.log = &log
+	return &clone
+}
+
+// WithMetrics returns a copy of the client that reports to the given metrics hook.
+// The copy shares the HTTP client and config with the original.
+func (c *Client) WithMetrics(m Metrics) *Client {
+	clone := *c
+	clone.metrics = m
+	return &clone
+}
+
+// WithOwnTransport returns a copy of the client with its own HTTP transport, so that
+// connection pools and HTTP/2 state aren't shared with the original.
+func (c *Client) WithOwnTransport() *Client {
+	clone := *c
+	httpClient := *c.HTTPClient
+	if transport, ok := httpClient.Transport.(*http.Transport); ok {
+		httpClient.Transport = transport.Clone()
+	}
+	clone.HTTPClient = &httpClient
+	return &clone
+}
+
+// Metrics returns the metrics hook of the client.
+func (c *Client) Metrics() Metrics {
+	if c.metrics != nil {
+		return c.metrics
+	}
+	return NoopMetrics{}
+}
+
+// nopLog is used by clients that weren't given a logger with WithLogger.
+var nopLog = zerolog.Nop()
+
+func (c *Client) logger() *zerolog.Logger {
+	if c.log != nil {
+		return c.log
+	}
+	return &nopLog
+}
+
+// urlForHost returns the configured base URL for one of the default Signal hosts.
+func (c *Client) urlForHost(host string) string {
+	if baseURL, ok := c.hostURLs[host]; ok {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	return "https://" + host
+}
+
+func (c *Client) cdnURL(cdnNumber uint32) string {
+	if baseURL, ok := c.Config.CDNURLs[cdnNumber]; ok {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	c.logger().Warn().Msgf("Invalid CDN index %v, using CDN 0", cdnNumber)
+	return strings.TrimSuffix(c.Config.CDNURLs[0], "/")
+}
+
+// websocketURL returns the websocket URL for the given path on the chat server.
+func (c *Client) websocketURL(path string) string {
+	chatURL := c.urlForHost(UrlHost)
+	if strings.HasPrefix(chatURL, "http://") {
+		return "ws://" + strings.TrimPrefix(chatURL, "http://") + path
+	}
+	return "wss://" + strings.TrimPrefix(chatURL, "https://") + path
+}
@@ -0,0 +1,161 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientURLMapping(t *testing.T) {
+	client, err := NewClient(Config{
+		ChatURL:    "http://localhost:8080/",
+		StorageURL: "https://storage.example.com",
+		CDNURLs:    map[uint32]string{2: "https://cdn2.example.com/"},
+	})
+	require.NoError(t, err)
+	client = client.WithLogger(zerolog.Nop())
+
+	assert.Equal(t, "http://localhost:8080", client.urlForHost(UrlHost))
+	assert.Equal(t, "https://storage.example.com", client.urlForHost(StorageUrlHost))
+	assert.Equal(t, "https://"+CDNUrlHost, client.urlForHost(CDNUrlHost), "unconfigured CDNs must use the default")
+	assert.Equal(t, "https://cdn2.example.com", client.urlForHost(CDN2UrlHost))
+	assert.Equal(t, "https://other.example.com", client.urlForHost("other.example.com"))
+
+	assert.Equal(t, "https://cdn2.example.com", client.cdnURL(2))
+	assert.Equal(t, "https://"+CDN3UrlHost, client.cdnURL(3))
+	assert.Equal(t, "https://"+CDNUrlHost, client.cdnURL(7), "unknown CDNs must fall back to CDN 0")
+
+	assert.Equal(t, DefaultTrustRoot, client.Config.TrustRoot)
+	assert.Equal(t, DefaultServerPublicParams, client.Config.ServerPublicParams)
+	assert.Len(t, DefaultCDNURLs, 3, "the defaults must not be modified")
+}
+
+func TestClientWebsocketURL(t *testing.T) {
+	client, err := NewClient(Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "wss://"+UrlHost+WebsocketPath, client.websocketURL(WebsocketPath))
+
+	client, err = NewClient(Config{ChatURL: "http://127.0.0.1:1234"})
+	require.NoError(t, err)
+	assert.Equal(t, "ws://127.0.0.1:1234"+WebsocketProvisioningPath, client.websocketURL(WebsocketProvisioningPath))
+}
+
+func TestNewClientInvalidConfig(t *testing.T) {
+	_, err := NewClient(Config{ChatURL: "ftp://chat.example.com"})
+	assert.Error(t, err)
+	_, err = NewClient(Config{CDNURLs: map[uint32]string{0: "cdn.example.com"}})
+	assert.Error(t, err, "URLs without a scheme must be rejected")
+	_, err = NewClient(Config{TrustRoot: "not base64!"})
+	assert.Error(t, err)
+	_, err = NewClient(Config{ServerPublicParams: "not base64!"})
+	assert.Error(t, err)
+}
+
+func TestClientProxy(t *testing.T) {
+	client, err := NewClient(Config{ProxyURL: "socks5://proxy.example.com:1080"})
+	require.NoError(t, err)
+	transport := client.HTTPClient.Transport.(*http.Transport)
+	require.NotNil(t, transport.Proxy)
+	req, err := http.NewRequest(http.MethodGet, "https://"+UrlHost, nil)
+	require.NoError(t, err)
+	proxyURL, err := transport.Proxy(req)
+	require.NoError(t, err)
+	assert.Equal(t, "socks5://proxy.example.com:1080", proxyURL.String())
+	assert.Nil(t, transport.DialContext)
+
+	client, err = NewClient(Config{TLSProxy: "tlsproxy.example.com"})
+	require.NoError(t, err)
+	transport = client.HTTPClient.Transport.(*http.Transport)
+	assert.Nil(t, transport.Proxy)
+	assert.NotNil(t, transport.DialContext)
+
+	_, err = NewClient(Config{ProxyURL: "ftp://proxy.example.com"})
+	assert.Error(t, err, "unsupported proxy schemes must be rejected")
+	_, err = NewClient(Config{ProxyURL: "http://proxy.example.com", TLSProxy: "tlsproxy.example.com"})
+	assert.Error(t, err, "a proxy and a TLS proxy can't be combined")
+}
+
+func writeTestCACert(t *testing.T) (string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "signalmeow test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	require.NoError(t, err)
+	return path, cert
+}
+
+func TestClientCACert(t *testing.T) {
+	path, cert := writeTestCACert(t)
+	client, err := NewClient(Config{CACertPath: path})
+	require.NoError(t, err)
+	rootCAs := client.HTTPClient.Transport.(*http.Transport).TLSClientConfig.RootCAs
+	_, err = cert.Verify(x509.VerifyOptions{Roots: rootCAs})
+	assert.NoError(t, err, "the extra CA must be trusted")
+
+	signalRootCert, err := x509.ParseCertificate(signalRootCertBytes)
+	require.NoError(t, err)
+	_, err = signalRootCert.Verify(x509.VerifyOptions{Roots: rootCAs})
+	assert.NoError(t, err, "the Signal root must still be trusted")
+
+	_, err = NewClient(Config{CACertPath: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+	emptyPath := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(emptyPath, []byte("no certificates here"), 0600))
+	_, err = NewClient(Config{CACertPath: emptyPath})
+	assert.Error(t, err)
+}
+
+func TestClientWithOwnTransport(t *testing.T) {
+	client, err := NewClient(Config{ProxyURL: "socks5://proxy.example.com:1080"})
+	require.NoError(t, err)
+	clone := client.WithOwnTransport()
+	assert.NotSame(t, client.HTTPClient, clone.HTTPClient)
+	assert.NotSame(t, client.HTTPClient.Transport, clone.HTTPClient.Transport)
+	assert.NotNil(t, clone.HTTPClient.Transport.(*http.Transport).Proxy, "the settings must be copied")
+
+	assert.Equal(t, NoopMetrics{}, client.Metrics())
+	withMetrics := client.WithMetrics(NoopMetrics{})
+	assert.Same(t, client.HTTPClient, withMetrics.HTTPClient)
+}
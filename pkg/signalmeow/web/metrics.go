@@ -0,0 +1,38 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"time"
+)
+
+// Metrics receives measurements of the websocket connections. See signalmeow.Metrics for the full hook.
+type Metrics interface {
+	// WebsocketReconnect is called every time a websocket connection is attempted again after the first try
+	WebsocketReconnect(name string)
+	// WebsocketRequest is called when the response to an outgoing websocket request arrives
+	WebsocketRequest(name string, status int, roundTrip time.Duration)
+	// AttachmentTransfer is called after an attachment has been uploaded or downloaded.
+	AttachmentTransfer(upload bool, bytes int64)
+}
+
+// NoopMetrics is a Metrics implementation that discards everything.
+type NoopMetrics struct{}
+
+func (NoopMetrics) WebsocketReconnect(name string)                                    {}
+func (NoopMetrics) WebsocketRequest(name string, status int, roundTrip time.Duration) {}
+func (NoopMetrics) AttachmentTransfer(upload bool, bytes int64)                       {}
@@ -23,8 +23,10 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/rs/zerolog"
 	"nhooyr.io/websocket"
 
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
@@ -34,12 +36,27 @@ import (
 const WebsocketProvisioningPath = "/v1/websocket/provisioning/"
 const WebsocketPath = "/v1/websocket/"
 
+// DefaultRequestTimeout is how long SendRequest waits for a response from the server.
+const DefaultRequestTimeout = 30 * time.Second
+
+const (
+	keepaliveInterval = 30 * time.Second
+	keepaliveTimeout  = 20 * time.Second
+)
+
+// ErrRequestTimeout is returned when the server doesn't respond to a request in time.
+var ErrRequestTimeout = errors.New("websocket request timed out")
+
+// ErrConnectionClosed is returned for requests that were still waiting for a response when the websocket disconnected.
+var ErrConnectionClosed = errors.New("websocket disconnected before receiving a response")
+
 type SimpleResponse struct {
 	Status int
 }
 type RequestHandlerFunc func(context.Context, *signalpb.WebSocketRequestMessage) (*SimpleResponse, error)
 
 type SignalWebsocket struct {
+	client        *Client
 	ws            *websocket.Conn
 	name          string // Purely for logging
 	path          string
@@ -48,13 +65,14 @@ type SignalWebsocket struct {
 	statusChannel chan SignalWebsocketConnectionStatus
 }
 
-func NewSignalWebsocket(ctx context.Context, name string, path string, username *string, password *string) *SignalWebsocket {
+func (c *Client) NewSignalWebsocket(ctx context.Context, name string, path string, username *string, password *string) *SignalWebsocket {
 	var basicAuth *string
 	if username != nil && password != nil {
 		b := base64.StdEncoding.EncodeToString([]byte(*username + ":" + *password))
 		basicAuth = &b
 	}
 	return &SignalWebsocket{
+		client:        c,
 		name:          name,
 		path:          path,
 		basicAuth:     basicAuth,
@@ -145,26 +163,26 @@ func (s *SignalWebsocket) connectLoop(
 		for {
 			select {
 			case <-ctx.Done():
-				zlog.Info().Msg("ctx done, stopping request loop")
+				s.client.logger().Info().Msg("ctx done, stopping request loop")
 				return
 			case request, ok := <-incomingRequestChan:
 				if !ok {
 					// Main connection loop must have closed, so we should stop
-					zlog.Info().Msg("incomingRequestChan closed, stopping request loop")
+					s.client.logger().Info().Msg("incomingRequestChan closed, stopping request loop")
 					return
 				}
 				if request == nil {
-					zlog.Fatal().Msg("Received nil request")
+					s.client.logger().Fatal().Msg("Received nil request")
 				}
 				if requestHandler == nil {
-					zlog.Fatal().Msg("Received request but no handler")
+					s.client.logger().Fatal().Msg("Received request but no handler")
 				}
 
 				// Handle the request with the request handler function
 				response, err := (*requestHandler)(ctx, request)
 
 				if err != nil {
-					zlog.Err(err).Msg("Error handling request")
+					s.client.logger().Err(err).Msg("Error handling request")
 					continue
 				}
 				if response != nil && s.sendChannel != nil {
@@ -182,21 +200,26 @@ func (s *SignalWebsocket) connectLoop(
 	backoff := backoffIncrement
 	retrying := false
 	errorCount := 0
+	firstAttempt := true
 	for {
 		if retrying {
 			if backoff > maxBackoff {
 				backoff = maxBackoff
 			}
-			zlog.Warn().Msgf("Failed to connect, retrying in %v seconds...\n", backoff.Seconds())
+			s.client.logger().Warn().Msgf("Failed to connect, retrying in %v seconds...\n", backoff.Seconds())
 			time.Sleep(backoff)
 			backoff += backoffIncrement
 		}
 		if ctx.Err() != nil {
-			zlog.Info().Msg("ctx done, stopping connection loop")
+			s.client.logger().Info().Msg("ctx done, stopping connection loop")
 			return
 		}
+		if !firstAttempt {
+			s.client.Metrics().WebsocketReconnect(s.name)
+		}
+		firstAttempt = false
 
-		ws, resp, err := OpenWebsocket(ctx, s.path)
+		ws, resp, err := s.client.OpenWebsocket(ctx, s.path)
 		if resp != nil {
 			if resp.StatusCode != 101 {
 				// Server didn't want to open websocket
@@ -257,60 +280,48 @@ func (s *SignalWebsocket) connectLoop(
 		retrying = false
 		backoff = backoffIncrement
 
-		responseChannels := make(map[uint64]chan *signalpb.WebSocketResponseMessage)
+		responseChannels := newResponseChannelMap()
 		loopCtx, loopCancel := context.WithCancelCause(ctx)
 
 		// Read loop (for reading incoming reqeusts and responses to outgoing requests)
 		go func() {
-			err := readLoop(loopCtx, ws, s.name, incomingRequestChan, &responseChannels)
+			err := readLoop(loopCtx, ws, s.client.logger(), s.name, incomingRequestChan, responseChannels)
 			// Don't want to put an err into loopCancel if we don't have one
 			if err != nil {
 				err = fmt.Errorf("error in readLoop: %w", err)
 			}
 			loopCancel(err)
-			zlog.Info().Msgf("readLoop exited (%s)", s.name)
+			s.client.logger().Info().Msgf("readLoop exited (%s)", s.name)
 		}()
 
 		// Write loop (for sending outgoing requests and responses to incoming requests)
 		go func() {
-			err := writeLoop(loopCtx, ws, s.name, s.sendChannel, &responseChannels)
+			err := writeLoop(loopCtx, ws, s.client.logger(), s.name, s.sendChannel, responseChannels)
 			// Don't want to put an err into loopCancel if we don't have one
 			if err != nil {
 				err = fmt.Errorf("error in writeLoop: %w", err)
 			}
 			loopCancel(err)
-			zlog.Info().Msgf("writeLoop exited (%s)", s.name)
+			s.client.logger().Info().Msgf("writeLoop exited (%s)", s.name)
 		}()
 
-		// Ping loop (send a keepalive Ping every 30s)
+		// Keepalive loop (send a keepalive request every 30s). Low-level pings aren't enough to notice
+		// half-open connections, so reconnect if the server doesn't respond to the request in time.
 		go func() {
-			ticker := time.NewTicker(30 * time.Second)
-			defer ticker.Stop()
-
-			for {
-				select {
-				case <-ticker.C:
-					err := ws.Ping(loopCtx)
-					if err != nil {
-						loopCancel(fmt.Errorf("error sending keepalive: %w", err))
-						return
-					}
-					zlog.Info().Msgf("Sent keepalive (%s)", s.name)
-				case <-loopCtx.Done():
-					return
-				}
+			if err := s.keepaliveLoop(loopCtx, keepaliveInterval, keepaliveTimeout); err != nil {
+				loopCancel(err)
 			}
 		}()
 
-		// Wait for read or write or ping loop to exit (which means there was an error)
-		zlog.Info().Msgf("Waiting for read or write loop to exit (%s)", s.name)
+		// Wait for read or write or keepalive loop to exit (which means there was an error)
+		s.client.logger().Info().Msgf("Waiting for read or write loop to exit (%s)", s.name)
 		select {
 		case <-loopCtx.Done():
-			zlog.Info().Msgf("received loopCtx done (%s)", s.name)
+			s.client.logger().Info().Msgf("received loopCtx done (%s)", s.name)
 			if context.Cause(loopCtx) != nil {
 				err := context.Cause(loopCtx)
 				if err != nil && err != context.Canceled {
-					zlog.Err(err).Msg("loopCtx error")
+					s.client.logger().Err(err).Msg("loopCtx error")
 					errorCount++
 				}
 			}
@@ -325,9 +336,9 @@ func (s *SignalWebsocket) connectLoop(
 				}
 			}
 		case <-ctx.Done():
-			zlog.Info().Msgf("received ctx done (%s)", s.name)
-			zlog.Debug().Msgf("ctx error: %v", ctx.Err())
-			zlog.Debug().Msgf("ctx cause: %v", context.Cause(ctx))
+			s.client.logger().Info().Msgf("received ctx done (%s)", s.name)
+			s.client.logger().Debug().Msgf("ctx error: %v", ctx.Err())
+			s.client.logger().Debug().Msgf("ctx cause: %v", context.Cause(ctx))
 			if context.Cause(ctx) != nil && context.Cause(ctx) == context.Canceled {
 				s.statusChannel <- SignalWebsocketConnectionStatus{
 					Event: SignalWebsocketConnectionEventCleanShutdown,
@@ -340,20 +351,43 @@ func (s *SignalWebsocket) connectLoop(
 				}
 			}
 		}
-		zlog.Info().Msgf("Read or write loop exited (%s)", s.name)
+		s.client.logger().Info().Msgf("Read or write loop exited (%s)", s.name)
 
 		// Clean up
 		ws.Close(200, "Done")
-		for _, responseChannel := range responseChannels {
-			close(responseChannel)
-		}
+		// Fail requests that were waiting for a response on this connection
+		responseChannels.closeAll()
 		loopCancel(nil)
-		zlog.Debug().Msg("Finished websocket cleanup")
+		s.client.logger().Debug().Msg("Finished websocket cleanup")
 		if errorCount > 500 {
 			// Something is really wrong, we better panic.
 			// This is a last defense against a runaway error loop,
 			// like the WS continually closing and reconnecting
-			zlog.Fatal().Msgf("Too many errors (%d), panicking (%s)", errorCount, s.name)
+			s.client.logger().Fatal().Msgf("Too many errors (%d), panicking (%s)", errorCount, s.name)
+		}
+	}
+}
+
+// keepaliveLoop sends a keepalive request every interval until ctx is done. An error is returned
+// if the server doesn't respond to a keepalive within timeout.
+func (s *SignalWebsocket) keepaliveLoop(ctx context.Context, interval, timeout time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			keepalive := CreateWSRequest(http.MethodGet, "/v1/keepalive", nil, nil, nil)
+			resp, err := s.sendRequestInternal(ctx, keepalive, timeout)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("error sending keepalive: %w", err)
+			}
+			s.client.logger().Debug().Msgf("Received keepalive response %v (%s)", resp.GetStatus(), s.name)
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
@@ -361,9 +395,10 @@ func (s *SignalWebsocket) connectLoop(
 func readLoop(
 	ctx context.Context,
 	ws *websocket.Conn,
+	log *zerolog.Logger,
 	name string,
 	incomingRequestChan chan *signalpb.WebSocketRequestMessage,
-	responseChannels *(map[uint64]chan *signalpb.WebSocketResponseMessage),
+	responseChannels *responseChannelMap,
 ) error {
 	for {
 		if ctx.Err() != nil {
@@ -374,10 +409,10 @@ func readLoop(
 		err := wspb.Read(ctx, ws, msg)
 		if err != nil {
 			if err == context.Canceled {
-				zlog.Info().Msgf("readLoop context canceled (%s)", name)
+				log.Info().Msgf("readLoop context canceled (%s)", name)
 			}
 			if strings.Contains(err.Error(), "StatusNormalClosure") {
-				zlog.Info().Msgf("readLoop received StatusNormalClosure (%s)", name)
+				log.Info().Msgf("readLoop received StatusNormalClosure (%s)", name)
 				return nil
 			}
 			return fmt.Errorf("error reading message: %w", err)
@@ -388,24 +423,23 @@ func readLoop(
 			if msg.Request == nil {
 				return errors.New("Received request message with no request")
 			}
-			zlog.Debug().Msgf("Received WS request %v:%v, verb: %v, path: %v", name, *msg.Request.Id, *msg.Request.Verb, *msg.Request.Path)
+			log.Debug().Msgf("Received WS request %v:%v, verb: %v, path: %v", name, *msg.Request.Id, *msg.Request.Verb, *msg.Request.Path)
 			incomingRequestChan <- msg.Request
 		} else if *msg.Type == signalpb.WebSocketMessage_RESPONSE {
 			if msg.Response == nil {
-				zlog.Fatal().Msg("Received response with no response")
+				log.Fatal().Msg("Received response with no response")
 			}
 			if msg.Response.Id == nil {
-				zlog.Fatal().Msg("Received response with no id")
+				log.Fatal().Msg("Received response with no id")
 			}
-			responseChannel, ok := (*responseChannels)[*msg.Response.Id]
+			responseChannel, ok := responseChannels.pop(*msg.Response.Id)
 			if !ok {
-				zlog.Warn().Msgf("Received response with unknown id: %v", *msg.Response.Id)
+				log.Warn().Msgf("Received response with unknown id (the request may have timed out): %v", *msg.Response.Id)
 				continue
 			}
-			zlog.Debug().Msgf("Received WS response %v:%v, status :%v", name, *msg.Response.Id, *msg.Response.Status)
+			log.Debug().Msgf("Received WS response %v:%v, status :%v", name, *msg.Response.Id, *msg.Response.Status)
+			// The channel is buffered, so this doesn't block even if the request already timed out
 			responseChannel <- msg.Response
-			delete(*responseChannels, *msg.Response.Id)
-			zlog.Trace().Msgf("Deleted response channel for id: %v", *msg.Response.Id)
 			close(responseChannel)
 		} else if *msg.Type == signalpb.WebSocketMessage_UNKNOWN {
 			return fmt.Errorf("Received message with unknown type: %v", *msg.Type)
@@ -415,9 +449,68 @@ func readLoop(
 	}
 }
 
+// responseChannelMap holds the channels of requests that are waiting for a response.
+// It's shared by the read and write loops of a single connection.
+type responseChannelMap struct {
+	lock     sync.Mutex
+	channels map[uint64]pendingResponse
+}
+
+type pendingResponse struct {
+	ch    chan *signalpb.WebSocketResponseMessage
+	timer *time.Timer
+}
+
+func newResponseChannelMap() *responseChannelMap {
+	return &responseChannelMap{channels: make(map[uint64]pendingResponse)}
+}
+
+// add stores the channel for a request. If deadline is set, the request is forgotten at the deadline,
+// because the sender has stopped waiting for the response by then.
+func (m *responseChannelMap) add(id uint64, ch chan *signalpb.WebSocketResponseMessage, deadline time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	pending := pendingResponse{ch: ch}
+	if !deadline.IsZero() {
+		pending.timer = time.AfterFunc(time.Until(deadline), func() {
+			m.lock.Lock()
+			delete(m.channels, id)
+			m.lock.Unlock()
+		})
+	}
+	m.channels[id] = pending
+}
+
+func (m *responseChannelMap) pop(id uint64) (chan *signalpb.WebSocketResponseMessage, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	pending, ok := m.channels[id]
+	if !ok {
+		return nil, false
+	}
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	delete(m.channels, id)
+	return pending.ch, true
+}
+
+func (m *responseChannelMap) closeAll() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, pending := range m.channels {
+		if pending.timer != nil {
+			pending.timer.Stop()
+		}
+		close(pending.ch)
+		delete(m.channels, id)
+	}
+}
+
 type SignalWebsocketSendMessage struct {
 	// Populate if we're sending a request:
 	RequestTime     time.Time
+	Deadline        time.Time
 	ResponseChannel chan *signalpb.WebSocketResponseMessage
 	// Populate if we're sending a response:
 	ResponseMessage *SimpleResponse
@@ -428,9 +521,10 @@ type SignalWebsocketSendMessage struct {
 func writeLoop(
 	ctx context.Context,
 	ws *websocket.Conn,
+	log *zerolog.Logger,
 	name string,
 	sendChannel chan SignalWebsocketSendMessage,
-	responseChannels *(map[uint64]chan *signalpb.WebSocketResponseMessage),
+	responseChannels *responseChannelMap,
 ) error {
 	for i := uint64(1); ; i++ {
 		select {
@@ -449,20 +543,24 @@ func writeLoop(
 					Type:    &msgType,
 					Request: request.RequestMessage,
 				}
-				request.RequestMessage.Id = &i
-				(*responseChannels)[i] = request.ResponseChannel
 				path := *request.RequestMessage.Path
-				if len(path) > 30 {
+				if len(path) > 40 {
 					path = path[:40]
 				}
+				if !request.Deadline.IsZero() && time.Now().After(request.Deadline) {
+					// The caller has already given up on this request
+					log.Warn().Msgf("Not sending expired WS request %v, verb: %v, path: %v", name, *request.RequestMessage.Verb, path)
+					close(request.ResponseChannel)
+					continue
+				}
+				request.RequestMessage.Id = &i
+				responseChannels.add(i, request.ResponseChannel, request.Deadline)
 				if request.RequestTime != (time.Time{}) {
 					elapsed := time.Since(request.RequestTime)
-					if elapsed > 1*time.Minute {
-						return fmt.Errorf("Took too long, not sending (elapsed: %v)", elapsed)
-					} else if elapsed > 10*time.Second {
-						zlog.Warn().Msgf("Sending WS request %v:%v, verb: %v, path: %v, elapsed: %v", name, i, *request.RequestMessage.Verb, path, elapsed)
+					if elapsed > 10*time.Second {
+						log.Warn().Msgf("Sending WS request %v:%v, verb: %v, path: %v, elapsed: %v", name, i, *request.RequestMessage.Verb, path, elapsed)
 					} else {
-						zlog.Debug().Msgf("Sending WS request %v:%v, verb: %v, path: %v, elapsed: %v", name, i, *request.RequestMessage.Verb, path, elapsed)
+						log.Debug().Msgf("Sending WS request %v:%v, verb: %v, path: %v, elapsed: %v", name, i, *request.RequestMessage.Verb, path, elapsed)
 					}
 				}
 				err := wspb.Write(ctx, ws, message)
@@ -474,7 +572,7 @@ func writeLoop(
 				}
 			} else if request.RequestMessage != nil && request.ResponseMessage != nil {
 				message := CreateWSResponse(*request.RequestMessage.Id, request.ResponseMessage.Status)
-				zlog.Debug().Msgf("Sending WS response %v:%v, status: %v", name, *request.RequestMessage.Id, request.ResponseMessage.Status)
+				log.Debug().Msgf("Sending WS response %v:%v, status: %v", name, *request.RequestMessage.Id, request.ResponseMessage.Status)
 				err := wspb.Write(ctx, ws, message)
 				if err != nil {
 					return fmt.Errorf("error writing response message: %w", err)
@@ -486,61 +584,64 @@ func writeLoop(
 	}
 }
 
+// SendRequest sends a request to the server and waits for the response. If there's no response
+// within DefaultRequestTimeout, an error wrapping ErrRequestTimeout is returned.
+// If the connection drops before the response arrives, ErrConnectionClosed is returned.
 func (s *SignalWebsocket) SendRequest(
 	ctx context.Context,
 	request *signalpb.WebSocketRequestMessage,
 ) (*signalpb.WebSocketResponseMessage, error) {
-	startTime := time.Now()
-	return s.sendRequestInternal(ctx, request, startTime, 0)
+	return s.sendRequestInternal(ctx, request, DefaultRequestTimeout)
 }
 
 func (s *SignalWebsocket) sendRequestInternal(
 	ctx context.Context,
 	request *signalpb.WebSocketRequestMessage,
-	startTime time.Time,
-	retryCount int,
+	timeout time.Duration,
 ) (*signalpb.WebSocketResponseMessage, error) {
 	if s.basicAuth != nil {
 		request.Headers = append(request.Headers, "authorization:Basic "+*s.basicAuth)
 	}
-	responseChannel := make(chan *signalpb.WebSocketResponseMessage, 1)
-	if s.sendChannel == nil {
+	sendChannel := s.sendChannel
+	if sendChannel == nil {
 		return nil, errors.New("Send channel not initialized")
 	}
-	s.sendChannel <- SignalWebsocketSendMessage{
+	startTime := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	responseChannel := make(chan *signalpb.WebSocketResponseMessage, 1)
+	// Sending blocks while the websocket is reconnecting, so the timeout applies to that too
+	select {
+	case sendChannel <- SignalWebsocketSendMessage{
 		RequestMessage:  request,
 		ResponseChannel: responseChannel,
 		RequestTime:     startTime,
+		Deadline:        startTime.Add(timeout),
+	}:
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: couldn't send %s %s within %v", ErrRequestTimeout, request.GetVerb(), request.GetPath(), timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	response := <-responseChannel
-
-	if response == nil {
-		// If out of retries, return error no matter what
-		if retryCount >= 3 {
-			// TODO: I think error isn't getting passed in this context (as it's not the one in writeLoop)
-			if ctx.Err() != nil {
-				return nil, fmt.Errorf("retried 3 times, giving up: %w", ctx.Err())
-			} else {
-				return nil, errors.New("Retried 3 times, giving up")
-			}
-		}
-		if ctx.Err() != nil {
-			// if error contains "Took too long" don't retry
-			if strings.Contains(ctx.Err().Error(), "Took too long") {
-				return nil, ctx.Err()
-			}
+	select {
+	case response := <-responseChannel:
+		if response == nil {
+			return nil, ErrConnectionClosed
 		}
-		zlog.Warn().Msgf("Received nil response, retrying recursively (%v)", retryCount)
-		return s.sendRequestInternal(ctx, request, startTime, retryCount+1)
+		s.client.Metrics().WebsocketRequest(s.name, int(response.GetStatus()), time.Since(startTime))
+		return response, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: no response to %s %s within %v", ErrRequestTimeout, request.GetVerb(), request.GetPath(), timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return response, nil
 }
 
-func OpenWebsocket(ctx context.Context, path string) (*websocket.Conn, *http.Response, error) {
+func (c *Client) OpenWebsocket(ctx context.Context, path string) (*websocket.Conn, *http.Response, error) {
 	opt := &websocket.DialOptions{
-		HTTPClient: signalHTTPClient,
+		HTTPClient: c.HTTPClient,
 	}
-	urlStr := "wss://" + UrlHost + path
+	urlStr := c.websocketURL(path)
 	ws, resp, err := websocket.Dial(ctx, urlStr, opt)
 	if ws != nil {
 		ws.SetReadLimit(1 << 20) // Increase read limit to 1MB from default of 32KB
@@ -549,13 +650,8 @@ func OpenWebsocket(ctx context.Context, path string) (*websocket.Conn, *http.Res
 }
 
 func CreateWSResponse(id uint64, status int) *signalpb.WebSocketMessage {
-	if status != 200 && status != 400 {
-		// TODO support more responses to Signal? Are there more?
-		zlog.Fatal().Msgf("Error creating response %v (non 200/400 not supported yet)", status)
-		return nil
-	}
 	msg_type := signalpb.WebSocketMessage_RESPONSE
-	message := "OK"
+	message := http.StatusText(status)
 	if status == 400 {
 		message = "Unknown"
 	}
@@ -0,0 +1,194 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"nhooyr.io/websocket"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/wspb"
+)
+
+func pendingResponseCount(m *responseChannelMap) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.channels)
+}
+
+func newTestSignalWebsocket() *SignalWebsocket {
+	return &SignalWebsocket{
+		client:      &Client{},
+		name:        "test",
+		sendChannel: make(chan SignalWebsocketSendMessage),
+	}
+}
+
+// respondToRequests answers requests sent through s until respond returns false, after which requests are ignored.
+func respondToRequests(ctx context.Context, s *SignalWebsocket, respond func(*signalpb.WebSocketRequestMessage) bool) {
+	status := uint32(http.StatusOK)
+	for {
+		select {
+		case msg := <-s.sendChannel:
+			if respond(msg.RequestMessage) {
+				msg.ResponseChannel <- &signalpb.WebSocketResponseMessage{Status: &status}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func TestResponseChannelMapForgetsExpiredRequests(t *testing.T) {
+	m := newResponseChannelMap()
+	m.add(1, make(chan *signalpb.WebSocketResponseMessage, 1), time.Now().Add(10*time.Millisecond))
+	m.add(2, make(chan *signalpb.WebSocketResponseMessage, 1), time.Now().Add(time.Hour))
+	noDeadline := make(chan *signalpb.WebSocketResponseMessage, 1)
+	m.add(3, noDeadline, time.Time{})
+
+	require.Eventually(t, func() bool {
+		return pendingResponseCount(m) == 2
+	}, time.Second, 5*time.Millisecond)
+	_, ok := m.pop(1)
+	assert.False(t, ok, "expired request")
+	_, ok = m.pop(2)
+	assert.True(t, ok)
+	assert.Equal(t, 1, pendingResponseCount(m))
+
+	m.closeAll()
+	assert.Equal(t, 0, pendingResponseCount(m))
+	_, open := <-noDeadline
+	assert.False(t, open)
+}
+
+func TestSendRequestTimeout(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSignalWebsocket()
+
+	// Nothing reads the send channel, e.g. while reconnecting
+	request := CreateWSRequest(http.MethodGet, "/v1/test", nil, nil, nil)
+	_, err := s.sendRequestInternal(ctx, request, 20*time.Millisecond)
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+	assert.Contains(t, err.Error(), "couldn't send")
+
+	// The request is sent, but there's no response
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go respondToRequests(ctx, s, func(*signalpb.WebSocketRequestMessage) bool { return false })
+	request = CreateWSRequest(http.MethodGet, "/v1/test", nil, nil, nil)
+	_, err = s.sendRequestInternal(ctx, request, 20*time.Millisecond)
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+	assert.Contains(t, err.Error(), "no response")
+}
+
+func TestSendRequestTimeoutForgetsRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The server responds to everything except /v1/slow, which it responds to only after the client gave up
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		for {
+			var msg signalpb.WebSocketMessage
+			if err = wspb.Read(r.Context(), conn, &msg); err != nil {
+				return
+			}
+			response := CreateWSResponse(msg.GetRequest().GetId(), http.StatusOK)
+			if msg.GetRequest().GetPath() == "/v1/slow" {
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					_ = wspb.Write(r.Context(), conn, response)
+				}()
+			} else if err = wspb.Write(r.Context(), conn, response); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer ws.Close(websocket.StatusNormalClosure, "")
+
+	s := newTestSignalWebsocket()
+	responseChannels := newResponseChannelMap()
+	log := s.client.logger()
+	go readLoop(ctx, ws, log, s.name, make(chan *signalpb.WebSocketRequestMessage), responseChannels)
+	go writeLoop(ctx, ws, log, s.name, s.sendChannel, responseChannels)
+
+	_, err = s.sendRequestInternal(ctx, CreateWSRequest(http.MethodGet, "/v1/slow", nil, nil, nil), 20*time.Millisecond)
+	require.ErrorIs(t, err, ErrRequestTimeout)
+	require.Eventually(t, func() bool {
+		return pendingResponseCount(responseChannels) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	// The late response is ignored and the connection keeps working
+	time.Sleep(150 * time.Millisecond)
+	resp, err := s.sendRequestInternal(ctx, CreateWSRequest(http.MethodGet, "/v1/fast", nil, nil, nil), time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, http.StatusOK, resp.GetStatus())
+	assert.Equal(t, 0, pendingResponseCount(responseChannels))
+}
+
+func TestKeepaliveLoopFailsWithoutResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSignalWebsocket()
+	var keepalives atomic.Int32
+	go respondToRequests(ctx, s, func(req *signalpb.WebSocketRequestMessage) bool {
+		assert.Equal(t, "/v1/keepalive", req.GetPath())
+		return keepalives.Add(1) <= 2
+	})
+
+	err := s.keepaliveLoop(ctx, 10*time.Millisecond, 20*time.Millisecond)
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+	assert.EqualValues(t, 3, keepalives.Load())
+}
+
+func TestKeepaliveLoopStopsWhenDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSignalWebsocket()
+	var keepalives atomic.Int32
+	go respondToRequests(ctx, s, func(*signalpb.WebSocketRequestMessage) bool {
+		keepalives.Add(1)
+		return true
+	})
+
+	loopCtx, loopCancel := context.WithCancel(ctx)
+	go func() {
+		for keepalives.Load() < 3 {
+			time.Sleep(time.Millisecond)
+		}
+		loopCancel()
+	}()
+	err := s.keepaliveLoop(loopCtx, 5*time.Millisecond, time.Second)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, keepalives.Load(), int32(3))
+}
@@ -18,76 +18,24 @@ package web
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"net/url"
-	"os"
-
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 )
 
-const proxyUrlStr = "" // Set this to proxy requests
-const caCertPath = ""  // Set this to trust a self-signed cert (ie. for mitmproxy)
-
 const (
 	UrlHost        = "chat.signal.org"
 	StorageUrlHost = "storage.signal.org"
 	CDNUrlHost     = "cdn.signal.org"
 	CDN2UrlHost    = "cdn2.signal.org"
+	CDN3UrlHost    = "cdn3.signal.org"
 )
 
-var CDNHosts = []string{
-	CDNUrlHost,
-	CDNUrlHost,
-	CDN2UrlHost,
-}
-
-// logging
-var zlog zerolog.Logger = zerolog.New(zerolog.ConsoleWriter{}).With().Timestamp().Logger()
-
-func SetLogger(l zerolog.Logger) {
-	zlog = l
-}
-
 //go:embed signal-root.crt.der
 var signalRootCertBytes []byte
-var signalTransport = &http.Transport{
-	ForceAttemptHTTP2: true,
-	TLSClientConfig: &tls.Config{
-		RootCAs: x509.NewCertPool(),
-	},
-}
-var signalHTTPClient = &http.Client{
-	Transport: signalTransport,
-}
-
-func init() {
-	cert, err := x509.ParseCertificate(signalRootCertBytes)
-	if err != nil {
-		panic(err)
-	}
-	signalTransport.TLSClientConfig.RootCAs.AddCert(cert)
-
-	if proxyUrlStr != "" {
-		proxyURL, err := url.Parse(proxyUrlStr)
-		if err != nil {
-			panic(err)
-		}
-		signalTransport.Proxy = http.ProxyURL(proxyURL)
-	}
-	if caCertPath != "" {
-		caCert, err := os.ReadFile(caCertPath)
-		if err != nil {
-			panic(err)
-		}
-		signalTransport.TLSClientConfig.RootCAs.AppendCertsFromPEM(caCert)
-	}
-}
 
 type ContentType string
 
@@ -95,6 +43,8 @@ const (
 	ContentTypeJSON        ContentType = "application/json"
 	ContentTypeProtobuf    ContentType = "application/x-protobuf"
 	ContentTypeOctetStream ContentType = "application/octet-stream"
+	// ContentTypeOffsetOctetStream is used for TUS PATCH requests
+	ContentTypeOffsetOctetStream ContentType = "application/offset+octet-stream"
 )
 
 type HTTPReqOpt struct {
@@ -102,14 +52,21 @@ type HTTPReqOpt struct {
 	Username    *string
 	Password    *string
 	ContentType ContentType
+	// Host is one of the default Signal hosts (e.g. StorageUrlHost), which is mapped to the configured URL
 	Host        string
 	Headers     map[string]string
 	OverrideURL string // Override the full URL, if set ignores path and Host
+
+	// Stream the body from a reader instead of Body, ContentLength must be set too
+	BodyReader    io.Reader
+	ContentLength int64
+	// Context cancels the request, if set
+	Context context.Context
 }
 
 var httpReqCounter = 0
 
-func SendHTTPRequest(method string, path string, opt *HTTPReqOpt) (*http.Response, error) {
+func (c *Client) SendHTTPRequest(method string, path string, opt *HTTPReqOpt) (*http.Response, error) {
 	// Set defaults
 	if opt == nil {
 		opt = &HTTPReqOpt{}
@@ -120,14 +77,24 @@ func SendHTTPRequest(method string, path string, opt *HTTPReqOpt) (*http.Respons
 	if len(path) > 0 && path[0] != '/' {
 		path = "/" + path
 	}
-	urlStr := "https://" + opt.Host + path
+	urlStr := c.urlForHost(opt.Host) + path
 	if opt.OverrideURL != "" {
 		urlStr = opt.OverrideURL
 	}
 
-	req, err := http.NewRequest(method, urlStr, bytes.NewBuffer(opt.Body))
+	var body io.Reader = bytes.NewBuffer(opt.Body)
+	contentLength := int64(len(opt.Body))
+	if opt.BodyReader != nil {
+		body = opt.BodyReader
+		contentLength = opt.ContentLength
+	}
+	ctx := opt.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, body)
 	if err != nil {
-		zlog.Err(err).Msg("Error creating request")
+		c.logger().Err(err).Msg("Error creating request")
 		return nil, err
 	}
 	if opt.Headers != nil {
@@ -140,7 +107,8 @@ func SendHTTPRequest(method string, path string, opt *HTTPReqOpt) (*http.Respons
 	} else {
 		req.Header.Set("Content-Type", string(ContentTypeJSON))
 	}
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(opt.Body)))
+	req.ContentLength = contentLength
+	req.Header.Set("Content-Length", fmt.Sprintf("%d", contentLength))
 	// TODO: figure out what user agent to use
 	//req.Header.Set("User-Agent", "SignalBridge/0.1")
 	//req.Header.Set("X-Signal-Agent", "SignalBridge/0.1")
@@ -149,28 +117,38 @@ func SendHTTPRequest(method string, path string, opt *HTTPReqOpt) (*http.Respons
 	}
 
 	httpReqCounter++
-	zlog.Debug().Msgf("Sending HTTP request %v, %v url: %s", httpReqCounter, method, urlStr)
-	resp, err := signalHTTPClient.Do(req)
+	c.logger().Debug().Msgf("Sending HTTP request %v, %v url: %s", httpReqCounter, method, urlStr)
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		zlog.Err(err).Msg("Error sending request")
+		c.logger().Err(err).Msg("Error sending request")
 		return nil, err
 	}
-	zlog.Debug().Msgf("Received HTTP response %v, status: %v", httpReqCounter, resp.StatusCode)
+	c.logger().Debug().Msgf("Received HTTP response %v, status: %v", httpReqCounter, resp.StatusCode)
 	return resp, nil
 }
 
 // DecodeHTTPResponseBody checks status code, reads an http.Response's Body and decodes it into the provided interface.
+// HTTPStatusError is returned by DecodeHTTPResponseBody when the server responds with a non-2xx status code.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	// Body is the start of the response body
+	Body string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("Unexpected status code: %d %s (body: %q)", e.StatusCode, e.Status, e.Body)
+}
+
 func DecodeHTTPResponseBody(out interface{}, resp *http.Response) error {
 	defer resp.Body.Close()
 
 	// Check if status code indicates success
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		// Read the whole body and log it
+		// Read the start of the body and include it in the error
 		buf := new(bytes.Buffer)
-		buf.ReadFrom(resp.Body)
-		body := buf.String()
-		log.Debug().Msgf("Response body: %v", body)
-		return fmt.Errorf("Unexpected status code: %d %s", resp.StatusCode, resp.Status)
+		buf.ReadFrom(io.LimitReader(resp.Body, 1024))
+		return &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: buf.String()}
 	}
 
 	decoder := json.NewDecoder(resp.Body)
@@ -182,37 +160,35 @@ func DecodeHTTPResponseBody(out interface{}, resp *http.Response) error {
 }
 
 // Download an attachment from the CDN
-func GetAttachment(path string, cdnNumber uint32, opt *HTTPReqOpt) (*http.Response, error) {
+func (c *Client) GetAttachment(path string, cdnNumber uint32, opt *HTTPReqOpt) (*http.Response, error) {
 	if opt == nil {
 		opt = &HTTPReqOpt{}
 	}
-	if opt.Host == "" {
-		if cdnNumber == 0 {
-			// This is basically a fallback if cdnNumber is not set
-			// but it also seems to be the right host if cdnNumber == 0
-			opt.Host = CDNHosts[0]
-		} else if cdnNumber > 0 && int(cdnNumber) <= len(CDNHosts) {
-			// Pull CDN hosts from array (cdnNumber is 1-indexed, but we have a placeholder host at index 0)
-			// (the 1-indexed is just an assumption, other clients seem to only explicitly handle cdnNumber == 0 and 2)
-			opt.Host = CDNHosts[cdnNumber]
-		} else {
-			opt.Host = CDNHosts[0]
-			log.Warn().Msgf("Invalid CDN index %v, using %s", cdnNumber, opt.Host)
-		}
+	var urlStr string
+	if opt.Host != "" {
+		urlStr = c.urlForHost(opt.Host) + path
+	} else {
+		// cdnNumber 0 is also used as a fallback if the number isn't set
+		urlStr = c.cdnURL(cdnNumber) + path
 	}
-	urlStr := "https://" + opt.Host + path
 	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	//const SERVICE_REFLECTOR_HOST = "europe-west1-signal-cdn-reflector.cloudfunctions.net"
 	//req.Header.Add("Host", SERVICE_REFLECTOR_HOST)
 	req.Header.Add("Content-Type", "application/octet-stream")
 
 	httpReqCounter++
-	zlog.Debug().Msgf("Sending Attachment HTTP request %v, url: %s", httpReqCounter, urlStr)
-	resp, err := signalHTTPClient.Do(req)
-	zlog.Debug().Msgf("Received Attachment HTTP response %v, status: %v", httpReqCounter, resp.StatusCode)
+	c.logger().Debug().Msgf("Sending Attachment HTTP request %v, url: %s", httpReqCounter, urlStr)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	c.logger().Debug().Msgf("Received Attachment HTTP response %v, status: %v", httpReqCounter, resp.StatusCode)
 
-	return resp, err
+	return resp, nil
 }
 
 // Upload an attachment to the CDN
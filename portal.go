@@ -19,14 +19,20 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"io"
+	"net/http"
+	"os"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -52,15 +58,21 @@ import (
 	"go.mau.fi/mautrix-signal/database"
 	"go.mau.fi/mautrix-signal/msgconv/matrixfmt"
 	"go.mau.fi/mautrix-signal/msgconv/signalfmt"
+	"go.mau.fi/mautrix-signal/msgconv/vcard"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 )
 
 type portalSignalMessage struct {
-	message signalmeow.IncomingSignalMessage
+	message IncomingSignalMessage
 	user    *User
 	sender  *Puppet
 	sync    bool
+	// done is closed after the message has been handled, if set
+	done chan struct{}
+	// result receives the error from handling the message, if set
+	result chan error
 }
 
 type portalMatrixMessage struct {
@@ -82,6 +94,15 @@ type Portal struct {
 
 	currentlyTyping     []id.UserID
 	currentlyTypingLock sync.Mutex
+	outgoingTyping      map[id.UserID]*outgoingTyping
+
+	outboxWake      chan struct{}
+	outboxOnce      sync.Once
+	outboxSkipDelay atomic.Bool
+	outboxLive      map[id.EventID]*outboxLiveMessage
+	outboxLock      sync.Mutex
+	// outboxSendLock is held while a queued message is being sent, so it can't be cancelled halfway
+	outboxSendLock sync.Mutex
 
 	latestReadTimestamp uint64 // Cache the latest read timestamp to avoid unnecessary read receipts
 
@@ -275,15 +296,21 @@ func (portal *Portal) messageLoop() {
 		case msg := <-portal.matrixMessages:
 			portal.handleMatrixMessages(msg)
 		case msg := <-portal.signalMessages:
-			portal.handleSignalMessages(msg)
+			err := portal.handleSignalMessages(msg)
+			if msg.result != nil {
+				msg.result <- err
+			}
+			if msg.done != nil {
+				close(msg.done)
+			}
 		}
 	}
 }
 
 func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
-	// If we have no SignalDevice, the bridge isn't logged in properly,
+	// If we have no Signal client, the bridge isn't logged in properly,
 	// so send BAD_CREDENTIALS so the user knows
-	if !msg.user.SignalDevice.IsDeviceLoggedIn() && !portal.HasRelaybot() {
+	if !msg.user.Client.IsDeviceLoggedIn() && !portal.HasRelaybot() {
 		go portal.sendMessageMetrics(msg.evt, errUserNotLoggedIn, "Ignoring", nil)
 		msg.user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBadCredentials, Message: "You have been logged out of Signal, please reconnect"})
 		return
@@ -360,34 +387,74 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 		return
 	}
 
-	timestamp := *msg.DataMessage.Timestamp
-	if timestamp == 0 {
-		timestamp = uint64(start.UnixMilli())
-	}
 	timings.convert = time.Since(start)
-	start = time.Now()
 
+	// Images are queued separately and merged into an album by the outbox when they're sent
+	albumPending := portal.bridge.Config.Bridge.CoalesceAlbums && sender.IsLoggedIn() && isAlbumCandidate(evt)
+	portal.queueConvertedMessage(ctx, msg, evt, &ms, start, albumPending)
+}
+
+// queueConvertedMessage queues a message converted from the given Matrix event to be sent to Signal.
+func (portal *Portal) queueConvertedMessage(ctx context.Context, msg *signalmeow.SignalContent, evt *event.Event, ms *metricSender, start time.Time, albumPending bool) {
+	if msg.DataMessage.GetTimestamp() == 0 {
+		msg.DataMessage.Timestamp = proto.Uint64(uint64(start.UnixMilli()))
+	}
 	// If the portal has disappearing messages enabled, set the expiration time
 	if portal.ExpirationTime > 0 {
 		signalmeow.AddExpiryToDataMessage(msg, uint32(portal.ExpirationTime))
 	}
-	if !sender.IsLoggedIn() {
-		sender = portal.GetRelayUser()
+	// The message is sent by the outbox loop, which retries if Signal can't be reached
+	err := portal.queueOutgoingMessage(ctx, msg, evt, ms, albumPending)
+	if err != nil {
+		go ms.sendMessageMetrics(evt, err, "Error queuing", true)
 	}
-	err = portal.sendSignalMessage(ctx, msg, sender, evt.ID)
+}
+
+const albumCoalesceWindow = 2 * time.Second
+const maxAlbumSize = 32
 
-	timings.totalSend = time.Since(start)
-	go ms.sendMessageMetrics(evt, err, "Error sending", true)
-	if err == nil {
-		portal.storeMessageInDB(ctx, evt.ID, sender.SignalID, timestamp, 0)
-		if portal.ExpirationTime > 0 {
-			portal.addDisappearingMessage(ctx, evt.ID, int64(portal.ExpirationTime), true)
+// isAlbumCandidate checks if a Matrix event is a plain image that can be merged into a Signal album.
+// Images with captions or replies are always sent on their own.
+func isAlbumCandidate(evt *event.Event) bool {
+	if evt.Type != event.EventMessage {
+		return false
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || content.MsgType != event.MsgImage || content.RelatesTo != nil {
+		return false
+	}
+	hasCaption := content.FileName != "" && (content.Body != content.FileName || content.Format == event.FormatHTML)
+	return !hasCaption
+}
+
+// redactOtherAlbumParts redacts the Matrix events of a Signal message other than the one the user redacted.
+func (portal *Portal) redactOtherAlbumParts(ctx context.Context, redacted id.EventID, parts []id.EventID) {
+	for _, partID := range parts {
+		if partID == redacted {
+			continue
+		}
+		_, err := portal.MainIntent().RedactEvent(portal.MXID, partID, mautrix.ReqRedact{
+			Reason: "Other part of Signal message redacted",
+			TxnID:  "mxsg_partredact_" + partID.String(),
+		})
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).
+				Str("part_event_id", partID.String()).
+				Msg("Failed to redact other part of redacted message")
 		}
 	}
 }
 
 func (portal *Portal) handleMatrixRedaction(ctx context.Context, sender *User, evt *event.Event) {
 	log := zerolog.Ctx(ctx)
+	// If the message hasn't been sent yet, just drop it from the outbox
+	if cancelled, err := portal.cancelOutboxMessage(ctx, evt.Redacts); err != nil {
+		log.Err(err).Msg("Failed to check outbox for redaction target")
+	} else if cancelled {
+		log.Debug().Msg("Redacted message was removed from the outbox before it was sent")
+		portal.sendMessageStatusCheckpointSuccess(evt)
+		return
+	}
 	// Find the original signal message based on eventID
 	dbMessage, err := portal.bridge.DB.Message.GetByMXID(ctx, evt.Redacts)
 	if err != nil {
@@ -423,18 +490,17 @@ func (portal *Portal) handleMatrixRedaction(ctx context.Context, sender *User, e
 		} else if otherParts, err := portal.bridge.DB.Message.GetAllPartsBySignalID(ctx, dbMessage.Sender, dbMessage.Timestamp, portal.Receiver); err != nil {
 			log.Err(err).Msg("Failed to get other parts of redacted message from database")
 		} else if len(otherParts) > 0 {
-			// If there are other parts of the message, send a redaction for each of them
+			// Signal messages (including albums) can only be deleted as a whole,
+			// so redact the other parts on Matrix too
+			log.Debug().
+				Int("part_count", len(otherParts)+1).
+				Msg("Redaction target is part of a multi-part Signal message, redacting all parts")
+			otherPartIDs := make([]id.EventID, len(otherParts))
+			for i, otherPart := range otherParts {
+				otherPartIDs[i] = otherPart.MXID
+			}
+			portal.redactOtherAlbumParts(ctx, evt.Redacts, otherPartIDs)
 			for _, otherPart := range otherParts {
-				_, err = portal.MainIntent().RedactEvent(portal.MXID, otherPart.MXID, mautrix.ReqRedact{
-					Reason: "Other part of Signal message redacted",
-					TxnID:  "mxsg_partredact_" + otherPart.MXID.String(),
-				})
-				if err != nil {
-					log.Err(err).
-						Str("part_event_id", otherPart.MXID.String()).
-						Int("part_index", otherPart.PartIndex).
-						Msg("Failed to redact other part of redacted message")
-				}
 				err = otherPart.Delete(ctx)
 				if err != nil {
 					log.Err(err).
@@ -524,7 +590,76 @@ func (portal *Portal) handleMatrixReaction(ctx context.Context, sender *User, ev
 	portal.sendMessageStatusCheckpointSuccess(evt)
 }
 
+func (portal *Portal) checkMatrixMediaSize(size int64) error {
+	if maxSize := portal.bridge.Config.Bridge.MaxMediaSize(); maxSize > 0 && size > maxSize {
+		return fmt.Errorf("%w (%.1f MB, limit is %d MB)", errMediaTooLarge, float64(size)/1024/1024, portal.bridge.Config.Bridge.MaxMediaSizeMB)
+	}
+	return nil
+}
+
+// downloadMatrixMediaToFile downloads and decrypts Matrix media into a temporary file.
+// The caller must close and remove the returned file.
+func (portal *Portal) downloadMatrixMediaToFile(ctx context.Context, content *event.MessageEventContent) (*os.File, int64, error) {
+	if err := portal.checkMatrixMediaSize(int64(content.GetInfo().Size)); err != nil {
+		return nil, 0, err
+	}
+	var file *event.EncryptedFileInfo
+	rawMXC := content.URL
+	if content.File != nil {
+		file = content.File
+		rawMXC = file.URL
+	}
+	mxc, err := rawMXC.Parse()
+	if err != nil {
+		return nil, 0, err
+	}
+	reader, err := portal.MainIntent().DownloadContext(ctx, mxc)
+	if err != nil {
+		return nil, 0, exerrors.NewDualError(errMediaDownloadFailed, err)
+	}
+	if file != nil {
+		reader = file.DecryptStream(reader)
+	}
+	tempFile, err := os.CreateTemp("", "mautrix-signal-media-*")
+	if err != nil {
+		_ = reader.Close()
+		return nil, 0, err
+	}
+	cleanup := func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}
+	var limitedReader io.Reader = reader
+	if maxSize := portal.bridge.Config.Bridge.MaxMediaSize(); maxSize > 0 {
+		// Read one byte more than the limit to find out if the file is too large
+		limitedReader = io.LimitReader(reader, maxSize+1)
+	}
+	size, err := io.Copy(tempFile, limitedReader)
+	if err != nil {
+		_ = reader.Close()
+		cleanup()
+		return nil, 0, exerrors.NewDualError(errMediaDownloadFailed, err)
+	}
+	// Closing the decrypting reader verifies the hash
+	if err = reader.Close(); err != nil && file != nil {
+		cleanup()
+		return nil, 0, exerrors.NewDualError(errMediaDecryptFailed, err)
+	}
+	if err = portal.checkMatrixMediaSize(size); err != nil {
+		cleanup()
+		return nil, 0, err
+	}
+	if _, err = tempFile.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, 0, err
+	}
+	return tempFile, size, nil
+}
+
 func (portal *Portal) downloadAndDecryptMatrixMedia(ctx context.Context, content *event.MessageEventContent) ([]byte, error) {
+	if err := portal.checkMatrixMediaSize(int64(content.GetInfo().Size)); err != nil {
+		return nil, err
+	}
 	var file *event.EncryptedFileInfo
 	rawMXC := content.URL
 	if content.File != nil {
@@ -735,7 +870,7 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 		if err != nil {
 			return nil, err
 		}
-		attachmentPointer, err := signalmeow.UploadAttachment(sender.SignalDevice, convertedImage, newMimeType, fileName)
+		attachmentPointer, err := sender.Client.UploadAttachment(ctx, convertedImage, newMimeType, fileName)
 		if err != nil {
 			return nil, err
 		}
@@ -757,7 +892,7 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 		if err != nil {
 			return nil, err
 		}
-		attachmentPointer, err := signalmeow.UploadAttachment(sender.SignalDevice, convertedSticker, newMimeType, content.FileName)
+		attachmentPointer, err := sender.Client.UploadAttachment(ctx, convertedSticker, newMimeType, content.FileName)
 		if err != nil {
 			return nil, err
 		}
@@ -795,7 +930,7 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 		if err != nil {
 			return nil, err
 		}
-		attachmentPointer, err := signalmeow.UploadAttachment(sender.SignalDevice, convertedVideo, newMimeType, fileName)
+		attachmentPointer, err := sender.Client.UploadAttachment(ctx, convertedVideo, newMimeType, fileName)
 		if err != nil {
 			return nil, err
 		}
@@ -823,7 +958,7 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			mime = "audio/aac"
 			fileName += ".m4a"
 		}
-		attachmentPointer, err := signalmeow.UploadAttachment(sender.SignalDevice, data, mime, fileName)
+		attachmentPointer, err := sender.Client.UploadAttachment(ctx, data, mime, fileName)
 		if err != nil {
 			return nil, err
 		}
@@ -833,6 +968,17 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 		outgoingMessage = signalmeow.DataMessageForAttachment(attachmentPointer, caption, ranges)
 
 	case event.MsgFile:
+		if isVCard(content) {
+			var err error
+			outgoingMessage, err = portal.convertMatrixContactCard(ctx, sender, content)
+			if err == nil {
+				break
+			} else if !errors.Is(err, errInvalidVCard) {
+				return nil, err
+			}
+			// Files that only look like contact cards are still worth sending
+			zerolog.Ctx(ctx).Debug().Err(err).Msg("Sending vCard as a normal file")
+		}
 		fileName := content.Body
 		var caption string
 		var ranges []*signalpb.BodyRange
@@ -840,18 +986,27 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			fileName = content.FileName
 			caption, ranges = matrixfmt.Parse(matrixFormatParams, content)
 		}
-		file, err := portal.downloadAndDecryptMatrixMedia(ctx, content)
+		file, size, err := portal.downloadMatrixMediaToFile(ctx, content)
 		if err != nil {
 			return nil, err
 		}
-		attachmentPointer, err := signalmeow.UploadAttachment(sender.SignalDevice, file, content.GetInfo().MimeType, fileName)
+		defer func() {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}()
+		attachmentPointer, err := sender.Client.UploadAttachmentStream(ctx, file, size, content.GetInfo().MimeType, fileName)
 		if err != nil {
 			return nil, err
 		}
 		outgoingMessage = signalmeow.DataMessageForAttachment(attachmentPointer, caption, ranges)
 
 	case event.MsgLocation:
-		fallthrough
+		var err error
+		outgoingMessage, err = portal.convertMatrixLocation(ctx, sender, content)
+		if err != nil {
+			return nil, err
+		}
+
 	default:
 		return nil, fmt.Errorf("%w %q", errUnknownMsgType, content.MsgType)
 	}
@@ -875,15 +1030,56 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 	return outgoingMessage, nil
 }
 
+func isVCard(content *event.MessageEventContent) bool {
+	mimeType := strings.ToLower(content.GetInfo().MimeType)
+	if mimeType == "text/vcard" || mimeType == "text/x-vcard" || mimeType == "text/directory" {
+		return true
+	}
+	fileName := content.FileName
+	if fileName == "" {
+		fileName = content.Body
+	}
+	return strings.HasSuffix(strings.ToLower(fileName), ".vcf")
+}
+
+func (portal *Portal) convertMatrixContactCard(ctx context.Context, sender *User, content *event.MessageEventContent) (*signalmeow.SignalContent, error) {
+	data, err := portal.downloadAndDecryptMatrixMedia(ctx, content)
+	if err != nil {
+		return nil, err
+	}
+	contact, avatar, err := vcard.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidVCard, err)
+	}
+	if avatar != nil {
+		avatarPointer, err := sender.Client.UploadAttachment(ctx, avatar.Data, avatar.MimeType, "avatar")
+		if err != nil {
+			return nil, err
+		}
+		contact.Avatar = &signalpb.DataMessage_Contact_Avatar{
+			Avatar:    (*signalpb.AttachmentPointer)(avatarPointer),
+			IsProfile: proto.Bool(false),
+		}
+	}
+	return signalmeow.DataMessageForContact(contact), nil
+}
+
 func (portal *Portal) sendSignalMessage(ctx context.Context, msg *signalmeow.SignalContent, sender *User, evtID id.EventID) error {
+	_, err := portal.sendSignalMessageTo(ctx, msg, sender, evtID, nil)
+	return err
+}
+
+// sendSignalMessageTo sends a message to Signal. In groups, it's only sent to the members in onlyTo if it's non-nil.
+// A group message counts as sent if it reached at least one member, the members that it should be sent to again
+// because of a retryable error are returned.
+func (portal *Portal) sendSignalMessageTo(ctx context.Context, msg *signalmeow.SignalContent, sender *User, evtID id.EventID, onlyTo []string) (retry []signalmeow.FailedSendResult, err error) {
 	recipientSignalID := portal.ChatID
 	portal.log.Debug().Msgf("Sending event %s to Signal %s", evtID, recipientSignalID)
 
 	// Check to see if recipientSignalID is a standard UUID (with dashes)
-	var err error
 	if _, uuidErr := uuid.Parse(recipientSignalID); uuidErr == nil {
 		// this is a 1:1 chat
-		result := signalmeow.SendMessage(ctx, sender.SignalDevice, recipientSignalID, msg)
+		result := sender.Client.SendMessage(ctx, recipientSignalID, msg)
 		if !result.WasSuccessful {
 			err = result.FailedSendResult.Error
 			portal.log.Error().Msgf("Error sending event %s to Signal %s: %s", evtID, recipientSignalID, err)
@@ -891,19 +1087,29 @@ func (portal *Portal) sendSignalMessage(ctx context.Context, msg *signalmeow.Sig
 	} else {
 		// this is a group chat
 		groupID := signalmeow.GroupIdentifier(recipientSignalID)
-		result, err := signalmeow.SendGroupMessage(ctx, sender.SignalDevice, groupID, msg)
+		var result *signalmeow.GroupMessageSendResult
+		if onlyTo != nil {
+			result, err = sender.Client.SendGroupMessageToMembers(ctx, groupID, msg, onlyTo)
+		} else {
+			result, err = sender.Client.SendGroupMessage(ctx, groupID, msg)
+		}
 		if err != nil {
 			// check the start of the error string, see if it starts with "No group master key found for group identifier"
 			if strings.HasPrefix(err.Error(), "No group master key found for group identifier") {
 				portal.MainIntent().SendNotice(portal.MXID, "Missing group encryption key. Please ask a group member to send a message in this chat, then retry sending.")
 			}
 			portal.log.Error().Msgf("Error sending event %s to Signal group %s: %s", evtID, recipientSignalID, err)
-			return err
+			return nil, err
 		}
 		totalRecipients := len(result.FailedToSendTo) + len(result.SuccessfullySentTo)
 		if len(result.FailedToSendTo) > 0 {
 			portal.log.Error().Msgf("Failed to send event %s to %d of %d members of Signal group %s", evtID, len(result.FailedToSendTo), totalRecipients, recipientSignalID)
 		}
+		for _, failed := range result.FailedToSendTo {
+			if signalmeow.IsRetryableSendError(failed.Error) {
+				retry = append(retry, failed)
+			}
+		}
 		if len(result.SuccessfullySentTo) == 0 && len(result.FailedToSendTo) == 0 {
 			portal.log.Debug().Msgf("No successes or failures - Probably sent to myself")
 		} else if len(result.SuccessfullySentTo) == 0 {
@@ -915,7 +1121,10 @@ func (portal *Portal) sendSignalMessage(ctx context.Context, msg *signalmeow.Sig
 			portal.log.Debug().Msgf("Sent event %s to all %d members of Signal group %s", evtID, totalRecipients, recipientSignalID)
 		}
 	}
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return retry, nil
 }
 
 func (portal *Portal) sendMessageStatusCheckpointSuccess(evt *event.Event) {
@@ -935,7 +1144,9 @@ func (portal *Portal) sendMessageStatusCheckpointFailed(evt *event.Event, err er
 	portal.sendStatusEvent(evt.ID, "", err, nil)
 }
 
-func (portal *Portal) handleSignalMessages(portalMessage portalSignalMessage) {
+// handleSignalMessages bridges a message to Matrix. Errors are returned if the message itself couldn't be bridged,
+// so that it can be retried, while failures of less important things like typing notifications are only logged.
+func (portal *Portal) handleSignalMessages(portalMessage portalSignalMessage) error {
 	log := portal.log.With().
 		Str("action", "handle signal message").
 		Str("sender", portalMessage.sender.SignalID.String()).
@@ -951,80 +1162,83 @@ func (portal *Portal) handleSignalMessages(portalMessage portalSignalMessage) {
 		portal.Receiver,
 	); err != nil {
 		log.Err(err).Msg("Failed to check if message was already handled")
-		return
+		return err
 	} else if existingMessage != nil {
 		log.Debug().Msg("Ignoring duplicate message")
-		return
+		return nil
 	}
 	if portal.MXID == "" {
 		log.Debug().Msg("Creating Matrix room from incoming message")
 		if err := portal.CreateMatrixRoom(portalMessage.user, nil); err != nil {
 			log.Error().Err(err).Msg("Failed to create portal room")
-			return
+			return err
 		}
 		ensureGroupPuppetsAreJoinedToPortal(context.Background(), portalMessage.user, portal)
-		signalmeow.SendContactSyncRequest(context.TODO(), portalMessage.user.SignalDevice)
+		portalMessage.user.Client.SendContactSyncRequest(context.TODO())
 	}
 
 	intent := portalMessage.sender.IntentFor(portal)
 	if intent == nil {
 		portal.log.Error().Msg("Failed to get message intent")
-		return
+		return fmt.Errorf("failed to get message intent")
 	}
 
 	var err error
-	if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeText {
+	if portalMessage.message.MessageType() == IncomingSignalMessageTypeText {
 		err = portal.handleSignalTextMessage(ctx, portalMessage, intent)
 		if err != nil {
 			portal.log.Error().Err(err).Msg("Failed to handle text message")
-			return
+			return err
 		}
-	} else if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeAttachment {
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeAttachment {
 		err = portal.handleSignalAttachmentMessage(ctx, portalMessage, intent)
 		if err != nil {
 			portal.log.Error().Err(err).Msg("Failed to handle attachment message")
-			return
+			return err
 		}
-	} else if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeReaction {
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeReaction {
 		portal.handleSignalReactionMessage(ctx, portalMessage, intent)
-	} else if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeDelete {
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeDelete {
 		portal.handleSignalDeleteMessage(ctx, portalMessage, intent)
-	} else if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeSticker {
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeSticker {
 		err := portal.handleSignalStickerMessage(ctx, portalMessage, intent)
 		if err != nil {
 			portal.log.Error().Err(err).Msg("Failed to handle sticker message")
-			return
+			return err
 		}
-	} else if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeTyping {
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeTyping {
 		err := portal.handleSignalTypingMessage(portalMessage, intent)
 		if err != nil {
 			portal.log.Error().Err(err).Msg("Failed to handle typing message")
-			return
 		}
-	} else if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeReceipt {
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeReceipt {
 		portal.handleSignalReceiptMessage(ctx, portalMessage, intent)
-	} else if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeCall {
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeCall {
 		err := portal.handleSignalCallMessage(portalMessage, intent)
 		if err != nil {
 			portal.log.Error().Err(err).Msg("Failed to handle call message")
-			return
 		}
-	} else if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeContactCard {
-		err := portal.handleSignalContactCardMessage(portalMessage, intent)
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeGroupChange {
+		err := portal.handleSignalGroupChange(ctx, portalMessage, intent)
+		if err != nil {
+			portal.log.Error().Err(err).Msg("Failed to handle group change")
+			return err
+		}
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeContactCard {
+		err := portal.handleSignalContactCardMessage(ctx, portalMessage, intent)
 		if err != nil {
 			portal.log.Error().Err(err).Msg("Failed to handle contact card message")
-			return
+			return err
 		}
-	} else if portalMessage.message.MessageType() == signalmeow.IncomingSignalMessageTypeUnhandled {
+	} else if portalMessage.message.MessageType() == IncomingSignalMessageTypeUnhandled {
 		err := portal.handleSignalUnhandledMessage(portalMessage, intent)
 		if err != nil {
 			portal.log.Error().Err(err).Msg("Failed to handle unhandled message")
-			return
 		}
 	} else {
 		portal.log.Warn().Msgf("Unknown message type: %v", portalMessage.message.MessageType())
-		return
 	}
+	return nil
 }
 
 func (portal *Portal) storeMessageInDB(ctx context.Context, eventID id.EventID, senderSignalID uuid.UUID, timestamp uint64, partIndex int) {
@@ -1065,7 +1279,20 @@ func (portal *Portal) storeReactionInDB(
 	}
 }
 
-func (portal *Portal) addSignalQuote(ctx context.Context, content *event.MessageEventContent, quote *signalmeow.IncomingSignalMessageQuoteData) {
+// getAlbumFirstPartMXID returns the Matrix event ID of the first part of a Signal album.
+func (portal *Portal) getAlbumFirstPartMXID(ctx context.Context, sender uuid.UUID, timestamp uint64) id.EventID {
+	firstPart, err := portal.bridge.DB.Message.GetBySignalID(ctx, sender, timestamp, 0, portal.Receiver)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Uint64("album_timestamp", timestamp).Msg("Failed to get first album part from database")
+		return ""
+	} else if firstPart == nil {
+		zerolog.Ctx(ctx).Warn().Uint64("album_timestamp", timestamp).Msg("First album part not found")
+		return ""
+	}
+	return firstPart.MXID
+}
+
+func (portal *Portal) addSignalQuote(ctx context.Context, content *event.MessageEventContent, quote *IncomingSignalMessageQuoteData) {
 	if quote == nil {
 		return
 	}
@@ -1098,8 +1325,17 @@ func (portal *Portal) addSignalQuote(ctx context.Context, content *event.Message
 	}
 }
 
-func (portal *Portal) addDisappearingMessage(ctx context.Context, eventID id.EventID, expireInSeconds int64, startTimerNow bool) {
-	portal.bridge.disappearingMessagesManager.AddDisappearingMessage(ctx, eventID, portal.MXID, time.Duration(expireInSeconds)*time.Second, startTimerNow)
+func (portal *Portal) addDisappearingMessage(ctx context.Context, eventID id.EventID, expireInSeconds int64, expireStart time.Time) {
+	portal.bridge.disappearingMessagesManager.AddDisappearingMessage(ctx, eventID, portal.MXID, time.Duration(expireInSeconds)*time.Second, expireStart)
+}
+
+// expirationStart returns when the disappearing timer of the message starts. Messages sent from our other devices
+// start immediately, while timers of incoming messages are only started once they're read.
+func (msg *portalSignalMessage) expirationStart() time.Time {
+	if !msg.sync {
+		return time.Time{}
+	}
+	return time.UnixMilli(int64(msg.message.Base().Timestamp))
 }
 
 var signalFormatParams *signalfmt.FormatParams
@@ -1107,8 +1343,22 @@ var matrixFormatParams *matrixfmt.HTMLParser
 
 func (portal *Portal) handleSignalTextMessage(ctx context.Context, portalMessage portalSignalMessage, intent *appservice.IntentAPI) error {
 	timestamp := portalMessage.message.Base().Timestamp
-	msg := (portalMessage.message).(signalmeow.IncomingSignalMessageText)
-	content := signalfmt.Parse(msg.Content, msg.ContentRanges, signalFormatParams)
+	msg := (portalMessage.message).(IncomingSignalMessageText)
+	var content *event.MessageEventContent
+	if description, lat, long, ok := parseSignalLocation(msg.Content, msg.ContentRanges); ok {
+		body := description
+		if body == "" {
+			body = fmt.Sprintf("Location: %s, %s", formatCoordinate(lat), formatCoordinate(long))
+		}
+		content = &event.MessageEventContent{
+			MsgType:  event.MsgLocation,
+			Body:     body,
+			GeoURI:   formatGeoURI(lat, long),
+			Mentions: &event.Mentions{},
+		}
+	} else {
+		content = signalfmt.Parse(msg.Content, msg.ContentRanges, signalFormatParams)
+	}
 	portal.addSignalQuote(ctx, content, msg.Quote)
 	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, content, nil, int64(timestamp))
 	if err != nil {
@@ -1118,13 +1368,13 @@ func (portal *Portal) handleSignalTextMessage(ctx context.Context, portalMessage
 		return errors.New("Didn't receive event ID from Matrix")
 	}
 	portal.storeMessageInDB(ctx, resp.EventID, portalMessage.sender.SignalID, timestamp, portalMessage.message.Base().PartIndex)
-	portal.addDisappearingMessage(ctx, resp.EventID, portalMessage.message.Base().ExpiresIn, portalMessage.sync)
+	portal.addDisappearingMessage(ctx, resp.EventID, portalMessage.message.Base().ExpiresIn, portalMessage.expirationStart())
 	return err
 }
 
 func (portal *Portal) handleSignalStickerMessage(ctx context.Context, portalMessage portalSignalMessage, intent *appservice.IntentAPI) error {
 	timestamp := portalMessage.message.Base().Timestamp
-	msg := (portalMessage.message).(signalmeow.IncomingSignalMessageSticker)
+	msg := (portalMessage.message).(IncomingSignalMessageSticker)
 	content := &event.MessageEventContent{
 		MsgType:  event.MessageType(event.EventSticker.Type),
 		Body:     msg.Emoji,
@@ -1151,12 +1401,12 @@ func (portal *Portal) handleSignalStickerMessage(ctx context.Context, portalMess
 		return errors.New("Didn't receive event ID from Matrix")
 	}
 	portal.storeMessageInDB(ctx, resp.EventID, portalMessage.sender.SignalID, timestamp, portalMessage.message.Base().PartIndex)
-	portal.addDisappearingMessage(ctx, resp.EventID, portalMessage.message.Base().ExpiresIn, portalMessage.sync)
+	portal.addDisappearingMessage(ctx, resp.EventID, portalMessage.message.Base().ExpiresIn, portalMessage.expirationStart())
 	return err
 }
 
 func (portal *Portal) handleSignalCallMessage(portalMessage portalSignalMessage, intent *appservice.IntentAPI) error {
-	callMessage := (portalMessage.message).(signalmeow.IncomingSignalMessageCall)
+	callMessage := (portalMessage.message).(IncomingSignalMessageCall)
 	var message string
 	if callMessage.IsRinging {
 		message = "Incoming Call"
@@ -1167,8 +1417,8 @@ func (portal *Portal) handleSignalCallMessage(portalMessage portalSignalMessage,
 	return nil
 }
 
-func (portal *Portal) handleSignalContactCardMessage(portalMessage portalSignalMessage, intent *appservice.IntentAPI) error {
-	contactCardMessage := (portalMessage.message).(signalmeow.IncomingSignalMessageContactCard)
+func (portal *Portal) handleSignalContactCardMessage(ctx context.Context, portalMessage portalSignalMessage, intent *appservice.IntentAPI) error {
+	contactCardMessage := (portalMessage.message).(IncomingSignalMessageContactCard)
 	messageParts := []string{}
 	messageParts = append(messageParts, contactCardMessage.DisplayName)
 	messageParts = append(messageParts, contactCardMessage.Organization)
@@ -1187,11 +1437,46 @@ func (portal *Portal) handleSignalContactCardMessage(portalMessage portalSignalM
 	message := strings.Join(messageParts, "\n")
 	intent.SendNotice(portal.MXID, message)
 
+	if contactCardMessage.Contact == nil {
+		return nil
+	}
+	// Also send the card as a vCard file, so that Matrix clients can import it
+	var avatar *vcard.Avatar
+	if len(contactCardMessage.Avatar) > 0 {
+		avatar = &vcard.Avatar{Data: contactCardMessage.Avatar, MimeType: contactCardMessage.AvatarContentType}
+	}
+	vcf := vcard.Format(contactCardMessage.Contact, avatar)
+	fileName := contactCardMessage.DisplayName
+	if fileName == "" {
+		fileName = "contact"
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgFile,
+		Body:    fileName + ".vcf",
+		Info: &event.FileInfo{
+			MimeType: "text/vcard",
+		},
+		Mentions: &event.Mentions{},
+	}
+	err := portal.uploadMediaToMatrix(intent, vcf, content)
+	if err != nil {
+		return fmt.Errorf("failed to upload vCard: %w", err)
+	}
+	timestamp := portalMessage.message.Base().Timestamp
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, content, nil, int64(timestamp))
+	if err != nil {
+		return err
+	}
+	if resp.EventID == "" {
+		return errors.New("Didn't receive event ID from Matrix")
+	}
+	portal.storeMessageInDB(ctx, resp.EventID, portalMessage.sender.SignalID, timestamp, portalMessage.message.Base().PartIndex)
+	portal.addDisappearingMessage(ctx, resp.EventID, portalMessage.message.Base().ExpiresIn, portalMessage.expirationStart())
 	return nil
 }
 
 func (portal *Portal) handleSignalUnhandledMessage(portalMessage portalSignalMessage, intent *appservice.IntentAPI) error {
-	unhandledMessage := (portalMessage.message).(signalmeow.IncomingSignalMessageUnhandled)
+	unhandledMessage := (portalMessage.message).(IncomingSignalMessageUnhandled)
 	portal.log.Warn().Msgf("Received unhandled message type %s, notice: %s", unhandledMessage.Type, unhandledMessage.Notice)
 	notice := unhandledMessage.Notice
 	portalMessage.sender.DefaultIntent().SendNotice(portal.MXID, notice)
@@ -1199,7 +1484,7 @@ func (portal *Portal) handleSignalUnhandledMessage(portalMessage portalSignalMes
 }
 
 func (portal *Portal) handleSignalReceiptMessage(ctx context.Context, portalMessage portalSignalMessage, intent *appservice.IntentAPI) {
-	receiptMessage := (portalMessage.message).(signalmeow.IncomingSignalMessageReceipt)
+	receiptMessage := (portalMessage.message).(IncomingSignalMessageReceipt)
 	log := zerolog.Ctx(ctx)
 	messageSender, err := uuid.Parse(receiptMessage.OriginalSender)
 	// TODO handle err
@@ -1213,7 +1498,7 @@ func (portal *Portal) handleSignalReceiptMessage(ctx context.Context, portalMess
 		return
 	}
 
-	if receiptMessage.ReceiptType == signalmeow.IncomingSignalMessageReceiptTypeRead {
+	if receiptMessage.ReceiptType == IncomingSignalMessageReceiptTypeRead {
 		log.Debug().Msg("Received read receipt")
 
 		// Don't process read receipts for messages older than the latest one we've seen
@@ -1223,15 +1508,18 @@ func (portal *Portal) handleSignalReceiptMessage(ctx context.Context, portalMess
 		}
 		portal.latestReadTimestamp = receiptMessage.OriginalTimestamp
 
+		if receiptMessage.SenderUUID == portalMessage.user.SignalID.String() {
+			// We read the chat on another device, so start the timers like the other device did
+			portal.bridge.disappearingMessagesManager.StartTimersForRead(ctx, portal.MXID, receiptMessage.OriginalTimestamp, time.UnixMilli(int64(receiptMessage.Timestamp)))
+		}
+
 		log.Debug().Msgf("Marking message %s as read", lastPart.MXID)
 		err := portal.SetReadMarkers(lastPart, portalMessage.sender)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed to set read markers for message %s", lastPart.MXID)
 			return
 		}
-		// TODO only schedule disappearing when user reads from other device
-		portal.ScheduleDisappearing()
-	} else if receiptMessage.ReceiptType == signalmeow.IncomingSignalMessageReceiptTypeDelivery {
+	} else if receiptMessage.ReceiptType == IncomingSignalMessageReceiptTypeDelivery {
 		log.Debug().Msg("Received delivery receipt")
 		// Only send delivery MSS for DMs, not groups
 		if portal.IsPrivateChat() {
@@ -1281,8 +1569,255 @@ func (portal *Portal) SetReadMarkers(dbMessage *database.Message, sender *Puppet
 
 const SignalTypingTimeout = 15 * time.Second
 
+// handleSignalGroupChange bridges a single revision from the group change log,
+// using the puppet of the user who made the change where possible.
+func (portal *Portal) handleSignalGroupChange(ctx context.Context, portalMessage portalSignalMessage, intent *appservice.IntentAPI) error {
+	change := portalMessage.message.(*IncomingSignalMessageGroupChange).Change
+	if change == nil {
+		return nil
+	}
+	log := zerolog.Ctx(ctx).With().Uint32("revision", change.Revision).Logger()
+	if int(change.Revision) <= portal.Revision {
+		log.Debug().Int("portal_revision", portal.Revision).Msg("Ignoring group change that was already bridged")
+		return nil
+	}
+
+	if change.NewTitle != nil && portal.Name != *change.NewTitle {
+		portal.Name = *change.NewTitle
+		err := portal.withIntentFallback(intent, func(intent *appservice.IntentAPI) error {
+			_, err := intent.SetRoomName(portal.MXID, portal.Name)
+			return err
+		})
+		if err != nil {
+			log.Err(err).Msg("Failed to set room name")
+		}
+		portal.NameSet = err == nil
+	}
+	if change.NewDescription != nil && portal.Topic != *change.NewDescription {
+		portal.Topic = *change.NewDescription
+		err := portal.withIntentFallback(intent, func(intent *appservice.IntentAPI) error {
+			_, err := intent.SetRoomTopic(portal.MXID, portal.Topic)
+			return err
+		})
+		if err != nil {
+			log.Err(err).Msg("Failed to set room topic")
+		}
+	}
+	if change.NewAvatarPath != nil {
+		portal.updateAvatarFromGroupChange(ctx, portalMessage.user, intent, *change.NewAvatarPath)
+	}
+	if change.NewDisappearingTimer != nil && portal.ExpirationTime != int(*change.NewDisappearingTimer) {
+		portal.ExpirationTime = int(*change.NewDisappearingTimer)
+		portal.HandleNewDisappearingMessageTime(*change.NewDisappearingTimer)
+	}
+
+	for _, memberID := range change.AddedMembers {
+		if memberID == portalMessage.user.SignalID {
+			portal.ensureUserInvited(portalMessage.user)
+			continue
+		}
+		memberPuppet := portal.bridge.GetPuppetBySignalID(memberID)
+		if memberPuppet == nil {
+			continue
+		}
+		_ = updatePuppetWithSignalContact(ctx, portalMessage.user, memberPuppet, nil)
+		if err := memberPuppet.DefaultIntent().EnsureJoined(portal.MXID); err != nil {
+			log.Err(err).Stringer("member", memberID).Msg("Failed to join added member")
+		}
+	}
+	for _, memberID := range change.RemovedMembers {
+		var memberMXID id.UserID
+		if memberID == portalMessage.user.SignalID {
+			memberMXID = portalMessage.user.MXID
+		} else if memberPuppet := portal.bridge.GetPuppetBySignalID(memberID); memberPuppet != nil {
+			memberMXID = memberPuppet.MXID
+			if memberPuppet == portalMessage.sender {
+				// The member left the group by themselves
+				if _, err := memberPuppet.DefaultIntent().LeaveRoom(portal.MXID); err != nil {
+					log.Err(err).Stringer("member", memberID).Msg("Failed to leave room for removed member")
+				}
+				continue
+			}
+		} else {
+			continue
+		}
+		err := portal.withIntentFallback(intent, func(intent *appservice.IntentAPI) error {
+			_, err := intent.KickUser(portal.MXID, &mautrix.ReqKickUser{UserID: memberMXID})
+			return err
+		})
+		if err != nil {
+			log.Err(err).Stringer("member", memberID).Msg("Failed to remove member")
+		}
+	}
+
+	portal.updatePowerLevelsFromGroupChange(log.WithContext(ctx), portalMessage.user, change)
+	portal.sendGroupAccessNotices(log.WithContext(ctx), change)
+
+	portal.Revision = int(change.Revision)
+	if err := portal.Update(ctx); err != nil {
+		log.Err(err).Msg("Failed to update portal after group change")
+		return err
+	}
+	portal.UpdateBridgeInfo()
+	return nil
+}
+
+// The power level that Signal group admins get in the Matrix room
+const groupAdminPowerLevel = 50
+
+func groupAccessPowerLevel(access signalpb.AccessControl_AccessRequired) int {
+	if access == signalpb.AccessControl_ADMINISTRATOR {
+		return groupAdminPowerLevel
+	}
+	return 0
+}
+
+// updatePowerLevelsFromGroupChange bridges member role changes, announcement-only mode and
+// who can edit the group info to the power levels of the room.
+func (portal *Portal) updatePowerLevelsFromGroupChange(ctx context.Context, user *User, change *events.GroupRevision) {
+	roleChanges := make(map[uuid.UUID]signalpb.Member_Role, len(change.ChangedRoles)+len(change.AddedAdmins))
+	for memberID, role := range change.ChangedRoles {
+		roleChanges[memberID] = role
+	}
+	for _, memberID := range change.AddedAdmins {
+		roleChanges[memberID] = signalpb.Member_ADMINISTRATOR
+	}
+	if len(roleChanges) == 0 && change.NewAnnouncementsOnly == nil && change.NewAttributesAccess == nil {
+		return
+	}
+	log := zerolog.Ctx(ctx)
+	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get power levels to apply group change")
+		return
+	}
+	changed := false
+	for memberID, role := range roleChanges {
+		var memberMXID id.UserID
+		if memberID == user.SignalID {
+			memberMXID = user.MXID
+		} else if memberPuppet := portal.bridge.GetPuppetBySignalID(memberID); memberPuppet != nil {
+			memberMXID = memberPuppet.MXID
+		} else {
+			continue
+		}
+		level := 0
+		if role == signalpb.Member_ADMINISTRATOR {
+			level = groupAdminPowerLevel
+		}
+		changed = levels.EnsureUserLevel(memberMXID, level) || changed
+	}
+	if change.NewAnnouncementsOnly != nil {
+		level := 0
+		if *change.NewAnnouncementsOnly {
+			level = groupAdminPowerLevel
+		}
+		if levels.EventsDefault != level {
+			levels.EventsDefault = level
+			changed = true
+		}
+	}
+	if change.NewAttributesAccess != nil {
+		level := groupAccessPowerLevel(*change.NewAttributesAccess)
+		changed = levels.EnsureEventLevel(event.StateRoomName, level) || changed
+		changed = levels.EnsureEventLevel(event.StateTopic, level) || changed
+		changed = levels.EnsureEventLevel(event.StateRoomAvatar, level) || changed
+		changed = levels.EnsureEventLevel(TypeDisappearingTimer, level) || changed
+	}
+	if !changed {
+		return
+	}
+	_, err = portal.MainIntent().SetPowerLevels(portal.MXID, levels)
+	if err != nil {
+		log.Err(err).Msg("Failed to update power levels from group change")
+	}
+}
+
+func describeGroupAccess(access signalpb.AccessControl_AccessRequired) string {
+	switch access {
+	case signalpb.AccessControl_ANY:
+		return "anyone"
+	case signalpb.AccessControl_MEMBER:
+		return "all members"
+	case signalpb.AccessControl_ADMINISTRATOR:
+		return "only admins"
+	default:
+		return "nobody"
+	}
+}
+
+// sendGroupAccessNotices sends notices about group permission changes that can't be bridged to power levels.
+func (portal *Portal) sendGroupAccessNotices(ctx context.Context, change *events.GroupRevision) {
+	var notices []string
+	if change.NewMemberAccess != nil {
+		notices = append(notices, fmt.Sprintf("Adding members to the group is now allowed for %s", describeGroupAccess(*change.NewMemberAccess)))
+	}
+	if change.NewAddFromInviteLinkAccess != nil {
+		switch *change.NewAddFromInviteLinkAccess {
+		case signalpb.AccessControl_ANY:
+			notices = append(notices, "The group link is now enabled")
+		case signalpb.AccessControl_ADMINISTRATOR:
+			notices = append(notices, "The group link is now enabled, and new members must be approved by an admin")
+		default:
+			notices = append(notices, "The group link is now disabled")
+		}
+	}
+	for _, notice := range notices {
+		_, err := portal.sendMainIntentMessage(&event.MessageEventContent{MsgType: event.MsgNotice, Body: notice})
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to send group access change notice")
+		}
+	}
+}
+
+// updateAvatarFromGroupChange sets the room avatar to a group avatar that was changed in the group change log.
+func (portal *Portal) updateAvatarFromGroupChange(ctx context.Context, user *User, intent *appservice.IntentAPI, avatarPath string) {
+	log := zerolog.Ctx(ctx)
+	if avatarPath == "" {
+		portal.AvatarURL = id.ContentURI{}
+		portal.AvatarHash = ""
+	} else {
+		_, avatarImage, err := user.Client.RetrieveGroupAndAvatarByID(ctx, signalmeow.GroupIdentifier(portal.ChatID))
+		if err != nil {
+			log.Err(err).Msg("Failed to retrieve group avatar")
+			return
+		} else if avatarImage == nil {
+			return
+		}
+		hash := sha256.Sum256(avatarImage)
+		if portal.AvatarHash == hex.EncodeToString(hash[:]) && portal.AvatarSet {
+			return
+		}
+		avatarURL, err := portal.MainIntent().UploadBytes(avatarImage, http.DetectContentType(avatarImage))
+		if err != nil {
+			log.Err(err).Msg("Failed to upload group avatar")
+			return
+		}
+		portal.AvatarURL = avatarURL.ContentURI
+		portal.AvatarHash = hex.EncodeToString(hash[:])
+	}
+	err := portal.withIntentFallback(intent, func(intent *appservice.IntentAPI) error {
+		_, err := intent.SetRoomAvatar(portal.MXID, portal.AvatarURL)
+		return err
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to set room avatar")
+	}
+	portal.AvatarSet = err == nil
+}
+
+// withIntentFallback calls fn with the given intent, and with the portal's main intent
+// if the given one isn't allowed to do it, e.g. because the puppet isn't in the room.
+func (portal *Portal) withIntentFallback(intent *appservice.IntentAPI, fn func(intent *appservice.IntentAPI) error) error {
+	err := fn(intent)
+	if errors.Is(err, mautrix.MForbidden) && intent != portal.MainIntent() {
+		err = fn(portal.MainIntent())
+	}
+	return err
+}
+
 func (portal *Portal) handleSignalTypingMessage(portalMessage portalSignalMessage, intent *appservice.IntentAPI) error {
-	typingMessage := (portalMessage.message).(signalmeow.IncomingSignalMessageTyping)
+	typingMessage := (portalMessage.message).(IncomingSignalMessageTyping)
 	var err error
 	if typingMessage.IsTyping {
 		_, err = intent.UserTyping(portal.MXID, true, SignalTypingTimeout)
@@ -1314,29 +1849,14 @@ OuterPrev:
 	return
 }
 
+// setTyping must be called with currentlyTypingLock held.
 func (portal *Portal) setTyping(userIDs []id.UserID, isTyping bool) {
 	for _, userID := range userIDs {
 		user := portal.bridge.GetUserByMXID(userID)
 		if user == nil || !user.IsLoggedIn() {
 			continue
 		}
-		recipientSignalID := portal.ChatID
-
-		// Check to see if recipientSignalID is a standard UUID (with dashes)
-		// Note: not handling sending to a group right now, since that will
-		// require SenderKey sending to not be terrible
-		var err error
-		if _, uuidErr := uuid.Parse(recipientSignalID); uuidErr == nil {
-			// this is a 1:1 chat
-			portal.log.Debug().Msgf("Sending Typing event to Signal %s", recipientSignalID)
-			ctx := context.Background()
-			typingMessage := signalmeow.TypingMessage(isTyping)
-			result := signalmeow.SendMessage(ctx, user.SignalDevice, recipientSignalID, typingMessage)
-			if !result.WasSuccessful {
-				err = result.FailedSendResult.Error
-				portal.log.Error().Msgf("Error sending event to Signal %s: %s", recipientSignalID, err)
-			}
-		}
+		portal.getOutgoingTyping(user).set(isTyping)
 	}
 }
 
@@ -1358,7 +1878,6 @@ func (portal *Portal) HandleMatrixReadReceipt(sender bridge.User, eventID id.Eve
 		Str("sender", sender.GetMXID().String()).
 		Logger()
 	log.Debug().Msg("Received read receipt")
-	portal.ScheduleDisappearing()
 
 	// Find event in the DB
 	dbMessage, err := portal.bridge.DB.Message.GetByMXID(context.TODO(), eventID)
@@ -1369,6 +1888,7 @@ func (portal *Portal) HandleMatrixReadReceipt(sender bridge.User, eventID id.Eve
 		log.Warn().Msg("Read receipt target message not found")
 		return
 	}
+	portal.bridge.disappearingMessagesManager.StartTimersForRead(log.WithContext(context.TODO()), portal.MXID, dbMessage.Timestamp, receipt.Timestamp)
 	// TODO find all messages that haven't been marked as read by the user
 	msg := signalmeow.ReadReceptMessageForTimestamps([]uint64{dbMessage.Timestamp})
 	receiptDestination := dbMessage.Sender
@@ -1378,7 +1898,7 @@ func (portal *Portal) HandleMatrixReadReceipt(sender bridge.User, eventID id.Eve
 	// who sent the original message, not the portal's ChatID
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	result := signalmeow.SendMessage(ctx, receiptSender.SignalDevice, receiptDestination.String(), msg)
+	result := receiptSender.Client.SendMessage(ctx, receiptDestination.String(), msg)
 	if !result.WasSuccessful {
 		log.Err(result.FailedSendResult.Error).
 			Str("receipt_destination", receiptDestination.String()).
@@ -1390,7 +1910,7 @@ func (portal *Portal) HandleMatrixReadReceipt(sender bridge.User, eventID id.Eve
 
 func (portal *Portal) handleSignalAttachmentMessage(ctx context.Context, portalMessage portalSignalMessage, intent *appservice.IntentAPI) error {
 	timestamp := portalMessage.message.Base().Timestamp
-	msg := (portalMessage.message).(signalmeow.IncomingSignalMessageAttachment)
+	msg := (portalMessage.message).(IncomingSignalMessageAttachment)
 	content := signalfmt.Parse(msg.Caption, msg.CaptionRanges, signalFormatParams)
 	content.Info = &event.FileInfo{
 		MimeType: msg.ContentType,
@@ -1423,9 +1943,57 @@ func (portal *Portal) handleSignalAttachmentMessage(ctx context.Context, portalM
 		portal.log.Debug().Msgf("Received file attachment: %s", msg.ContentType)
 		content.MsgType = event.MsgFile
 	}
-	portal.addSignalQuote(ctx, content, msg.Quote)
-	err := portal.uploadMediaToMatrix(intent, msg.Attachment, content)
-	if err != nil {
+	var extraContent map[string]interface{}
+	partIndex := portalMessage.message.Base().PartIndex
+	if msg.AlbumSize > 1 {
+		albumInfo := map[string]interface{}{
+			"index": msg.AlbumIndex,
+			"size":  msg.AlbumSize,
+		}
+		extraContent = map[string]interface{}{
+			"fi.mau.signal.album": albumInfo,
+		}
+		if partIndex > 0 {
+			// Link the other album parts to the first one instead of repeating the reply
+			if firstPartMXID := portal.getAlbumFirstPartMXID(ctx, portalMessage.sender.SignalID, timestamp); firstPartMXID != "" {
+				albumInfo["first_event_id"] = firstPartMXID
+			}
+		}
+	}
+	if partIndex == 0 || msg.AlbumSize <= 1 {
+		portal.addSignalQuote(ctx, content, msg.Quote)
+	}
+	err := portal.downloadAndUploadSignalAttachment(intent, msg.Attachment, content)
+	var downloadErr error
+	var mediaContent event.MessageEventContent
+	if errors.Is(err, errMediaTooLarge) || errors.Is(err, errMediaDownloadFailed) {
+		portal.log.Err(err).Msg("Failed to bridge attachment")
+		// Local attachments, e.g. from backups, have no CDN pointer that could be downloaded again
+		if isRetryableMediaError(err) && !msg.Attachment.IsLocal() {
+			downloadErr = err
+			mediaContent = *content
+		}
+		// Send a notice in place of the attachment, so that the message isn't silently lost
+		content.MsgType = event.MsgNotice
+		reason := err.Error()
+		if errors.Is(err, signalmeow.ErrInvalidDigestForAttachment) ||
+			errors.Is(err, signalmeow.ErrInvalidMACForAttachment) ||
+			errors.Is(err, signalmeow.ErrInvalidPaddingForAttachment) {
+			reason = "the file failed integrity checks and may be corrupted or tampered with"
+		}
+		if msg.Filename != "" {
+			content.Body = fmt.Sprintf("Failed to bridge attachment %s: %s", msg.Filename, reason)
+		} else {
+			content.Body = fmt.Sprintf("Failed to bridge attachment: %s", reason)
+		}
+		if downloadErr != nil {
+			content.Body += " (the download will be retried automatically)"
+		}
+		content.Format = ""
+		content.FormattedBody = ""
+		content.FileName = ""
+		content.Info = nil
+	} else if err != nil {
 		failureMessage := "Failed to bridge media: "
 		if errors.Is(err, mautrix.MTooLarge) {
 			failureMessage = failureMessage + "homeserver rejected too large file"
@@ -1437,7 +2005,7 @@ func (portal *Portal) handleSignalAttachmentMessage(ctx context.Context, portalM
 		portal.log.Error().Err(err).Msg(failureMessage)
 		portal.MainIntent().SendNotice(portal.MXID, failureMessage)
 	}
-	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, content, nil, int64(timestamp))
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, content, extraContent, int64(timestamp))
 	if err != nil {
 		return err
 	}
@@ -1445,12 +2013,15 @@ func (portal *Portal) handleSignalAttachmentMessage(ctx context.Context, portalM
 		return errors.New("Didn't receive event ID from Matrix")
 	}
 	portal.storeMessageInDB(ctx, resp.EventID, portalMessage.sender.SignalID, timestamp, portalMessage.message.Base().PartIndex)
-	portal.addDisappearingMessage(ctx, resp.EventID, portalMessage.message.Base().ExpiresIn, portalMessage.sync)
+	portal.addDisappearingMessage(ctx, resp.EventID, portalMessage.message.Base().ExpiresIn, portalMessage.expirationStart())
+	if downloadErr != nil {
+		portal.bridge.mediaRetryManager.AddFailedAttachment(ctx, portal.MXID, resp.EventID, portalMessage.sender.SignalID, &mediaContent, msg.Attachment.Pointer, downloadErr)
+	}
 	return err
 }
 
 func (portal *Portal) handleSignalReactionMessage(ctx context.Context, portalMessage portalSignalMessage, intent *appservice.IntentAPI) {
-	msg := (portalMessage.message).(signalmeow.IncomingSignalMessageReaction)
+	msg := (portalMessage.message).(IncomingSignalMessageReaction)
 	matrixEmoji := variationselector.Add(msg.Emoji) // Add variation selector for Matrix
 
 	log := zerolog.Ctx(ctx)
@@ -1508,7 +2079,7 @@ func (portal *Portal) handleSignalReactionMessage(ctx context.Context, portalMes
 			EventID: dbMessage.MXID,
 		},
 	}
-	resp, err := portal.sendMatrixReaction(intent, event.EventReaction, content, nil, 0)
+	resp, err := portal.sendMatrixReaction(intent, event.EventReaction, content, nil, int64(msg.Timestamp))
 	if err != nil {
 		portal.log.Err(err).Msgf("Failed to send reaction: %v", err)
 		return
@@ -1526,7 +2097,7 @@ func (portal *Portal) handleSignalReactionMessage(ctx context.Context, portalMes
 }
 
 func (portal *Portal) handleSignalDeleteMessage(ctx context.Context, portalMessage portalSignalMessage, intent *appservice.IntentAPI) {
-	msg := (portalMessage.message).(signalmeow.IncomingSignalMessageDelete)
+	msg := (portalMessage.message).(IncomingSignalMessageDelete)
 
 	senderUUID, err := uuid.Parse(msg.SenderUUID)
 	// TODO handle err
@@ -1588,6 +2159,123 @@ func (portal *Portal) encryptFileInPlace(data []byte, mimeType string) (string,
 	return "application/octet-stream", file
 }
 
+func (portal *Portal) downloadAndUploadSignalAttachment(intent *appservice.IntentAPI, attachment *signalmeow.IncomingAttachment, content *event.MessageEventContent) error {
+	if maxSize := portal.bridge.Config.Bridge.MaxMediaSize(); maxSize > 0 && int64(attachment.Size()) > maxSize {
+		return fmt.Errorf("%w (%.1f MB, limit is %d MB)", errMediaTooLarge, float64(attachment.Size())/1024/1024, portal.bridge.Config.Bridge.MaxMediaSizeMB)
+	}
+	file, err := attachment.Download(portal.bridge.Config.Bridge.MaxMediaSize())
+	if errors.Is(err, signalmeow.ErrAttachmentTooLarge) {
+		return fmt.Errorf("%w (%v)", errMediaTooLarge, err)
+	} else if err != nil {
+		return exerrors.NewDualError(errMediaDownloadFailed, err)
+	}
+	return portal.uploadMediaStreamToMatrix(intent, file, file.Size, content)
+}
+
+// uploadMediaStreamToMatrix is like uploadMediaToMatrix, but reads the file from a stream instead of
+// requiring it to be in memory. The file is closed once it has been uploaded. With async media, that's
+// after this returns, as the upload continues in the background.
+func (portal *Portal) uploadMediaStreamToMatrix(intent *appservice.IntentAPI, file io.ReadSeekCloser, size int64, content *event.MessageEventContent) error {
+	closeFile := true
+	defer func() {
+		if closeFile {
+			_ = file.Close()
+		}
+	}()
+	if content.Info.Width == 0 && content.Info.Height == 0 && strings.HasPrefix(content.Info.MimeType, "image/") {
+		cfg, _, _ := image.DecodeConfig(file)
+		content.Info.Width, content.Info.Height = cfg.Width, cfg.Height
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	// The HTTP client closes request bodies, but the file is closed here once the upload is done
+	body := io.NopCloser(file)
+	req := mautrix.ReqUploadMedia{
+		Content:       body,
+		ContentLength: size,
+		ContentType:   content.Info.MimeType,
+	}
+	var encryptedFile *event.EncryptedFileInfo
+	if portal.Encrypted {
+		encryptedFile = &event.EncryptedFileInfo{
+			EncryptedFile: *attachment.NewEncryptedFile(),
+		}
+		req.ContentType = "application/octet-stream"
+	}
+	var mxc id.ContentURI
+	if portal.bridge.Config.Homeserver.AsyncMedia {
+		if encryptedFile != nil {
+			// The hash has to be in the event before the upload finishes, so encrypt the file once just to hash it.
+			// AES-CTR with the same key and IV produces the same ciphertext again for the actual upload.
+			hashStream := encryptedFile.EncryptStream(body)
+			if _, err := io.Copy(io.Discard, hashStream); err != nil {
+				return err
+			} else if err = hashStream.Close(); err != nil {
+				return err
+			} else if _, err = file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			// Use a copy, so that the upload finishing doesn't write to the file info that's in the event
+			uploadFile := encryptedFile.EncryptedFile
+			req.Content = io.NopCloser(uploadFile.EncryptStream(body))
+		}
+		created, err := intent.CreateMXC()
+		if err != nil {
+			return err
+		}
+		req.MXC = created.ContentURI
+		req.UnstableUploadURL = created.UnstableUploadURL
+		closeFile = false
+		go func() {
+			defer file.Close()
+			_, err := intent.UploadMedia(req)
+			if err != nil {
+				portal.log.Err(err).Str("mxc", req.MXC.String()).Msg("Async upload of media failed")
+			}
+		}()
+		mxc = created.ContentURI
+	} else {
+		var encryptStream io.ReadCloser
+		if encryptedFile != nil {
+			// AES-CTR doesn't change the length of the data
+			encryptStream = encryptedFile.EncryptStream(body)
+			req.Content = io.NopCloser(encryptStream)
+		}
+		uploaded, err := intent.UploadMedia(req)
+		if err != nil {
+			return err
+		}
+		if encryptStream != nil {
+			// Closing the stream fills the hash in the encrypted file info
+			if err = encryptStream.Close(); err != nil {
+				return err
+			}
+		}
+		mxc = uploaded.ContentURI
+	}
+	if encryptedFile != nil {
+		encryptedFile.URL = mxc.CUString()
+		content.File = encryptedFile
+	} else {
+		content.URL = mxc.CUString()
+	}
+	content.Info.Size = int(size)
+
+	// This is a hack for bad clients like Element iOS that require a thumbnail (https://github.com/vector-im/element-ios/issues/4004)
+	if strings.HasPrefix(content.Info.MimeType, "image/") && content.Info.ThumbnailInfo == nil {
+		infoCopy := *content.Info
+		content.Info.ThumbnailInfo = &infoCopy
+		if content.File != nil {
+			content.Info.ThumbnailFile = encryptedFile
+		} else {
+			content.Info.ThumbnailURL = content.URL
+		}
+	}
+	return nil
+}
+
 func (portal *Portal) uploadMediaToMatrix(intent *appservice.IntentAPI, data []byte, content *event.MessageEventContent) error {
 	uploadMimeType, file := portal.encryptFileInPlace(data, content.Info.MimeType)
 
@@ -1722,6 +2410,13 @@ func (portal *Portal) CreateMatrixRoom(user *User, meta *any) error {
 		})
 	}
 
+	if portal.ExpirationTime > 0 {
+		initialState = append(initialState, &event.Event{
+			Type:    TypeDisappearingTimer,
+			Content: event.Content{Parsed: NewDisappearingTimerEventContent(uint32(portal.ExpirationTime))},
+		})
+	}
+
 	creationContent := make(map[string]interface{})
 	if !portal.bridge.Config.Bridge.FederateRooms {
 		creationContent["m.federate"] = false
@@ -1874,7 +2569,8 @@ func (portal *Portal) getBridgeInfoStateKey() string {
 
 // ** DisappearingPortal interface **
 func (portal *Portal) ScheduleDisappearing() {
-	portal.bridge.disappearingMessagesManager.ScheduleDisappearingForRoom(context.TODO(), portal.MXID)
+	// This is only called for double puppeted read receipts, which are bridged from Signal read syncs.
+	// Timers are started when the read sync is handled, as only it says which messages were read.
 }
 
 func (portal *Portal) HandleNewDisappearingMessageTime(newTimer uint32) {
@@ -1885,6 +2581,41 @@ func (portal *Portal) HandleNewDisappearingMessageTime(newTimer uint32) {
 	} else {
 		intent.SendNotice(portal.MXID, fmt.Sprintf("Disappearing messages set to %s", exfmt.Duration(time.Duration(newTimer)*time.Second)))
 	}
+	portal.updateDisappearingTimerState(newTimer)
+}
+
+func (portal *Portal) updateDisappearingTimerState(newTimer uint32) {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, TypeDisappearingTimer, "", NewDisappearingTimerEventContent(newTimer))
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to update disappearing timer state event")
+	}
+}
+
+// SetDisappearingTimer changes the disappearing message timer of the chat on Signal and updates the portal to match.
+// It doesn't touch the Matrix room, as changes made with the state event are already visible there.
+func (portal *Portal) SetDisappearingTimer(ctx context.Context, sender *User, newTimer uint32) (sendErr error) {
+	if portal.IsPrivateChat() {
+		msg := signalmeow.DataMessageForExpireTimerUpdate(newTimer)
+		result := sender.Client.SendMessage(ctx, portal.ChatID, msg)
+		if !result.WasSuccessful {
+			return result.FailedSendResult.Error
+		}
+	} else {
+		sendErr = sender.Client.UpdateGroupDisappearingTimer(ctx, signalmeow.GroupIdentifier(portal.ChatID), newTimer)
+		if sendErr != nil && !errors.Is(sendErr, signalmeow.ErrGroupChangeNotSent) {
+			return sendErr
+		}
+		// If only notifying the members failed, the timer did change, so the portal is still updated
+	}
+	portal.ExpirationTime = int(newTimer)
+	err := portal.Update(ctx)
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to save new expiration time")
+	}
+	return sendErr
 }
 
 func (portal *Portal) HasRelaybot() bool {
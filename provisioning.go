@@ -65,6 +65,8 @@ func (prov *ProvisioningAPI) Init() {
 	r.HandleFunc("/v2/logout", prov.Logout).Methods(http.MethodPost)
 	r.HandleFunc("/v2/resolve_identifier/{phonenum}", prov.ResolveIdentifier).Methods(http.MethodGet)
 	r.HandleFunc("/v2/pm/{phonenum}", prov.StartPM).Methods(http.MethodPost)
+	r.HandleFunc("/v2/devices", prov.ListDevices).Methods(http.MethodGet)
+	r.HandleFunc("/v2/devices/{device_id}", prov.UnlinkDevice).Methods(http.MethodDelete)
 
 	if prov.bridge.Config.Bridge.Provisioning.DebugEndpoints {
 		prov.log.Debug().Msg("Enabling debug API at /debug")
@@ -170,11 +172,11 @@ func (prov *ProvisioningAPI) resolveIdentifier(user *User, phoneNum string) (int
 	if !strings.HasPrefix(phoneNum, "+") {
 		phoneNum = "+" + phoneNum
 	}
-	if user.SignalDevice == nil {
+	if user.Client == nil {
 		prov.log.Debug().Msgf("ResolveIdentifier from %v, no device found", user.MXID)
 		return http.StatusUnauthorized, nil, fmt.Errorf("Not currently connected to Signal")
 	}
-	contact, err := user.SignalDevice.ContactByE164(phoneNum)
+	contact, err := user.Client.Device.ContactByE164(phoneNum)
 	if err != nil {
 		prov.log.Err(err).Msgf("ResolveIdentifier from %v, error looking up contact", user.MXID)
 		return http.StatusInternalServerError, nil, fmt.Errorf("Error looking up number in local contact list: %w", err)
@@ -276,6 +278,99 @@ func (prov *ProvisioningAPI) StartPM(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ** Linked devices ** //
+
+type LinkedDevice struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Created  int64  `json:"created"`
+	LastSeen int64  `json:"last_seen"`
+	Primary  bool   `json:"primary"`
+	Current  bool   `json:"current"`
+}
+
+type ListDevicesResponse struct {
+	Success bool           `json:"success"`
+	Devices []LinkedDevice `json:"devices"`
+}
+
+func (prov *ProvisioningAPI) ListDevices(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	prov.log.Debug().Msgf("ListDevices from %v", user.MXID)
+	if !user.Client.IsDeviceLoggedIn() {
+		jsonResponse(w, http.StatusUnauthorized, Error{
+			Success: false,
+			Error:   "Not currently connected to Signal",
+			ErrCode: "M_FORBIDDEN",
+		})
+		return
+	}
+	devices, err := user.Client.Device.ListDevices(r.Context())
+	if err != nil {
+		prov.log.Err(err).Msgf("ListDevices from %v, error listing devices", user.MXID)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Success: false,
+			Error:   "Error listing devices",
+			ErrCode: "M_INTERNAL",
+		})
+		return
+	}
+	resp := ListDevicesResponse{Success: true, Devices: make([]LinkedDevice, len(devices))}
+	for i, device := range devices {
+		resp.Devices[i] = LinkedDevice{
+			ID:       device.ID,
+			Name:     device.Name,
+			Created:  device.Created.UnixMilli(),
+			LastSeen: device.LastSeen.UnixMilli(),
+			Primary:  device.ID == signalmeow.PrimaryDeviceID,
+			Current:  device.ID == user.Client.Device.Data.DeviceId,
+		}
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+func (prov *ProvisioningAPI) UnlinkDevice(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	deviceID, err := strconv.Atoi(mux.Vars(r)["device_id"])
+	prov.log.Debug().Msgf("UnlinkDevice from %v, device ID: %v", user.MXID, deviceID)
+	if err != nil || deviceID == signalmeow.PrimaryDeviceID {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Success: false,
+			Error:   "Invalid device ID",
+			ErrCode: "M_BAD_JSON",
+		})
+		return
+	} else if !user.Client.IsDeviceLoggedIn() {
+		jsonResponse(w, http.StatusUnauthorized, Error{
+			Success: false,
+			Error:   "Not currently connected to Signal",
+			ErrCode: "M_FORBIDDEN",
+		})
+		return
+	}
+	err = user.Client.Device.UnlinkDevice(r.Context(), deviceID)
+	if errors.Is(err, signalmeow.ErrCantUnlinkOwnDevice) || errors.Is(err, signalmeow.ErrNotPrimaryDevice) {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Success: false,
+			Error:   err.Error(),
+			ErrCode: "M_FORBIDDEN",
+		})
+		return
+	} else if err != nil {
+		prov.log.Err(err).Msgf("UnlinkDevice from %v, error unlinking device", user.MXID)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Success: false,
+			Error:   "Error unlinking device",
+			ErrCode: "M_INTERNAL",
+		})
+		return
+	}
+	jsonResponse(w, http.StatusOK, Response{
+		Success: true,
+		Status:  "unlinked",
+	})
+}
+
 // ** Provisioning session creation and management ** //
 
 func (prov *ProvisioningAPI) mutexForUser(user *User) *sync.Mutex {
@@ -0,0 +1,343 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// signalEventMessages converts an event from signalmeow into the messages that portals bridge.
+// Events that the bridge doesn't handle produce no messages.
+func (user *User) signalEventMessages(ctx context.Context, rawEvt any) []IncomingSignalMessage {
+	switch evt := rawEvt.(type) {
+	case *events.Message:
+		if !user.hasSignalChat(ctx, evt.Info) {
+			return nil
+		}
+		return user.dataMessageParts(ctx, user.signalMessageBase(evt.Info), evt.Message)
+	case *events.Reaction:
+		if !user.hasSignalChat(ctx, evt.Info) {
+			return nil
+		}
+		return []IncomingSignalMessage{IncomingSignalMessageReaction{
+			IncomingSignalMessageBase: user.signalMessageBase(evt.Info),
+			Emoji:                     evt.Reaction.GetEmoji(),
+			Remove:                    evt.Reaction.GetRemove(),
+			// make sure target author UUID is lowercase
+			TargetAuthorUUID:       strings.ToLower(evt.Reaction.GetTargetAuthorAci()),
+			TargetMessageTimestamp: evt.Reaction.GetTargetSentTimestamp(),
+		}}
+	case *events.Delete:
+		if !user.hasSignalChat(ctx, evt.Info) {
+			return nil
+		}
+		return []IncomingSignalMessage{IncomingSignalMessageDelete{
+			IncomingSignalMessageBase: user.signalMessageBase(evt.Info),
+			TargetMessageTimestamp:    evt.Delete.GetTargetSentTimestamp(),
+		}}
+	case *events.DisappearingTimer:
+		if !user.hasSignalChat(ctx, evt.Info) {
+			return nil
+		}
+		return []IncomingSignalMessage{IncomingSignalMessageExpireTimerChange{
+			IncomingSignalMessageBase: user.signalMessageBase(evt.Info),
+			NewExpireTimer:            evt.Timer,
+		}}
+	case *events.Typing:
+		return []IncomingSignalMessage{IncomingSignalMessageTyping{
+			IncomingSignalMessageBase: user.signalMessageBase(evt.Info),
+			IsTyping:                  evt.Typing.GetAction() == signalpb.TypingMessage_STARTED,
+		}}
+	case *events.Call:
+		return user.callMessages(evt)
+	case *events.Receipt:
+		return user.receiptMessages(ctx, evt)
+	case *events.ReadSelf:
+		// Model each read message as a read receipt from ourselves
+		timestamp := uint64(time.Now().UnixMilli())
+		messages := make([]IncomingSignalMessage, 0, len(evt.Messages))
+		for _, read := range evt.Messages {
+			messages = append(messages, IncomingSignalMessageReceipt{
+				IncomingSignalMessageBase: IncomingSignalMessageBase{
+					SenderUUID:    user.SignalID.String(),
+					RecipientUUID: user.SignalID.String(),
+					Timestamp:     timestamp, // there is no timestamp on a read sync
+				},
+				ReceiptType:       IncomingSignalMessageReceiptTypeRead,
+				OriginalTimestamp: read.GetTimestamp(),
+				OriginalSender:    read.GetSenderAci(),
+			})
+		}
+		return messages
+	case *events.GroupChange:
+		// The whole group is synced, since only the new state is known
+		return []IncomingSignalMessage{&IncomingSignalMessageGroupChange{
+			IncomingSignalMessageBase: user.signalMessageBase(evt.Info),
+		}}
+	case *events.GroupRevision:
+		return []IncomingSignalMessage{&IncomingSignalMessageGroupChange{
+			IncomingSignalMessageBase: user.signalMessageBase(evt.Info),
+			Change:                    evt,
+		}}
+	case *events.ContactChange:
+		return user.contactChangeMessages(evt)
+	}
+	return nil
+}
+
+// hasSignalChat returns false for messages sent from our other devices that don't say where they were sent.
+func (user *User) hasSignalChat(ctx context.Context, info events.MessageInfo) bool {
+	if info.Chat == "" {
+		zerolog.Ctx(ctx).Warn().Uint64("timestamp", info.Timestamp).Msg("Ignoring sync message without destination")
+		return false
+	}
+	return true
+}
+
+// signalMessageBase creates the base of a message from the info of an event. For messages we sent
+// from another device, the recipient is the chat the message was sent to.
+func (user *User) signalMessageBase(info events.MessageInfo) IncomingSignalMessageBase {
+	base := IncomingSignalMessageBase{
+		SenderUUID:    info.Sender.String(),
+		RecipientUUID: user.SignalID.String(),
+		Timestamp:     info.Timestamp,
+	}
+	if info.Sender == user.SignalID {
+		base.RecipientUUID = info.Chat
+	}
+	if info.IsGroup {
+		gid := signalmeow.GroupIdentifier(info.Chat)
+		base.GroupID = &gid
+	}
+	return base
+}
+
+// dataMessageParts splits a message into its parts. Multiple attachments form an album,
+// each attachment is a separate part of the same logical message.
+func (user *User) dataMessageParts(ctx context.Context, base IncomingSignalMessageBase, dataMessage *signalpb.DataMessage) []IncomingSignalMessage {
+	log := zerolog.Ctx(ctx)
+	var parts []IncomingSignalMessage
+
+	// Grab quote (reply) info if it exists
+	if dataMessage.Quote != nil {
+		base.Quote = &IncomingSignalMessageQuoteData{
+			QuotedSender:    dataMessage.GetQuote().GetAuthorAci(),
+			QuotedTimestamp: dataMessage.GetQuote().GetId(),
+		}
+	}
+	// If this message is disappearing, set ExpiresIn
+	base.ExpiresIn = int64(dataMessage.GetExpireTimer())
+	nextPart := func() IncomingSignalMessageBase {
+		partBase := base
+		partBase.PartIndex = len(parts)
+		return partBase
+	}
+
+	captionInMessage := user.bridge.Config.Bridge.CaptionInMessage
+	captionSent := false
+	albumSize := len(dataMessage.GetAttachments())
+	for index, attachmentPointer := range dataMessage.GetAttachments() {
+		// Attachments are downloaded lazily by the portal to avoid holding large files in memory
+		part := IncomingSignalMessageAttachment{
+			IncomingSignalMessageBase: nextPart(),
+			Attachment:                user.Client.NewIncomingAttachment(attachmentPointer),
+			Filename:                  attachmentPointer.GetFileName(),
+			ContentType:               attachmentPointer.GetContentType(),
+			Size:                      uint64(attachmentPointer.GetSize()),
+			Width:                     attachmentPointer.GetWidth(),
+			Height:                    attachmentPointer.GetHeight(),
+			BlurHash:                  attachmentPointer.GetBlurHash(),
+			AlbumIndex:                index,
+			AlbumSize:                 albumSize,
+		}
+		// The caption belongs to the whole album, so only send it once with the first part
+		if captionInMessage && !captionSent {
+			part.Caption = dataMessage.GetBody()
+			part.CaptionRanges = dataMessage.GetBodyRanges()
+			captionSent = true
+		}
+		parts = append(parts, part)
+	}
+
+	// If there's a body but no attachment to carry it as a caption, pass along as a text message
+	if dataMessage.Body != nil && !captionSent {
+		parts = append(parts, IncomingSignalMessageText{
+			IncomingSignalMessageBase: nextPart(),
+			Content:                   dataMessage.GetBody(),
+			ContentRanges:             dataMessage.GetBodyRanges(),
+		})
+	}
+
+	// if a sticker and has data, send it
+	if stickerData := dataMessage.GetSticker().GetData(); stickerData != nil {
+		sticker, err := user.Client.DownloadAttachment(ctx, stickerData)
+		if err != nil {
+			log.Err(err).Msg("Failed to download sticker")
+		} else {
+			parts = append(parts, IncomingSignalMessageSticker{
+				IncomingSignalMessageBase: nextPart(),
+				Width:                     stickerData.GetWidth(),
+				Height:                    stickerData.GetHeight(),
+				ContentType:               stickerData.GetContentType(),
+				Filename:                  stickerData.GetFileName(),
+				Sticker:                   sticker,
+				Emoji:                     dataMessage.GetSticker().GetEmoji(),
+			})
+		}
+	}
+
+	// If there's a contact card share, pass it along
+	for _, contactCard := range dataMessage.GetContact() {
+		part := contactCardMessage(contactCard)
+		part.IncomingSignalMessageBase = nextPart()
+		part.Quote = nil
+		part.ExpiresIn = 0
+		if avatarPointer := contactCard.GetAvatar().GetAvatar(); avatarPointer != nil {
+			avatar, err := user.Client.DownloadAttachment(ctx, avatarPointer)
+			if err != nil {
+				log.Err(err).Msg("Failed to download contact card avatar")
+			} else {
+				part.Avatar = avatar
+				part.AvatarContentType = avatarPointer.GetContentType()
+			}
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+func contactCardMessage(contactCard *signalpb.DataMessage_Contact) IncomingSignalMessageContactCard {
+	msg := IncomingSignalMessageContactCard{
+		DisplayName:  contactCard.GetName().GetDisplayName(),
+		Organization: contactCard.GetOrganization(),
+		Contact:      contactCard,
+		PhoneNumbers: make([]string, 0),
+		Emails:       make([]string, 0),
+		Addresses:    make([]string, 0),
+	}
+	for _, phone := range contactCard.GetNumber() {
+		msg.PhoneNumbers = append(msg.PhoneNumbers, phone.GetValue())
+	}
+	for _, email := range contactCard.GetEmail() {
+		msg.Emails = append(msg.Emails, email.GetValue())
+	}
+	for _, address := range contactCard.GetAddress() {
+		addressParts := make([]string, 0)
+		if address.Pobox != nil {
+			addressParts = append(addressParts, "P.O. Box: "+address.GetPobox())
+		}
+		for _, part := range []*string{address.Street, address.Neighborhood, address.City, address.Region, address.Postcode, address.Country} {
+			if part != nil {
+				addressParts = append(addressParts, *part)
+			}
+		}
+		msg.Addresses = append(msg.Addresses, strings.Join(addressParts, ", "))
+	}
+	return msg
+}
+
+// callMessages converts call events. Group calls only tell us that something happened in the call,
+// so whether they're ringing is inferred from the call ID. Private calls are only bridged when
+// they start or end (group call is an opaque callMessage and a groupCallUpdate in a dataMessage).
+func (user *User) callMessages(evt *events.Call) []IncomingSignalMessage {
+	base := user.signalMessageBase(evt.Info)
+	if evt.GroupCallUpdate != nil {
+		if base.GroupID == nil {
+			return nil
+		}
+		return []IncomingSignalMessage{IncomingSignalMessageCall{
+			IncomingSignalMessageBase: base,
+			IsRinging:                 user.Client.Device.UpdateActiveCalls(*base.GroupID, evt.GroupCallUpdate.GetEraId()),
+		}}
+	} else if evt.CallMessage.GetOffer() == nil && evt.CallMessage.GetHangup() == nil {
+		return nil
+	}
+	base.Timestamp = uint64(time.Now().UnixMilli()) // there is no timestamp on a callMessage
+	return []IncomingSignalMessage{IncomingSignalMessageCall{
+		IncomingSignalMessageBase: base,
+		IsRinging:                 evt.CallMessage.GetOffer() != nil,
+	}}
+}
+
+// receiptMessages converts a receipt into one message for each timestamp, so they can be sent to different portals if necessary.
+func (user *User) receiptMessages(ctx context.Context, evt *events.Receipt) []IncomingSignalMessage {
+	var receiptType IncomingSignalMessageReceiptType
+	switch evt.GetType() {
+	case signalpb.ReceiptMessage_READ:
+		receiptType = IncomingSignalMessageReceiptTypeRead
+	case signalpb.ReceiptMessage_DELIVERY:
+		// If this is a delivery receipt from one of our other devices, ignore it
+		if evt.Sender == user.SignalID {
+			return nil
+		}
+		receiptType = IncomingSignalMessageReceiptTypeDelivery
+	default:
+		zerolog.Ctx(ctx).Debug().Stringer("receipt_type", evt.GetType()).Msg("Ignoring unsupported receipt type")
+		return nil
+	}
+	timestamp := uint64(time.Now().UnixMilli())
+	messages := make([]IncomingSignalMessage, 0, len(evt.Timestamp))
+	for _, originalTimestamp := range evt.Timestamp {
+		messages = append(messages, IncomingSignalMessageReceipt{
+			IncomingSignalMessageBase: IncomingSignalMessageBase{
+				SenderUUID:    evt.Sender.String(),
+				RecipientUUID: user.SignalID.String(),
+				Timestamp:     timestamp, // there is no timestamp on a receiptMessage
+			},
+			ReceiptType:       receiptType,
+			OriginalTimestamp: originalTimestamp,
+			OriginalSender:    user.SignalID.String(), // this is a receipt for a message we sent
+		})
+	}
+	return messages
+}
+
+// contactChangeMessages models a contact from a contact sync as an incoming contact change message.
+// The avatar is only included if it's different from the one the puppet has.
+func (user *User) contactChangeMessages(evt *events.ContactChange) []IncomingSignalMessage {
+	contactID, err := uuid.Parse(evt.Contact.GetAci())
+	if err != nil {
+		return nil
+	}
+	msg := IncomingSignalMessageContactChange{
+		IncomingSignalMessageBase: IncomingSignalMessageBase{
+			SenderUUID:    contactID.String(),
+			RecipientUUID: user.SignalID.String(),
+			Timestamp:     uint64(time.Now().UnixMilli()),
+		},
+		Contact: evt.Contact,
+	}
+	if len(evt.Avatar) > 0 {
+		hash := sha256.Sum256(evt.Avatar)
+		puppet := user.bridge.GetPuppetBySignalID(contactID)
+		if puppet == nil || puppet.AvatarHash != hex.EncodeToString(hash[:]) {
+			msg.Avatar = signalmeow.NewContactAvatar(evt.Contact, evt.Avatar)
+		}
+	}
+	return []IncomingSignalMessage{msg}
+}
@@ -0,0 +1,186 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+)
+
+const (
+	// Signal clients hide the typing indicator if it isn't refreshed within SignalTypingTimeout
+	outgoingTypingRefreshInterval = 10 * time.Second
+	// If Matrix doesn't say anything for this long, assume the user stopped typing
+	outgoingTypingTimeout = 60 * time.Second
+	// Typing notifications to a chat are sent at most this often. In groups, every notification is sent
+	// to every member separately, so flapping typing state would otherwise cause a lot of sends.
+	outgoingTypingMinInterval = 3 * time.Second
+)
+
+// outgoingTyping tracks the typing state of one Matrix user in a portal and sends it to Signal,
+// refreshing it while the user keeps typing and rate limiting changes.
+type outgoingTyping struct {
+	portal *Portal
+	user   *User
+
+	lock sync.Mutex
+	// typing is the state according to Matrix, which expires at expires
+	typing  bool
+	expires time.Time
+	// sentTyping is the state that was last sent to Signal at lastSent
+	sentTyping bool
+	lastSent   time.Time
+	timer      *time.Timer
+
+	// Sends happen one at a time in the order they were decided, so a stop can't overtake the start before it.
+	// pendingSend is the next state to send and sending is true while sendLoop is running.
+	pendingSend    bool
+	hasPendingSend bool
+	sending        bool
+	sendFunc       func(isTyping bool)
+}
+
+// getOutgoingTyping must be called with currentlyTypingLock held.
+func (portal *Portal) getOutgoingTyping(user *User) *outgoingTyping {
+	if portal.outgoingTyping == nil {
+		portal.outgoingTyping = make(map[id.UserID]*outgoingTyping)
+	}
+	ot, ok := portal.outgoingTyping[user.MXID]
+	if !ok {
+		ot = &outgoingTyping{portal: portal, user: user}
+		ot.sendFunc = ot.send
+		portal.outgoingTyping[user.MXID] = ot
+	}
+	return ot
+}
+
+func (ot *outgoingTyping) set(typing bool) {
+	ot.lock.Lock()
+	defer ot.lock.Unlock()
+	ot.typing = typing
+	if typing {
+		ot.expires = time.Now().Add(outgoingTypingTimeout)
+	}
+	ot.update()
+}
+
+func (ot *outgoingTyping) onTimer() {
+	ot.lock.Lock()
+	defer ot.lock.Unlock()
+	ot.update()
+}
+
+// update sends the current state to Signal if necessary and schedules the next check.
+// It must be called with the lock held.
+func (ot *outgoingTyping) update() {
+	send, next := ot.check(time.Now())
+	if send {
+		ot.queueSend(ot.sentTyping)
+	}
+	if ot.timer != nil {
+		ot.timer.Stop()
+		ot.timer = nil
+	}
+	if next > 0 {
+		ot.timer = time.AfterFunc(next, ot.onTimer)
+	}
+}
+
+// check decides whether the state should be sent to Signal now and when to check again (zero means not needed).
+// If it should be sent, the sent state is updated. It must be called with the lock held.
+func (ot *outgoingTyping) check(now time.Time) (send bool, next time.Duration) {
+	if ot.typing && !now.Before(ot.expires) {
+		ot.typing = false
+	}
+	needsSend := ot.typing != ot.sentTyping || (ot.typing && now.Sub(ot.lastSent) >= outgoingTypingRefreshInterval)
+	if wait := outgoingTypingMinInterval - now.Sub(ot.lastSent); needsSend && wait > 0 {
+		// Check again once sending is allowed, the state may have changed back by then
+		return false, wait
+	}
+	if needsSend {
+		ot.sentTyping = ot.typing
+		ot.lastSent = now
+	}
+	if ot.typing {
+		next = ot.lastSent.Add(outgoingTypingRefreshInterval).Sub(now)
+		if untilExpiry := ot.expires.Sub(now); untilExpiry < next {
+			next = untilExpiry
+		}
+	}
+	return needsSend, next
+}
+
+// queueSend makes sendLoop send the given state after any send that's in progress.
+// It must be called with the lock held.
+func (ot *outgoingTyping) queueSend(isTyping bool) {
+	ot.pendingSend = isTyping
+	ot.hasPendingSend = true
+	if !ot.sending {
+		ot.sending = true
+		go ot.sendLoop()
+	}
+}
+
+func (ot *outgoingTyping) sendLoop() {
+	for {
+		ot.lock.Lock()
+		if !ot.hasPendingSend {
+			ot.sending = false
+			ot.lock.Unlock()
+			return
+		}
+		isTyping := ot.pendingSend
+		ot.hasPendingSend = false
+		ot.lock.Unlock()
+		ot.sendFunc(isTyping)
+	}
+}
+
+func (ot *outgoingTyping) send(isTyping bool) {
+	if !ot.user.IsLoggedIn() {
+		return
+	}
+	log := ot.portal.log.With().
+		Str("action", "send typing").
+		Str("user_id", ot.user.MXID.String()).
+		Bool("typing", isTyping).
+		Logger()
+	ctx, cancel := context.WithTimeout(log.WithContext(context.Background()), 30*time.Second)
+	defer cancel()
+	typingMessage := signalmeow.TypingMessage(isTyping)
+	if ot.portal.IsPrivateChat() {
+		result := ot.user.Client.SendMessage(ctx, ot.portal.ChatID, typingMessage)
+		if !result.WasSuccessful {
+			log.Err(result.FailedSendResult.Error).Msg("Failed to send typing notification to Signal")
+			return
+		}
+	} else {
+		result, err := ot.user.Client.SendGroupMessage(ctx, signalmeow.GroupIdentifier(ot.portal.ChatID), typingMessage)
+		if err != nil {
+			log.Err(err).Msg("Failed to send typing notification to Signal group")
+			return
+		} else if len(result.FailedToSendTo) > 0 {
+			log.Debug().Int("failed_count", len(result.FailedToSendTo)).Msg("Failed to send typing notification to some group members")
+		}
+	}
+	log.Debug().Msg("Sent typing notification to Signal")
+}
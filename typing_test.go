@@ -0,0 +1,137 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setTestTyping(ot *outgoingTyping, typing bool, now time.Time) {
+	ot.typing = typing
+	if typing {
+		ot.expires = now.Add(outgoingTypingTimeout)
+	}
+}
+
+func TestOutgoingTypingMinInterval(t *testing.T) {
+	var ot outgoingTyping
+	start := time.Now()
+
+	setTestTyping(&ot, true, start)
+	send, next := ot.check(start)
+	assert.True(t, send)
+	assert.True(t, ot.sentTyping)
+	assert.Equal(t, outgoingTypingRefreshInterval, next)
+
+	// Stopping right after starting has to wait for the minimum interval
+	setTestTyping(&ot, false, start.Add(time.Second))
+	send, next = ot.check(start.Add(time.Second))
+	assert.False(t, send)
+	assert.Equal(t, outgoingTypingMinInterval-time.Second, next)
+
+	send, next = ot.check(start.Add(outgoingTypingMinInterval))
+	assert.True(t, send)
+	assert.False(t, ot.sentTyping)
+	assert.Zero(t, next, "no checks are needed when not typing")
+
+	// Flapping back to the state that was already sent doesn't need a send
+	setTestTyping(&ot, true, start.Add(outgoingTypingMinInterval+time.Second))
+	setTestTyping(&ot, false, start.Add(outgoingTypingMinInterval+time.Second))
+	send, next = ot.check(start.Add(outgoingTypingMinInterval + time.Second))
+	assert.False(t, send)
+	assert.Zero(t, next)
+}
+
+func TestOutgoingTypingRefresh(t *testing.T) {
+	var ot outgoingTyping
+	start := time.Now()
+	setTestTyping(&ot, true, start)
+	send, _ := ot.check(start)
+	require.True(t, send)
+
+	send, next := ot.check(start.Add(outgoingTypingRefreshInterval / 2))
+	assert.False(t, send)
+	assert.Equal(t, outgoingTypingRefreshInterval/2, next)
+
+	send, next = ot.check(start.Add(outgoingTypingRefreshInterval))
+	assert.True(t, send, "typing should be refreshed before Signal clients hide it")
+	assert.True(t, ot.sentTyping)
+	assert.Equal(t, outgoingTypingRefreshInterval, next)
+}
+
+func TestOutgoingTypingTimeout(t *testing.T) {
+	var ot outgoingTyping
+	start := time.Now()
+	setTestTyping(&ot, true, start)
+	ot.expires = start.Add(outgoingTypingRefreshInterval + 5*time.Second)
+	send, _ := ot.check(start)
+	require.True(t, send)
+
+	send, next := ot.check(start.Add(outgoingTypingRefreshInterval))
+	assert.True(t, send)
+	assert.Equal(t, 5*time.Second, next, "the next check should happen when the typing state expires")
+
+	send, next = ot.check(start.Add(outgoingTypingRefreshInterval + 5*time.Second))
+	assert.True(t, send, "expired typing should be stopped on Signal")
+	assert.False(t, ot.typing)
+	assert.False(t, ot.sentTyping)
+	assert.Zero(t, next)
+}
+
+func TestOutgoingTypingSendsInOrder(t *testing.T) {
+	var sentLock sync.Mutex
+	var sent []bool
+	firstStarted := make(chan struct{})
+	release := make(chan struct{})
+	ot := &outgoingTyping{}
+	ot.sendFunc = func(isTyping bool) {
+		sentLock.Lock()
+		sent = append(sent, isTyping)
+		first := len(sent) == 1
+		sentLock.Unlock()
+		if first {
+			close(firstStarted)
+			<-release
+		}
+	}
+
+	ot.lock.Lock()
+	ot.queueSend(true)
+	ot.lock.Unlock()
+	<-firstStarted
+	// While the start is being sent, the state changes a few times and only the latest one is sent after it
+	ot.lock.Lock()
+	ot.queueSend(false)
+	ot.queueSend(true)
+	ot.queueSend(false)
+	ot.lock.Unlock()
+	close(release)
+
+	require.Eventually(t, func() bool {
+		ot.lock.Lock()
+		defer ot.lock.Unlock()
+		return !ot.sending
+	}, 5*time.Second, 10*time.Millisecond)
+	sentLock.Lock()
+	defer sentLock.Unlock()
+	assert.Equal(t, []bool{true, false}, sent)
+}
@@ -57,7 +57,7 @@ type User struct {
 	Admin           bool
 	PermissionLevel bridgeconfig.PermissionLevel
 
-	SignalDevice *signalmeow.Device
+	Client *signalmeow.Client
 
 	BridgeState     *bridge.BridgeStateQueue
 	bridgeStateLock sync.Mutex
@@ -76,7 +76,7 @@ func (user *User) IsLoggedIn() bool {
 	user.Lock()
 	defer user.Unlock()
 
-	return user.SignalDevice.IsDeviceLoggedIn()
+	return user.Client.IsDeviceLoggedIn()
 }
 
 func (user *User) GetManagementRoomID() id.RoomID {
@@ -259,7 +259,7 @@ func (user *User) syncChatDoublePuppetDetails(portal *Portal, justCreated bool)
 
 	// TODO: Get chat setting from Signal and sync them here
 	//if justCreated || !user.bridge.Config.Bridge.TagOnlyOnCreate {
-	//	chat, err := user.SignalDevice.Store.ChatSettings.GetChatSettings(portal.Key().ChatID)
+	//	chat, err := user.Client.Store.ChatSettings.GetChatSettings(portal.Key().ChatID)
 	//	if err != nil {
 	//		user.log.Warn().Err(err).Msgf("Failed to get settings of %s", portal.Key().ChatID)
 	//		return
@@ -321,12 +321,12 @@ func (br *SignalBridge) getAllLoggedInUsers() []*User {
 func (user *User) startupTryConnect(retryCount int) {
 	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
 
-	// Make sure user has the Signal device populated
-	user.populateSignalDevice()
+	// Make sure user has the Signal client populated
+	user.populateSignalClient()
 
 	user.log.Debug().Msg("Connecting to Signal")
 	ctx := context.Background()
-	statusChan, err := signalmeow.StartReceiveLoops(ctx, user.SignalDevice)
+	statusChan, err := user.Client.StartReceiveLoops(ctx)
 
 	if err != nil {
 		user.log.Error().Err(err).Msg("Error connecting on startup")
@@ -372,6 +372,8 @@ func (user *User) startupTryConnect(retryCount int) {
 			case signalmeow.SignalConnectionEventConnected:
 				user.log.Debug().Msg("Sending Connected BridgeState")
 				user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+				// Messages that failed to send while disconnected can be retried right away
+				go user.bridge.WakeOutboxes(context.TODO(), true)
 
 			case signalmeow.SignalConnectionEventDisconnected:
 				user.log.Debug().Msg("Received SignalConnectionEventDisconnected")
@@ -438,7 +440,7 @@ func (user *User) startupTryConnect(retryCount int) {
 				user.BridgeState.Send(status.BridgeState{StateEvent: status.StateUnknownError, Error: "unknown-websocket-error", Message: err.Error()})
 
 			case signalmeow.SignalConnectionCleanShutdown:
-				if user.SignalDevice.IsDeviceLoggedIn() {
+				if user.Client.IsDeviceLoggedIn() {
 					user.log.Debug().Msg("Clean Shutdown - sending no BridgeState")
 				} else {
 					user.log.Debug().Msg("Clean Shutdown, but logged out - Sending BadCredentials BridgeState")
@@ -452,7 +454,7 @@ func (user *User) startupTryConnect(retryCount int) {
 func (user *User) clearKeysAndDisconnect() {
 	// We need to clear out keys associated with the Signal device that no longer has valid credentials
 	user.log.Debug().Msg("Clearing out Signal device keys")
-	err := user.SignalDevice.ClearKeysAndDisconnect()
+	err := user.Client.Device.ClearKeysAndDisconnect()
 	if err != nil {
 		user.log.Err(err).Msg("Error clearing device keys")
 	}
@@ -464,8 +466,8 @@ func (br *SignalBridge) StartUsers() {
 	usersWithToken := br.getAllLoggedInUsers()
 	numUsersStarting := 0
 	for _, u := range usersWithToken {
-		device := u.populateSignalDevice()
-		if device == nil || !device.IsDeviceLoggedIn() {
+		client := u.populateSignalClient()
+		if client == nil || !client.IsDeviceLoggedIn() {
 			br.ZLog.Warn().Str("user_id", u.MXID.String()).Msg("No device found for user, skipping Connect and sending BadCredentials BridgeState")
 			u.BridgeState.Send(status.BridgeState{StateEvent: status.StateBadCredentials, Message: "You have been logged out of Signal, please reconnect"})
 			continue
@@ -493,7 +495,7 @@ func (user *User) Login() (<-chan signalmeow.ProvisioningResponse, error) {
 	user.Lock()
 	defer user.Unlock()
 
-	provChan := signalmeow.PerformProvisioning(context.TODO(), user.bridge.MeowStore, user.bridge.Config.Signal.DeviceName)
+	provChan := signalmeow.PerformProvisioning(user.log.WithContext(context.TODO()), user.bridge.WebClient.WithLogger(user.log.With().Str("component", "signalmeow/web").Logger()), user.bridge.MeowStore, user.bridge.Config.Signal.DeviceName)
 
 	return provChan, nil
 }
@@ -502,7 +504,7 @@ func (user *User) Connect() {
 	user.startupTryConnect(0)
 }
 
-func (user *User) populateSignalDevice() *signalmeow.Device {
+func (user *User) populateSignalClient() *signalmeow.Client {
 	user.Lock()
 	defer user.Unlock()
 
@@ -520,13 +522,15 @@ func (user *User) populateSignalDevice() *signalmeow.Device {
 		return nil
 	}
 
-	user.SignalDevice = device
-	device.Connection.IncomingSignalMessageHandler = user.incomingMessageHandler
-	return device
+	user.Client = signalmeow.NewClient(device, user.log.With().Str("component", "signalmeow").Logger(), user.bridge.WebClient, user.bridge.Metrics)
+	device.AddEventHandlerWithSuccessStatus(user.handleSignalEvent)
+	device.Connection.NewOwnDeviceHandler = user.handleNewOwnDevice
+	device.Connection.CaptchaRequiredHandler = user.handleCaptchaRequired
+	return user.Client
 }
 
 func updatePuppetWithSignalContact(ctx context.Context, user *User, puppet *Puppet, newContactAvatar *signalmeow.ContactAvatar) error {
-	contact, newProfileAvatar, err := user.SignalDevice.ContactByIDWithProfileAvatar(puppet.SignalID.String())
+	contact, newProfileAvatar, err := user.Client.Device.ContactByIDWithProfileAvatar(puppet.SignalID.String())
 	if err != nil {
 		user.log.Err(err).Msg("updatePuppetWithSignalContact: error retrieving contact")
 		return err
@@ -619,7 +623,7 @@ func ensureGroupPuppetsAreJoinedToPortal(ctx context.Context, user *User, portal
 		return nil
 	}
 	user.log.Info().Msgf("Ensuring everyone is joined to room %s, groupID: %s", portal.MXID, portal.ChatID)
-	group, err := signalmeow.RetrieveGroupByID(ctx, user.SignalDevice, signalmeow.GroupIdentifier(portal.ChatID))
+	group, err := user.Client.RetrieveGroupByID(ctx, signalmeow.GroupIdentifier(portal.ChatID))
 	if err != nil {
 		user.log.Err(err).Msg("error retrieving group")
 		return err
@@ -647,7 +651,20 @@ func ensureGroupPuppetsAreJoinedToPortal(ctx context.Context, user *User, portal
 	return nil
 }
 
-func (user *User) incomingMessageHandler(incomingMessage signalmeow.IncomingSignalMessage) error {
+// handleSignalEvent receives the events of the Signal client and bridges them. Returning false makes
+// signalmeow keep the message in its inbox and deliver the event again later.
+func (user *User) handleSignalEvent(rawEvt any) bool {
+	ctx := user.log.WithContext(context.TODO())
+	for _, incomingMessage := range user.signalEventMessages(ctx, rawEvt) {
+		if err := user.incomingMessageHandler(incomingMessage); err != nil {
+			user.log.Err(err).Msgf("Failed to handle %T from Signal", rawEvt)
+			return false
+		}
+	}
+	return true
+}
+
+func (user *User) incomingMessageHandler(incomingMessage IncomingSignalMessage) error {
 	// Handle things common to all message types
 	m := incomingMessage.Base()
 	var chatID string
@@ -687,8 +704,8 @@ func (user *User) incomingMessageHandler(incomingMessage signalmeow.IncomingSign
 		// If this is a contact change, it might have a new contact avatar, and if it does
 		// we'll need to pull it out there, since we can't get it any other time
 		var newAvatar *signalmeow.ContactAvatar
-		if incomingMessage.MessageType() == signalmeow.IncomingSignalMessageTypeContactChange {
-			contactChangeMessage := incomingMessage.(signalmeow.IncomingSignalMessageContactChange)
+		if incomingMessage.MessageType() == IncomingSignalMessageTypeContactChange {
+			contactChangeMessage := incomingMessage.(IncomingSignalMessageContactChange)
 			newAvatar = contactChangeMessage.Avatar
 		}
 
@@ -702,8 +719,8 @@ func (user *User) incomingMessageHandler(incomingMessage signalmeow.IncomingSign
 	}
 
 	// If this is a receipt, the chatID/portal is the room where the message was read
-	if incomingMessage.MessageType() == signalmeow.IncomingSignalMessageTypeReceipt {
-		receiptMessage := incomingMessage.(signalmeow.IncomingSignalMessageReceipt)
+	if incomingMessage.MessageType() == IncomingSignalMessageTypeReceipt {
+		receiptMessage := incomingMessage.(IncomingSignalMessageReceipt)
 		timestamp := receiptMessage.OriginalTimestamp
 		sender, err := uuid.Parse(receiptMessage.OriginalSender)
 		if err != nil {
@@ -730,8 +747,8 @@ func (user *User) incomingMessageHandler(incomingMessage signalmeow.IncomingSign
 	}
 
 	// If this is an expireTimer change, update the portal and return (only for DMs, group expireTimer changes are handled below)
-	if incomingMessage.MessageType() == signalmeow.IncomingSignalMessageTypeExpireTimerChange {
-		expireTimerMessage := incomingMessage.(signalmeow.IncomingSignalMessageExpireTimerChange)
+	if incomingMessage.MessageType() == IncomingSignalMessageTypeExpireTimerChange {
+		expireTimerMessage := incomingMessage.(IncomingSignalMessageExpireTimerChange)
 		portal.log.Debug().Msgf("Updating expiration time to %d (DM)", expireTimerMessage.NewExpireTimer)
 		if portal.ExpirationTime != int(expireTimerMessage.NewExpireTimer) {
 			portal.ExpirationTime = int(expireTimerMessage.NewExpireTimer)
@@ -744,45 +761,61 @@ func (user *User) incomingMessageHandler(incomingMessage signalmeow.IncomingSign
 		return nil
 	}
 
+	// Group changes from the group change log are bridged one by one by the portal, so the whole group doesn't need to be synced
+	groupChange, isGroupRevision := incomingMessage.(*IncomingSignalMessageGroupChange)
+	isGroupRevision = isGroupRevision && groupChange.Change != nil && portal.MXID != "" && portal.Revision != 0
+
 	// Don't bother with portal updates for receipts or typing notifications
 	// (esp. read receipts - they don't have GroupID set so it breaks)
-	if !(incomingMessage.MessageType() == signalmeow.IncomingSignalMessageTypeReceipt || incomingMessage.MessageType() == signalmeow.IncomingSignalMessageTypeTyping) {
+	if !(incomingMessage.MessageType() == IncomingSignalMessageTypeReceipt || incomingMessage.MessageType() == IncomingSignalMessageTypeTyping || isGroupRevision) {
 		updatePortal := false
 		if m.GroupID != nil {
-			group, avatarImage, err := signalmeow.RetrieveGroupAndAvatarByID(context.Background(), user.SignalDevice, *m.GroupID)
+			group, err := user.Client.RetrieveGroupByID(context.Background(), *m.GroupID)
 			if err != nil {
 				user.log.Err(err).Msg("error retrieving group")
 				return err
 			}
-			if portal.Name != group.Title || portal.Topic != group.Description {
-				portal.Name = group.Title
-				portal.Topic = group.Description
-				updatePortal = true
-			}
-			if portal.ExpirationTime != int(group.DisappearingMessagesDuration) {
-				portal.ExpirationTime = int(group.DisappearingMessagesDuration)
-				updatePortal = true
-				portal.log.Debug().Msgf("Updating expiration time to %d (group)", group.DisappearingMessagesDuration)
-				portal.HandleNewDisappearingMessageTime(group.DisappearingMessagesDuration)
-			}
-			// avatarImage is only not nil if there's a new avatar to set
-			if avatarImage != nil {
-				user.log.Debug().Msg("Uploading new group avatar")
-				avatarURL, err := portal.MainIntent().UploadBytes(avatarImage, http.DetectContentType(avatarImage))
+			// The group info only needs to be synced if the group has changed since the last time
+			if portal.Revision == 0 || int(group.Revision) > portal.Revision {
+				_, avatarImage, err := user.Client.RetrieveGroupAndAvatarByID(context.Background(), *m.GroupID)
 				if err != nil {
-					user.log.Err(err).Msg("error uploading group avatar")
+					user.log.Err(err).Msg("error retrieving group avatar")
 					return err
 				}
-				portal.AvatarURL = avatarURL.ContentURI
-				portal.AvatarSet = true
-				hash := sha256.Sum256(avatarImage)
-				portal.AvatarHash = hex.EncodeToString(hash[:])
-				updatePortal = true
-			}
+				if portal.Revision != int(group.Revision) {
+					portal.Revision = int(group.Revision)
+					updatePortal = true
+				}
+				if portal.Name != group.Title || portal.Topic != group.Description {
+					portal.Name = group.Title
+					portal.Topic = group.Description
+					updatePortal = true
+				}
+				if portal.ExpirationTime != int(group.DisappearingMessagesDuration) {
+					portal.ExpirationTime = int(group.DisappearingMessagesDuration)
+					updatePortal = true
+					portal.log.Debug().Msgf("Updating expiration time to %d (group)", group.DisappearingMessagesDuration)
+					portal.HandleNewDisappearingMessageTime(group.DisappearingMessagesDuration)
+				}
+				// avatarImage is only not nil if there's a new avatar to set
+				if avatarImage != nil {
+					user.log.Debug().Msg("Uploading new group avatar")
+					avatarURL, err := portal.MainIntent().UploadBytes(avatarImage, http.DetectContentType(avatarImage))
+					if err != nil {
+						user.log.Err(err).Msg("error uploading group avatar")
+						return err
+					}
+					portal.AvatarURL = avatarURL.ContentURI
+					portal.AvatarSet = true
+					hash := sha256.Sum256(avatarImage)
+					portal.AvatarHash = hex.EncodeToString(hash[:])
+					updatePortal = true
+				}
 
-			// ensure everyone is invited to the group
-			portal.ensureUserInvited(user)
-			_ = ensureGroupPuppetsAreJoinedToPortal(context.Background(), user, portal)
+				// ensure everyone is invited to the group
+				portal.ensureUserInvited(user)
+				_ = ensureGroupPuppetsAreJoinedToPortal(context.Background(), user, portal)
+			}
 		} else if senderPuppet.SignalID != user.SignalID && senderPuppet.Name != portal.Name && portal.shouldSetDMRoomMetadata() {
 			portal.Name = senderPuppet.Name
 			updatePortal = true
@@ -808,23 +841,58 @@ func (user *User) incomingMessageHandler(incomingMessage signalmeow.IncomingSign
 			}
 			portal.UpdateBridgeInfo()
 		}
-		if incomingMessage.MessageType() == signalmeow.IncomingSignalMessageTypeGroupChange ||
-			incomingMessage.MessageType() == signalmeow.IncomingSignalMessageTypeContactChange {
+		if incomingMessage.MessageType() == IncomingSignalMessageTypeGroupChange ||
+			incomingMessage.MessageType() == IncomingSignalMessageTypeContactChange {
 			// This was just a group or contact change message, and we changed the group, so we're done
 			return nil
 		}
 	}
 
 	// We've updated puppets and portals, now send the message along to the portal
+	// and wait for it to be bridged, so that signalmeow only considers it handled if it actually was.
+	result := make(chan error, 1)
 	portalSignalMessage := portalSignalMessage{
 		user:    user,
 		sender:  senderPuppet,
 		message: incomingMessage,
 		sync:    isSyncMessage,
+		result:  result,
 	}
 	portal.signalMessages <- portalSignalMessage
 
-	return nil
+	return <-result
+}
+
+func (user *User) handleNewOwnDevice(deviceID int) {
+	user.log.Warn().Int("device_id", deviceID).Msg("New device linked to Signal account")
+	if user.ManagementRoom == "" {
+		return
+	}
+	_, err := user.bridge.Bot.SendNotice(user.ManagementRoom, fmt.Sprintf(
+		"Security alert: a new device (ID %d) appeared on your Signal account. "+
+			"If you didn't link it, check the list-devices command and remove the device from the Signal app on your phone.",
+		deviceID,
+	))
+	if err != nil {
+		user.log.Err(err).Msg("Failed to send new device notice to management room")
+	}
+}
+
+func (user *User) handleCaptchaRequired() {
+	user.log.Warn().Msg("Signal requires a captcha before sending more messages")
+	if user.ManagementRoom == "" {
+		return
+	}
+	_, err := user.bridge.Bot.SendNotice(user.ManagementRoom, fmt.Sprintf(
+		"Signal is rate limiting your account and requires a captcha before more messages can be sent. "+
+			"Messages will be queued until then.\n\n"+
+			"Solve the captcha at %s, copy the `signalcaptcha://` link from the \"Open Signal\" button "+
+			"and send it here as `submit-captcha <link>`.",
+		signalmeow.CaptchaURL,
+	))
+	if err != nil {
+		user.log.Err(err).Msg("Failed to send captcha notice to management room")
+	}
 }
 
 func (user *User) GetPortalByChatID(signalID string) *Portal {
@@ -835,15 +903,15 @@ func (user *User) GetPortalByChatID(signalID string) *Portal {
 	return user.bridge.GetPortalByChatID(pk)
 }
 
-func (user *User) disconnectNoLock() (*signalmeow.Device, error) {
-	if user.SignalDevice == nil {
+func (user *User) disconnectNoLock() (*signalmeow.Client, error) {
+	if user.Client == nil {
 		return nil, ErrNotConnected
 	}
 
-	disconnectedDevice := user.SignalDevice
-	err := signalmeow.StopReceiveLoops(user.SignalDevice)
-	user.SignalDevice = nil
-	return disconnectedDevice, err
+	disconnectedClient := user.Client
+	err := user.Client.StopReceiveLoops()
+	user.Client = nil
+	return disconnectedClient, err
 }
 func (user *User) Disconnect() error {
 	user.Lock()
@@ -858,7 +926,7 @@ func (user *User) Logout() error {
 	defer user.Unlock()
 	user.log.Info().Msg("Logging out of session")
 	loggedOutDevice, err := user.disconnectNoLock()
-	user.bridge.MeowStore.DeleteDevice(&loggedOutDevice.Data)
+	user.bridge.MeowStore.DeleteDevice(&loggedOutDevice.Device.Data)
 	user.bridge.GetPuppetByCustomMXID(user.MXID).ClearCustomMXID()
 	return err
 }